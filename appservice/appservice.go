@@ -64,20 +64,10 @@ func Load(path string) (*AppService, error) {
 	return config, yaml.Unmarshal(data, config)
 }
 
-// QueryHandler handles room alias and user ID queries from the homeserver.
-type QueryHandler interface {
-	QueryAlias(alias string) bool
-	QueryUser(userID id.UserID) bool
-}
-
-type QueryHandlerStub struct{}
-
-func (qh *QueryHandlerStub) QueryAlias(alias string) bool {
-	return false
-}
-
-func (qh *QueryHandlerStub) QueryUser(userID id.UserID) bool {
-	return false
+// CryptoHelper is an interface for encrypting outgoing events, e.g. a wrapper around crypto.OlmMachine
+// that shares group sessions when necessary.
+type CryptoHelper interface {
+	Encrypt(roomID id.RoomID, eventType event.Type, content interface{}) (*event.EncryptedEventContent, error)
 }
 
 type WebsocketHandler func(WebsocketCommand) (ok bool, data interface{})
@@ -101,6 +91,19 @@ type AppService struct {
 	OTKCounts    chan *mautrix.OTKCount    `yaml:"-"`
 	QueryHandler QueryHandler              `yaml:"-"`
 	StateStore   StateStore                `yaml:"-"`
+	// ProfileCache is an optional cache for global user profiles, e.g. mautrix.NewProfileCache(0). It's shared by
+	// all clients created by the appservice, so it must be set before any clients or intents are created.
+	ProfileCache *mautrix.ProfileCache `yaml:"-"`
+	// Crypto is an optional helper for encrypting events. If set, intents will encrypt
+	// message events sent to rooms that the state store reports as encrypted.
+	Crypto CryptoHelper `yaml:"-"`
+
+	eventMiddleware []EventMiddleware
+	// EventFilter is an optional filter for dropping uninteresting events before they're parsed.
+	EventFilter *EventFilter `yaml:"-"`
+
+	// ThirdPartyHandler handles third party network lookups. If nil, the lookup endpoints will always return 404.
+	ThirdPartyHandler ThirdPartyQueryHandler `yaml:"-"`
 
 	Router     *mux.Router `yaml:"-"`
 	UserAgent  string      `yaml:"-"`
@@ -109,6 +112,10 @@ type AppService struct {
 	botClient  *mautrix.Client
 	botIntent  *IntentAPI
 
+	// RateLimiter is an optional limiter shared by all clients created by the appservice.
+	// It must be set before any clients or intents are created.
+	RateLimiter *RateLimiter `yaml:"-"`
+
 	MessageSendCheckpointEndpoint string
 
 	DefaultHTTPRetries int
@@ -116,6 +123,24 @@ type AppService struct {
 	Live  bool
 	Ready bool
 
+	// EnableHealthEndpoints enables the /_health/live and /_health/ready endpoints.
+	EnableHealthEndpoints bool `yaml:"-"`
+	// EnableMetricsEndpoint enables the /metrics endpoint.
+	EnableMetricsEndpoint bool `yaml:"-"`
+	stats                 appserviceStats
+
+	// stopLock guards stopping and server.
+	stopping           bool
+	stopLock           sync.RWMutex
+	registerRoutesOnce sync.Once
+	inFlightTxns       sync.WaitGroup
+	eventProcessors    []*EventProcessor
+	processorsLock     sync.Mutex
+
+	registrationLock    sync.RWMutex
+	previousServerToken string
+	previousTokenExpiry time.Time
+
 	clients     map[id.UserID]*mautrix.Client
 	clientsLock sync.RWMutex
 	intents     map[id.UserID]*IntentAPI
@@ -149,17 +174,40 @@ func (as *AppService) PrepareWebsocket() {
 
 // HostConfig contains info about how to host the appservice.
 type HostConfig struct {
+	// Hostname is the host to listen on. If it starts with a slash, it's treated as a path to a unix socket.
 	Hostname string `yaml:"hostname"`
 	Port     uint16 `yaml:"port"`
 	TLSKey   string `yaml:"tls_key,omitempty"`
 	TLSCert  string `yaml:"tls_cert,omitempty"`
+
+	// PathPrefix is an optional prefix for all the HTTP endpoints, for serving the appservice behind a reverse proxy.
+	PathPrefix string `yaml:"path_prefix,omitempty"`
+	// MaxBodySize is the maximum size of request bodies in bytes. Zero means no limit.
+	MaxBodySize int64 `yaml:"max_body_size,omitempty"`
+
+	ReadTimeout  time.Duration `yaml:"read_timeout,omitempty"`
+	WriteTimeout time.Duration `yaml:"write_timeout,omitempty"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout,omitempty"`
 }
 
 // Address gets the whole address of the Appservice.
 func (hc *HostConfig) Address() string {
+	if hc.IsUnixSocket() {
+		return hc.Hostname
+	}
 	return fmt.Sprintf("%s:%d", hc.Hostname, hc.Port)
 }
 
+// IsUnixSocket returns true if the appservice should listen on a unix socket rather than a TCP port.
+func (hc *HostConfig) IsUnixSocket() bool {
+	return strings.HasPrefix(hc.Hostname, "/")
+}
+
+// IsTLS returns true if both the TLS certificate and key are configured.
+func (hc *HostConfig) IsTLS() bool {
+	return len(hc.TLSCert) > 0 && len(hc.TLSKey) > 0
+}
+
 // Save saves this config into a file at the given path.
 func (as *AppService) Save(path string) error {
 	data, err := yaml.Marshal(as)
@@ -179,7 +227,7 @@ func (as *AppService) YAML() (string, error) {
 }
 
 func (as *AppService) BotMXID() id.UserID {
-	return id.NewUserID(as.Registration.SenderLocalpart, as.HomeserverDomain)
+	return id.NewUserID(as.GetRegistration().SenderLocalpart, as.HomeserverDomain)
 }
 
 func (as *AppService) makeIntent(userID id.UserID) *IntentAPI {
@@ -233,7 +281,16 @@ func (as *AppService) makeClient(userID id.UserID) *mautrix.Client {
 		return client
 	}
 
-	client, err := mautrix.NewClient(as.HomeserverURL, userID, as.Registration.AppToken)
+	client = as.createClient(userID, PriorityRealtime)
+	if client != nil {
+		as.clients[userID] = client
+	}
+	return client
+}
+
+func (as *AppService) createClient(userID id.UserID, priority RequestPriority) *mautrix.Client {
+	// The access token is added by the transport, so that registration reloads apply to existing clients.
+	client, err := mautrix.NewClient(as.HomeserverURL, userID, "")
 	if err != nil {
 		as.Log.Fatalln("Failed to create mautrix client instance:", err)
 		return nil
@@ -244,8 +301,12 @@ func (as *AppService) makeClient(userID id.UserID) *mautrix.Client {
 	client.AppServiceUserID = userID
 	client.Logger = as.Log.Sub(string(userID))
 	client.Client = as.HTTPClient
+	if as.RateLimiter != nil {
+		client.Client = as.RateLimiter.WrapClient(as.HTTPClient, priority)
+	}
+	client.Client = as.wrapClientWithToken(client.Client)
 	client.DefaultHTTPRetries = as.DefaultHTTPRetries
-	as.clients[userID] = client
+	client.ProfileCache = as.ProfileCache
 	return client
 }
 
@@ -286,11 +347,13 @@ func (as *AppService) Init() (bool, error) {
 	as.Log.Debugln("Logger initialized successfully.")
 
 	if len(as.RegistrationPath) > 0 {
-		var err error
-		as.Registration, err = LoadRegistration(as.RegistrationPath)
+		reg, err := LoadRegistration(as.RegistrationPath)
 		if err != nil {
 			return false, err
 		}
+		as.registrationLock.Lock()
+		as.Registration = reg
+		as.registrationLock.Unlock()
 	}
 
 	as.Log.Debugln("Appservice initialized successfully.")
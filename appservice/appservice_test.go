@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// newTestAppService creates an appservice whose homeserver is the given handler.
+// The homeserver handler may be nil if the test doesn't make any requests.
+func newTestAppService(t *testing.T, homeserver http.Handler) *appservice.AppService {
+	as := appservice.Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &appservice.Registration{
+		AppToken:        "as_token",
+		ServerToken:     "hs_token",
+		SenderLocalpart: "bot",
+	}
+	as.Log = maulogger.Create()
+	as.Log.(*maulogger.BasicLogger).PrintLevel = maulogger.LevelFatal.Severity + 1
+	if homeserver != nil {
+		server := httptest.NewServer(homeserver)
+		t.Cleanup(server.Close)
+		as.HomeserverURL = server.URL
+	} else {
+		as.HomeserverURL = "http://localhost"
+	}
+	return as
+}
+
+// requestLog is a fake homeserver that records the method, path and body of every request.
+// Requests are answered by respond, or with an empty JSON object if respond is nil.
+type requestLog struct {
+	lock     sync.Mutex
+	requests []string
+	bodies   []string
+	respond  http.HandlerFunc
+}
+
+func (rl *requestLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rl.lock.Lock()
+	rl.requests = append(rl.requests, r.Method+" "+r.URL.Path)
+	rl.bodies = append(rl.bodies, string(body))
+	rl.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if rl.respond != nil {
+		rl.respond(w, r)
+	} else {
+		_, _ = w.Write([]byte("{}"))
+	}
+}
+
+// Requests returns the requests received so far, formatted as "METHOD /path".
+func (rl *requestLog) Requests() []string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return append([]string{}, rl.requests...)
+}
+
+// Body returns the body of the first request with the given method and path.
+func (rl *requestLog) Body(request string) string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	for i, req := range rl.requests {
+		if req == request {
+			return rl.bodies[i]
+		}
+	}
+	return ""
+}
+
+func TestAppService_StopWhileStarting(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		as := newTestAppService(t, nil)
+		as.Host.Hostname = "127.0.0.1"
+		done := make(chan struct{})
+		go func() {
+			as.Start()
+			close(done)
+		}()
+		// Start may begin listening after a Stop call has already returned, so keep stopping until it returns.
+		timeout := time.After(5 * time.Second)
+	Loop:
+		for {
+			assert.NoError(t, as.Stop(context.Background()))
+			select {
+			case <-done:
+				break Loop
+			case <-time.After(10 * time.Millisecond):
+			case <-timeout:
+				t.Fatal("Start didn't return after Stop")
+			}
+		}
+	}
+}
+
+// newUnixSocketClient creates a HTTP client that connects to the given unix socket regardless of the URL.
+func newUnixSocketClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// waitForLive polls the liveness endpoint until the appservice responds.
+// The path prefix is prepended to the endpoint path.
+func waitForLive(t *testing.T, client *http.Client, pathPrefix string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get("http://appservice" + pathPrefix + "/_matrix/mau/live")
+		if err == nil {
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatal("appservice didn't start listening:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAppService_Restart(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.Live = true
+	as.Host.Hostname = filepath.Join(t.TempDir(), "as.sock")
+	client := newUnixSocketClient(as.Host.Hostname)
+
+	for i := 0; i < 2; i++ {
+		done := make(chan struct{})
+		go func() {
+			as.Start()
+			close(done)
+		}()
+		waitForLive(t, client, "")
+		client.CloseIdleConnections()
+
+		require.NoError(t, as.Stop(context.Background()))
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Start didn't return after Stop")
+		}
+	}
+}
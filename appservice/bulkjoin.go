@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultBulkJoinConcurrency is the number of users that BulkJoin processes in parallel if no concurrency is specified.
+const DefaultBulkJoinConcurrency = 8
+
+// BulkJoinProgressFunc is called by BulkJoin after each user has been processed.
+// The error is nil if the user was joined successfully.
+type BulkJoinProgressFunc func(done, total int, userID id.UserID, err error)
+
+// BulkJoinParams contains optional parameters for BulkJoin.
+type BulkJoinParams struct {
+	// The maximum number of users to process in parallel. Defaults to DefaultBulkJoinConcurrency.
+	Concurrency int
+	// An optional function that is called after each user is processed.
+	Progress BulkJoinProgressFunc
+}
+
+// BulkJoin registers the ghost users with the given localparts, invites them to the room using this intent
+// and joins them. Users who are already in the room according to the state store are skipped.
+//
+// The returned map contains the errors for users that couldn't be joined. If every user was joined, the map is empty.
+func (intent *IntentAPI) BulkJoin(roomID id.RoomID, localparts []string, extra ...BulkJoinParams) map[id.UserID]error {
+	var params BulkJoinParams
+	if len(extra) > 1 {
+		panic("invalid number of extra parameters")
+	} else if len(extra) == 1 {
+		params = extra[0]
+	}
+	if params.Concurrency <= 0 {
+		params.Concurrency = DefaultBulkJoinConcurrency
+	}
+
+	errs := make(map[id.UserID]error)
+	total := len(localparts)
+	if err := intent.EnsureJoined(roomID); err != nil {
+		err = fmt.Errorf("inviter failed to join room: %w", err)
+		for i, localpart := range localparts {
+			userID := id.NewUserID(localpart, intent.as.HomeserverDomain)
+			errs[userID] = err
+			if params.Progress != nil {
+				params.Progress(i+1, total, userID, err)
+			}
+		}
+		return errs
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	queue := make(chan string)
+	worker := func() {
+		defer wg.Done()
+		for localpart := range queue {
+			userID := id.NewUserID(localpart, intent.as.HomeserverDomain)
+			err := intent.bulkJoinOne(roomID, userID)
+			lock.Lock()
+			done++
+			if err != nil {
+				errs[userID] = err
+			}
+			if params.Progress != nil {
+				params.Progress(done, total, userID, err)
+			}
+			lock.Unlock()
+		}
+	}
+	wg.Add(params.Concurrency)
+	for i := 0; i < params.Concurrency; i++ {
+		go worker()
+	}
+	for _, localpart := range localparts {
+		queue <- localpart
+	}
+	close(queue)
+	wg.Wait()
+	return errs
+}
+
+func (intent *IntentAPI) bulkJoinOne(roomID id.RoomID, userID id.UserID) error {
+	if intent.as.StateStore.IsInRoom(roomID, userID) {
+		return nil
+	}
+	ghost := intent.as.Intent(userID)
+	if ghost == nil {
+		return fmt.Errorf("%s is not a valid ghost user ID", userID)
+	}
+	err := ghost.EnsureRegistered()
+	if err != nil {
+		return err
+	}
+	if err = intent.EnsureInvited(roomID, userID); err != nil {
+		return fmt.Errorf("failed to invite: %w", err)
+	}
+	return ghost.EnsureJoined(roomID, EnsureJoinedParams{BotOverride: intent.Client})
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const bulkJoinTestRoom = id.RoomID("!portal:example.com")
+
+func TestIntentAPI_BulkJoin(t *testing.T) {
+	var inFlight, maxInFlight int32
+	hs := &requestLog{respond: func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			prevMax := atomic.LoadInt32(&maxInFlight)
+			if current <= prevMax || atomic.CompareAndSwapInt32(&maxInFlight, prevMax, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if strings.HasSuffix(r.URL.Path, "/join") && r.URL.Query().Get("user_id") == "@broken:example.com" {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Internal server error"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"room_id": "` + string(bulkJoinTestRoom) + `"}`))
+	}}
+	as := newTestAppService(t, hs)
+	as.StateStore.SetMembership(bulkJoinTestRoom, "@bot:example.com", event.MembershipJoin)
+	as.StateStore.SetMembership(bulkJoinTestRoom, "@existing:example.com", event.MembershipJoin)
+
+	var progressLock sync.Mutex
+	var progress []int
+	var progressUsers []id.UserID
+	localparts := []string{"alice", "bob", "existing", "broken", "carol", "dave"}
+	errs := as.BotIntent().BulkJoin(bulkJoinTestRoom, localparts, appservice.BulkJoinParams{
+		Concurrency: 2,
+		Progress: func(done, total int, userID id.UserID, err error) {
+			progressLock.Lock()
+			defer progressLock.Unlock()
+			assert.Equal(t, len(localparts), total)
+			assert.Equal(t, userID == "@broken:example.com", err != nil, userID)
+			progress = append(progress, done)
+			progressUsers = append(progressUsers, userID)
+		},
+	})
+
+	require.Len(t, errs, 1)
+	assert.Error(t, errs["@broken:example.com"])
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, progress)
+	assert.ElementsMatch(t, []id.UserID{
+		"@alice:example.com", "@bob:example.com", "@existing:example.com",
+		"@broken:example.com", "@carol:example.com", "@dave:example.com",
+	}, progressUsers)
+	for _, userID := range []id.UserID{"@alice:example.com", "@bob:example.com", "@carol:example.com", "@dave:example.com"} {
+		assert.True(t, as.StateStore.IsInRoom(bulkJoinTestRoom, userID), userID)
+	}
+	assert.False(t, as.StateStore.IsInRoom(bulkJoinTestRoom, "@broken:example.com"))
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(2))
+
+	// Users who are already in the room aren't invited.
+	invites := 0
+	for _, req := range hs.Requests() {
+		if strings.HasSuffix(req, "/invite") {
+			invites++
+		}
+	}
+	assert.Equal(t, 5, invites)
+}
+
+func TestIntentAPI_BulkJoin_InviterNotJoined(t *testing.T) {
+	as := newTestAppService(t, errorHomeserver(http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "You are not invited to this room"}`))
+	as.StateStore.MarkRegistered("@bot:example.com")
+
+	var progress []int
+	errs := as.BotIntent().BulkJoin(bulkJoinTestRoom, []string{"alice", "bob"}, appservice.BulkJoinParams{
+		Progress: func(done, total int, userID id.UserID, err error) {
+			assert.Error(t, err)
+			assert.Equal(t, 2, total)
+			progress = append(progress, done)
+		},
+	})
+	assert.Equal(t, []int{1, 2}, progress)
+	require.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.ErrorIs(t, err, mautrix.MForbidden)
+		assert.ErrorContains(t, err, "inviter failed to join room")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DirectChatsRetries is the number of times ModifyDirectChats retries if another client
+// overwrites the m.direct account data at the same time.
+var DirectChatsRetries = 3
+
+// DirectChatsMutator modifies the given m.direct content and returns whether anything was changed.
+type DirectChatsMutator func(content event.DirectChatsEventContent) bool
+
+// GetDirectChats fetches the m.direct account data of the intent's user.
+// If the user doesn't have any m.direct data, an empty map is returned.
+func (intent *IntentAPI) GetDirectChats() (event.DirectChatsEventContent, error) {
+	content := event.DirectChatsEventContent{}
+	err := intent.GetAccountData(event.AccountDataDirectChats.Type, &content)
+	if errors.Is(err, mautrix.MNotFound) {
+		return event.DirectChatsEventContent{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get m.direct account data: %w", err)
+	} else if content == nil {
+		content = event.DirectChatsEventContent{}
+	}
+	return content, nil
+}
+
+// ModifyDirectChats applies the given mutator to the m.direct account data of the intent's user.
+//
+// This is meant for custom puppets (i.e. double puppeting), where the real user's clients may also
+// be modifying m.direct. Account data has no compare-and-swap, so after writing, the data is read
+// back and the mutator is applied again if someone else's write replaced ours.
+func (intent *IntentAPI) ModifyDirectChats(mutator DirectChatsMutator) error {
+	intent.directChatsLock.Lock()
+	defer intent.directChatsLock.Unlock()
+	for attempt := 0; ; attempt++ {
+		content, err := intent.GetDirectChats()
+		if err != nil {
+			return err
+		} else if !mutator(content) {
+			return nil
+		} else if attempt >= DirectChatsRetries {
+			return fmt.Errorf("m.direct was modified concurrently %d times in a row", attempt)
+		}
+		err = intent.SetAccountData(event.AccountDataDirectChats.Type, content)
+		if err != nil {
+			return fmt.Errorf("failed to set m.direct account data: %w", err)
+		}
+		// The next iteration reads the data back: if our change is still there, the mutator won't change anything.
+	}
+}
+
+// AddDirectChat marks the given room as a DM with the given user in the m.direct account data of the intent's user.
+func (intent *IntentAPI) AddDirectChat(userID id.UserID, roomID id.RoomID) error {
+	return intent.ModifyDirectChats(func(content event.DirectChatsEventContent) bool {
+		for _, existingRoomID := range content[userID] {
+			if existingRoomID == roomID {
+				return false
+			}
+		}
+		content[userID] = append(content[userID], roomID)
+		return true
+	})
+}
+
+// RemoveDirectChat removes the given room from the DMs with the given user in the m.direct account data of the intent's user.
+func (intent *IntentAPI) RemoveDirectChat(userID id.UserID, roomID id.RoomID) error {
+	return intent.ModifyDirectChats(func(content event.DirectChatsEventContent) bool {
+		rooms := content[userID]
+		for i, existingRoomID := range rooms {
+			if existingRoomID == roomID {
+				rooms = append(rooms[:i], rooms[i+1:]...)
+				if len(rooms) == 0 {
+					delete(content, userID)
+				} else {
+					content[userID] = rooms
+				}
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (intent *IntentAPI) isUsableDirectChat(roomID id.RoomID, userID id.UserID) bool {
+	store := intent.as.StateStore
+	return store.IsInRoom(roomID, intent.UserID) && store.IsInvited(roomID, userID)
+}
+
+// EnsureDirectChat returns the ID of a DM room between the intent's user and the given user, creating one if necessary.
+//
+// Existing rooms are found from a cache and the m.direct account data of the intent's user. A room is only
+// reused if the state store says the intent is joined and the other user is joined or invited.
+// New rooms are created with is_direct and added to the intent's m.direct.
+func (intent *IntentAPI) EnsureDirectChat(userID id.UserID) (id.RoomID, error) {
+	intent.directChatCacheLock.Lock()
+	defer intent.directChatCacheLock.Unlock()
+	if intent.directChatCache == nil {
+		intent.directChatCache = make(map[id.UserID]id.RoomID)
+	}
+
+	if roomID, ok := intent.directChatCache[userID]; ok && intent.isUsableDirectChat(roomID, userID) {
+		return roomID, nil
+	}
+	delete(intent.directChatCache, userID)
+
+	directChats, err := intent.GetDirectChats()
+	if err != nil {
+		intent.Logger.Debugfln("Failed to get m.direct to find DM with %s: %v", userID, err)
+	}
+	for _, roomID := range directChats[userID] {
+		if intent.isUsableDirectChat(roomID, userID) {
+			intent.directChatCache[userID] = roomID
+			return roomID, nil
+		}
+	}
+
+	resp, err := intent.CreateRoom(&mautrix.ReqCreateRoom{
+		Invite:   []id.UserID{userID},
+		Preset:   "trusted_private_chat",
+		IsDirect: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create DM room: %w", err)
+	}
+	intent.directChatCache[userID] = resp.RoomID
+	if err = intent.AddDirectChat(userID, resp.RoomID); err != nil {
+		intent.Logger.Debugfln("Failed to add %s to m.direct after creating DM with %s: %v", resp.RoomID, userID, err)
+	}
+	return resp.RoomID, nil
+}
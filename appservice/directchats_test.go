@@ -0,0 +1,157 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// directChatsHomeserver is a fake homeserver that stores the m.direct account data.
+type directChatsHomeserver struct {
+	lock    sync.Mutex
+	content string
+	puts    int
+	// afterPut is called after each write, e.g. to simulate another client overwriting the data.
+	afterPut func(hs *directChatsHomeserver)
+	creates  []string
+}
+
+func (hs *directChatsHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/account_data/m.direct") && r.Method == http.MethodGet:
+		if len(hs.content) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Account data not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(hs.content))
+	case strings.HasSuffix(r.URL.Path, "/account_data/m.direct") && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		hs.content = string(body)
+		hs.puts++
+		if hs.afterPut != nil {
+			hs.afterPut(hs)
+		}
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasSuffix(r.URL.Path, "/createRoom"):
+		body, _ := io.ReadAll(r.Body)
+		hs.creates = append(hs.creates, string(body))
+		_, _ = w.Write([]byte(`{"room_id": "!new:example.com"}`))
+	default:
+		_, _ = w.Write([]byte(`{}`))
+	}
+}
+
+func newDirectChatsTestIntent(t *testing.T) (*appservice.AppService, *appservice.IntentAPI, *directChatsHomeserver) {
+	hs := &directChatsHomeserver{}
+	as := newTestAppService(t, hs)
+	as.StateStore.MarkRegistered("@bot:example.com")
+	return as, as.BotIntent(), hs
+}
+
+func TestIntentAPI_AddDirectChat(t *testing.T) {
+	_, intent, hs := newDirectChatsTestIntent(t)
+
+	require.NoError(t, intent.AddDirectChat("@alice:example.com", "!a:example.com"))
+	assert.JSONEq(t, `{"@alice:example.com": ["!a:example.com"]}`, hs.content)
+	require.NoError(t, intent.AddDirectChat("@alice:example.com", "!b:example.com"))
+	assert.JSONEq(t, `{"@alice:example.com": ["!a:example.com", "!b:example.com"]}`, hs.content)
+	// Adding a room that's already there doesn't write anything.
+	require.NoError(t, intent.AddDirectChat("@alice:example.com", "!a:example.com"))
+	assert.Equal(t, 2, hs.puts)
+
+	require.NoError(t, intent.RemoveDirectChat("@alice:example.com", "!a:example.com"))
+	assert.JSONEq(t, `{"@alice:example.com": ["!b:example.com"]}`, hs.content)
+	// Users without any DMs left are removed.
+	require.NoError(t, intent.RemoveDirectChat("@alice:example.com", "!b:example.com"))
+	assert.JSONEq(t, `{}`, hs.content)
+	require.NoError(t, intent.RemoveDirectChat("@alice:example.com", "!b:example.com"))
+	assert.Equal(t, 4, hs.puts)
+}
+
+func TestIntentAPI_ModifyDirectChats_ConcurrentWrite(t *testing.T) {
+	_, intent, hs := newDirectChatsTestIntent(t)
+	hs.content = `{"@bob:example.com": ["!bob:example.com"]}`
+	hs.afterPut = func(hs *directChatsHomeserver) {
+		// Another client overwrites our first write with its own change.
+		hs.content = `{"@bob:example.com": ["!bob:example.com"], "@carol:example.com": ["!carol:example.com"]}`
+		hs.afterPut = nil
+	}
+
+	require.NoError(t, intent.AddDirectChat("@alice:example.com", "!alice:example.com"))
+	assert.JSONEq(t, `{
+		"@alice:example.com": ["!alice:example.com"],
+		"@bob:example.com": ["!bob:example.com"],
+		"@carol:example.com": ["!carol:example.com"]
+	}`, hs.content)
+	assert.Equal(t, 2, hs.puts)
+}
+
+func TestIntentAPI_ModifyDirectChats_TooManyConflicts(t *testing.T) {
+	_, intent, hs := newDirectChatsTestIntent(t)
+	hs.afterPut = func(hs *directChatsHomeserver) {
+		hs.content = `{}`
+	}
+
+	err := intent.AddDirectChat("@alice:example.com", "!alice:example.com")
+	assert.ErrorContains(t, err, "m.direct was modified concurrently")
+	assert.Equal(t, appservice.DirectChatsRetries, hs.puts)
+}
+
+func TestIntentAPI_EnsureDirectChat_Create(t *testing.T) {
+	as, intent, hs := newDirectChatsTestIntent(t)
+
+	roomID, err := intent.EnsureDirectChat("@alice:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!new:example.com"), roomID)
+	require.Len(t, hs.creates, 1)
+	assert.JSONEq(t, `{"invite": ["@alice:example.com"], "preset": "trusted_private_chat", "is_direct": true}`, hs.creates[0])
+	assert.JSONEq(t, `{"@alice:example.com": ["!new:example.com"]}`, hs.content)
+	assert.True(t, as.StateStore.IsInvited(roomID, "@alice:example.com"))
+
+	// The room is cached, so the second call doesn't create another room.
+	roomID, err = intent.EnsureDirectChat("@alice:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!new:example.com"), roomID)
+	assert.Len(t, hs.creates, 1)
+
+	// If the other user leaves, a new room is created.
+	as.StateStore.SetMembership(roomID, "@alice:example.com", event.MembershipLeave)
+	_, err = intent.EnsureDirectChat("@alice:example.com")
+	require.NoError(t, err)
+	assert.Len(t, hs.creates, 2)
+}
+
+func TestIntentAPI_EnsureDirectChat_Existing(t *testing.T) {
+	as, intent, hs := newDirectChatsTestIntent(t)
+	hs.content = `{"@alice:example.com": ["!left:example.com", "!dm:example.com"]}`
+	as.StateStore.SetMembership("!left:example.com", "@bot:example.com", event.MembershipJoin)
+	as.StateStore.SetMembership("!left:example.com", "@alice:example.com", event.MembershipLeave)
+	as.StateStore.SetMembership("!dm:example.com", "@bot:example.com", event.MembershipJoin)
+	as.StateStore.SetMembership("!dm:example.com", "@alice:example.com", event.MembershipJoin)
+
+	// Rooms in m.direct that the other user has left are skipped.
+	roomID, err := intent.EnsureDirectChat("@alice:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!dm:example.com"), roomID)
+	assert.Empty(t, hs.creates)
+	assert.Zero(t, hs.puts)
+}
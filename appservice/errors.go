@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix"
+)
+
+// Failure reasons of IntentAPI methods. They can be checked with errors.Is():
+//
+//	_, err := intent.SendText(roomID, "hello")
+//	if errors.Is(err, appservice.ErrPowerLevelTooLow) {
+//	  // ask for more permissions
+//	}
+//
+// The underlying HTTP errors are still available, so errors.Is(err, mautrix.MForbidden) works too.
+var (
+	// The intent's user couldn't be registered.
+	ErrNotRegistered = errors.New("user is not registered")
+	// The intent's user couldn't join the room, because they weren't invited and the bot couldn't invite them.
+	ErrNotInvited = errors.New("user is not invited to the room")
+	// The intent's user doesn't have a high enough power level for the action.
+	ErrPowerLevelTooLow = errors.New("power level too low")
+	// The room doesn't exist or the homeserver doesn't know about it.
+	ErrRoomNotFound = errors.New("room not found")
+	// The homeserver rate limited the request.
+	ErrRateLimited = errors.New("rate limited")
+	// The target user is already in the room, e.g. when inviting someone who has already joined.
+	ErrAlreadyInRoom = errors.New("user is already in the room")
+	// The intent's user or the target user is banned from the room.
+	ErrBanned = errors.New("user is banned from the room")
+)
+
+// IntentError is returned by IntentAPI methods when the reason of the failure is known.
+type IntentError struct {
+	// What the intent was doing, e.g. "ensure joined". Can be empty.
+	Op string
+	// One of the Err* failure reasons, or nil if the reason wasn't recognized.
+	Kind error
+	// The underlying error.
+	Err error
+}
+
+func (ie *IntentError) Error() string {
+	if len(ie.Op) == 0 {
+		return ie.Err.Error()
+	}
+	return fmt.Sprintf("failed to %s: %v", ie.Op, ie.Err)
+}
+
+func (ie *IntentError) Is(target error) bool {
+	return ie.Kind != nil && ie.Kind == target
+}
+
+func (ie *IntentError) Unwrap() error {
+	return ie.Err
+}
+
+// classifyError wraps the given error in an IntentError. The meaning of M_FORBIDDEN and M_NOT_FOUND errors
+// depends on the operation, so the caller provides the kinds for them. Either kind can be nil if the error
+// can't be classified more specifically for the operation.
+func classifyError(op string, err error, forbiddenKind, notFoundKind error) error {
+	if err == nil {
+		return nil
+	}
+	var kind error
+	switch {
+	case errors.Is(err, mautrix.MLimitExceeded):
+		kind = ErrRateLimited
+	case errors.Is(err, mautrix.MNotFound):
+		kind = notFoundKind
+	case errors.Is(err, mautrix.MForbidden):
+		kind = classifyForbidden(err, forbiddenKind)
+	}
+	return &IntentError{Op: op, Kind: kind, Err: err}
+}
+
+// classifyForbidden recognizes the M_FORBIDDEN errors that don't depend on the operation from the error message.
+func classifyForbidden(err error, defaultKind error) error {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil {
+		return defaultKind
+	}
+	message := strings.ToLower(httpErr.RespError.Err)
+	switch {
+	case strings.Contains(message, "already in the room"):
+		return ErrAlreadyInRoom
+	case strings.Contains(message, "banned"):
+		return ErrBanned
+	default:
+		return defaultKind
+	}
+}
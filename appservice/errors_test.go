@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+)
+
+func errorHomeserver(status int, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	})
+}
+
+func TestIntentAPI_InviteUser_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		kind   error
+	}{
+		{"AlreadyInRoom", http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "@user:example.com is already in the room."}`, appservice.ErrAlreadyInRoom},
+		{"Banned", http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "@user:example.com is banned from the room"}`, appservice.ErrBanned},
+		{"PowerLevel", http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "You don't have permission to invite users"}`, appservice.ErrPowerLevelTooLow},
+		{"NotFound", http.StatusNotFound, `{"errcode": "M_NOT_FOUND", "error": "Unknown room"}`, appservice.ErrRoomNotFound},
+		{"RateLimited", http.StatusTooManyRequests, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`, appservice.ErrRateLimited},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			as := newTestAppService(t, errorHomeserver(test.status, test.body))
+			_, err := as.BotIntent().InviteUser("!room:example.com", &mautrix.ReqInviteUser{UserID: "@user:example.com"})
+			assert.ErrorIs(t, err, test.kind)
+			var intentErr *appservice.IntentError
+			assert.ErrorAs(t, err, &intentErr)
+			assert.Equal(t, test.kind, intentErr.Kind)
+		})
+	}
+}
+
+func TestIntentAPI_EnsureInvited_AlreadyInRoom(t *testing.T) {
+	as := newTestAppService(t, errorHomeserver(http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "@user:example.com is already in the room."}`))
+	assert.NoError(t, as.BotIntent().EnsureInvited("!room:example.com", "@user:example.com"))
+
+	as = newTestAppService(t, errorHomeserver(http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "You don't have permission to invite users"}`))
+	assert.ErrorIs(t, as.BotIntent().EnsureInvited("!room:example.com", "@user:example.com"), appservice.ErrPowerLevelTooLow)
+}
+
+func TestIntentAPI_RedactEvent_BotFallbackError(t *testing.T) {
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/register") {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "You don't have permission to redact events"}`))
+	}))
+	as.StateStore.SetMembership("!room:example.com", "@ghost:example.com", "join")
+	as.StateStore.SetMembership("!room:example.com", "@bot:example.com", "join")
+	_, err := as.Intent("@ghost:example.com").RedactEvent("!room:example.com", "$event")
+	assert.ErrorIs(t, err, appservice.ErrPowerLevelTooLow)
+	var intentErr *appservice.IntentError
+	if assert.ErrorAs(t, err, &intentErr) {
+		// The bot's error must only be wrapped in an IntentError once.
+		var nestedErr *appservice.IntentError
+		assert.False(t, errors.As(intentErr.Err, &nestedErr))
+	}
+}
+
+func TestIntentAPI_EnsureRegistered_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		kind   error
+	}{
+		{"Exclusive", http.StatusBadRequest, `{"errcode": "M_EXCLUSIVE", "error": "User ID is not in the appservice namespace"}`, appservice.ErrNotRegistered},
+		{"InvalidUsername", http.StatusBadRequest, `{"errcode": "M_INVALID_USERNAME", "error": "Invalid username"}`, appservice.ErrNotRegistered},
+		{"Forbidden", http.StatusForbidden, `{"errcode": "M_FORBIDDEN", "error": "Registration is disabled"}`, appservice.ErrNotRegistered},
+		{"RateLimited", http.StatusTooManyRequests, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`, appservice.ErrRateLimited},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			as := newTestAppService(t, errorHomeserver(test.status, test.body))
+			err := as.Intent("@user:example.com").EnsureRegistered()
+			var intentErr *appservice.IntentError
+			assert.ErrorAs(t, err, &intentErr)
+			assert.Equal(t, test.kind, intentErr.Kind)
+		})
+	}
+}
+
+func TestIntentAPI_EnsureRegistered_UnknownError(t *testing.T) {
+	as := newTestAppService(t, errorHomeserver(http.StatusInternalServerError, `{"errcode": "M_UNKNOWN", "error": "Internal server error"}`))
+	err := as.Intent("@user:example.com").EnsureRegistered()
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, appservice.ErrNotRegistered))
+	assert.False(t, as.StateStore.IsRegistered("@user:example.com"))
+}
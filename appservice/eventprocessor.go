@@ -7,8 +7,10 @@
 package appservice
 
 import (
+	"context"
 	"encoding/json"
 	"runtime/debug"
+	"sync"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -33,24 +35,51 @@ type EventProcessor struct {
 
 	as       *AppService
 	log      log.Logger
-	stop     chan struct{}
 	handlers map[event.Type][]EventHandler
+	dispatch EventListener
+	running  sync.WaitGroup
+
+	stop      chan struct{}
+	stopOnce  sync.Once
+	loopDone  chan struct{}
+	stateLock sync.Mutex
+	started   bool
+	stopped   bool
 
 	otkHandlers        []OTKHandler
 	deviceListHandlers []DeviceListHandler
 }
 
 func NewEventProcessor(as *AppService) *EventProcessor {
-	return &EventProcessor{
+	ep := &EventProcessor{
 		ExecMode: AsyncHandlers,
 		as:       as,
 		log:      as.Log.Sub("Events"),
-		stop:     make(chan struct{}, 1),
 		handlers: make(map[event.Type][]EventHandler),
+		stop:     make(chan struct{}),
+		loopDone: make(chan struct{}),
 
 		otkHandlers:        make([]OTKHandler, 0),
 		deviceListHandlers: make([]DeviceListHandler, 0),
 	}
+	as.processorsLock.Lock()
+	ep.dispatch = as.buildEventChain(ep.dispatchToHandlers)
+	as.eventProcessors = append(as.eventProcessors, ep)
+	as.processorsLock.Unlock()
+	return ep
+}
+
+// RemoveEventProcessor unregisters the given event processor, so that Stop no longer waits for it and
+// middleware added with AddEventMiddleware no longer applies to it. It doesn't stop the processor.
+func (as *AppService) RemoveEventProcessor(ep *EventProcessor) {
+	as.processorsLock.Lock()
+	defer as.processorsLock.Unlock()
+	for i, existing := range as.eventProcessors {
+		if existing == ep {
+			as.eventProcessors = append(as.eventProcessors[:i:i], as.eventProcessors[i+1:]...)
+			return
+		}
+	}
 }
 
 func (ep *EventProcessor) On(evtType event.Type, handler EventHandler) {
@@ -79,33 +108,70 @@ func (ep *EventProcessor) recoverFunc(data interface{}) {
 }
 
 func (ep *EventProcessor) callHandler(handler EventHandler, evt *event.Event) {
+	defer ep.running.Done()
 	defer ep.recoverFunc(evt)
 	handler(evt)
 }
 
 func (ep *EventProcessor) callOTKHandler(handler OTKHandler, otk *mautrix.OTKCount) {
+	defer ep.running.Done()
 	defer ep.recoverFunc(otk)
 	handler(otk)
 }
 
 func (ep *EventProcessor) callDeviceListHandler(handler DeviceListHandler, dl *mautrix.DeviceLists) {
+	defer ep.running.Done()
 	defer ep.recoverFunc(dl)
 	handler(dl, "")
 }
 
+// startDispatch marks a dispatch as running, unless the processor has been stopped.
+// The mark is added under the state lock, so that Stop can guarantee nothing is added to the wait group
+// after it returns (other than nested dispatches from handlers that are still running).
+func (ep *EventProcessor) startDispatch() bool {
+	ep.stateLock.Lock()
+	defer ep.stateLock.Unlock()
+	if ep.stopped {
+		return false
+	}
+	ep.running.Add(1)
+	return true
+}
+
 func (ep *EventProcessor) DispatchOTK(otk *mautrix.OTKCount) {
+	if !ep.startDispatch() {
+		return
+	}
+	defer ep.running.Done()
 	for _, handler := range ep.otkHandlers {
+		ep.running.Add(1)
 		go ep.callOTKHandler(handler, otk)
 	}
 }
 
 func (ep *EventProcessor) DispatchDeviceList(dl *mautrix.DeviceLists) {
+	if !ep.startDispatch() {
+		return
+	}
+	defer ep.running.Done()
 	for _, handler := range ep.deviceListHandlers {
+		ep.running.Add(1)
 		go ep.callDeviceListHandler(handler, dl)
 	}
 }
 
+// Dispatch passes the event through the appservice's event middlewares and then to the registered handlers.
+// Events dispatched after Stop has returned are dropped.
 func (ep *EventProcessor) Dispatch(evt *event.Event) {
+	if !ep.startDispatch() {
+		ep.log.Debugfln("Dropping %s after the event processor was stopped", evt.ID)
+		return
+	}
+	defer ep.running.Done()
+	ep.dispatch(evt)
+}
+
+func (ep *EventProcessor) dispatchToHandlers(evt *event.Event) {
 	handlers, ok := ep.handlers[evt.Type]
 	if !ok {
 		return
@@ -113,9 +179,11 @@ func (ep *EventProcessor) Dispatch(evt *event.Event) {
 	switch ep.ExecMode {
 	case AsyncHandlers:
 		for _, handler := range handlers {
+			ep.running.Add(1)
 			go ep.callHandler(handler, evt)
 		}
 	case AsyncLoop:
+		ep.running.Add(len(handlers))
 		go func() {
 			for _, handler := range handlers {
 				ep.callHandler(handler, evt)
@@ -123,12 +191,23 @@ func (ep *EventProcessor) Dispatch(evt *event.Event) {
 		}()
 	case Sync:
 		for _, handler := range handlers {
+			ep.running.Add(1)
 			ep.callHandler(handler, evt)
 		}
 	}
 }
 
+// Start runs the event loop, which reads events from the appservice and dispatches them to handlers.
+// It blocks until Stop is called, so it should usually be called in a new goroutine.
 func (ep *EventProcessor) Start() {
+	ep.stateLock.Lock()
+	if ep.stopped || ep.started {
+		ep.stateLock.Unlock()
+		return
+	}
+	ep.started = true
+	ep.stateLock.Unlock()
+	defer close(ep.loopDone)
 	for {
 		select {
 		case evt := <-ep.as.Events:
@@ -143,6 +222,30 @@ func (ep *EventProcessor) Start() {
 	}
 }
 
+// Stop stops the event loop and waits for it to exit. In the Sync execution mode, that includes waiting
+// for the handlers of the event that is currently being processed.
+//
+// After Stop returns, no new handlers will be dispatched, so Wait can be used to wait for the handlers
+// that are still running. The processor is also removed from the appservice (see RemoveEventProcessor).
+// A stopped event processor can't be started again.
 func (ep *EventProcessor) Stop() {
-	ep.stop <- struct{}{}
+	ep.stopOnce.Do(func() {
+		close(ep.stop)
+	})
+	ep.stateLock.Lock()
+	started := ep.started
+	ep.stateLock.Unlock()
+	if started {
+		<-ep.loopDone
+	}
+	ep.stateLock.Lock()
+	ep.stopped = true
+	ep.stateLock.Unlock()
+	ep.as.RemoveEventProcessor(ep)
+}
+
+// Wait waits until all handlers that have been dispatched have returned, or until the context is canceled.
+// It must only be called after Stop, as new dispatches can't be waited for reliably while the loop is running.
+func (ep *EventProcessor) Wait(ctx context.Context) error {
+	return waitWithContext(ctx, &ep.running)
 }
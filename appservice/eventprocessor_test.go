@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestEventProcessor_StopAndWait(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.Events = make(chan *event.Event, 8)
+	ep := appservice.NewEventProcessor(as)
+
+	var handled int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ep.On(event.EventMessage, func(evt *event.Event) {
+		if atomic.AddInt32(&handled, 1) == 1 {
+			close(started)
+		}
+		<-release
+	})
+	go ep.Start()
+
+	as.Events <- &event.Event{ID: "$1", Type: event.EventMessage}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler wasn't called")
+	}
+
+	ep.Stop()
+	// Nothing may be dispatched after Stop has returned.
+	ep.Dispatch(&event.Event{ID: "$2", Type: event.EventMessage})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	assert.ErrorIs(t, ep.Wait(ctx), context.DeadlineExceeded)
+	cancel()
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, ep.Wait(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+
+	// Stopping again is a no-op.
+	ep.Stop()
+}
+
+func TestEventProcessor_StopWithoutStart(t *testing.T) {
+	as := newTestAppService(t, nil)
+	ep := appservice.NewEventProcessor(as)
+	done := make(chan struct{})
+	go func() {
+		ep.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked even though the processor wasn't started")
+	}
+	ep.Start()
+	assert.NoError(t, ep.Wait(context.Background()))
+}
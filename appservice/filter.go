@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// EventFilter contains allowlists and denylists for incoming events.
+//
+// The filter is applied to the raw JSON of transactions, so dropped events are never fully parsed.
+// Empty allowlists allow everything. The denylists take precedence over the allowlists.
+type EventFilter struct {
+	// Event types (e.g. m.presence) to allow or deny.
+	AllowTypes []string
+	DenyTypes  []string
+	// Rooms to allow or deny events from. Events without a room ID (e.g. presence) are only affected by the type lists.
+	AllowRooms []id.RoomID
+	DenyRooms  []id.RoomID
+}
+
+func containsString(list []string, item string) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRoomID(list []id.RoomID, item id.RoomID) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks if an event with the given type and room ID passes the filter.
+func (filter *EventFilter) Allows(evtType string, roomID id.RoomID) bool {
+	if containsString(filter.DenyTypes, evtType) || (len(filter.AllowTypes) > 0 && !containsString(filter.AllowTypes, evtType)) {
+		return false
+	} else if len(roomID) == 0 {
+		return true
+	}
+	return !containsRoomID(filter.DenyRooms, roomID) && (len(filter.AllowRooms) == 0 || containsRoomID(filter.AllowRooms, roomID))
+}
+
+func (filter *EventFilter) parseEvents(raw []json.RawMessage) ([]*event.Event, int, error) {
+	if raw == nil {
+		return nil, 0, nil
+	}
+	evts := make([]*event.Event, 0, len(raw))
+	dropped := 0
+	for _, data := range raw {
+		fields := gjson.GetManyBytes(data, "type", "room_id")
+		if !filter.Allows(fields[0].Str, id.RoomID(fields[1].Str)) {
+			dropped++
+			continue
+		}
+		var evt event.Event
+		if err := json.Unmarshal(data, &evt); err != nil {
+			return nil, dropped, err
+		}
+		evts = append(evts, &evt)
+	}
+	return evts, dropped, nil
+}
+
+// parseTransaction parses a transaction body, dropping events that don't pass the appservice's EventFilter.
+func (as *AppService) parseTransaction(body []byte, txn *Transaction) error {
+	filter := as.EventFilter
+	if filter == nil {
+		return json.Unmarshal(body, txn)
+	}
+	// The event fields in this struct shadow the ones in the embedded transaction,
+	// so everything else is parsed normally, but events are left as raw JSON.
+	raw := struct {
+		*Transaction
+		Events                 []json.RawMessage `json:"events"`
+		EphemeralEvents        []json.RawMessage `json:"ephemeral,omitempty"`
+		MSC2409EphemeralEvents []json.RawMessage `json:"de.sorunome.msc2409.ephemeral,omitempty"`
+	}{Transaction: txn}
+	err := json.Unmarshal(body, &raw)
+	if err != nil {
+		return err
+	}
+	var dropped, droppedEphemeral, droppedUnstable int
+	if txn.Events, dropped, err = filter.parseEvents(raw.Events); err != nil {
+		return err
+	} else if txn.EphemeralEvents, droppedEphemeral, err = filter.parseEvents(raw.EphemeralEvents); err != nil {
+		return err
+	} else if txn.MSC2409EphemeralEvents, droppedUnstable, err = filter.parseEvents(raw.MSC2409EphemeralEvents); err != nil {
+		return err
+	}
+	if total := dropped + droppedEphemeral + droppedUnstable; total > 0 {
+		as.Log.Debugfln("Event filter dropped %d events from transaction", total)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestEventFilter_Allows(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  appservice.EventFilter
+		evtType string
+		roomID  id.RoomID
+		allowed bool
+	}{
+		{"empty filter", appservice.EventFilter{}, "m.room.message", "!room:example.com", true},
+		{"denied type", appservice.EventFilter{DenyTypes: []string{"m.presence"}}, "m.presence", "", false},
+		{"type not in allowlist", appservice.EventFilter{AllowTypes: []string{"m.room.message"}}, "m.typing", "!room:example.com", false},
+		{"type in allowlist", appservice.EventFilter{AllowTypes: []string{"m.room.message"}}, "m.room.message", "!room:example.com", true},
+		{"denied room", appservice.EventFilter{DenyRooms: []id.RoomID{"!spam:example.com"}}, "m.room.message", "!spam:example.com", false},
+		{"room not in allowlist", appservice.EventFilter{AllowRooms: []id.RoomID{"!room:example.com"}}, "m.room.message", "!other:example.com", false},
+		{"room in allowlist", appservice.EventFilter{AllowRooms: []id.RoomID{"!room:example.com"}}, "m.room.message", "!room:example.com", true},
+		{"no room with room allowlist", appservice.EventFilter{AllowRooms: []id.RoomID{"!room:example.com"}}, "m.presence", "", true},
+		{"denylist takes precedence", appservice.EventFilter{
+			AllowTypes: []string{"m.room.message"}, DenyTypes: []string{"m.room.message"},
+		}, "m.room.message", "!room:example.com", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.allowed, test.filter.Allows(test.evtType, test.roomID))
+		})
+	}
+}
+
+func TestAppService_EventFilter(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.Registration.EphemeralEvents = true
+	as.Events = make(chan *event.Event, 8)
+	as.DeviceLists = make(chan *mautrix.DeviceLists, 1)
+	as.EventFilter = &appservice.EventFilter{
+		DenyTypes: []string{"m.presence"},
+		DenyRooms: []id.RoomID{"!spam:example.com"},
+	}
+	client := startUnixSocketListener(t, as)
+
+	// The dropped events have content that can't be parsed, which would fail the whole transaction if they were parsed.
+	txn := `{
+		"events": [
+			{"type": "m.room.message", "event_id": "$1", "room_id": "!room:example.com", "sender": "@alice:example.com", "content": {"msgtype": "m.text", "body": "hi"}},
+			{"type": "m.room.message", "event_id": "$2", "room_id": "!spam:example.com", "sender": "@alice:example.com", "content": "not an object"}
+		],
+		"de.sorunome.msc2409.ephemeral": [
+			{"type": "m.presence", "sender": "@alice:example.com", "content": "not an object"},
+			{"type": "m.typing", "room_id": "!room:example.com", "content": {"user_ids": ["@alice:example.com"]}}
+		],
+		"device_lists": {"changed": ["@alice:example.com"]}
+	}`
+	status, _ := doRequest(t, client, http.MethodPut, "http://appservice/_matrix/app/v1/transactions/1", strings.NewReader(txn))
+	require.Equal(t, http.StatusOK, status)
+
+	var received []string
+	for len(as.Events) > 0 {
+		evt := <-as.Events
+		received = append(received, evt.Type.Type+" "+string(evt.RoomID))
+	}
+	assert.Equal(t, []string{"m.typing !room:example.com", "m.room.message !room:example.com"}, received)
+	// Fields other than events are parsed normally.
+	require.Len(t, as.DeviceLists, 1)
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, (<-as.DeviceLists).Changed)
+}
+
+func TestAppService_EventFilter_InvalidAllowedEvent(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.Events = make(chan *event.Event, 8)
+	as.EventFilter = &appservice.EventFilter{DenyTypes: []string{"m.presence"}}
+	client := startUnixSocketListener(t, as)
+
+	txn := `{"events": [{"type": "m.room.message", "event_id": "$1", "room_id": "!room:example.com", "content": "not an object"}]}`
+	status, respErr := doRequest(t, client, http.MethodPut, "http://appservice/_matrix/app/v1/transactions/1", strings.NewReader(txn))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, appservice.ErrBadJSON, respErr.ErrorCode)
+	assert.Empty(t, as.Events)
+}
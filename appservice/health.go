@@ -0,0 +1,187 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HomeserverCheckInterval is how long the result of a homeserver connectivity check is cached for.
+var HomeserverCheckInterval = 15 * time.Second
+
+// appserviceStats contains the data reported by the health and metrics endpoints.
+type appserviceStats struct {
+	lock                sync.RWMutex
+	transactions        int64
+	events              int64
+	lastTransaction     time.Time
+	lastTransactionLag  time.Duration
+	lastHomeserverCheck time.Time
+	homeserverReachable bool
+}
+
+func (stats *appserviceStats) markTransaction(txn *Transaction) {
+	var newestTS int64
+	for _, evt := range txn.Events {
+		if evt.Timestamp > newestTS {
+			newestTS = evt.Timestamp
+		}
+	}
+	now := time.Now()
+	stats.lock.Lock()
+	stats.transactions++
+	stats.events += int64(len(txn.Events))
+	stats.lastTransaction = now
+	if newestTS > 0 {
+		stats.lastTransactionLag = now.Sub(time.Unix(newestTS/1000, (newestTS%1000)*int64(time.Millisecond)))
+	}
+	stats.lock.Unlock()
+}
+
+func (as *AppService) checkHomeserverConnectivity() bool {
+	as.stats.lock.RLock()
+	lastCheck, reachable := as.stats.lastHomeserverCheck, as.stats.homeserverReachable
+	as.stats.lock.RUnlock()
+	if time.Since(lastCheck) < HomeserverCheckInterval {
+		return reachable
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reachable = false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(as.HomeserverURL, "/")+"/_matrix/client/versions", nil)
+	if err == nil {
+		req.Header.Set("User-Agent", as.UserAgent)
+		var resp *http.Response
+		resp, err = as.HTTPClient.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			reachable = resp.StatusCode == http.StatusOK
+		}
+	}
+	if !reachable {
+		as.Log.Debugfln("Homeserver connectivity check failed (error: %v)", err)
+	}
+	as.stats.lock.Lock()
+	as.stats.lastHomeserverCheck = time.Now()
+	as.stats.homeserverReachable = reachable
+	as.stats.lock.Unlock()
+	return reachable
+}
+
+// GetHealthLive handles the /_health/live endpoint, which reports whether the process is alive.
+func (as *AppService) GetHealthLive(w http.ResponseWriter, r *http.Request) {
+	as.GetLive(w, r)
+}
+
+// GetHealthReady handles the /_health/ready endpoint, which reports whether the appservice
+// is ready to receive transactions and the homeserver is reachable.
+func (as *AppService) GetHealthReady(w http.ResponseWriter, r *http.Request) {
+	queueDepth := len(as.Events)
+	hsReachable := as.checkHomeserverConnectivity()
+	w.Header().Add("Content-Type", "application/json")
+	if as.Ready && hsReachable {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = Respond(w, map[string]interface{}{
+		"ready":                as.Ready,
+		"homeserver_reachable": hsReachable,
+		"queue_depth":          queueDepth,
+	})
+}
+
+// GetMetrics handles the /metrics endpoint, which reports basic statistics in the Prometheus text format.
+func (as *AppService) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	as.stats.lock.RLock()
+	transactions, events := as.stats.transactions, as.stats.events
+	lastTransaction := as.stats.lastTransaction
+	lag := as.stats.lastTransactionLag
+	as.stats.lock.RUnlock()
+	var lastTransactionTS float64
+	if !lastTransaction.IsZero() {
+		lastTransactionTS = float64(lastTransaction.UnixNano()) / float64(time.Second)
+	}
+
+	var buf strings.Builder
+	writeMetric := func(name, metricType, help string, value interface{}) {
+		_, _ = fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, value)
+	}
+	writeMetric("mautrix_appservice_transactions_total", "counter", "Number of transactions received from the homeserver.", transactions)
+	writeMetric("mautrix_appservice_events_total", "counter", "Number of events received from the homeserver.", events)
+	writeMetric("mautrix_appservice_event_queue_depth", "gauge", "Number of events waiting to be processed.", len(as.Events))
+	writeMetric("mautrix_appservice_last_transaction_timestamp_seconds", "gauge", "Time when the last transaction was received.", lastTransactionTS)
+	writeMetric("mautrix_appservice_transaction_lag_seconds", "gauge", "Delay between the newest event in the last transaction being sent and it reaching the appservice.", lag.Seconds())
+	writeMetric("mautrix_appservice_homeserver_reachable", "gauge", "Whether the homeserver responded to the last connectivity check.", boolToInt(as.checkHomeserverConnectivity()))
+	writeMetric("mautrix_appservice_ready", "gauge", "Whether the appservice is ready.", boolToInt(as.Ready))
+	as.writeStateStoreMetrics(&buf)
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(buf.String()))
+}
+
+func writeLabeledMetric(buf *strings.Builder, name, metricType, help, label string, values map[string]interface{}) {
+	if len(values) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(buf, "%s{%s=%q} %v\n", name, label, key, values[key])
+	}
+}
+
+// writeStateStoreMetrics writes the operation statistics of the state store if it or a store it wraps implements
+// StateStoreStatsProvider, and the entry counts if the state store implements StateStoreEntryCounter.
+func (as *AppService) writeStateStoreMetrics(buf *strings.Builder) {
+	if provider, ok := findStateStore[StateStoreStatsProvider](as.StateStore); ok {
+		stats := provider.Stats()
+		calls := make(map[string]interface{}, len(stats))
+		hits := make(map[string]interface{})
+		misses := make(map[string]interface{})
+		durations := make(map[string]interface{}, len(stats))
+		for op, opStats := range stats {
+			calls[op] = opStats.Calls
+			durations[op] = opStats.Duration.Seconds()
+			if opStats.Hits > 0 || opStats.Misses > 0 {
+				hits[op] = opStats.Hits
+				misses[op] = opStats.Misses
+			}
+		}
+		writeLabeledMetric(buf, "mautrix_appservice_state_store_operations_total", "counter", "Number of state store operations.", "operation", calls)
+		writeLabeledMetric(buf, "mautrix_appservice_state_store_hits_total", "counter", "Number of state store lookups that found the requested data.", "operation", hits)
+		writeLabeledMetric(buf, "mautrix_appservice_state_store_misses_total", "counter", "Number of state store lookups that didn't find the requested data.", "operation", misses)
+		writeLabeledMetric(buf, "mautrix_appservice_state_store_operation_seconds_total", "counter", "Total time spent in state store operations.", "operation", durations)
+	}
+	if counter, ok := as.StateStore.(StateStoreEntryCounter); ok {
+		counts := counter.CountEntries()
+		entries := make(map[string]interface{}, len(counts))
+		for entryType, count := range counts {
+			entries[entryType] = count
+		}
+		writeLabeledMetric(buf, "mautrix_appservice_state_store_entries", "gauge", "Number of entries in the state store.", "type", entries)
+	}
+}
+
+func boolToInt(val bool) int {
+	if val {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// versionsHomeserver is a fake homeserver that counts connectivity checks and answers them with the given status.
+func versionsHomeserver(status *int32, checks *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/versions" {
+			atomic.AddInt32(checks, 1)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+		_, _ = w.Write([]byte("{}"))
+	})
+}
+
+func getHealthReady(t *testing.T, client *http.Client) (int, map[string]interface{}) {
+	resp, err := client.Get("http://appservice/_health/ready")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp.StatusCode, body
+}
+
+func TestAppService_HealthEndpoints(t *testing.T) {
+	status, checks := int32(http.StatusOK), int32(0)
+	as := newTestAppService(t, versionsHomeserver(&status, &checks))
+	as.EnableHealthEndpoints = true
+	client := startUnixSocketListener(t, as)
+
+	resp, err := client.Get("http://appservice/_health/live")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	code, body := getHealthReady(t, client)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]interface{}{"ready": false, "homeserver_reachable": true, "queue_depth": float64(0)}, body)
+
+	as.Ready = true
+	code, body = getHealthReady(t, client)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["ready"])
+	// The connectivity check result is cached.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&checks))
+}
+
+func TestAppService_HealthEndpoints_HomeserverDown(t *testing.T) {
+	status, checks := int32(http.StatusBadGateway), int32(0)
+	as := newTestAppService(t, versionsHomeserver(&status, &checks))
+	as.EnableHealthEndpoints = true
+	as.Ready = true
+	client := startUnixSocketListener(t, as)
+
+	code, body := getHealthReady(t, client)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, false, body["homeserver_reachable"])
+}
+
+func TestAppService_HealthEndpoints_Disabled(t *testing.T) {
+	as := newTestAppService(t, nil)
+	client := startUnixSocketListener(t, as)
+
+	for _, path := range []string{"/_health/live", "/_health/ready", "/metrics"} {
+		resp, err := client.Get("http://appservice" + path)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
+
+func TestAppService_GetMetrics(t *testing.T) {
+	status, checks := int32(http.StatusOK), int32(0)
+	as := newTestAppService(t, versionsHomeserver(&status, &checks))
+	as.EnableMetricsEndpoint = true
+	as.Events = make(chan *event.Event, 8)
+	client := startUnixSocketListener(t, as)
+
+	sentAt := time.Now().Add(-2 * time.Second).UnixMilli()
+	txn := fmt.Sprintf(`{"events": [
+		{"type": "m.room.message", "event_id": "$1", "room_id": "!room:example.com", "sender": "@alice:example.com", "origin_server_ts": %d, "content": {}},
+		{"type": "m.room.message", "event_id": "$2", "room_id": "!room:example.com", "sender": "@alice:example.com", "origin_server_ts": %d, "content": {}}
+	]}`, sentAt-1000, sentAt)
+	code, _ := doRequest(t, client, http.MethodPut, "http://appservice/_matrix/app/v1/transactions/1", strings.NewReader(txn))
+	require.Equal(t, http.StatusOK, code)
+
+	resp, err := client.Get("http://appservice/metrics")
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	// Empty the queue so that stopping the appservice doesn't wait for it.
+	<-as.Events
+	<-as.Events
+	metrics := string(data)
+	assert.Contains(t, metrics, "mautrix_appservice_transactions_total 1\n")
+	assert.Contains(t, metrics, "mautrix_appservice_events_total 2\n")
+	assert.Contains(t, metrics, "mautrix_appservice_event_queue_depth 2\n")
+	assert.Contains(t, metrics, "mautrix_appservice_homeserver_reachable 1\n")
+	assert.Contains(t, metrics, "mautrix_appservice_ready 0\n")
+	// The lag is measured from the newest event in the transaction.
+	match := regexp.MustCompile(`(?m)^mautrix_appservice_transaction_lag_seconds (\S+)$`).FindStringSubmatch(metrics)
+	require.NotNil(t, match)
+	lag, err := strconv.ParseFloat(match[1], 64)
+	require.NoError(t, err)
+	assert.True(t, lag >= 2 && lag < 3, "unexpected lag %v", lag)
+}
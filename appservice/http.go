@@ -8,11 +8,14 @@ package appservice
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -23,54 +26,210 @@ import (
 )
 
 // Start starts the HTTP server that listens for calls from the Matrix homeserver.
+//
+// The listener is configured with the Host field: it can listen on a unix socket, use TLS,
+// serve the endpoints under a path prefix and limit request sizes and durations.
+//
+// The appservice can be started again after Stop has returned. If Start is called while Stop is still
+// in progress, it returns immediately without listening.
 func (as *AppService) Start() {
-	as.Router.HandleFunc("/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
-	as.Router.HandleFunc("/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
-	as.Router.HandleFunc("/users/{userID}", as.GetUser).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
-	as.Router.HandleFunc("/_matrix/app/v1/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/app/v1/users/{userID}", as.GetUser).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/mau/live", as.GetLive).Methods(http.MethodGet)
-	as.Router.HandleFunc("/_matrix/mau/ready", as.GetReady).Methods(http.MethodGet)
+	as.registerRoutesOnce.Do(as.registerRoutes)
+
+	var handler http.Handler = as.Router
+	if as.Host.MaxBodySize > 0 {
+		handler = limitBodySize(handler, as.Host.MaxBodySize)
+	}
+	server := &http.Server{
+		Addr:         as.Host.Address(),
+		Handler:      handler,
+		ReadTimeout:  as.Host.ReadTimeout,
+		WriteTimeout: as.Host.WriteTimeout,
+		IdleTimeout:  as.Host.IdleTimeout,
+	}
+	// Stop may be called concurrently, so the server is only published while holding the lifecycle lock.
+	// If Stop gets the server before it starts serving, Serve returns http.ErrServerClosed immediately.
+	as.stopLock.Lock()
+	if as.stopping {
+		as.stopLock.Unlock()
+		as.Log.Warnln("Not starting listener, the appservice is stopping")
+		return
+	}
+	as.server = server
+	as.stopLock.Unlock()
 
+	var listener net.Listener
 	var err error
-	as.server = &http.Server{
-		Addr:    as.Host.Address(),
-		Handler: as.Router,
+	if as.Host.IsUnixSocket() {
+		// Remove a stale socket left behind by a previous run, but never delete anything else at the path.
+		if info, statErr := os.Lstat(as.Host.Hostname); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(as.Host.Hostname)
+		}
+		listener, err = net.Listen("unix", as.Host.Hostname)
+	} else {
+		listener, err = net.Listen("tcp", as.Host.Address())
+	}
+	if err != nil {
+		as.Log.Fatalln("Error while listening:", err)
+		return
 	}
 	as.Log.Infoln("Listening on", as.Host.Address())
-	if len(as.Host.TLSCert) == 0 || len(as.Host.TLSKey) == 0 {
-		err = as.server.ListenAndServe()
+	if as.Host.IsTLS() {
+		err = server.ServeTLS(listener, as.Host.TLSCert, as.Host.TLSKey)
 	} else {
-		err = as.server.ListenAndServeTLS(as.Host.TLSCert, as.Host.TLSKey)
+		err = server.Serve(listener)
 	}
-	if err != nil && err.Error() != "http: Server closed" {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		as.Log.Fatalln("Error while listening:", err)
 	} else {
 		as.Log.Debugln("Listener stopped.")
 	}
 }
 
-func (as *AppService) Stop() {
-	if as.server == nil {
-		return
+// registerRoutes adds the appservice API endpoints to the router. It's only called once, so that restarting
+// the appservice doesn't register the routes again.
+func (as *AppService) registerRoutes() {
+	router := as.Router
+	if len(as.Host.PathPrefix) > 0 {
+		router = as.Router.PathPrefix(as.Host.PathPrefix).Subrouter()
+	}
+	router.HandleFunc("/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
+	router.HandleFunc("/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
+	router.HandleFunc("/users/{userID}", as.GetUser).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
+	router.HandleFunc("/_matrix/app/v1/rooms/{roomAlias}", as.GetRoom).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/app/v1/users/{userID}", as.GetUser).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/app/v1/thirdparty/protocol/{protocol}", as.GetThirdPartyProtocol).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/app/v1/thirdparty/user", as.ReverseGetThirdPartyUser).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/app/v1/thirdparty/location", as.ReverseGetThirdPartyLocation).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/app/v1/thirdparty/user/{protocol}", as.GetThirdPartyUser).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/app/v1/thirdparty/location/{protocol}", as.GetThirdPartyLocation).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/mau/live", as.GetLive).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/mau/ready", as.GetReady).Methods(http.MethodGet)
+	if as.EnableHealthEndpoints {
+		router.HandleFunc("/_health/live", as.GetHealthLive).Methods(http.MethodGet)
+		router.HandleFunc("/_health/ready", as.GetHealthReady).Methods(http.MethodGet)
 	}
+	if as.EnableMetricsEndpoint {
+		router.HandleFunc("/metrics", as.GetMetrics).Methods(http.MethodGet)
+	}
+}
+
+func limitBodySize(next http.Handler, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxSize {
+			Error{
+				ErrorCode:  ErrTooLarge,
+				HTTPStatus: http.StatusRequestEntityTooLarge,
+				Message:    "Request body too large",
+			}.Write(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StateStoreFlusher is an optional interface for state stores that buffer writes.
+// If the StateStore implements it, Stop will flush the store before returning.
+type StateStoreFlusher interface {
+	Flush() error
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	_ = as.server.Shutdown(ctx)
+// Stop gracefully shuts down the appservice.
+//
+// New transactions are rejected with HTTP 503 so that the homeserver retries them later.
+// After that, Stop waits for transactions that are already being handled, for the event queue to be
+// emptied, and then stops all EventProcessors and waits for their handlers to return. Finally, the HTTP server is shut
+// down and the state store is flushed. If the context is canceled before everything is done,
+// the HTTP server is closed immediately and the context error is returned.
+//
+// The stopped event processors are removed from the appservice. After Stop returns, the appservice can be
+// started again with Start, but new event processors must be created, as stopped ones can't be restarted.
+func (as *AppService) Stop(ctx context.Context) error {
+	as.stopLock.Lock()
+	as.stopping = true
+	server := as.server
 	as.server = nil
+	as.stopLock.Unlock()
+
+	err := as.drain(ctx)
+	if server != nil {
+		if err != nil {
+			_ = server.Close()
+		} else {
+			err = server.Shutdown(ctx)
+		}
+	}
+	if flusher, ok := as.StateStore.(StateStoreFlusher); ok {
+		if flushErr := flusher.Flush(); flushErr != nil && err == nil {
+			err = fmt.Errorf("failed to flush state store: %w", flushErr)
+		}
+	}
+	as.stopLock.Lock()
+	as.stopping = false
+	as.stopLock.Unlock()
+	return err
+}
+
+func (as *AppService) drain(ctx context.Context) error {
+	if err := waitWithContext(ctx, &as.inFlightTxns); err != nil {
+		return fmt.Errorf("failed to wait for in-flight transactions: %w", err)
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for len(as.Events) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("failed to wait for event queue to drain: %w", ctx.Err())
+		}
+	}
+	as.processorsLock.Lock()
+	processors := as.eventProcessors
+	as.processorsLock.Unlock()
+	for _, ep := range processors {
+		ep.Stop()
+		if err := ep.Wait(ctx); err != nil {
+			return fmt.Errorf("failed to wait for event handlers: %w", err)
+		}
+	}
+	return nil
+}
+
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startTransaction marks a transaction as in-flight, unless the appservice is stopping.
+func (as *AppService) startTransaction() bool {
+	as.stopLock.RLock()
+	defer as.stopLock.RUnlock()
+	if as.stopping {
+		return false
+	}
+	as.inFlightTxns.Add(1)
+	return true
 }
 
 // CheckServerToken checks if the given request originated from the Matrix homeserver.
 func (as *AppService) CheckServerToken(w http.ResponseWriter, r *http.Request) (isValid bool) {
 	authHeader := r.Header.Get("Authorization")
 	if len(authHeader) > 0 && strings.HasPrefix(authHeader, "Bearer ") {
-		isValid = authHeader[len("Bearer "):] == as.Registration.ServerToken
+		isValid = as.isValidServerToken(authHeader[len("Bearer "):])
 	} else {
 		queryToken := r.URL.Query().Get("access_token")
 		if len(queryToken) > 0 {
-			isValid = queryToken == as.Registration.ServerToken
+			isValid = as.isValidServerToken(queryToken)
 		} else {
 			Error{
 				ErrorCode:  ErrUnknownToken,
@@ -94,7 +253,15 @@ func (as *AppService) CheckServerToken(w http.ResponseWriter, r *http.Request) (
 func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 	if !as.CheckServerToken(w, r) {
 		return
+	} else if !as.startTransaction() {
+		Error{
+			ErrorCode:  ErrShuttingDown,
+			HTTPStatus: http.StatusServiceUnavailable,
+			Message:    "Appservice is shutting down",
+		}.Write(w)
+		return
 	}
+	defer as.inFlightTxns.Done()
 
 	vars := mux.Vars(r)
 	txnID := vars["txnID"]
@@ -124,7 +291,7 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var txn Transaction
-	err = json.Unmarshal(body, &txn)
+	err = as.parseTransaction(body, &txn)
 	if err != nil {
 		as.Log.Warnfln("Failed to parse JSON of transaction %s: %v", txnID, err)
 		Error{
@@ -133,6 +300,7 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 			Message:    "Failed to parse body JSON",
 		}.Write(w)
 	} else {
+		as.stats.markTransaction(&txn)
 		as.handleTransaction(txnID, &txn)
 		WriteBlankOK(w)
 	}
@@ -140,7 +308,7 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 
 func (as *AppService) handleTransaction(id string, txn *Transaction) {
 	as.Log.Debugfln("Starting handling of transaction %s (%s)", id, txn.ContentString())
-	if as.Registration.EphemeralEvents {
+	if as.GetRegistration().EphemeralEvents {
 		if txn.EphemeralEvents != nil {
 			as.handleEvents(txn.EphemeralEvents, event.EphemeralEventType)
 		} else if txn.MSC2409EphemeralEvents != nil {
@@ -204,8 +372,7 @@ func (as *AppService) handleEvents(evts []*event.Event, defaultTypeClass event.T
 
 		if evt.Type.IsState() {
 			// TODO remove this check after https://github.com/matrix-org/synapse/pull/11265
-			historical, ok := evt.Content.Raw["org.matrix.msc2716.historical"].(bool)
-			if !ok || !historical {
+			if !evt.IsHistorical() {
 				as.UpdateState(evt)
 			}
 		}
@@ -213,44 +380,6 @@ func (as *AppService) handleEvents(evts []*event.Event, defaultTypeClass event.T
 	}
 }
 
-// GetRoom handles a /rooms GET call from the homeserver.
-func (as *AppService) GetRoom(w http.ResponseWriter, r *http.Request) {
-	if !as.CheckServerToken(w, r) {
-		return
-	}
-
-	vars := mux.Vars(r)
-	roomAlias := vars["roomAlias"]
-	ok := as.QueryHandler.QueryAlias(roomAlias)
-	if ok {
-		WriteBlankOK(w)
-	} else {
-		Error{
-			ErrorCode:  ErrUnknown,
-			HTTPStatus: http.StatusNotFound,
-		}.Write(w)
-	}
-}
-
-// GetUser handles a /users GET call from the homeserver.
-func (as *AppService) GetUser(w http.ResponseWriter, r *http.Request) {
-	if !as.CheckServerToken(w, r) {
-		return
-	}
-
-	vars := mux.Vars(r)
-	userID := id.UserID(vars["userID"])
-	ok := as.QueryHandler.QueryUser(userID)
-	if ok {
-		WriteBlankOK(w)
-	} else {
-		Error{
-			ErrorCode:  ErrUnknown,
-			HTTPStatus: http.StatusNotFound,
-		}.Write(w)
-	}
-}
-
 func (as *AppService) GetLive(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 	if as.Live {
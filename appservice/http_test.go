@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// startUnixSocketListener starts the appservice on a unix socket in a temporary directory and stops it when
+// the test is done. It returns a client that sends all requests to the socket.
+func startUnixSocketListener(t *testing.T, as *appservice.AppService) *http.Client {
+	if len(as.Host.Hostname) == 0 {
+		as.Host.Hostname = filepath.Join(t.TempDir(), "as.sock")
+	}
+	as.Live = true
+	client := newUnixSocketClient(as.Host.Hostname)
+	done := make(chan struct{})
+	go func() {
+		as.Start()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.CloseIdleConnections()
+		assert.NoError(t, as.Stop(context.Background()))
+		<-done
+	})
+	waitForLive(t, client, as.Host.PathPrefix)
+	return client
+}
+
+func doRequest(t *testing.T, client *http.Client, method, url string, body io.Reader) (int, appservice.Error) {
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer hs_token")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var respErr appservice.Error
+	_ = json.NewDecoder(resp.Body).Decode(&respErr)
+	return resp.StatusCode, respErr
+}
+
+func TestAppService_Start_PathPrefix(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.Host.PathPrefix = "/appservice"
+	client := startUnixSocketListener(t, as)
+
+	status, _ := doRequest(t, client, http.MethodPut, "http://appservice/appservice/_matrix/app/v1/transactions/1", strings.NewReader(`{"events": []}`))
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = doRequest(t, client, http.MethodPut, "http://appservice/appservice/transactions/2", strings.NewReader(`{"events": []}`))
+	assert.Equal(t, http.StatusOK, status)
+	// The endpoints aren't served without the prefix.
+	status, _ = doRequest(t, client, http.MethodPut, "http://appservice/_matrix/app/v1/transactions/3", strings.NewReader(`{"events": []}`))
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestAppService_Start_MaxBodySize(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.Host.MaxBodySize = 32
+	client := startUnixSocketListener(t, as)
+
+	status, _ := doRequest(t, client, http.MethodPut, "http://appservice/_matrix/app/v1/transactions/1", strings.NewReader(`{"events": []}`))
+	assert.Equal(t, http.StatusOK, status)
+
+	largeBody := `{"events": [], "padding": "` + strings.Repeat("a", 64) + `"}`
+	status, respErr := doRequest(t, client, http.MethodPut, "http://appservice/_matrix/app/v1/transactions/2", strings.NewReader(largeBody))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, appservice.ErrTooLarge, respErr.ErrorCode)
+
+	// Bodies without a Content-Length header are cut off at the limit instead.
+	status, _ = doRequest(t, client, http.MethodPut, "http://appservice/_matrix/app/v1/transactions/3", io.MultiReader(strings.NewReader(largeBody)))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestAppService_Start_UnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "as.sock")
+	// Leave a stale socket behind, like a process that crashed would.
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, listener.Close())
+
+	as := newTestAppService(t, nil)
+	as.Host.Hostname = socketPath
+	assert.True(t, as.Host.IsUnixSocket())
+	assert.Equal(t, socketPath, as.Host.Address())
+	startUnixSocketListener(t, as)
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSocket)
+}
+
+func TestAppService_Start_Timeouts(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.Host.ReadTimeout = 100 * time.Millisecond
+	startUnixSocketListener(t, as)
+
+	// A client that never finishes sending its request is disconnected after the read timeout.
+	conn, err := net.Dial("unix", as.Host.Hostname)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /_matrix/mau/live HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "connection wasn't closed by the server")
+}
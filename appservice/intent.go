@@ -10,7 +10,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strings"
+	"sync"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -25,6 +25,13 @@ type IntentAPI struct {
 	UserID    id.UserID
 
 	IsCustomPuppet bool
+
+	registerLock sync.Mutex
+	joinLocks    roomLocks
+
+	directChatsLock     sync.Mutex
+	directChatCache     map[id.UserID]id.RoomID
+	directChatCacheLock sync.Mutex
 }
 
 func (as *AppService) NewIntentAPI(localpart string) *IntentAPI {
@@ -58,9 +65,19 @@ func (intent *IntentAPI) EnsureRegistered() error {
 		return nil
 	}
 
+	// Only let one goroutine register at a time, the others will see the updated state store after the lock is released.
+	intent.registerLock.Lock()
+	defer intent.registerLock.Unlock()
+	if intent.as.StateStore.IsRegistered(intent.UserID) {
+		return nil
+	}
+
 	err := intent.Register()
 	if err != nil && !errors.Is(err, mautrix.MUserInUse) {
-		return fmt.Errorf("failed to ensure registered: %w", err)
+		if errors.Is(err, mautrix.MExclusive) || errors.Is(err, mautrix.MInvalidUsername) {
+			return &IntentError{Op: "ensure registered", Kind: ErrNotRegistered, Err: err}
+		}
+		return classifyError("ensure registered", err, ErrNotRegistered, nil)
 	}
 	intent.as.StateStore.MarkRegistered(intent.UserID)
 	return nil
@@ -82,6 +99,13 @@ func (intent *IntentAPI) EnsureJoined(roomID id.RoomID, extra ...EnsureJoinedPar
 		return nil
 	}
 
+	// Concurrent calls for the same room wait for the first one instead of racing joins and invites.
+	intent.joinLocks.Lock(roomID)
+	defer intent.joinLocks.Unlock(roomID)
+	if intent.as.StateStore.IsInRoom(roomID, intent.UserID) && !params.IgnoreCache {
+		return nil
+	}
+
 	if err := intent.EnsureRegistered(); err != nil {
 		return fmt.Errorf("failed to ensure joined: %w", err)
 	}
@@ -93,17 +117,17 @@ func (intent *IntentAPI) EnsureJoined(roomID id.RoomID, extra ...EnsureJoinedPar
 			bot = params.BotOverride
 		}
 		if !errors.Is(err, mautrix.MForbidden) || bot == nil {
-			return fmt.Errorf("failed to ensure joined: %w", err)
+			return classifyError("ensure joined", err, ErrNotInvited, ErrRoomNotFound)
 		}
 		_, inviteErr := bot.InviteUser(roomID, &mautrix.ReqInviteUser{
 			UserID: intent.UserID,
 		})
 		if inviteErr != nil {
-			return fmt.Errorf("failed to invite in ensure joined: %w", inviteErr)
+			return classifyError("invite in ensure joined", inviteErr, ErrNotInvited, ErrRoomNotFound)
 		}
 		resp, err = intent.JoinRoomByID(roomID)
 		if err != nil {
-			return fmt.Errorf("failed to ensure joined after invite: %w", err)
+			return classifyError("ensure joined after invite", err, ErrNotInvited, ErrRoomNotFound)
 		}
 	}
 	intent.as.StateStore.SetMembership(resp.RoomID, intent.UserID, event.MembershipJoin)
@@ -114,14 +138,41 @@ func (intent *IntentAPI) SendMessageEvent(roomID id.RoomID, eventType event.Type
 	if err := intent.EnsureJoined(roomID); err != nil {
 		return nil, err
 	}
-	return intent.Client.SendMessageEvent(roomID, eventType, contentJSON)
+	eventType, contentJSON, err := intent.encryptIfNeeded(roomID, eventType, contentJSON)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := intent.Client.SendMessageEvent(roomID, eventType, contentJSON)
+	return resp, classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
 }
 
 func (intent *IntentAPI) SendMassagedMessageEvent(roomID id.RoomID, eventType event.Type, contentJSON interface{}, ts int64) (*mautrix.RespSendEvent, error) {
 	if err := intent.EnsureJoined(roomID); err != nil {
 		return nil, err
 	}
-	return intent.Client.SendMessageEvent(roomID, eventType, contentJSON, mautrix.ReqSendEvent{Timestamp: ts})
+	eventType, contentJSON, err := intent.encryptIfNeeded(roomID, eventType, contentJSON)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := intent.Client.SendMessageEvent(roomID, eventType, contentJSON, mautrix.ReqSendEvent{Timestamp: ts})
+	return resp, classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
+}
+
+// encryptIfNeeded encrypts the given event using the appservice's crypto helper if the room is encrypted.
+// Relations (including reactions) stay visible to the server as long as the crypto helper copies m.relates_to
+// to the unencrypted content like crypto.OlmMachine does.
+func (intent *IntentAPI) encryptIfNeeded(roomID id.RoomID, eventType event.Type, contentJSON interface{}) (event.Type, interface{}, error) {
+	if intent.as.Crypto == nil || eventType == event.EventEncrypted {
+		return eventType, contentJSON, nil
+	}
+	if !intent.as.StateStore.IsEncrypted(roomID) {
+		return eventType, contentJSON, nil
+	}
+	encrypted, err := intent.as.Crypto.Encrypt(roomID, eventType, contentJSON)
+	if err != nil {
+		return eventType, nil, fmt.Errorf("failed to encrypt %s event: %w", eventType.Type, err)
+	}
+	return event.EventEncrypted, encrypted, nil
 }
 
 func (intent *IntentAPI) updateStoreWithOutgoingEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, eventID id.EventID) {
@@ -160,7 +211,7 @@ func (intent *IntentAPI) SendStateEvent(roomID id.RoomID, eventType event.Type,
 	if err == nil && resp != nil {
 		intent.updateStoreWithOutgoingEvent(roomID, eventType, stateKey, contentJSON, resp.EventID)
 	}
-	return resp, err
+	return resp, classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
 }
 
 func (intent *IntentAPI) SendMassagedStateEvent(roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, ts int64) (*mautrix.RespSendEvent, error) {
@@ -171,7 +222,7 @@ func (intent *IntentAPI) SendMassagedStateEvent(roomID id.RoomID, eventType even
 	if err == nil && resp != nil {
 		intent.updateStoreWithOutgoingEvent(roomID, eventType, stateKey, contentJSON, resp.EventID)
 	}
-	return resp, err
+	return resp, classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
 }
 
 func (intent *IntentAPI) StateEvent(roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error {
@@ -191,20 +242,141 @@ func (intent *IntentAPI) State(roomID id.RoomID) (mautrix.RoomStateMap, error) {
 	}
 	state, err := intent.Client.State(roomID)
 	if err == nil {
-		for _, events := range state {
-			for _, evt := range events {
-				intent.as.UpdateState(evt)
+		var events []*event.Event
+		for _, stateKeyMap := range state {
+			for _, evt := range stateKeyMap {
+				events = append(events, evt)
 			}
 		}
+		intent.as.StateStore.ReplaceRoomState(roomID, events)
 	}
 	return state, err
 }
 
+func intPtr(val int) *int {
+	return &val
+}
+
+// createRoomPowerLevels returns the power levels the server will generate for a room created with the given request.
+// The defaults of the preset are overridden by each top-level field that is set in the override, like the server does,
+// so e.g. overriding the users object means the creator (and invitees of trusted private chats) don't get the admin
+// level automatically.
+func createRoomPowerLevels(creator id.UserID, req *mautrix.ReqCreateRoom) *event.PowerLevelsEventContent {
+	preset := req.Preset
+	if len(preset) == 0 {
+		preset = "private_chat"
+		if req.Visibility == "public" {
+			preset = "public_chat"
+		}
+	}
+	pl := &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{creator: 100},
+		Events: map[string]int{
+			event.StateRoomName.Type:          50,
+			event.StatePowerLevels.Type:       100,
+			event.StateHistoryVisibility.Type: 100,
+			event.StateCanonicalAlias.Type:    50,
+			event.StateRoomAvatar.Type:        50,
+			event.StateTombstone.Type:         100,
+			event.StateServerACL.Type:         100,
+			event.StateEncryption.Type:        100,
+		},
+		StateDefaultPtr: intPtr(50),
+		InvitePtr:       intPtr(50),
+		KickPtr:         intPtr(50),
+		BanPtr:          intPtr(50),
+		RedactPtr:       intPtr(50),
+		HistoricalPtr:   intPtr(100),
+	}
+	if preset != "public_chat" {
+		pl.InvitePtr = intPtr(0)
+	}
+	if preset == "trusted_private_chat" {
+		for _, userID := range req.Invite {
+			pl.Users[userID] = 100
+		}
+	}
+
+	override := req.PowerLevelOverride.Clone()
+	if override == nil {
+		return pl
+	}
+	// Empty maps and zero defaults are omitted when the override is serialized, so they don't replace anything.
+	if len(override.Users) > 0 {
+		pl.Users = override.Users
+	}
+	if override.UsersDefault != 0 {
+		pl.UsersDefault = override.UsersDefault
+	}
+	if len(override.Events) > 0 {
+		pl.Events = override.Events
+	}
+	if override.EventsDefault != 0 {
+		pl.EventsDefault = override.EventsDefault
+	}
+	if override.StateDefaultPtr != nil {
+		pl.StateDefaultPtr = override.StateDefaultPtr
+	}
+	if override.InvitePtr != nil {
+		pl.InvitePtr = override.InvitePtr
+	}
+	if override.KickPtr != nil {
+		pl.KickPtr = override.KickPtr
+	}
+	if override.BanPtr != nil {
+		pl.BanPtr = override.BanPtr
+	}
+	if override.RedactPtr != nil {
+		pl.RedactPtr = override.RedactPtr
+	}
+	if override.HistoricalPtr != nil {
+		pl.HistoricalPtr = override.HistoricalPtr
+	}
+	if override.Notifications != nil {
+		pl.Notifications = override.Notifications
+	}
+	// Unknown top-level keys are copied into the power levels as-is.
+	pl.Extra = override.Extra
+	return pl
+}
+
+// CreateRoom creates a room and fills the state store with the state that is known to exist after creation:
+// the creator's membership, the power levels, the initial state events, the name and topic, and invites.
+func (intent *IntentAPI) CreateRoom(req *mautrix.ReqCreateRoom) (*mautrix.RespCreateRoom, error) {
+	if err := intent.EnsureRegistered(); err != nil {
+		return nil, err
+	}
+	resp, err := intent.Client.CreateRoom(req)
+	if err != nil {
+		return nil, err
+	}
+	intent.as.StateStore.SetMembership(resp.RoomID, intent.UserID, event.MembershipJoin)
+	// The server sends the power levels before the initial state, so any power levels in the initial state win.
+	intent.updateStoreWithOutgoingEvent(resp.RoomID, event.StatePowerLevels, "", createRoomPowerLevels(intent.UserID, req), "")
+	for _, evt := range req.InitialState {
+		evtType := evt.Type
+		evtType.Class = event.StateEventType
+		intent.updateStoreWithOutgoingEvent(resp.RoomID, evtType, evt.GetStateKey(), &evt.Content, "")
+	}
+	// The name and topic fields are sent after the initial state, so they override any name or topic in it.
+	if len(req.Name) > 0 {
+		intent.as.StateStore.SetRoomName(resp.RoomID, req.Name)
+	}
+	if len(req.Topic) > 0 {
+		intent.as.StateStore.SetRoomTopic(resp.RoomID, req.Topic)
+	}
+	for _, userID := range req.Invite {
+		intent.as.StateStore.SetMembership(resp.RoomID, userID, event.MembershipInvite)
+	}
+	return resp, nil
+}
+
 func (intent *IntentAPI) InviteUser(roomID id.RoomID, req *mautrix.ReqInviteUser) (resp *mautrix.RespInviteUser, err error) {
 	resp, err = intent.Client.InviteUser(roomID, req)
 	if err == nil {
 		intent.as.StateStore.SetMembership(roomID, req.UserID, event.MembershipInvite)
 	}
+	err = classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
 	return
 }
 
@@ -213,6 +385,7 @@ func (intent *IntentAPI) KickUser(roomID id.RoomID, req *mautrix.ReqKickUser) (r
 	if err == nil {
 		intent.as.StateStore.SetMembership(roomID, req.UserID, event.MembershipLeave)
 	}
+	err = classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
 	return
 }
 
@@ -221,6 +394,7 @@ func (intent *IntentAPI) BanUser(roomID id.RoomID, req *mautrix.ReqBanUser) (res
 	if err == nil {
 		intent.as.StateStore.SetMembership(roomID, req.UserID, event.MembershipBan)
 	}
+	err = classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
 	return
 }
 
@@ -229,6 +403,7 @@ func (intent *IntentAPI) UnbanUser(roomID id.RoomID, req *mautrix.ReqUnbanUser)
 	if err == nil {
 		intent.as.StateStore.SetMembership(roomID, req.UserID, event.MembershipLeave)
 	}
+	err = classifyError("", err, ErrPowerLevelTooLow, ErrRoomNotFound)
 	return
 }
 
@@ -253,6 +428,22 @@ func (intent *IntentAPI) PowerLevels(roomID id.RoomID) (pl *event.PowerLevelsEve
 	return
 }
 
+// SetBridgeInfo publishes or updates the bridge info of a portal room using both the stable m.bridge and
+// the unstable uk.half-shot.bridge event types. If stateKey is empty, it's generated with event.BridgeInfoStateKey
+// using the bridge bot's localpart as the bridge name.
+func (intent *IntentAPI) SetBridgeInfo(roomID id.RoomID, stateKey string, content *event.BridgeEventContent) error {
+	if len(stateKey) == 0 {
+		bridgeName, _, _ := content.BridgeBot.Parse()
+		stateKey = event.BridgeInfoStateKey(bridgeName, content)
+	}
+	if _, err := intent.SendStateEvent(roomID, event.StateBridge, stateKey, content); err != nil {
+		return err
+	} else if _, err = intent.SendStateEvent(roomID, event.StateHalfShotBridge, stateKey, content); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (intent *IntentAPI) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) (resp *mautrix.RespSendEvent, err error) {
 	resp, err = intent.SendStateEvent(roomID, event.StatePowerLevels, "", &levels)
 	if err == nil {
@@ -268,12 +459,72 @@ func (intent *IntentAPI) SetPowerLevel(roomID id.RoomID, userID id.UserID, level
 	}
 
 	if pl.GetUserLevel(userID) != level {
+		// The power levels may be the state store's own copy, which must only change once the event is sent.
+		pl = pl.Clone()
 		pl.SetUserLevel(userID, level)
 		return intent.SendStateEvent(roomID, event.StatePowerLevels, "", &pl)
 	}
 	return nil, nil
 }
 
+// PowerLevelMutator modifies the given power levels in-place and returns true if anything was changed.
+type PowerLevelMutator func(pl *event.PowerLevelsEventContent) bool
+
+// PowerLevelRetries is the number of times ModifyPowerLevels will refetch the power levels
+// and retry if sending the modified power levels is rejected.
+var PowerLevelRetries = 2
+
+// ModifyPowerLevels applies all the given mutators to the current power levels of the room and sends
+// at most one power level event. If the homeserver rejects the change (e.g. because the cached power
+// levels were outdated after a conflicting update), the latest power levels are fetched from the
+// server and the mutators are applied again.
+//
+// If none of the mutators change anything, nothing is sent and the returned response is nil.
+func (intent *IntentAPI) ModifyPowerLevels(roomID id.RoomID, mutators ...PowerLevelMutator) (*mautrix.RespSendEvent, error) {
+	for attempt := 0; ; attempt++ {
+		var pl *event.PowerLevelsEventContent
+		var err error
+		if attempt == 0 {
+			pl, err = intent.PowerLevels(roomID)
+		} else {
+			pl = &event.PowerLevelsEventContent{}
+			err = intent.StateEvent(roomID, event.StatePowerLevels, "", pl)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pl = pl.Clone()
+		changed := false
+		for _, mutate := range mutators {
+			if mutate(pl) {
+				changed = true
+			}
+		}
+		if !changed {
+			return nil, nil
+		}
+		resp, err := intent.SendStateEvent(roomID, event.StatePowerLevels, "", pl)
+		if err == nil || attempt >= PowerLevelRetries || !errors.Is(err, mautrix.MForbidden) {
+			return resp, err
+		}
+		intent.Logger.Debugfln("Failed to send modified power levels to %s (attempt #%d), refetching and retrying: %v", roomID, attempt+1, err)
+	}
+}
+
+// EnsureUserLevel makes sure the given user has the given power level in the room.
+func (intent *IntentAPI) EnsureUserLevel(roomID id.RoomID, userID id.UserID, level int) (*mautrix.RespSendEvent, error) {
+	return intent.ModifyPowerLevels(roomID, func(pl *event.PowerLevelsEventContent) bool {
+		return pl.EnsureUserLevel(userID, level)
+	})
+}
+
+// EnsureEventLevel makes sure sending the given event type requires the given power level in the room.
+func (intent *IntentAPI) EnsureEventLevel(roomID id.RoomID, eventType event.Type, level int) (*mautrix.RespSendEvent, error) {
+	return intent.ModifyPowerLevels(roomID, func(pl *event.PowerLevelsEventContent) bool {
+		return pl.EnsureEventLevel(eventType, level)
+	})
+}
+
 func (intent *IntentAPI) UserTyping(roomID id.RoomID, typing bool, timeout int64) (resp *mautrix.RespTyping, err error) {
 	if intent.as.StateStore.IsTyping(roomID, intent.UserID) == typing {
 		return
@@ -289,39 +540,98 @@ func (intent *IntentAPI) UserTyping(roomID id.RoomID, typing bool, timeout int64
 	return
 }
 
-func (intent *IntentAPI) SendText(roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
+// SendReceipt sends a receipt of the given type after making sure the intent is joined to the room.
+// The content can be a *mautrix.ReqSendReceipt to make the receipt threaded.
+func (intent *IntentAPI) SendReceipt(roomID id.RoomID, eventID id.EventID, receiptType event.ReceiptType, content interface{}) error {
 	if err := intent.EnsureJoined(roomID); err != nil {
-		return nil, err
+		return err
 	}
-	return intent.Client.SendText(roomID, text)
+	return intent.Client.SendReceipt(roomID, eventID, receiptType, content)
 }
 
-func (intent *IntentAPI) SendImage(roomID id.RoomID, body string, url id.ContentURI) (*mautrix.RespSendEvent, error) {
+// MarkRead sends a normal unthreaded public read receipt for the given event.
+func (intent *IntentAPI) MarkRead(roomID id.RoomID, eventID id.EventID) error {
+	return intent.SendReceipt(roomID, eventID, event.ReceiptTypeRead, nil)
+}
+
+// MarkReadThread sends a threaded read receipt. The thread ID should be the root event ID of the thread,
+// or event.ReceiptThreadMain for events that aren't in a thread.
+func (intent *IntentAPI) MarkReadThread(roomID id.RoomID, eventID id.EventID, threadID string) error {
+	return intent.SendReceipt(roomID, eventID, event.ReceiptTypeRead, &mautrix.ReqSendReceipt{ThreadID: threadID})
+}
+
+// MarkReadPrivate sends a private read receipt, which is only visible to the intent's own user.
+func (intent *IntentAPI) MarkReadPrivate(roomID id.RoomID, eventID id.EventID) error {
+	return intent.SendReceipt(roomID, eventID, event.ReceiptTypeReadPrivate, nil)
+}
+
+// SetReadMarkers sets the fully read marker and optionally the public and private read receipts.
+// The content is usually a *mautrix.ReqSetReadMarkers.
+func (intent *IntentAPI) SetReadMarkers(roomID id.RoomID, content interface{}) error {
 	if err := intent.EnsureJoined(roomID); err != nil {
-		return nil, err
+		return err
 	}
-	return intent.Client.SendImage(roomID, body, url)
+	return intent.Client.SetReadMarkers(roomID, content)
+}
+
+func (intent *IntentAPI) SendText(roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
+	return intent.SendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    text,
+	})
+}
+
+func (intent *IntentAPI) SendImage(roomID id.RoomID, body string, url id.ContentURI) (*mautrix.RespSendEvent, error) {
+	return intent.SendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    body,
+		URL:     url.CUString(),
+	})
 }
 
 func (intent *IntentAPI) SendVideo(roomID id.RoomID, body string, url id.ContentURI) (*mautrix.RespSendEvent, error) {
-	if err := intent.EnsureJoined(roomID); err != nil {
-		return nil, err
-	}
-	return intent.Client.SendVideo(roomID, body, url)
+	return intent.SendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgVideo,
+		Body:    body,
+		URL:     url.CUString(),
+	})
 }
 
 func (intent *IntentAPI) SendNotice(roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
-	if err := intent.EnsureJoined(roomID); err != nil {
-		return nil, err
-	}
-	return intent.Client.SendNotice(roomID, text)
+	return intent.SendMessageEvent(roomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	})
+}
+
+func (intent *IntentAPI) SendReaction(roomID id.RoomID, eventID id.EventID, reaction string) (*mautrix.RespSendEvent, error) {
+	return intent.SendMessageEvent(roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{
+			EventID: eventID,
+			Type:    event.RelAnnotation,
+			Key:     reaction,
+		},
+	})
 }
 
+// RedactEvent redacts the given event. If the intent doesn't have permission to redact the event,
+// the redaction is retried with the appservice bot, similar to how EnsureJoined falls back to a bot invite.
 func (intent *IntentAPI) RedactEvent(roomID id.RoomID, eventID id.EventID, req ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error) {
 	if err := intent.EnsureJoined(roomID); err != nil {
 		return nil, err
 	}
-	return intent.Client.RedactEvent(roomID, eventID, req...)
+	resp, err := intent.Client.RedactEvent(roomID, eventID, req...)
+	if err != nil && errors.Is(err, mautrix.MForbidden) && intent.bot != nil {
+		botIntent := intent.as.BotIntent()
+		var botErr error
+		resp, botErr = botIntent.RedactEvent(roomID, eventID, req...)
+		if botErr != nil {
+			// The bot intent already classified the error, so only add context here.
+			return nil, fmt.Errorf("failed to redact with bot after %v: %w", err, botErr)
+		}
+		return resp, nil
+	}
+	return resp, classifyError("", err, ErrPowerLevelTooLow, nil)
 }
 
 func (intent *IntentAPI) SetRoomName(roomID id.RoomID, roomName string) (*mautrix.RespSendEvent, error) {
@@ -336,24 +646,72 @@ func (intent *IntentAPI) SetRoomAvatar(roomID id.RoomID, avatarURL id.ContentURI
 	})
 }
 
+// PinEvent pins the given event in the room, unless it's already pinned.
+func (intent *IntentAPI) PinEvent(roomID id.RoomID, eventID id.EventID) error {
+	if err := intent.EnsureJoined(roomID); err != nil {
+		return err
+	}
+	return classifyError("pin event", intent.Client.PinEvent(roomID, eventID), ErrPowerLevelTooLow, nil)
+}
+
+// UnpinEvent unpins the given event in the room.
+func (intent *IntentAPI) UnpinEvent(roomID id.RoomID, eventID id.EventID) error {
+	if err := intent.EnsureJoined(roomID); err != nil {
+		return err
+	}
+	return classifyError("unpin event", intent.Client.UnpinEvent(roomID, eventID), ErrPowerLevelTooLow, nil)
+}
+
 func (intent *IntentAPI) SetRoomTopic(roomID id.RoomID, topic string) (*mautrix.RespSendEvent, error) {
 	return intent.SendStateEvent(roomID, event.StateTopic, "", map[string]interface{}{
 		"topic": topic,
 	})
 }
 
+// SetDisplayName sets the global displayname of the intent's user.
+// The request is skipped if the cached displayname is the same, see SetDisplayNameForce to always send it.
 func (intent *IntentAPI) SetDisplayName(displayName string) error {
+	if !intent.IsCustomPuppet {
+		if current, ok := intent.as.StateStore.GetDisplayName(intent.UserID); ok && current == displayName {
+			return nil
+		}
+	}
+	return intent.SetDisplayNameForce(displayName)
+}
+
+// SetDisplayNameForce sets the global displayname of the intent's user without checking the cached displayname.
+func (intent *IntentAPI) SetDisplayNameForce(displayName string) error {
 	if err := intent.EnsureRegistered(); err != nil {
 		return err
 	}
-	return intent.Client.SetDisplayName(displayName)
+	err := intent.Client.SetDisplayName(displayName)
+	if err == nil {
+		intent.as.StateStore.SetDisplayName(intent.UserID, displayName)
+	}
+	return err
 }
 
+// SetAvatarURL sets the global avatar of the intent's user.
+// The request is skipped if the cached avatar URL is the same, see SetAvatarURLForce to always send it.
 func (intent *IntentAPI) SetAvatarURL(avatarURL id.ContentURI) error {
+	if !intent.IsCustomPuppet {
+		if current, ok := intent.as.StateStore.GetAvatarURL(intent.UserID); ok && current == avatarURL {
+			return nil
+		}
+	}
+	return intent.SetAvatarURLForce(avatarURL)
+}
+
+// SetAvatarURLForce sets the global avatar of the intent's user without checking the cached avatar URL.
+func (intent *IntentAPI) SetAvatarURLForce(avatarURL id.ContentURI) error {
 	if err := intent.EnsureRegistered(); err != nil {
 		return err
 	}
-	return intent.Client.SetAvatarURL(avatarURL)
+	err := intent.Client.SetAvatarURL(avatarURL)
+	if err == nil {
+		intent.as.StateStore.SetAvatarURL(intent.UserID, avatarURL)
+	}
+	return err
 }
 
 func (intent *IntentAPI) Whoami() (*mautrix.RespWhoami, error) {
@@ -363,11 +721,103 @@ func (intent *IntentAPI) Whoami() (*mautrix.RespWhoami, error) {
 	return intent.Client.Whoami()
 }
 
+// EnsureDevice makes sure the intent's user has a device with the given ID and makes the intent use it.
+//
+// If the registration enables MSC4190, the device is created with the appservice device management
+// endpoints and the appservice token is used with device masquerading. Otherwise, the device is
+// created by logging in with the legacy m.login.application_service login type, which stores the
+// new access token in the intent's client.
+func (intent *IntentAPI) EnsureDevice(deviceID id.DeviceID, displayName string) error {
+	if err := intent.EnsureRegistered(); err != nil {
+		return err
+	}
+	if intent.as.GetRegistration().MSC4190 {
+		err := intent.Client.CreateDeviceMSC4190(deviceID, displayName)
+		if err != nil {
+			return fmt.Errorf("failed to create device: %w", err)
+		}
+		intent.Client.DeviceID = deviceID
+		intent.Client.AppServiceDeviceID = deviceID
+		return nil
+	}
+	_, err := intent.Client.Login(&mautrix.ReqLogin{
+		Type: mautrix.AuthTypeAppservice,
+		Identifier: mautrix.UserIdentifier{
+			Type: mautrix.IdentifierTypeUser,
+			User: string(intent.UserID),
+		},
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: displayName,
+		StoreCredentials:         true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+	return nil
+}
+
+// SendToDevice sends to-device events as the intent's user after making sure the user is registered.
+func (intent *IntentAPI) SendToDevice(eventType event.Type, req *mautrix.ReqSendToDevice) (*mautrix.RespSendToDevice, error) {
+	if err := intent.EnsureRegistered(); err != nil {
+		return nil, err
+	}
+	return intent.Client.SendToDevice(eventType, req)
+}
+
+// ToDeviceBatchSize is the maximum number of messages that SendToDeviceBatched puts in a single request.
+var ToDeviceBatchSize = 100
+
+// SendToDeviceBatched sends to-device events like SendToDevice, but splits the messages into multiple
+// requests if there are more than ToDeviceBatchSize of them. All messages for a single user are
+// kept in the same request when possible.
+func (intent *IntentAPI) SendToDeviceBatched(eventType event.Type, req *mautrix.ReqSendToDevice) error {
+	if err := intent.EnsureRegistered(); err != nil {
+		return err
+	}
+	batch := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	batchSize := 0
+	flush := func() error {
+		if batchSize == 0 {
+			return nil
+		}
+		_, err := intent.Client.SendToDevice(eventType, batch)
+		if err != nil {
+			return fmt.Errorf("failed to send batch of %d to-device messages: %w", batchSize, err)
+		}
+		batch = &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+		batchSize = 0
+		return nil
+	}
+	for userID, devices := range req.Messages {
+		if batchSize > 0 && batchSize+len(devices) > ToDeviceBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		for deviceID, content := range devices {
+			if batchSize >= ToDeviceBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			userMessages, ok := batch.Messages[userID]
+			if !ok {
+				userMessages = make(map[id.DeviceID]*event.Content)
+				batch.Messages[userID] = userMessages
+			}
+			userMessages[deviceID] = content
+			batchSize++
+		}
+	}
+	return flush()
+}
+
 func (intent *IntentAPI) JoinedMembers(roomID id.RoomID) (resp *mautrix.RespJoinedMembers, err error) {
 	resp, err = intent.Client.JoinedMembers(roomID)
 	if err != nil {
 		return
 	}
+	members := make(map[id.UserID]*event.MemberEventContent, len(resp.Joined))
 	for userID, member := range resp.Joined {
 		var displayname string
 		var avatarURL id.ContentURIString
@@ -377,22 +827,25 @@ func (intent *IntentAPI) JoinedMembers(roomID id.RoomID) (resp *mautrix.RespJoin
 		if member.AvatarURL != nil {
 			avatarURL = id.ContentURIString(*member.AvatarURL)
 		}
-		intent.as.StateStore.SetMember(roomID, userID, &event.MemberEventContent{
+		members[userID] = &event.MemberEventContent{
 			Membership:  event.MembershipJoin,
 			AvatarURL:   avatarURL,
 			Displayname: displayname,
-		})
+		}
 	}
+	intent.as.StateStore.SetMembers(roomID, members)
 	return
 }
 
+// Members gets the member events of the room. The response is only stored in the state store if the request
+// isn't filtered, as filtered responses may be incomplete or from an earlier point in the room's history.
 func (intent *IntentAPI) Members(roomID id.RoomID, req ...mautrix.ReqMembers) (resp *mautrix.RespMembers, err error) {
 	resp, err = intent.Client.Members(roomID, req...)
 	if err != nil {
 		return
 	}
-	for _, evt := range resp.Chunk {
-		intent.as.UpdateState(evt)
+	if len(req) == 0 || (len(req[0].At) == 0 && len(req[0].Membership) == 0 && len(req[0].NotMembership) == 0) {
+		intent.as.StateStore.SetMembers(roomID, NewRoomStateSnapshot(resp.Chunk).Members)
 	}
 	return
 }
@@ -402,7 +855,7 @@ func (intent *IntentAPI) EnsureInvited(roomID id.RoomID, userID id.UserID) error
 		_, err := intent.InviteUser(roomID, &mautrix.ReqInviteUser{
 			UserID: userID,
 		})
-		if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.RespError != nil && strings.Contains(httpErr.RespError.Err, "is already in the room") {
+		if errors.Is(err, ErrAlreadyInRoom) {
 			return nil
 		}
 		return err
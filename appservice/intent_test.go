@@ -0,0 +1,456 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const encryptedTestRoom = id.RoomID("!encrypted:example.com")
+
+type fakeCryptoHelper struct {
+	encrypted []event.Type
+}
+
+func (helper *fakeCryptoHelper) Encrypt(roomID id.RoomID, eventType event.Type, content interface{}) (*event.EncryptedEventContent, error) {
+	helper.encrypted = append(helper.encrypted, eventType)
+	return &event.EncryptedEventContent{
+		Algorithm:        id.AlgorithmMegolmV1,
+		MegolmCiphertext: []byte("ciphertext"),
+	}, nil
+}
+
+// sendRecorder is a fake homeserver that records the event types of events sent to rooms.
+type sendRecorder struct {
+	lock  sync.Mutex
+	types []string
+}
+
+func (rec *sendRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) > 3 && parts[len(parts)-3] == "send" {
+		rec.lock.Lock()
+		rec.types = append(rec.types, parts[len(parts)-2])
+		rec.lock.Unlock()
+		_, _ = w.Write([]byte(`{"event_id": "$event"}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{}`))
+}
+
+func newEncryptionTestAppService(t *testing.T) (*appservice.AppService, *fakeCryptoHelper, *sendRecorder) {
+	rec := &sendRecorder{}
+	as := newTestAppService(t, rec)
+	helper := &fakeCryptoHelper{}
+	as.Crypto = helper
+	as.StateStore.SetMembership(encryptedTestRoom, "@bot:example.com", event.MembershipJoin)
+	as.StateStore.SetMembership("!plain:example.com", "@bot:example.com", event.MembershipJoin)
+	as.UpdateState(&event.Event{
+		Type:     event.StateEncryption,
+		RoomID:   encryptedTestRoom,
+		StateKey: new(string),
+		Content:  event.Content{Parsed: &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}},
+	})
+	return as, helper, rec
+}
+
+func TestIntentAPI_SendMessageEvent_Encrypted(t *testing.T) {
+	as, helper, rec := newEncryptionTestAppService(t)
+	intent := as.BotIntent()
+	_, err := intent.SendText(encryptedTestRoom, "hello")
+	require.NoError(t, err)
+	_, err = intent.SendReaction(encryptedTestRoom, "$target", "👍")
+	require.NoError(t, err)
+	_, err = intent.SendText("!plain:example.com", "hello")
+	require.NoError(t, err)
+
+	assert.Equal(t, []event.Type{event.EventMessage, event.EventReaction}, helper.encrypted)
+	assert.Equal(t, []string{"m.room.encrypted", "m.room.encrypted", "m.room.message"}, rec.types)
+}
+
+func TestIntentAPI_CreateRoom(t *testing.T) {
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"room_id": "!new:example.com"}`))
+	}))
+	as.StateStore.MarkRegistered("@bot:example.com")
+	kick := 100
+	_, err := as.BotIntent().CreateRoom(&mautrix.ReqCreateRoom{
+		Preset: "trusted_private_chat",
+		Name:   "Room",
+		Topic:  "Topic",
+		Invite: []id.UserID{"@alice:example.com"},
+		PowerLevelOverride: &event.PowerLevelsEventContent{
+			Events:  map[string]int{"m.room.topic": 100},
+			KickPtr: &kick,
+		},
+	})
+	require.NoError(t, err)
+
+	const roomID = id.RoomID("!new:example.com")
+	assert.True(t, as.StateStore.IsInRoom(roomID, "@bot:example.com"))
+	assert.True(t, as.StateStore.IsInvited(roomID, "@alice:example.com"))
+	assert.Equal(t, 100, as.StateStore.GetPowerLevel(roomID, "@alice:example.com"))
+	assert.Equal(t, 100, as.StateStore.GetPowerLevelRequirement(roomID, event.StateTopic))
+	// The events override replaces the whole default events object.
+	assert.Equal(t, 50, as.StateStore.GetPowerLevelRequirement(roomID, event.StatePowerLevels))
+	pl := as.StateStore.GetPowerLevels(roomID)
+	assert.Equal(t, 100, pl.Kick())
+	assert.Equal(t, 50, pl.Ban())
+	assert.Equal(t, 0, pl.Invite())
+	meta, ok := as.StateStore.GetRoomMetadata(roomID)
+	require.True(t, ok)
+	assert.Equal(t, "Room", meta.Name)
+	assert.Equal(t, "Topic", meta.Topic)
+}
+
+func TestIntentAPI_CreateRoom_DefaultPowerLevels(t *testing.T) {
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"room_id": "!new:example.com"}`))
+	}))
+	as.StateStore.MarkRegistered("@bot:example.com")
+	_, err := as.BotIntent().CreateRoom(&mautrix.ReqCreateRoom{Visibility: "public"})
+	require.NoError(t, err)
+
+	const roomID = id.RoomID("!new:example.com")
+	assert.Equal(t, 100, as.StateStore.GetPowerLevel(roomID, "@bot:example.com"))
+	assert.Equal(t, 100, as.StateStore.GetPowerLevelRequirement(roomID, event.StatePowerLevels))
+	assert.Equal(t, 100, as.StateStore.GetPowerLevelRequirement(roomID, event.StateTombstone))
+	assert.Equal(t, 50, as.StateStore.GetPowerLevelRequirement(roomID, event.StateTopic))
+	assert.Equal(t, 0, as.StateStore.GetPowerLevelRequirement(roomID, event.EventMessage))
+	assert.Equal(t, 50, as.StateStore.GetPowerLevels(roomID).Invite())
+}
+
+func TestIntentAPI_SetPowerLevel_KeepsUnknownKeys(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	var sent []byte
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPut {
+			sent, _ = io.ReadAll(r.Body)
+		}
+		_, _ = w.Write([]byte(`{"event_id": "$event"}`))
+	}))
+	as.StateStore.SetMembership(roomID, "@bot:example.com", event.MembershipJoin)
+	var pl event.PowerLevelsEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"users": {"@bot:example.com": 100}, "org.example.custom": {"level": 42}}`), &pl))
+	as.StateStore.SetPowerLevels(roomID, &pl)
+
+	_, err := as.BotIntent().SetPowerLevel(roomID, "@alice:example.com", 50)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"users": {"@bot:example.com": 100, "@alice:example.com": 50}, "org.example.custom": {"level": 42}}`, string(sent))
+}
+
+func TestIntentAPI_Members_Filtered(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"chunk": [{"type": "m.room.member", "state_key": "@alice:example.com", "sender": "@alice:example.com", "event_id": "$alice", "room_id": "!room:example.com", "content": {"membership": "join"}}]}`))
+	}))
+	intent := as.BotIntent()
+
+	for _, req := range []mautrix.ReqMembers{{At: "s123"}, {Membership: event.MembershipJoin}, {NotMembership: event.MembershipLeave}} {
+		_, err := intent.Members(roomID, req)
+		require.NoError(t, err)
+		assert.False(t, as.StateStore.IsInRoom(roomID, "@alice:example.com"), "filtered response %+v was cached", req)
+	}
+
+	_, err := intent.Members(roomID)
+	require.NoError(t, err)
+	assert.True(t, as.StateStore.IsInRoom(roomID, "@alice:example.com"))
+}
+
+func TestIntentAPI_MarkRead(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	hs := &requestLog{respond: func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"room_id": "!room:example.com"}`))
+	}}
+	as := newTestAppService(t, hs)
+	intent := as.Intent("@ghost:example.com")
+
+	require.NoError(t, intent.MarkRead(roomID, "$1"))
+	require.NoError(t, intent.MarkReadThread(roomID, "$2", "$root"))
+	require.NoError(t, intent.MarkReadPrivate(roomID, "$3"))
+	require.NoError(t, intent.SetReadMarkers(roomID, &mautrix.ReqSetReadMarkers{FullyRead: "$3", Read: "$3"}))
+
+	// The ghost is registered and joined before the first receipt, and only once.
+	assert.Equal(t, []string{
+		"POST /_matrix/client/r0/register",
+		"POST /_matrix/client/r0/rooms/!room:example.com/join",
+		"POST /_matrix/client/r0/rooms/!room:example.com/receipt/m.read/$1",
+		"POST /_matrix/client/r0/rooms/!room:example.com/receipt/m.read/$2",
+		"POST /_matrix/client/r0/rooms/!room:example.com/receipt/m.read.private/$3",
+		"POST /_matrix/client/r0/rooms/!room:example.com/read_markers",
+	}, hs.Requests())
+	assert.JSONEq(t, `{}`, hs.Body("POST /_matrix/client/r0/rooms/!room:example.com/receipt/m.read/$1"))
+	assert.JSONEq(t, `{"thread_id": "$root"}`, hs.Body("POST /_matrix/client/r0/rooms/!room:example.com/receipt/m.read/$2"))
+	assert.JSONEq(t, `{"m.fully_read": "$3", "m.read": "$3"}`, hs.Body("POST /_matrix/client/r0/rooms/!room:example.com/read_markers"))
+}
+
+func TestIntentAPI_RedactEvent_BotFallback(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	var redactedBy []string
+	forbidBot := false
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		userID := r.URL.Query().Get("user_id")
+		redactedBy = append(redactedBy, userID)
+		if userID == "@ghost:example.com" || forbidBot {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "You don't have permission to redact events"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"event_id": "$redaction"}`))
+	}))
+	as.StateStore.SetMembership(roomID, "@ghost:example.com", event.MembershipJoin)
+	as.StateStore.SetMembership(roomID, "@bot:example.com", event.MembershipJoin)
+
+	resp, err := as.Intent("@ghost:example.com").RedactEvent(roomID, "$event", mautrix.ReqRedact{Reason: "spam"})
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$redaction"), resp.EventID)
+	assert.Equal(t, []string{"@ghost:example.com", "@bot:example.com"}, redactedBy)
+
+	// The bot itself has nothing to fall back to.
+	redactedBy = nil
+	forbidBot = true
+	_, err = as.BotIntent().RedactEvent(roomID, "$event")
+	assert.ErrorIs(t, err, appservice.ErrPowerLevelTooLow)
+	assert.Equal(t, []string{"@bot:example.com"}, redactedBy)
+}
+
+func TestIntentAPI_RedactEvent_NoFallbackForOtherErrors(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	requests := 0
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found"}`))
+	}))
+	as.StateStore.SetMembership(roomID, "@ghost:example.com", event.MembershipJoin)
+
+	_, err := as.Intent("@ghost:example.com").RedactEvent(roomID, "$event")
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	assert.Equal(t, 1, requests)
+}
+
+func TestIntentAPI_EnsureJoined_Concurrent(t *testing.T) {
+	hs := &requestLog{respond: func(w http.ResponseWriter, r *http.Request) {
+		// Slow responses make it likely that the goroutines overlap.
+		time.Sleep(20 * time.Millisecond)
+		roomID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0/rooms/"), "/join")
+		_, _ = w.Write([]byte(`{"room_id": "` + roomID + `"}`))
+	}}
+	as := newTestAppService(t, hs)
+	intent := as.Intent("@ghost:example.com")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, roomID := range []id.RoomID{"!a:example.com", "!b:example.com"} {
+			wg.Add(1)
+			go func(roomID id.RoomID) {
+				defer wg.Done()
+				assert.NoError(t, intent.EnsureJoined(roomID))
+			}(roomID)
+		}
+	}
+	wg.Wait()
+
+	// Registration happens once, and each room is joined once.
+	assert.ElementsMatch(t, []string{
+		"POST /_matrix/client/r0/register",
+		"POST /_matrix/client/r0/rooms/!a:example.com/join",
+		"POST /_matrix/client/r0/rooms/!b:example.com/join",
+	}, hs.Requests())
+	assert.True(t, as.StateStore.IsInRoom("!a:example.com", "@ghost:example.com"))
+	assert.True(t, as.StateStore.IsInRoom("!b:example.com", "@ghost:example.com"))
+}
+
+func TestIntentAPI_EnsureJoined_FailedJoinIsRetried(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	joins := 0
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/join") {
+			joins++
+			if joins == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Internal server error"}`))
+				return
+			}
+		}
+		_, _ = w.Write([]byte(`{"room_id": "!room:example.com"}`))
+	}))
+	as.StateStore.MarkRegistered("@ghost:example.com")
+	intent := as.Intent("@ghost:example.com")
+
+	// A failed join isn't remembered, so the next call tries again.
+	assert.Error(t, intent.EnsureJoined(roomID))
+	assert.NoError(t, intent.EnsureJoined(roomID))
+	assert.Equal(t, 2, joins)
+}
+
+func TestIntentAPI_SendToDevice(t *testing.T) {
+	var userIDs []string
+	hs := &requestLog{respond: func(w http.ResponseWriter, r *http.Request) {
+		userIDs = append(userIDs, r.URL.Query().Get("user_id"))
+		_, _ = w.Write([]byte(`{}`))
+	}}
+	as := newTestAppService(t, hs)
+	_, err := as.Intent("@ghost:example.com").SendToDevice(event.ToDeviceRoomKey, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			"@alice:example.com": {"DEVICE": {Raw: map[string]interface{}{"session_id": "meow"}}},
+		},
+	})
+	require.NoError(t, err)
+
+	requests := hs.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "POST /_matrix/client/r0/register", requests[0])
+	assert.True(t, strings.HasPrefix(requests[1], "PUT /_matrix/client/r0/sendToDevice/m.room_key/"), requests[1])
+	// The request is sent as the ghost.
+	assert.Equal(t, "@ghost:example.com", userIDs[1])
+	assert.JSONEq(t, `{"messages": {"@alice:example.com": {"DEVICE": {"session_id": "meow"}}}}`, hs.Body(requests[1]))
+}
+
+func TestIntentAPI_SendToDeviceBatched(t *testing.T) {
+	defer func(size int) { appservice.ToDeviceBatchSize = size }(appservice.ToDeviceBatchSize)
+	appservice.ToDeviceBatchSize = 3
+
+	var batches []mautrix.ReqSendToDevice
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch mautrix.ReqSendToDevice
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		batches = append(batches, batch)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	as.StateStore.MarkRegistered("@ghost:example.com")
+	req := &mautrix.ReqSendToDevice{Messages: map[id.UserID]map[id.DeviceID]*event.Content{}}
+	devices := map[id.UserID]int{"@alice:example.com": 2, "@bob:example.com": 2, "@carol:example.com": 5}
+	for userID, count := range devices {
+		req.Messages[userID] = make(map[id.DeviceID]*event.Content)
+		for i := 0; i < count; i++ {
+			req.Messages[userID][id.DeviceID(fmt.Sprintf("DEVICE%d", i))] = &event.Content{Raw: map[string]interface{}{"index": i}}
+		}
+	}
+	require.NoError(t, as.Intent("@ghost:example.com").SendToDeviceBatched(event.ToDeviceRoomKey, req))
+
+	delivered := map[id.UserID]int{}
+	for _, batch := range batches {
+		size := 0
+		for userID, userDevices := range batch.Messages {
+			size += len(userDevices)
+			delivered[userID] += len(userDevices)
+			// Users with few enough devices aren't split across batches.
+			if devices[userID] <= appservice.ToDeviceBatchSize {
+				assert.Len(t, userDevices, devices[userID])
+			}
+		}
+		assert.LessOrEqual(t, size, appservice.ToDeviceBatchSize)
+	}
+	assert.Equal(t, devices, delivered)
+}
+
+func TestIntentAPI_SendToDeviceBatched_Error(t *testing.T) {
+	as := newTestAppService(t, errorHomeserver(http.StatusBadRequest, `{"errcode": "M_BAD_JSON", "error": "Bad request"}`))
+	as.StateStore.MarkRegistered("@ghost:example.com")
+	err := as.Intent("@ghost:example.com").SendToDeviceBatched(event.ToDeviceRoomKey, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{"@alice:example.com": {"DEVICE": {}}},
+	})
+	assert.ErrorIs(t, err, mautrix.MBadJSON)
+	assert.Contains(t, err.Error(), "failed to send batch of 1 to-device messages")
+
+	// Nothing is sent if there are no messages.
+	assert.NoError(t, as.Intent("@ghost:example.com").SendToDeviceBatched(event.ToDeviceRoomKey, &mautrix.ReqSendToDevice{}))
+}
+
+// deviceHomeserver is a fake homeserver that records the requests, query parameters and access tokens
+// used by an intent with a device.
+type deviceHomeserver struct {
+	requestLog
+	queries []url.Values
+	tokens  []string
+}
+
+func (hs *deviceHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.queries = append(hs.queries, r.URL.Query())
+	hs.tokens = append(hs.tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	hs.requestLog.ServeHTTP(w, r)
+}
+
+func TestIntentAPI_EnsureDevice_MSC4190(t *testing.T) {
+	hs := &deviceHomeserver{}
+	hs.respond = func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"user_id": "@ghost:example.com", "device_id": "DEVICE"}`))
+	}
+	as := newTestAppService(t, hs)
+	as.Registration.MSC4190 = true
+	intent := as.Intent("@ghost:example.com")
+
+	require.NoError(t, intent.EnsureDevice("DEVICE", "Bridge"))
+	assert.Equal(t, id.DeviceID("DEVICE"), intent.DeviceID)
+	_, err := intent.Whoami()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"POST /_matrix/client/r0/register",
+		"PUT /_matrix/client/r0/devices/DEVICE",
+		"GET /_matrix/client/r0/account/whoami",
+	}, hs.Requests())
+	assert.JSONEq(t, `{"display_name": "Bridge"}`, hs.Body("PUT /_matrix/client/r0/devices/DEVICE"))
+	// Requests after creating the device masquerade as the device using the appservice token.
+	assert.Equal(t, "DEVICE", hs.queries[2].Get("org.matrix.msc3202.device_id"))
+	assert.Equal(t, "@ghost:example.com", hs.queries[2].Get("user_id"))
+	assert.Equal(t, "as_token", hs.tokens[2])
+}
+
+func TestIntentAPI_EnsureDevice_Login(t *testing.T) {
+	hs := &deviceHomeserver{}
+	hs.respond = func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"user_id": "@ghost:example.com", "device_id": "DEVICE", "access_token": "device_token"}`))
+	}
+	as := newTestAppService(t, hs)
+	intent := as.Intent("@ghost:example.com")
+
+	require.NoError(t, intent.EnsureDevice("DEVICE", "Bridge"))
+	_, err := intent.Whoami()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"POST /_matrix/client/r0/register",
+		"POST /_matrix/client/r0/login",
+		"GET /_matrix/client/r0/account/whoami",
+	}, hs.Requests())
+	assert.JSONEq(t, `{
+		"type": "m.login.application_service",
+		"identifier": {"type": "m.id.user", "user": "@ghost:example.com"},
+		"device_id": "DEVICE",
+		"initial_device_display_name": "Bridge"
+	}`, hs.Body("POST /_matrix/client/r0/login"))
+	// The access token from the login is used after that.
+	assert.Equal(t, "device_token", hs.tokens[2])
+	assert.Empty(t, hs.queries[2].Get("org.matrix.msc3202.device_id"))
+}
@@ -142,7 +142,7 @@ func SendCheckpoints(as *AppService, checkpoints []*MessageSendCheckpoint) error
 		return err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+as.Registration.AppToken)
+	req.Header.Set("Authorization", "Bearer "+as.GetRegistration().AppToken)
 	req.Header.Set("User-Agent", mautrix.DefaultUserAgent+" checkpoint sender")
 	req.Header.Set("Content-Type", "application/json")
 
@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"runtime/debug"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// EventMiddleware wraps the dispatching of events to the handlers of event processors.
+//
+// A middleware can modify the event before passing it to next, drop the event by not calling next at all,
+// or run code before and after the rest of the chain (e.g. for measuring processing time). Note that next
+// only waits for the handlers to return if the event processor uses the Sync execution mode.
+type EventMiddleware func(next EventListener) EventListener
+
+// AddEventMiddleware adds middlewares to the event dispatch chain of all event processors of the appservice.
+// Middlewares are called in the order they're added, and must be added before the event processors are started.
+func (as *AppService) AddEventMiddleware(middlewares ...EventMiddleware) {
+	as.processorsLock.Lock()
+	defer as.processorsLock.Unlock()
+	as.eventMiddleware = append(as.eventMiddleware, middlewares...)
+	for _, ep := range as.eventProcessors {
+		ep.dispatch = as.buildEventChain(ep.dispatchToHandlers)
+	}
+}
+
+// buildEventChain wraps the given listener with all the event middlewares.
+// The chain is built once when the middlewares change instead of for every event.
+func (as *AppService) buildEventChain(final EventListener) EventListener {
+	for i := len(as.eventMiddleware) - 1; i >= 0; i-- {
+		final = as.eventMiddleware[i](final)
+	}
+	return final
+}
+
+// FilterEvents returns a middleware that drops all events for which the given function returns false.
+func FilterEvents(allow func(evt *event.Event) bool) EventMiddleware {
+	return func(next EventListener) EventListener {
+		return func(evt *event.Event) {
+			if allow(evt) {
+				next(evt)
+			}
+		}
+	}
+}
+
+// RecoverEventMiddleware returns a middleware that recovers panics in the rest of the chain, including
+// handlers that run synchronously, and logs them instead of crashing the event processor.
+func (as *AppService) RecoverEventMiddleware() EventMiddleware {
+	return func(next EventListener) EventListener {
+		return func(evt *event.Event) {
+			defer func() {
+				if err := recover(); err != nil {
+					as.Log.Errorfln("Panic in event middleware or handler while handling %s: %v\n%s", evt.ID, err, debug.Stack())
+				}
+			}()
+			next(evt)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestEventMiddleware(t *testing.T) {
+	as := newTestAppService(t, nil)
+	ep := appservice.NewEventProcessor(as)
+	ep.ExecMode = appservice.Sync
+
+	var handled []id.EventID
+	ep.On(event.EventMessage, func(evt *event.Event) {
+		handled = append(handled, evt.ID)
+	})
+	chainBuilds := 0
+	as.AddEventMiddleware(
+		as.RecoverEventMiddleware(),
+		appservice.FilterEvents(func(evt *event.Event) bool {
+			return evt.RoomID != "!muted:example.com"
+		}),
+		func(next appservice.EventListener) appservice.EventListener {
+			chainBuilds++
+			return func(evt *event.Event) {
+				if evt.ID == "$panic" {
+					panic("meow")
+				}
+				evt.ID += "-rewritten"
+				next(evt)
+			}
+		},
+	)
+
+	ep.Dispatch(&event.Event{ID: "$1", RoomID: "!room:example.com", Type: event.EventMessage})
+	ep.Dispatch(&event.Event{ID: "$2", RoomID: "!muted:example.com", Type: event.EventMessage})
+	ep.Dispatch(&event.Event{ID: "$panic", RoomID: "!room:example.com", Type: event.EventMessage})
+	ep.Dispatch(&event.Event{ID: "$3", RoomID: "!room:example.com", Type: event.EventMessage})
+
+	assert.Equal(t, []id.EventID{"$1-rewritten", "$3-rewritten"}, handled)
+	assert.Equal(t, 1, chainBuilds)
+}
+
+func TestEventMiddleware_StoppedProcessor(t *testing.T) {
+	as := newTestAppService(t, nil)
+	stopped := appservice.NewEventProcessor(as)
+	appservice.NewEventProcessor(as)
+	stopped.Stop()
+
+	chainBuilds := 0
+	as.AddEventMiddleware(func(next appservice.EventListener) appservice.EventListener {
+		chainBuilds++
+		return next
+	})
+	// Only the processor that is still running gets the middleware.
+	assert.Equal(t, 1, chainBuilds)
+}
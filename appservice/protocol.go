@@ -95,9 +95,13 @@ const (
 	ErrBadJSON      ErrorCode = "M_BAD_JSON"
 	ErrNotJSON      ErrorCode = "M_NOT_JSON"
 	ErrUnknown      ErrorCode = "M_UNKNOWN"
+	ErrNotFound     ErrorCode = "M_NOT_FOUND"
+	ErrTooLarge     ErrorCode = "M_TOO_LARGE"
+	ErrInvalidParam ErrorCode = "M_INVALID_PARAM"
 )
 
 // Custom ErrorCodes
 const (
 	ErrNoTransactionID ErrorCode = "NET.MAUNIUM.NO_TRANSACTION_ID"
+	ErrShuttingDown    ErrorCode = "NET.MAUNIUM.SHUTTING_DOWN"
 )
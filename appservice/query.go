@@ -0,0 +1,340 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// QueryHandler handles room alias and user ID queries from the homeserver.
+//
+// Returning a nil result and nil error means the user or alias doesn't exist.
+type QueryHandler interface {
+	QueryAlias(ctx context.Context, alias id.RoomAlias) (*QueryAliasResult, error)
+	QueryUser(ctx context.Context, userID id.UserID) (*QueryUserResult, error)
+}
+
+// QueryUserResult is returned by QueryHandler.QueryUser if the queried user exists.
+//
+// The ghost user will be registered before responding to the homeserver.
+type QueryUserResult struct {
+	// Optional profile info to set after registering the user.
+	DisplayName string
+	AvatarURL   id.ContentURI
+}
+
+// QueryAliasResult is returned by QueryHandler.QueryAlias if a room should be created for the queried alias.
+//
+// The room will be created with the queried alias before responding to the homeserver.
+type QueryAliasResult struct {
+	// Creator is the user who should create the room. If empty, the appservice bot is used.
+	Creator id.UserID
+	// CreateRoom contains the parameters for creating the room. The alias name is filled automatically.
+	CreateRoom *mautrix.ReqCreateRoom
+	// RoomCreated is an optional function that is called after the room has been created.
+	RoomCreated func(roomID id.RoomID)
+}
+
+type QueryHandlerStub struct{}
+
+func (qh *QueryHandlerStub) QueryAlias(ctx context.Context, alias id.RoomAlias) (*QueryAliasResult, error) {
+	return nil, nil
+}
+
+func (qh *QueryHandlerStub) QueryUser(ctx context.Context, userID id.UserID) (*QueryUserResult, error) {
+	return nil, nil
+}
+
+// ThirdPartyUser is a Matrix user that represents a user on a third party network.
+type ThirdPartyUser struct {
+	UserID   id.UserID         `json:"userid"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// ThirdPartyLocation is a Matrix room alias that represents a location on a third party network.
+type ThirdPartyLocation struct {
+	Alias    id.RoomAlias      `json:"alias"`
+	Protocol string            `json:"protocol"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// ThirdPartyFieldType describes how a field of a third party protocol should be presented to users.
+type ThirdPartyFieldType struct {
+	Regexp      string `json:"regexp"`
+	Placeholder string `json:"placeholder"`
+}
+
+// ThirdPartyProtocolInstance is a single network (e.g. a specific server) that a protocol can connect to.
+type ThirdPartyProtocolInstance struct {
+	Desc        string            `json:"desc"`
+	Icon        string            `json:"icon,omitempty"`
+	Fields      map[string]string `json:"fields"`
+	NetworkID   string            `json:"network_id"`
+	InstanceID  string            `json:"instance_id,omitempty"`
+	BotUserID   id.UserID         `json:"bot_user_id,omitempty"`
+	ExternalURL string            `json:"external_url,omitempty"`
+}
+
+// ThirdPartyProtocol contains the metadata of a third party protocol that the appservice bridges to.
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           string                         `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []ThirdPartyProtocolInstance   `json:"instances"`
+}
+
+// ThirdPartyQueryHandler handles the third party network lookup queries from the homeserver.
+//
+// Returning a nil protocol or an empty list from any method means that nothing was found.
+type ThirdPartyQueryHandler interface {
+	GetProtocol(ctx context.Context, protocol string) (*ThirdPartyProtocol, error)
+	QueryThirdPartyUser(ctx context.Context, protocol string, fields map[string]string) ([]*ThirdPartyUser, error)
+	QueryThirdPartyLocation(ctx context.Context, protocol string, fields map[string]string) ([]*ThirdPartyLocation, error)
+	// ReverseQueryThirdPartyUser finds the third party user that the given Matrix user represents.
+	ReverseQueryThirdPartyUser(ctx context.Context, userID id.UserID) ([]*ThirdPartyUser, error)
+	// ReverseQueryThirdPartyLocation finds the third party location that the given room alias represents.
+	ReverseQueryThirdPartyLocation(ctx context.Context, alias id.RoomAlias) ([]*ThirdPartyLocation, error)
+}
+
+func writeQueryError(w http.ResponseWriter, message string) {
+	Error{
+		ErrorCode:  ErrUnknown,
+		HTTPStatus: http.StatusInternalServerError,
+		Message:    message,
+	}.Write(w)
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	Error{
+		ErrorCode:  ErrNotFound,
+		HTTPStatus: http.StatusNotFound,
+	}.Write(w)
+}
+
+func (as *AppService) createRoomForAlias(alias id.RoomAlias, result *QueryAliasResult) error {
+	intent := as.BotIntent()
+	if len(result.Creator) > 0 {
+		intent = as.Intent(result.Creator)
+	}
+	// Copy the request so that the handler can safely reuse the same template for multiple aliases.
+	var req mautrix.ReqCreateRoom
+	if result.CreateRoom != nil {
+		req = *result.CreateRoom
+	}
+	localpart := strings.TrimPrefix(string(alias), "#")
+	if colonIdx := strings.IndexRune(localpart, ':'); colonIdx >= 0 {
+		localpart = localpart[:colonIdx]
+	}
+	req.RoomAliasName = localpart
+	resp, err := intent.CreateRoom(&req)
+	if err != nil {
+		return err
+	}
+	if result.RoomCreated != nil {
+		result.RoomCreated(resp.RoomID)
+	}
+	return nil
+}
+
+// GetRoom handles a /rooms GET call from the homeserver.
+func (as *AppService) GetRoom(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	roomAlias := id.RoomAlias(vars["roomAlias"])
+	result, err := as.QueryHandler.QueryAlias(r.Context(), roomAlias)
+	if err != nil {
+		as.Log.Warnfln("Failed to handle query for room alias %s: %v", roomAlias, err)
+		writeQueryError(w, "Failed to query room alias")
+	} else if result == nil {
+		writeNotFound(w)
+	} else if err = as.createRoomForAlias(roomAlias, result); err != nil {
+		as.Log.Warnfln("Failed to create room for alias %s: %v", roomAlias, err)
+		writeQueryError(w, "Failed to create room")
+	} else {
+		WriteBlankOK(w)
+	}
+}
+
+// GetUser handles a /users GET call from the homeserver.
+func (as *AppService) GetUser(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	userID := id.UserID(vars["userID"])
+	result, err := as.QueryHandler.QueryUser(r.Context(), userID)
+	if err != nil {
+		as.Log.Warnfln("Failed to handle query for user %s: %v", userID, err)
+		writeQueryError(w, "Failed to query user")
+		return
+	} else if result == nil {
+		writeNotFound(w)
+		return
+	}
+	intent := as.Intent(userID)
+	if intent == nil {
+		writeNotFound(w)
+		return
+	}
+	err = intent.EnsureRegistered()
+	if err == nil && len(result.DisplayName) > 0 {
+		err = intent.SetDisplayName(result.DisplayName)
+	}
+	if err == nil && !result.AvatarURL.IsEmpty() {
+		err = intent.SetAvatarURL(result.AvatarURL)
+	}
+	if err != nil {
+		as.Log.Warnfln("Failed to register queried user %s: %v", userID, err)
+		writeQueryError(w, "Failed to register user")
+	} else {
+		WriteBlankOK(w)
+	}
+}
+
+func queryFields(r *http.Request) map[string]string {
+	query := r.URL.Query()
+	fields := make(map[string]string, len(query))
+	for key := range query {
+		fields[key] = query.Get(key)
+	}
+	delete(fields, "access_token")
+	return fields
+}
+
+// GetThirdPartyUser handles a /thirdparty/user/{protocol} GET call from the homeserver.
+func (as *AppService) GetThirdPartyUser(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	} else if as.ThirdPartyHandler == nil {
+		writeNotFound(w)
+		return
+	}
+
+	protocol := mux.Vars(r)["protocol"]
+	users, err := as.ThirdPartyHandler.QueryThirdPartyUser(r.Context(), protocol, queryFields(r))
+	if err != nil {
+		as.Log.Warnfln("Failed to handle third party user query for %s: %v", protocol, err)
+		writeQueryError(w, "Failed to query third party users")
+	} else if len(users) == 0 {
+		writeNotFound(w)
+	} else {
+		_ = Respond(w, users)
+	}
+}
+
+// GetThirdPartyLocation handles a /thirdparty/location/{protocol} GET call from the homeserver.
+func (as *AppService) GetThirdPartyLocation(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	} else if as.ThirdPartyHandler == nil {
+		writeNotFound(w)
+		return
+	}
+
+	protocol := mux.Vars(r)["protocol"]
+	locations, err := as.ThirdPartyHandler.QueryThirdPartyLocation(r.Context(), protocol, queryFields(r))
+	if err != nil {
+		as.Log.Warnfln("Failed to handle third party location query for %s: %v", protocol, err)
+		writeQueryError(w, "Failed to query third party locations")
+	} else if len(locations) == 0 {
+		writeNotFound(w)
+	} else {
+		_ = Respond(w, locations)
+	}
+}
+
+// GetThirdPartyProtocol handles a /thirdparty/protocol/{protocol} GET call from the homeserver.
+func (as *AppService) GetThirdPartyProtocol(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	} else if as.ThirdPartyHandler == nil {
+		writeNotFound(w)
+		return
+	}
+
+	protocol := mux.Vars(r)["protocol"]
+	meta, err := as.ThirdPartyHandler.GetProtocol(r.Context(), protocol)
+	if err != nil {
+		as.Log.Warnfln("Failed to get metadata of third party protocol %s: %v", protocol, err)
+		writeQueryError(w, "Failed to get protocol metadata")
+	} else if meta == nil {
+		writeNotFound(w)
+	} else {
+		_ = Respond(w, meta)
+	}
+}
+
+// ReverseGetThirdPartyUser handles a /thirdparty/user?userid= GET call from the homeserver.
+func (as *AppService) ReverseGetThirdPartyUser(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	} else if as.ThirdPartyHandler == nil {
+		writeNotFound(w)
+		return
+	}
+
+	userID := id.UserID(r.URL.Query().Get("userid"))
+	if len(userID) == 0 {
+		Error{
+			ErrorCode:  ErrInvalidParam,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Missing userid parameter",
+		}.Write(w)
+		return
+	}
+	users, err := as.ThirdPartyHandler.ReverseQueryThirdPartyUser(r.Context(), userID)
+	if err != nil {
+		as.Log.Warnfln("Failed to handle third party user reverse query for %s: %v", userID, err)
+		writeQueryError(w, "Failed to query third party users")
+	} else if len(users) == 0 {
+		writeNotFound(w)
+	} else {
+		_ = Respond(w, users)
+	}
+}
+
+// ReverseGetThirdPartyLocation handles a /thirdparty/location?alias= GET call from the homeserver.
+func (as *AppService) ReverseGetThirdPartyLocation(w http.ResponseWriter, r *http.Request) {
+	if !as.CheckServerToken(w, r) {
+		return
+	} else if as.ThirdPartyHandler == nil {
+		writeNotFound(w)
+		return
+	}
+
+	alias := id.RoomAlias(r.URL.Query().Get("alias"))
+	if len(alias) == 0 {
+		Error{
+			ErrorCode:  ErrInvalidParam,
+			HTTPStatus: http.StatusBadRequest,
+			Message:    "Missing alias parameter",
+		}.Write(w)
+		return
+	}
+	locations, err := as.ThirdPartyHandler.ReverseQueryThirdPartyLocation(r.Context(), alias)
+	if err != nil {
+		as.Log.Warnfln("Failed to handle third party location reverse query for %s: %v", alias, err)
+		writeQueryError(w, "Failed to query third party locations")
+	} else if len(locations) == 0 {
+		writeNotFound(w)
+	} else {
+		_ = Respond(w, locations)
+	}
+}
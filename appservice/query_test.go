@@ -0,0 +1,255 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+type testQueryHandler struct {
+	aliases map[id.RoomAlias]*appservice.QueryAliasResult
+	users   map[id.UserID]*appservice.QueryUserResult
+	err     error
+}
+
+func (qh *testQueryHandler) QueryAlias(ctx context.Context, alias id.RoomAlias) (*appservice.QueryAliasResult, error) {
+	return qh.aliases[alias], qh.err
+}
+
+func (qh *testQueryHandler) QueryUser(ctx context.Context, userID id.UserID) (*appservice.QueryUserResult, error) {
+	return qh.users[userID], qh.err
+}
+
+func TestAppService_GetRoom(t *testing.T) {
+	hs := &requestLog{respond: func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"room_id": "!portal:example.com"}`))
+	}}
+	as := newTestAppService(t, hs)
+	template := &mautrix.ReqCreateRoom{Name: "Portal"}
+	var created []id.RoomID
+	qh := &testQueryHandler{aliases: map[id.RoomAlias]*appservice.QueryAliasResult{
+		"#portal:example.com": {
+			Creator:    "@ghost:example.com",
+			CreateRoom: template,
+			RoomCreated: func(roomID id.RoomID) {
+				created = append(created, roomID)
+			},
+		},
+	}}
+	as.QueryHandler = qh
+	client := startUnixSocketListener(t, as)
+
+	status, _ := doRequest(t, client, http.MethodGet, "http://appservice/_matrix/app/v1/rooms/"+url.PathEscape("#portal:example.com"), nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []id.RoomID{"!portal:example.com"}, created)
+	assert.Equal(t, []string{
+		"POST /_matrix/client/r0/register",
+		"POST /_matrix/client/r0/createRoom",
+	}, hs.Requests())
+	var req mautrix.ReqCreateRoom
+	require.NoError(t, json.Unmarshal([]byte(hs.Body("POST /_matrix/client/r0/createRoom")), &req))
+	assert.Equal(t, "portal", req.RoomAliasName)
+	assert.Equal(t, "Portal", req.Name)
+	// The template given by the handler isn't modified.
+	assert.Empty(t, template.RoomAliasName)
+
+	status, respErr := doRequest(t, client, http.MethodGet, "http://appservice/_matrix/app/v1/rooms/"+url.PathEscape("#unknown:example.com"), nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, appservice.ErrNotFound, respErr.ErrorCode)
+
+	qh.err = errors.New("database is down")
+	status, respErr = doRequest(t, client, http.MethodGet, "http://appservice/_matrix/app/v1/rooms/"+url.PathEscape("#portal:example.com"), nil)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, appservice.ErrUnknown, respErr.ErrorCode)
+	assert.Len(t, hs.Requests(), 2)
+}
+
+func TestAppService_GetRoom_CreateFails(t *testing.T) {
+	as := newTestAppService(t, errorHomeserver(http.StatusBadRequest, `{"errcode": "M_ROOM_IN_USE", "error": "Room alias already taken"}`))
+	as.StateStore.MarkRegistered("@bot:example.com")
+	as.QueryHandler = &testQueryHandler{aliases: map[id.RoomAlias]*appservice.QueryAliasResult{
+		"#portal:example.com": {},
+	}}
+	client := startUnixSocketListener(t, as)
+
+	status, respErr := doRequest(t, client, http.MethodGet, "http://appservice/_matrix/app/v1/rooms/"+url.PathEscape("#portal:example.com"), nil)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, "Failed to create room", respErr.Message)
+}
+
+func TestAppService_GetUser(t *testing.T) {
+	hs := &requestLog{}
+	as := newTestAppService(t, hs)
+	as.QueryHandler = &testQueryHandler{users: map[id.UserID]*appservice.QueryUserResult{
+		"@ghost:example.com": {DisplayName: "Ghost", AvatarURL: id.ContentURI{Homeserver: "example.com", FileID: "avatar"}},
+		"@plain:example.com": {},
+	}}
+	client := startUnixSocketListener(t, as)
+
+	status, _ := doRequest(t, client, http.MethodGet, "http://appservice/_matrix/app/v1/users/@ghost:example.com", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{
+		"POST /_matrix/client/r0/register",
+		"PUT /_matrix/client/r0/profile/@ghost:example.com/displayname",
+		"PUT /_matrix/client/r0/profile/@ghost:example.com/avatar_url",
+	}, hs.Requests())
+	assert.JSONEq(t, `{"displayname": "Ghost"}`, hs.Body("PUT /_matrix/client/r0/profile/@ghost:example.com/displayname"))
+	assert.True(t, as.StateStore.IsRegistered("@ghost:example.com"))
+
+	// Without profile info, the user is only registered.
+	status, _ = doRequest(t, client, http.MethodGet, "http://appservice/_matrix/app/v1/users/@plain:example.com", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, hs.Requests(), 4)
+
+	status, respErr := doRequest(t, client, http.MethodGet, "http://appservice/_matrix/app/v1/users/@unknown:example.com", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, appservice.ErrNotFound, respErr.ErrorCode)
+	assert.Len(t, hs.Requests(), 4)
+}
+
+func TestAppService_Query_RequiresToken(t *testing.T) {
+	as := newTestAppService(t, nil)
+	as.QueryHandler = &testQueryHandler{users: map[id.UserID]*appservice.QueryUserResult{"@ghost:example.com": {}}}
+	client := startUnixSocketListener(t, as)
+
+	resp, err := client.Get("http://appservice/_matrix/app/v1/users/@ghost:example.com")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, err = client.Get("http://appservice/_matrix/app/v1/users/@ghost:example.com?access_token=wrong")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+type testThirdPartyHandler struct {
+	fields map[string]string
+}
+
+func (tp *testThirdPartyHandler) GetProtocol(ctx context.Context, protocol string) (*appservice.ThirdPartyProtocol, error) {
+	if protocol != "remote" {
+		return nil, nil
+	}
+	return &appservice.ThirdPartyProtocol{
+		UserFields:     []string{"username"},
+		LocationFields: []string{"channel"},
+		FieldTypes:     map[string]appservice.ThirdPartyFieldType{"username": {Regexp: "[a-z]+", Placeholder: "alice"}},
+		Instances:      []appservice.ThirdPartyProtocolInstance{},
+	}, nil
+}
+
+func (tp *testThirdPartyHandler) QueryThirdPartyUser(ctx context.Context, protocol string, fields map[string]string) ([]*appservice.ThirdPartyUser, error) {
+	tp.fields = fields
+	if fields["username"] == "broken" {
+		return nil, errors.New("remote network is down")
+	} else if fields["username"] != "alice" {
+		return nil, nil
+	}
+	return []*appservice.ThirdPartyUser{{UserID: "@remote_alice:example.com", Protocol: protocol, Fields: fields}}, nil
+}
+
+func (tp *testThirdPartyHandler) QueryThirdPartyLocation(ctx context.Context, protocol string, fields map[string]string) ([]*appservice.ThirdPartyLocation, error) {
+	tp.fields = fields
+	return []*appservice.ThirdPartyLocation{{Alias: "#remote_general:example.com", Protocol: protocol, Fields: fields}}, nil
+}
+
+func (tp *testThirdPartyHandler) ReverseQueryThirdPartyUser(ctx context.Context, userID id.UserID) ([]*appservice.ThirdPartyUser, error) {
+	if userID != "@remote_alice:example.com" {
+		return nil, nil
+	}
+	return []*appservice.ThirdPartyUser{{UserID: userID, Protocol: "remote", Fields: map[string]string{"username": "alice"}}}, nil
+}
+
+func (tp *testThirdPartyHandler) ReverseQueryThirdPartyLocation(ctx context.Context, alias id.RoomAlias) ([]*appservice.ThirdPartyLocation, error) {
+	return nil, nil
+}
+
+// getJSON sends an authenticated GET request and returns the status code and raw response body.
+func getJSON(t *testing.T, client *http.Client, url string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer hs_token")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func TestAppService_ThirdPartyQueries(t *testing.T) {
+	as := newTestAppService(t, nil)
+	handler := &testThirdPartyHandler{}
+	as.ThirdPartyHandler = handler
+	client := startUnixSocketListener(t, as)
+
+	status, body := getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/protocol/remote")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{
+		"user_fields": ["username"],
+		"location_fields": ["channel"],
+		"icon": "",
+		"field_types": {"username": {"regexp": "[a-z]+", "placeholder": "alice"}},
+		"instances": []
+	}`, body)
+	status, _ = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/protocol/other")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/user/remote?username=alice&access_token=hs_token")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"userid": "@remote_alice:example.com", "protocol": "remote", "fields": {"username": "alice"}}]`, body)
+	// The access token isn't passed to the handler as a field.
+	assert.Equal(t, map[string]string{"username": "alice"}, handler.fields)
+	status, _ = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/user/remote?username=bob")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/user/remote?username=broken")
+	assert.Equal(t, http.StatusInternalServerError, status)
+
+	status, body = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/location/remote?channel=general")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"alias": "#remote_general:example.com", "protocol": "remote", "fields": {"channel": "general"}}]`, body)
+
+	status, body = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/user?userid="+url.QueryEscape("@remote_alice:example.com"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"userid": "@remote_alice:example.com", "protocol": "remote", "fields": {"username": "alice"}}]`, body)
+	status, _ = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/user")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/location?alias="+url.QueryEscape("#unknown:example.com"))
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = getJSON(t, client, "http://appservice/_matrix/app/v1/thirdparty/location")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestAppService_ThirdPartyQueries_NoHandler(t *testing.T) {
+	as := newTestAppService(t, nil)
+	client := startUnixSocketListener(t, as)
+
+	for _, path := range []string{
+		"/_matrix/app/v1/thirdparty/protocol/remote",
+		"/_matrix/app/v1/thirdparty/user/remote?username=alice",
+		"/_matrix/app/v1/thirdparty/location/remote?channel=general",
+		"/_matrix/app/v1/thirdparty/user?userid=@remote_alice:example.com",
+		"/_matrix/app/v1/thirdparty/location?alias=%23remote_general:example.com",
+	} {
+		status, _ := getJSON(t, client, "http://appservice"+path)
+		assert.Equal(t, http.StatusNotFound, status, path)
+	}
+}
@@ -1,34 +1,12 @@
 package appservice
 
 import (
-	"math/rand"
-	"time"
-	"unsafe"
+	"maunium.net/go/mautrix/util"
 )
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-const (
-	letterIdxBits = 6
-	letterIdxMask = 1<<letterIdxBits - 1
-	letterIdxMax  = 63 / letterIdxBits
-)
-
-var src = rand.NewSource(time.Now().UnixNano())
-
-// RandomString generates a random string of the given length.
+// RandomString generates a random alphanumeric string of the given length.
+//
+// Deprecated: use util.RandomToken or util.RandomString instead.
 func RandomString(n int) string {
-	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
-	}
-	return *(*string)(unsafe.Pointer(&b))
+	return util.RandomToken(n)
 }
@@ -0,0 +1,162 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RequestPriority is the priority class of requests going through a RateLimiter.
+type RequestPriority int
+
+const (
+	// PriorityRealtime is for requests that a user is waiting for, like bridging new messages.
+	PriorityRealtime RequestPriority = iota
+	// PriorityNormal is for background requests that should still happen reasonably fast, like syncing room metadata.
+	PriorityNormal
+	// PriorityBackfill is for bulk requests like history imports, which only get to run when nothing else is waiting.
+	PriorityBackfill
+
+	priorityCount
+)
+
+type priorityContextKey struct{}
+
+// ContextWithPriority returns a context that overrides the priority of requests made with it.
+func ContextWithPriority(ctx context.Context, priority RequestPriority) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+// RateLimiter is a token bucket rate limiter with priority classes.
+//
+// A request can only take a token if no requests with a higher priority are waiting,
+// so lower priority traffic like backfilling can't starve realtime traffic.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	lock    sync.Mutex
+	tokens  float64
+	updated time.Time
+	waiting [priorityCount]int
+}
+
+// NewRateLimiter creates a rate limiter that allows the given number of requests per second on average,
+// with bursts of up to the given size.
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    perSecond,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		updated: time.Now(),
+	}
+}
+
+func (rl *RateLimiter) refill(now time.Time) {
+	rl.tokens += now.Sub(rl.updated).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.updated = now
+}
+
+func (rl *RateLimiter) higherPriorityWaiting(priority RequestPriority) bool {
+	for higher := PriorityRealtime; higher < priority; higher++ {
+		if rl.waiting[higher] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait blocks until a request with the given priority is allowed, or until the context is canceled.
+func (rl *RateLimiter) Wait(ctx context.Context, priority RequestPriority) error {
+	if priority < PriorityRealtime || priority >= priorityCount {
+		priority = PriorityNormal
+	}
+	rl.lock.Lock()
+	rl.waiting[priority]++
+	for {
+		rl.refill(time.Now())
+		if rl.tokens >= 1 && !rl.higherPriorityWaiting(priority) {
+			rl.tokens--
+			rl.waiting[priority]--
+			rl.lock.Unlock()
+			return nil
+		}
+		delay := 5 * time.Millisecond
+		if rl.tokens < 1 && rl.rate > 0 {
+			delay += time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+		}
+		rl.lock.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			rl.lock.Lock()
+			rl.waiting[priority]--
+			rl.lock.Unlock()
+			return ctx.Err()
+		}
+		rl.lock.Lock()
+	}
+}
+
+type rateLimitedTransport struct {
+	limiter  *RateLimiter
+	priority RequestPriority
+	base     http.RoundTripper
+}
+
+func (rlt *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	priority := rlt.priority
+	if ctxPriority, ok := req.Context().Value(priorityContextKey{}).(RequestPriority); ok {
+		priority = ctxPriority
+	}
+	if err := rlt.limiter.Wait(req.Context(), priority); err != nil {
+		return nil, err
+	}
+	return rlt.base.RoundTrip(req)
+}
+
+// WrapClient returns a copy of the given HTTP client whose requests go through this rate limiter
+// with the given priority, unless the request context overrides it with ContextWithPriority.
+func (rl *RateLimiter) WrapClient(client *http.Client, priority RequestPriority) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport:     &rateLimitedTransport{limiter: rl, priority: priority, base: base},
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}
+}
+
+// PriorityIntent creates a new intent for the given user whose requests use the given priority
+// when the appservice has a RateLimiter. Unlike Intent, the returned intent isn't cached,
+// so it should be reused for the duration of the work, e.g. a single backfill.
+func (as *AppService) PriorityIntent(userID id.UserID, priority RequestPriority) *IntentAPI {
+	intent := as.Intent(userID)
+	if intent == nil || as.RateLimiter == nil {
+		return intent
+	}
+	priorityIntent := as.NewIntentAPI(intent.Localpart)
+	priorityIntent.Client = as.createClient(userID, priority)
+	return priorityIntent
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+func TestRateLimiter_Burst(t *testing.T) {
+	rl := appservice.NewRateLimiter(20, 3)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rl.Wait(ctx, appservice.PriorityRealtime))
+	}
+	assert.Less(t, time.Since(start), 40*time.Millisecond, "burst requests shouldn't wait")
+
+	// After the burst, requests are limited to the rate.
+	require.NoError(t, rl.Wait(ctx, appservice.PriorityRealtime))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestRateLimiter_ContextCanceled(t *testing.T) {
+	rl := appservice.NewRateLimiter(10, 1)
+	require.NoError(t, rl.Wait(context.Background(), appservice.PriorityRealtime))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, rl.Wait(ctx, appservice.PriorityRealtime), context.DeadlineExceeded)
+
+	// The canceled realtime request doesn't block lower priorities forever.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, rl.Wait(ctx, appservice.PriorityBackfill))
+}
+
+func TestRateLimiter_Priority(t *testing.T) {
+	rl := appservice.NewRateLimiter(10, 1)
+	require.NoError(t, rl.Wait(context.Background(), appservice.PriorityRealtime))
+
+	var lock sync.Mutex
+	var order []appservice.RequestPriority
+	var wg sync.WaitGroup
+	wait := func(priority appservice.RequestPriority) {
+		defer wg.Done()
+		assert.NoError(t, rl.Wait(context.Background(), priority))
+		lock.Lock()
+		order = append(order, priority)
+		lock.Unlock()
+	}
+	wg.Add(3)
+	go wait(appservice.PriorityBackfill)
+	go wait(appservice.PriorityNormal)
+	// The realtime request starts later, but still gets the next token.
+	time.Sleep(20 * time.Millisecond)
+	go wait(appservice.PriorityRealtime)
+	wg.Wait()
+
+	assert.Equal(t, []appservice.RequestPriority{appservice.PriorityRealtime, appservice.PriorityNormal, appservice.PriorityBackfill}, order)
+}
+
+func TestAppService_PriorityIntent(t *testing.T) {
+	homeserver := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"user_id": "@ghost:example.com"}`))
+	})
+	// Without a rate limiter, the normal intent is returned.
+	as := newTestAppService(t, homeserver)
+	assert.Same(t, as.Intent("@ghost:example.com"), as.PriorityIntent("@ghost:example.com", appservice.PriorityBackfill))
+
+	as = newTestAppService(t, homeserver)
+	as.StateStore.MarkRegistered("@ghost:example.com")
+	as.HTTPClient = &http.Client{Timeout: 100 * time.Millisecond}
+	// The limiter allows one request, and doesn't refill during the test.
+	as.RateLimiter = appservice.NewRateLimiter(0.001, 1)
+	intent := as.Intent("@ghost:example.com")
+	backfillIntent := as.PriorityIntent("@ghost:example.com", appservice.PriorityBackfill)
+	assert.NotSame(t, intent, backfillIntent)
+	assert.Equal(t, intent.UserID, backfillIntent.UserID)
+
+	_, err := intent.Whoami()
+	require.NoError(t, err)
+	// The limiter is shared between intents, so the backfill intent has to wait for a token.
+	_, err = backfillIntent.Whoami()
+	assert.Error(t, err)
+}
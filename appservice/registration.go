@@ -9,8 +9,12 @@ package appservice
 import (
 	"io/ioutil"
 	"regexp"
+	"sync"
 
 	"gopkg.in/yaml.v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
 )
 
 // Registration contains the data in a Matrix appservice registration.
@@ -25,13 +29,16 @@ type Registration struct {
 	Namespaces      Namespaces `yaml:"namespaces"`
 	EphemeralEvents bool       `yaml:"de.sorunome.msc2409.push_ephemeral,omitempty"`
 	Protocols       []string   `yaml:"protocols,omitempty"`
+
+	// Whether the appservice manages devices of its users with the MSC4190 endpoints instead of /login.
+	MSC4190 bool `yaml:"io.element.msc4190,omitempty"`
 }
 
 // CreateRegistration creates a Registration with random appservice and homeserver tokens.
 func CreateRegistration() *Registration {
 	return &Registration{
-		AppToken:    RandomString(64),
-		ServerToken: RandomString(64),
+		AppToken:    util.RandomToken(64),
+		ServerToken: util.RandomToken(64),
 	}
 }
 
@@ -81,6 +88,54 @@ type Namespace struct {
 	Exclusive bool   `yaml:"exclusive"`
 }
 
+// namespaceRegexes caches compiled namespace regexes. The value is nil if the regex is invalid.
+var namespaceRegexes sync.Map
+
+func compileNamespaceRegex(pattern string) *regexp.Regexp {
+	if cached, ok := namespaceRegexes.Load(pattern); ok {
+		return cached.(*regexp.Regexp)
+	}
+	regex, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		regex = nil
+	}
+	namespaceRegexes.Store(pattern, regex)
+	return regex
+}
+
+// Matches checks if the given string matches the regex of this namespace.
+// The whole string must match, as namespace regexes are implicitly anchored by homeservers.
+func (ns *Namespace) Matches(str string) bool {
+	regex := compileNamespaceRegex(ns.Regex)
+	return regex != nil && regex.MatchString(str)
+}
+
+func matchNamespaces(namespaces []Namespace, str string) (matches, exclusive bool) {
+	for _, ns := range namespaces {
+		if ns.Matches(str) {
+			matches = true
+			exclusive = exclusive || ns.Exclusive
+		}
+	}
+	return
+}
+
+// MatchesUserID checks if the given user ID is in the user namespaces, and whether any of the matching
+// namespaces are exclusive.
+func (nslist *Namespaces) MatchesUserID(userID id.UserID) (matches, exclusive bool) {
+	return matchNamespaces(nslist.UserIDs, string(userID))
+}
+
+// MatchesRoomAlias checks if the given room alias is in the alias namespaces, and whether any of the matching
+// namespaces are exclusive. The server name in the alias is normalized to lowercase before matching,
+// and invalid aliases never match.
+func (nslist *Namespaces) MatchesRoomAlias(alias id.RoomAlias) (matches, exclusive bool) {
+	if _, _, err := alias.ParseAndValidate(); err != nil {
+		return false, false
+	}
+	return matchNamespaces(nslist.RoomAliases, string(alias.Normalize()))
+}
+
 // RegisterUserIDs creates an user ID namespace registration.
 func (nslist *Namespaces) RegisterUserIDs(regex *regexp.Regexp, exclusive bool) {
 	nslist.UserIDs = append(nslist.UserIDs, Namespace{
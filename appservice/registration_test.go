@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestNamespaces_MatchesUserID(t *testing.T) {
+	namespaces := appservice.Namespaces{UserIDs: []appservice.Namespace{
+		{Regex: "@bridge_.+:example\\.com", Exclusive: true},
+		{Regex: "@shared_.+:example\\.com"},
+		{Regex: "@invalid_(.+:example\\.com"},
+	}}
+	for i := 0; i < 2; i++ {
+		matches, exclusive := namespaces.MatchesUserID("@bridge_alice:example.com")
+		assert.True(t, matches)
+		assert.True(t, exclusive)
+		matches, exclusive = namespaces.MatchesUserID("@shared_bob:example.com")
+		assert.True(t, matches)
+		assert.False(t, exclusive)
+		matches, _ = namespaces.MatchesUserID(id.UserID("@x:y.com @bridge_alice:example.com"))
+		assert.False(t, matches, "namespace regexes must be anchored")
+		matches, _ = namespaces.MatchesUserID("@invalid_carol:example.com")
+		assert.False(t, matches, "invalid regexes must not match")
+	}
+}
+
+func TestRegistration_MSC4190(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registration.yaml")
+	reg := &appservice.Registration{ID: "bridge", MSC4190: true}
+	require.NoError(t, reg.Save(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "io.element.msc4190: true")
+
+	loaded, err := appservice.LoadRegistration(path)
+	require.NoError(t, err)
+	assert.True(t, loaded.MSC4190)
+}
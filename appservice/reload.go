@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// TokenGracePeriod is how long the previous hs_token is still accepted after the registration is updated.
+// This gives the homeserver time to pick up the new registration without transactions being rejected.
+var TokenGracePeriod = 5 * time.Minute
+
+func (as *AppService) isValidServerToken(token string) bool {
+	as.registrationLock.RLock()
+	defer as.registrationLock.RUnlock()
+	if subtle.ConstantTimeCompare([]byte(token), []byte(as.Registration.ServerToken)) == 1 {
+		return true
+	}
+	return len(as.previousServerToken) > 0 &&
+		time.Now().Before(as.previousTokenExpiry) &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(as.previousServerToken)) == 1
+}
+
+// ErrWebsocketRegistrationChanged is passed to StopWebsocket when the as_token changes, as the websocket
+// connection is still authenticated with the old token. The caller should call StartWebsocket again.
+var ErrWebsocketRegistrationChanged = errors.New("the appservice registration was reloaded with a new as_token")
+
+// GetRegistration returns the current registration of the appservice.
+// Unlike reading the Registration field directly, this is safe to call concurrently with UpdateRegistration.
+func (as *AppService) GetRegistration() *Registration {
+	as.registrationLock.RLock()
+	defer as.registrationLock.RUnlock()
+	return as.Registration
+}
+
+// UpdateRegistration replaces the registration of the appservice at runtime.
+//
+// Clients created by the appservice read the as_token from the current registration on every request,
+// so they switch to the new token immediately. If the hs_token changed, the old token will still be accepted
+// for incoming requests for TokenGracePeriod. If the as_token changed, the websocket (if any) is stopped
+// with ErrWebsocketRegistrationChanged so that it can be reconnected with the new token.
+//
+// Code outside this package must use GetRegistration instead of reading the Registration field
+// if the registration may be reloaded while the appservice is running.
+func (as *AppService) UpdateRegistration(reg *Registration) {
+	as.registrationLock.Lock()
+	tokenChanged := as.Registration != nil && as.Registration.AppToken != reg.AppToken
+	if as.Registration != nil && as.Registration.ServerToken != reg.ServerToken {
+		as.previousServerToken = as.Registration.ServerToken
+		as.previousTokenExpiry = time.Now().Add(TokenGracePeriod)
+	}
+	as.Registration = reg
+	as.registrationLock.Unlock()
+
+	if tokenChanged && as.StopWebsocket != nil {
+		as.StopWebsocket(ErrWebsocketRegistrationChanged)
+	}
+	as.Log.Infoln("Appservice registration updated")
+}
+
+// tokenTransport adds the current as_token to requests that don't have an Authorization header,
+// i.e. requests from clients that haven't logged in with their own access token.
+type tokenTransport struct {
+	as   *AppService
+	base http.RoundTripper
+}
+
+func (tt *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) == 0 {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+tt.as.GetRegistration().AppToken)
+	}
+	return tt.base.RoundTrip(req)
+}
+
+func (as *AppService) wrapClientWithToken(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport:     &tokenTransport{as: as, base: base},
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}
+}
+
+// ReloadRegistration reads the registration file from RegistrationPath again and applies it with UpdateRegistration.
+func (as *AppService) ReloadRegistration() error {
+	if len(as.RegistrationPath) == 0 {
+		return errors.New("registration path not set")
+	}
+	reg, err := LoadRegistration(as.RegistrationPath)
+	if err != nil {
+		return err
+	}
+	as.UpdateRegistration(reg)
+	return nil
+}
+
+// ReloadRegistrationOnSIGHUP starts a goroutine that calls ReloadRegistration whenever the process receives SIGHUP.
+// The returned function can be used to stop listening for the signal.
+func (as *AppService) ReloadRegistrationOnSIGHUP() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if err := as.ReloadRegistration(); err != nil {
+					as.Log.Errorln("Failed to reload registration:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
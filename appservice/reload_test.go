@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+func TestAppService_UpdateRegistration(t *testing.T) {
+	var lock sync.Mutex
+	var tokens []string
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		lock.Unlock()
+		_, _ = w.Write([]byte(`{"user_id": "@bot:example.com"}`))
+	}))
+	client := as.BotClient()
+
+	_, err := client.Whoami()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		as.UpdateRegistration(&appservice.Registration{AppToken: "new_as_token", ServerToken: "hs_token", SenderLocalpart: "bot"})
+	}()
+	go func() {
+		defer wg.Done()
+		_ = as.BotMXID()
+	}()
+	wg.Wait()
+
+	_, err = client.Whoami()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer as_token", "Bearer new_as_token"}, tokens)
+	assert.Equal(t, "new_as_token", as.GetRegistration().AppToken)
+}
+
+func TestAppService_UpdateRegistration_StopsWebsocket(t *testing.T) {
+	as := newTestAppService(t, nil)
+	var stopErr error
+	as.StopWebsocket = func(err error) {
+		stopErr = err
+	}
+	as.UpdateRegistration(&appservice.Registration{AppToken: "as_token", ServerToken: "new_hs_token", SenderLocalpart: "bot"})
+	assert.NoError(t, stopErr)
+	as.UpdateRegistration(&appservice.Registration{AppToken: "new_as_token", ServerToken: "new_hs_token", SenderLocalpart: "bot"})
+	assert.ErrorIs(t, stopErr, appservice.ErrWebsocketRegistrationChanged)
+}
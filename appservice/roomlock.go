@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type roomLock struct {
+	sync.Mutex
+	refs int
+}
+
+// roomLocks is a set of per-room locks. Locks are removed once nobody is holding or waiting for them,
+// so the zero value is ready to use and the set doesn't grow with the number of rooms ever locked.
+type roomLocks struct {
+	lock  sync.Mutex
+	rooms map[id.RoomID]*roomLock
+}
+
+func (rl *roomLocks) Lock(roomID id.RoomID) {
+	rl.lock.Lock()
+	if rl.rooms == nil {
+		rl.rooms = make(map[id.RoomID]*roomLock)
+	}
+	lock, ok := rl.rooms[roomID]
+	if !ok {
+		lock = &roomLock{}
+		rl.rooms[roomID] = lock
+	}
+	lock.refs++
+	rl.lock.Unlock()
+	lock.Lock()
+}
+
+func (rl *roomLocks) Unlock(roomID id.RoomID) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	lock := rl.rooms[roomID]
+	lock.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(rl.rooms, roomID)
+	}
+}
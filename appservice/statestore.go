@@ -28,12 +28,34 @@ type StateStore interface {
 	TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool)
 	SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership)
 	SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent)
+	// SetMembers stores the given members in one batch. Members that aren't in the map are left as-is.
+	SetMembers(roomID id.RoomID, members map[id.UserID]*event.MemberEventContent)
+	// ReplaceRoomState replaces all cached state of the room with the given full state, e.g. from a /state response.
+	ReplaceRoomState(roomID id.RoomID, state []*event.Event)
 
 	SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent)
 	GetPowerLevels(roomID id.RoomID) *event.PowerLevelsEventContent
 	GetPowerLevel(roomID id.RoomID, userID id.UserID) int
 	GetPowerLevelRequirement(roomID id.RoomID, eventType event.Type) int
 	HasPowerLevel(roomID id.RoomID, userID id.UserID, eventType event.Type) bool
+
+	SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent)
+	GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent
+	IsEncrypted(roomID id.RoomID) bool
+	// FindSharedRooms returns the encrypted rooms where the given user is joined or invited.
+	FindSharedRooms(userID id.UserID) []id.RoomID
+
+	SetRoomName(roomID id.RoomID, name string)
+	SetRoomTopic(roomID id.RoomID, topic string)
+	SetRoomAvatar(roomID id.RoomID, avatarURL id.ContentURI)
+	SetCanonicalAlias(roomID id.RoomID, alias id.RoomAlias)
+	SetRoomType(roomID id.RoomID, roomType event.RoomType)
+	GetRoomMetadata(roomID id.RoomID) (metadata RoomMetadata, ok bool)
+
+	GetDisplayName(userID id.UserID) (displayName string, ok bool)
+	SetDisplayName(userID id.UserID, displayName string)
+	GetAvatarURL(userID id.UserID) (avatarURL id.ContentURI, ok bool)
+	SetAvatarURL(userID id.UserID, avatarURL id.ContentURI)
 }
 
 func (as *AppService) UpdateState(evt *event.Event) {
@@ -42,7 +64,89 @@ func (as *AppService) UpdateState(evt *event.Event) {
 		as.StateStore.SetMember(evt.RoomID, id.UserID(evt.GetStateKey()), content)
 	case *event.PowerLevelsEventContent:
 		as.StateStore.SetPowerLevels(evt.RoomID, content)
+	case *event.EncryptionEventContent:
+		as.StateStore.SetEncryptionEvent(evt.RoomID, content)
+	case *event.RoomNameEventContent:
+		as.StateStore.SetRoomName(evt.RoomID, content.Name)
+	case *event.TopicEventContent:
+		as.StateStore.SetRoomTopic(evt.RoomID, content.Topic)
+	case *event.RoomAvatarEventContent:
+		as.StateStore.SetRoomAvatar(evt.RoomID, content.URL)
+	case *event.CanonicalAliasEventContent:
+		as.StateStore.SetCanonicalAlias(evt.RoomID, content.Alias)
+	case *event.CreateEventContent:
+		as.StateStore.SetRoomType(evt.RoomID, content.Type)
+	}
+}
+
+// RoomStateSnapshot contains the parts of a room's state that are cached in state stores.
+// It's used by state stores to apply full room state in one batch.
+type RoomStateSnapshot struct {
+	Members     map[id.UserID]*event.MemberEventContent
+	PowerLevels *event.PowerLevelsEventContent
+	Encryption  *event.EncryptionEventContent
+	Metadata    RoomMetadata
+}
+
+// NewRoomStateSnapshot collects the cached parts of the given state events. Event contents are parsed
+// if they haven't been parsed yet, and events that can't be parsed are ignored.
+func NewRoomStateSnapshot(state []*event.Event) *RoomStateSnapshot {
+	snapshot := &RoomStateSnapshot{
+		Members: make(map[id.UserID]*event.MemberEventContent),
+	}
+	for _, evt := range state {
+		if evt.Content.Parsed == nil {
+			evt.Type.Class = event.StateEventType
+			if err := evt.Content.ParseRaw(evt.Type); err != nil {
+				continue
+			}
+		}
+		switch content := evt.Content.Parsed.(type) {
+		case *event.MemberEventContent:
+			snapshot.Members[id.UserID(evt.GetStateKey())] = content
+		case *event.PowerLevelsEventContent:
+			snapshot.PowerLevels = content
+		case *event.EncryptionEventContent:
+			snapshot.Encryption = content
+		case *event.RoomNameEventContent:
+			snapshot.Metadata.Name = content.Name
+		case *event.TopicEventContent:
+			snapshot.Metadata.Topic = content.Topic
+		case *event.RoomAvatarEventContent:
+			snapshot.Metadata.AvatarURL = content.URL
+		case *event.CanonicalAliasEventContent:
+			snapshot.Metadata.CanonicalAlias = content.Alias
+		case *event.CreateEventContent:
+			snapshot.Metadata.Type = content.Type
+		}
+	}
+	return snapshot
+}
+
+// powerLevelsEqual checks whether the given power levels grant the same levels. Nil and empty maps are equal,
+// as the difference isn't preserved by all state codecs (e.g. gob) or by PowerLevelsEventContent.Clone.
+func powerLevelsEqual(a, b *event.PowerLevelsEventContent) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	a, b = a.Clone(), b.Clone()
+	return levelMapsEqual(a.Users, b.Users) && a.UsersDefault == b.UsersDefault &&
+		levelMapsEqual(a.Events, b.Events) && a.EventsDefault == b.EventsDefault &&
+		a.StateDefault() == b.StateDefault() && a.Invite() == b.Invite() && a.Kick() == b.Kick() &&
+		a.Ban() == b.Ban() && a.Redact() == b.Redact() && a.Historical() == b.Historical() &&
+		a.NotificationLevel("room") == b.NotificationLevel("room")
+}
+
+func levelMapsEqual[K comparable](a, b map[K]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, level := range a {
+		if otherLevel, ok := b[key]; !ok || otherLevel != level {
+			return false
+		}
 	}
+	return true
 }
 
 type TypingStateStore struct {
@@ -67,6 +171,23 @@ func (store *TypingStateStore) IsTyping(roomID id.RoomID, userID id.UserID) bool
 	return typingEndsAt >= time.Now().Unix()
 }
 
+// PruneExpired removes all typing notifications that have expired.
+func (store *TypingStateStore) PruneExpired() {
+	store.typingLock.Lock()
+	defer store.typingLock.Unlock()
+	now := time.Now().Unix()
+	for roomID, roomTyping := range store.typing {
+		for userID, typingEndsAt := range roomTyping {
+			if typingEndsAt < now {
+				delete(roomTyping, userID)
+			}
+		}
+		if len(roomTyping) == 0 {
+			delete(store.typing, roomID)
+		}
+	}
+}
+
 func (store *TypingStateStore) SetTyping(roomID id.RoomID, userID id.UserID, timeout int64) {
 	store.typingLock.Lock()
 	defer store.typingLock.Unlock()
@@ -86,7 +207,148 @@ func (store *TypingStateStore) SetTyping(roomID id.RoomID, userID id.UserID, tim
 			delete(roomTyping, userID)
 		}
 	}
-	store.typing[roomID] = roomTyping
+	if len(roomTyping) == 0 {
+		delete(store.typing, roomID)
+	} else {
+		store.typing[roomID] = roomTyping
+	}
+}
+
+type globalProfile struct {
+	displayName    string
+	hasDisplayName bool
+	avatarURL      id.ContentURI
+	hasAvatarURL   bool
+}
+
+// ProfileStateStore caches the global profiles of users, which is used to avoid redundant profile updates.
+type ProfileStateStore struct {
+	profiles     map[id.UserID]*globalProfile
+	profilesLock sync.RWMutex
+}
+
+func NewProfileStateStore() *ProfileStateStore {
+	return &ProfileStateStore{
+		profiles: make(map[id.UserID]*globalProfile),
+	}
+}
+
+func (store *ProfileStateStore) GetDisplayName(userID id.UserID) (string, bool) {
+	store.profilesLock.RLock()
+	defer store.profilesLock.RUnlock()
+	profile, ok := store.profiles[userID]
+	if !ok {
+		return "", false
+	}
+	return profile.displayName, profile.hasDisplayName
+}
+
+func (store *ProfileStateStore) SetDisplayName(userID id.UserID, displayName string) {
+	store.profilesLock.Lock()
+	defer store.profilesLock.Unlock()
+	profile, ok := store.profiles[userID]
+	if !ok {
+		profile = &globalProfile{}
+		store.profiles[userID] = profile
+	}
+	profile.displayName = displayName
+	profile.hasDisplayName = true
+}
+
+func (store *ProfileStateStore) GetAvatarURL(userID id.UserID) (id.ContentURI, bool) {
+	store.profilesLock.RLock()
+	defer store.profilesLock.RUnlock()
+	profile, ok := store.profiles[userID]
+	if !ok {
+		return id.ContentURI{}, false
+	}
+	return profile.avatarURL, profile.hasAvatarURL
+}
+
+func (store *ProfileStateStore) SetAvatarURL(userID id.UserID, avatarURL id.ContentURI) {
+	store.profilesLock.Lock()
+	defer store.profilesLock.Unlock()
+	profile, ok := store.profiles[userID]
+	if !ok {
+		profile = &globalProfile{}
+		store.profiles[userID] = profile
+	}
+	profile.avatarURL = avatarURL
+	profile.hasAvatarURL = true
+}
+
+// RoomMetadata contains the commonly displayed metadata of a room, which is cached from state events.
+type RoomMetadata struct {
+	Name           string
+	Topic          string
+	AvatarURL      id.ContentURI
+	CanonicalAlias id.RoomAlias
+	Type           event.RoomType
+}
+
+// IsSpace returns true if the room is a space.
+func (meta RoomMetadata) IsSpace() bool {
+	return meta.Type == event.RoomTypeSpace
+}
+
+// RoomMetadataStateStore caches the metadata of rooms in memory.
+type RoomMetadataStateStore struct {
+	rooms     map[id.RoomID]*RoomMetadata
+	roomsLock sync.RWMutex
+}
+
+func NewRoomMetadataStateStore() *RoomMetadataStateStore {
+	return &RoomMetadataStateStore{
+		rooms: make(map[id.RoomID]*RoomMetadata),
+	}
+}
+
+func (store *RoomMetadataStateStore) update(roomID id.RoomID, fn func(meta *RoomMetadata)) {
+	store.roomsLock.Lock()
+	defer store.roomsLock.Unlock()
+	meta, ok := store.rooms[roomID]
+	if !ok {
+		meta = &RoomMetadata{}
+		store.rooms[roomID] = meta
+	}
+	fn(meta)
+}
+
+func (store *RoomMetadataStateStore) SetRoomName(roomID id.RoomID, name string) {
+	store.update(roomID, func(meta *RoomMetadata) { meta.Name = name })
+}
+
+func (store *RoomMetadataStateStore) SetRoomTopic(roomID id.RoomID, topic string) {
+	store.update(roomID, func(meta *RoomMetadata) { meta.Topic = topic })
+}
+
+func (store *RoomMetadataStateStore) SetRoomAvatar(roomID id.RoomID, avatarURL id.ContentURI) {
+	store.update(roomID, func(meta *RoomMetadata) { meta.AvatarURL = avatarURL })
+}
+
+func (store *RoomMetadataStateStore) SetCanonicalAlias(roomID id.RoomID, alias id.RoomAlias) {
+	store.update(roomID, func(meta *RoomMetadata) { meta.CanonicalAlias = alias })
+}
+
+func (store *RoomMetadataStateStore) SetRoomType(roomID id.RoomID, roomType event.RoomType) {
+	store.update(roomID, func(meta *RoomMetadata) { meta.Type = roomType })
+}
+
+func (store *RoomMetadataStateStore) setRoomMetadata(roomID id.RoomID, meta RoomMetadata) {
+	store.roomsLock.Lock()
+	store.rooms[roomID] = &meta
+	store.roomsLock.Unlock()
+}
+
+// GetRoomMetadata returns a copy of the cached metadata of the room. If nothing is cached, ok is false.
+func (store *RoomMetadataStateStore) GetRoomMetadata(roomID id.RoomID) (RoomMetadata, bool) {
+	store.roomsLock.RLock()
+	defer store.roomsLock.RUnlock()
+	meta, ok := store.rooms[roomID]
+	if !ok {
+		return RoomMetadata{}, false
+	}
+	return *meta, true
 }
 
 type BasicStateStore struct {
@@ -96,16 +358,27 @@ type BasicStateStore struct {
 	Members           map[id.RoomID]map[id.UserID]*event.MemberEventContent `json:"memberships"`
 	powerLevelsLock   sync.RWMutex                                          `json:"-"`
 	PowerLevels       map[id.RoomID]*event.PowerLevelsEventContent          `json:"power_levels"`
+	encryptionLock    sync.RWMutex                                          `json:"-"`
+	Encryption        map[id.RoomID]*event.EncryptionEventContent           `json:"encryption"`
 
 	*TypingStateStore
+	*ProfileStateStore
+	*RoomMetadataStateStore
+
+	options BasicStateStoreOptions
+	lru     *roomLRU
 }
 
 func NewBasicStateStore() StateStore {
 	return &BasicStateStore{
-		Registrations:    make(map[id.UserID]bool),
-		Members:          make(map[id.RoomID]map[id.UserID]*event.MemberEventContent),
-		PowerLevels:      make(map[id.RoomID]*event.PowerLevelsEventContent),
-		TypingStateStore: NewTypingStateStore(),
+		Registrations:     make(map[id.UserID]bool),
+		Members:           make(map[id.RoomID]map[id.UserID]*event.MemberEventContent),
+		PowerLevels:       make(map[id.RoomID]*event.PowerLevelsEventContent),
+		Encryption:        make(map[id.RoomID]*event.EncryptionEventContent),
+		TypingStateStore:  NewTypingStateStore(),
+		ProfileStateStore: NewProfileStateStore(),
+
+		RoomMetadataStateStore: NewRoomMetadataStateStore(),
 	}
 }
 
@@ -123,6 +396,7 @@ func (store *BasicStateStore) MarkRegistered(userID id.UserID) {
 }
 
 func (store *BasicStateStore) GetRoomMembers(roomID id.RoomID) map[id.UserID]*event.MemberEventContent {
+	store.touchRoom(roomID)
 	store.membersLock.RLock()
 	members, ok := store.Members[roomID]
 	store.membersLock.RUnlock()
@@ -148,6 +422,7 @@ func (store *BasicStateStore) GetMember(roomID id.RoomID, userID id.UserID) *eve
 }
 
 func (store *BasicStateStore) TryGetMember(roomID id.RoomID, userID id.UserID) (member *event.MemberEventContent, ok bool) {
+	store.touchRoom(roomID)
 	store.membersLock.RLock()
 	defer store.membersLock.RUnlock()
 	members, membersOk := store.Members[roomID]
@@ -177,6 +452,7 @@ func (store *BasicStateStore) IsMembership(roomID id.RoomID, userID id.UserID, a
 }
 
 func (store *BasicStateStore) SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership) {
+	store.touchRoom(roomID)
 	store.membersLock.Lock()
 	members, ok := store.Members[roomID]
 	if !ok {
@@ -192,11 +468,13 @@ func (store *BasicStateStore) SetMembership(roomID id.RoomID, userID id.UserID,
 			members[userID] = member
 		}
 	}
+	store.capMembers(members)
 	store.Members[roomID] = members
 	store.membersLock.Unlock()
 }
 
 func (store *BasicStateStore) SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	store.touchRoom(roomID)
 	store.membersLock.Lock()
 	members, ok := store.Members[roomID]
 	if !ok {
@@ -206,17 +484,59 @@ func (store *BasicStateStore) SetMember(roomID id.RoomID, userID id.UserID, memb
 	} else {
 		members[userID] = member
 	}
+	store.capMembers(members)
 	store.Members[roomID] = members
 	store.membersLock.Unlock()
 }
 
+func (store *BasicStateStore) SetMembers(roomID id.RoomID, newMembers map[id.UserID]*event.MemberEventContent) {
+	store.touchRoom(roomID)
+	store.membersLock.Lock()
+	members, ok := store.Members[roomID]
+	if !ok {
+		members = make(map[id.UserID]*event.MemberEventContent, len(newMembers))
+		store.Members[roomID] = members
+	}
+	for userID, member := range newMembers {
+		members[userID] = member
+	}
+	store.capMembers(members)
+	store.membersLock.Unlock()
+}
+
+func (store *BasicStateStore) ReplaceRoomState(roomID id.RoomID, state []*event.Event) {
+	store.touchRoom(roomID)
+	snapshot := NewRoomStateSnapshot(state)
+	store.membersLock.Lock()
+	store.capMembers(snapshot.Members)
+	store.Members[roomID] = snapshot.Members
+	store.membersLock.Unlock()
+	store.powerLevelsLock.Lock()
+	if snapshot.PowerLevels != nil {
+		store.PowerLevels[roomID] = snapshot.PowerLevels
+	} else {
+		delete(store.PowerLevels, roomID)
+	}
+	store.powerLevelsLock.Unlock()
+	store.encryptionLock.Lock()
+	if snapshot.Encryption != nil {
+		store.Encryption[roomID] = snapshot.Encryption
+	} else {
+		delete(store.Encryption, roomID)
+	}
+	store.encryptionLock.Unlock()
+	store.setRoomMetadata(roomID, snapshot.Metadata)
+}
+
 func (store *BasicStateStore) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) {
+	store.touchRoom(roomID)
 	store.powerLevelsLock.Lock()
 	store.PowerLevels[roomID] = levels
 	store.powerLevelsLock.Unlock()
 }
 
 func (store *BasicStateStore) GetPowerLevels(roomID id.RoomID) (levels *event.PowerLevelsEventContent) {
+	store.touchRoom(roomID)
 	store.powerLevelsLock.RLock()
 	levels = store.PowerLevels[roomID]
 	store.powerLevelsLock.RUnlock()
@@ -234,3 +554,57 @@ func (store *BasicStateStore) GetPowerLevelRequirement(roomID id.RoomID, eventTy
 func (store *BasicStateStore) HasPowerLevel(roomID id.RoomID, userID id.UserID, eventType event.Type) bool {
 	return store.GetPowerLevel(roomID, userID) >= store.GetPowerLevelRequirement(roomID, eventType)
 }
+
+func (store *BasicStateStore) SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent) {
+	store.encryptionLock.Lock()
+	store.Encryption[roomID] = content
+	store.encryptionLock.Unlock()
+}
+
+func (store *BasicStateStore) GetEncryptionEvent(roomID id.RoomID) (content *event.EncryptionEventContent) {
+	store.encryptionLock.RLock()
+	content = store.Encryption[roomID]
+	store.encryptionLock.RUnlock()
+	return
+}
+
+func (store *BasicStateStore) IsEncrypted(roomID id.RoomID) bool {
+	return store.GetEncryptionEvent(roomID) != nil
+}
+
+// FindSharedRooms returns the encrypted rooms where the given user is joined or invited.
+func (store *BasicStateStore) FindSharedRooms(userID id.UserID) (rooms []id.RoomID) {
+	// The members are read directly, as a scan over all encrypted rooms mustn't mark them as recently used.
+	store.encryptionLock.RLock()
+	defer store.encryptionLock.RUnlock()
+	store.membersLock.RLock()
+	defer store.membersLock.RUnlock()
+	for roomID := range store.Encryption {
+		member, ok := store.Members[roomID][userID]
+		if ok && (member.Membership == event.MembershipJoin || member.Membership == event.MembershipInvite) {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return
+}
+
+// CountEntries returns the number of registrations, rooms with cached members, members, power levels and encrypted rooms in the store.
+func (store *BasicStateStore) CountEntries() map[string]int {
+	counts := make(map[string]int, 5)
+	store.registrationsLock.RLock()
+	counts["registrations"] = len(store.Registrations)
+	store.registrationsLock.RUnlock()
+	store.membersLock.RLock()
+	counts["rooms"] = len(store.Members)
+	for _, members := range store.Members {
+		counts["members"] += len(members)
+	}
+	store.membersLock.RUnlock()
+	store.powerLevelsLock.RLock()
+	counts["power_levels"] = len(store.PowerLevels)
+	store.powerLevelsLock.RUnlock()
+	store.encryptionLock.RLock()
+	counts["encrypted_rooms"] = len(store.Encryption)
+	store.encryptionLock.RUnlock()
+	return counts
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+)
+
+// StateCodec is used by persistent state stores to encode the state payloads they store as opaque values,
+// such as power levels and encryption event contents.
+//
+// Stores must be read with the same codec that was used to write them, so the codec of an existing store
+// can't be changed without clearing it (or resyncing all rooms with IntentAPI.CheckRoomState).
+type StateCodec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes values as JSON. This is the default codec of all state stores.
+	JSONCodec StateCodec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob. Unknown fields (like MemberEventContent.Extra) are preserved.
+	GobCodec StateCodec = gobCodec{}
+)
+
+var (
+	stateCodecs     = map[string]StateCodec{JSONCodec.Name(): JSONCodec, GobCodec.Name(): GobCodec}
+	stateCodecsLock sync.RWMutex
+)
+
+// RegisterStateCodec registers a codec, so that it can be found with StateCodecByName.
+//
+// A MessagePack codec is available in the maunium.net/go/mautrix/msgpackcodec module, which registers itself
+// when imported.
+func RegisterStateCodec(codec StateCodec) {
+	stateCodecsLock.Lock()
+	stateCodecs[codec.Name()] = codec
+	stateCodecsLock.Unlock()
+}
+
+// StateCodecByName returns the built-in or registered codec with the given name, or nil if there is none.
+func StateCodecByName(name string) StateCodec {
+	stateCodecsLock.RLock()
+	defer stateCodecsLock.RUnlock()
+	return stateCodecs[name]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// BasicStateStoreOptions contains limits for the in-memory state store. Zero values mean no limit.
+//
+// Evicted rooms are treated the same as rooms that were never cached: users are assumed to not be in the room,
+// so intents will make redundant join requests, and GetRoomMembers returns an empty map until the members are
+// cached again (e.g. with IntentAPI.CheckRoomState or a new member list fetch). Power levels of evicted rooms
+// fall back to the defaults, so HasPowerLevel may be wrong until the power levels are fetched again.
+// Room encryption state is never evicted, as forgetting it could cause messages to be sent unencrypted.
+type BasicStateStoreOptions struct {
+	// MaxRooms is the maximum number of rooms to cache members, power levels and metadata for.
+	// When the limit is exceeded, the least recently used room is evicted.
+	MaxRooms int
+	// RoomTTL is the duration after which rooms that haven't been accessed are evicted by Prune.
+	RoomTTL time.Duration
+	// MaxMembersPerRoom is the number of cached members per room after which members who have left the room
+	// are evicted. Forgetting them doesn't lose any information, as unknown users are treated as having left.
+	// Other members are never evicted, so rooms with more current members than this can still exceed the limit.
+	MaxMembersPerRoom int
+	// Now returns the current time used for RoomTTL. Defaults to time.Now.
+	Now func() time.Time
+}
+
+type lruRoom struct {
+	roomID     id.RoomID
+	lastAccess time.Time
+}
+
+// roomLRU tracks when rooms were last accessed. The front of the list is the most recently used room.
+type roomLRU struct {
+	lock     sync.Mutex
+	order    *list.List
+	elements map[id.RoomID]*list.Element
+}
+
+func newRoomLRU() *roomLRU {
+	return &roomLRU{
+		order:    list.New(),
+		elements: make(map[id.RoomID]*list.Element),
+	}
+}
+
+// touch marks the room as used and returns the rooms that need to be evicted to stay within maxRooms.
+func (lru *roomLRU) touch(roomID id.RoomID, now time.Time, maxRooms int) (evicted []id.RoomID) {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+	if elem, ok := lru.elements[roomID]; ok {
+		elem.Value.(*lruRoom).lastAccess = now
+		lru.order.MoveToFront(elem)
+	} else {
+		lru.elements[roomID] = lru.order.PushFront(&lruRoom{roomID: roomID, lastAccess: now})
+	}
+	for maxRooms > 0 && lru.order.Len() > maxRooms {
+		evicted = append(evicted, lru.removeElement(lru.order.Back()))
+	}
+	return
+}
+
+// expire removes and returns the rooms that haven't been accessed after the given time.
+func (lru *roomLRU) expire(before time.Time) (evicted []id.RoomID) {
+	lru.lock.Lock()
+	defer lru.lock.Unlock()
+	for elem := lru.order.Back(); elem != nil && elem.Value.(*lruRoom).lastAccess.Before(before); elem = lru.order.Back() {
+		evicted = append(evicted, lru.removeElement(elem))
+	}
+	return
+}
+
+func (lru *roomLRU) removeElement(elem *list.Element) id.RoomID {
+	roomID := lru.order.Remove(elem).(*lruRoom).roomID
+	delete(lru.elements, roomID)
+	return roomID
+}
+
+// NewBasicStateStoreWithOptions creates a new in-memory state store with the given size limits.
+func NewBasicStateStoreWithOptions(options BasicStateStoreOptions) *BasicStateStore {
+	store := NewBasicStateStore().(*BasicStateStore)
+	store.options = options
+	if store.options.Now == nil {
+		store.options.Now = time.Now
+	}
+	if options.MaxRooms > 0 || options.RoomTTL > 0 {
+		store.lru = newRoomLRU()
+	}
+	return store
+}
+
+// touchRoom marks the room as recently used and evicts other rooms if necessary.
+// This must not be called while holding any of the store's locks.
+func (store *BasicStateStore) touchRoom(roomID id.RoomID) {
+	if store.lru == nil {
+		return
+	}
+	for _, evictedRoomID := range store.lru.touch(roomID, store.options.Now(), store.options.MaxRooms) {
+		store.evictRoom(evictedRoomID)
+	}
+}
+
+func (store *BasicStateStore) evictRoom(roomID id.RoomID) {
+	store.membersLock.Lock()
+	delete(store.Members, roomID)
+	store.membersLock.Unlock()
+	store.powerLevelsLock.Lock()
+	delete(store.PowerLevels, roomID)
+	store.powerLevelsLock.Unlock()
+	store.roomsLock.Lock()
+	delete(store.rooms, roomID)
+	store.roomsLock.Unlock()
+}
+
+// capMembers evicts members who have left the room from the given map until it's within MaxMembersPerRoom.
+// This must be called while holding membersLock.
+func (store *BasicStateStore) capMembers(members map[id.UserID]*event.MemberEventContent) {
+	maxMembers := store.options.MaxMembersPerRoom
+	if maxMembers <= 0 || len(members) <= maxMembers {
+		return
+	}
+	for userID, member := range members {
+		if len(members) <= maxMembers {
+			return
+		} else if member.Membership == event.MembershipLeave {
+			delete(members, userID)
+		}
+	}
+}
+
+// Prune removes expired typing notifications and evicts rooms that haven't been accessed within RoomTTL.
+// It should be called periodically when using RoomTTL, as rooms are only expired here.
+func (store *BasicStateStore) Prune() {
+	store.TypingStateStore.PruneExpired()
+	if store.lru != nil && store.options.RoomTTL > 0 {
+		for _, roomID := range store.lru.expire(store.options.Now().Add(-store.options.RoomTTL)) {
+			store.evictRoom(roomID)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const limitsTestUser = id.UserID("@user:example.com")
+
+func TestBasicStateStore_MaxRooms(t *testing.T) {
+	store := appservice.NewBasicStateStoreWithOptions(appservice.BasicStateStoreOptions{MaxRooms: 2})
+	store.SetMembership("!a:example.com", limitsTestUser, event.MembershipJoin)
+	store.SetMembership("!b:example.com", limitsTestUser, event.MembershipJoin)
+	store.SetEncryptionEvent("!b:example.com", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+	// Using room A makes B the least recently used room.
+	assert.True(t, store.IsInRoom("!a:example.com", limitsTestUser))
+	store.SetPowerLevels("!c:example.com", &event.PowerLevelsEventContent{})
+
+	assert.Contains(t, store.Members, id.RoomID("!a:example.com"))
+	assert.NotContains(t, store.Members, id.RoomID("!b:example.com"))
+	assert.Contains(t, store.PowerLevels, id.RoomID("!c:example.com"))
+	assert.True(t, store.IsEncrypted("!b:example.com"), "encryption state must never be evicted")
+	assert.False(t, store.IsInRoom("!b:example.com", limitsTestUser))
+}
+
+func TestBasicStateStore_RoomTTL(t *testing.T) {
+	now := time.Now()
+	store := appservice.NewBasicStateStoreWithOptions(appservice.BasicStateStoreOptions{
+		RoomTTL: time.Minute,
+		Now:     func() time.Time { return now },
+	})
+	store.SetMembership("!old:example.com", limitsTestUser, event.MembershipJoin)
+	now = now.Add(2 * time.Minute)
+	store.SetMembership("!new:example.com", limitsTestUser, event.MembershipJoin)
+
+	assert.Contains(t, store.Members, id.RoomID("!old:example.com"), "rooms must only be expired by Prune")
+	store.Prune()
+	assert.NotContains(t, store.Members, id.RoomID("!old:example.com"))
+	assert.True(t, store.IsInRoom("!new:example.com", limitsTestUser))
+}
+
+func TestBasicStateStore_FindSharedRoomsDoesNotTouch(t *testing.T) {
+	store := appservice.NewBasicStateStoreWithOptions(appservice.BasicStateStoreOptions{MaxRooms: 2})
+	store.SetMembership("!a:example.com", limitsTestUser, event.MembershipInvite)
+	store.SetEncryptionEvent("!a:example.com", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+	store.SetMembership("!b:example.com", limitsTestUser, event.MembershipJoin)
+
+	assert.Equal(t, []id.RoomID{"!a:example.com"}, store.FindSharedRooms(limitsTestUser))
+	// Room A must still be the least recently used room.
+	store.SetMembership("!c:example.com", limitsTestUser, event.MembershipJoin)
+	assert.NotContains(t, store.Members, id.RoomID("!a:example.com"))
+	assert.Contains(t, store.Members, id.RoomID("!b:example.com"))
+}
+
+func TestBasicStateStore_MaxMembersPerRoom(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	store := appservice.NewBasicStateStoreWithOptions(appservice.BasicStateStoreOptions{MaxMembersPerRoom: 2})
+	store.SetMembership(roomID, "@left:example.com", event.MembershipLeave)
+	store.SetMembership(roomID, "@banned:example.com", event.MembershipBan)
+	store.SetMembership(roomID, "@bot:example.com", event.MembershipJoin)
+	store.SetMembership(roomID, "@invited:example.com", event.MembershipInvite)
+
+	members := store.GetRoomMembers(roomID)
+	assert.NotContains(t, members, id.UserID("@left:example.com"))
+	// Members who haven't left are kept even if the room exceeds the limit.
+	assert.Len(t, members, 3)
+	assert.True(t, store.IsMembership(roomID, "@banned:example.com", event.MembershipBan))
+	assert.True(t, store.IsInRoom(roomID, "@bot:example.com"))
+	assert.True(t, store.IsInvited(roomID, "@invited:example.com"))
+}
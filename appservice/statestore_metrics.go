@@ -0,0 +1,253 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// StateStoreEntryCounter is implemented by state stores that can report how many entries of each type
+// (e.g. rooms, members, encrypted_rooms) they contain.
+type StateStoreEntryCounter interface {
+	CountEntries() map[string]int
+}
+
+// StateStoreStatsProvider is implemented by state stores that record operation statistics, like InstrumentedStateStore.
+// The statistics are included in the /metrics endpoint, even if the store is wrapped in a StateStoreWrapper.
+type StateStoreStatsProvider interface {
+	Stats() map[string]StateStoreOperationStats
+}
+
+// StateStoreOperationStats contains the statistics of a single state store operation.
+type StateStoreOperationStats struct {
+	Calls int64
+	// Hits and Misses are only counted for lookups, where a miss means the store didn't have the requested data.
+	Hits     int64
+	Misses   int64
+	Duration time.Duration
+}
+
+const (
+	opGetMember        = "get_member"
+	opIsMembership     = "is_membership"
+	opGetPowerLevels   = "get_power_levels"
+	opGetEncryption    = "get_encryption"
+	opGetRoomMetadata  = "get_room_metadata"
+	opGetDisplayName   = "get_displayname"
+	opGetAvatarURL     = "get_avatar_url"
+	opSetMember        = "set_member"
+	opSetMembers       = "set_members"
+	opReplaceRoomState = "replace_room_state"
+	opSetPowerLevels   = "set_power_levels"
+	opSetEncryption    = "set_encryption"
+)
+
+// InstrumentedStateStore wraps another StateStore and records call counts, hit/miss counts and latency
+// of member, power level, encryption, room metadata and profile operations. Membership and power level checks
+// are answered from TryGetMember and GetPowerLevels of the wrapped store, so they're counted as lookups too.
+//
+// When the appservice's StateStore is instrumented, the statistics are included in the /metrics endpoint,
+// which makes it possible to tell when state store misses are causing excessive member fetches.
+type InstrumentedStateStore struct {
+	stateStoreWrapper
+
+	statsLock sync.Mutex
+	stats     map[string]*StateStoreOperationStats
+}
+
+var _ StateStoreWrapper = (*InstrumentedStateStore)(nil)
+var _ StateStoreStatsProvider = (*InstrumentedStateStore)(nil)
+
+// NewInstrumentedStateStore wraps the given state store.
+func NewInstrumentedStateStore(store StateStore) *InstrumentedStateStore {
+	return &InstrumentedStateStore{
+		stateStoreWrapper: stateStoreWrapper{store},
+		stats:             make(map[string]*StateStoreOperationStats),
+	}
+}
+
+// Stats returns a copy of the current statistics of each operation.
+func (store *InstrumentedStateStore) Stats() map[string]StateStoreOperationStats {
+	store.statsLock.Lock()
+	defer store.statsLock.Unlock()
+	stats := make(map[string]StateStoreOperationStats, len(store.stats))
+	for op, opStats := range store.stats {
+		stats[op] = *opStats
+	}
+	return stats
+}
+
+// ResetStats clears all recorded statistics.
+func (store *InstrumentedStateStore) ResetStats() {
+	store.statsLock.Lock()
+	store.stats = make(map[string]*StateStoreOperationStats)
+	store.statsLock.Unlock()
+}
+
+func (store *InstrumentedStateStore) record(op string, start time.Time, lookup, found bool) {
+	duration := time.Since(start)
+	store.statsLock.Lock()
+	defer store.statsLock.Unlock()
+	opStats, ok := store.stats[op]
+	if !ok {
+		opStats = &StateStoreOperationStats{}
+		store.stats[op] = opStats
+	}
+	opStats.Calls++
+	opStats.Duration += duration
+	if lookup && found {
+		opStats.Hits++
+	} else if lookup {
+		opStats.Misses++
+	}
+}
+
+func (store *InstrumentedStateStore) TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool) {
+	start := time.Now()
+	member, ok := store.StateStore.TryGetMember(roomID, userID)
+	store.record(opGetMember, start, true, ok)
+	return member, ok
+}
+
+func (store *InstrumentedStateStore) GetMember(roomID id.RoomID, userID id.UserID) *event.MemberEventContent {
+	member, ok := store.TryGetMember(roomID, userID)
+	if !ok {
+		member = &event.MemberEventContent{Membership: event.MembershipLeave}
+	}
+	return member
+}
+
+func (store *InstrumentedStateStore) IsInRoom(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin)
+}
+
+func (store *InstrumentedStateStore) IsInvited(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin, event.MembershipInvite)
+}
+
+// IsMembership looks up the member with TryGetMember of the wrapped store, so that membership checks are counted
+// as hits or misses. Like in the built-in stores, users who aren't in the store are treated as having left.
+func (store *InstrumentedStateStore) IsMembership(roomID id.RoomID, userID id.UserID, allowedMemberships ...event.Membership) bool {
+	start := time.Now()
+	member, ok := store.StateStore.TryGetMember(roomID, userID)
+	store.record(opIsMembership, start, true, ok)
+	membership := event.MembershipLeave
+	if ok && member != nil {
+		membership = member.Membership
+	}
+	for _, allowedMembership := range allowedMemberships {
+		if allowedMembership == membership {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *InstrumentedStateStore) GetPowerLevels(roomID id.RoomID) *event.PowerLevelsEventContent {
+	start := time.Now()
+	levels := store.StateStore.GetPowerLevels(roomID)
+	store.record(opGetPowerLevels, start, true, levels != nil)
+	return levels
+}
+
+// GetPowerLevel gets the user's level from GetPowerLevels, so it's counted as a hit or miss.
+// If the power levels aren't cached, the wrapped store decides the level.
+func (store *InstrumentedStateStore) GetPowerLevel(roomID id.RoomID, userID id.UserID) int {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return store.StateStore.GetPowerLevel(roomID, userID)
+	}
+	return levels.GetUserLevel(userID)
+}
+
+func (store *InstrumentedStateStore) GetPowerLevelRequirement(roomID id.RoomID, eventType event.Type) int {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return store.StateStore.GetPowerLevelRequirement(roomID, eventType)
+	}
+	return levels.GetEventLevel(eventType)
+}
+
+func (store *InstrumentedStateStore) HasPowerLevel(roomID id.RoomID, userID id.UserID, eventType event.Type) bool {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return store.StateStore.HasPowerLevel(roomID, userID, eventType)
+	}
+	return levels.GetUserLevel(userID) >= levels.GetEventLevel(eventType)
+}
+
+func (store *InstrumentedStateStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	start := time.Now()
+	content := store.StateStore.GetEncryptionEvent(roomID)
+	store.record(opGetEncryption, start, true, content != nil)
+	return content
+}
+
+func (store *InstrumentedStateStore) IsEncrypted(roomID id.RoomID) bool {
+	return store.GetEncryptionEvent(roomID) != nil
+}
+
+func (store *InstrumentedStateStore) GetRoomMetadata(roomID id.RoomID) (RoomMetadata, bool) {
+	start := time.Now()
+	meta, ok := store.StateStore.GetRoomMetadata(roomID)
+	store.record(opGetRoomMetadata, start, true, ok)
+	return meta, ok
+}
+
+func (store *InstrumentedStateStore) GetDisplayName(userID id.UserID) (string, bool) {
+	start := time.Now()
+	displayName, ok := store.StateStore.GetDisplayName(userID)
+	store.record(opGetDisplayName, start, true, ok)
+	return displayName, ok
+}
+
+func (store *InstrumentedStateStore) GetAvatarURL(userID id.UserID) (id.ContentURI, bool) {
+	start := time.Now()
+	avatarURL, ok := store.StateStore.GetAvatarURL(userID)
+	store.record(opGetAvatarURL, start, true, ok)
+	return avatarURL, ok
+}
+
+func (store *InstrumentedStateStore) SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership) {
+	start := time.Now()
+	store.StateStore.SetMembership(roomID, userID, membership)
+	store.record(opSetMember, start, false, false)
+}
+
+func (store *InstrumentedStateStore) SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	start := time.Now()
+	store.StateStore.SetMember(roomID, userID, member)
+	store.record(opSetMember, start, false, false)
+}
+
+func (store *InstrumentedStateStore) SetMembers(roomID id.RoomID, members map[id.UserID]*event.MemberEventContent) {
+	start := time.Now()
+	store.StateStore.SetMembers(roomID, members)
+	store.record(opSetMembers, start, false, false)
+}
+
+func (store *InstrumentedStateStore) ReplaceRoomState(roomID id.RoomID, state []*event.Event) {
+	start := time.Now()
+	store.StateStore.ReplaceRoomState(roomID, state)
+	store.record(opReplaceRoomState, start, false, false)
+}
+
+func (store *InstrumentedStateStore) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) {
+	start := time.Now()
+	store.StateStore.SetPowerLevels(roomID, levels)
+	store.record(opSetPowerLevels, start, false, false)
+}
+
+func (store *InstrumentedStateStore) SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent) {
+	start := time.Now()
+	store.StateStore.SetEncryptionEvent(roomID, content)
+	store.record(opSetEncryption, start, false, false)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const metricsTestRoom = id.RoomID("!room:example.com")
+
+func TestInstrumentedStateStore_MembershipChecks(t *testing.T) {
+	store := appservice.NewInstrumentedStateStore(appservice.NewBasicStateStore())
+	store.SetMembership(metricsTestRoom, "@alice:example.com", event.MembershipJoin)
+
+	assert.True(t, store.IsInRoom(metricsTestRoom, "@alice:example.com"))
+	assert.True(t, store.IsInvited(metricsTestRoom, "@alice:example.com"))
+	assert.False(t, store.IsInRoom(metricsTestRoom, "@bob:example.com"))
+	stats := store.Stats()["is_membership"]
+	assert.Equal(t, int64(3), stats.Calls)
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+}
+
+func TestInstrumentedStateStore_PowerLevelChecks(t *testing.T) {
+	store := appservice.NewInstrumentedStateStore(appservice.NewBasicStateStore())
+	store.SetPowerLevels(metricsTestRoom, &event.PowerLevelsEventContent{
+		Users:  map[id.UserID]int{"@alice:example.com": 100},
+		Events: map[string]int{event.StateTopic.Type: 50},
+	})
+
+	assert.Equal(t, 100, store.GetPowerLevel(metricsTestRoom, "@alice:example.com"))
+	assert.True(t, store.HasPowerLevel(metricsTestRoom, "@alice:example.com", event.StateTopic))
+	assert.False(t, store.HasPowerLevel(metricsTestRoom, "@bob:example.com", event.StateTopic))
+	assert.Equal(t, 50, store.GetPowerLevelRequirement(metricsTestRoom, event.StateTopic))
+	assert.Nil(t, store.GetPowerLevels("!other:example.com"))
+	stats := store.Stats()["get_power_levels"]
+	assert.Equal(t, int64(5), stats.Calls)
+	assert.Equal(t, int64(4), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+}
+
+func TestAppService_GetMetrics_WrappedInstrumentedStateStore(t *testing.T) {
+	as := newTestAppService(t, nil)
+	instrumented := appservice.NewInstrumentedStateStore(appservice.NewBasicStateStore())
+	as.StateStore = appservice.NewObservableStateStore(instrumented)
+	as.StateStore.GetPowerLevels(metricsTestRoom)
+
+	w := httptest.NewRecorder()
+	as.GetMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `mautrix_appservice_state_store_misses_total{operation="get_power_levels"} 1`)
+}
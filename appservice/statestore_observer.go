@@ -0,0 +1,214 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MembershipChangeHandler is called when the stored membership of a user in a room changes.
+// The previous membership is "leave" if the user wasn't known before.
+type MembershipChangeHandler func(roomID id.RoomID, userID id.UserID, prevMembership, newMembership event.Membership)
+
+// PowerLevelsChangeHandler is called when the stored power levels of a room change.
+// The previous power levels are nil if they weren't known before.
+type PowerLevelsChangeHandler func(roomID id.RoomID, prevLevels, newLevels *event.PowerLevelsEventContent)
+
+// EncryptionEnabledHandler is called when a room that wasn't previously known to be encrypted becomes encrypted.
+type EncryptionEnabledHandler func(roomID id.RoomID, content *event.EncryptionEventContent)
+
+// ObservableStateStore wraps another StateStore and calls registered handlers when the stored state changes.
+//
+// Since all state updates go through the store, handlers are called regardless of whether the change came from
+// an appservice transaction, a sync or an outgoing request made by an intent. Handlers are called synchronously
+// after the wrapped store has been updated, so they should not block for long.
+//
+// Updates to the same room are serialized, so the previous values passed to handlers are always the ones the
+// update replaced. Handlers are called after the room is unlocked, which means they may update the store,
+// but the handlers of concurrent updates to the same room may be called in either order.
+type ObservableStateStore struct {
+	stateStoreWrapper
+
+	roomLocks roomLocks
+
+	handlersLock       sync.RWMutex
+	membershipHandlers []MembershipChangeHandler
+	powerLevelHandlers []PowerLevelsChangeHandler
+	encryptionHandlers []EncryptionEnabledHandler
+}
+
+var _ StateStoreWrapper = (*ObservableStateStore)(nil)
+
+// NewObservableStateStore wraps the given state store.
+func NewObservableStateStore(store StateStore) *ObservableStateStore {
+	return &ObservableStateStore{stateStoreWrapper: stateStoreWrapper{store}}
+}
+
+// OnMembershipChange registers a handler for membership changes.
+func (store *ObservableStateStore) OnMembershipChange(handler MembershipChangeHandler) {
+	store.handlersLock.Lock()
+	store.membershipHandlers = append(store.membershipHandlers, handler)
+	store.handlersLock.Unlock()
+}
+
+// OnPowerLevelsChange registers a handler for power level changes.
+func (store *ObservableStateStore) OnPowerLevelsChange(handler PowerLevelsChangeHandler) {
+	store.handlersLock.Lock()
+	store.powerLevelHandlers = append(store.powerLevelHandlers, handler)
+	store.handlersLock.Unlock()
+}
+
+// OnEncryptionEnabled registers a handler for rooms becoming encrypted.
+func (store *ObservableStateStore) OnEncryptionEnabled(handler EncryptionEnabledHandler) {
+	store.handlersLock.Lock()
+	store.encryptionHandlers = append(store.encryptionHandlers, handler)
+	store.handlersLock.Unlock()
+}
+
+func (store *ObservableStateStore) hasMembershipHandlers() bool {
+	store.handlersLock.RLock()
+	defer store.handlersLock.RUnlock()
+	return len(store.membershipHandlers) > 0
+}
+
+func (store *ObservableStateStore) notifyMembership(roomID id.RoomID, userID id.UserID, prevMembership, newMembership event.Membership) {
+	if prevMembership == newMembership {
+		return
+	}
+	store.handlersLock.RLock()
+	handlers := store.membershipHandlers
+	store.handlersLock.RUnlock()
+	for _, handler := range handlers {
+		handler(roomID, userID, prevMembership, newMembership)
+	}
+}
+
+func (store *ObservableStateStore) notifyPowerLevels(roomID id.RoomID, prevLevels, newLevels *event.PowerLevelsEventContent) {
+	if powerLevelsEqual(prevLevels, newLevels) {
+		return
+	}
+	store.handlersLock.RLock()
+	handlers := store.powerLevelHandlers
+	store.handlersLock.RUnlock()
+	for _, handler := range handlers {
+		handler(roomID, prevLevels, newLevels)
+	}
+}
+
+func (store *ObservableStateStore) notifyEncryption(roomID id.RoomID, wasEncrypted bool, content *event.EncryptionEventContent) {
+	if wasEncrypted || content == nil {
+		return
+	}
+	store.handlersLock.RLock()
+	handlers := store.encryptionHandlers
+	store.handlersLock.RUnlock()
+	for _, handler := range handlers {
+		handler(roomID, content)
+	}
+}
+
+// prevPowerLevels returns a copy of the currently stored power levels, as in-memory stores
+// may return the same pointer that is later mutated.
+func (store *ObservableStateStore) prevPowerLevels(roomID id.RoomID) *event.PowerLevelsEventContent {
+	levels := store.StateStore.GetPowerLevels(roomID)
+	if levels != nil {
+		levels = levels.Clone()
+	}
+	return levels
+}
+
+func (store *ObservableStateStore) SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership) {
+	store.roomLocks.Lock(roomID)
+	prevMembership := store.StateStore.GetMember(roomID, userID).Membership
+	store.StateStore.SetMembership(roomID, userID, membership)
+	store.roomLocks.Unlock(roomID)
+	store.notifyMembership(roomID, userID, prevMembership, membership)
+}
+
+func (store *ObservableStateStore) SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	store.roomLocks.Lock(roomID)
+	prevMembership := store.StateStore.GetMember(roomID, userID).Membership
+	store.StateStore.SetMember(roomID, userID, member)
+	store.roomLocks.Unlock(roomID)
+	store.notifyMembership(roomID, userID, prevMembership, member.Membership)
+}
+
+func (store *ObservableStateStore) getPrevMemberships(roomID id.RoomID, members map[id.UserID]*event.MemberEventContent) map[id.UserID]event.Membership {
+	if !store.hasMembershipHandlers() {
+		return nil
+	}
+	prevMemberships := make(map[id.UserID]event.Membership, len(members))
+	for userID := range members {
+		prevMemberships[userID] = store.StateStore.GetMember(roomID, userID).Membership
+	}
+	return prevMemberships
+}
+
+func (store *ObservableStateStore) notifyMembers(roomID id.RoomID, prevMemberships map[id.UserID]event.Membership, members map[id.UserID]*event.MemberEventContent) {
+	if prevMemberships == nil {
+		return
+	}
+	for userID, member := range members {
+		store.notifyMembership(roomID, userID, prevMemberships[userID], member.Membership)
+	}
+}
+
+func (store *ObservableStateStore) SetMembers(roomID id.RoomID, members map[id.UserID]*event.MemberEventContent) {
+	store.roomLocks.Lock(roomID)
+	prevMemberships := store.getPrevMemberships(roomID, members)
+	store.StateStore.SetMembers(roomID, members)
+	store.roomLocks.Unlock(roomID)
+	store.notifyMembers(roomID, prevMemberships, members)
+}
+
+// ReplaceRoomState replaces the state of the room in the wrapped store. Members who were stored before, but aren't
+// in the new state, are notified as having left if the wrapped store can list room members.
+func (store *ObservableStateStore) ReplaceRoomState(roomID id.RoomID, state []*event.Event) {
+	snapshot := NewRoomStateSnapshot(state)
+	store.roomLocks.Lock(roomID)
+	prevMemberships := store.getPrevMemberships(roomID, snapshot.Members)
+	if prevMemberships != nil {
+		for userID, member := range store.GetRoomMembers(roomID) {
+			if _, ok := prevMemberships[userID]; !ok {
+				prevMemberships[userID] = member.Membership
+			}
+		}
+	}
+	prevLevels := store.prevPowerLevels(roomID)
+	wasEncrypted := store.StateStore.IsEncrypted(roomID)
+	store.StateStore.ReplaceRoomState(roomID, state)
+	store.roomLocks.Unlock(roomID)
+	store.notifyMembers(roomID, prevMemberships, snapshot.Members)
+	for userID, prevMembership := range prevMemberships {
+		if _, inState := snapshot.Members[userID]; !inState {
+			store.notifyMembership(roomID, userID, prevMembership, event.MembershipLeave)
+		}
+	}
+	if snapshot.PowerLevels != nil {
+		store.notifyPowerLevels(roomID, prevLevels, snapshot.PowerLevels)
+	}
+	store.notifyEncryption(roomID, wasEncrypted, snapshot.Encryption)
+}
+
+func (store *ObservableStateStore) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) {
+	store.roomLocks.Lock(roomID)
+	prevLevels := store.prevPowerLevels(roomID)
+	store.StateStore.SetPowerLevels(roomID, levels)
+	store.roomLocks.Unlock(roomID)
+	store.notifyPowerLevels(roomID, prevLevels, levels)
+}
+
+func (store *ObservableStateStore) SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent) {
+	store.roomLocks.Lock(roomID)
+	wasEncrypted := store.StateStore.IsEncrypted(roomID)
+	store.StateStore.SetEncryptionEvent(roomID, content)
+	store.roomLocks.Unlock(roomID)
+	store.notifyEncryption(roomID, wasEncrypted, content)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/statestoretest"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const observerTestRoom = id.RoomID("!room:example.com")
+
+func newRecordingObservableStore() (*appservice.ObservableStateStore, *[]string) {
+	store := appservice.NewObservableStateStore(appservice.NewBasicStateStore())
+	var changes []string
+	store.OnMembershipChange(func(roomID id.RoomID, userID id.UserID, prevMembership, newMembership event.Membership) {
+		changes = append(changes, fmt.Sprintf("%s %s->%s", userID, prevMembership, newMembership))
+	})
+	return store, &changes
+}
+
+func TestObservableStateStore_Membership(t *testing.T) {
+	store, changes := newRecordingObservableStore()
+	store.SetMembership(observerTestRoom, "@alice:example.com", event.MembershipJoin)
+	store.SetMember(observerTestRoom, "@alice:example.com", &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "Alice"})
+	store.SetMembers(observerTestRoom, map[id.UserID]*event.MemberEventContent{
+		"@alice:example.com": {Membership: event.MembershipLeave},
+	})
+	assert.Equal(t, []string{"@alice:example.com leave->join", "@alice:example.com join->leave"}, *changes)
+}
+
+// slowMemberStore widens the window between reading the previous membership and storing the new one.
+type slowMemberStore struct {
+	appservice.StateStore
+}
+
+func (store slowMemberStore) GetMember(roomID id.RoomID, userID id.UserID) *event.MemberEventContent {
+	member := store.StateStore.GetMember(roomID, userID)
+	time.Sleep(time.Millisecond)
+	return member
+}
+
+func TestObservableStateStore_ConcurrentMembership(t *testing.T) {
+	store := appservice.NewObservableStateStore(slowMemberStore{appservice.NewBasicStateStore()})
+	var lock sync.Mutex
+	var joins, leaves int
+	store.OnMembershipChange(func(roomID id.RoomID, userID id.UserID, prevMembership, newMembership event.Membership) {
+		lock.Lock()
+		defer lock.Unlock()
+		if newMembership == event.MembershipJoin {
+			joins++
+		} else {
+			leaves++
+		}
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		membership := event.MembershipJoin
+		if i%2 == 1 {
+			membership = event.MembershipLeave
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.SetMembership(observerTestRoom, "@alice:example.com", membership)
+		}()
+	}
+	wg.Wait()
+	// Every reported transition must start from the membership the previous one ended in.
+	expectedJoins := leaves
+	if store.IsInRoom(observerTestRoom, "@alice:example.com") {
+		expectedJoins++
+	}
+	assert.Equal(t, expectedJoins, joins)
+}
+
+func TestObservableStateStore_ReplaceRoomState(t *testing.T) {
+	store, changes := newRecordingObservableStore()
+	store.SetMembership(observerTestRoom, "@alice:example.com", event.MembershipJoin)
+	store.SetMembership(observerTestRoom, "@bob:example.com", event.MembershipJoin)
+	*changes = nil
+
+	store.ReplaceRoomState(observerTestRoom, []*event.Event{
+		statestoretest.StateEvent(event.StateMember, "@alice:example.com", &event.MemberEventContent{Membership: event.MembershipJoin}),
+		statestoretest.StateEvent(event.StateMember, "@carol:example.com", &event.MemberEventContent{Membership: event.MembershipInvite}),
+	})
+	sort.Strings(*changes)
+	assert.Equal(t, []string{"@bob:example.com join->leave", "@carol:example.com leave->invite"}, *changes)
+	assert.False(t, store.IsInRoom(observerTestRoom, "@bob:example.com"))
+}
+
+func TestObservableStateStore_PowerLevels(t *testing.T) {
+	store := appservice.NewObservableStateStore(appservice.NewBasicStateStore())
+	var calls int
+	var prev *event.PowerLevelsEventContent
+	store.OnPowerLevelsChange(func(roomID id.RoomID, prevLevels, newLevels *event.PowerLevelsEventContent) {
+		calls++
+		prev = prevLevels
+	})
+	store.SetPowerLevels(observerTestRoom, &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@alice:example.com": 100}})
+	assert.Equal(t, 1, calls)
+	assert.Nil(t, prev)
+	store.SetPowerLevels(observerTestRoom, &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@alice:example.com": 100}})
+	assert.Equal(t, 1, calls, "unchanged power levels must not be notified")
+	store.SetPowerLevels(observerTestRoom, &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@alice:example.com": 50}})
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 100, prev.GetUserLevel("@alice:example.com"))
+}
+
+func TestObservableStateStore_IntentSetPowerLevel(t *testing.T) {
+	as := newTestAppService(t, &sendRecorder{})
+	store := appservice.NewObservableStateStore(appservice.NewBasicStateStore())
+	as.StateStore = store
+	store.SetMembership(observerTestRoom, "@bot:example.com", event.MembershipJoin)
+	store.SetPowerLevels(observerTestRoom, &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@bot:example.com": 100}})
+	var prev, next *event.PowerLevelsEventContent
+	store.OnPowerLevelsChange(func(roomID id.RoomID, prevLevels, newLevels *event.PowerLevelsEventContent) {
+		prev, next = prevLevels, newLevels
+	})
+
+	_, err := as.BotIntent().SetPowerLevel(observerTestRoom, "@alice:example.com", 50)
+	require.NoError(t, err)
+	require.NotNil(t, next)
+	assert.Equal(t, 0, prev.GetUserLevel("@alice:example.com"))
+	assert.Equal(t, 50, next.GetUserLevel("@alice:example.com"))
+}
+
+func TestObservableStateStore_EncryptionEnabled(t *testing.T) {
+	store := appservice.NewObservableStateStore(appservice.NewBasicStateStore())
+	var encrypted []id.RoomID
+	store.OnEncryptionEnabled(func(roomID id.RoomID, content *event.EncryptionEventContent) {
+		encrypted = append(encrypted, roomID)
+	})
+	store.SetEncryptionEvent(observerTestRoom, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+	store.SetEncryptionEvent(observerTestRoom, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1, RotationPeriodMessages: 100})
+	store.ReplaceRoomState("!other:example.com", []*event.Event{
+		statestoretest.StateEvent(event.StateEncryption, "", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}),
+	})
+	assert.Equal(t, []id.RoomID{observerTestRoom, "!other:example.com"}, encrypted)
+	assert.True(t, store.IsEncrypted(observerTestRoom))
+}
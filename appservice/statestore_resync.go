@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MemberDrift describes a member whose stored info doesn't match the actual room state.
+type MemberDrift struct {
+	UserID id.UserID
+	// The member info in the state store, or nil if the store doesn't know about the user.
+	Stored *event.MemberEventContent
+	// The member info in the actual room state, or nil if the user has no member event in the room.
+	Actual *event.MemberEventContent
+}
+
+// StateDrift is the result of comparing the state store's view of a room against the actual room state.
+type StateDrift struct {
+	RoomID id.RoomID
+
+	Members     []MemberDrift
+	PowerLevels bool
+	Encryption  bool
+	Metadata    bool
+}
+
+// HasDrift returns true if anything in the state store differs from the actual room state.
+func (drift *StateDrift) HasDrift() bool {
+	return len(drift.Members) > 0 || drift.PowerLevels || drift.Encryption || drift.Metadata
+}
+
+type roomMemberLister interface {
+	GetRoomMembers(roomID id.RoomID) map[id.UserID]*event.MemberEventContent
+}
+
+func memberEqual(stored, actual *event.MemberEventContent) bool {
+	return stored.Membership == actual.Membership &&
+		stored.Displayname == actual.Displayname &&
+		stored.AvatarURL == actual.AvatarURL
+}
+
+func encryptionEqual(stored, actual *event.EncryptionEventContent) bool {
+	if stored == nil || actual == nil {
+		return stored == actual
+	}
+	return stored.Algorithm == actual.Algorithm &&
+		stored.RotationPeriodMillis == actual.RotationPeriodMillis &&
+		stored.RotationPeriodMessages == actual.RotationPeriodMessages
+}
+
+// CompareRoomState compares the state store's view of the room against the given full room state.
+//
+// Stored members who aren't in the room state are only reported if the store can list room members
+// (i.e. has a GetRoomMembers method) and the stored membership isn't leave. Power levels and encryption
+// are compared by their values, so differences that codecs don't preserve (like nil vs empty maps) aren't drift.
+func CompareRoomState(store StateStore, roomID id.RoomID, state []*event.Event) *StateDrift {
+	snapshot := NewRoomStateSnapshot(state)
+	drift := &StateDrift{RoomID: roomID}
+
+	for userID, actual := range snapshot.Members {
+		stored, ok := store.TryGetMember(roomID, userID)
+		if !ok {
+			if actual.Membership != event.MembershipLeave {
+				drift.Members = append(drift.Members, MemberDrift{UserID: userID, Actual: actual})
+			}
+		} else if !memberEqual(stored, actual) {
+			drift.Members = append(drift.Members, MemberDrift{UserID: userID, Stored: stored, Actual: actual})
+		}
+	}
+	if lister, ok := store.(roomMemberLister); ok {
+		for userID, stored := range lister.GetRoomMembers(roomID) {
+			if _, inState := snapshot.Members[userID]; !inState && stored.Membership != event.MembershipLeave {
+				drift.Members = append(drift.Members, MemberDrift{UserID: userID, Stored: stored})
+			}
+		}
+	}
+
+	drift.PowerLevels = !powerLevelsEqual(store.GetPowerLevels(roomID), snapshot.PowerLevels)
+	drift.Encryption = !encryptionEqual(store.GetEncryptionEvent(roomID), snapshot.Encryption)
+	storedMeta, _ := store.GetRoomMetadata(roomID)
+	drift.Metadata = storedMeta != snapshot.Metadata
+	return drift
+}
+
+// CheckRoomState fetches the full state of the room and compares it against the state store.
+// If repair is true and any drift is found, the stored state of the room is replaced with the fetched state.
+//
+// This is meant to be used as a periodic maintenance task for long-running bridges.
+func (intent *IntentAPI) CheckRoomState(roomID id.RoomID, repair bool) (*StateDrift, error) {
+	state, err := intent.Client.State(roomID)
+	if err != nil {
+		return nil, err
+	}
+	var events []*event.Event
+	for _, stateKeyMap := range state {
+		for _, evt := range stateKeyMap {
+			events = append(events, evt)
+		}
+	}
+	drift := CompareRoomState(intent.as.StateStore, roomID, events)
+	if repair && drift.HasDrift() {
+		intent.as.StateStore.ReplaceRoomState(roomID, events)
+	}
+	return drift, nil
+}
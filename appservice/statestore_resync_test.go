@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/statestoretest"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const resyncTestRoom = id.RoomID("!room:example.com")
+
+func resyncTestState() []*event.Event {
+	return []*event.Event{
+		statestoretest.StateEvent(event.StateMember, "@alice:example.com", &event.MemberEventContent{Membership: event.MembershipJoin}),
+		statestoretest.StateEvent(event.StatePowerLevels, "", &event.PowerLevelsEventContent{
+			Users:  map[id.UserID]int{"@alice:example.com": 100},
+			Events: map[string]int{},
+		}),
+		statestoretest.StateEvent(event.StateEncryption, "", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}),
+	}
+}
+
+func TestCompareRoomState_NoDrift(t *testing.T) {
+	store := appservice.NewBasicStateStore()
+	store.SetMembership(resyncTestRoom, "@alice:example.com", event.MembershipJoin)
+	// Persistent stores may lose the difference between nil and empty maps, which must not be reported as drift.
+	store.SetPowerLevels(resyncTestRoom, &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{"@alice:example.com": 100},
+	})
+	store.SetEncryptionEvent(resyncTestRoom, &event.EncryptionEventContent{
+		Algorithm: id.AlgorithmMegolmV1,
+		Extra:     map[string]json.RawMessage{},
+	})
+
+	drift := appservice.CompareRoomState(store, resyncTestRoom, resyncTestState())
+	assert.False(t, drift.HasDrift(), "%+v", drift)
+}
+
+func TestCompareRoomState_Drift(t *testing.T) {
+	store := appservice.NewBasicStateStore()
+	store.ReplaceRoomState(resyncTestRoom, resyncTestState())
+	store.SetMembership(resyncTestRoom, "@bob:example.com", event.MembershipJoin)
+	store.GetPowerLevels(resyncTestRoom).SetUserLevel("@alice:example.com", 50)
+
+	drift := appservice.CompareRoomState(store, resyncTestRoom, resyncTestState())
+	assert.True(t, drift.PowerLevels)
+	assert.False(t, drift.Encryption)
+	require.Len(t, drift.Members, 1)
+	assert.Equal(t, id.UserID("@bob:example.com"), drift.Members[0].UserID)
+	assert.Nil(t, drift.Members[0].Actual)
+}
+
+func TestIntentAPI_CheckRoomState_Repair(t *testing.T) {
+	as := newTestAppService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[
+			{"type": "m.room.member", "state_key": "@bot:example.com", "sender": "@bot:example.com", "event_id": "$1", "room_id": "!room:example.com", "content": {"membership": "join"}},
+			{"type": "m.room.encryption", "state_key": "", "sender": "@bot:example.com", "event_id": "$2", "room_id": "!room:example.com", "content": {"algorithm": "m.megolm.v1.aes-sha2"}}
+		]`))
+	}))
+	as.StateStore.SetMembership(resyncTestRoom, "@ghost:example.com", event.MembershipJoin)
+
+	drift, err := as.BotIntent().CheckRoomState(resyncTestRoom, true)
+	require.NoError(t, err)
+	assert.True(t, drift.Encryption)
+	assert.Len(t, drift.Members, 2)
+	assert.True(t, as.StateStore.IsInRoom(resyncTestRoom, "@bot:example.com"))
+	assert.False(t, as.StateStore.IsInRoom(resyncTestRoom, "@ghost:example.com"))
+
+	drift, err = as.BotIntent().CheckRoomState(resyncTestRoom, false)
+	require.NoError(t, err)
+	assert.False(t, drift.HasDrift(), "%+v", drift)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// StateStoreWrapper is implemented by state stores that wrap another state store,
+// like ObservableStateStore and InstrumentedStateStore.
+type StateStoreWrapper interface {
+	StateStore
+	// Unwrap returns the wrapped state store.
+	Unwrap() StateStore
+}
+
+// findStateStore returns the first state store in the chain of wrappers that implements T.
+func findStateStore[T any](store StateStore) (found T, ok bool) {
+	for store != nil {
+		if found, ok = store.(T); ok {
+			return
+		}
+		wrapper, isWrapper := store.(StateStoreWrapper)
+		if !isWrapper {
+			break
+		}
+		store = wrapper.Unwrap()
+	}
+	return
+}
+
+// stateStoreWrapper is embedded in state store wrappers. It delegates all methods that the wrapper doesn't
+// override to the wrapped store, including the optional interfaces that the wrapped store implements.
+type stateStoreWrapper struct {
+	StateStore
+}
+
+func (wrapper stateStoreWrapper) Unwrap() StateStore {
+	return wrapper.StateStore
+}
+
+// Flush flushes the wrapped store if it implements StateStoreFlusher.
+func (wrapper stateStoreWrapper) Flush() error {
+	if flusher, ok := wrapper.StateStore.(StateStoreFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// CountEntries returns the entry counts of the wrapped store, or nil if it doesn't implement StateStoreEntryCounter.
+func (wrapper stateStoreWrapper) CountEntries() map[string]int {
+	if counter, ok := wrapper.StateStore.(StateStoreEntryCounter); ok {
+		return counter.CountEntries()
+	}
+	return nil
+}
+
+// GetRoomMembers returns the members of the room from the wrapped store, or nil if it can't list members.
+func (wrapper stateStoreWrapper) GetRoomMembers(roomID id.RoomID) map[id.UserID]*event.MemberEventContent {
+	if lister, ok := wrapper.StateStore.(roomMemberLister); ok {
+		return lister.GetRoomMembers(roomID)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package statestoretest contains helpers shared by the tests of appservice.StateStore implementations.
+package statestoretest
+
+import (
+	"maunium.net/go/mautrix/event"
+)
+
+// StateEvent returns a state event with already parsed content, like the ones passed to
+// StateStore.ReplaceRoomState after fetching the room state.
+func StateEvent(evtType event.Type, stateKey string, content interface{}) *event.Event {
+	evtType.Class = event.StateEventType
+	return &event.Event{
+		Type:     evtType,
+		StateKey: &stateKey,
+		Content:  event.Content{Parsed: content},
+	}
+}
@@ -295,7 +295,7 @@ func (as *AppService) StartWebsocket(baseURL string, onConnect func()) error {
 		parsed.Scheme = "wss"
 	}
 	ws, resp, err := websocket.DefaultDialer.Dial(parsed.String(), http.Header{
-		"Authorization": []string{fmt.Sprintf("Bearer %s", as.Registration.AppToken)},
+		"Authorization": []string{fmt.Sprintf("Bearer %s", as.GetRegistration().AppToken)},
 		"User-Agent":    []string{as.BotClient().UserAgent},
 
 		"X-Mautrix-Process-ID":        []string{as.ProcessID},
@@ -0,0 +1,260 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package bridge contains the common skeleton of mautrix bridges: config loading, appservice and crypto wiring,
+// database-backed portal, puppet and user managers and the main loop. Bridges implement NetworkConnector
+// and NetworkClient for their remote network and call Main.
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqlstatestore"
+)
+
+var ErrCryptoNotSet = errors.New("encryption is enabled in the config, but the bridge was built without encryption support")
+
+// Bridge is a bridge between Matrix and a remote network.
+type Bridge struct {
+	Network NetworkConnector
+	Version string
+
+	Config           *Config
+	ConfigPath       string
+	RegistrationPath string
+	// GenerateRegistration makes Main write a new registration file and exit instead of starting the bridge.
+	GenerateRegistration bool
+
+	AS             *appservice.AppService
+	EventProcessor *appservice.EventProcessor
+	Bot            *appservice.IntentAPI
+	DB             *Database
+	StateStore     *sqlstatestore.SQLStateStore
+	Log            log.Logger
+	// Crypto is the end-to-bridge encryption helper. If it's not set before Init and encryption is allowed
+	// in the config, the default CryptoHelper is used.
+	Crypto Crypto
+	// CryptoPickleKey is used to encrypt the olm account and sessions in the database. It defaults to the network ID.
+	// Changing it makes all previously stored encryption keys unusable.
+	CryptoPickleKey string
+
+	Portals *PortalManager
+	Puppets *PuppetManager
+	Users   *UserManager
+}
+
+// New creates a new bridge for the given network connector.
+func New(network NetworkConnector, version string) *Bridge {
+	return &Bridge{
+		Network:          network,
+		Version:          version,
+		ConfigPath:       "config.yaml",
+		RegistrationPath: "registration.yaml",
+	}
+}
+
+// Main parses the command-line flags, initializes and starts the bridge and then waits for SIGINT or SIGTERM.
+func (br *Bridge) Main() {
+	flag.StringVar(&br.ConfigPath, "c", br.ConfigPath, "Path to the config file")
+	flag.StringVar(&br.RegistrationPath, "r", br.RegistrationPath, "Path to the registration file")
+	flag.BoolVar(&br.GenerateRegistration, "g", false, "Generate a registration file and exit")
+	flag.Parse()
+
+	if br.GenerateRegistration {
+		if err := br.generateRegistration(); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "Failed to generate registration:", err)
+			os.Exit(10)
+		}
+		fmt.Println("Registration generated. See https://docs.mau.fi/bridges/general/registering-appservices.html " +
+			"for instructions on installing the registration.")
+		os.Exit(0)
+	}
+
+	if err := br.Init(); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to initialize bridge:", err)
+		os.Exit(11)
+	}
+	if err := br.Start(); err != nil {
+		br.Log.Fatalln("Failed to start bridge:", err)
+		os.Exit(12)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	br.Log.Infoln("Interrupt received, stopping...")
+	br.Stop()
+	br.Log.Infoln("Bridge stopped.")
+}
+
+func (br *Bridge) generateRegistration() error {
+	config, err := LoadConfig(br.ConfigPath, br.Network.GetConfigPtr())
+	if err != nil {
+		return err
+	}
+	registration := config.GenerateRegistration()
+	if err = registration.Save(br.RegistrationPath); err != nil {
+		return err
+	}
+	return config.Save(br.ConfigPath)
+}
+
+// Init loads the config and prepares the appservice, database, managers, crypto and network connector.
+func (br *Bridge) Init() error {
+	var err error
+	if br.Config == nil {
+		br.Config, err = LoadConfig(br.ConfigPath, br.Network.GetConfigPtr())
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+
+	br.AS = appservice.Create()
+	br.AS.HomeserverURL = br.Config.Homeserver.Address
+	br.AS.HomeserverDomain = br.Config.Homeserver.Domain
+	br.AS.Host.Hostname = br.Config.AppService.Hostname
+	br.AS.Host.Port = br.Config.AppService.Port
+	br.AS.LogConfig = br.Config.Logging
+	br.AS.RegistrationPath = br.RegistrationPath
+	if _, err = br.AS.Init(); err != nil {
+		return fmt.Errorf("failed to initialize appservice: %w", err)
+	}
+	br.Log = br.AS.Log
+	name := br.Network.GetName()
+	br.AS.UserAgent = fmt.Sprintf("%s/%s %s", name.NetworkID, br.Version, br.AS.UserAgent)
+
+	br.Log.Debugln("Initializing database connection")
+	rawDB, err := sql.Open(br.Config.Database.Type, br.Config.Database.URI)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	rawDB.SetMaxOpenConns(br.Config.Database.MaxOpenConns)
+	rawDB.SetMaxIdleConns(br.Config.Database.MaxIdleConns)
+	br.DB = &Database{DB: rawDB, Dialect: br.Config.Database.Type}
+	br.StateStore = sqlstatestore.NewSQLStateStore(rawDB, br.DB.Dialect, br.Log.Sub("StateStore"))
+	br.AS.StateStore = br.StateStore
+	if err = br.StateStore.CreateTables(); err != nil {
+		return fmt.Errorf("failed to upgrade state store: %w", err)
+	} else if err = br.DB.Upgrade(); err != nil {
+		return fmt.Errorf("failed to upgrade bridge database: %w", err)
+	}
+
+	br.EventProcessor = appservice.NewEventProcessor(br.AS)
+	br.Bot = br.AS.BotIntent()
+	br.Portals = newPortalManager(br)
+	br.Puppets = newPuppetManager(br)
+	br.Users = newUserManager(br)
+	br.registerMatrixHandlers()
+
+	if br.Config.Bridge.Encryption.Allow {
+		if br.Crypto == nil {
+			br.Crypto = NewCryptoHelper(br)
+		}
+		if br.Crypto == nil {
+			return ErrCryptoNotSet
+		} else if err = br.Crypto.Init(); err != nil {
+			return fmt.Errorf("failed to initialize crypto: %w", err)
+		}
+		br.AS.Crypto = br.Crypto
+	}
+
+	if err = br.Network.Init(br); err != nil {
+		return fmt.Errorf("failed to initialize network connector: %w", err)
+	}
+	return nil
+}
+
+// Start starts the appservice listener, updates the bot profile and connects all logged in users.
+func (br *Bridge) Start() error {
+	br.Log.Debugln("Starting appservice HTTP server")
+	go br.AS.Start()
+	br.Log.Debugln("Starting event processor")
+	go br.EventProcessor.Start()
+
+	br.Log.Debugln("Updating bridge bot profile")
+	if err := br.Bot.EnsureRegistered(); err != nil {
+		return fmt.Errorf("failed to register bridge bot: %w", err)
+	}
+	if err := br.Bot.SetDisplayName(br.Config.AppService.Bot.Displayname); err != nil {
+		br.Log.Warnln("Failed to update bot displayname:", err)
+	}
+	if avatar, err := br.Config.AppService.Bot.Avatar.Parse(); err == nil {
+		if err = br.Bot.SetAvatarURL(avatar); err != nil {
+			br.Log.Warnln("Failed to update bot avatar:", err)
+		}
+	}
+
+	br.Log.Debugln("Starting network connector")
+	if err := br.Network.Start(); err != nil {
+		return fmt.Errorf("failed to start network connector: %w", err)
+	}
+	if br.Crypto != nil && br.AS.Crypto != nil {
+		br.Crypto.Start()
+	}
+	for _, user := range br.Users.GetAllLoggedIn() {
+		go func(user *User) {
+			if err := user.Connect(); err != nil {
+				user.log.Errorln("Failed to connect:", err)
+			}
+		}(user)
+	}
+	br.Log.Infoln("Bridge started")
+	return nil
+}
+
+// Stop disconnects all users and stops the network connector, crypto helper and appservice.
+// The event processor is stopped by the appservice after the queued events have been handled.
+func (br *Bridge) Stop() {
+	if br.Crypto != nil && br.AS.Crypto != nil {
+		br.Crypto.Stop()
+	}
+	for _, user := range br.Users.GetAllLoggedIn() {
+		user.Disconnect()
+	}
+	br.Network.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := br.AS.Stop(ctx); err != nil {
+		br.Log.Warnln("Failed to stop appservice HTTP server:", err)
+	}
+	if err := br.DB.Close(); err != nil {
+		br.Log.Warnln("Failed to close database:", err)
+	}
+}
+
+// BotMXID returns the user ID of the bridge bot.
+func (br *Bridge) BotMXID() id.UserID {
+	return id.NewUserID(br.Config.AppService.Bot.Username, br.Config.Homeserver.Domain)
+}
+
+// IsGhost returns true if the given user ID is a ghost of a remote user.
+func (br *Bridge) IsGhost(userID id.UserID) bool {
+	_, ok := br.ParseGhostMXID(userID)
+	return ok
+}
+
+// ParseGhostMXID returns the remote user ID of the given ghost user ID, or false if the user ID isn't a ghost.
+func (br *Bridge) ParseGhostMXID(userID id.UserID) (RemoteUserID, bool) {
+	localpart, homeserver, err := userID.Parse()
+	if err != nil || homeserver != br.Config.Homeserver.Domain {
+		return "", false
+	}
+	remoteID, ok := br.Config.Bridge.ParseUsername(localpart)
+	return RemoteUserID(remoteID), ok
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const testConfig = `
+homeserver:
+  address: https://matrix.example.com
+  domain: example.com
+appservice:
+  address: http://localhost:29999
+  hostname: 127.0.0.1
+  port: 29999
+  id: example
+  bot:
+    username: examplebot
+    displayname: Example bridge bot
+database:
+  type: sqlite3
+  uri: ":memory:"
+bridge:
+  username_template: example_{{.}}
+  command_prefix: "!ex"
+  permissions:
+    "*": block
+    example.com: user
+    "@admin:example.com": admin
+    "@custom:other.com": 50
+network:
+  api_key: meow
+`
+
+type networkConfig struct {
+	APIKey string `yaml:"api_key"`
+}
+
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func loadTestConfig(t *testing.T) (*bridge.Config, *networkConfig) {
+	var netConfig networkConfig
+	config, err := bridge.LoadConfig(writeConfig(t, testConfig), &netConfig)
+	require.NoError(t, err)
+	return config, &netConfig
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, netConfig := loadTestConfig(t)
+	assert.Equal(t, "example.com", config.Homeserver.Domain)
+	assert.Equal(t, "examplebot", config.AppService.Bot.Username)
+	assert.Equal(t, "meow", netConfig.APIKey)
+
+	_, err := bridge.LoadConfig(writeConfig(t, "homeserver:\n  domain: example.com\n"), nil)
+	assert.ErrorIs(t, err, bridge.ErrMissingHomeserver)
+	_, err = bridge.LoadConfig(writeConfig(t, `
+homeserver: {address: "https://example.com", domain: example.com}
+database: {type: sqlite3, uri: ":memory:"}
+bridge: {username_template: example}
+`), nil)
+	assert.ErrorIs(t, err, bridge.ErrInvalidUsernameFormat)
+}
+
+func TestConfig_Usernames(t *testing.T) {
+	config, _ := loadTestConfig(t)
+	localpart := config.Bridge.FormatUsername("Alice")
+	assert.Equal(t, "example__alice", localpart)
+	remoteID, ok := config.Bridge.ParseUsername(localpart)
+	assert.True(t, ok)
+	assert.Equal(t, "Alice", remoteID)
+	_, ok = config.Bridge.ParseUsername("examplebot")
+	assert.False(t, ok)
+	_, ok = config.Bridge.ParseUsername("example_")
+	assert.False(t, ok)
+
+	br := &bridge.Bridge{Config: config}
+	assert.Equal(t, id.UserID("@examplebot:example.com"), br.BotMXID())
+	parsed, ok := br.ParseGhostMXID("@example__alice:example.com")
+	assert.True(t, ok)
+	assert.Equal(t, bridge.RemoteUserID("Alice"), parsed)
+	assert.False(t, br.IsGhost("@example__alice:other.com"))
+	assert.False(t, br.IsGhost("@examplebot:example.com"))
+}
+
+func TestConfig_GenerateRegistration(t *testing.T) {
+	config, _ := loadTestConfig(t)
+	registration := config.GenerateRegistration()
+	assert.Equal(t, "examplebot", registration.SenderLocalpart)
+	assert.Equal(t, registration.AppToken, config.AppService.ASToken)
+	assert.Equal(t, registration.ServerToken, config.AppService.HSToken)
+
+	matches, exclusive := registration.Namespaces.MatchesUserID("@example__alice:example.com")
+	assert.True(t, matches)
+	assert.True(t, exclusive)
+	matches, _ = registration.Namespaces.MatchesUserID("@examplebot:example.com")
+	assert.True(t, matches)
+	matches, _ = registration.Namespaces.MatchesUserID("@someone:example.com")
+	assert.False(t, matches)
+}
+
+func TestPermissionConfig_Get(t *testing.T) {
+	config, _ := loadTestConfig(t)
+	perms := config.Bridge.Permissions
+	assert.Equal(t, bridge.PermissionLevelAdmin, perms.Get("@admin:example.com"))
+	assert.Equal(t, bridge.PermissionLevelUser, perms.Get("@user:example.com"))
+	assert.Equal(t, bridge.PermissionLevel(50), perms.Get("@custom:other.com"))
+	assert.Equal(t, bridge.PermissionLevelBlock, perms.Get("@someone:other.com"))
+}
+
+func TestDatabase_Upgrade(t *testing.T) {
+	rawDB, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	rawDB.SetMaxOpenConns(1)
+	defer rawDB.Close()
+	db := &bridge.Database{DB: rawDB, Dialect: "sqlite3"}
+	require.NoError(t, db.Upgrade())
+	// Upgrading again should be a no-op.
+	require.NoError(t, db.Upgrade())
+
+	var version int
+	require.NoError(t, db.QueryRow("SELECT version FROM bridge_version").Scan(&version))
+	assert.Equal(t, len(bridge.DatabaseUpgrades), version)
+	for _, table := range []string{"bridge_user", "bridge_portal", "bridge_puppet", "bridge_message"} {
+		_, err = db.Exec("SELECT * FROM " + table)
+		assert.NoError(t, err, table)
+	}
+
+	assert.ErrorIs(t, (&bridge.Database{DB: rawDB, Dialect: "mysql"}).Upgrade(), bridge.ErrUnknownDialect)
+}
+
+type fakeConnector struct {
+	config  networkConfig
+	started bool
+	stopped bool
+}
+
+func (fc *fakeConnector) GetName() bridge.BridgeName {
+	return bridge.BridgeName{DisplayName: "Example", NetworkID: "example"}
+}
+
+func (fc *fakeConnector) GetConfigPtr() interface{} {
+	return &fc.config
+}
+
+func (fc *fakeConnector) Init(br *bridge.Bridge) error {
+	return nil
+}
+
+func (fc *fakeConnector) Start() error {
+	fc.started = true
+	return nil
+}
+
+func (fc *fakeConnector) Stop() {
+	fc.stopped = true
+}
+
+func (fc *fakeConnector) NewClient(user *bridge.User) (bridge.NetworkClient, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func freePort(t *testing.T) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestBridge_StartStop(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer homeserver.Close()
+
+	config, _ := loadTestConfig(t)
+	config.Homeserver.Address = homeserver.URL
+	config.AppService.Port = freePort(t)
+	config.Database.URI = filepath.Join(t.TempDir(), "bridge.db")
+	config.Logging.PrintLevel = 100
+	connector := &fakeConnector{}
+	br := bridge.New(connector, "test")
+	br.Config = config
+	br.RegistrationPath = filepath.Join(t.TempDir(), "registration.yaml")
+	require.NoError(t, config.GenerateRegistration().Save(br.RegistrationPath))
+
+	require.NoError(t, br.Init())
+	handled := make(chan id.EventID, 1)
+	br.EventProcessor.On(event.EventReaction, func(evt *event.Event) {
+		handled <- evt.ID
+	})
+	require.NoError(t, br.Start())
+	assert.True(t, connector.started)
+
+	br.AS.Events <- &event.Event{Type: event.EventReaction, ID: "$reaction", RoomID: "!room:example.com"}
+	select {
+	case eventID := <-handled:
+		assert.Equal(t, id.EventID("$reaction"), eventID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't dispatched after starting the bridge")
+	}
+
+	liveURL := fmt.Sprintf("http://127.0.0.1:%d/_matrix/mau/live", config.AppService.Port)
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(liveURL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		br.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(4 * time.Second):
+		t.Fatal("stopping the bridge took too long")
+	}
+	assert.True(t, connector.stopped)
+	_, err := http.Get(liveURL)
+	assert.Error(t, err, "the appservice HTTP server should be stopped")
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// CommandEvent is a command sent to the bridge bot, either in the user's management room or with the command prefix.
+type CommandEvent struct {
+	Bridge *Bridge
+	User   *User
+	// Portal is the portal where the command was sent, or nil if it wasn't sent in a portal.
+	Portal  *Portal
+	RoomID  id.RoomID
+	EventID id.EventID
+
+	Command string
+	Args    []string
+}
+
+// Reply sends a notice to the room where the command was sent. The message is rendered as markdown.
+func (ce *CommandEvent) Reply(msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	content := format.RenderMarkdown(msg, true, false)
+	content.MsgType = event.MsgNotice
+	_, err := ce.Bridge.Bot.SendMessageEvent(ce.RoomID, event.EventMessage, &content)
+	if err != nil {
+		ce.Bridge.Log.Warnfln("Failed to reply to command %s from %s: %v", ce.Command, ce.User.MXID, err)
+	}
+}
+
+func (br *Bridge) parseCommand(user *User, evt *event.Event, portal *Portal) *CommandEvent {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.MsgType != event.MsgText {
+		return nil
+	}
+	body := strings.TrimSpace(content.Body)
+	hasPrefix := strings.HasPrefix(body, br.Config.Bridge.CommandPrefix+" ")
+	if hasPrefix {
+		body = strings.TrimSpace(body[len(br.Config.Bridge.CommandPrefix):])
+	} else if evt.RoomID != user.ManagementRoom {
+		return nil
+	}
+	args := strings.Fields(body)
+	if len(args) == 0 {
+		return nil
+	}
+	return &CommandEvent{
+		Bridge:  br,
+		User:    user,
+		Portal:  portal,
+		RoomID:  evt.RoomID,
+		EventID: evt.ID,
+		Command: strings.ToLower(args[0]),
+		Args:    args[1:],
+	}
+}
+
+func (br *Bridge) handleCommand(ce *CommandEvent) {
+	br.Log.Debugfln("%s sent command %s in %s", ce.User.MXID, ce.Command, ce.RoomID)
+	switch ce.Command {
+	case "help":
+		ce.Reply("Built-in commands:\n\n" +
+			"* `help` - Show this help message.\n" +
+			"* `ping` - Check whether you're logged in.\n" +
+			"* `logout` - Log out from the remote network.\n" +
+			"* `set-management-room` - Mark this room as your management room.")
+	case "ping":
+		if ce.User.IsLoggedIn() {
+			ce.Reply("You're logged in as `%s`.", ce.User.RemoteID)
+		} else {
+			ce.Reply("You're not logged in.")
+		}
+	case "logout":
+		if !ce.User.IsLoggedIn() {
+			ce.Reply("You're not logged in.")
+		} else if err := ce.User.Logout(); err != nil {
+			ce.Reply("Failed to log out: %v", err)
+		} else {
+			ce.Reply("Logged out successfully.")
+		}
+	case "set-management-room":
+		if ce.Portal != nil {
+			ce.Reply("Portal rooms can't be used as management rooms.")
+		} else if err := ce.User.SetManagementRoom(ce.RoomID); err != nil {
+			ce.Reply("Failed to set management room: %v", err)
+		} else {
+			ce.Reply("This room is now your management room.")
+		}
+	default:
+		if handler, ok := br.Network.(CommandHandlingNetwork); !ok || !handler.HandleCommand(ce) {
+			ce.Reply("Unknown command, use the `help` command for help.")
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrMissingHomeserver     = errors.New("homeserver address and domain must be set in the config")
+	ErrInvalidUsernameFormat = errors.New("bridge.username_template must contain {{.}} exactly once")
+	ErrMissingDatabase       = errors.New("database type and uri must be set in the config")
+)
+
+// HomeserverConfig contains the address and server name of the homeserver the bridge is connected to.
+type HomeserverConfig struct {
+	Address string `yaml:"address"`
+	Domain  string `yaml:"domain"`
+}
+
+// BotConfig contains the profile of the bridge bot.
+type BotConfig struct {
+	Username    string              `yaml:"username"`
+	Displayname string              `yaml:"displayname"`
+	Avatar      id.ContentURIString `yaml:"avatar"`
+}
+
+// AppServiceConfig contains the appservice registration info and the listener settings.
+type AppServiceConfig struct {
+	Address  string `yaml:"address"`
+	Hostname string `yaml:"hostname"`
+	Port     uint16 `yaml:"port"`
+
+	ID              string    `yaml:"id"`
+	Bot             BotConfig `yaml:"bot"`
+	EphemeralEvents bool      `yaml:"ephemeral_events"`
+
+	ASToken string `yaml:"as_token"`
+	HSToken string `yaml:"hs_token"`
+}
+
+// DatabaseConfig contains the database connection info. The type is the database/sql driver name,
+// which must be either sqlite3 or postgres. The driver itself must be imported by the bridge.
+type DatabaseConfig struct {
+	Type         string `yaml:"type"`
+	URI          string `yaml:"uri"`
+	MaxOpenConns int    `yaml:"max_open_conns"`
+	MaxIdleConns int    `yaml:"max_idle_conns"`
+}
+
+// EncryptionConfig contains the end-to-bridge encryption settings.
+type EncryptionConfig struct {
+	// Allow enables encryption support. The bridge must be built with encryption support if this is true.
+	Allow bool `yaml:"allow"`
+	// Default makes new portal rooms encrypted by default.
+	Default bool `yaml:"default"`
+	// Appservice makes the default crypto helper receive to-device events, device list changes and one-time key
+	// counts through appservice transactions (MSC2409 and MSC3202) instead of syncing as the bridge bot's device.
+	Appservice bool `yaml:"appservice"`
+}
+
+// BridgeConfig contains the network-agnostic bridge settings.
+type BridgeConfig struct {
+	// UsernameTemplate is the template for ghost user localparts. It must contain {{.}}, which is replaced
+	// with the remote user ID, e.g. "example_{{.}}".
+	UsernameTemplate string `yaml:"username_template"`
+	CommandPrefix    string `yaml:"command_prefix"`
+
+	Permissions PermissionConfig `yaml:"permissions"`
+	Encryption  EncryptionConfig `yaml:"encryption"`
+
+	usernamePrefix string
+	usernameSuffix string
+}
+
+// Config is the base config of a bridge. Network-specific settings are read from the network section
+// into the struct returned by NetworkConnector.GetConfigPtr.
+type Config struct {
+	Homeserver HomeserverConfig     `yaml:"homeserver"`
+	AppService AppServiceConfig     `yaml:"appservice"`
+	Database   DatabaseConfig       `yaml:"database"`
+	Bridge     BridgeConfig         `yaml:"bridge"`
+	Logging    appservice.LogConfig `yaml:"logging"`
+
+	Network networkConfig `yaml:"network"`
+}
+
+// networkConfig unmarshals the network section of the config into the connector's config struct.
+type networkConfig struct {
+	ptr interface{}
+}
+
+func (nc *networkConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if nc.ptr == nil {
+		return nil
+	}
+	return unmarshal(nc.ptr)
+}
+
+func (nc networkConfig) MarshalYAML() (interface{}, error) {
+	return nc.ptr, nil
+}
+
+// LoadConfig reads the config file at the given path. If networkConfigPtr is not nil,
+// the network section of the config is unmarshaled into it.
+func LoadConfig(path string, networkConfigPtr interface{}) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{
+		Logging: appservice.CreateLogConfig(),
+		Network: networkConfig{ptr: networkConfigPtr},
+	}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	} else if err = config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Save writes the config to the given path, e.g. after generating the registration tokens.
+func (config *Config) Save(path string) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (config *Config) validate() error {
+	if len(config.Homeserver.Address) == 0 || len(config.Homeserver.Domain) == 0 {
+		return ErrMissingHomeserver
+	} else if len(config.Database.Type) == 0 || len(config.Database.URI) == 0 {
+		return ErrMissingDatabase
+	}
+	parts := strings.Split(config.Bridge.UsernameTemplate, "{{.}}")
+	if len(parts) != 2 {
+		return ErrInvalidUsernameFormat
+	}
+	config.Bridge.usernamePrefix, config.Bridge.usernameSuffix = parts[0], parts[1]
+	return nil
+}
+
+// FormatUsername returns the ghost localpart for the given remote user ID.
+func (bc *BridgeConfig) FormatUsername(remoteID string) string {
+	return bc.usernamePrefix + id.EncodeUserLocalpart(remoteID) + bc.usernameSuffix
+}
+
+// ParseUsername returns the remote user ID from a ghost localpart, or false if the localpart isn't a ghost.
+func (bc *BridgeConfig) ParseUsername(localpart string) (string, bool) {
+	if len(localpart) <= len(bc.usernamePrefix)+len(bc.usernameSuffix) ||
+		!strings.HasPrefix(localpart, bc.usernamePrefix) || !strings.HasSuffix(localpart, bc.usernameSuffix) {
+		return "", false
+	}
+	encoded := localpart[len(bc.usernamePrefix) : len(localpart)-len(bc.usernameSuffix)]
+	decoded, err := id.DecodeUserLocalpart(encoded)
+	if err != nil {
+		return "", false
+	}
+	return decoded, true
+}
+
+// GenerateRegistration creates a new appservice registration based on the config.
+// The generated tokens are stored in the config, so it should be saved afterwards.
+func (config *Config) GenerateRegistration() *appservice.Registration {
+	registration := appservice.CreateRegistration()
+	config.AppService.ASToken = registration.AppToken
+	config.AppService.HSToken = registration.ServerToken
+
+	registration.ID = config.AppService.ID
+	registration.URL = config.AppService.Address
+	registration.SenderLocalpart = config.AppService.Bot.Username
+	registration.EphemeralEvents = config.AppService.EphemeralEvents
+	falseVal := false
+	registration.RateLimited = &falseVal
+
+	domain := regexp.QuoteMeta(config.Homeserver.Domain)
+	registration.Namespaces.UserIDs = []appservice.Namespace{{
+		Regex:     fmt.Sprintf("^@%s:%s$", regexp.QuoteMeta(config.AppService.Bot.Username), domain),
+		Exclusive: true,
+	}, {
+		Regex: fmt.Sprintf("^@%s.+%s:%s$",
+			regexp.QuoteMeta(config.Bridge.usernamePrefix), regexp.QuoteMeta(config.Bridge.usernameSuffix), domain),
+		Exclusive: true,
+	}}
+	return registration
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// PortalID is the identifier of a chat on the remote network.
+type PortalID string
+
+// RemoteUserID is the identifier of a user on the remote network.
+type RemoteUserID string
+
+// RemoteMessageID is the identifier of a message on the remote network.
+type RemoteMessageID string
+
+// BridgeName contains the static information about the remote network.
+type BridgeName struct {
+	// DisplayName is the human-readable name of the network, e.g. "Example Chat".
+	DisplayName string
+	// NetworkID is a short identifier of the network, used in m.bridge events, e.g. "examplechat".
+	NetworkID   string
+	NetworkURL  string
+	NetworkIcon id.ContentURIString
+}
+
+// NetworkConnector is the main interface that bridges implement to connect the framework to a remote network.
+type NetworkConnector interface {
+	// GetName returns the static information about the network.
+	GetName() BridgeName
+	// GetConfigPtr returns a pointer to the network-specific config struct, or nil if there is none.
+	// The network section of the config file is unmarshaled into it.
+	GetConfigPtr() interface{}
+	// Init is called after the config is loaded and the database is upgraded, but before anything is started.
+	Init(br *Bridge) error
+	// Start is called after the appservice has been started.
+	Start() error
+	// Stop is called when the bridge is shutting down.
+	Stop()
+
+	// NewClient creates a client for a user who is logged into the remote network.
+	// It's called for every logged-in user when the bridge starts and when a user logs in.
+	NewClient(user *User) (NetworkClient, error)
+}
+
+// NetworkClient is a connection to the remote network on behalf of a single logged-in user.
+type NetworkClient interface {
+	Connect() error
+	Disconnect()
+
+	// GetPortalInfo returns the current info of the given remote chat.
+	GetPortalInfo(ctx context.Context, portal *Portal) (*PortalInfo, error)
+	// GetPuppetInfo returns the current info of the given remote user.
+	GetPuppetInfo(ctx context.Context, puppet *Puppet) (*PuppetInfo, error)
+	// HandleMatrixMessage sends a Matrix message to the remote network and returns the ID of the remote message.
+	HandleMatrixMessage(ctx context.Context, msg *MatrixMessage) (RemoteMessageID, error)
+}
+
+// CommandHandlingNetwork can be implemented by network connectors to handle bridge bot commands
+// that aren't built into the framework.
+type CommandHandlingNetwork interface {
+	NetworkConnector
+	// HandleCommand handles a command. It should return false if the command is unknown.
+	HandleCommand(ce *CommandEvent) bool
+}
+
+// Crypto is implemented by end-to-bridge encryption helpers. The default implementation, CryptoHelper, wraps
+// crypto.OlmMachine. It's only available when building with cgo and without the nocrypto tag, as it requires libolm.
+type Crypto interface {
+	appservice.CryptoHelper
+	// Init prepares the crypto store and device of the bridge bot.
+	Init() error
+	Start()
+	Stop()
+	// Decrypt decrypts an m.room.encrypted event.
+	Decrypt(evt *event.Event) (*event.Event, error)
+}
+
+// PortalInfo contains the metadata of a remote chat.
+type PortalInfo struct {
+	Name      string
+	Topic     string
+	AvatarURL id.ContentURI
+	// Members contains the remote users in the chat. Their puppets are joined to the room when it's created.
+	Members []RemoteUserID
+	// IsDirect marks the chat as a direct chat with a single remote user.
+	IsDirect bool
+}
+
+// PuppetInfo contains the profile of a remote user.
+type PuppetInfo struct {
+	Name      string
+	AvatarURL id.ContentURI
+}
+
+// MatrixMessage is a message sent by a Matrix user in a portal room.
+type MatrixMessage struct {
+	Portal  *Portal
+	User    *User
+	Event   *event.Event
+	Content *event.MessageEventContent
+}
+
+// RemoteMessage is a message received from the remote network.
+type RemoteMessage struct {
+	ID        RemoteMessageID
+	PortalID  PortalID
+	Sender    RemoteUserID
+	Timestamp time.Time
+	Content   *event.MessageEventContent
+}
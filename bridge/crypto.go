@@ -0,0 +1,248 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build cgo && !nocrypto
+// +build cgo,!nocrypto
+
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrAppserviceLoginUnsupported = errors.New("homeserver does not support appservice login")
+
+var levelTrace = log.Level{
+	Name:     "Trace",
+	Severity: -10,
+	Color:    -1,
+}
+
+// CryptoHelper is the default Crypto implementation. It logs in as the bridge bot to get a device,
+// stores the crypto state in the bridge database and handles key sharing with crypto.OlmMachine.
+//
+// To-device events, device list changes and one-time key counts are received by syncing as the bot's device,
+// or through appservice transactions (MSC2409 and MSC3202) if EncryptionConfig.Appservice is set.
+type CryptoHelper struct {
+	bridge *Bridge
+	client *mautrix.Client
+	mach   *crypto.OlmMachine
+	store  *crypto.SQLCryptoStore
+	log    log.Logger
+}
+
+var _ Crypto = (*CryptoHelper)(nil)
+
+// NewCryptoHelper creates the default crypto helper for the given bridge. Init must be called
+// after the bridge database and appservice have been initialized.
+func NewCryptoHelper(br *Bridge) Crypto {
+	return &CryptoHelper{bridge: br}
+}
+
+func (helper *CryptoHelper) Init() error {
+	br := helper.bridge
+	helper.log = br.Log.Sub("Crypto")
+	helper.log.Debugln("Initializing end-to-bridge encryption...")
+	pickleKey := br.CryptoPickleKey
+	if len(pickleKey) == 0 {
+		pickleKey = br.Network.GetName().NetworkID
+	}
+	cryptoLog := &cryptoLogger{helper.log}
+	helper.store = crypto.NewSQLCryptoStore(br.DB.DB, br.DB.Dialect, br.BotMXID().String(), "", []byte(pickleKey), cryptoLog)
+	if err := helper.store.CreateTables(); err != nil {
+		return fmt.Errorf("failed to upgrade crypto store: %w", err)
+	}
+
+	var err error
+	helper.client, err = helper.loginBot(helper.store.FindDeviceID())
+	if err != nil {
+		return err
+	}
+	helper.store.DeviceID = helper.client.DeviceID
+	helper.log.Debugln("Logged in as bridge bot with device ID", helper.client.DeviceID)
+	helper.client.Store = &cryptoClientStore{InMemoryStore: mautrix.NewInMemoryStore(), crypto: helper.store}
+	helper.mach = crypto.NewOlmMachine(helper.client, cryptoLog, helper.store, br.AS.StateStore)
+	helper.client.Syncer = &cryptoSyncer{helper.mach}
+	if err = helper.mach.Load(); err != nil {
+		return fmt.Errorf("failed to load olm account: %w", err)
+	}
+	// Uploading keys without any new keys returns the current one-time key count,
+	// which makes sure the device keys and enough one-time keys are uploaded before anything is encrypted.
+	resp, err := helper.client.UploadKeys(&mautrix.ReqUploadKeys{})
+	if err != nil {
+		return fmt.Errorf("failed to get one-time key count: %w", err)
+	} else if err = helper.mach.ShareKeys(resp.OneTimeKeyCounts.SignedCurve25519); err != nil {
+		return fmt.Errorf("failed to share keys: %w", err)
+	}
+	if br.Config.Bridge.Encryption.Appservice {
+		// The listeners must be added before the event processor is started.
+		helper.mach.AddAppserviceListener(br.EventProcessor, br.AS)
+	}
+	return nil
+}
+
+// loginBot logs in as the bridge bot using the appservice login type. The device ID of the existing crypto account
+// is reused, as the stored olm account is only valid for that device.
+func (helper *CryptoHelper) loginBot(deviceID id.DeviceID) (*mautrix.Client, error) {
+	br := helper.bridge
+	client, err := mautrix.NewClient(br.AS.HomeserverURL, br.BotMXID(), br.AS.GetRegistration().AppToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create crypto client: %w", err)
+	}
+	client.UserAgent = br.AS.UserAgent
+	client.Client = br.AS.HTTPClient
+	client.Logger = helper.log.Sub("Client")
+	client.DefaultHTTPRetries = br.AS.DefaultHTTPRetries
+
+	flows, err := client.GetLoginFlows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get supported login flows: %w", err)
+	} else if !flows.HasFlow(mautrix.AuthTypeAppservice) {
+		return nil, ErrAppserviceLoginUnsupported
+	}
+	resp, err := client.Login(&mautrix.ReqLogin{
+		Type:                     mautrix.AuthTypeAppservice,
+		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: string(br.BotMXID())},
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: fmt.Sprintf("%s bridge", br.Network.GetName().DisplayName),
+		StoreCredentials:         true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in as bridge bot: %w", err)
+	} else if len(deviceID) > 0 && resp.DeviceID != deviceID {
+		return nil, fmt.Errorf("homeserver returned device %s instead of the stored device %s", resp.DeviceID, deviceID)
+	}
+	return client, nil
+}
+
+func (helper *CryptoHelper) Start() {
+	if helper.bridge.Config.Bridge.Encryption.Appservice {
+		return
+	}
+	helper.log.Debugln("Starting syncer for receiving to-device events")
+	go func() {
+		if err := helper.client.Sync(); err != nil {
+			helper.log.Errorln("Fatal error syncing:", err)
+		}
+	}()
+}
+
+func (helper *CryptoHelper) Stop() {
+	helper.client.StopSync()
+	if err := helper.mach.FlushStore(); err != nil {
+		helper.log.Warnln("Failed to flush crypto store:", err)
+	}
+}
+
+// Encrypt encrypts the given event. If there's no usable outbound session for the room, a new one
+// is shared with the joined and invited members of the room first.
+func (helper *CryptoHelper) Encrypt(roomID id.RoomID, eventType event.Type, content interface{}) (*event.EncryptedEventContent, error) {
+	encrypted, err := helper.mach.EncryptMegolmEvent(roomID, eventType, content)
+	if err == nil || !crypto.IsShareError(err) {
+		return encrypted, err
+	}
+	helper.log.Debugfln("Got %v while encrypting event for %s, sharing group session and trying again...", err, roomID)
+	var users []id.UserID
+	for userID, member := range helper.bridge.StateStore.GetRoomMembers(roomID) {
+		if member.Membership == event.MembershipJoin || member.Membership == event.MembershipInvite {
+			users = append(users, userID)
+		}
+	}
+	if err = helper.mach.ShareGroupSession(roomID, users); err != nil {
+		return nil, fmt.Errorf("failed to share group session: %w", err)
+	}
+	return helper.mach.EncryptMegolmEvent(roomID, eventType, content)
+}
+
+// Decrypt decrypts the given event. If the session isn't known yet, it waits a few seconds for the keys to arrive.
+func (helper *CryptoHelper) Decrypt(evt *event.Event) (*event.Event, error) {
+	decrypted, err := helper.mach.DecryptMegolmEvent(evt)
+	if !errors.Is(err, crypto.NoSessionFound) {
+		return decrypted, err
+	}
+	content := evt.Content.AsEncrypted()
+	helper.log.Debugfln("Couldn't find session %s for %s, waiting for keys to arrive...", content.SessionID, evt.ID)
+	if !helper.mach.WaitForSession(evt.RoomID, content.SenderKey, content.SessionID, 5*time.Second) {
+		return nil, err
+	}
+	return helper.mach.DecryptMegolmEvent(evt)
+}
+
+// cryptoSyncer passes /sync responses of the bot's device to the olm machine.
+type cryptoSyncer struct {
+	mach *crypto.OlmMachine
+}
+
+func (syncer *cryptoSyncer) ProcessResponse(resp *mautrix.RespSync, since string) error {
+	syncer.mach.ProcessSyncResponse(resp, since)
+	return nil
+}
+
+func (syncer *cryptoSyncer) OnFailedSync(_ *mautrix.RespSync, err error) (time.Duration, error) {
+	syncer.mach.Log.Error("Error /syncing, waiting 10 seconds: %v", err)
+	return 10 * time.Second, nil
+}
+
+// GetFilterJSON filters out everything except to-device events, device lists and one-time key counts,
+// as room events are received through the appservice.
+func (syncer *cryptoSyncer) GetFilterJSON(_ id.UserID) *mautrix.Filter {
+	everything := []event.Type{{Type: "*"}}
+	return &mautrix.Filter{
+		Presence:    mautrix.FilterPart{NotTypes: everything},
+		AccountData: mautrix.FilterPart{NotTypes: everything},
+		Room: mautrix.RoomFilter{
+			Ephemeral:   mautrix.FilterPart{NotTypes: everything},
+			AccountData: mautrix.FilterPart{NotTypes: everything},
+			State:       mautrix.FilterPart{NotTypes: everything},
+			Timeline:    mautrix.FilterPart{NotTypes: everything},
+		},
+	}
+}
+
+// cryptoClientStore stores the sync token of the bot's device in the crypto store, so the syncer doesn't
+// receive the same to-device events again after a restart.
+type cryptoClientStore struct {
+	*mautrix.InMemoryStore
+	crypto *crypto.SQLCryptoStore
+}
+
+func (store *cryptoClientStore) SaveNextBatch(_ id.UserID, nextBatchToken string) {
+	store.crypto.PutNextBatch(nextBatchToken)
+}
+
+func (store *cryptoClientStore) LoadNextBatch(_ id.UserID) string {
+	return store.crypto.GetNextBatch()
+}
+
+// cryptoLogger adapts the bridge logger to the crypto.Logger interface.
+type cryptoLogger struct {
+	int log.Logger
+}
+
+func (c *cryptoLogger) Error(message string, args ...interface{}) {
+	c.int.Errorfln(message, args...)
+}
+
+func (c *cryptoLogger) Warn(message string, args ...interface{}) {
+	c.int.Warnfln(message, args...)
+}
+
+func (c *cryptoLogger) Debug(message string, args ...interface{}) {
+	c.int.Debugfln(message, args...)
+}
+
+func (c *cryptoLogger) Trace(message string, args ...interface{}) {
+	c.int.Logfln(levelTrace, message, args...)
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var ErrUnknownDialect = errors.New("unknown database dialect")
+
+// Database is the database of the bridge. The same database is also used for the appservice state store,
+// whose tables are prefixed with mx_, while the bridge tables are prefixed with bridge_.
+type Database struct {
+	*sql.DB
+	Dialect string
+}
+
+type dbUpgradeFunc func(tx *sql.Tx, dialect string) error
+
+// DatabaseUpgrades contains the migrations of the bridge tables. The index of the function is the schema version
+// that it upgrades from.
+var DatabaseUpgrades = [...]dbUpgradeFunc{
+	func(tx *sql.Tx, dialect string) error {
+		boolType := "BOOLEAN"
+		if dialect == "sqlite3" {
+			boolType = "INTEGER"
+		}
+		for _, query := range []string{
+			`CREATE TABLE IF NOT EXISTS bridge_user (
+				mxid            TEXT PRIMARY KEY,
+				remote_id       TEXT,
+				management_room TEXT
+			)`,
+			`CREATE TABLE IF NOT EXISTS bridge_portal (
+				id         TEXT PRIMARY KEY,
+				mxid       TEXT UNIQUE,
+				name       TEXT NOT NULL DEFAULT '',
+				topic      TEXT NOT NULL DEFAULT '',
+				avatar_url TEXT NOT NULL DEFAULT '',
+				encrypted  ` + boolType + ` NOT NULL DEFAULT false
+			)`,
+			`CREATE TABLE IF NOT EXISTS bridge_puppet (
+				id         TEXT PRIMARY KEY,
+				name       TEXT NOT NULL DEFAULT '',
+				avatar_url TEXT NOT NULL DEFAULT '',
+				name_set   ` + boolType + ` NOT NULL DEFAULT false,
+				avatar_set ` + boolType + ` NOT NULL DEFAULT false
+			)`,
+			`CREATE TABLE IF NOT EXISTS bridge_message (
+				portal_id TEXT,
+				remote_id TEXT,
+				mxid      TEXT NOT NULL UNIQUE,
+				sender    TEXT NOT NULL,
+				timestamp BIGINT NOT NULL,
+				PRIMARY KEY (portal_id, remote_id),
+				FOREIGN KEY (portal_id) REFERENCES bridge_portal(id) ON DELETE CASCADE
+			)`,
+		} {
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func (db *Database) getVersion() (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS bridge_version (version INTEGER)")
+	if err != nil {
+		return -1, err
+	}
+	version := 0
+	err = db.QueryRow("SELECT version FROM bridge_version LIMIT 1").Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return -1, err
+	}
+	return version, nil
+}
+
+func setVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec("DELETE FROM bridge_version")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO bridge_version (version) VALUES ($1)", version)
+	return err
+}
+
+// Upgrade upgrades the bridge tables to the latest version.
+func (db *Database) Upgrade() error {
+	if db.Dialect != "sqlite3" && db.Dialect != "postgres" {
+		return ErrUnknownDialect
+	}
+	version, err := db.getVersion()
+	if err != nil {
+		return err
+	}
+	for ; version < len(DatabaseUpgrades); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = DatabaseUpgrades[version](tx, db.Dialect); err != nil {
+			_ = tx.Rollback()
+			return err
+		} else if err = setVersion(tx, version+1); err != nil {
+			_ = tx.Rollback()
+			return err
+		} else if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type scannable interface {
+	Scan(dest ...interface{}) error
+}
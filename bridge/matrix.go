@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func (br *Bridge) registerMatrixHandlers() {
+	br.EventProcessor.On(event.StateMember, br.handleMatrixMember)
+	br.EventProcessor.On(event.EventMessage, br.handleMatrixMessage)
+	br.EventProcessor.On(event.EventEncrypted, br.handleMatrixEncrypted)
+}
+
+func (br *Bridge) handleMatrixMember(evt *event.Event) {
+	content := evt.Content.AsMember()
+	if id.UserID(evt.GetStateKey()) != br.BotMXID() || content.Membership != event.MembershipInvite {
+		return
+	}
+	user := br.Users.GetByMXID(evt.Sender)
+	if user == nil || user.PermissionLevel < PermissionLevelUser {
+		br.Log.Debugfln("Rejecting invite to %s from %s (not whitelisted)", evt.RoomID, evt.Sender)
+		_, err := br.Bot.LeaveRoom(evt.RoomID, &mautrix.ReqLeave{Reason: "You're not allowed to use this bridge"})
+		if err != nil {
+			br.Log.Warnfln("Failed to reject invite to %s: %v", evt.RoomID, err)
+		}
+		return
+	}
+	if err := br.Bot.EnsureJoined(evt.RoomID); err != nil {
+		br.Log.Warnfln("Failed to accept invite to %s from %s: %v", evt.RoomID, evt.Sender, err)
+		return
+	}
+	if len(user.ManagementRoom) == 0 && br.Portals.GetByMXID(evt.RoomID) == nil {
+		if err := user.SetManagementRoom(evt.RoomID); err != nil {
+			br.Log.Warnfln("Failed to set management room of %s: %v", user.MXID, err)
+			return
+		}
+		_, _ = br.Bot.SendNotice(evt.RoomID, "This room has been registered as your bridge management room. Send `help` to get a list of commands.")
+	}
+}
+
+func (br *Bridge) handleMatrixMessage(evt *event.Event) {
+	if evt.Sender == br.BotMXID() || br.IsGhost(evt.Sender) {
+		return
+	}
+	user := br.Users.GetByMXID(evt.Sender)
+	if user == nil || user.PermissionLevel < PermissionLevelUser {
+		return
+	}
+	portal := br.Portals.GetByMXID(evt.RoomID)
+	if ce := br.parseCommand(user, evt, portal); ce != nil {
+		br.handleCommand(ce)
+	} else if portal != nil {
+		portal.handleMatrixMessage(user, evt)
+	}
+}
+
+func (br *Bridge) handleMatrixEncrypted(evt *event.Event) {
+	if br.AS.Crypto == nil {
+		return
+	}
+	decrypted, err := br.Crypto.Decrypt(evt)
+	if err != nil {
+		br.Log.Warnfln("Failed to decrypt %s in %s: %v", evt.ID, evt.RoomID, err)
+		return
+	}
+	br.EventProcessor.Dispatch(decrypted)
+}
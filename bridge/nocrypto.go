@@ -0,0 +1,16 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !cgo || nocrypto
+// +build !cgo nocrypto
+
+package bridge
+
+// NewCryptoHelper returns nil, as the bridge was built without end-to-bridge encryption support.
+// Build with cgo and without the nocrypto tag to use the default crypto helper.
+func NewCryptoHelper(br *Bridge) Crypto {
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PermissionLevel is the level of access a Matrix user has to the bridge.
+type PermissionLevel int
+
+const (
+	PermissionLevelBlock PermissionLevel = 0
+	PermissionLevelUser  PermissionLevel = 10
+	PermissionLevelAdmin PermissionLevel = 100
+)
+
+var namedPermissionLevels = map[string]PermissionLevel{
+	"block": PermissionLevelBlock,
+	"user":  PermissionLevelUser,
+	"admin": PermissionLevelAdmin,
+}
+
+func (pl *PermissionLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	if level, ok := namedPermissionLevels[str]; ok {
+		*pl = level
+		return nil
+	}
+	level, err := strconv.Atoi(str)
+	if err != nil {
+		return fmt.Errorf("invalid permission level %q", str)
+	}
+	*pl = PermissionLevel(level)
+	return nil
+}
+
+func (pl PermissionLevel) MarshalYAML() (interface{}, error) {
+	for name, level := range namedPermissionLevels {
+		if level == pl {
+			return name, nil
+		}
+	}
+	return int(pl), nil
+}
+
+// PermissionConfig maps user IDs, server names or * to permission levels.
+type PermissionConfig map[string]PermissionLevel
+
+// Get returns the permission level of the given user. Exact user ID matches take priority
+// over server name matches, which take priority over the * wildcard.
+func (pc PermissionConfig) Get(userID id.UserID) PermissionLevel {
+	if level, ok := pc[string(userID)]; ok {
+		return level
+	}
+	if _, homeserver, err := userID.Parse(); err == nil {
+		if level, ok := pc[homeserver]; ok {
+			return level
+		}
+	}
+	return pc["*"]
+}
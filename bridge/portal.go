@@ -0,0 +1,366 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Portal is a Matrix room that is bridged to a chat on the remote network.
+type Portal struct {
+	ID        PortalID
+	MXID      id.RoomID
+	Name      string
+	Topic     string
+	AvatarURL id.ContentURI
+	Encrypted bool
+
+	bridge *Bridge
+	log    log.Logger
+
+	// roomCreateLock is held while creating the Matrix room, handleLock while bridging a message,
+	// so that messages are bridged in the order they're received.
+	roomCreateLock sync.Mutex
+	handleLock     sync.Mutex
+}
+
+// Update saves the portal to the database.
+func (portal *Portal) Update() error {
+	_, err := portal.bridge.DB.Exec(`
+		INSERT INTO bridge_portal (id, mxid, name, topic, avatar_url, encrypted) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE
+			SET mxid=excluded.mxid, name=excluded.name, topic=excluded.topic, avatar_url=excluded.avatar_url, encrypted=excluded.encrypted
+	`, portal.ID, nullString(string(portal.MXID)), portal.Name, portal.Topic, portal.AvatarURL.String(), portal.Encrypted)
+	return err
+}
+
+func (portal *Portal) getBridgeInfo() (string, *event.BridgeEventContent) {
+	name := portal.bridge.Network.GetName()
+	stateKey := fmt.Sprintf("%s://%s/%s", name.NetworkID, portal.bridge.Config.AppService.ID, portal.ID)
+	return stateKey, &event.BridgeEventContent{
+		BridgeBot: portal.bridge.BotMXID(),
+		Protocol: event.BridgeInfoSection{
+			ID:          name.NetworkID,
+			DisplayName: name.DisplayName,
+			AvatarURL:   name.NetworkIcon,
+			ExternalURL: name.NetworkURL,
+		},
+		Channel: event.BridgeInfoSection{
+			ID:          string(portal.ID),
+			DisplayName: portal.Name,
+			AvatarURL:   portal.AvatarURL.CUString(),
+		},
+	}
+}
+
+// CreateMatrixRoom creates the Matrix room for the portal if it doesn't exist yet, invites the given user
+// and joins the puppets of the remote members.
+func (portal *Portal) CreateMatrixRoom(ctx context.Context, source *User, info *PortalInfo) error {
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if len(portal.MXID) > 0 {
+		return nil
+	}
+	portal.Name = info.Name
+	portal.Topic = info.Topic
+	portal.AvatarURL = info.AvatarURL
+	portal.Encrypted = portal.bridge.Config.Bridge.Encryption.Default
+
+	bridgeInfoStateKey, bridgeInfo := portal.getBridgeInfo()
+	emptyStateKey := ""
+	initialState := []*event.Event{{
+		Type:     event.StateBridge,
+		StateKey: &bridgeInfoStateKey,
+		Content:  event.Content{Parsed: bridgeInfo},
+	}, {
+		Type:     event.StateHalfShotBridge,
+		StateKey: &bridgeInfoStateKey,
+		Content:  event.Content{Parsed: bridgeInfo},
+	}}
+	if !portal.AvatarURL.IsEmpty() {
+		initialState = append(initialState, &event.Event{
+			Type:     event.StateRoomAvatar,
+			StateKey: &emptyStateKey,
+			Content:  event.Content{Parsed: &event.RoomAvatarEventContent{URL: portal.AvatarURL}},
+		})
+	}
+	if portal.Encrypted {
+		initialState = append(initialState, &event.Event{
+			Type:     event.StateEncryption,
+			StateKey: &emptyStateKey,
+			Content:  event.Content{Parsed: &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}},
+		})
+	}
+
+	resp, err := portal.bridge.Bot.CreateRoom(&mautrix.ReqCreateRoom{
+		Visibility:   "private",
+		Name:         portal.Name,
+		Topic:        portal.Topic,
+		Invite:       []id.UserID{source.MXID},
+		Preset:       "private_chat",
+		IsDirect:     info.IsDirect,
+		InitialState: initialState,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create room: %w", err)
+	}
+	portal.MXID = resp.RoomID
+	portal.bridge.Portals.lock.Lock()
+	portal.bridge.Portals.byMXID[portal.MXID] = portal
+	portal.bridge.Portals.lock.Unlock()
+	if err = portal.Update(); err != nil {
+		return fmt.Errorf("failed to save portal: %w", err)
+	}
+	portal.log.Infoln("Created Matrix room", portal.MXID)
+
+	for _, member := range info.Members {
+		puppet := portal.bridge.Puppets.GetByID(member)
+		if puppet == nil {
+			continue
+		}
+		if err = puppet.SyncInfo(ctx, source); err != nil {
+			portal.log.Warnfln("Failed to sync info of %s: %v", member, err)
+		}
+		if err = puppet.Intent().EnsureJoined(portal.MXID); err != nil {
+			portal.log.Warnfln("Failed to join %s to the room: %v", puppet.MXID, err)
+		}
+	}
+	return nil
+}
+
+func (portal *Portal) isDuplicate(remoteID RemoteMessageID) bool {
+	var exists bool
+	err := portal.bridge.DB.
+		QueryRow("SELECT EXISTS(SELECT 1 FROM bridge_message WHERE portal_id=$1 AND remote_id=$2)", portal.ID, remoteID).
+		Scan(&exists)
+	if err != nil {
+		portal.log.Warnfln("Failed to check if %s is a duplicate: %v", remoteID, err)
+	}
+	return exists
+}
+
+func (portal *Portal) saveMessage(remoteID RemoteMessageID, mxid id.EventID, sender id.UserID, ts time.Time) {
+	_, err := portal.bridge.DB.Exec(
+		"INSERT INTO bridge_message (portal_id, remote_id, mxid, sender, timestamp) VALUES ($1, $2, $3, $4, $5)",
+		portal.ID, remoteID, mxid, sender, ts.UnixMilli(),
+	)
+	if err != nil {
+		portal.log.Warnfln("Failed to save message mapping %s -> %s: %v", remoteID, mxid, err)
+	}
+}
+
+// GetMessageMXID returns the Matrix event ID of a bridged remote message, or an empty string if it isn't bridged.
+func (portal *Portal) GetMessageMXID(remoteID RemoteMessageID) id.EventID {
+	var mxid id.EventID
+	err := portal.bridge.DB.
+		QueryRow("SELECT mxid FROM bridge_message WHERE portal_id=$1 AND remote_id=$2", portal.ID, remoteID).
+		Scan(&mxid)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		portal.log.Warnfln("Failed to get Matrix event ID of %s: %v", remoteID, err)
+	}
+	return mxid
+}
+
+// HandleRemoteMessage bridges a message from the remote network to Matrix, creating the room if necessary.
+// Messages that have already been bridged (e.g. echoes of messages sent from Matrix) are ignored.
+func (portal *Portal) HandleRemoteMessage(ctx context.Context, source *User, msg *RemoteMessage) error {
+	portal.handleLock.Lock()
+	defer portal.handleLock.Unlock()
+	if portal.isDuplicate(msg.ID) {
+		portal.log.Debugfln("Ignoring duplicate message %s", msg.ID)
+		return nil
+	}
+	if len(portal.MXID) == 0 {
+		if source.Client == nil {
+			return errors.New("source user isn't connected")
+		}
+		info, err := source.Client.GetPortalInfo(ctx, portal)
+		if err != nil {
+			return fmt.Errorf("failed to get portal info: %w", err)
+		} else if err = portal.CreateMatrixRoom(ctx, source, info); err != nil {
+			return err
+		}
+	}
+	puppet := portal.bridge.Puppets.GetByID(msg.Sender)
+	if puppet == nil {
+		return fmt.Errorf("failed to get puppet for %s", msg.Sender)
+	}
+	intent := puppet.Intent()
+	if err := intent.EnsureJoined(portal.MXID); err != nil {
+		return fmt.Errorf("failed to ensure %s is joined: %w", puppet.MXID, err)
+	}
+	ts := msg.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	resp, err := intent.SendMassagedMessageEvent(portal.MXID, event.EventMessage, msg.Content, ts.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	portal.saveMessage(msg.ID, resp.EventID, puppet.MXID, ts)
+	return nil
+}
+
+func (portal *Portal) handleMatrixMessage(user *User, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return
+	}
+	portal.handleLock.Lock()
+	defer portal.handleLock.Unlock()
+	if user.Client == nil {
+		portal.sendErrorNotice(evt, errors.New("you're not logged in"))
+		return
+	}
+	remoteID, err := user.Client.HandleMatrixMessage(context.Background(), &MatrixMessage{
+		Portal:  portal,
+		User:    user,
+		Event:   evt,
+		Content: content,
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to bridge %s from %s: %v", evt.ID, evt.Sender, err)
+		portal.sendErrorNotice(evt, err)
+		return
+	}
+	if len(remoteID) > 0 {
+		portal.saveMessage(remoteID, evt.ID, evt.Sender, time.UnixMilli(evt.Timestamp))
+	}
+}
+
+func (portal *Portal) sendErrorNotice(evt *event.Event, err error) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("\u26a0 Your message was not bridged: %v", err),
+	}
+	content.SetReply(evt)
+	_, sendErr := portal.bridge.Bot.SendMessageEvent(portal.MXID, event.EventMessage, content)
+	if sendErr != nil {
+		portal.log.Warnfln("Failed to send error notice about %s: %v", evt.ID, sendErr)
+	}
+}
+
+// PortalManager caches the portals of the bridge.
+type PortalManager struct {
+	bridge *Bridge
+	lock   sync.Mutex
+	byID   map[PortalID]*Portal
+	byMXID map[id.RoomID]*Portal
+}
+
+func newPortalManager(br *Bridge) *PortalManager {
+	return &PortalManager{
+		bridge: br,
+		byID:   make(map[PortalID]*Portal),
+		byMXID: make(map[id.RoomID]*Portal),
+	}
+}
+
+const getPortalBaseQuery = "SELECT id, mxid, name, topic, avatar_url, encrypted FROM bridge_portal"
+
+func (pm *PortalManager) scanPortal(row scannable) (*Portal, error) {
+	var portalID PortalID
+	var mxid sql.NullString
+	var name, topic, avatarURL string
+	var encrypted bool
+	if err := row.Scan(&portalID, &mxid, &name, &topic, &avatarURL, &encrypted); err != nil {
+		return nil, err
+	} else if portal, ok := pm.byID[portalID]; ok {
+		return portal, nil
+	}
+	portal := pm.newPortal(portalID)
+	portal.MXID = id.RoomID(mxid.String)
+	portal.Name = name
+	portal.Topic = topic
+	portal.AvatarURL, _ = id.ParseContentURI(avatarURL)
+	portal.Encrypted = encrypted
+	if len(portal.MXID) > 0 {
+		pm.byMXID[portal.MXID] = portal
+	}
+	return portal, nil
+}
+
+func (pm *PortalManager) newPortal(portalID PortalID) *Portal {
+	portal := &Portal{
+		ID:     portalID,
+		bridge: pm.bridge,
+		log:    pm.bridge.Log.Sub("Portal").Sub(string(portalID)),
+	}
+	pm.byID[portalID] = portal
+	return portal
+}
+
+// GetByID returns the portal of the given remote chat, creating it if it doesn't exist.
+// The Matrix room is only created when the first message is bridged or CreateMatrixRoom is called.
+func (pm *PortalManager) GetByID(portalID PortalID) *Portal {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if portal, ok := pm.byID[portalID]; ok {
+		return portal
+	}
+	portal, err := pm.scanPortal(pm.bridge.DB.QueryRow(getPortalBaseQuery+" WHERE id=$1", portalID))
+	if errors.Is(err, sql.ErrNoRows) {
+		portal = pm.newPortal(portalID)
+		if err = portal.Update(); err != nil {
+			pm.bridge.Log.Warnfln("Failed to insert portal %s: %v", portalID, err)
+		}
+	} else if err != nil {
+		pm.bridge.Log.Errorfln("Failed to load portal %s: %v", portalID, err)
+		return nil
+	}
+	return portal
+}
+
+// GetByMXID returns the portal with the given Matrix room ID, or nil if the room isn't a portal.
+func (pm *PortalManager) GetByMXID(roomID id.RoomID) *Portal {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if portal, ok := pm.byMXID[roomID]; ok {
+		return portal
+	}
+	portal, err := pm.scanPortal(pm.bridge.DB.QueryRow(getPortalBaseQuery+" WHERE mxid=$1", roomID))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			pm.bridge.Log.Errorfln("Failed to load portal by room ID %s: %v", roomID, err)
+		}
+		return nil
+	}
+	return portal
+}
+
+// GetAllWithRoom returns all portals that have a Matrix room.
+func (pm *PortalManager) GetAllWithRoom() []*Portal {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	rows, err := pm.bridge.DB.Query(getPortalBaseQuery + " WHERE mxid IS NOT NULL")
+	if err != nil {
+		pm.bridge.Log.Errorfln("Failed to query portals: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var portals []*Portal
+	for rows.Next() {
+		portal, err := pm.scanPortal(rows)
+		if err != nil {
+			pm.bridge.Log.Errorfln("Failed to scan portal: %v", err)
+		} else {
+			portals = append(portals, portal)
+		}
+	}
+	return portals
+}
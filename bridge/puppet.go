@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+// Puppet is a Matrix ghost user that represents a user on the remote network.
+type Puppet struct {
+	ID        RemoteUserID
+	MXID      id.UserID
+	Name      string
+	AvatarURL id.ContentURI
+	NameSet   bool
+	AvatarSet bool
+
+	bridge   *Bridge
+	log      log.Logger
+	infoLock sync.Mutex
+}
+
+// Intent returns the intent of the ghost user.
+func (puppet *Puppet) Intent() *appservice.IntentAPI {
+	return puppet.bridge.AS.Intent(puppet.MXID)
+}
+
+// Update saves the puppet to the database.
+func (puppet *Puppet) Update() error {
+	_, err := puppet.bridge.DB.Exec(`
+		INSERT INTO bridge_puppet (id, name, avatar_url, name_set, avatar_set) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE
+			SET name=excluded.name, avatar_url=excluded.avatar_url, name_set=excluded.name_set, avatar_set=excluded.avatar_set
+	`, puppet.ID, puppet.Name, puppet.AvatarURL.String(), puppet.NameSet, puppet.AvatarSet)
+	return err
+}
+
+// UpdateInfo updates the profile of the ghost user if the given info differs from the stored info.
+func (puppet *Puppet) UpdateInfo(info *PuppetInfo) {
+	puppet.infoLock.Lock()
+	defer puppet.infoLock.Unlock()
+	changed := false
+	if info.Name != puppet.Name || !puppet.NameSet {
+		puppet.Name = info.Name
+		puppet.NameSet = puppet.Intent().SetDisplayName(info.Name) == nil
+		changed = true
+	}
+	if info.AvatarURL != puppet.AvatarURL || !puppet.AvatarSet {
+		puppet.AvatarURL = info.AvatarURL
+		puppet.AvatarSet = puppet.Intent().SetAvatarURL(info.AvatarURL) == nil
+		changed = true
+	}
+	if changed {
+		if err := puppet.Update(); err != nil {
+			puppet.log.Warnln("Failed to save puppet after updating info:", err)
+		}
+	}
+}
+
+// SyncInfo fetches the profile of the remote user through the given user's network client and updates the ghost.
+func (puppet *Puppet) SyncInfo(ctx context.Context, source *User) error {
+	if source.Client == nil {
+		return errors.New("source user isn't connected")
+	}
+	info, err := source.Client.GetPuppetInfo(ctx, puppet)
+	if err != nil {
+		return err
+	}
+	puppet.UpdateInfo(info)
+	return nil
+}
+
+// PuppetManager caches the puppets of the bridge.
+type PuppetManager struct {
+	bridge *Bridge
+	lock   sync.Mutex
+	byID   map[RemoteUserID]*Puppet
+}
+
+func newPuppetManager(br *Bridge) *PuppetManager {
+	return &PuppetManager{
+		bridge: br,
+		byID:   make(map[RemoteUserID]*Puppet),
+	}
+}
+
+func (pm *PuppetManager) newPuppet(remoteID RemoteUserID) *Puppet {
+	mxid := id.NewUserID(pm.bridge.Config.Bridge.FormatUsername(string(remoteID)), pm.bridge.Config.Homeserver.Domain)
+	return &Puppet{
+		ID:     remoteID,
+		MXID:   mxid,
+		bridge: pm.bridge,
+		log:    pm.bridge.Log.Sub("Puppet").Sub(string(remoteID)),
+	}
+}
+
+// GetByID returns the puppet of the given remote user, creating it if it doesn't exist.
+func (pm *PuppetManager) GetByID(remoteID RemoteUserID) *Puppet {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if puppet, ok := pm.byID[remoteID]; ok {
+		return puppet
+	}
+	puppet := pm.newPuppet(remoteID)
+	var avatarURL string
+	err := pm.bridge.DB.
+		QueryRow("SELECT name, avatar_url, name_set, avatar_set FROM bridge_puppet WHERE id=$1", remoteID).
+		Scan(&puppet.Name, &avatarURL, &puppet.NameSet, &puppet.AvatarSet)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err = puppet.Update(); err != nil {
+			pm.bridge.Log.Warnfln("Failed to insert puppet %s: %v", remoteID, err)
+		}
+	} else if err != nil {
+		pm.bridge.Log.Errorfln("Failed to load puppet %s: %v", remoteID, err)
+		return nil
+	} else {
+		puppet.AvatarURL, _ = id.ParseContentURI(avatarURL)
+	}
+	pm.byID[remoteID] = puppet
+	return puppet
+}
+
+// GetByMXID returns the puppet for the given ghost user ID, or nil if the user ID isn't a ghost.
+func (pm *PuppetManager) GetByMXID(userID id.UserID) *Puppet {
+	remoteID, ok := pm.bridge.ParseGhostMXID(userID)
+	if !ok {
+		return nil
+	}
+	return pm.GetByID(remoteID)
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bridge
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// User is a Matrix user of the bridge, who may be logged into the remote network.
+type User struct {
+	MXID           id.UserID
+	RemoteID       RemoteUserID
+	ManagementRoom id.RoomID
+
+	PermissionLevel PermissionLevel
+
+	bridge *Bridge
+	log    log.Logger
+
+	Client     NetworkClient
+	clientLock sync.Mutex
+}
+
+func nullString(str string) sql.NullString {
+	return sql.NullString{String: str, Valid: len(str) > 0}
+}
+
+// Update saves the user to the database.
+func (user *User) Update() error {
+	_, err := user.bridge.DB.Exec(`
+		INSERT INTO bridge_user (mxid, remote_id, management_room) VALUES ($1, $2, $3)
+		ON CONFLICT (mxid) DO UPDATE SET remote_id=excluded.remote_id, management_room=excluded.management_room
+	`, user.MXID, nullString(string(user.RemoteID)), nullString(string(user.ManagementRoom)))
+	return err
+}
+
+// IsLoggedIn returns true if the user has a remote login.
+func (user *User) IsLoggedIn() bool {
+	return len(user.RemoteID) > 0
+}
+
+// SetManagementRoom sets the room where the user can send commands to the bridge bot without a prefix.
+func (user *User) SetManagementRoom(roomID id.RoomID) error {
+	user.ManagementRoom = roomID
+	return user.Update()
+}
+
+// Login stores the remote ID of the user and connects to the remote network on their behalf.
+// Network connectors should call this after completing their own login flow.
+func (user *User) Login(remoteID RemoteUserID) error {
+	user.bridge.Users.lock.Lock()
+	if existing, ok := user.bridge.Users.byRemoteID[remoteID]; ok && existing != user {
+		user.bridge.Users.lock.Unlock()
+		return fmt.Errorf("%s is already logged in as %s", existing.MXID, remoteID)
+	}
+	user.RemoteID = remoteID
+	user.bridge.Users.byRemoteID[remoteID] = user
+	user.bridge.Users.lock.Unlock()
+	if err := user.Update(); err != nil {
+		return fmt.Errorf("failed to save login: %w", err)
+	}
+	return user.Connect()
+}
+
+// Connect creates a network client for the user if necessary and connects it.
+func (user *User) Connect() error {
+	if !user.IsLoggedIn() {
+		return errors.New("user is not logged in")
+	}
+	user.clientLock.Lock()
+	defer user.clientLock.Unlock()
+	if user.Client == nil {
+		client, err := user.bridge.Network.NewClient(user)
+		if err != nil {
+			return fmt.Errorf("failed to create network client: %w", err)
+		}
+		user.Client = client
+	}
+	return user.Client.Connect()
+}
+
+// Disconnect disconnects the user's network client, but keeps the login.
+func (user *User) Disconnect() {
+	user.clientLock.Lock()
+	defer user.clientLock.Unlock()
+	if user.Client != nil {
+		user.Client.Disconnect()
+	}
+}
+
+// Logout disconnects the user's network client and removes the remote login.
+func (user *User) Logout() error {
+	user.Disconnect()
+	user.clientLock.Lock()
+	user.Client = nil
+	user.clientLock.Unlock()
+	user.bridge.Users.lock.Lock()
+	delete(user.bridge.Users.byRemoteID, user.RemoteID)
+	user.bridge.Users.lock.Unlock()
+	user.RemoteID = ""
+	return user.Update()
+}
+
+// UserManager caches the users of the bridge.
+type UserManager struct {
+	bridge     *Bridge
+	lock       sync.Mutex
+	byMXID     map[id.UserID]*User
+	byRemoteID map[RemoteUserID]*User
+}
+
+func newUserManager(br *Bridge) *UserManager {
+	return &UserManager{
+		bridge:     br,
+		byMXID:     make(map[id.UserID]*User),
+		byRemoteID: make(map[RemoteUserID]*User),
+	}
+}
+
+const getUserBaseQuery = "SELECT mxid, remote_id, management_room FROM bridge_user"
+
+func (um *UserManager) scanUser(row scannable) (*User, error) {
+	var mxid id.UserID
+	var remoteID, managementRoom sql.NullString
+	if err := row.Scan(&mxid, &remoteID, &managementRoom); err != nil {
+		return nil, err
+	} else if user, ok := um.byMXID[mxid]; ok {
+		return user, nil
+	}
+	return um.newUser(mxid, RemoteUserID(remoteID.String), id.RoomID(managementRoom.String)), nil
+}
+
+func (um *UserManager) newUser(mxid id.UserID, remoteID RemoteUserID, managementRoom id.RoomID) *User {
+	user := &User{
+		MXID:           mxid,
+		RemoteID:       remoteID,
+		ManagementRoom: managementRoom,
+
+		PermissionLevel: um.bridge.Config.Bridge.Permissions.Get(mxid),
+
+		bridge: um.bridge,
+		log:    um.bridge.Log.Sub("User").Sub(string(mxid)),
+	}
+	um.byMXID[mxid] = user
+	if len(remoteID) > 0 {
+		um.byRemoteID[remoteID] = user
+	}
+	return user
+}
+
+// GetByMXID returns the user with the given Matrix user ID. If the user isn't in the database,
+// a new user is created. Ghosts and the bridge bot never have a User.
+func (um *UserManager) GetByMXID(userID id.UserID) *User {
+	if um.bridge.IsGhost(userID) || userID == um.bridge.BotMXID() {
+		return nil
+	}
+	um.lock.Lock()
+	defer um.lock.Unlock()
+	if user, ok := um.byMXID[userID]; ok {
+		return user
+	}
+	user, err := um.scanUser(um.bridge.DB.QueryRow(getUserBaseQuery+" WHERE mxid=$1", userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		user = um.newUser(userID, "", "")
+		if err = user.Update(); err != nil {
+			um.bridge.Log.Warnfln("Failed to insert user %s: %v", userID, err)
+		}
+	} else if err != nil {
+		um.bridge.Log.Errorfln("Failed to load user %s: %v", userID, err)
+		return nil
+	}
+	return user
+}
+
+// GetByRemoteID returns the user who is logged in as the given remote user, or nil if there's no such user.
+func (um *UserManager) GetByRemoteID(remoteID RemoteUserID) *User {
+	um.lock.Lock()
+	defer um.lock.Unlock()
+	if user, ok := um.byRemoteID[remoteID]; ok {
+		return user
+	}
+	user, err := um.scanUser(um.bridge.DB.QueryRow(getUserBaseQuery+" WHERE remote_id=$1", remoteID))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			um.bridge.Log.Errorfln("Failed to load user by remote ID %s: %v", remoteID, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// GetAllLoggedIn returns all users who have a remote login.
+func (um *UserManager) GetAllLoggedIn() []*User {
+	um.lock.Lock()
+	defer um.lock.Unlock()
+	rows, err := um.bridge.DB.Query(getUserBaseQuery + " WHERE remote_id IS NOT NULL")
+	if err != nil {
+		um.bridge.Log.Errorfln("Failed to query logged in users: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var users []*User
+	for rows.Next() {
+		user, err := um.scanUser(rows)
+		if err != nil {
+			um.bridge.Log.Errorfln("Failed to scan logged in user: %v", err)
+		} else {
+			users = append(users, user)
+		}
+	}
+	return users
+}
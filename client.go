@@ -16,12 +16,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
+	"maunium.net/go/mautrix/util"
 )
 
 type Logger interface {
@@ -59,20 +61,28 @@ type Client struct {
 	Logger        Logger
 	SyncPresence  event.Presence
 
+	// ProfileCache is an optional cache for global user profiles. If set, GetProfile will check the cache first,
+	// and profiles from /profile responses will be stored in it.
+	ProfileCache *ProfileCache
+
 	StreamSyncMinAge time.Duration
 
 	// Number of times that mautrix will retry any HTTP request
 	// if the request fails entirely or returns a HTTP gateway error (502-504)
 	DefaultHTTPRetries int
 
-	txnID int32
-
 	// The ?user_id= query parameter for application services. This must be set *prior* to calling a method. If this is empty,
 	// no user_id parameter will be sent.
 	// See http://matrix.org/docs/spec/application_service/unstable.html#identity-assertion
 	AppServiceUserID id.UserID
+	// The device ID to masquerade as when using appservice identity assertion (MSC3202).
+	// If this is empty, no device ID parameter will be sent.
+	AppServiceDeviceID id.DeviceID
 
 	syncingID uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+
+	pinnedEventsLocks     map[id.RoomID]*roomLock
+	pinnedEventsLocksLock sync.Mutex
 }
 
 type ClientWellKnown struct {
@@ -187,6 +197,9 @@ func (cli *Client) BuildBaseURLWithQuery(urlPath URLPath, urlQuery map[string]st
 	query := hsURL.Query()
 	if cli.AppServiceUserID != "" {
 		query.Set("user_id", string(cli.AppServiceUserID))
+		if cli.AppServiceDeviceID != "" {
+			query.Set("org.matrix.msc3202.device_id", string(cli.AppServiceDeviceID))
+		}
 	}
 	if urlQuery != nil {
 		for k, v := range urlQuery {
@@ -281,6 +294,11 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
 		cli.Store.SaveNextBatch(cli.UserID, resSync.NextBatch)
+		for roomID, roomData := range resSync.Rooms.Join {
+			for _, evt := range roomData.AccountData.Events {
+				cli.Store.SaveRoomAccountData(roomID, evt)
+			}
+		}
 		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
 			return err
 		}
@@ -790,6 +808,23 @@ func (cli *Client) JoinRoomByID(roomID id.RoomID) (resp *RespJoinRoom, err error
 	return
 }
 
+// GetProfile returns the global profile of the user with the specified MXID. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuserid
+//
+// If the client has a ProfileCache, the cached profile is returned if available, and fetched profiles are stored in the cache.
+func (cli *Client) GetProfile(mxid id.UserID) (resp *RespUserProfile, err error) {
+	if cli.ProfileCache != nil {
+		if cached, ok := cli.ProfileCache.Get(mxid); ok {
+			return cached, nil
+		}
+	}
+	urlPath := cli.BuildURL("profile", mxid)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	if err == nil && cli.ProfileCache != nil {
+		cli.ProfileCache.Set(mxid, resp)
+	}
+	return
+}
+
 // GetDisplayName returns the display name of the user with the specified MXID. See https://matrix.org/docs/spec/client_server/r0.6.1.html#get-matrix-client-r0-profile-userid-displayname
 func (cli *Client) GetDisplayName(mxid id.UserID) (resp *RespUserDisplayName, err error) {
 	urlPath := cli.BuildURL("profile", mxid, "displayname")
@@ -809,6 +844,9 @@ func (cli *Client) SetDisplayName(displayName string) (err error) {
 		DisplayName string `json:"displayname"`
 	}{displayName}
 	_, err = cli.MakeRequest("PUT", urlPath, &s, nil)
+	if err == nil && cli.ProfileCache != nil {
+		cli.ProfileCache.Invalidate(cli.UserID)
+	}
 	return
 }
 
@@ -842,6 +880,9 @@ func (cli *Client) SetAvatarURL(url id.ContentURI) (err error) {
 	if err != nil {
 		return err
 	}
+	if cli.ProfileCache != nil {
+		cli.ProfileCache.Invalidate(cli.UserID)
+	}
 
 	return nil
 }
@@ -1110,6 +1151,147 @@ func (cli *Client) StateEvent(roomID id.RoomID, eventType event.Type, stateKey s
 	return
 }
 
+// roomLock is a per-room lock that is removed from the client once nobody is holding or waiting for it.
+type roomLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (cli *Client) lockPinnedEvents(roomID id.RoomID) {
+	cli.pinnedEventsLocksLock.Lock()
+	if cli.pinnedEventsLocks == nil {
+		cli.pinnedEventsLocks = make(map[id.RoomID]*roomLock)
+	}
+	lock, ok := cli.pinnedEventsLocks[roomID]
+	if !ok {
+		lock = &roomLock{}
+		cli.pinnedEventsLocks[roomID] = lock
+	}
+	lock.refs++
+	cli.pinnedEventsLocksLock.Unlock()
+	lock.Lock()
+}
+
+func (cli *Client) unlockPinnedEvents(roomID id.RoomID) {
+	cli.pinnedEventsLocksLock.Lock()
+	defer cli.pinnedEventsLocksLock.Unlock()
+	lock := cli.pinnedEventsLocks[roomID]
+	lock.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(cli.pinnedEventsLocks, roomID)
+	}
+}
+
+// modifyPinnedEvents does a read-modify-write of the pinned events in the given room.
+// The change is only sent if the modifier function returns true. Modifications of the same room
+// through this client are serialized, but changes made by other clients can still be overwritten.
+func (cli *Client) modifyPinnedEvents(roomID id.RoomID, modify func(content *event.PinnedEventsEventContent) bool) error {
+	cli.lockPinnedEvents(roomID)
+	defer cli.unlockPinnedEvents(roomID)
+	var content event.PinnedEventsEventContent
+	err := cli.StateEvent(roomID, event.StatePinnedEvents, "", &content)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return fmt.Errorf("failed to get pinned events: %w", err)
+	}
+	if !modify(&content) {
+		return nil
+	}
+	if content.Pinned == nil {
+		content.Pinned = []id.EventID{}
+	}
+	_, err = cli.SendStateEvent(roomID, event.StatePinnedEvents, "", &content)
+	return err
+}
+
+// PinEvent adds the given event to the pinned events of the room, unless it's already pinned.
+func (cli *Client) PinEvent(roomID id.RoomID, eventID id.EventID) error {
+	return cli.modifyPinnedEvents(roomID, func(content *event.PinnedEventsEventContent) bool {
+		return content.Pin(eventID)
+	})
+}
+
+// UnpinEvent removes the given event from the pinned events of the room.
+func (cli *Client) UnpinEvent(roomID id.RoomID, eventID id.EventID) error {
+	return cli.modifyPinnedEvents(roomID, func(content *event.PinnedEventsEventContent) bool {
+		return content.Unpin(eventID)
+	})
+}
+
+// AddSpaceChild adds a room to a space, or updates the existing m.space.child event of the room.
+//
+// If the room is already in the space, the via servers of the existing event are kept in addition to the given ones.
+func (cli *Client) AddSpaceChild(spaceID, childID id.RoomID, content *event.SpaceChildEventContent) error {
+	if err := event.ValidateSpaceOrder(content.Order); err != nil {
+		return err
+	}
+	var existing event.SpaceChildEventContent
+	err := cli.StateEvent(spaceID, event.StateSpaceChild, childID.String(), &existing)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return fmt.Errorf("failed to get existing space child event: %w", err)
+	}
+	merged := *content
+	merged.Via = append([]string{}, content.Via...)
+	merged.AddVia(existing.Via...)
+	if !merged.IsValid() {
+		return fmt.Errorf("space child event must have at least one via server")
+	}
+	_, err = cli.SendStateEvent(spaceID, event.StateSpaceChild, childID.String(), &merged)
+	return err
+}
+
+// RemoveSpaceChild removes a room from a space by replacing its m.space.child event with empty content.
+func (cli *Client) RemoveSpaceChild(spaceID, childID id.RoomID) error {
+	_, err := cli.SendStateEvent(spaceID, event.StateSpaceChild, childID.String(), struct{}{})
+	return err
+}
+
+// SetWidget adds or updates a widget in the room. The widget ID in the content is used as the state key.
+//
+// Widgets are sent using the unstable im.vector.modular.widgets event type, as that's what clients currently read.
+func (cli *Client) SetWidget(roomID id.RoomID, content *event.WidgetEventContent) (*RespSendEvent, error) {
+	if len(content.ID) == 0 {
+		return nil, fmt.Errorf("widget ID must be set")
+	}
+	return cli.SendStateEvent(roomID, event.StateUnstableWidget, content.ID, content)
+}
+
+// RemoveWidget removes a widget from the room by replacing its state event with empty content.
+func (cli *Client) RemoveWidget(roomID id.RoomID, widgetID string) (*RespSendEvent, error) {
+	return cli.SendStateEvent(roomID, event.StateUnstableWidget, widgetID, struct{}{})
+}
+
+// GetRoomPredecessors follows the predecessor links in m.room.create events and returns the IDs of the rooms that
+// the given room replaced, starting from the direct predecessor. At most maxDepth rooms are returned.
+//
+// The chain ends early without an error if the client can't read the create event of a predecessor room,
+// e.g. because the user was never in the old room.
+func (cli *Client) GetRoomPredecessors(roomID id.RoomID, maxDepth int) ([]id.RoomID, error) {
+	var predecessors []id.RoomID
+	seen := map[id.RoomID]struct{}{roomID: {}}
+	for len(predecessors) < maxDepth {
+		var content event.CreateEventContent
+		err := cli.StateEvent(roomID, event.StateCreate, "", &content)
+		if errors.Is(err, MNotFound) || errors.Is(err, MForbidden) {
+			if len(predecessors) > 0 {
+				break
+			}
+			return nil, err
+		} else if err != nil {
+			return predecessors, fmt.Errorf("failed to get create event of %s: %w", roomID, err)
+		} else if !content.HasPredecessor() {
+			break
+		}
+		roomID = content.Predecessor.RoomID
+		if _, alreadySeen := seen[roomID]; alreadySeen {
+			break
+		}
+		seen[roomID] = struct{}{}
+		predecessors = append(predecessors, roomID)
+	}
+	return predecessors, nil
+}
+
 // parseRoomStateArray parses a JSON array as a stream and stores the events inside it in a room state map.
 func parseRoomStateArray(_ *http.Request, res *http.Response, responseJSON interface{}) ([]byte, error) {
 	response := make(RoomStateMap)
@@ -1193,6 +1375,32 @@ func (cli *Client) DownloadBytes(mxcURL id.ContentURI) ([]byte, error) {
 	return ioutil.ReadAll(resp)
 }
 
+// GetAuthenticatedDownloadURL returns the authenticated media download URL for the given content URI.
+// Unlike the URL returned by GetDownloadURL, requests to this URL must include the access token.
+func (cli *Client) GetAuthenticatedDownloadURL(mxcURL id.ContentURI) string {
+	return cli.BuildBaseURL("_matrix", "client", "v1", "media", "download", mxcURL.Homeserver, mxcURL.FileID)
+}
+
+// GetAuthenticatedThumbnailURL returns the authenticated media thumbnail URL for the given content URI.
+func (cli *Client) GetAuthenticatedThumbnailURL(mxcURL id.ContentURI, width, height int, method id.ThumbnailMethod) string {
+	query := map[string]string{
+		"width":  strconv.Itoa(width),
+		"height": strconv.Itoa(height),
+	}
+	if len(method) > 0 {
+		query["method"] = string(method)
+	}
+	return cli.BuildBaseURLWithQuery(URLPath{"_matrix", "client", "v1", "media", "thumbnail", mxcURL.Homeserver, mxcURL.FileID}, query)
+}
+
+// DownloadAuthenticatedBytes downloads the given content URI using the authenticated media endpoints.
+func (cli *Client) DownloadAuthenticatedBytes(mxcURL id.ContentURI) ([]byte, error) {
+	return cli.MakeFullRequest(FullRequest{
+		Method: http.MethodGet,
+		URL:    cli.GetAuthenticatedDownloadURL(mxcURL),
+	})
+}
+
 // UnstableCreateMXC creates a blank Matrix content URI to allow uploading the content asynchronously later.
 // See https://github.com/matrix-org/matrix-spec-proposals/pull/2246
 func (cli *Client) UnstableCreateMXC() (*RespCreateMXC, error) {
@@ -1398,6 +1606,69 @@ func (cli *Client) GetEvent(roomID id.RoomID, eventID id.EventID) (resp *event.E
 	return
 }
 
+// GetReplyTarget returns the event that the given message event is replying to, or nil if it's not a reply.
+//
+// The cache function is checked first if it's provided. If it doesn't have the event, the event is fetched using
+// the /context endpoint and its content is parsed. Encrypted events are not decrypted.
+func (cli *Client) GetReplyTarget(evt *event.Event, cache func(id.EventID) *event.Event) (*event.Event, error) {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return nil, nil
+	}
+	replyTo := content.GetReplyTo()
+	if len(replyTo) == 0 {
+		return nil, nil
+	} else if cache != nil {
+		if cached := cache(replyTo); cached != nil {
+			return cached, nil
+		}
+	}
+	resp, err := cli.Context(evt.RoomID, replyTo, nil, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch reply target: %w", err)
+	} else if resp.Event == nil {
+		return nil, fmt.Errorf("reply target %s not found in context response", replyTo)
+	}
+	target := resp.Event
+	if target.RoomID == "" {
+		target.RoomID = evt.RoomID
+	}
+	err = target.Content.ParseRaw(target.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) && !errors.Is(err, event.ErrUnsupportedContentType) {
+		return nil, fmt.Errorf("failed to parse reply target: %w", err)
+	}
+	return target, nil
+}
+
+// GetRelations returns the events that relate to the given event, e.g. reactions, edits or thread messages.
+// See https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidrelationseventidreltypeeventtype
+func (cli *Client) GetRelations(roomID id.RoomID, eventID id.EventID, req *ReqGetRelations) (resp *RespGetRelations, err error) {
+	urlPath := URLPath{"_matrix", "client", "v1", "rooms", roomID, "relations", eventID}
+	query := map[string]string{}
+	if req != nil {
+		if len(req.RelationType) > 0 {
+			urlPath = append(urlPath, req.RelationType)
+			if len(req.EventType.Type) > 0 {
+				urlPath = append(urlPath, req.EventType.Type)
+			}
+		}
+		if req.Dir != 0 {
+			query["dir"] = string(req.Dir)
+		}
+		if len(req.From) > 0 {
+			query["from"] = req.From
+		}
+		if len(req.To) > 0 {
+			query["to"] = req.To
+		}
+		if req.Limit > 0 {
+			query["limit"] = strconv.Itoa(req.Limit)
+		}
+	}
+	_, err = cli.MakeRequest("GET", cli.BuildBaseURLWithQuery(urlPath, query), nil, &resp)
+	return
+}
+
 func (cli *Client) MarkRead(roomID id.RoomID, eventID id.EventID) (err error) {
 	return cli.MarkReadWithContent(roomID, eventID, struct{}{})
 }
@@ -1410,6 +1681,18 @@ func (cli *Client) MarkReadWithContent(roomID id.RoomID, eventID id.EventID, con
 	return
 }
 
+// SendReceipt sends a receipt of the given type, usually specifically a read receipt.
+//
+// The content can be used to specify the thread the receipt applies to, see ReqSendReceipt.
+func (cli *Client) SendReceipt(roomID id.RoomID, eventID id.EventID, receiptType event.ReceiptType, content interface{}) (err error) {
+	if content == nil {
+		content = struct{}{}
+	}
+	urlPath := cli.BuildURL("rooms", roomID, "receipt", receiptType, eventID)
+	_, err = cli.MakeRequest("POST", urlPath, &content, nil)
+	return
+}
+
 func (cli *Client) SetReadMarkers(roomID id.RoomID, content interface{}) (err error) {
 	urlPath := cli.BuildURL("rooms", roomID, "read_markers")
 	_, err = cli.MakeRequest("POST", urlPath, &content, nil)
@@ -1531,6 +1814,18 @@ func (cli *Client) SetDeviceInfo(deviceID id.DeviceID, req *ReqDeviceInfo) error
 	return err
 }
 
+// CreateDeviceMSC4190 creates a device for the current user without logging in.
+// This only works for appservice users on homeservers that support MSC4190.
+// Devices created this way can be deleted with DeleteDevice without user-interactive auth.
+//
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/4190
+func (cli *Client) CreateDeviceMSC4190(deviceID id.DeviceID, initialName string) error {
+	if len(deviceID) == 0 {
+		return fmt.Errorf("device ID is required")
+	}
+	return cli.SetDeviceInfo(deviceID, &ReqDeviceInfo{DisplayName: initialName})
+}
+
 func (cli *Client) DeleteDevice(deviceID id.DeviceID, req *ReqDeleteDevice) error {
 	urlPath := cli.BuildURL("devices", deviceID)
 	_, err := cli.MakeRequest("DELETE", urlPath, req, nil)
@@ -1618,6 +1913,123 @@ func (cli *Client) PutPushRule(scope string, kind pushrules.PushRuleType, ruleID
 	return err
 }
 
+// MovePushRule moves an existing push rule before or after another rule of the same kind.
+// Only one of before and after should be set. Default server rules can't be moved.
+func (cli *Client) MovePushRule(scope string, kind pushrules.PushRuleType, ruleID, before, after string) error {
+	rule, err := cli.GetPushRule(scope, kind, ruleID)
+	if err != nil {
+		return err
+	}
+	req := NewReqPutPushRule(rule)
+	req.Before = before
+	req.After = after
+	return cli.PutPushRule(scope, kind, ruleID, req)
+}
+
+// IsPushRuleEnabled checks whether the given push rule is enabled.
+func (cli *Client) IsPushRuleEnabled(scope string, kind pushrules.PushRuleType, ruleID string) (bool, error) {
+	var resp RespPushRuleEnabled
+	urlPath := cli.BuildURL("pushrules", scope, kind, ruleID, "enabled")
+	_, err := cli.MakeRequest("GET", urlPath, nil, &resp)
+	return resp.Enabled, err
+}
+
+// SetPushRuleEnabled enables or disables the given push rule.
+func (cli *Client) SetPushRuleEnabled(scope string, kind pushrules.PushRuleType, ruleID string, enabled bool) error {
+	urlPath := cli.BuildURL("pushrules", scope, kind, ruleID, "enabled")
+	_, err := cli.MakeRequest("PUT", urlPath, &ReqPutPushRuleEnabled{Enabled: enabled}, nil)
+	return err
+}
+
+// GetPushRuleActions gets the actions of the given push rule.
+func (cli *Client) GetPushRuleActions(scope string, kind pushrules.PushRuleType, ruleID string) (pushrules.PushActionArray, error) {
+	var resp RespPushRuleActions
+	urlPath := cli.BuildURL("pushrules", scope, kind, ruleID, "actions")
+	_, err := cli.MakeRequest("GET", urlPath, nil, &resp)
+	return resp.Actions, err
+}
+
+// SetPushRuleActions changes the actions of the given push rule. This also works for default server rules.
+func (cli *Client) SetPushRuleActions(scope string, kind pushrules.PushRuleType, ruleID string, actions pushrules.PushActionArray) error {
+	urlPath := cli.BuildURL("pushrules", scope, kind, ruleID, "actions")
+	_, err := cli.MakeRequest("PUT", urlPath, &ReqPutPushRuleActions{Actions: actions}, nil)
+	return err
+}
+
+func (cli *Client) deletePushRuleIfExists(kind pushrules.PushRuleType, ruleID string) error {
+	err := cli.DeletePushRule("global", kind, ruleID)
+	if errors.Is(err, MNotFound) {
+		return nil
+	}
+	return err
+}
+
+// SetRoomNotificationMode changes the notification mode of a room by replacing the room-specific push rules.
+func (cli *Client) SetRoomNotificationMode(roomID id.RoomID, mode pushrules.RoomNotificationMode) error {
+	switch mode {
+	case pushrules.RoomModeDefault, pushrules.RoomModeMute, pushrules.RoomModeMentionsOnly, pushrules.RoomModeAllMessages:
+	default:
+		return fmt.Errorf("unknown room notification mode %q", mode)
+	}
+	if mode != pushrules.RoomModeMute {
+		err := cli.deletePushRuleIfExists(pushrules.OverrideRule, roomID.String())
+		if err != nil {
+			return fmt.Errorf("failed to delete mute rule: %w", err)
+		}
+	}
+	if mode == pushrules.RoomModeDefault || mode == pushrules.RoomModeMute {
+		err := cli.deletePushRuleIfExists(pushrules.RoomRule, roomID.String())
+		if err != nil {
+			return fmt.Errorf("failed to delete room rule: %w", err)
+		}
+	}
+	var rule *pushrules.PushRule
+	if mode == pushrules.RoomModeMute {
+		rule = pushrules.NewRoomMuteRule(roomID)
+	} else {
+		rule = pushrules.NewRoomRule(roomID, mode)
+	}
+	if rule == nil {
+		return nil
+	}
+	return cli.PutPushRule("global", rule.Type, rule.RuleID, NewReqPutPushRule(rule))
+}
+
+// MuteRoom disables all notifications in the given room.
+func (cli *Client) MuteRoom(roomID id.RoomID) error {
+	return cli.SetRoomNotificationMode(roomID, pushrules.RoomModeMute)
+}
+
+// GetRoomNotificationMode fetches the user's push rules and returns the notification mode of the given room.
+func (cli *Client) GetRoomNotificationMode(roomID id.RoomID) (pushrules.RoomNotificationMode, error) {
+	rules, err := cli.GetPushRules()
+	if err != nil {
+		return "", err
+	}
+	return rules.GetRoomNotificationMode(roomID), nil
+}
+
+// GetKeywords fetches the user's push rules and returns the user-defined keyword content rules.
+func (cli *Client) GetKeywords() ([]pushrules.Keyword, error) {
+	rules, err := cli.GetPushRules()
+	if err != nil {
+		return nil, err
+	}
+	return rules.GetKeywords(), nil
+}
+
+// SetKeyword adds or replaces a keyword content rule. The keyword is matched literally,
+// i.e. glob special characters in it are escaped.
+func (cli *Client) SetKeyword(keyword string, highlight bool, sound string) error {
+	rule := pushrules.NewKeywordRule(keyword, highlight, sound)
+	return cli.PutPushRule("global", rule.Type, rule.RuleID, NewReqPutPushRule(rule))
+}
+
+// RemoveKeyword removes a keyword content rule created with SetKeyword.
+func (cli *Client) RemoveKeyword(keyword string) error {
+	return cli.DeletePushRule("global", pushrules.ContentRule, pushrules.KeywordRuleID(keyword))
+}
+
 // BatchSend sends a batch of historical events into a room. This is only available for appservices.
 //
 // See https://github.com/matrix-org/matrix-doc/pull/2716 for more info.
@@ -1633,10 +2045,9 @@ func (cli *Client) BatchSend(roomID id.RoomID, req *ReqBatchSend) (resp *RespBat
 	return
 }
 
-// TxnID returns the next transaction ID.
+// TxnID returns a new random transaction ID.
 func (cli *Client) TxnID() string {
-	txnID := atomic.AddInt32(&cli.txnID, 1)
-	return fmt.Sprintf("mautrix-go_%d_%d", time.Now().UnixNano(), txnID)
+	return util.RandomTransactionID()
 }
 
 // NewClient creates a new Matrix Client ready for syncing
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// pinnedEventsServer is a fake homeserver that only stores the m.room.pinned_events state of rooms.
+type pinnedEventsServer struct {
+	lock   sync.Mutex
+	pinned map[string]*event.PinnedEventsEventContent
+	puts   int
+}
+
+func (srv *pinnedEventsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0/rooms/")
+	roomID := path[:strings.IndexByte(path, '/')]
+	switch r.Method {
+	case http.MethodGet:
+		srv.lock.Lock()
+		content, ok := srv.pinned[roomID]
+		var data []byte
+		if ok {
+			data, _ = json.Marshal(content)
+		}
+		srv.lock.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found"}`))
+			return
+		}
+		// Make concurrent read-modify-writes overlap if they aren't serialized.
+		time.Sleep(5 * time.Millisecond)
+		_, _ = w.Write(data)
+	case http.MethodPut:
+		var content event.PinnedEventsEventContent
+		_ = json.NewDecoder(r.Body).Decode(&content)
+		srv.lock.Lock()
+		srv.pinned[roomID] = &content
+		srv.puts++
+		srv.lock.Unlock()
+		_, _ = w.Write([]byte(`{"event_id": "$state"}`))
+	}
+}
+
+func newPinnedEventsClient(t *testing.T) (*mautrix.Client, *pinnedEventsServer) {
+	srv := &pinnedEventsServer{pinned: make(map[string]*event.PinnedEventsEventContent)}
+	httpServer := httptest.NewServer(srv)
+	t.Cleanup(httpServer.Close)
+	cli, err := mautrix.NewClient(httpServer.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	return cli, srv
+}
+
+func TestClient_PinEvent(t *testing.T) {
+	cli, srv := newPinnedEventsClient(t)
+	roomID := id.RoomID("!room:example.com")
+
+	require.NoError(t, cli.PinEvent(roomID, "$a"))
+	require.NoError(t, cli.PinEvent(roomID, "$b"))
+	// Pinning an already pinned event doesn't send anything.
+	require.NoError(t, cli.PinEvent(roomID, "$a"))
+	assert.Equal(t, []id.EventID{"$a", "$b"}, srv.pinned[string(roomID)].Pinned)
+	assert.Equal(t, 2, srv.puts)
+
+	require.NoError(t, cli.UnpinEvent(roomID, "$a"))
+	require.NoError(t, cli.UnpinEvent(roomID, "$a"))
+	assert.Equal(t, []id.EventID{"$b"}, srv.pinned[string(roomID)].Pinned)
+	assert.Equal(t, 3, srv.puts)
+}
+
+func TestClient_PinEvent_Concurrent(t *testing.T) {
+	cli, srv := newPinnedEventsClient(t)
+	rooms := []id.RoomID{"!room1:example.com", "!room2:example.com"}
+	const perRoom = 10
+
+	var wg sync.WaitGroup
+	for _, roomID := range rooms {
+		for i := 0; i < perRoom; i++ {
+			wg.Add(1)
+			go func(roomID id.RoomID, eventID id.EventID) {
+				defer wg.Done()
+				assert.NoError(t, cli.PinEvent(roomID, eventID))
+			}(roomID, id.EventID(fmt.Sprintf("$event%d", i)))
+		}
+	}
+	wg.Wait()
+
+	for _, roomID := range rooms {
+		require.Contains(t, srv.pinned, string(roomID))
+		assert.Len(t, srv.pinned[string(roomID)].Pinned, perRoom, roomID)
+	}
+}
@@ -93,6 +93,7 @@ func (mach *OlmMachine) decryptAndParseOlmCiphertext(sender id.UserID, senderKey
 		return nil, RecipientKeyMismatch
 	}
 
+	olmEvt.Type.Class = event.ToDeviceEventType
 	err = olmEvt.Content.ParseRaw(olmEvt.Type)
 	if err != nil && !event.IsUnsupportedContentType(err) {
 		return nil, fmt.Errorf("failed to parse content of olm payload event: %w", err)
@@ -67,6 +67,17 @@ func (store *SQLCryptoStore) Flush() error {
 	return nil
 }
 
+// FindDeviceID returns the device ID of the stored account, or an empty string if there is no account yet.
+func (store *SQLCryptoStore) FindDeviceID() (deviceID id.DeviceID) {
+	err := store.DB.
+		QueryRow("SELECT device_id FROM crypto_account WHERE account_id=$1", store.AccountID).
+		Scan(&deviceID)
+	if err != nil && err != sql.ErrNoRows {
+		store.Log.Warn("Failed to scan device ID: %v", err)
+	}
+	return
+}
+
 // PutNextBatch stores the next sync batch token for the current account.
 func (store *SQLCryptoStore) PutNextBatch(nextBatch string) {
 	store.SyncToken = nextBatch
@@ -24,9 +24,7 @@ func NewSSSSMachine(client *mautrix.Client) *Machine {
 	}
 }
 
-type DefaultSecretStorageKeyContent struct {
-	KeyID string `json:"key"`
-}
+type DefaultSecretStorageKeyContent = event.SecretStorageDefaultKeyEventContent
 
 // GetDefaultKeyID retrieves the default key ID for this account from SSSS.
 func (mach *Machine) GetDefaultKeyID() (string, error) {
@@ -46,7 +44,7 @@ func (mach *Machine) GetDefaultKeyID() (string, error) {
 
 // SetDefaultKeyID sets the default key ID for this account on the server.
 func (mach *Machine) SetDefaultKeyID(keyID string) error {
-	return mach.Client.SetAccountData(event.AccountDataSecretStorageDefaultKey.Type, &DefaultSecretStorageKeyContent{keyID})
+	return mach.Client.SetAccountData(event.AccountDataSecretStorageDefaultKey.Type, &DefaultSecretStorageKeyContent{KeyID: keyID})
 }
 
 // GetKeyData gets the details about the given key ID.
@@ -9,7 +9,6 @@ package ssss
 import (
 	"errors"
 	"fmt"
-	"reflect"
 
 	"maunium.net/go/mautrix/event"
 )
@@ -66,10 +65,10 @@ func (ed *EncryptedAccountDataEventContent) Decrypt(eventType string, key *Key)
 }
 
 func init() {
-	encryptedContent := reflect.TypeOf(&EncryptedAccountDataEventContent{})
-	event.TypeMap[event.AccountDataCrossSigningMaster] = encryptedContent
-	event.TypeMap[event.AccountDataCrossSigningSelf] = encryptedContent
-	event.TypeMap[event.AccountDataCrossSigningUser] = encryptedContent
-	event.TypeMap[event.AccountDataSecretStorageDefaultKey] = reflect.TypeOf(&DefaultSecretStorageKeyContent{})
-	event.TypeMap[event.AccountDataSecretStorageKey] = reflect.TypeOf(&KeyMetadata{})
+	event.RegisterEventType(event.AccountDataCrossSigningMaster, &EncryptedAccountDataEventContent{})
+	event.RegisterEventType(event.AccountDataCrossSigningSelf, &EncryptedAccountDataEventContent{})
+	event.RegisterEventType(event.AccountDataCrossSigningUser, &EncryptedAccountDataEventContent{})
+	event.RegisterEventType(event.AccountDataMegolmBackupKey, &EncryptedAccountDataEventContent{})
+	event.RegisterEventType(event.AccountDataSecretStorageDefaultKey, &DefaultSecretStorageKeyContent{})
+	event.RegisterEventType(event.AccountDataSecretStorageKey, &KeyMetadata{})
 }
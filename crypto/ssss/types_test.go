@@ -0,0 +1,40 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ssss_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+)
+
+func parseAccountData(t *testing.T, data string) *event.Event {
+	var evt event.Event
+	require.NoError(t, json.Unmarshal([]byte(data), &evt))
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	return &evt
+}
+
+func TestTypeMapRegistrations(t *testing.T) {
+	for _, evtType := range []string{"m.cross_signing.master", "m.megolm_backup.v1"} {
+		evt := parseAccountData(t, `{"type":"`+evtType+`","content":{"encrypted":{"abc":{"ciphertext":"c","iv":"i","mac":"m"}}}}`)
+		require.IsType(t, &ssss.EncryptedAccountDataEventContent{}, evt.Content.Parsed, evtType)
+		assert.Equal(t, "c", evt.Content.Parsed.(*ssss.EncryptedAccountDataEventContent).Encrypted["abc"].Ciphertext)
+	}
+
+	evt := parseAccountData(t, `{"type":"m.secret_storage.key","content":`+key1Meta+`}`)
+	require.IsType(t, &ssss.KeyMetadata{}, evt.Content.Parsed)
+	assert.Equal(t, ssss.AlgorithmAESHMACSHA2, evt.Content.Parsed.(*ssss.KeyMetadata).Algorithm)
+
+	evt = parseAccountData(t, `{"type":"m.secret_storage.default_key","content":{"key":"abc"}}`)
+	assert.Equal(t, "abc", evt.Content.AsSecretStorageDefaultKey().KeyID)
+}
@@ -13,12 +13,12 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
-	"math/rand"
 	"strings"
 
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/pbkdf2"
 
+	"maunium.net/go/mautrix/util"
 	"maunium.net/go/mautrix/util/base58"
 )
 
@@ -43,25 +43,16 @@ func XorA256CTR(source []byte, key [AESCTRKeyLength]byte, iv [AESCTRIVLength]byt
 
 // GenAttachmentA256CTR generates a new random AES256-CTR key and IV suitable for encrypting attachments.
 func GenAttachmentA256CTR() (key [AESCTRKeyLength]byte, iv [AESCTRIVLength]byte) {
-	_, err := rand.Read(key[:])
-	if err != nil {
-		panic(err)
-	}
+	copy(key[:], util.RandomBytes(AESCTRKeyLength))
 
 	// The last 8 bytes of the IV act as the counter in AES-CTR, which means they're left empty here
-	_, err = rand.Read(iv[:8])
-	if err != nil {
-		panic(err)
-	}
+	copy(iv[:8], util.RandomBytes(8))
 	return
 }
 
 // GenA256CTRIV generates a random IV for AES256-CTR with the last bit set to zero.
 func GenA256CTRIV() (iv [AESCTRIVLength]byte) {
-	_, err := rand.Read(iv[:])
-	if err != nil {
-		panic(err)
-	}
+	copy(iv[:], util.RandomBytes(AESCTRIVLength))
 	iv[8] &= 0x7F
 	return
 }
@@ -43,3 +43,22 @@ type IgnoredUserListEventContent struct {
 type IgnoredUser struct {
 	// This is an empty object
 }
+
+// SecretStorageDefaultKeyEventContent represents the content of a m.secret_storage.default_key account data event.
+// https://spec.matrix.org/v1.4/client-server-api/#key-storage
+type SecretStorageDefaultKeyEventContent struct {
+	KeyID string `json:"key"`
+}
+
+// IdentityServerEventContent represents the content of a m.identity_server account data event.
+// https://spec.matrix.org/v1.4/client-server-api/#identity-server-change
+type IdentityServerEventContent struct {
+	// The URL of the identity server. A nil value means the user explicitly chose not to use an identity server.
+	BaseURL *string `json:"base_url"`
+}
+
+// BreadcrumbsEventContent represents the content of an im.vector.setting.breadcrumbs account data event,
+// which contains the rooms the user has recently viewed, most recent first.
+type BreadcrumbsEventContent struct {
+	RecentRooms []id.RoomID `json:"recent_rooms"`
+}
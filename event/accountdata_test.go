@@ -0,0 +1,31 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAccountData_SecretStorage(t *testing.T) {
+	defaultKey := parseEvent(t, `{"type":"m.secret_storage.default_key","content":{"key":"abc"}}`)
+	assert.Equal(t, event.AccountDataEventType, defaultKey.Type.Class)
+	assert.Equal(t, "abc", defaultKey.Content.AsSecretStorageDefaultKey().KeyID)
+}
+
+func TestAccountData_Settings(t *testing.T) {
+	identityServer := parseEvent(t, `{"type":"m.identity_server","content":{"base_url":null}}`)
+	assert.Equal(t, event.AccountDataEventType, identityServer.Type.Class)
+	assert.Nil(t, identityServer.Content.AsIdentityServer().BaseURL)
+
+	breadcrumbs := parseEvent(t, `{"type":"im.vector.setting.breadcrumbs","content":{"recent_rooms":["!a:example.com","!b:example.com"]}}`)
+	assert.Equal(t, []id.RoomID{"!a:example.com", "!b:example.com"}, breadcrumbs.Content.AsBreadcrumbs().RecentRooms)
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"sort"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// AggregatedMessage contains the reactions and edits of a single message.
+type AggregatedMessage struct {
+	// The original event. This is nil if only relations to the event have been seen.
+	Original *Event
+	// Reaction key -> sender -> reaction event ID
+	Reactions map[string]map[id.UserID]id.EventID
+	// All m.replace events targeting this message, including ones that may turn out to be invalid
+	// after the original event is seen.
+	edits []*Event
+}
+
+type reactionTarget struct {
+	eventID id.EventID
+	key     string
+	sender  id.UserID
+}
+
+// Aggregator collects reactions and edits from events received via sync or /relations.
+//
+// Events can be added in any order. The content of added events must already be parsed.
+type Aggregator struct {
+	messages        map[id.EventID]*AggregatedMessage
+	reactionTargets map[id.EventID]reactionTarget
+	messagesLock    sync.RWMutex
+}
+
+// NewAggregator creates a new empty Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		messages:        make(map[id.EventID]*AggregatedMessage),
+		reactionTargets: make(map[id.EventID]reactionTarget),
+	}
+}
+
+func (agg *Aggregator) getMessage(eventID id.EventID) *AggregatedMessage {
+	msg, ok := agg.messages[eventID]
+	if !ok {
+		msg = &AggregatedMessage{Reactions: make(map[string]map[id.UserID]id.EventID)}
+		agg.messages[eventID] = msg
+	}
+	return msg
+}
+
+// AddAll adds all the given events to the aggregator.
+func (agg *Aggregator) AddAll(events []*Event) {
+	for _, evt := range events {
+		agg.Add(evt)
+	}
+}
+
+// Add adds a single event to the aggregator. Reactions, edits and redactions of reactions are aggregated,
+// while other message events are stored as the original event of their aggregation.
+func (agg *Aggregator) Add(evt *Event) {
+	agg.messagesLock.Lock()
+	defer agg.messagesLock.Unlock()
+	switch evt.Type {
+	case EventReaction:
+		agg.addReaction(evt)
+	case EventRedaction:
+		agg.removeReaction(evt.GetRedactsID())
+	case EventMessage, EventSticker:
+		content := evt.Content.AsMessage()
+		if content.RelatesTo != nil && content.RelatesTo.Type == RelReplace && content.NewContent != nil {
+			target := agg.getMessage(content.RelatesTo.EventID)
+			target.edits = append(target.edits, evt)
+		} else {
+			agg.getMessage(evt.ID).Original = evt
+		}
+	}
+}
+
+func (agg *Aggregator) addReaction(evt *Event) {
+	rel := evt.Content.AsReaction().RelatesTo
+	targetID, key := rel.GetAnnotationID(), rel.GetAnnotationKey()
+	if len(targetID) == 0 || len(key) == 0 {
+		return
+	} else if _, alreadyAdded := agg.reactionTargets[evt.ID]; alreadyAdded {
+		return
+	}
+	senders, ok := agg.getMessage(targetID).Reactions[key]
+	if !ok {
+		senders = make(map[id.UserID]id.EventID)
+		agg.messages[targetID].Reactions[key] = senders
+	}
+	if _, alreadyReacted := senders[evt.Sender]; !alreadyReacted {
+		senders[evt.Sender] = evt.ID
+	}
+	agg.reactionTargets[evt.ID] = reactionTarget{eventID: targetID, key: key, sender: evt.Sender}
+}
+
+func (agg *Aggregator) removeReaction(reactionID id.EventID) {
+	target, ok := agg.reactionTargets[reactionID]
+	if !ok {
+		return
+	}
+	delete(agg.reactionTargets, reactionID)
+	msg, ok := agg.messages[target.eventID]
+	if !ok {
+		return
+	}
+	senders := msg.Reactions[target.key]
+	if senders[target.sender] != reactionID {
+		return
+	}
+	delete(senders, target.sender)
+	// If the same user reacted with the same key multiple times, fall back to one of the other reactions.
+	for otherID, other := range agg.reactionTargets {
+		if other == target {
+			senders[target.sender] = otherID
+			break
+		}
+	}
+	if len(senders) == 0 {
+		delete(msg.Reactions, target.key)
+	}
+}
+
+// Get returns the aggregation for the given event ID, or nil if no events related to it have been added.
+func (agg *Aggregator) Get(eventID id.EventID) *AggregatedMessage {
+	agg.messagesLock.RLock()
+	defer agg.messagesLock.RUnlock()
+	return agg.messages[eventID]
+}
+
+// ReactionCounts returns the number of unique senders for each reaction key on the given message.
+func (agg *Aggregator) ReactionCounts(eventID id.EventID) map[string]int {
+	agg.messagesLock.RLock()
+	defer agg.messagesLock.RUnlock()
+	counts := make(map[string]int)
+	if msg, ok := agg.messages[eventID]; ok {
+		for key, senders := range msg.Reactions {
+			counts[key] = len(senders)
+		}
+	}
+	return counts
+}
+
+// ReactionSenders returns the users who reacted to the given message with the given key.
+func (agg *Aggregator) ReactionSenders(eventID id.EventID, key string) []id.UserID {
+	agg.messagesLock.RLock()
+	defer agg.messagesLock.RUnlock()
+	msg, ok := agg.messages[eventID]
+	if !ok {
+		return nil
+	}
+	senders := make([]id.UserID, 0, len(msg.Reactions[key]))
+	for sender := range msg.Reactions[key] {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		return senders[i] < senders[j]
+	})
+	return senders
+}
+
+// LatestEdit returns the most recent valid m.replace event for the given message.
+//
+// Edits are only considered valid if they're from the same sender as the original event, so nil is returned
+// until the original event has been added. Ties in timestamps are broken by the lexicographically largest event ID.
+func (agg *Aggregator) LatestEdit(eventID id.EventID) *Event {
+	agg.messagesLock.RLock()
+	defer agg.messagesLock.RUnlock()
+	msg, ok := agg.messages[eventID]
+	if !ok || msg.Original == nil {
+		return nil
+	}
+	var latest *Event
+	for _, edit := range msg.edits {
+		if edit.Sender != msg.Original.Sender || edit.Type != msg.Original.Type {
+			continue
+		} else if latest == nil || edit.Timestamp > latest.Timestamp ||
+			(edit.Timestamp == latest.Timestamp && edit.ID > latest.ID) {
+			latest = edit
+		}
+	}
+	return latest
+}
+
+// EffectiveContent returns the content of the latest edit of the given message, or the content of the original
+// message if it hasn't been edited. The relation of the original message is preserved in the returned content,
+// as edits are not allowed to change it.
+func (agg *Aggregator) EffectiveContent(eventID id.EventID) *MessageEventContent {
+	latest := agg.LatestEdit(eventID)
+	agg.messagesLock.RLock()
+	defer agg.messagesLock.RUnlock()
+	msg, ok := agg.messages[eventID]
+	if !ok || msg.Original == nil {
+		return nil
+	}
+	original := msg.Original.Content.AsMessage()
+	if latest == nil {
+		return original
+	}
+	newContent := *latest.Content.AsMessage().NewContent
+	newContent.RelatesTo = original.RelatesTo
+	return &newContent
+}
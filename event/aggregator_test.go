@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func makeReaction(eventID id.EventID, sender id.UserID, target id.EventID, key string) *event.Event {
+	return &event.Event{
+		ID:     eventID,
+		Sender: sender,
+		Type:   event.EventReaction,
+		Content: event.Content{Parsed: &event.ReactionEventContent{
+			RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: target, Key: key},
+		}},
+	}
+}
+
+func makeEdit(eventID id.EventID, sender id.UserID, target id.EventID, body string, ts int64) *event.Event {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "* " + body}
+	content.SetEdit(target)
+	content.NewContent.Body = body
+	return &event.Event{
+		ID:        eventID,
+		Sender:    sender,
+		Type:      event.EventMessage,
+		Timestamp: ts,
+		Content:   event.Content{Parsed: content},
+	}
+}
+
+func TestAggregator_Reactions(t *testing.T) {
+	agg := event.NewAggregator()
+	agg.AddAll([]*event.Event{
+		makeReaction("$r1", "@alice:example.com", "$msg", "👍"),
+		makeReaction("$r2", "@bob:example.com", "$msg", "👍"),
+		makeReaction("$r3", "@bob:example.com", "$msg", "👍"),
+		makeReaction("$r4", "@alice:example.com", "$msg", "🎉"),
+	})
+	assert.Equal(t, map[string]int{"👍": 2, "🎉": 1}, agg.ReactionCounts("$msg"))
+	assert.Equal(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, agg.ReactionSenders("$msg", "👍"))
+
+	agg.Add(&event.Event{Type: event.EventRedaction, Redacts: "$r2"})
+	assert.Equal(t, 2, agg.ReactionCounts("$msg")["👍"], "duplicate reaction should take over after redaction")
+	agg.Add(&event.Event{Type: event.EventRedaction, Redacts: "$r3"})
+	agg.Add(&event.Event{Type: event.EventRedaction, Redacts: "$r4"})
+	assert.Equal(t, map[string]int{"👍": 1}, agg.ReactionCounts("$msg"))
+}
+
+func TestAggregator_Edits(t *testing.T) {
+	agg := event.NewAggregator()
+	agg.Add(makeEdit("$edit2", "@alice:example.com", "$msg", "second", 3))
+	agg.Add(makeEdit("$edit1", "@alice:example.com", "$msg", "first", 2))
+	agg.Add(makeEdit("$evil", "@mallory:example.com", "$msg", "hacked", 4))
+	assert.Nil(t, agg.LatestEdit("$msg"), "edits shouldn't be resolved before the original event is known")
+
+	agg.Add(&event.Event{
+		ID:        "$msg",
+		Sender:    "@alice:example.com",
+		Type:      event.EventMessage,
+		Timestamp: 1,
+		Content:   event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "original"}},
+	})
+	latest := agg.LatestEdit("$msg")
+	require.NotNil(t, latest)
+	assert.Equal(t, id.EventID("$edit2"), latest.ID)
+	assert.Equal(t, "second", agg.EffectiveContent("$msg").Body)
+	assert.Nil(t, agg.EffectiveContent("$unknown"))
+}
+
+func TestEvent_GetRedactsID(t *testing.T) {
+	legacy := parseEvent(t, `{"type": "m.room.redaction", "event_id": "$r1", "sender": "@a:example.com", "redacts": "$target1", "content": {"reason": "spam"}}`)
+	assert.Equal(t, id.EventID("$target1"), legacy.GetRedactsID())
+	assert.Equal(t, "spam", legacy.Content.AsRedaction().Reason)
+
+	v11 := parseEvent(t, `{"type": "m.room.redaction", "event_id": "$r2", "sender": "@a:example.com", "content": {"redacts": "$target2"}}`)
+	assert.Equal(t, id.EventID("$target2"), v11.GetRedactsID())
+
+	var unparsed event.Event
+	require.NoError(t, json.Unmarshal([]byte(`{"type": "m.room.redaction", "content": {"redacts": "$target3"}}`), &unparsed))
+	assert.Equal(t, id.EventID("$target3"), unparsed.GetRedactsID())
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// MaxWaveformValue is the maximum value of a single sample in MSC1767Audio.Waveform.
+	MaxWaveformValue = 1024
+	// DefaultWaveformSamples is the number of samples NormalizeWaveform produces if no sample count is specified.
+	DefaultWaveformSamples = 100
+)
+
+// MSC1767Audio is the org.matrix.msc1767.audio block of audio messages.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3246
+type MSC1767Audio struct {
+	// Duration of the audio in milliseconds.
+	Duration int `json:"duration"`
+	// Waveform of the audio, with values between 0 and MaxWaveformValue.
+	Waveform []int `json:"waveform"`
+}
+
+// MSC3245Voice is the org.matrix.msc3245.voice block, which marks an audio message as a voice message.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3245
+type MSC3245Voice struct{}
+
+// NormalizeWaveform converts raw audio amplitudes (e.g. PCM samples) into a waveform for MSC1767Audio.
+//
+// The amplitudes are split into the given number of buckets (DefaultWaveformSamples if zero), the peak
+// of each bucket is taken, and the peaks are scaled so that the loudest bucket is MaxWaveformValue.
+func NormalizeWaveform(amplitudes []float64, samples int) []int {
+	if samples <= 0 {
+		samples = DefaultWaveformSamples
+	}
+	if len(amplitudes) < samples {
+		samples = len(amplitudes)
+	}
+	waveform := make([]int, samples)
+	if samples == 0 {
+		return waveform
+	}
+	peaks := make([]float64, samples)
+	var maxPeak float64
+	for i := range peaks {
+		start := i * len(amplitudes) / samples
+		end := (i + 1) * len(amplitudes) / samples
+		for _, amplitude := range amplitudes[start:end] {
+			peaks[i] = math.Max(peaks[i], math.Abs(amplitude))
+		}
+		maxPeak = math.Max(maxPeak, peaks[i])
+	}
+	if maxPeak == 0 {
+		return waveform
+	}
+	for i, peak := range peaks {
+		waveform[i] = int(math.Round(peak / maxPeak * MaxWaveformValue))
+	}
+	return waveform
+}
+
+// IsVoiceMessage returns true if the message is an audio message marked as a voice message.
+func (content *MessageEventContent) IsVoiceMessage() bool {
+	return content.MsgType == MsgAudio && content.MSC3245Voice != nil
+}
+
+// SetAudioInfo sets the duration of an audio message in both the file info and the MSC1767 audio block.
+// The waveform is optional.
+func (content *MessageEventContent) SetAudioInfo(duration time.Duration, waveform []int) {
+	durationMS := int(duration.Milliseconds())
+	content.GetInfo().Duration = durationMS
+	content.MSC1767Audio = &MSC1767Audio{
+		Duration: durationMS,
+		Waveform: waveform,
+	}
+	if content.MSC1767Audio.Waveform == nil {
+		content.MSC1767Audio.Waveform = []int{}
+	}
+}
+
+// MarkAsVoice turns the message into an audio message that clients render as a voice message.
+func (content *MessageEventContent) MarkAsVoice(duration time.Duration, waveform []int) {
+	content.MsgType = MsgAudio
+	content.SetAudioInfo(duration, waveform)
+	content.MSC3245Voice = &MSC3245Voice{}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestNormalizeWaveform(t *testing.T) {
+	assert.Equal(t, []int{256, 1024}, event.NormalizeWaveform([]float64{0.1, -0.25, 0.5, -1}, 2))
+	// Fewer amplitudes than samples produces one sample per amplitude.
+	assert.Equal(t, []int{512, 1024}, event.NormalizeWaveform([]float64{0.5, 1}, 10))
+	assert.Equal(t, []int{0, 0, 0}, event.NormalizeWaveform([]float64{0, 0, 0}, 0))
+	assert.Empty(t, event.NormalizeWaveform(nil, 0))
+	assert.Len(t, event.NormalizeWaveform(make([]float64, 1000), 0), event.DefaultWaveformSamples)
+}
+
+func TestMessageEventContent_MarkAsVoice(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgFile, Body: "voice.ogg"}
+	assert.False(t, content.IsVoiceMessage())
+	content.MarkAsVoice(2500*time.Millisecond, nil)
+	assert.True(t, content.IsVoiceMessage())
+
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"msgtype": "m.audio",
+		"body": "voice.ogg",
+		"info": {"duration": 2500},
+		"org.matrix.msc1767.audio": {"duration": 2500, "waveform": []},
+		"org.matrix.msc3245.voice": {}
+	}`, string(data))
+}
+
+func TestMessageEventContent_ParseVoice(t *testing.T) {
+	evt := makeEvent(t, event.Event{Type: event.EventMessage}, `{
+		"msgtype": "m.audio",
+		"body": "Voice message",
+		"url": "mxc://example.com/voice",
+		"org.matrix.msc1767.audio": {"duration": 1234, "waveform": [0, 512, 1024]},
+		"org.matrix.msc3245.voice": {}
+	}`)
+	content := evt.Content.AsMessage()
+	assert.True(t, content.IsVoiceMessage())
+	require.NotNil(t, content.MSC1767Audio)
+	assert.Equal(t, 1234, content.MSC1767Audio.Duration)
+	assert.Equal(t, []int{0, 512, 1024}, content.MSC1767Audio.Waveform)
+
+	plainAudio := makeEvent(t, event.Event{Type: event.EventMessage}, `{"msgtype": "m.audio", "body": "song.mp3"}`)
+	assert.False(t, plainAudio.Content.AsMessage().IsVoiceMessage())
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// HistoricalContentKey is the content key that marks events imported using the MSC2716 batch send endpoint.
+const HistoricalContentKey = "org.matrix.msc2716.historical"
+
+// InsertionEventContent represents the content of an org.matrix.msc2716.insertion event.
+// Insertion events mark a point in the room DAG where more history can be inserted. The next batch
+// of history is inserted by using NextBatchID as the batch ID in the batch send request.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2716
+type InsertionEventContent struct {
+	NextBatchID id.BatchID `json:"org.matrix.msc2716.next_batch_id"`
+	Historical  bool       `json:"org.matrix.msc2716.historical,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// BatchEventContent represents the content of an org.matrix.msc2716.batch event.
+// Batch events are at the end of each batch of imported history and point to the insertion event they connect to.
+type BatchEventContent struct {
+	BatchID    id.BatchID `json:"org.matrix.msc2716.batch_id"`
+	Historical bool       `json:"org.matrix.msc2716.historical,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// MarkerEventContent represents the content of an org.matrix.msc2716.marker state event.
+// Markers are sent to the live timeline to tell other servers that history was inserted at the given insertion event.
+// The state key should be unique for each marker so that older markers aren't replaced.
+type MarkerEventContent struct {
+	InsertionEventID id.EventID `json:"org.matrix.msc2716.marker.insertion"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// ContinuesWith returns whether the given batch event is connected to this insertion event.
+func (content *InsertionEventContent) ContinuesWith(batch *BatchEventContent) bool {
+	return len(content.NextBatchID) > 0 && content.NextBatchID == batch.BatchID
+}
+
+// IsHistorical returns whether the event was imported into the room using the MSC2716 batch send endpoint.
+func (evt *Event) IsHistorical() bool {
+	switch content := evt.Content.Parsed.(type) {
+	case *InsertionEventContent:
+		return content.Historical
+	case *BatchEventContent:
+		return content.Historical
+	}
+	historical, ok := evt.Content.Raw[HistoricalContentKey].(bool)
+	return ok && historical
+}
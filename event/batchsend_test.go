@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestBatchSendEvents(t *testing.T) {
+	insertion := parseEvent(t, `{"type":"org.matrix.msc2716.insertion","content":{"org.matrix.msc2716.next_batch_id":"abc","org.matrix.msc2716.historical":true}}`)
+	assert.Equal(t, event.MessageEventType, insertion.Type.Class)
+	assert.True(t, insertion.IsHistorical())
+	batch := parseEvent(t, `{"type":"org.matrix.msc2716.batch","content":{"org.matrix.msc2716.batch_id":"abc","org.matrix.msc2716.historical":true}}`)
+	assert.True(t, insertion.Content.AsInsertion().ContinuesWith(batch.Content.AsBatch()))
+	assert.False(t, insertion.Content.AsInsertion().ContinuesWith(&event.BatchEventContent{BatchID: "def"}))
+
+	marker := parseEvent(t, `{"type":"org.matrix.msc2716.marker","state_key":"1","content":{"org.matrix.msc2716.marker.insertion":"$insertion"}}`)
+	assert.Equal(t, event.StateEventType, marker.Type.Class)
+	assert.Equal(t, id.EventID("$insertion"), marker.Content.AsMarker().InsertionEventID)
+	assert.False(t, marker.IsHistorical())
+
+	message := parseEvent(t, `{"type":"m.room.message","content":{"msgtype":"m.text","body":"hi","org.matrix.msc2716.historical":true}}`)
+	assert.True(t, message.IsHistorical())
+}
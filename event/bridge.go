@@ -0,0 +1,36 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// BridgeInfoStateKey returns the state key for the bridge info event of a portal room in the format
+// recommended by MSC2346: <bridge name>://<protocol>/<network>/<channel>, where the network is omitted if not set.
+func BridgeInfoStateKey(bridgeName string, content *BridgeEventContent) string {
+	if content.Network != nil && len(content.Network.ID) > 0 {
+		return fmt.Sprintf("%s://%s/%s/%s", bridgeName, url.PathEscape(content.Protocol.ID),
+			url.PathEscape(content.Network.ID), url.PathEscape(content.Channel.ID))
+	}
+	return fmt.Sprintf("%s://%s/%s", bridgeName, url.PathEscape(content.Protocol.ID), url.PathEscape(content.Channel.ID))
+}
+
+// InitialState returns the bridge info as state events for the initial_state field of room creation requests.
+// Both the stable m.bridge and the unstable uk.half-shot.bridge event types are included.
+func (content *BridgeEventContent) InitialState(stateKey string) []*Event {
+	return []*Event{{
+		Type:     StateBridge,
+		StateKey: &stateKey,
+		Content:  Content{Parsed: content},
+	}, {
+		Type:     StateHalfShotBridge,
+		StateKey: &stateKey,
+		Content:  Content{Parsed: content},
+	}}
+}
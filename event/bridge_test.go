@@ -0,0 +1,31 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestBridgeInfoStateKey(t *testing.T) {
+	content := &event.BridgeEventContent{
+		BridgeBot: "@telegrambot:example.com",
+		Protocol:  event.BridgeInfoSection{ID: "telegram"},
+		Channel:   event.BridgeInfoSection{ID: "-100/1234"},
+	}
+	assert.Equal(t, "telegrambot://telegram/-100%2F1234", event.BridgeInfoStateKey("telegrambot", content))
+	content.Network = &event.BridgeInfoSection{ID: "dc2"}
+	assert.Equal(t, "telegrambot://telegram/dc2/-100%2F1234", event.BridgeInfoStateKey("telegrambot", content))
+
+	state := content.InitialState("key")
+	assert.Len(t, state, 2)
+	assert.Equal(t, event.StateHalfShotBridge, state[1].Type)
+	assert.Equal(t, "key", *state[1].StateKey)
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type CallState string
+
+const (
+	CallStateRinging   CallState = "ringing"
+	CallStateConnected CallState = "connected"
+	CallStateEnded     CallState = "ended"
+)
+
+// TrackedCall is the state of a single legacy (m.call.*) VoIP call.
+type TrackedCall struct {
+	CallID  string
+	RoomID  id.RoomID
+	Version CallVersion
+	State   CallState
+
+	Caller        id.UserID
+	CallerPartyID string
+	// The user the call was meant for. Only set for version 1 calls that specify an invitee.
+	Invitee id.UserID
+	// The user and party who answered the call. If multiple parties answer, the one selected by the caller wins.
+	Callee        id.UserID
+	CalleePartyID string
+
+	Offer  CallData
+	Answer *CallData
+	Video  bool
+
+	StartedAt    time.Time
+	ExpiresAt    time.Time
+	AnsweredAt   time.Time
+	EndedAt      time.Time
+	HangupReason CallHangupReason
+	// Whether the call was ended with m.call.reject rather than m.call.hangup.
+	Rejected bool
+}
+
+// IsActive returns whether the call is ongoing or still ringing at the given time.
+func (call *TrackedCall) IsActive(now time.Time) bool {
+	switch call.State {
+	case CallStateConnected:
+		return true
+	case CallStateRinging:
+		return call.ExpiresAt.IsZero() || now.Before(call.ExpiresAt)
+	default:
+		return false
+	}
+}
+
+// CallTracker keeps track of the state of legacy VoIP calls based on m.call.* events.
+type CallTracker struct {
+	calls     map[string]*TrackedCall
+	callsLock sync.RWMutex
+}
+
+// NewCallTracker creates a new empty CallTracker.
+func NewCallTracker() *CallTracker {
+	return &CallTracker{calls: make(map[string]*TrackedCall)}
+}
+
+// Update applies the given call event to the tracked state. The content of the event must already be parsed.
+// The returned value is a copy of the updated call, or nil if the event wasn't a call event or referenced
+// an unknown call.
+func (ct *CallTracker) Update(evt *Event) *TrackedCall {
+	if !evt.Type.IsCall() {
+		return nil
+	}
+	ts := time.UnixMilli(evt.Timestamp)
+	ct.callsLock.Lock()
+	defer ct.callsLock.Unlock()
+	var call *TrackedCall
+	switch content := evt.Content.Parsed.(type) {
+	case *CallInviteEventContent:
+		if _, exists := ct.calls[content.CallID]; exists {
+			return nil
+		}
+		call = &TrackedCall{
+			CallID:        content.CallID,
+			RoomID:        evt.RoomID,
+			Version:       content.Version,
+			State:         CallStateRinging,
+			Caller:        evt.Sender,
+			CallerPartyID: content.PartyID,
+			Invitee:       content.Invitee,
+			Offer:         content.Offer,
+			Video:         strings.Contains(content.Offer.SDP, "m=video"),
+			StartedAt:     ts,
+		}
+		if content.Lifetime > 0 {
+			call.ExpiresAt = ts.Add(time.Duration(content.Lifetime) * time.Millisecond)
+		}
+		ct.calls[content.CallID] = call
+	case *CallAnswerEventContent:
+		call = ct.calls[content.CallID]
+		if call == nil || call.State != CallStateRinging {
+			return nil
+		}
+		call.State = CallStateConnected
+		call.Callee = evt.Sender
+		call.CalleePartyID = content.PartyID
+		answer := content.Answer
+		call.Answer = &answer
+		call.AnsweredAt = ts
+	case *CallSelectAnswerEventContent:
+		call = ct.calls[content.CallID]
+		if call == nil || call.State == CallStateEnded {
+			return nil
+		}
+		call.CalleePartyID = content.SelectedPartyID
+	case *CallNegotiateEventContent:
+		call = ct.calls[content.CallID]
+		if call == nil || call.State == CallStateEnded {
+			return nil
+		}
+		if content.Description.Type == CallDataTypeOffer {
+			call.Video = strings.Contains(content.Description.SDP, "m=video")
+		}
+	case *CallRejectEventContent:
+		call = ct.calls[content.CallID]
+		if call == nil || call.State == CallStateEnded {
+			return nil
+		}
+		call.State = CallStateEnded
+		call.Rejected = true
+		call.EndedAt = ts
+	case *CallHangupEventContent:
+		call = ct.calls[content.CallID]
+		if call == nil || call.State == CallStateEnded {
+			return nil
+		}
+		call.State = CallStateEnded
+		call.HangupReason = content.Reason
+		call.EndedAt = ts
+	case *CallCandidatesEventContent:
+		call = ct.calls[content.CallID]
+		if call == nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	callCopy := *call
+	return &callCopy
+}
+
+// Get returns a copy of the state of the given call, or nil if the call isn't known.
+func (ct *CallTracker) Get(callID string) *TrackedCall {
+	ct.callsLock.RLock()
+	defer ct.callsLock.RUnlock()
+	call, ok := ct.calls[callID]
+	if !ok {
+		return nil
+	}
+	callCopy := *call
+	return &callCopy
+}
+
+// Active returns copies of all calls that are ringing or connected at the given time, sorted by start time.
+func (ct *CallTracker) Active(now time.Time) []*TrackedCall {
+	ct.callsLock.RLock()
+	defer ct.callsLock.RUnlock()
+	var active []*TrackedCall
+	for _, call := range ct.calls {
+		if call.IsActive(now) {
+			callCopy := *call
+			active = append(active, &callCopy)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].StartedAt.Before(active[j].StartedAt)
+	})
+	return active
+}
+
+// Forget removes the given call from the tracker.
+func (ct *CallTracker) Forget(callID string) {
+	ct.callsLock.Lock()
+	delete(ct.calls, callID)
+	ct.callsLock.Unlock()
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+// IsMedia returns whether the message is a media message (image, video, audio or file).
+func (content *MessageEventContent) IsMedia() bool {
+	switch content.MsgType {
+	case MsgImage, MsgVideo, MsgAudio, MsgFile:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetFileName returns the file name of a media message. Messages without a separate filename field
+// use the body as the file name.
+func (content *MessageEventContent) GetFileName() string {
+	if len(content.FileName) > 0 {
+		return content.FileName
+	}
+	return content.Body
+}
+
+// HasCaption returns whether the body of the media message is a caption rather than the file name.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2530
+func (content *MessageEventContent) HasCaption() bool {
+	return len(content.FileName) > 0 && content.FileName != content.Body
+}
+
+// GetCaption returns the plaintext caption of the media message, or an empty string if it doesn't have one.
+func (content *MessageEventContent) GetCaption() string {
+	if !content.HasCaption() {
+		return ""
+	}
+	return content.Body
+}
+
+// GetFormattedCaption returns the HTML caption of the media message, or an empty string if
+// the message doesn't have a caption or the caption isn't formatted.
+func (content *MessageEventContent) GetFormattedCaption() string {
+	if !content.HasCaption() || content.Format != FormatHTML {
+		return ""
+	}
+	return content.FormattedBody
+}
+
+// SetCaption sets the caption of a media message, moving the file name from the body into the filename field
+// if necessary. The formatted caption is optional. Setting an empty caption removes the existing caption.
+func (content *MessageEventContent) SetCaption(caption, formattedCaption string) {
+	fileName := content.GetFileName()
+	content.Format = ""
+	content.FormattedBody = ""
+	if len(caption) == 0 {
+		content.Body = fileName
+		content.FileName = ""
+		return
+	}
+	content.Body = caption
+	content.FileName = fileName
+	if len(formattedCaption) > 0 {
+		content.Format = FormatHTML
+		content.FormattedBody = formattedCaption
+	}
+}
@@ -38,6 +38,17 @@ var TypeMap = map[Type]reflect.Type{
 	StateHalfShotBridge:    reflect.TypeOf(BridgeEventContent{}),
 	StateSpaceParent:       reflect.TypeOf(SpaceParentEventContent{}),
 	StateSpaceChild:        reflect.TypeOf(SpaceChildEventContent{}),
+	StateBeaconInfo:        reflect.TypeOf(BeaconInfoEventContent{}),
+	StateWidget:            reflect.TypeOf(WidgetEventContent{}),
+	StateUnstableWidget:    reflect.TypeOf(WidgetEventContent{}),
+	StateGroupCall:         reflect.TypeOf(GroupCallEventContent{}),
+	StateGroupCallMember:   reflect.TypeOf(GroupCallMemberEventContent{}),
+	StateImagePack:         reflect.TypeOf(ImagePackEventContent{}),
+	StateInsertionMarker:   reflect.TypeOf(MarkerEventContent{}),
+
+	StateUnstablePolicyRoom:   reflect.TypeOf(ModPolicyContent{}),
+	StateUnstablePolicyServer: reflect.TypeOf(ModPolicyContent{}),
+	StateUnstablePolicyUser:   reflect.TypeOf(ModPolicyContent{}),
 
 	EventMessage:   reflect.TypeOf(MessageEventContent{}),
 	EventSticker:   reflect.TypeOf(MessageEventContent{}),
@@ -45,10 +56,33 @@ var TypeMap = map[Type]reflect.Type{
 	EventRedaction: reflect.TypeOf(RedactionEventContent{}),
 	EventReaction:  reflect.TypeOf(ReactionEventContent{}),
 
+	EventPollStart:            reflect.TypeOf(PollStartEventContent{}),
+	EventPollResponse:         reflect.TypeOf(PollResponseEventContent{}),
+	EventPollEnd:              reflect.TypeOf(PollEndEventContent{}),
+	EventUnstablePollStart:    reflect.TypeOf(PollStartEventContent{}),
+	EventUnstablePollResponse: reflect.TypeOf(PollResponseEventContent{}),
+	EventUnstablePollEnd:      reflect.TypeOf(PollEndEventContent{}),
+
+	EventBeacon: reflect.TypeOf(BeaconEventContent{}),
+
+	EventInsertion: reflect.TypeOf(InsertionEventContent{}),
+	EventBatch:     reflect.TypeOf(BatchEventContent{}),
+
+	EventExtensibleMessage: reflect.TypeOf(ExtensibleContent{}),
+	EventExtensibleFile:    reflect.TypeOf(ExtensibleContent{}),
+	EventExtensibleImage:   reflect.TypeOf(ExtensibleContent{}),
+	EventExtensibleAudio:   reflect.TypeOf(ExtensibleContent{}),
+
 	AccountDataRoomTags:        reflect.TypeOf(TagEventContent{}),
 	AccountDataDirectChats:     reflect.TypeOf(DirectChatsEventContent{}),
 	AccountDataFullyRead:       reflect.TypeOf(FullyReadEventContent{}),
 	AccountDataIgnoredUserList: reflect.TypeOf(IgnoredUserListEventContent{}),
+	AccountDataImagePack:       reflect.TypeOf(ImagePackEventContent{}),
+	AccountDataImagePackRooms:  reflect.TypeOf(ImagePackRoomsEventContent{}),
+
+	AccountDataSecretStorageDefaultKey: reflect.TypeOf(SecretStorageDefaultKeyEventContent{}),
+	AccountDataIdentityServer:          reflect.TypeOf(IdentityServerEventContent{}),
+	AccountDataBreadcrumbs:             reflect.TypeOf(BreadcrumbsEventContent{}),
 
 	EphemeralEventTyping:   reflect.TypeOf(TypingEventContent{}),
 	EphemeralEventReceipt:  reflect.TypeOf(ReceiptEventContent{}),
@@ -60,6 +94,7 @@ var TypeMap = map[Type]reflect.Type{
 	InRoomVerificationKey:    reflect.TypeOf(VerificationKeyEventContent{}),
 	InRoomVerificationMAC:    reflect.TypeOf(VerificationMacEventContent{}),
 	InRoomVerificationCancel: reflect.TypeOf(VerificationCancelEventContent{}),
+	InRoomVerificationDone:   reflect.TypeOf(VerificationDoneEventContent{}),
 
 	ToDeviceRoomKey:          reflect.TypeOf(RoomKeyEventContent{}),
 	ToDeviceForwardedRoomKey: reflect.TypeOf(ForwardedRoomKeyEventContent{}),
@@ -74,6 +109,11 @@ var TypeMap = map[Type]reflect.Type{
 	ToDeviceVerificationMAC:     reflect.TypeOf(VerificationMacEventContent{}),
 	ToDeviceVerificationCancel:  reflect.TypeOf(VerificationCancelEventContent{}),
 	ToDeviceVerificationRequest: reflect.TypeOf(VerificationRequestEventContent{}),
+	ToDeviceVerificationReady:   reflect.TypeOf(VerificationReadyEventContent{}),
+	ToDeviceVerificationDone:    reflect.TypeOf(VerificationDoneEventContent{}),
+
+	ToDeviceSecretRequest: reflect.TypeOf(SecretRequestEventContent{}),
+	ToDeviceSecretSend:    reflect.TypeOf(SecretSendEventContent{}),
 
 	ToDeviceOrgMatrixRoomKeyWithheld: reflect.TypeOf(RoomKeyWithheldEventContent{}),
 
@@ -165,7 +205,7 @@ func (content *Content) ParseRaw(evtType Type) error {
 	if content.Parsed != nil {
 		return ErrContentAlreadyParsed
 	}
-	structType, ok := TypeMap[evtType]
+	structType, ok := getContentStructType(evtType)
 	if !ok {
 		return fmt.Errorf("%w %s", ErrUnsupportedContentType, evtType.Repr())
 	}
@@ -212,6 +252,17 @@ func init() {
 	gob.Register(&EncryptedEventContent{})
 	gob.Register(&RedactionEventContent{})
 	gob.Register(&ReactionEventContent{})
+	gob.Register(&PollStartEventContent{})
+	gob.Register(&PollResponseEventContent{})
+	gob.Register(&PollEndEventContent{})
+	gob.Register(&BeaconInfoEventContent{})
+	gob.Register(&BeaconEventContent{})
+	gob.Register(&ExtensibleContent{})
+	gob.Register(&WidgetEventContent{})
+	gob.Register(&GroupCallEventContent{})
+	gob.Register(&GroupCallMemberEventContent{})
+	gob.Register(&ImagePackEventContent{})
+	gob.Register(&ImagePackRoomsEventContent{})
 	gob.Register(&TagEventContent{})
 	gob.Register(&DirectChatsEventContent{})
 	gob.Register(&FullyReadEventContent{})
@@ -223,6 +274,23 @@ func init() {
 	gob.Register(&ForwardedRoomKeyEventContent{})
 	gob.Register(&RoomKeyRequestEventContent{})
 	gob.Register(&RoomKeyWithheldEventContent{})
+	gob.Register(&DummyEventContent{})
+	gob.Register(&SecretRequestEventContent{})
+	gob.Register(&SecretSendEventContent{})
+	gob.Register(&VerificationRequestEventContent{})
+	gob.Register(&VerificationStartEventContent{})
+	gob.Register(&VerificationReadyEventContent{})
+	gob.Register(&VerificationAcceptEventContent{})
+	gob.Register(&VerificationKeyEventContent{})
+	gob.Register(&VerificationMacEventContent{})
+	gob.Register(&VerificationCancelEventContent{})
+	gob.Register(&VerificationDoneEventContent{})
+	gob.Register(&SecretStorageDefaultKeyEventContent{})
+	gob.Register(&IdentityServerEventContent{})
+	gob.Register(&BreadcrumbsEventContent{})
+	gob.Register(&InsertionEventContent{})
+	gob.Register(&BatchEventContent{})
+	gob.Register(&MarkerEventContent{})
 }
 
 // Helper cast functions below
@@ -444,6 +512,76 @@ func (content *Content) AsRoomKeyWithheld() *RoomKeyWithheldEventContent {
 	}
 	return casted
 }
+func (content *Content) AsSecretRequest() *SecretRequestEventContent {
+	casted, ok := content.Parsed.(*SecretRequestEventContent)
+	if !ok {
+		return &SecretRequestEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsSecretSend() *SecretSendEventContent {
+	casted, ok := content.Parsed.(*SecretSendEventContent)
+	if !ok {
+		return &SecretSendEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationRequest() *VerificationRequestEventContent {
+	casted, ok := content.Parsed.(*VerificationRequestEventContent)
+	if !ok {
+		return &VerificationRequestEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationStart() *VerificationStartEventContent {
+	casted, ok := content.Parsed.(*VerificationStartEventContent)
+	if !ok {
+		return &VerificationStartEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationReady() *VerificationReadyEventContent {
+	casted, ok := content.Parsed.(*VerificationReadyEventContent)
+	if !ok {
+		return &VerificationReadyEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationAccept() *VerificationAcceptEventContent {
+	casted, ok := content.Parsed.(*VerificationAcceptEventContent)
+	if !ok {
+		return &VerificationAcceptEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationKey() *VerificationKeyEventContent {
+	casted, ok := content.Parsed.(*VerificationKeyEventContent)
+	if !ok {
+		return &VerificationKeyEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationMAC() *VerificationMacEventContent {
+	casted, ok := content.Parsed.(*VerificationMacEventContent)
+	if !ok {
+		return &VerificationMacEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationCancel() *VerificationCancelEventContent {
+	casted, ok := content.Parsed.(*VerificationCancelEventContent)
+	if !ok {
+		return &VerificationCancelEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsVerificationDone() *VerificationDoneEventContent {
+	casted, ok := content.Parsed.(*VerificationDoneEventContent)
+	if !ok {
+		return &VerificationDoneEventContent{}
+	}
+	return casted
+}
 func (content *Content) AsCallInvite() *CallInviteEventContent {
 	casted, ok := content.Parsed.(*CallInviteEventContent)
 	if !ok {
@@ -500,3 +638,129 @@ func (content *Content) AsModPolicy() *ModPolicyContent {
 	}
 	return casted
 }
+func (content *Content) AsPollStart() *PollStartEventContent {
+	casted, ok := content.Parsed.(*PollStartEventContent)
+	if !ok {
+		return &PollStartEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsPollResponse() *PollResponseEventContent {
+	casted, ok := content.Parsed.(*PollResponseEventContent)
+	if !ok {
+		return &PollResponseEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsPollEnd() *PollEndEventContent {
+	casted, ok := content.Parsed.(*PollEndEventContent)
+	if !ok {
+		return &PollEndEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsBeaconInfo() *BeaconInfoEventContent {
+	casted, ok := content.Parsed.(*BeaconInfoEventContent)
+	if !ok {
+		return &BeaconInfoEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsBeacon() *BeaconEventContent {
+	casted, ok := content.Parsed.(*BeaconEventContent)
+	if !ok {
+		return &BeaconEventContent{}
+	}
+	return casted
+}
+
+func (content *Content) AsExtensible() *ExtensibleContent {
+	casted, ok := content.Parsed.(*ExtensibleContent)
+	if !ok {
+		return &ExtensibleContent{}
+	}
+	return casted
+}
+
+func (content *Content) AsWidget() *WidgetEventContent {
+	casted, ok := content.Parsed.(*WidgetEventContent)
+	if !ok {
+		return &WidgetEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsGroupCall() *GroupCallEventContent {
+	casted, ok := content.Parsed.(*GroupCallEventContent)
+	if !ok {
+		return &GroupCallEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsGroupCallMember() *GroupCallMemberEventContent {
+	casted, ok := content.Parsed.(*GroupCallMemberEventContent)
+	if !ok {
+		return &GroupCallMemberEventContent{}
+	}
+	return casted
+}
+
+// AsSticker returns the content of a m.sticker event. Stickers use the same struct as m.room.message events.
+func (content *Content) AsSticker() *MessageEventContent {
+	return content.AsMessage()
+}
+func (content *Content) AsImagePack() *ImagePackEventContent {
+	casted, ok := content.Parsed.(*ImagePackEventContent)
+	if !ok {
+		return &ImagePackEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsImagePackRooms() *ImagePackRoomsEventContent {
+	casted, ok := content.Parsed.(*ImagePackRoomsEventContent)
+	if !ok {
+		return &ImagePackRoomsEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsInsertion() *InsertionEventContent {
+	casted, ok := content.Parsed.(*InsertionEventContent)
+	if !ok {
+		return &InsertionEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsBatch() *BatchEventContent {
+	casted, ok := content.Parsed.(*BatchEventContent)
+	if !ok {
+		return &BatchEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsMarker() *MarkerEventContent {
+	casted, ok := content.Parsed.(*MarkerEventContent)
+	if !ok {
+		return &MarkerEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsSecretStorageDefaultKey() *SecretStorageDefaultKeyEventContent {
+	casted, ok := content.Parsed.(*SecretStorageDefaultKeyEventContent)
+	if !ok {
+		return &SecretStorageDefaultKeyEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsIdentityServer() *IdentityServerEventContent {
+	casted, ok := content.Parsed.(*IdentityServerEventContent)
+	if !ok {
+		return &IdentityServerEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsBreadcrumbs() *BreadcrumbsEventContent {
+	casted, ok := content.Parsed.(*BreadcrumbsEventContent)
+	if !ok {
+		return &BreadcrumbsEventContent{}
+	}
+	return casted
+}
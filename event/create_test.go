@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCreateEventContent_Defaults(t *testing.T) {
+	evt := parseEvent(t, `{"type":"m.room.create","state_key":"","content":{"creator":"@a:example.com"}}`)
+	content := evt.Content.AsCreate()
+	assert.True(t, content.IsFederated())
+	assert.Equal(t, id.RoomV1, content.GetRoomVersion())
+	assert.False(t, content.IsSpace())
+	assert.False(t, content.HasPredecessor())
+}
+
+func TestCreateEventContent_Upgraded(t *testing.T) {
+	evt := parseEvent(t, `{"type":"m.room.create","state_key":"","content":{
+		"room_version":"10",
+		"type":"m.space",
+		"m.federate":false,
+		"predecessor":{"room_id":"!old:example.com","event_id":"$tombstone"}
+	}}`)
+	content := evt.Content.AsCreate()
+	assert.False(t, content.IsFederated())
+	assert.False(t, content.Federate)
+	assert.Equal(t, id.RoomV10, content.GetRoomVersion())
+	assert.True(t, content.IsSpace())
+	require.True(t, content.HasPredecessor())
+	assert.Equal(t, id.RoomID("!old:example.com"), content.Predecessor.RoomID)
+	assert.Equal(t, id.EventID("$tombstone"), content.Predecessor.EventID)
+}
+
+func TestCreateEventContent_Marshal(t *testing.T) {
+	content := &event.CreateEventContent{RoomVersion: "9"}
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"room_version":"9"}`, string(data))
+	content.SetFederated(false)
+	data, err = json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"room_version":"9","m.federate":false}`, string(data))
+
+	// The deprecated Federate field is still respected if FederatePtr isn't set.
+	content = &event.CreateEventContent{Federate: true, Predecessor: event.Predecessor{RoomID: "!old:example.com"}}
+	data, err = json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"m.federate":true,"predecessor":{"room_id":"!old:example.com","event_id":""}}`, string(data))
+}
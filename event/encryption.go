@@ -21,6 +21,8 @@ type EncryptionEventContent struct {
 	RotationPeriodMillis int64 `json:"rotation_period_ms,omitempty"`
 	// How many messages should be sent before changing the session. 100 is the recommended default.
 	RotationPeriodMessages int `json:"rotation_period_msgs,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // EncryptedEventContent represents the content of a m.room.encrypted message event.
@@ -141,3 +143,28 @@ type RoomKeyWithheldEventContent struct {
 }
 
 type DummyEventContent struct{}
+
+type SecretRequestAction string
+
+const (
+	SecretRequestRequest      SecretRequestAction = "request"
+	SecretRequestCancellation SecretRequestAction = "request_cancellation"
+)
+
+// SecretRequestEventContent represents the content of a m.secret.request to_device event.
+// https://spec.matrix.org/v1.4/client-server-api/#msecretrequest
+type SecretRequestEventContent struct {
+	// The name of the secret that is being requested. Only present when the action is request.
+	Name               string              `json:"name,omitempty"`
+	Action             SecretRequestAction `json:"action"`
+	RequestingDeviceID id.DeviceID         `json:"requesting_device_id"`
+	RequestID          string              `json:"request_id"`
+}
+
+// SecretSendEventContent represents the content of a m.secret.send to_device event.
+// It must always be sent encrypted.
+// https://spec.matrix.org/v1.4/client-server-api/#msecretsend
+type SecretSendEventContent struct {
+	RequestID string `json:"request_id"`
+	Secret    string `json:"secret"`
+}
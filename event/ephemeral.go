@@ -23,11 +23,24 @@ type TypingEventContent struct {
 type ReceiptEventContent map[id.EventID]Receipts
 
 type Receipts struct {
-	Read map[id.UserID]ReadReceipt `json:"m.read"`
+	Read        map[id.UserID]ReadReceipt `json:"m.read,omitempty"`
+	ReadPrivate map[id.UserID]ReadReceipt `json:"m.read.private,omitempty"`
 }
 
+type ReceiptType string
+
+const (
+	ReceiptTypeRead        ReceiptType = "m.read"
+	ReceiptTypeReadPrivate ReceiptType = "m.read.private"
+)
+
+// ReceiptThreadMain is the thread ID used for receipts of events that aren't in any thread.
+const ReceiptThreadMain = "main"
+
 type ReadReceipt struct {
 	Timestamp int64 `json:"ts"`
+	// ThreadID is the thread the receipt is scoped to, or empty for unthreaded receipts.
+	ThreadID string `json:"thread_id,omitempty"`
 
 	// Extra contains any unknown fields in the read receipt event.
 	// Most servers don't allow clients to set them, so this will be empty in most cases.
@@ -52,9 +65,12 @@ func (rr *ReadReceipt) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	ts, _ := parsed["ts"].(float64)
+	threadID, _ := parsed["thread_id"].(string)
 	delete(parsed, "ts")
+	delete(parsed, "thread_id")
 	*rr = ReadReceipt{
 		Timestamp: int64(ts),
+		ThreadID:  threadID,
 		Extra:     parsed,
 	}
 	return nil
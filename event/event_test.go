@@ -0,0 +1,44 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// parseEvent parses a full event from JSON, including the content.
+func parseEvent(t *testing.T, data string) *event.Event {
+	var evt *event.Event
+	require.NoError(t, json.Unmarshal([]byte(data), &evt))
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	return evt
+}
+
+// makeEvent returns a copy of the given event with the given content. The content can either be
+// a JSON string or a value that is marshaled to JSON. Either way, it's parsed like a received event.
+func makeEvent(t *testing.T, evt event.Event, content interface{}) *event.Event {
+	data, ok := content.(string)
+	raw := []byte(data)
+	if !ok {
+		var err error
+		raw, err = json.Marshal(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, evt.Content.UnmarshalJSON(raw))
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	return &evt
+}
+
+// makeStateEvent is a shorthand for makeEvent with only the type and state key set.
+func makeStateEvent(t *testing.T, evtType event.Type, stateKey string, content interface{}) *event.Event {
+	return makeEvent(t, event.Event{Type: evtType, StateKey: &stateKey}, content)
+}
@@ -114,6 +114,17 @@ func (evt *Event) GetStateKey() string {
 	return ""
 }
 
+// GetRedactsID returns the ID of the event that a m.room.redaction event redacts.
+// The redacts field is in the content in room version 11 and later, and at the top level in older versions.
+func (evt *Event) GetRedactsID() id.EventID {
+	if parsed, ok := evt.Content.Parsed.(*RedactionEventContent); ok && len(parsed.Redacts) > 0 {
+		return parsed.Redacts
+	} else if redacts, ok := evt.Content.Raw["redacts"].(string); ok && len(redacts) > 0 {
+		return id.EventID(redacts)
+	}
+	return evt.Redacts
+}
+
 type StrippedState struct {
 	Content  Content `json:"content"`
 	Type     Type    `json:"type"`
@@ -134,5 +145,6 @@ type Unsigned struct {
 func (us *Unsigned) IsEmpty() bool {
 	return us.PrevContent == nil && us.PrevSender == "" && us.ReplacesState == "" && us.Age == 0 &&
 		us.TransactionID == "" && us.RedactedBecause == nil && us.InviteRoomState == nil && us.Relations.Raw == nil &&
-		us.Relations.Annotations.Map == nil && us.Relations.References.List == nil && us.Relations.Replaces.List == nil
+		us.Relations.Annotations.Map == nil && us.Relations.References.List == nil && us.Relations.Replaces.List == nil && us.Relations.Thread == nil &&
+		us.Relations.Replace == nil
 }
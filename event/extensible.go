@@ -0,0 +1,222 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// ExtensibleText is a single representation of text in an MSC1767 m.text block.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/1767
+type ExtensibleText struct {
+	Body     string `json:"body"`
+	MimeType string `json:"mimetype,omitempty"`
+}
+
+// ExtensibleTextContainer is an MSC1767 m.text block, which contains the same text in different formats.
+type ExtensibleTextContainer []ExtensibleText
+
+const mimeTypeHTML = "text/html"
+
+// MakeExtensibleText creates a m.text block with a plaintext and optionally a HTML representation.
+func MakeExtensibleText(plain, html string) ExtensibleTextContainer {
+	var container ExtensibleTextContainer
+	if len(html) > 0 {
+		container = append(container, ExtensibleText{Body: html, MimeType: mimeTypeHTML})
+	}
+	if len(plain) > 0 || len(container) == 0 {
+		container = append(container, ExtensibleText{Body: plain})
+	}
+	return container
+}
+
+func (etc ExtensibleTextContainer) find(mimeType string) (string, bool) {
+	for _, text := range etc {
+		if text.MimeType == mimeType || (mimeType == "text/plain" && len(text.MimeType) == 0) {
+			return text.Body, true
+		}
+	}
+	return "", false
+}
+
+// Plain returns the plaintext representation. If there isn't one, the first representation is returned.
+func (etc ExtensibleTextContainer) Plain() string {
+	if text, ok := etc.find("text/plain"); ok {
+		return text
+	} else if len(etc) > 0 {
+		return etc[0].Body
+	}
+	return ""
+}
+
+// HTML returns the HTML representation, or an empty string if there isn't one.
+func (etc ExtensibleTextContainer) HTML() string {
+	text, _ := etc.find(mimeTypeHTML)
+	return text
+}
+
+// ExtensibleFile is an MSC3551 m.file block.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3551
+type ExtensibleFile struct {
+	URL      id.ContentURIString `json:"url"`
+	Name     string              `json:"name,omitempty"`
+	MimeType string              `json:"mimetype,omitempty"`
+	Size     int                 `json:"size,omitempty"`
+
+	// Encryption info for encrypted files, in the same format as the file object of legacy messages.
+	// The URL inside it is the same as the outer URL.
+	File *EncryptedFileInfo `json:"file,omitempty"`
+}
+
+// ExtensibleImage is an MSC3552 m.image block.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3552
+type ExtensibleImage struct {
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// ExtensibleContent contains the MSC1767 content blocks of an event.
+type ExtensibleContent struct {
+	Text  ExtensibleTextContainer `json:"m.text,omitempty"`
+	File  *ExtensibleFile         `json:"m.file,omitempty"`
+	Image *ExtensibleImage        `json:"m.image,omitempty"`
+	Audio *MSC1767Audio           `json:"m.audio,omitempty"`
+
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+// RoomVersionRequiresExtensible returns whether the given room version only allows extensible events (MSC3932).
+func RoomVersionRequiresExtensible(roomVersion id.RoomVersion) bool {
+	return roomVersion.ExtensibleEvents()
+}
+
+// ParseExtensible finds the extensible content blocks in the given event content.
+//
+// If the content doesn't have a m.text block (i.e. it's a legacy m.room.message event), the blocks
+// are generated from the legacy fields instead. The content must either be parsed or contain raw JSON.
+func ParseExtensible(content *Content) *ExtensibleContent {
+	var ec ExtensibleContent
+	if content.VeryRaw != nil {
+		_ = json.Unmarshal(content.VeryRaw, &ec)
+	} else if content.Raw != nil {
+		data, _ := json.Marshal(content.Raw)
+		_ = json.Unmarshal(data, &ec)
+	}
+	if len(ec.Text) > 0 {
+		return &ec
+	}
+	msg, ok := content.Parsed.(*MessageEventContent)
+	if !ok {
+		msg = &MessageEventContent{}
+		if content.VeryRaw != nil && json.Unmarshal(content.VeryRaw, msg) != nil {
+			return &ec
+		}
+	}
+	return ExtensibleFromLegacy(msg)
+}
+
+// ExtensibleFromLegacy converts a legacy m.room.message content into extensible content blocks.
+func ExtensibleFromLegacy(msg *MessageEventContent) *ExtensibleContent {
+	ec := &ExtensibleContent{RelatesTo: msg.RelatesTo}
+	html := ""
+	if msg.Format == FormatHTML {
+		html = msg.FormattedBody
+	}
+	ec.Text = MakeExtensibleText(msg.Body, html)
+	switch msg.MsgType {
+	case MsgImage, MsgFile, MsgAudio, MsgVideo:
+		ec.File = &ExtensibleFile{URL: msg.URL, Name: msg.Body, File: msg.File}
+		if msg.File != nil {
+			ec.File.URL = msg.File.URL
+		}
+		if msg.Info != nil {
+			ec.File.MimeType = msg.Info.MimeType
+			ec.File.Size = msg.Info.Size
+			if msg.MsgType == MsgImage {
+				ec.Image = &ExtensibleImage{Width: msg.Info.Width, Height: msg.Info.Height}
+			}
+		}
+		if msg.MsgType == MsgAudio {
+			ec.Audio = msg.MSC1767Audio
+		}
+	}
+	return ec
+}
+
+// ToLegacy renders the extensible content as a legacy m.room.message for clients that don't support extensible events.
+func (ec *ExtensibleContent) ToLegacy() *MessageEventContent {
+	msg := &MessageEventContent{
+		MsgType:   MsgText,
+		Body:      ec.Text.Plain(),
+		RelatesTo: ec.RelatesTo,
+	}
+	if html := ec.Text.HTML(); len(html) > 0 {
+		msg.Format = FormatHTML
+		msg.FormattedBody = html
+	}
+	if ec.File != nil {
+		msg.MsgType = MsgFile
+		if ec.Image != nil {
+			msg.MsgType = MsgImage
+		} else if ec.Audio != nil {
+			msg.MsgType = MsgAudio
+			msg.MSC1767Audio = ec.Audio
+		}
+		if len(ec.File.Name) > 0 && len(msg.Body) == 0 {
+			msg.Body = ec.File.Name
+		}
+		if ec.File.File != nil {
+			// Copy the encryption info so that setting the URL doesn't modify the extensible content.
+			file := *ec.File.File
+			file.URL = ec.File.URL
+			msg.File = &file
+		} else {
+			msg.URL = ec.File.URL
+		}
+		msg.Info = &FileInfo{MimeType: ec.File.MimeType, Size: ec.File.Size}
+		if ec.Image != nil {
+			msg.Info.Width = ec.Image.Width
+			msg.Info.Height = ec.Image.Height
+		}
+		if ec.Audio != nil {
+			msg.Info.Duration = ec.Audio.Duration
+		}
+	}
+	return msg
+}
+
+// EventType returns the extensible event type that matches the primary block of the content.
+func (ec *ExtensibleContent) EventType() Type {
+	switch {
+	case ec.Image != nil:
+		return EventExtensibleImage
+	case ec.Audio != nil && ec.File != nil:
+		return EventExtensibleAudio
+	case ec.File != nil:
+		return EventExtensibleFile
+	default:
+		return EventExtensibleMessage
+	}
+}
+
+// ToEvent returns the event type and content to send in a room with the given version.
+//
+// If the room version requires extensible events, only the extensible blocks are sent. Otherwise, a m.room.message
+// event is sent with mixed content: the legacy fields for old clients and the extensible blocks for new ones.
+func (ec *ExtensibleContent) ToEvent(roomVersion id.RoomVersion) (Type, *Content) {
+	if RoomVersionRequiresExtensible(roomVersion) {
+		return ec.EventType(), &Content{Parsed: ec}
+	}
+	var blocks map[string]interface{}
+	data, err := json.Marshal(ec)
+	if err == nil {
+		_ = json.Unmarshal(data, &blocks)
+	}
+	return EventMessage, &Content{Parsed: ec.ToLegacy(), Raw: blocks}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const mixedImageEvent = `{
+	"type": "m.room.message",
+	"event_id": "$image",
+	"content": {
+		"msgtype": "m.image",
+		"body": "cat.png",
+		"url": "mxc://example.com/legacy",
+		"m.text": [{"mimetype": "text/html", "body": "<b>cat.png</b>"}, {"body": "cat.png"}],
+		"m.file": {"url": "mxc://example.com/cat", "name": "cat.png", "mimetype": "image/png", "size": 1234},
+		"m.image": {"width": 640, "height": 480}
+	}
+}`
+
+func TestParseExtensible_Mixed(t *testing.T) {
+	evt := parseEvent(t, mixedImageEvent)
+	ec := event.ParseExtensible(&evt.Content)
+	assert.Equal(t, "cat.png", ec.Text.Plain())
+	assert.Equal(t, "<b>cat.png</b>", ec.Text.HTML())
+	require.NotNil(t, ec.File)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/cat"), ec.File.URL)
+	assert.Equal(t, 1234, ec.File.Size)
+	require.NotNil(t, ec.Image)
+	assert.Equal(t, 640, ec.Image.Width)
+	assert.Equal(t, event.EventExtensibleImage, ec.EventType())
+}
+
+func TestParseExtensible_Legacy(t *testing.T) {
+	evt := parseEvent(t, `{"type": "m.room.message", "content": {"msgtype": "m.text", "body": "hi", "format": "org.matrix.custom.html", "formatted_body": "<i>hi</i>"}}`)
+	ec := event.ParseExtensible(&evt.Content)
+	assert.Equal(t, "hi", ec.Text.Plain())
+	assert.Equal(t, "<i>hi</i>", ec.Text.HTML())
+	assert.Nil(t, ec.File)
+	assert.Equal(t, event.EventExtensibleMessage, ec.EventType())
+}
+
+func TestExtensibleContent_ToEvent(t *testing.T) {
+	ec := &event.ExtensibleContent{
+		Text:  event.MakeExtensibleText("cat.png", ""),
+		File:  &event.ExtensibleFile{URL: "mxc://example.com/cat", MimeType: "image/png", Size: 1234},
+		Image: &event.ExtensibleImage{Width: 640, Height: 480},
+	}
+
+	evtType, content := ec.ToEvent("9")
+	assert.Equal(t, event.EventMessage, evtType)
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	var mixed map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &mixed))
+	assert.Equal(t, "m.image", mixed["msgtype"])
+	assert.Equal(t, "cat.png", mixed["body"])
+	assert.Equal(t, "mxc://example.com/cat", mixed["url"])
+	assert.Contains(t, mixed, "m.file")
+	assert.Contains(t, mixed, "m.image")
+
+	evtType, content = ec.ToEvent("org.matrix.msc1767.10")
+	assert.Equal(t, event.EventExtensibleImage, evtType)
+	data, err = json.Marshal(content)
+	require.NoError(t, err)
+	var extensible map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &extensible))
+	assert.NotContains(t, extensible, "msgtype")
+	assert.Contains(t, extensible, "m.text")
+}
+
+func TestExtensibleFile_Encrypted(t *testing.T) {
+	evt := parseEvent(t, `{"type": "m.room.message", "content": {
+		"m.text": [{"body": "secret.txt"}],
+		"m.file": {"url": "mxc://example.com/secret", "name": "secret.txt", "file": {
+			"url": "mxc://example.com/secret",
+			"key": {"kty": "oct", "key_ops": ["encrypt", "decrypt"], "alg": "A256CTR", "k": "key", "ext": true},
+			"iv": "iv", "hashes": {"sha256": "hash"}, "v": "v2"
+		}}
+	}}`)
+	ec := event.ParseExtensible(&evt.Content)
+	require.NotNil(t, ec.File)
+	require.NotNil(t, ec.File.File)
+	assert.Equal(t, "key", ec.File.File.Key.Key)
+	assert.Equal(t, "iv", ec.File.File.InitVector)
+
+	data, err := json.Marshal(ec)
+	require.NoError(t, err)
+	var reparsed event.ExtensibleContent
+	require.NoError(t, json.Unmarshal(data, &reparsed))
+	require.NotNil(t, reparsed.File.File)
+	assert.Equal(t, *ec.File.File, *reparsed.File.File)
+
+	ec.File.File.URL = ""
+	msg := ec.ToLegacy()
+	require.NotNil(t, msg.File)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/secret"), msg.File.URL)
+	assert.Empty(t, msg.URL)
+	assert.Empty(t, ec.File.File.URL, "ToLegacy must not modify the extensible content")
+}
@@ -0,0 +1,608 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var knownFieldsCache sync.Map
+
+// jsonFields contains the JSON keys that a struct type handles itself, mapped to the index path of the struct field.
+type jsonFields struct {
+	exact map[string][]int
+	// Keys lowercased for case-insensitive matching, like encoding/json does when there's no exact match.
+	folded map[string][]int
+}
+
+func (jf *jsonFields) find(key string) ([]int, bool) {
+	index, ok := jf.exact[key]
+	if !ok {
+		index, ok = jf.folded[strings.ToLower(key)]
+	}
+	return index, ok
+}
+
+// knownJSONFields returns the JSON keys that the given struct type handles itself.
+func knownJSONFields(structType reflect.Type) *jsonFields {
+	if cached, ok := knownFieldsCache.Load(structType); ok {
+		return cached.(*jsonFields)
+	}
+	fields := &jsonFields{exact: make(map[string][]int), folded: make(map[string][]int)}
+	collectJSONFields(structType, nil, fields)
+	knownFieldsCache.Store(structType, fields)
+	return fields
+}
+
+func collectJSONFields(structType reflect.Type, parentIndex []int, into *jsonFields) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		index := append(append([]int{}, parentIndex...), i)
+		tag := field.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name == "-" && len(tag) == 1 {
+			continue
+		} else if field.Anonymous && len(name) == 0 {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				collectJSONFields(embedded, index, into)
+				continue
+			}
+		} else if len(field.PkgPath) > 0 {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		// Fields of the outer struct take precedence over fields of embedded structs.
+		if _, exists := into.exact[name]; !exists || len(index) < len(into.exact[name]) {
+			into.exact[name] = index
+			into.folded[strings.ToLower(name)] = index
+		}
+	}
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but allocates nil embedded struct pointers along the way.
+func fieldByIndex(val reflect.Value, index []int) reflect.Value {
+	for i, fieldIndex := range index {
+		if i > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				val.Set(reflect.New(val.Type().Elem()))
+			}
+			val = val.Elem()
+		}
+		val = val.Field(fieldIndex)
+	}
+	return val
+}
+
+// unmarshalWithExtra unmarshals data into the given struct pointer and returns the fields that the struct doesn't know.
+// The struct pointer must be of a type without a custom UnmarshalJSON method to avoid infinite recursion.
+//
+// The top-level object is only parsed once: known keys are decoded directly into their struct fields
+// and the rest are returned as-is.
+func unmarshalWithExtra(data []byte, into interface{}) (map[string]json.RawMessage, error) {
+	var allFields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &allFields); err != nil {
+		return nil, err
+	}
+	structVal := reflect.ValueOf(into).Elem()
+	known := knownJSONFields(structVal.Type())
+	var extra map[string]json.RawMessage
+	var typeErr error
+	for key, value := range allFields {
+		index, isKnown := known.find(key)
+		if !isKnown {
+			if extra == nil {
+				extra = make(map[string]json.RawMessage)
+			}
+			extra[key] = value
+			continue
+		}
+		field := fieldByIndex(structVal, index)
+		err := json.Unmarshal(value, field.Addr().Interface())
+		var fieldTypeErr *json.UnmarshalTypeError
+		if errors.As(err, &fieldTypeErr) {
+			// Like encoding/json, keep decoding the other fields and return the first type error at the end.
+			if len(fieldTypeErr.Field) > 0 {
+				fieldTypeErr.Field = key + "." + fieldTypeErr.Field
+			} else {
+				fieldTypeErr.Field = key
+			}
+			if typeErr == nil {
+				typeErr = fieldTypeErr
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return extra, typeErr
+}
+
+// marshalWithExtra marshals the given struct and appends the given extra fields to the output.
+// Extra fields with a key that the struct knows are ignored even if the struct field is omitted,
+// so that Extra can't override or duplicate typed fields.
+func marshalWithExtra(from interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(from)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	known := knownJSONFields(reflect.Indirect(reflect.ValueOf(from)).Type())
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		if _, isKnown := known.exact[key]; !isKnown {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return data, nil
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	// Strip the closing brace and append the extra keys before adding it back.
+	buf.Write(data[:len(data)-1])
+	needComma := len(data) > 2
+	for _, key := range keys {
+		if needComma {
+			buf.WriteByte(',')
+		}
+		needComma = true
+		keyData, _ := json.Marshal(key)
+		buf.Write(keyData)
+		buf.WriteByte(':')
+		if err = json.Compact(&buf, extra[key]); err != nil {
+			return nil, fmt.Errorf("invalid extra field %s: %w", key, err)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type serializableMessageEventContent MessageEventContent
+
+func (content *MessageEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableMessageEventContent)(content))
+	if err != nil {
+		return
+	}
+	content.Custom, err = parseCustomMessageType(content.MsgType, data)
+	return
+}
+
+func (content MessageEventContent) MarshalJSON() ([]byte, error) {
+	extra, err := mergeCustomFields(content.Custom, content.Extra)
+	if err != nil {
+		return nil, err
+	}
+	return marshalWithExtra(serializableMessageEventContent(content), extra)
+}
+
+type serializableReactionEventContent ReactionEventContent
+
+func (content *ReactionEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableReactionEventContent)(content))
+	return
+}
+
+func (content ReactionEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableReactionEventContent(content), content.Extra)
+}
+
+type serializableMemberEventContent MemberEventContent
+
+func (content *MemberEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableMemberEventContent)(content))
+	return
+}
+
+func (content MemberEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableMemberEventContent(content), content.Extra)
+}
+
+type serializableRedactionEventContent RedactionEventContent
+
+func (content *RedactionEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableRedactionEventContent)(content))
+	return
+}
+
+func (content RedactionEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableRedactionEventContent(content), content.Extra)
+}
+
+type serializableCanonicalAliasEventContent CanonicalAliasEventContent
+
+func (content *CanonicalAliasEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCanonicalAliasEventContent)(content))
+	return
+}
+
+func (content CanonicalAliasEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCanonicalAliasEventContent(content), content.Extra)
+}
+
+type serializableRoomNameEventContent RoomNameEventContent
+
+func (content *RoomNameEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableRoomNameEventContent)(content))
+	return
+}
+
+func (content RoomNameEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableRoomNameEventContent(content), content.Extra)
+}
+
+type serializableRoomAvatarEventContent RoomAvatarEventContent
+
+func (content *RoomAvatarEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableRoomAvatarEventContent)(content))
+	return
+}
+
+func (content RoomAvatarEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableRoomAvatarEventContent(content), content.Extra)
+}
+
+type serializableServerACLEventContent ServerACLEventContent
+
+func (content *ServerACLEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableServerACLEventContent)(content))
+	return
+}
+
+func (content ServerACLEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableServerACLEventContent(content), content.Extra)
+}
+
+type serializableTopicEventContent TopicEventContent
+
+func (content *TopicEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableTopicEventContent)(content))
+	return
+}
+
+func (content TopicEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableTopicEventContent(content), content.Extra)
+}
+
+type serializableTombstoneEventContent TombstoneEventContent
+
+func (content *TombstoneEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableTombstoneEventContent)(content))
+	return
+}
+
+func (content TombstoneEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableTombstoneEventContent(content), content.Extra)
+}
+
+type serializableCreateEventContent CreateEventContent
+
+func (content *CreateEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCreateEventContent)(content))
+	content.Federate = content.FederatePtr != nil && *content.FederatePtr
+	return
+}
+
+// marshalableCreateEventContent overrides the fields of CreateEventContent that need to be omitted when empty.
+type marshalableCreateEventContent struct {
+	serializableCreateEventContent
+	FederatePtr *bool        `json:"m.federate,omitempty"`
+	Predecessor *Predecessor `json:"predecessor,omitempty"`
+}
+
+func (content CreateEventContent) MarshalJSON() ([]byte, error) {
+	output := marshalableCreateEventContent{
+		serializableCreateEventContent: serializableCreateEventContent(content),
+		FederatePtr:                    content.FederatePtr,
+	}
+	if output.FederatePtr == nil && content.Federate {
+		output.FederatePtr = &content.Federate
+	}
+	if len(content.Predecessor.RoomID) > 0 {
+		output.Predecessor = &content.Predecessor
+	}
+	return marshalWithExtra(output, content.Extra)
+}
+
+type serializableJoinRulesEventContent JoinRulesEventContent
+
+func (content *JoinRulesEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableJoinRulesEventContent)(content))
+	return
+}
+
+func (content JoinRulesEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableJoinRulesEventContent(content), content.Extra)
+}
+
+type serializablePinnedEventsEventContent PinnedEventsEventContent
+
+func (content *PinnedEventsEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializablePinnedEventsEventContent)(content))
+	return
+}
+
+func (content PinnedEventsEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializablePinnedEventsEventContent(content), content.Extra)
+}
+
+type serializableHistoryVisibilityEventContent HistoryVisibilityEventContent
+
+func (content *HistoryVisibilityEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableHistoryVisibilityEventContent)(content))
+	return
+}
+
+func (content HistoryVisibilityEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableHistoryVisibilityEventContent(content), content.Extra)
+}
+
+type serializableGuestAccessEventContent GuestAccessEventContent
+
+func (content *GuestAccessEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableGuestAccessEventContent)(content))
+	return
+}
+
+func (content GuestAccessEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableGuestAccessEventContent(content), content.Extra)
+}
+
+type serializableBridgeEventContent BridgeEventContent
+
+func (content *BridgeEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableBridgeEventContent)(content))
+	return
+}
+
+func (content BridgeEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableBridgeEventContent(content), content.Extra)
+}
+
+type serializableSpaceChildEventContent SpaceChildEventContent
+
+func (content *SpaceChildEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableSpaceChildEventContent)(content))
+	return
+}
+
+func (content SpaceChildEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableSpaceChildEventContent(content), content.Extra)
+}
+
+type serializableSpaceParentEventContent SpaceParentEventContent
+
+func (content *SpaceParentEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableSpaceParentEventContent)(content))
+	return
+}
+
+func (content SpaceParentEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableSpaceParentEventContent(content), content.Extra)
+}
+
+type serializableModPolicyContent ModPolicyContent
+
+func (content *ModPolicyContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableModPolicyContent)(content))
+	return
+}
+
+func (content ModPolicyContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableModPolicyContent(content), content.Extra)
+}
+
+type serializableEncryptionEventContent EncryptionEventContent
+
+func (content *EncryptionEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableEncryptionEventContent)(content))
+	return
+}
+
+func (content EncryptionEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableEncryptionEventContent(content), content.Extra)
+}
+
+type serializableBeaconInfoEventContent BeaconInfoEventContent
+
+func (content *BeaconInfoEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableBeaconInfoEventContent)(content))
+	return
+}
+
+func (content BeaconInfoEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableBeaconInfoEventContent(content), content.Extra)
+}
+
+type serializableBeaconEventContent BeaconEventContent
+
+func (content *BeaconEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableBeaconEventContent)(content))
+	return
+}
+
+func (content BeaconEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableBeaconEventContent(content), content.Extra)
+}
+
+type serializableGroupCallEventContent GroupCallEventContent
+
+func (content *GroupCallEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableGroupCallEventContent)(content))
+	return
+}
+
+func (content GroupCallEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableGroupCallEventContent(content), content.Extra)
+}
+
+type serializableGroupCallMemberEventContent GroupCallMemberEventContent
+
+func (content *GroupCallMemberEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableGroupCallMemberEventContent)(content))
+	return
+}
+
+func (content GroupCallMemberEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableGroupCallMemberEventContent(content), content.Extra)
+}
+
+type serializableWidgetEventContent WidgetEventContent
+
+func (content *WidgetEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableWidgetEventContent)(content))
+	return
+}
+
+func (content WidgetEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableWidgetEventContent(content), content.Extra)
+}
+
+type serializableImagePackEventContent ImagePackEventContent
+
+func (content *ImagePackEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableImagePackEventContent)(content))
+	return
+}
+
+func (content ImagePackEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableImagePackEventContent(content), content.Extra)
+}
+
+type serializableInsertionEventContent InsertionEventContent
+
+func (content *InsertionEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableInsertionEventContent)(content))
+	return
+}
+
+func (content InsertionEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableInsertionEventContent(content), content.Extra)
+}
+
+type serializableBatchEventContent BatchEventContent
+
+func (content *BatchEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableBatchEventContent)(content))
+	return
+}
+
+func (content BatchEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableBatchEventContent(content), content.Extra)
+}
+
+type serializableMarkerEventContent MarkerEventContent
+
+func (content *MarkerEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableMarkerEventContent)(content))
+	return
+}
+
+func (content MarkerEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableMarkerEventContent(content), content.Extra)
+}
+
+type serializableCallInviteEventContent CallInviteEventContent
+
+func (content *CallInviteEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCallInviteEventContent)(content))
+	return
+}
+
+func (content CallInviteEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCallInviteEventContent(content), content.Extra)
+}
+
+type serializableCallCandidatesEventContent CallCandidatesEventContent
+
+func (content *CallCandidatesEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCallCandidatesEventContent)(content))
+	return
+}
+
+func (content CallCandidatesEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCallCandidatesEventContent(content), content.Extra)
+}
+
+type serializableCallRejectEventContent CallRejectEventContent
+
+func (content *CallRejectEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCallRejectEventContent)(content))
+	return
+}
+
+func (content CallRejectEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCallRejectEventContent(content), content.Extra)
+}
+
+type serializableCallAnswerEventContent CallAnswerEventContent
+
+func (content *CallAnswerEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCallAnswerEventContent)(content))
+	return
+}
+
+func (content CallAnswerEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCallAnswerEventContent(content), content.Extra)
+}
+
+type serializableCallSelectAnswerEventContent CallSelectAnswerEventContent
+
+func (content *CallSelectAnswerEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCallSelectAnswerEventContent)(content))
+	return
+}
+
+func (content CallSelectAnswerEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCallSelectAnswerEventContent(content), content.Extra)
+}
+
+type serializableCallNegotiateEventContent CallNegotiateEventContent
+
+func (content *CallNegotiateEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCallNegotiateEventContent)(content))
+	return
+}
+
+func (content CallNegotiateEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCallNegotiateEventContent(content), content.Extra)
+}
+
+type serializableCallHangupEventContent CallHangupEventContent
+
+func (content *CallHangupEventContent) UnmarshalJSON(data []byte) (err error) {
+	content.Extra, err = unmarshalWithExtra(data, (*serializableCallHangupEventContent)(content))
+	return
+}
+
+func (content CallHangupEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(serializableCallHangupEventContent(content), content.Extra)
+}
+
+type serializablePowerLevelsEventContent PowerLevelsEventContent
+
+func (pl *PowerLevelsEventContent) UnmarshalJSON(data []byte) (err error) {
+	pl.Extra, err = unmarshalWithExtra(data, (*serializablePowerLevelsEventContent)(pl))
+	return
+}
+
+// MarshalJSON has a pointer receiver, as the power level content contains locks and must not be copied.
+func (pl *PowerLevelsEventContent) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra((*serializablePowerLevelsEventContent)(pl), pl.Extra)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestExtra_StateContent(t *testing.T) {
+	evt := parseEvent(t, `{"type": "m.room.topic", "state_key": "", "content": {"topic": "meow", "com.example.topic_source": "irc"}}`)
+	content := evt.Content.AsTopic()
+	assert.Equal(t, "meow", content.Topic)
+	assert.JSONEq(t, `"irc"`, string(content.Extra["com.example.topic_source"]))
+
+	// Extra fields must survive marshaling both pointers and values.
+	output, err := json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"topic": "meow", "com.example.topic_source": "irc"}`, string(output))
+	output, err = json.Marshal(*content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"topic": "meow", "com.example.topic_source": "irc"}`, string(output))
+	output, err = json.Marshal(map[string]interface{}{"content": *content})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"content": {"topic": "meow", "com.example.topic_source": "irc"}}`, string(output))
+}
+
+func TestExtra_EmbeddedFields(t *testing.T) {
+	var content event.CallHangupEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"call_id": "1234", "version": "1", "party_id": "abc", "reason": "user_hangup", "com.example.custom": true}`), &content))
+	assert.Equal(t, "1234", content.CallID)
+	assert.Equal(t, "abc", content.PartyID)
+	assert.Len(t, content.Extra, 1)
+	output, err := json.Marshal(&content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"call_id": "1234", "version": "1", "party_id": "abc", "reason": "user_hangup", "com.example.custom": true}`, string(output))
+}
+
+func TestExtra_PowerLevels(t *testing.T) {
+	var content event.PowerLevelsEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"users": {"@alice:example.com": 100}, "com.example.custom": 1}`), &content))
+	assert.Equal(t, 100, content.GetUserLevel("@alice:example.com"))
+	output, err := json.Marshal(&content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"users": {"@alice:example.com": 100}, "com.example.custom": 1}`, string(output))
+}
+
+func TestExtra_KnownFieldsTakePrecedence(t *testing.T) {
+	content := event.RoomNameEventContent{
+		Name: "real",
+		Extra: map[string]json.RawMessage{
+			"name":  json.RawMessage(`"fake"`),
+			"other": json.RawMessage(`[1, 2, 3]`),
+		},
+	}
+	output, err := json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "real", "other": [1, 2, 3]}`, string(output))
+
+	content.Extra["broken"] = json.RawMessage(`{`)
+	_, err = json.Marshal(content)
+	assert.Error(t, err)
+}
+
+func TestExtra_TypeError(t *testing.T) {
+	var content event.TopicEventContent
+	err := json.Unmarshal([]byte(`{"topic": 123}`), &content)
+	var typeErr *json.UnmarshalTypeError
+	require.ErrorAs(t, err, &typeErr)
+	assert.Equal(t, "topic", typeErr.Field)
+
+	var member event.MemberEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"Membership": "join"}`), &member), "keys should be matched case-insensitively like encoding/json")
+	assert.Equal(t, event.MembershipJoin, member.Membership)
+	assert.Empty(t, member.Extra)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ContentAs returns the content parsed into the given struct type.
+//
+// If the content has already been parsed into T, the existing parsed struct is returned. If the content hasn't
+// been parsed at all, it's parsed into a new T, which is then cached in the Parsed field. If the content has been
+// parsed into some other type, the raw content is parsed into a new T without modifying the Parsed field.
+//
+// Unlike ParseRaw, this works with any struct type, including ones that aren't registered in TypeMap.
+func ContentAs[T any](content *Content) (*T, error) {
+	if casted, ok := content.Parsed.(*T); ok {
+		return casted, nil
+	}
+	data := []byte(content.VeryRaw)
+	if data == nil {
+		var err error
+		data, err = content.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal content: %w", err)
+		}
+	}
+	var parsed T
+	err := json.Unmarshal(data, &parsed)
+	if err != nil {
+		return nil, err
+	}
+	if content.Parsed == nil {
+		content.Parsed = &parsed
+	}
+	return &parsed, nil
+}
+
+// ContentAsOrEmpty is like ContentAs, but returns a pointer to an empty T if parsing fails,
+// similar to the AsMessage/AsMember/etc helper methods of Content.
+func ContentAsOrEmpty[T any](content *Content) *T {
+	parsed, err := ContentAs[T](content)
+	if err != nil {
+		return new(T)
+	}
+	return parsed
+}
+
+// GetContentAs returns the content of the event parsed into the given struct type. See ContentAs for details.
+func GetContentAs[T any](evt *Event) (*T, error) {
+	return ContentAs[T](&evt.Content)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestGetContentAs(t *testing.T) {
+	var evt event.Event
+	require.NoError(t, json.Unmarshal([]byte(`{"type": "m.room.message", "content": {"msgtype": "m.text", "body": "hi"}}`), &evt))
+	content, err := event.GetContentAs[event.MessageEventContent](&evt)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", content.Body)
+	// The parsed content is cached and returned as-is on the next call
+	assert.Same(t, content, evt.Content.Parsed)
+	again, err := event.GetContentAs[event.MessageEventContent](&evt)
+	require.NoError(t, err)
+	assert.Same(t, content, again)
+
+	// Parsing into another type doesn't replace the cached content
+	custom, err := event.GetContentAs[customEventContent](&evt)
+	require.NoError(t, err)
+	assert.Equal(t, 0, custom.Counter)
+	assert.Same(t, content, evt.Content.Parsed)
+}
+
+func TestContentAs_Unparsed(t *testing.T) {
+	content := event.Content{Raw: map[string]interface{}{"counter": 3}}
+	parsed, err := event.ContentAs[customEventContent](&content)
+	require.NoError(t, err)
+	assert.Equal(t, 3, parsed.Counter)
+
+	invalid := event.Content{VeryRaw: json.RawMessage(`{"counter": "three"}`)}
+	_, err = event.ContentAs[customEventContent](&invalid)
+	assert.Error(t, err)
+	assert.NotNil(t, event.ContentAsOrEmpty[customEventContent](&invalid))
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+	"sort"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// ImagePackUsage specifies what images in an image pack can be used for.
+type ImagePackUsage string
+
+const (
+	ImagePackUsageEmoticon ImagePackUsage = "emoticon"
+	ImagePackUsageSticker  ImagePackUsage = "sticker"
+)
+
+// ImagePackImage is a single image in an image pack.
+type ImagePackImage struct {
+	URL  id.ContentURIString `json:"url"`
+	Body string              `json:"body,omitempty"`
+	Info *FileInfo           `json:"info,omitempty"`
+	// What the image can be used for. If empty, the usage of the pack is used.
+	Usage []ImagePackUsage `json:"usage,omitempty"`
+}
+
+// ImagePackInfo is the metadata of an image pack.
+type ImagePackInfo struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	// What the images in the pack can be used for. If empty, they can be used as both emoticons and stickers.
+	Usage       []ImagePackUsage `json:"usage,omitempty"`
+	Attribution string           `json:"attribution,omitempty"`
+}
+
+// ImagePackEventContent represents the content of an im.ponies.room_emotes state event
+// or an im.ponies.user_emotes account data event. The state key of room packs is the pack ID.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2545
+type ImagePackEventContent struct {
+	Images map[string]*ImagePackImage `json:"images"`
+	Pack   ImagePackInfo              `json:"pack"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// ImagePackRoomsEventContent represents the content of an im.ponies.emote_rooms account data event,
+// which lists the room image packs that the user has enabled globally.
+type ImagePackRoomsEventContent struct {
+	// Map from room ID to pack state key to arbitrary data (currently always an empty object).
+	Rooms map[id.RoomID]map[string]struct{} `json:"rooms"`
+}
+
+func usageContains(usage []ImagePackUsage, target ImagePackUsage) bool {
+	for _, item := range usage {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
+
+// CanBeUsedAs returns whether the image in the given pack can be used for the given purpose.
+func (img *ImagePackImage) CanBeUsedAs(pack *ImagePackEventContent, usage ImagePackUsage) bool {
+	effectiveUsage := img.Usage
+	if len(effectiveUsage) == 0 {
+		effectiveUsage = pack.Pack.Usage
+	}
+	return len(effectiveUsage) == 0 || usageContains(effectiveUsage, usage)
+}
+
+// ShortcodesFor returns the sorted shortcodes of images in the pack that can be used for the given purpose.
+func (content *ImagePackEventContent) ShortcodesFor(usage ImagePackUsage) []string {
+	shortcodes := make([]string, 0, len(content.Images))
+	for shortcode, img := range content.Images {
+		if img != nil && img.CanBeUsedAs(content, usage) {
+			shortcodes = append(shortcodes, shortcode)
+		}
+	}
+	sort.Strings(shortcodes)
+	return shortcodes
+}
+
+// Get returns the image with the given shortcode if it can be used for the given purpose.
+func (content *ImagePackEventContent) Get(shortcode string, usage ImagePackUsage) *ImagePackImage {
+	img, ok := content.Images[shortcode]
+	if !ok || img == nil || !img.CanBeUsedAs(content, usage) {
+		return nil
+	}
+	return img
+}
+
+// ResolveImageShortcode finds the image with the given shortcode from the given packs. Earlier packs take priority,
+// so the user's own pack should usually be first, followed by the packs of the current room and global room packs.
+func ResolveImageShortcode(shortcode string, usage ImagePackUsage, packs ...*ImagePackEventContent) *ImagePackImage {
+	for _, pack := range packs {
+		if pack == nil {
+			continue
+		}
+		if img := pack.Get(shortcode, usage); img != nil {
+			return img
+		}
+	}
+	return nil
+}
+
+// ToSticker creates the content for a m.sticker event that sends the image. If the image doesn't have a body,
+// the shortcode is used as the body.
+func (img *ImagePackImage) ToSticker(shortcode string) *MessageEventContent {
+	body := img.Body
+	if len(body) == 0 {
+		body = shortcode
+	}
+	return NewStickerContent(body, img.URL, img.Info)
+}
+
+// NewStickerContent creates the content for a m.sticker event.
+// https://spec.matrix.org/v1.4/client-server-api/#msticker
+func NewStickerContent(body string, url id.ContentURIString, info *FileInfo) *MessageEventContent {
+	if info == nil {
+		info = &FileInfo{}
+	}
+	return &MessageEventContent{
+		Body: body,
+		URL:  url,
+		Info: info,
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const roomImagePack = `{
+	"type": "im.ponies.room_emotes",
+	"state_key": "cats",
+	"event_id": "$pack",
+	"sender": "@a:example.com",
+	"content": {
+		"pack": {"display_name": "Cats", "usage": ["sticker"]},
+		"images": {
+			"happycat": {"url": "mxc://example.com/happy", "body": "Happy cat", "info": {"mimetype": "image/png", "w": 256, "h": 256}},
+			"blobcat": {"url": "mxc://example.com/blob", "usage": ["emoticon", "sticker"]},
+			"tinycat": {"url": "mxc://example.com/tiny", "usage": ["emoticon"]}
+		}
+	}
+}`
+
+func TestImagePack(t *testing.T) {
+	evt := parseEvent(t, roomImagePack)
+	pack := evt.Content.AsImagePack()
+	assert.Equal(t, "Cats", pack.Pack.DisplayName)
+	assert.Equal(t, []string{"blobcat", "happycat"}, pack.ShortcodesFor(event.ImagePackUsageSticker))
+	assert.Equal(t, []string{"blobcat", "tinycat"}, pack.ShortcodesFor(event.ImagePackUsageEmoticon))
+
+	userPack := &event.ImagePackEventContent{Images: map[string]*event.ImagePackImage{
+		"happycat": {URL: "mxc://example.com/myhappy"},
+	}}
+	img := event.ResolveImageShortcode("happycat", event.ImagePackUsageSticker, userPack, pack)
+	require.NotNil(t, img)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/myhappy"), img.URL)
+	assert.Nil(t, event.ResolveImageShortcode("tinycat", event.ImagePackUsageSticker, userPack, pack))
+
+	sticker := pack.Get("happycat", event.ImagePackUsageSticker).ToSticker("happycat")
+	assert.Equal(t, "Happy cat", sticker.Body)
+	assert.Equal(t, 256, sticker.Info.Width)
+	assert.Empty(t, sticker.MsgType)
+}
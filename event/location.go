@@ -0,0 +1,218 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrInvalidGeoURI = errors.New("invalid geo URI")
+
+// GeoURI is a parsed RFC 5870 geo URI, e.g. geo:60.1699,24.9384;u=35
+type GeoURI struct {
+	Latitude  float64
+	Longitude float64
+	// Altitude is optional and only included if HasAltitude is true.
+	Altitude    float64
+	HasAltitude bool
+	// Uncertainty of the location in meters. Zero means unknown.
+	Uncertainty float64
+}
+
+// ParseGeoURI parses a geo URI. Only the WGS-84 coordinate system is supported.
+func ParseGeoURI(uri string) (*GeoURI, error) {
+	if !strings.HasPrefix(strings.ToLower(uri), "geo:") {
+		return nil, fmt.Errorf("%w: missing geo: prefix", ErrInvalidGeoURI)
+	}
+	parts := strings.Split(uri[len("geo:"):], ";")
+	coordinates := strings.Split(parts[0], ",")
+	if len(coordinates) != 2 && len(coordinates) != 3 {
+		return nil, fmt.Errorf("%w: expected 2 or 3 coordinates, got %d", ErrInvalidGeoURI, len(coordinates))
+	}
+	var geo GeoURI
+	var err error
+	if geo.Latitude, err = strconv.ParseFloat(coordinates[0], 64); err != nil || geo.Latitude < -90 || geo.Latitude > 90 {
+		return nil, fmt.Errorf("%w: invalid latitude %q", ErrInvalidGeoURI, coordinates[0])
+	} else if geo.Longitude, err = strconv.ParseFloat(coordinates[1], 64); err != nil || geo.Longitude < -180 || geo.Longitude > 180 {
+		return nil, fmt.Errorf("%w: invalid longitude %q", ErrInvalidGeoURI, coordinates[1])
+	}
+	if len(coordinates) == 3 {
+		if geo.Altitude, err = strconv.ParseFloat(coordinates[2], 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid altitude %q", ErrInvalidGeoURI, coordinates[2])
+		}
+		geo.HasAltitude = true
+	}
+	for _, param := range parts[1:] {
+		key, value := param, ""
+		if eqIndex := strings.IndexRune(param, '='); eqIndex >= 0 {
+			key, value = param[:eqIndex], param[eqIndex+1:]
+		}
+		switch strings.ToLower(key) {
+		case "crs":
+			if strings.ToLower(value) != "wgs84" {
+				return nil, fmt.Errorf("%w: unsupported coordinate reference system %q", ErrInvalidGeoURI, value)
+			}
+		case "u":
+			if geo.Uncertainty, err = strconv.ParseFloat(value, 64); err != nil || geo.Uncertainty < 0 {
+				return nil, fmt.Errorf("%w: invalid uncertainty %q", ErrInvalidGeoURI, value)
+			}
+		}
+	}
+	return &geo, nil
+}
+
+func (geo *GeoURI) String() string {
+	var buf strings.Builder
+	buf.WriteString("geo:")
+	buf.WriteString(strconv.FormatFloat(geo.Latitude, 'f', -1, 64))
+	buf.WriteRune(',')
+	buf.WriteString(strconv.FormatFloat(geo.Longitude, 'f', -1, 64))
+	if geo.HasAltitude {
+		buf.WriteRune(',')
+		buf.WriteString(strconv.FormatFloat(geo.Altitude, 'f', -1, 64))
+	}
+	if geo.Uncertainty > 0 {
+		buf.WriteString(";u=")
+		buf.WriteString(strconv.FormatFloat(geo.Uncertainty, 'f', -1, 64))
+	}
+	return buf.String()
+}
+
+// LocationAssetType specifies what a shared location represents.
+type LocationAssetType string
+
+const (
+	// AssetSelf means the location is the sender's own location.
+	AssetSelf LocationAssetType = "m.self"
+	// AssetPin means the location is a place that was picked on a map.
+	AssetPin LocationAssetType = "m.pin"
+)
+
+// LocationAsset is the org.matrix.msc3488.asset field of location events.
+type LocationAsset struct {
+	Type LocationAssetType `json:"type"`
+}
+
+// LocationContent is the org.matrix.msc3488.location field of location events.
+type LocationContent struct {
+	URI         string `json:"uri"`
+	Description string `json:"description,omitempty"`
+}
+
+// Parse parses the geo URI of the location.
+func (loc *LocationContent) Parse() (*GeoURI, error) {
+	return ParseGeoURI(loc.URI)
+}
+
+// NewLocationMessage creates a m.location message with both the legacy geo_uri field and the MSC3488 fields.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3488
+func NewLocationMessage(geo *GeoURI, description string, asset LocationAssetType) *MessageEventContent {
+	uri := geo.String()
+	body := description
+	if len(body) == 0 {
+		body = fmt.Sprintf("Location: %s", uri)
+	} else {
+		body = fmt.Sprintf("%s: %s", description, uri)
+	}
+	return &MessageEventContent{
+		MsgType: MsgLocation,
+		Body:    body,
+		GeoURI:  uri,
+
+		MSC3488Location:  &LocationContent{URI: uri, Description: description},
+		MSC3488Asset:     &LocationAsset{Type: asset},
+		MSC3488Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// GetLocation returns the location of a m.location message, preferring the MSC3488 location if it's present.
+func (content *MessageEventContent) GetLocation() (*GeoURI, error) {
+	if content.MSC3488Location != nil && len(content.MSC3488Location.URI) > 0 {
+		return content.MSC3488Location.Parse()
+	}
+	return ParseGeoURI(content.GeoURI)
+}
+
+// BeaconInfoEventContent represents the content of a org.matrix.msc3672.beacon_info state event,
+// which describes a live location share. The state key is the user ID of the sharer.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3672
+type BeaconInfoEventContent struct {
+	Description string `json:"description,omitempty"`
+	Live        bool   `json:"live"`
+	// How long the live location share lasts in milliseconds, counted from Timestamp.
+	Timeout   int64         `json:"timeout"`
+	Timestamp int64         `json:"org.matrix.msc3488.ts"`
+	Asset     LocationAsset `json:"org.matrix.msc3488.asset"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// NewBeaconInfo creates the content for starting a live location share that lasts for the given duration.
+func NewBeaconInfo(description string, duration time.Duration) *BeaconInfoEventContent {
+	return &BeaconInfoEventContent{
+		Description: description,
+		Live:        true,
+		Timeout:     duration.Milliseconds(),
+		Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+		Asset:       LocationAsset{Type: AssetSelf},
+	}
+}
+
+// Stopped returns a copy of the beacon info with live set to false, which should be sent to stop sharing the location.
+func (content *BeaconInfoEventContent) Stopped() *BeaconInfoEventContent {
+	stopped := *content
+	stopped.Live = false
+	return &stopped
+}
+
+// ExpiresAt returns the time when the live location share times out.
+func (content *BeaconInfoEventContent) ExpiresAt() time.Time {
+	return time.Unix(0, (content.Timestamp+content.Timeout)*int64(time.Millisecond))
+}
+
+// IsActive returns whether the live location share is live and hasn't timed out.
+func (content *BeaconInfoEventContent) IsActive() bool {
+	return content.Live && time.Now().Before(content.ExpiresAt())
+}
+
+// BeaconEventContent represents the content of a org.matrix.msc3672.beacon message event,
+// which is a location update in a live location share. It references the beacon_info state event.
+type BeaconEventContent struct {
+	RelatesTo RelatesTo       `json:"m.relates_to"`
+	Location  LocationContent `json:"org.matrix.msc3488.location"`
+	Timestamp int64           `json:"org.matrix.msc3488.ts"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// NewBeaconUpdate creates a location update for the live location share started by the given beacon_info event.
+func NewBeaconUpdate(beaconInfoID id.EventID, geo *GeoURI) *BeaconEventContent {
+	return &BeaconEventContent{
+		RelatesTo: RelatesTo{Type: RelReference, EventID: beaconInfoID},
+		Location:  LocationContent{URI: geo.String()},
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (content *BeaconEventContent) GetRelatesTo() *RelatesTo {
+	return &content.RelatesTo
+}
+
+func (content *BeaconEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return &content.RelatesTo
+}
+
+func (content *BeaconEventContent) SetRelatesTo(rel *RelatesTo) {
+	content.RelatesTo = *rel
+}
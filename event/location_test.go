@@ -0,0 +1,40 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestParseGeoURI(t *testing.T) {
+	geo, err := event.ParseGeoURI("geo:60.1699,24.9384,12.5;crs=wgs84;u=35")
+	require.NoError(t, err)
+	assert.Equal(t, &event.GeoURI{Latitude: 60.1699, Longitude: 24.9384, Altitude: 12.5, HasAltitude: true, Uncertainty: 35}, geo)
+	assert.Equal(t, "geo:60.1699,24.9384,12.5;u=35", geo.String())
+}
+
+func TestParseGeoURI_Invalid(t *testing.T) {
+	for _, uri := range []string{"60.1,24.9", "geo:91,0", "geo:0,181", "geo:1", "geo:1,2;u=-5", "geo:1,2;crs=foo"} {
+		_, err := event.ParseGeoURI(uri)
+		assert.True(t, errors.Is(err, event.ErrInvalidGeoURI), uri)
+	}
+}
+
+func TestMessageEventContent_GetLocation(t *testing.T) {
+	content := event.NewLocationMessage(&event.GeoURI{Latitude: 1.5, Longitude: -2}, "Somewhere", event.AssetPin)
+	assert.Equal(t, "Somewhere: geo:1.5,-2", content.Body)
+	content.GeoURI = "geo:0,0"
+	geo, err := content.GetLocation()
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, geo.Latitude)
+}
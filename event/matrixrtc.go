@@ -0,0 +1,137 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type GroupCallIntent string
+
+const (
+	GroupCallIntentRing   GroupCallIntent = "m.ring"
+	GroupCallIntentPrompt GroupCallIntent = "m.prompt"
+	GroupCallIntentRoom   GroupCallIntent = "m.room"
+)
+
+type GroupCallType string
+
+const (
+	GroupCallTypeVoice GroupCallType = "m.voice"
+	GroupCallTypeVideo GroupCallType = "m.video"
+)
+
+// GroupCallEventContent represents the content of a org.matrix.msc3401.call state event.
+// The state key is the ID of the call.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3401
+type GroupCallEventContent struct {
+	Intent GroupCallIntent `json:"m.intent,omitempty"`
+	Type   GroupCallType   `json:"m.type,omitempty"`
+	Name   string          `json:"m.name,omitempty"`
+	// The reason why the call ended. If set, the call is no longer active.
+	Terminated string `json:"m.terminated,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// IsTerminated returns whether the call has ended.
+func (content *GroupCallEventContent) IsTerminated() bool {
+	return len(content.Terminated) > 0
+}
+
+// GroupCallMemberDevice is a single device of a user participating in a group call.
+type GroupCallMemberDevice struct {
+	DeviceID  id.DeviceID `json:"device_id"`
+	SessionID string      `json:"session_id"`
+	// The time when the membership of this device expires, in milliseconds since the epoch.
+	// Devices without an expiry are considered active.
+	ExpiresTS int64 `json:"expires_ts,omitempty"`
+
+	Feeds []map[string]interface{} `json:"feeds,omitempty"`
+}
+
+// IsActive returns whether the device is still participating in the call at the given time.
+func (device *GroupCallMemberDevice) IsActive(now time.Time) bool {
+	return device.ExpiresTS == 0 || device.ExpiresTS > now.UnixMilli()
+}
+
+// GroupCallMembership is a user's membership in a single call.
+type GroupCallMembership struct {
+	CallID  string                  `json:"m.call_id"`
+	Foci    []string                `json:"m.foci,omitempty"`
+	Devices []GroupCallMemberDevice `json:"m.devices"`
+}
+
+// GroupCallMemberEventContent represents the content of a org.matrix.msc3401.call.member state event.
+// The state key is the user ID of the member.
+type GroupCallMemberEventContent struct {
+	Calls []GroupCallMembership `json:"m.calls"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// ActiveDevices returns the devices of the user that are currently in the given call.
+func (content *GroupCallMemberEventContent) ActiveDevices(callID string, now time.Time) []GroupCallMemberDevice {
+	var active []GroupCallMemberDevice
+	for _, call := range content.Calls {
+		if call.CallID != callID {
+			continue
+		}
+		for _, device := range call.Devices {
+			if device.IsActive(now) {
+				active = append(active, device)
+			}
+		}
+	}
+	return active
+}
+
+// IsInCall returns whether the user has at least one device in the given call.
+func (content *GroupCallMemberEventContent) IsInCall(callID string, now time.Time) bool {
+	return len(content.ActiveDevices(callID, now)) > 0
+}
+
+// ActiveGroupCall is a call that has at least one participant.
+type ActiveGroupCall struct {
+	CallID       string
+	Call         *GroupCallEventContent
+	Participants []id.UserID
+}
+
+// ActiveGroupCalls finds the calls in the given room state that haven't been terminated and have
+// at least one participant with an unexpired device. The content of the state events must already be parsed.
+// The calls are sorted by call ID.
+func ActiveGroupCalls(state map[Type]map[string]*Event, now time.Time) []*ActiveGroupCall {
+	var calls []*ActiveGroupCall
+	for callID, evt := range state[StateGroupCall] {
+		content, ok := evt.Content.Parsed.(*GroupCallEventContent)
+		if !ok || content.IsTerminated() {
+			continue
+		}
+		call := &ActiveGroupCall{CallID: callID, Call: content}
+		for userID, memberEvt := range state[StateGroupCallMember] {
+			member, ok := memberEvt.Content.Parsed.(*GroupCallMemberEventContent)
+			if ok && member.IsInCall(callID, now) {
+				call.Participants = append(call.Participants, id.UserID(userID))
+			}
+		}
+		if len(call.Participants) > 0 {
+			sort.Slice(call.Participants, func(i, j int) bool {
+				return call.Participants[i] < call.Participants[j]
+			})
+			calls = append(calls, call)
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].CallID < calls[j].CallID
+	})
+	return calls
+}
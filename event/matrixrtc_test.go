@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestActiveGroupCalls(t *testing.T) {
+	now := time.UnixMilli(1_000_000)
+	state := map[event.Type]map[string]*event.Event{
+		event.StateGroupCall: {
+			"call1": makeStateEvent(t, event.StateGroupCall, "call1", `{"m.intent": "m.room", "m.type": "m.video"}`),
+			"call2": makeStateEvent(t, event.StateGroupCall, "call2", `{"m.intent": "m.room", "m.terminated": "call_ended"}`),
+			"call3": makeStateEvent(t, event.StateGroupCall, "call3", `{"m.intent": "m.ring"}`),
+		},
+		event.StateGroupCallMember: {
+			"@b:example.com": makeStateEvent(t, event.StateGroupCallMember, "@b:example.com", `{"m.calls": [{"m.call_id": "call1", "m.devices": [{"device_id": "B", "session_id": "s", "expires_ts": 2000000}]}]}`),
+			"@a:example.com": makeStateEvent(t, event.StateGroupCallMember, "@a:example.com", `{"m.calls": [{"m.call_id": "call1", "m.devices": [{"device_id": "A", "session_id": "s"}]}, {"m.call_id": "call2", "m.devices": [{"device_id": "A", "session_id": "s"}]}]}`),
+			"@c:example.com": makeStateEvent(t, event.StateGroupCallMember, "@c:example.com", `{"m.calls": [{"m.call_id": "call3", "m.devices": [{"device_id": "C", "session_id": "s", "expires_ts": 500000}]}]}`),
+		},
+	}
+	calls := event.ActiveGroupCalls(state, now)
+	require.Len(t, calls, 1)
+	assert.Equal(t, "call1", calls[0].CallID)
+	assert.Equal(t, event.GroupCallTypeVideo, calls[0].Call.Type)
+	assert.Equal(t, []id.UserID{"@a:example.com", "@b:example.com"}, calls[0].Participants)
+}
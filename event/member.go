@@ -41,6 +41,8 @@ type MemberEventContent struct {
 	IsDirect         bool                `json:"is_direct,omitempty"`
 	ThirdPartyInvite *ThirdPartyInvite   `json:"third_party_invite,omitempty"`
 	Reason           string              `json:"reason,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type ThirdPartyInvite struct {
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+// Mentions is the m.mentions field of messages, which lists the users who were intentionally mentioned (MSC3952).
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3952
+type Mentions struct {
+	UserIDs []id.UserID `json:"user_ids,omitempty"`
+	Room    bool        `json:"room,omitempty"`
+}
+
+// Has returns whether the given user is mentioned.
+func (m *Mentions) Has(userID id.UserID) bool {
+	if m == nil {
+		return false
+	}
+	for _, mentioned := range m.UserIDs {
+		if mentioned == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds the given user to the mentions, unless they're already mentioned.
+func (m *Mentions) Add(userID id.UserID) {
+	if !m.Has(userID) {
+		m.UserIDs = append(m.UserIDs, userID)
+	}
+}
+
+// AddUserMention adds the given user to the m.mentions of the message.
+func (content *MessageEventContent) AddUserMention(userID id.UserID) {
+	if content.Mentions == nil {
+		content.Mentions = &Mentions{}
+	}
+	content.Mentions.Add(userID)
+}
+
+// AddRoomMention marks the message as mentioning the whole room (i.e. @room).
+func (content *MessageEventContent) AddRoomMention() {
+	if content.Mentions == nil {
+		content.Mentions = &Mentions{}
+	}
+	content.Mentions.Room = true
+}
+
+// MentionsUser returns whether the message intentionally mentions the given user.
+func (content *MessageEventContent) MentionsUser(userID id.UserID) bool {
+	return content.Mentions.Has(userID)
+}
+
+// StripEditMentions removes users who were already mentioned in the previous version of the message from the
+// top-level mentions of an edit, so that editing a message doesn't notify the same users again.
+// The full list of mentions stays in m.new_content.
+//
+// This must be called after SetEdit.
+func (content *MessageEventContent) StripEditMentions(previous *Mentions) {
+	if content.NewContent == nil || content.NewContent.Mentions == nil {
+		return
+	}
+	newMentions := &Mentions{Room: content.NewContent.Mentions.Room && (previous == nil || !previous.Room)}
+	for _, userID := range content.NewContent.Mentions.UserIDs {
+		if !previous.Has(userID) {
+			newMentions.Add(userID)
+		}
+	}
+	content.Mentions = newMentions
+}
@@ -30,6 +30,14 @@ const (
 	MsgFile     MessageType = "m.file"
 
 	MsgVerificationRequest MessageType = "m.key.verification.request"
+
+	// Chat effects used by Element. They have the same fields as m.text.
+	MsgEffectConfetti      MessageType = "nic.custom.confetti"
+	MsgEffectFireworks     MessageType = "nic.custom.fireworks"
+	MsgEffectHearts        MessageType = "io.element.effect.hearts"
+	MsgEffectRainfall      MessageType = "io.element.effect.rainfall"
+	MsgEffectSnowfall      MessageType = "io.element.effect.snowfall"
+	MsgEffectSpaceInvaders MessageType = "io.element.effects.space_invaders"
 )
 
 // Format specifies the format of the formatted_body in m.room.message events.
@@ -43,18 +51,26 @@ const (
 
 // RedactionEventContent represents the content of a m.room.redaction message event.
 //
-// The redacted event ID is still at the top level, but will move in a future room version.
-// See https://github.com/matrix-org/matrix-doc/pull/2244 and https://github.com/matrix-org/matrix-doc/pull/2174
+// In room versions before v11, the redacted event ID is at the top level of the event rather than in the content.
+// Use Event.GetRedactsID to read the target in a way that works with all room versions.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/2174
 //
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-redaction
 type RedactionEventContent struct {
 	Reason string `json:"reason,omitempty"`
+	// The ID of the event being redacted. Only present in room version 11 and later.
+	Redacts id.EventID `json:"redacts,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // ReactionEventContent represents the content of a m.reaction message event.
 // This is not yet in a spec release, see https://github.com/matrix-org/matrix-doc/pull/1849
 type ReactionEventContent struct {
 	RelatesTo RelatesTo `json:"m.relates_to"`
+
+	// Fields that aren't recognized by this struct, such as custom reaction metadata added by other clients.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 func (content *ReactionEventContent) GetRelatesTo() *RelatesTo {
@@ -84,23 +100,42 @@ type MessageEventContent struct {
 	Format        Format `json:"format,omitempty"`
 	FormattedBody string `json:"formatted_body,omitempty"`
 
-	// Extra field for m.location
-	GeoURI string `json:"geo_uri,omitempty"`
+	// Extra fields for m.location
+	GeoURI           string           `json:"geo_uri,omitempty"`
+	MSC3488Location  *LocationContent `json:"org.matrix.msc3488.location,omitempty"`
+	MSC3488Asset     *LocationAsset   `json:"org.matrix.msc3488.asset,omitempty"`
+	MSC3488Timestamp int64            `json:"org.matrix.msc3488.ts,omitempty"`
 
 	// Extra fields for media types
 	URL  id.ContentURIString `json:"url,omitempty"`
 	Info *FileInfo           `json:"info,omitempty"`
 	File *EncryptedFileInfo  `json:"file,omitempty"`
+	// The file name of media messages. If present and different from the body, the body is a caption (MSC2530).
+	FileName string `json:"filename,omitempty"`
+
+	// Extra fields for m.audio
+	MSC1767Audio *MSC1767Audio `json:"org.matrix.msc1767.audio,omitempty"`
+	MSC3245Voice *MSC3245Voice `json:"org.matrix.msc3245.voice,omitempty"`
 
 	// Edits and relations
 	NewContent *MessageEventContent `json:"m.new_content,omitempty"`
 	RelatesTo  *RelatesTo           `json:"m.relates_to,omitempty"`
 
+	Mentions *Mentions `json:"m.mentions,omitempty"`
+
+	PerMessageProfile *PerMessageProfile `json:"com.beeper.per_message_profile,omitempty"`
+
 	// In-room verification
 	To         id.UserID            `json:"to,omitempty"`
 	FromDevice id.DeviceID          `json:"from_device,omitempty"`
 	Methods    []VerificationMethod `json:"methods,omitempty"`
 
+	// Fields that aren't recognized by this struct. They're preserved when marshaling the content back into JSON,
+	// so that edits and relayed messages don't lose custom fields added by other clients or bridges.
+	Extra map[string]json.RawMessage `json:"-"`
+	// The parsed custom fields of msgtypes registered with RegisterMessageType.
+	Custom interface{} `json:"-"`
+
 	replyFallbackRemoved bool
 }
 
@@ -122,6 +157,10 @@ func (content *MessageEventContent) SetRelatesTo(rel *RelatesTo) {
 func (content *MessageEventContent) SetEdit(original id.EventID) {
 	newContent := *content
 	content.NewContent = &newContent
+	if content.Mentions != nil {
+		// Nobody should be notified about an edit unless StripEditMentions is used to find new mentions
+		content.Mentions = &Mentions{}
+	}
 	content.RelatesTo = &RelatesTo{
 		Type:    RelReplace,
 		EventID: original,
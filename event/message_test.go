@@ -166,3 +166,74 @@ func TestMessageEventContent__Marshal_Custom(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expectedCustomMarshalResult, string(data))
 }
+
+func TestMessageEventContent_StripEditMentions(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hi @alice and @bob"}
+	content.AddUserMention("@alice:example.com")
+	content.AddUserMention("@bob:example.com")
+	content.AddUserMention("@alice:example.com")
+	content.SetEdit("$original")
+	assert.Empty(t, content.Mentions.UserIDs)
+	assert.Len(t, content.NewContent.Mentions.UserIDs, 2)
+
+	content.StripEditMentions(&event.Mentions{UserIDs: []id.UserID{"@alice:example.com"}})
+	assert.Equal(t, []id.UserID{"@bob:example.com"}, content.Mentions.UserIDs)
+	assert.True(t, content.NewContent.MentionsUser("@alice:example.com"))
+	assert.False(t, content.MentionsUser("@alice:example.com"))
+}
+
+func TestMessageEventContent_PreservesUnknownFields(t *testing.T) {
+	input := `{"msgtype": "m.text", "body": "hi", "com.example.custom": {"nested": [1, 2]}, "m.relates_to": {"rel_type": "m.replace", "event_id": "$abc"}}`
+	var content event.MessageEventContent
+	require.NoError(t, json.Unmarshal([]byte(input), &content))
+	assert.Equal(t, "hi", content.Body)
+	assert.Len(t, content.Extra, 1)
+	assert.JSONEq(t, `{"nested": [1, 2]}`, string(content.Extra["com.example.custom"]))
+
+	content.Body = "edited"
+	output, err := json.Marshal(&content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"msgtype": "m.text", "body": "edited", "com.example.custom": {"nested": [1, 2]}, "m.relates_to": {"rel_type": "m.replace", "event_id": "$abc"}}`, string(output))
+}
+
+func TestMessageEventContent_Caption(t *testing.T) {
+	var content event.MessageEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"msgtype": "m.image", "body": "cat.jpg", "url": "mxc://example.com/cat"}`), &content))
+	assert.True(t, content.IsMedia())
+	assert.False(t, content.HasCaption())
+	assert.Equal(t, "cat.jpg", content.GetFileName())
+	assert.Empty(t, content.GetCaption())
+
+	content.SetCaption("look at this cat", "look at <b>this</b> cat")
+	assert.Equal(t, "cat.jpg", content.GetFileName())
+	assert.Equal(t, "look at this cat", content.GetCaption())
+	assert.Equal(t, "look at <b>this</b> cat", content.GetFormattedCaption())
+	output, err := json.Marshal(&content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"msgtype": "m.image", "body": "look at this cat", "filename": "cat.jpg", "format": "org.matrix.custom.html", "formatted_body": "look at <b>this</b> cat", "url": "mxc://example.com/cat"}`, string(output))
+
+	content.SetCaption("", "")
+	assert.False(t, content.HasCaption())
+	assert.Equal(t, "cat.jpg", content.Body)
+	assert.Empty(t, content.FileName)
+	assert.Empty(t, content.FormattedBody)
+}
+
+func TestMessageEventContent_PerMessageProfile(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello <world>"}
+	content.SetPerMessageProfile(event.PerMessageProfile{ID: "alice", Displayname: "Alice & co"}, true)
+	assert.Equal(t, "Alice & co: hello <world>", content.Body)
+	assert.Equal(t, "<strong data-mx-profile-fallback>Alice &amp; co: </strong>hello &lt;world&gt;", content.FormattedBody)
+	assert.True(t, content.PerMessageProfile.HasFallback)
+
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	var parsed event.MessageEventContent
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	require.NotNil(t, parsed.PerMessageProfile)
+	assert.Equal(t, "alice", parsed.PerMessageProfile.ID)
+	parsed.RemovePerMessageProfileFallback()
+	assert.Equal(t, "hello <world>", parsed.Body)
+	assert.Equal(t, "hello &lt;world&gt;", parsed.FormattedBody)
+	assert.False(t, parsed.PerMessageProfile.HasFallback)
+}
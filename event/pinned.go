@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+// IsPinned returns whether the given event is pinned.
+func (content *PinnedEventsEventContent) IsPinned(eventID id.EventID) bool {
+	for _, pinned := range content.Pinned {
+		if pinned == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// Pin adds the given event to the end of the pinned list. Returns false if the event was already pinned.
+func (content *PinnedEventsEventContent) Pin(eventID id.EventID) bool {
+	if content.IsPinned(eventID) {
+		return false
+	}
+	content.Pinned = append(content.Pinned, eventID)
+	return true
+}
+
+// Unpin removes all occurrences of the given event from the pinned list. Returns false if the event wasn't pinned.
+func (content *PinnedEventsEventContent) Unpin(eventID id.EventID) bool {
+	filtered := make([]id.EventID, 0, len(content.Pinned))
+	for _, pinned := range content.Pinned {
+		if pinned != eventID {
+			filtered = append(filtered, pinned)
+		}
+	}
+	changed := len(filtered) != len(content.Pinned)
+	content.Pinned = filtered
+	return changed
+}
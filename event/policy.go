@@ -0,0 +1,190 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PolicyRecommendation is the action that a moderation policy rule recommends taking.
+type PolicyRecommendation string
+
+const (
+	PolicyRecommendationBan         PolicyRecommendation = "m.ban"
+	PolicyRecommendationUnstableBan PolicyRecommendation = "org.matrix.mjolnir.ban"
+)
+
+// IsBan returns whether the recommendation is to ban the entity, accepting both the stable and unstable identifiers.
+func (pr PolicyRecommendation) IsBan() bool {
+	return pr == PolicyRecommendationBan || pr == PolicyRecommendationUnstableBan
+}
+
+// PolicyEntityType is the kind of entity that a policy rule applies to.
+type PolicyEntityType string
+
+const (
+	PolicyEntityUser   PolicyEntityType = "user"
+	PolicyEntityRoom   PolicyEntityType = "room"
+	PolicyEntityServer PolicyEntityType = "server"
+)
+
+// PolicyEntityTypeOf returns the entity type of the given policy rule event type, or an empty string if
+// the event type is not a policy rule. Both the stable and unstable event types are supported.
+func PolicyEntityTypeOf(evtType Type) PolicyEntityType {
+	switch evtType.Type {
+	case StatePolicyUser.Type, StateUnstablePolicyUser.Type:
+		return PolicyEntityUser
+	case StatePolicyRoom.Type, StateUnstablePolicyRoom.Type:
+		return PolicyEntityRoom
+	case StatePolicyServer.Type, StateUnstablePolicyServer.Type:
+		return PolicyEntityServer
+	default:
+		return ""
+	}
+}
+
+// CompilePolicyGlob compiles a policy rule entity, which may contain * and ? wildcards, into a regular expression.
+func CompilePolicyGlob(entity string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteRune('^')
+	for _, char := range entity {
+		switch char {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteRune('.')
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	pattern.WriteRune('$')
+	return regexp.MustCompile(pattern.String())
+}
+
+// PolicyRule is a single parsed rule in a PolicyList.
+type PolicyRule struct {
+	EntityType PolicyEntityType
+	StateKey   string
+	Sender     id.UserID
+	*ModPolicyContent
+
+	pattern *regexp.Regexp
+}
+
+// Match returns whether the given entity matches the glob in the rule.
+func (rule *PolicyRule) Match(entity string) bool {
+	if rule.pattern == nil {
+		rule.pattern = CompilePolicyGlob(rule.Entity)
+	}
+	return rule.pattern.MatchString(entity)
+}
+
+// PolicyList aggregates the moderation policy rules in a single policy list room.
+type PolicyList struct {
+	RoomID id.RoomID
+
+	rules     map[PolicyEntityType]map[string]*PolicyRule
+	rulesLock sync.RWMutex
+}
+
+// NewPolicyList creates an empty PolicyList for the given room.
+func NewPolicyList(roomID id.RoomID) *PolicyList {
+	return &PolicyList{
+		RoomID: roomID,
+		rules: map[PolicyEntityType]map[string]*PolicyRule{
+			PolicyEntityUser:   make(map[string]*PolicyRule),
+			PolicyEntityRoom:   make(map[string]*PolicyRule),
+			PolicyEntityServer: make(map[string]*PolicyRule),
+		},
+	}
+}
+
+// Update ingests a state event from the policy list room. Events with an empty entity (e.g. redacted or removed
+// rules) delete the rule with the same state key. The event content must already be parsed.
+//
+// Returns false if the event is not a policy rule in this room.
+func (pl *PolicyList) Update(evt *Event) bool {
+	entityType := PolicyEntityTypeOf(evt.Type)
+	if len(entityType) == 0 || evt.StateKey == nil || evt.RoomID != pl.RoomID {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*ModPolicyContent)
+	pl.rulesLock.Lock()
+	defer pl.rulesLock.Unlock()
+	if !ok || len(content.Entity) == 0 {
+		delete(pl.rules[entityType], *evt.StateKey)
+	} else {
+		pl.rules[entityType][*evt.StateKey] = &PolicyRule{
+			EntityType:       entityType,
+			StateKey:         *evt.StateKey,
+			Sender:           evt.Sender,
+			ModPolicyContent: content,
+
+			pattern: CompilePolicyGlob(content.Entity),
+		}
+	}
+	return true
+}
+
+// Rules returns all the rules of the given entity type in the list.
+func (pl *PolicyList) Rules(entityType PolicyEntityType) []*PolicyRule {
+	pl.rulesLock.RLock()
+	defer pl.rulesLock.RUnlock()
+	rules := make([]*PolicyRule, 0, len(pl.rules[entityType]))
+	for _, rule := range pl.rules[entityType] {
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Match finds a ban rule of the given entity type that matches the given entity.
+func (pl *PolicyList) Match(entityType PolicyEntityType, entity string) *PolicyRule {
+	pl.rulesLock.RLock()
+	defer pl.rulesLock.RUnlock()
+	for _, rule := range pl.rules[entityType] {
+		if rule.Recommendation.IsBan() && rule.Match(entity) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// MatchServer finds a ban rule that matches the given server name.
+func (pl *PolicyList) MatchServer(serverName string) *PolicyRule {
+	return pl.Match(PolicyEntityServer, serverName)
+}
+
+// MatchRoom finds a ban rule that matches the given room ID or alias.
+func (pl *PolicyList) MatchRoom(room string) *PolicyRule {
+	return pl.Match(PolicyEntityRoom, room)
+}
+
+// MatchUser finds a ban rule that matches the given user, either directly or via a server rule for their homeserver.
+func (pl *PolicyList) MatchUser(userID id.UserID) *PolicyRule {
+	if rule := pl.Match(PolicyEntityUser, string(userID)); rule != nil {
+		return rule
+	}
+	_, homeserver, err := userID.Parse()
+	if err != nil {
+		return nil
+	}
+	return pl.MatchServer(homeserver)
+}
+
+// IsUserBanned returns whether the given user is banned by the policy list.
+func (pl *PolicyList) IsUserBanned(userID id.UserID) bool {
+	return pl.MatchUser(userID) != nil
+}
+
+// IsServerBanned returns whether the given server is banned by the policy list.
+func (pl *PolicyList) IsServerBanned(serverName string) bool {
+	return pl.MatchServer(serverName) != nil
+}
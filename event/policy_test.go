@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPolicyList(t *testing.T) {
+	pl := event.NewPolicyList("!policies:example.com")
+	makePolicyEvent := func(evtType event.Type, stateKey, entity string, recommendation event.PolicyRecommendation) *event.Event {
+		return makeEvent(t, event.Event{RoomID: "!policies:example.com", Type: evtType, StateKey: &stateKey}, &event.ModPolicyContent{
+			Entity:         entity,
+			Reason:         "spam",
+			Recommendation: recommendation,
+		})
+	}
+	assert.True(t, pl.Update(makePolicyEvent(event.StatePolicyUser, "rule1", "@spam*:example.com", event.PolicyRecommendationBan)))
+	assert.True(t, pl.Update(makePolicyEvent(event.StateUnstablePolicyServer, "rule2", "*.evil.com", event.PolicyRecommendationUnstableBan)))
+	assert.True(t, pl.Update(makePolicyEvent(event.StatePolicyServer, "rule3", "fine.example", "org.example.watch")))
+	assert.False(t, pl.Update(makePolicyEvent(event.StateMember, "@user:example.com", "", "")))
+
+	assert.True(t, pl.IsUserBanned("@spammer:example.com"))
+	assert.False(t, pl.IsUserBanned("@alice:example.com"))
+	assert.True(t, pl.IsUserBanned("@alice:matrix.evil.com"), "users should be banned via server rules")
+	assert.False(t, pl.IsServerBanned("evil.com"))
+	assert.False(t, pl.IsServerBanned("fine.example"), "non-ban recommendations shouldn't count as bans")
+
+	rule := pl.MatchUser("@spam:example.com")
+	if assert.NotNil(t, rule) {
+		assert.Equal(t, event.PolicyEntityUser, rule.EntityType)
+		assert.Equal(t, "spam", rule.Reason)
+	}
+
+	pl.Update(makePolicyEvent(event.StatePolicyUser, "rule1", "", ""))
+	assert.False(t, pl.IsUserBanned(id.UserID("@spammer:example.com")))
+	assert.Len(t, pl.Rules(event.PolicyEntityServer), 2)
+}
@@ -0,0 +1,422 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PollKind specifies whether the results of a poll are visible before the poll ends.
+type PollKind string
+
+const (
+	PollKindDisclosed   PollKind = "m.disclosed"
+	PollKindUndisclosed PollKind = "m.undisclosed"
+
+	PollKindUnstableDisclosed   PollKind = "org.matrix.msc3381.poll.disclosed"
+	PollKindUnstableUndisclosed PollKind = "org.matrix.msc3381.poll.undisclosed"
+)
+
+// Stable returns the stable version of the poll kind.
+func (kind PollKind) Stable() PollKind {
+	switch kind {
+	case PollKindUnstableDisclosed:
+		return PollKindDisclosed
+	case PollKindUnstableUndisclosed:
+		return PollKindUndisclosed
+	default:
+		return kind
+	}
+}
+
+// Unstable returns the MSC3381 unstable prefixed version of the poll kind.
+func (kind PollKind) Unstable() PollKind {
+	switch kind {
+	case PollKindDisclosed:
+		return PollKindUnstableDisclosed
+	case PollKindUndisclosed:
+		return PollKindUnstableUndisclosed
+	default:
+		return kind
+	}
+}
+
+// PollAnswer is a single option in a poll.
+type PollAnswer struct {
+	ID   string
+	Text string
+}
+
+type serializablePollAnswer struct {
+	ID   string                  `json:"m.id"`
+	Text ExtensibleTextContainer `json:"m.text"`
+}
+
+type serializablePollQuestion struct {
+	Text ExtensibleTextContainer `json:"m.text"`
+}
+
+type serializablePoll struct {
+	Kind          PollKind                 `json:"kind,omitempty"`
+	MaxSelections int                      `json:"max_selections,omitempty"`
+	Question      serializablePollQuestion `json:"question"`
+	Answers       []serializablePollAnswer `json:"answers"`
+}
+
+type serializableUnstablePollAnswer struct {
+	ID   string `json:"id"`
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type serializableUnstablePollQuestion struct {
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type serializableUnstablePoll struct {
+	Kind          PollKind                         `json:"kind,omitempty"`
+	MaxSelections int                              `json:"max_selections,omitempty"`
+	Question      serializableUnstablePollQuestion `json:"question"`
+	Answers       []serializableUnstablePollAnswer `json:"answers"`
+}
+
+type serializablePollStart struct {
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+
+	Poll *serializablePoll       `json:"m.poll,omitempty"`
+	Text ExtensibleTextContainer `json:"m.text,omitempty"`
+
+	UnstablePoll *serializableUnstablePoll `json:"org.matrix.msc3381.poll.start,omitempty"`
+	UnstableText string                    `json:"org.matrix.msc1767.text,omitempty"`
+}
+
+func makePollText(text string) ExtensibleTextContainer {
+	if len(text) == 0 {
+		return nil
+	}
+	return ExtensibleTextContainer{{Body: text}}
+}
+
+// PollStartEventContent represents the content of a m.poll.start message event (MSC3381).
+//
+// Both the stable and the org.matrix.msc3381 unstable formats are supported when unmarshaling.
+// When marshaling, the unstable format is used if Unstable is true.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3381
+type PollStartEventContent struct {
+	RelatesTo *RelatesTo
+
+	Question      string
+	Kind          PollKind
+	MaxSelections int
+	Answers       []PollAnswer
+	// Fallback text for clients that don't support polls.
+	Fallback string
+
+	Unstable bool
+}
+
+func (content *PollStartEventContent) GetMaxSelections() int {
+	if content.MaxSelections < 1 {
+		return 1
+	}
+	return content.MaxSelections
+}
+
+func (content *PollStartEventContent) HasAnswer(answerID string) bool {
+	for _, answer := range content.Answers {
+		if answer.ID == answerID {
+			return true
+		}
+	}
+	return false
+}
+
+func (content *PollStartEventContent) UnmarshalJSON(data []byte) error {
+	var sps serializablePollStart
+	if err := json.Unmarshal(data, &sps); err != nil {
+		return err
+	}
+	content.RelatesTo = sps.RelatesTo
+	if sps.Poll != nil {
+		content.Unstable = false
+		content.Question = sps.Poll.Question.Text.Plain()
+		content.Kind = sps.Poll.Kind.Stable()
+		content.MaxSelections = sps.Poll.MaxSelections
+		content.Answers = make([]PollAnswer, len(sps.Poll.Answers))
+		for i, answer := range sps.Poll.Answers {
+			content.Answers[i] = PollAnswer{ID: answer.ID, Text: answer.Text.Plain()}
+		}
+		content.Fallback = sps.Text.Plain()
+	} else if sps.UnstablePoll != nil {
+		content.Unstable = true
+		content.Question = sps.UnstablePoll.Question.Text
+		content.Kind = sps.UnstablePoll.Kind.Stable()
+		content.MaxSelections = sps.UnstablePoll.MaxSelections
+		content.Answers = make([]PollAnswer, len(sps.UnstablePoll.Answers))
+		for i, answer := range sps.UnstablePoll.Answers {
+			content.Answers[i] = PollAnswer{ID: answer.ID, Text: answer.Text}
+		}
+		content.Fallback = sps.UnstableText
+	}
+	return nil
+}
+
+func (content *PollStartEventContent) MarshalJSON() ([]byte, error) {
+	sps := serializablePollStart{RelatesTo: content.RelatesTo}
+	if content.Unstable {
+		sps.UnstableText = content.Fallback
+		sps.UnstablePoll = &serializableUnstablePoll{
+			Kind:          content.Kind.Unstable(),
+			MaxSelections: content.MaxSelections,
+			Question:      serializableUnstablePollQuestion{Text: content.Question},
+			Answers:       make([]serializableUnstablePollAnswer, len(content.Answers)),
+		}
+		for i, answer := range content.Answers {
+			sps.UnstablePoll.Answers[i] = serializableUnstablePollAnswer{ID: answer.ID, Text: answer.Text}
+		}
+	} else {
+		sps.Text = makePollText(content.Fallback)
+		sps.Poll = &serializablePoll{
+			Kind:          content.Kind.Stable(),
+			MaxSelections: content.MaxSelections,
+			Question:      serializablePollQuestion{Text: makePollText(content.Question)},
+			Answers:       make([]serializablePollAnswer, len(content.Answers)),
+		}
+		for i, answer := range content.Answers {
+			sps.Poll.Answers[i] = serializablePollAnswer{ID: answer.ID, Text: makePollText(answer.Text)}
+		}
+	}
+	return json.Marshal(&sps)
+}
+
+type serializablePollResponseSelections struct {
+	Answers []string `json:"answers"`
+}
+
+type serializablePollResponse struct {
+	RelatesTo RelatesTo `json:"m.relates_to"`
+
+	Selections *[]string `json:"m.selections,omitempty"`
+
+	UnstableResponse *serializablePollResponseSelections `json:"org.matrix.msc3381.poll.response,omitempty"`
+}
+
+// PollResponseEventContent represents the content of a m.poll.response message event (MSC3381).
+// The poll start event is referenced with a m.reference relation.
+type PollResponseEventContent struct {
+	RelatesTo RelatesTo
+	// The IDs of the selected answers. An empty list means the previous vote is retracted.
+	Answers []string
+
+	Unstable bool
+}
+
+func (content *PollResponseEventContent) UnmarshalJSON(data []byte) error {
+	var spr serializablePollResponse
+	if err := json.Unmarshal(data, &spr); err != nil {
+		return err
+	}
+	content.RelatesTo = spr.RelatesTo
+	if spr.UnstableResponse != nil {
+		content.Unstable = true
+		content.Answers = spr.UnstableResponse.Answers
+	} else {
+		content.Unstable = false
+		content.Answers = nil
+		if spr.Selections != nil {
+			content.Answers = *spr.Selections
+		}
+	}
+	return nil
+}
+
+func (content *PollResponseEventContent) MarshalJSON() ([]byte, error) {
+	answers := content.Answers
+	if answers == nil {
+		answers = []string{}
+	}
+	spr := serializablePollResponse{RelatesTo: content.RelatesTo}
+	if content.Unstable {
+		spr.UnstableResponse = &serializablePollResponseSelections{Answers: answers}
+	} else {
+		spr.Selections = &answers
+	}
+	return json.Marshal(&spr)
+}
+
+type serializablePollEnd struct {
+	RelatesTo RelatesTo `json:"m.relates_to"`
+
+	Text ExtensibleTextContainer `json:"m.text,omitempty"`
+
+	UnstableEnd  *struct{} `json:"org.matrix.msc3381.poll.end,omitempty"`
+	UnstableText string    `json:"org.matrix.msc1767.text,omitempty"`
+}
+
+// PollEndEventContent represents the content of a m.poll.end message event (MSC3381).
+// The poll start event is referenced with a m.reference relation.
+type PollEndEventContent struct {
+	RelatesTo RelatesTo
+	// Fallback text for clients that don't support polls, usually the results of the poll.
+	Fallback string
+
+	Unstable bool
+}
+
+func (content *PollEndEventContent) UnmarshalJSON(data []byte) error {
+	var spe serializablePollEnd
+	if err := json.Unmarshal(data, &spe); err != nil {
+		return err
+	}
+	content.RelatesTo = spe.RelatesTo
+	if spe.UnstableEnd != nil {
+		content.Unstable = true
+		content.Fallback = spe.UnstableText
+	} else {
+		content.Unstable = false
+		content.Fallback = spe.Text.Plain()
+	}
+	return nil
+}
+
+func (content *PollEndEventContent) MarshalJSON() ([]byte, error) {
+	spe := serializablePollEnd{RelatesTo: content.RelatesTo}
+	if content.Unstable {
+		spe.UnstableEnd = &struct{}{}
+		spe.UnstableText = content.Fallback
+	} else {
+		spe.Text = makePollText(content.Fallback)
+	}
+	return json.Marshal(&spe)
+}
+
+type pollVote struct {
+	timestamp int64
+	answers   []string
+}
+
+// PollAggregator tallies the responses to a single poll.
+//
+// Only the latest response of each user counts, responses sent after the poll ended are ignored,
+// and only the first max_selections valid answers of each response are counted.
+type PollAggregator struct {
+	PollID  id.EventID
+	Creator id.UserID
+	Poll    *PollStartEventContent
+
+	votes   map[id.UserID]pollVote
+	endedAt int64
+}
+
+// NewPollAggregator creates an aggregator for the given poll start event.
+// The content of the event must already be parsed.
+func NewPollAggregator(start *Event) *PollAggregator {
+	return &PollAggregator{
+		PollID:  start.ID,
+		Creator: start.Sender,
+		Poll:    start.Content.AsPollStart(),
+		votes:   make(map[id.UserID]pollVote),
+	}
+}
+
+// AddResponse adds a poll response event to the tally. It returns false if the event doesn't refer to this poll
+// or if it was superseded by a newer response from the same user.
+func (pa *PollAggregator) AddResponse(evt *Event) bool {
+	content := evt.Content.AsPollResponse()
+	if content.RelatesTo.GetReferenceID() != pa.PollID {
+		return false
+	} else if existing, ok := pa.votes[evt.Sender]; ok && existing.timestamp > evt.Timestamp {
+		return false
+	}
+	pa.votes[evt.Sender] = pollVote{timestamp: evt.Timestamp, answers: content.Answers}
+	return true
+}
+
+// End marks the poll as ended based on the given poll end event. Only the creator of the poll can end it.
+func (pa *PollAggregator) End(evt *Event) bool {
+	content := evt.Content.AsPollEnd()
+	if content.RelatesTo.GetReferenceID() != pa.PollID || evt.Sender != pa.Creator {
+		return false
+	} else if pa.endedAt != 0 && pa.endedAt <= evt.Timestamp {
+		return false
+	}
+	pa.endedAt = evt.Timestamp
+	return true
+}
+
+// IsEnded returns whether a valid end event has been passed to End.
+func (pa *PollAggregator) IsEnded() bool {
+	return pa.endedAt != 0
+}
+
+func (pa *PollAggregator) validAnswers(answers []string) []string {
+	maxSelections := pa.Poll.GetMaxSelections()
+	valid := make([]string, 0, maxSelections)
+	seen := make(map[string]struct{}, len(answers))
+	for _, answerID := range answers {
+		if _, isDuplicate := seen[answerID]; isDuplicate || !pa.Poll.HasAnswer(answerID) {
+			continue
+		}
+		seen[answerID] = struct{}{}
+		valid = append(valid, answerID)
+		if len(valid) >= maxSelections {
+			break
+		}
+	}
+	return valid
+}
+
+// Votes returns the answers of each user whose vote counts. Users whose latest response has no valid answers are not included.
+func (pa *PollAggregator) Votes() map[id.UserID][]string {
+	votes := make(map[id.UserID][]string, len(pa.votes))
+	for userID, vote := range pa.votes {
+		if pa.endedAt != 0 && vote.timestamp > pa.endedAt {
+			continue
+		}
+		if answers := pa.validAnswers(vote.answers); len(answers) > 0 {
+			votes[userID] = answers
+		}
+	}
+	return votes
+}
+
+// Results returns the number of votes for each answer ID. All answers of the poll are included, even if they have no votes.
+func (pa *PollAggregator) Results() map[string]int {
+	results := make(map[string]int, len(pa.Poll.Answers))
+	for _, answer := range pa.Poll.Answers {
+		results[answer.ID] = 0
+	}
+	for _, answers := range pa.Votes() {
+		for _, answerID := range answers {
+			results[answerID]++
+		}
+	}
+	return results
+}
+
+// Winners returns the IDs of the answers with the most votes, in the order they appear in the poll.
+// If nobody has voted, the list is empty.
+func (pa *PollAggregator) Winners() []string {
+	results := pa.Results()
+	maxVotes := 0
+	for _, count := range results {
+		if count > maxVotes {
+			maxVotes = count
+		}
+	}
+	if maxVotes == 0 {
+		return []string{}
+	}
+	winners := make([]string, 0, 1)
+	for _, answer := range pa.Poll.Answers {
+		if results[answer.ID] == maxVotes {
+			winners = append(winners, answer.ID)
+		}
+	}
+	return winners
+}
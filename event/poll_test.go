@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const unstablePollStartEvent = `{
+	"sender": "@tulir:maunium.net",
+	"type": "org.matrix.msc3381.poll.start",
+	"origin_server_ts": 1000,
+	"event_id": "$poll",
+	"room_id": "!bar",
+	"content": {
+		"org.matrix.msc3381.poll.start": {
+			"kind": "org.matrix.msc3381.poll.disclosed",
+			"max_selections": 2,
+			"question": {"org.matrix.msc1767.text": "Favorite color?"},
+			"answers": [
+				{"id": "red", "org.matrix.msc1767.text": "Red"},
+				{"id": "green", "org.matrix.msc1767.text": "Green"},
+				{"id": "blue", "org.matrix.msc1767.text": "Blue"}
+			]
+		},
+		"org.matrix.msc1767.text": "Favorite color?\n1. Red\n2. Green\n3. Blue"
+	}
+}`
+
+func TestPollStartEventContent_ParseUnstable(t *testing.T) {
+	evt := parseEvent(t, unstablePollStartEvent)
+	assert.Equal(t, event.EventUnstablePollStart, evt.Type)
+	content := evt.Content.AsPollStart()
+	assert.True(t, content.Unstable)
+	assert.Equal(t, "Favorite color?", content.Question)
+	assert.Equal(t, event.PollKindDisclosed, content.Kind)
+	assert.Equal(t, 2, content.GetMaxSelections())
+	assert.Equal(t, []event.PollAnswer{{"red", "Red"}, {"green", "Green"}, {"blue", "Blue"}}, content.Answers)
+}
+
+func TestPollStartEventContent_MarshalStable(t *testing.T) {
+	content := &event.PollStartEventContent{
+		Question: "Favorite color?",
+		Kind:     event.PollKindUndisclosed,
+		Answers:  []event.PollAnswer{{"red", "Red"}},
+		Fallback: "Favorite color?",
+	}
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"m.poll": {
+			"kind": "m.undisclosed",
+			"question": {"m.text": [{"body": "Favorite color?"}]},
+			"answers": [{"m.id": "red", "m.text": [{"body": "Red"}]}]
+		},
+		"m.text": [{"body": "Favorite color?"}]
+	}`, string(data))
+
+	var parsed event.PollStartEventContent
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, *content, parsed)
+}
+
+func TestPollResponseEventContent_MarshalRetraction(t *testing.T) {
+	content := &event.PollResponseEventContent{RelatesTo: event.RelatesTo{Type: event.RelReference, EventID: "$poll"}}
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"m.relates_to": {"rel_type": "m.reference", "event_id": "$poll"}, "m.selections": []}`, string(data))
+}
+
+func TestPollAggregator(t *testing.T) {
+	agg := event.NewPollAggregator(parseEvent(t, unstablePollStartEvent))
+	ref := event.RelatesTo{Type: event.RelReference, EventID: "$poll"}
+	vote := func(sender id.UserID, ts int64, answers ...string) bool {
+		return agg.AddResponse(makeEvent(t, event.Event{Type: event.EventUnstablePollResponse, Sender: sender, Timestamp: ts}, &event.PollResponseEventContent{
+			RelatesTo: ref,
+			Answers:   answers,
+			Unstable:  true,
+		}))
+	}
+
+	assert.True(t, vote("@a:example.com", 2000, "red"))
+	// Later votes replace earlier ones, but older ones received late are ignored.
+	assert.True(t, vote("@a:example.com", 3000, "green", "blue", "red"))
+	assert.False(t, vote("@a:example.com", 2500, "red"))
+	// Unknown answers are ignored, which makes this a spoiled vote.
+	assert.True(t, vote("@b:example.com", 2000, "purple"))
+	assert.True(t, vote("@c:example.com", 2000, "blue", "blue"))
+	assert.True(t, vote("@d:example.com", 6000, "red"))
+	assert.False(t, agg.AddResponse(makeEvent(t, event.Event{Type: event.EventPollResponse, Sender: "@e:example.com", Timestamp: 2000}, &event.PollResponseEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelReference, EventID: "$other"},
+		Answers:   []string{"red"},
+	})))
+
+	endContent := &event.PollEndEventContent{RelatesTo: ref, Unstable: true}
+	assert.False(t, agg.End(makeEvent(t, event.Event{Type: event.EventUnstablePollEnd, Sender: "@a:example.com", Timestamp: 5000}, endContent)))
+	assert.False(t, agg.IsEnded())
+	assert.True(t, agg.End(makeEvent(t, event.Event{Type: event.EventUnstablePollEnd, Sender: "@tulir:maunium.net", Timestamp: 5000}, endContent)))
+	assert.True(t, agg.IsEnded())
+
+	assert.Equal(t, map[id.UserID][]string{
+		"@a:example.com": {"green", "blue"},
+		"@c:example.com": {"blue"},
+	}, agg.Votes())
+	assert.Equal(t, map[string]int{"red": 0, "green": 1, "blue": 2}, agg.Results())
+	assert.Equal(t, []string{"blue"}, agg.Winners())
+}
@@ -7,6 +7,7 @@
 package event
 
 import (
+	"encoding/json"
 	"sync"
 
 	"maunium.net/go/mautrix/id"
@@ -30,6 +31,78 @@ type PowerLevelsEventContent struct {
 	BanPtr        *int `json:"ban,omitempty"`
 	RedactPtr     *int `json:"redact,omitempty"`
 	HistoricalPtr *int `json:"historical,omitempty"`
+
+	Notifications *NotificationPowerLevels `json:"notifications,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// NotificationPowerLevels contains the power levels required to trigger specific types of notifications.
+type NotificationPowerLevels struct {
+	RoomPtr *int `json:"room,omitempty"`
+}
+
+func (npl *NotificationPowerLevels) Clone() *NotificationPowerLevels {
+	if npl == nil {
+		return nil
+	}
+	return &NotificationPowerLevels{RoomPtr: copyPtr(npl.RoomPtr)}
+}
+
+func copyPtr(ptr *int) *int {
+	if ptr == nil {
+		return nil
+	}
+	val := *ptr
+	return &val
+}
+
+// Clone returns a deep copy of the power levels, which can be safely modified without affecting the original.
+func (pl *PowerLevelsEventContent) Clone() *PowerLevelsEventContent {
+	if pl == nil {
+		return nil
+	}
+	pl.usersLock.RLock()
+	users := make(map[id.UserID]int, len(pl.Users))
+	for userID, level := range pl.Users {
+		users[userID] = level
+	}
+	pl.usersLock.RUnlock()
+	pl.eventsLock.RLock()
+	events := make(map[string]int, len(pl.Events))
+	for evtType, level := range pl.Events {
+		events[evtType] = level
+	}
+	pl.eventsLock.RUnlock()
+	return &PowerLevelsEventContent{
+		Users:         users,
+		UsersDefault:  pl.UsersDefault,
+		Events:        events,
+		EventsDefault: pl.EventsDefault,
+
+		StateDefaultPtr: copyPtr(pl.StateDefaultPtr),
+
+		InvitePtr:     copyPtr(pl.InvitePtr),
+		KickPtr:       copyPtr(pl.KickPtr),
+		BanPtr:        copyPtr(pl.BanPtr),
+		RedactPtr:     copyPtr(pl.RedactPtr),
+		HistoricalPtr: copyPtr(pl.HistoricalPtr),
+
+		Notifications: pl.Notifications.Clone(),
+
+		Extra: copyExtra(pl.Extra),
+	}
+}
+
+func copyExtra(extra map[string]json.RawMessage) map[string]json.RawMessage {
+	if extra == nil {
+		return nil
+	}
+	copied := make(map[string]json.RawMessage, len(extra))
+	for key, val := range extra {
+		copied[key] = append(json.RawMessage(nil), val...)
+	}
+	return copied
 }
 
 func (pl *PowerLevelsEventContent) Invite() int {
@@ -67,6 +140,18 @@ func (pl *PowerLevelsEventContent) Historical() int {
 	return 100
 }
 
+// NotificationLevel returns the power level required to trigger the given type of notification,
+// e.g. "room" for @room mentions.
+func (pl *PowerLevelsEventContent) NotificationLevel(key string) int {
+	switch key {
+	case "room":
+		if pl.Notifications != nil && pl.Notifications.RoomPtr != nil {
+			return *pl.Notifications.RoomPtr
+		}
+	}
+	return 50
+}
+
 func (pl *PowerLevelsEventContent) StateDefault() int {
 	if pl.StateDefaultPtr != nil {
 		return *pl.StateDefaultPtr
@@ -90,6 +175,9 @@ func (pl *PowerLevelsEventContent) SetUserLevel(userID id.UserID, level int) {
 	if level == pl.UsersDefault {
 		delete(pl.Users, userID)
 	} else {
+		if pl.Users == nil {
+			pl.Users = make(map[id.UserID]int)
+		}
 		pl.Users[userID] = level
 	}
 }
@@ -122,6 +210,9 @@ func (pl *PowerLevelsEventContent) SetEventLevel(eventType Type, level int) {
 	if (eventType.IsState() && level == pl.StateDefault()) || (!eventType.IsState() && level == pl.EventsDefault) {
 		delete(pl.Events, eventType.String())
 	} else {
+		if pl.Events == nil {
+			pl.Events = make(map[string]int)
+		}
 		pl.Events[eventType.String()] = level
 	}
 }
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPowerLevelsEventContent_Clone(t *testing.T) {
+	ban := 75
+	pl := &event.PowerLevelsEventContent{
+		Users:  map[id.UserID]int{"@tulir:maunium.net": 100},
+		Events: map[string]int{"m.room.name": 50},
+		BanPtr: &ban,
+	}
+	clone := pl.Clone()
+	clone.SetUserLevel("@tulir:maunium.net", 50)
+	clone.SetEventLevel(event.EventReaction, 10)
+	*clone.BanPtr = 100
+
+	assert.Equal(t, 100, pl.GetUserLevel("@tulir:maunium.net"))
+	assert.Equal(t, 0, pl.GetEventLevel(event.EventReaction))
+	assert.Equal(t, 75, pl.Ban())
+	assert.Equal(t, 50, clone.GetUserLevel("@tulir:maunium.net"))
+	assert.Equal(t, 10, clone.GetEventLevel(event.EventReaction))
+	assert.Equal(t, 100, clone.Ban())
+}
+
+func TestPowerLevelsEventContent_CloneRoundTrip(t *testing.T) {
+	input := `{"users": {"@alice:example.com": 100}, "state_default": 50, "notifications": {"room": 20}, "org.example.custom": {"level": 42}}`
+	var pl event.PowerLevelsEventContent
+	require.NoError(t, json.Unmarshal([]byte(input), &pl))
+	clone := pl.Clone()
+	output, err := json.Marshal(clone)
+	require.NoError(t, err)
+	assert.JSONEq(t, input, string(output))
+
+	clone.Extra["org.example.custom"][2] = 'x'
+	clone.Extra["org.example.other"] = json.RawMessage(`true`)
+	assert.JSONEq(t, `{"level": 42}`, string(pl.Extra["org.example.custom"]))
+	assert.NotContains(t, pl.Extra, "org.example.other")
+}
+
+func TestPowerLevelsEventContent_SetLevelsOnEmpty(t *testing.T) {
+	pl := &event.PowerLevelsEventContent{}
+	assert.True(t, pl.EnsureUserLevel("@tulir:maunium.net", 100))
+	assert.True(t, pl.EnsureEventLevel(event.StateTopic, 0))
+	assert.False(t, pl.EnsureUserLevel("@tulir:maunium.net", 100))
+	assert.Equal(t, 100, pl.GetUserLevel("@tulir:maunium.net"))
+	assert.Equal(t, 0, pl.GetEventLevel(event.StateTopic))
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// PerMessageProfile is a profile override for a single message, which can be used by relay bots and bridges to show
+// the name and avatar of the real sender without creating a separate user for them.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4144
+type PerMessageProfile struct {
+	// An opaque identifier for the profile. Clients may group consecutive messages with the same ID.
+	ID          string              `json:"id"`
+	Displayname string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	// Whether the body of the message contains a fallback for clients that don't support per-message profiles.
+	HasFallback bool `json:"has_fallback,omitempty"`
+}
+
+const perMessageProfileFallbackHTML = `<strong data-mx-profile-fallback>%s: </strong>`
+
+var HTMLProfileFallbackRegex = regexp.MustCompile(`^<strong data-mx-profile-fallback>[\s\S]*?</strong>`)
+
+// SetPerMessageProfile sets the per-message profile of the message. If addFallback is true and the profile has a
+// displayname, the name is also prepended to the body for clients that don't support per-message profiles.
+//
+// The fallback should be added after the body and formatted body are otherwise complete, and before calling SetEdit.
+func (content *MessageEventContent) SetPerMessageProfile(profile PerMessageProfile, addFallback bool) {
+	profile.HasFallback = addFallback && len(profile.Displayname) > 0
+	if profile.HasFallback {
+		if content.Format != FormatHTML {
+			content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+			content.Format = FormatHTML
+		}
+		content.Body = fmt.Sprintf("%s: %s", profile.Displayname, content.Body)
+		content.FormattedBody = fmt.Sprintf(perMessageProfileFallbackHTML, html.EscapeString(profile.Displayname)) + content.FormattedBody
+	}
+	content.PerMessageProfile = &profile
+}
+
+// RemovePerMessageProfileFallback removes the displayname fallback that was added to the body by SetPerMessageProfile.
+func (content *MessageEventContent) RemovePerMessageProfileFallback() {
+	if content.PerMessageProfile == nil || !content.PerMessageProfile.HasFallback {
+		return
+	}
+	if content.Format == FormatHTML {
+		content.FormattedBody = HTMLProfileFallbackRegex.ReplaceAllString(content.FormattedBody, "")
+	}
+	content.Body = strings.TrimPrefix(content.Body, content.PerMessageProfile.Displayname+": ")
+	content.PerMessageProfile.HasFallback = false
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+var (
+	// registryLock protects TypeMap and the other registries below after init.
+	// Packages that modify TypeMap directly in their init functions don't need to lock it.
+	registryLock sync.RWMutex
+
+	customTypeClasses = make(map[string]TypeClass)
+	// MessageTypeMap is a mapping from custom msgtypes to structs that contain the custom fields of the msgtype.
+	MessageTypeMap = make(map[MessageType]reflect.Type)
+)
+
+// RegisterEventType registers a custom event type, so that Content.ParseRaw can parse the content into the given struct.
+// The content argument should be a pointer to an empty instance of the struct, e.g. &CustomEventContent{}.
+//
+// The class of the type will also be used by Type.GuessClass, which means events with the type will have
+// the correct class when parsed outside of /sync responses.
+//
+// This is safe to call at any time, but it's recommended to register types in init functions.
+func RegisterEventType(evtType Type, content interface{}) {
+	structType := reflect.TypeOf(content)
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	gob.Register(reflect.New(structType).Interface())
+	registryLock.Lock()
+	TypeMap[evtType] = structType
+	if evtType.Class != UnknownEventType {
+		customTypeClasses[evtType.Type] = evtType.Class
+	}
+	registryLock.Unlock()
+}
+
+// RegisterMessageType registers a custom msgtype for m.room.message events. When a MessageEventContent with the
+// given msgtype is unmarshaled, the content is also parsed into the given struct and stored in the Custom field.
+// The content argument should be a pointer to an empty instance of the struct, e.g. &CustomMessageFields{}.
+//
+// When marshaling, the fields of the Custom struct are merged into the output. Standard fields of
+// MessageEventContent take priority if both contain the same key.
+func RegisterMessageType(msgType MessageType, content interface{}) {
+	structType := reflect.TypeOf(content)
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	gob.Register(reflect.New(structType).Interface())
+	registryLock.Lock()
+	MessageTypeMap[msgType] = structType
+	registryLock.Unlock()
+}
+
+func getContentStructType(evtType Type) (reflect.Type, bool) {
+	registryLock.RLock()
+	structType, ok := TypeMap[evtType]
+	registryLock.RUnlock()
+	return structType, ok
+}
+
+func getCustomTypeClass(evtType string) (TypeClass, bool) {
+	registryLock.RLock()
+	class, ok := customTypeClasses[evtType]
+	registryLock.RUnlock()
+	return class, ok
+}
+
+func getMessageStructType(msgType MessageType) (reflect.Type, bool) {
+	registryLock.RLock()
+	structType, ok := MessageTypeMap[msgType]
+	registryLock.RUnlock()
+	return structType, ok
+}
+
+// parseCustomMessageType parses the custom fields of a registered msgtype. It returns nil if the msgtype isn't registered.
+func parseCustomMessageType(msgType MessageType, data []byte) (interface{}, error) {
+	structType, ok := getMessageStructType(msgType)
+	if !ok {
+		return nil, nil
+	}
+	custom := reflect.New(structType).Interface()
+	err := json.Unmarshal(data, custom)
+	if err != nil {
+		return nil, err
+	}
+	return custom, nil
+}
+
+// mergeCustomFields returns the extra fields to add when marshaling message content: the fields of the custom struct
+// override the unknown fields from the original JSON.
+func mergeCustomFields(custom interface{}, extra map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	if custom == nil {
+		return extra, nil
+	}
+	data, err := json.Marshal(custom)
+	if err != nil {
+		return nil, err
+	}
+	var customFields map[string]json.RawMessage
+	err = json.Unmarshal(data, &customFields)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]json.RawMessage, len(extra)+len(customFields))
+	for key, value := range extra {
+		merged[key] = value
+	}
+	for key, value := range customFields {
+		merged[key] = value
+	}
+	return merged, nil
+}
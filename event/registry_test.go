@@ -0,0 +1,56 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+type customEventContent struct {
+	Counter int `json:"counter"`
+}
+
+var customEventType = event.Type{Type: "com.example.counter", Class: event.MessageEventType}
+
+type customMessageFields struct {
+	Location string `json:"com.example.location"`
+}
+
+const customMsgType event.MessageType = "com.example.checkin"
+
+func init() {
+	event.RegisterEventType(customEventType, &customEventContent{})
+	event.RegisterMessageType(customMsgType, &customMessageFields{})
+}
+
+func TestRegisterEventType(t *testing.T) {
+	evt := parseEvent(t, `{"type": "com.example.counter", "event_id": "$a", "sender": "@a:example.com", "content": {"counter": 5}}`)
+	assert.Equal(t, event.MessageEventType, evt.Type.Class)
+	assert.Equal(t, 5, evt.Content.Parsed.(*customEventContent).Counter)
+}
+
+func TestRegisterMessageType(t *testing.T) {
+	var content event.MessageEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"msgtype": "com.example.checkin", "body": "checked in", "com.example.location": "office"}`), &content))
+	custom, ok := content.Custom.(*customMessageFields)
+	require.True(t, ok)
+	assert.Equal(t, "office", custom.Location)
+
+	custom.Location = "home"
+	data, err := json.Marshal(&content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"msgtype": "com.example.checkin", "body": "checked in", "com.example.location": "home"}`, string(data))
+
+	require.NoError(t, json.Unmarshal([]byte(`{"msgtype": "m.text", "body": "hi"}`), &content))
+	assert.Nil(t, content.Custom)
+}
@@ -18,6 +18,7 @@ const (
 	RelReplace    RelationType = "m.replace"
 	RelReference  RelationType = "m.reference"
 	RelAnnotation RelationType = "m.annotation"
+	RelThread     RelationType = "m.thread"
 	RelReply      RelationType = "net.maunium.reply"
 )
 
@@ -25,6 +26,12 @@ type RelatesTo struct {
 	Type    RelationType
 	EventID id.EventID
 	Key     string
+
+	// The m.in_reply_to event ID for relations that have both a rel_type and a reply (i.e. threads).
+	// For plain replies, the event ID is in EventID and Type is RelReply.
+	InReplyTo id.EventID
+	// Whether InReplyTo is only a fallback for clients that don't support threads.
+	IsFallingBack bool
 }
 
 type serializableInReplyTo struct {
@@ -34,9 +41,10 @@ type serializableInReplyTo struct {
 type serializableRelatesTo struct {
 	InReplyTo *serializableInReplyTo `json:"m.in_reply_to,omitempty"`
 
-	Type    RelationType `json:"rel_type,omitempty"`
-	EventID id.EventID   `json:"event_id,omitempty"`
-	Key     string       `json:"key,omitempty"`
+	Type          RelationType `json:"rel_type,omitempty"`
+	EventID       id.EventID   `json:"event_id,omitempty"`
+	Key           string       `json:"key,omitempty"`
+	IsFallingBack bool         `json:"is_falling_back,omitempty"`
 }
 
 func (rel *RelatesTo) GetReplaceID() id.EventID {
@@ -56,6 +64,15 @@ func (rel *RelatesTo) GetReferenceID() id.EventID {
 func (rel *RelatesTo) GetReplyID() id.EventID {
 	if rel.Type == RelReply {
 		return rel.EventID
+	} else if !rel.IsFallingBack {
+		return rel.InReplyTo
+	}
+	return ""
+}
+
+func (rel *RelatesTo) GetThreadID() id.EventID {
+	if rel.Type == RelThread {
+		return rel.EventID
 	}
 	return ""
 }
@@ -83,6 +100,10 @@ func (rel *RelatesTo) UnmarshalJSON(data []byte) error {
 		rel.Type = srel.Type
 		rel.EventID = srel.EventID
 		rel.Key = srel.Key
+		rel.IsFallingBack = srel.IsFallingBack
+		if srel.InReplyTo != nil {
+			rel.InReplyTo = srel.InReplyTo.EventID
+		}
 	} else if srel.InReplyTo != nil && len(srel.InReplyTo.EventID) > 0 {
 		rel.Type = RelReply
 		rel.EventID = srel.InReplyTo.EventID
@@ -92,9 +113,11 @@ func (rel *RelatesTo) UnmarshalJSON(data []byte) error {
 }
 
 func (rel *RelatesTo) MarshalJSON() ([]byte, error) {
-	srel := serializableRelatesTo{Type: rel.Type, EventID: rel.EventID, Key: rel.Key}
+	srel := serializableRelatesTo{Type: rel.Type, EventID: rel.EventID, Key: rel.Key, IsFallingBack: rel.IsFallingBack}
 	if rel.Type == RelReply {
 		srel.InReplyTo = &serializableInReplyTo{rel.EventID}
+	} else if len(rel.InReplyTo) > 0 {
+		srel.InReplyTo = &serializableInReplyTo{rel.InReplyTo}
 	}
 	return json.Marshal(&srel)
 }
@@ -140,6 +163,7 @@ func (ac *AnnotationChunk) Serialize() RelationChunk {
 			Key:   key,
 			Count: count,
 		}
+		i++
 	}
 	return ac.RelationChunk
 }
@@ -178,15 +202,34 @@ type Relations struct {
 	Annotations AnnotationChunk `json:"m.annotation,omitempty"`
 	References  EventIDChunk    `json:"m.reference,omitempty"`
 	Replaces    EventIDChunk    `json:"m.replace,omitempty"`
+	Thread      *ThreadSummary  `json:"m.thread,omitempty"`
+
+	// The latest edit of the event. Depending on the server version, this may be the full event,
+	// or only contain the event ID, sender and timestamp. Older servers only populate Replaces instead.
+	Replace *Event `json:"-"`
 }
 
 type serializableRelations Relations
 
+type bundledReplace struct {
+	Replace *Event `json:"m.replace"`
+}
+
 func (relations *Relations) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &relations.Raw); err != nil {
 		return err
+	} else if err = json.Unmarshal(data, (*serializableRelations)(relations)); err != nil {
+		return err
+	}
+	var replace bundledReplace
+	// The old chunk format of m.replace won't unmarshal into an event, so errors are ignored here.
+	if json.Unmarshal(data, &replace) == nil && replace.Replace != nil && len(replace.Replace.ID) > 0 {
+		relations.Replace = replace.Replace
+		if replace.Replace.Content.VeryRaw != nil {
+			_ = replace.Replace.Content.ParseRaw(replace.Replace.Type)
+		}
 	}
-	return json.Unmarshal(data, (*serializableRelations)(relations))
+	return nil
 }
 
 func (relations *Relations) MarshalJSON() ([]byte, error) {
@@ -196,5 +239,54 @@ func (relations *Relations) MarshalJSON() ([]byte, error) {
 	relations.Raw[RelAnnotation] = relations.Annotations.Serialize()
 	relations.Raw[RelReference] = relations.References.Serialize(RelReference)
 	relations.Raw[RelReplace] = relations.Replaces.Serialize(RelReplace)
-	return json.Marshal(relations.Raw)
+	if relations.Thread == nil && relations.Replace == nil {
+		return json.Marshal(relations.Raw)
+	}
+	withAggregations := make(map[RelationType]interface{}, len(relations.Raw)+1)
+	for relType, chunk := range relations.Raw {
+		withAggregations[relType] = chunk
+	}
+	if relations.Thread != nil {
+		withAggregations[RelThread] = relations.Thread
+	}
+	if relations.Replace != nil {
+		withAggregations[RelReplace] = relations.Replace
+	}
+	return json.Marshal(withAggregations)
+}
+
+// IsEdited returns whether the server has bundled an edit with the event.
+func (relations *Relations) IsEdited() bool {
+	return relations.Replace != nil || len(relations.Replaces.List) > 0
+}
+
+// LatestEditID returns the ID of the latest edit bundled with the event, or an empty string if there are no edits.
+func (relations *Relations) LatestEditID() id.EventID {
+	if relations.Replace != nil {
+		return relations.Replace.ID
+	} else if len(relations.Replaces.List) > 0 {
+		return id.EventID(relations.Replaces.List[len(relations.Replaces.List)-1])
+	}
+	return ""
+}
+
+// ReactionCount returns the number of reactions with the given key.
+func (relations *Relations) ReactionCount(key string) int {
+	return relations.Annotations.Map[key]
+}
+
+// ReferenceCount returns the number of events referencing the event.
+func (relations *Relations) ReferenceCount() int {
+	if relations.References.Count > len(relations.References.List) {
+		return relations.References.Count
+	}
+	return len(relations.References.List)
+}
+
+// ThreadCount returns the number of events in the thread if the event is a thread root.
+func (relations *Relations) ThreadCount() int {
+	if relations.Thread == nil {
+		return 0
+	}
+	return relations.Thread.Count
 }
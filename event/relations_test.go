@@ -0,0 +1,71 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const bundledAggregationsEvent = `{
+	"type": "m.room.message",
+	"event_id": "$original",
+	"sender": "@alice:example.com",
+	"content": {"msgtype": "m.text", "body": "helo"},
+	"unsigned": {
+		"m.relations": {
+			"m.annotation": {"chunk": [{"type": "m.reaction", "key": "👍", "count": 3}, {"type": "m.reaction", "key": "🎉", "count": 1}]},
+			"m.reference": {"chunk": [{"event_id": "$ref1"}, {"event_id": "$ref2"}]},
+			"m.replace": {
+				"type": "m.room.message",
+				"event_id": "$edit",
+				"sender": "@alice:example.com",
+				"origin_server_ts": 1234,
+				"content": {
+					"msgtype": "m.text",
+					"body": "* hello",
+					"m.new_content": {"msgtype": "m.text", "body": "hello"},
+					"m.relates_to": {"rel_type": "m.replace", "event_id": "$original"}
+				}
+			}
+		}
+	}
+}`
+
+func TestRelations_BundledAggregations(t *testing.T) {
+	evt := parseEvent(t, bundledAggregationsEvent)
+	relations := &evt.Unsigned.Relations
+	assert.Equal(t, 3, relations.ReactionCount("👍"))
+	assert.Equal(t, 0, relations.ReactionCount("👎"))
+	assert.Equal(t, 2, relations.ReferenceCount())
+	assert.Equal(t, 0, relations.ThreadCount())
+
+	require.True(t, relations.IsEdited())
+	assert.Equal(t, id.EventID("$edit"), relations.LatestEditID())
+	assert.Equal(t, "hello", relations.Replace.Content.AsMessage().NewContent.Body)
+
+	data, err := json.Marshal(evt)
+	require.NoError(t, err)
+	var roundtrip *event.Event
+	require.NoError(t, json.Unmarshal(data, &roundtrip))
+	assert.Equal(t, id.EventID("$edit"), roundtrip.Unsigned.Relations.LatestEditID())
+	assert.Equal(t, 1, roundtrip.Unsigned.Relations.ReactionCount("🎉"))
+}
+
+func TestRelations_LegacyReplaceChunk(t *testing.T) {
+	var relations event.Relations
+	require.NoError(t, json.Unmarshal([]byte(`{"m.replace": {"chunk": [{"type": "m.room.message", "event_id": "$edit"}]}}`), &relations))
+	assert.Nil(t, relations.Replace)
+	assert.True(t, relations.IsEdited())
+	assert.Equal(t, id.EventID("$edit"), relations.LatestEditID())
+}
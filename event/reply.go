@@ -8,6 +8,7 @@ package event
 
 import (
 	"fmt"
+	"net/url"
 	"regexp"
 	"strings"
 
@@ -28,7 +29,7 @@ func TrimReplyFallbackText(text string) string {
 	}
 
 	lines := strings.Split(text, "\n")
-	for len(lines) > 0 && strings.HasPrefix(lines[0], "> ") {
+	for len(lines) > 0 && (strings.HasPrefix(lines[0], "> ") || lines[0] == ">") {
 		lines = lines[1:]
 	}
 	return strings.TrimSpace(strings.Join(lines, "\n"))
@@ -45,44 +46,101 @@ func (content *MessageEventContent) RemoveReplyFallback() {
 }
 
 func (content *MessageEventContent) GetReplyTo() id.EventID {
-	if content.RelatesTo != nil && content.RelatesTo.Type == RelReply {
-		return content.RelatesTo.EventID
+	if content.RelatesTo != nil {
+		return content.RelatesTo.GetReplyID()
 	}
 	return ""
 }
 
-const ReplyFormat = `<mx-reply><blockquote><a href="https://matrix.to/#/%s/%s">In reply to</a> <a href="https://matrix.to/#/%s">%s</a><br>%s</blockquote></mx-reply>`
+const ReplyFormat = `<mx-reply><blockquote><a href="%s">In reply to</a> <a href="https://matrix.to/#/%s">%s</a><br>%s</blockquote></mx-reply>`
 
-func (evt *Event) GenerateReplyFallbackHTML() string {
+// Permalink returns a matrix.to link to the event. The server of the sender is used as the via parameter,
+// so that clients that aren't in the room can still find the event.
+//
+// Unlike id.MatrixURI.MatrixToURL, the IDs aren't percent-encoded, to match the reply fallbacks that Element generates.
+func (evt *Event) Permalink() string {
+	link := fmt.Sprintf("https://matrix.to/#/%s/%s", evt.RoomID, evt.ID)
+	if _, server, err := evt.Sender.Parse(); err == nil && len(server) > 0 {
+		link += "?via=" + url.QueryEscape(server)
+	}
+	return link
+}
+
+// replyFallbackContent returns a copy of the message content with its own reply fallback removed,
+// so that generating a fallback doesn't modify the event being replied to.
+func (evt *Event) replyFallbackContent() (*MessageEventContent, bool) {
 	parsedContent, ok := evt.Content.Parsed.(*MessageEventContent)
+	if !ok {
+		return nil, false
+	}
+	contentCopy := *parsedContent
+	contentCopy.RemoveReplyFallback()
+	return &contentCopy, true
+}
+
+// replyFallbackMediaText returns the text used in reply fallbacks instead of the body of media messages.
+func (evt *Event) replyFallbackMediaText(content *MessageEventContent) string {
+	if evt.Type == EventSticker {
+		return "sent a sticker."
+	}
+	switch content.MsgType {
+	case MsgImage:
+		return "sent an image."
+	case MsgVideo:
+		return "sent a video."
+	case MsgAudio:
+		return "sent an audio file."
+	case MsgFile:
+		return "sent a file."
+	case MsgLocation:
+		return "sent a location."
+	default:
+		return ""
+	}
+}
+
+func (evt *Event) GenerateReplyFallbackHTML() string {
+	parsedContent, ok := evt.replyFallbackContent()
 	if !ok {
 		return ""
 	}
-	parsedContent.RemoveReplyFallback()
-	body := parsedContent.FormattedBody
+	body := evt.replyFallbackMediaText(parsedContent)
 	if len(body) == 0 {
-		body = strings.ReplaceAll(html.EscapeString(parsedContent.Body), "\n", "<br/>")
+		if parsedContent.Format == FormatHTML && len(parsedContent.FormattedBody) > 0 {
+			body = parsedContent.FormattedBody
+		} else {
+			body = strings.ReplaceAll(html.EscapeString(parsedContent.Body), "\n", "<br/>")
+		}
+	}
+	if parsedContent.MsgType == MsgEmote {
+		body = "* " + body
 	}
 
 	senderDisplayName := evt.Sender
 
-	return fmt.Sprintf(ReplyFormat, evt.RoomID, evt.ID, evt.Sender, senderDisplayName, body)
+	return fmt.Sprintf(ReplyFormat, html.EscapeString(evt.Permalink()), evt.Sender, senderDisplayName, body)
 }
 
 func (evt *Event) GenerateReplyFallbackText() string {
-	parsedContent, ok := evt.Content.Parsed.(*MessageEventContent)
+	parsedContent, ok := evt.replyFallbackContent()
 	if !ok {
 		return ""
 	}
-	parsedContent.RemoveReplyFallback()
-	body := parsedContent.Body
+	body := evt.replyFallbackMediaText(parsedContent)
+	if len(body) == 0 {
+		body = parsedContent.Body
+	}
 	lines := strings.Split(strings.TrimSpace(body), "\n")
 	firstLine, lines := lines[0], lines[1:]
 
 	senderDisplayName := evt.Sender
 
 	var fallbackText strings.Builder
-	_, _ = fmt.Fprintf(&fallbackText, "> <%s> %s", senderDisplayName, firstLine)
+	if parsedContent.MsgType == MsgEmote {
+		_, _ = fmt.Fprintf(&fallbackText, "> * <%s> %s", senderDisplayName, firstLine)
+	} else {
+		_, _ = fmt.Fprintf(&fallbackText, "> <%s> %s", senderDisplayName, firstLine)
+	}
 	for _, line := range lines {
 		_, _ = fmt.Fprintf(&fallbackText, "\n> %s", line)
 	}
@@ -90,13 +148,19 @@ func (evt *Event) GenerateReplyFallbackText() string {
 	return fallbackText.String()
 }
 
+// SetReply makes the message a reply to the given event.
+//
+// Text, notice and emote messages will also get a reply fallback in both the plaintext body and the HTML
+// formatted_body (the formatted body is generated from the plaintext one if necessary). Any existing fallback
+// is replaced. The content of the event being replied to must be parsed for the fallback to be generated.
 func (content *MessageEventContent) SetReply(inReplyTo *Event) {
+	content.RemoveReplyFallback()
 	content.RelatesTo = &RelatesTo{
 		EventID: inReplyTo.ID,
 		Type:    RelReply,
 	}
 
-	if content.MsgType == MsgText || content.MsgType == MsgNotice {
+	if content.MsgType == MsgText || content.MsgType == MsgNotice || content.MsgType == MsgEmote {
 		if len(content.FormattedBody) == 0 || content.Format != FormatHTML {
 			content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br/>")
 			content.Format = FormatHTML
@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestMessageEventContent_SetReply(t *testing.T) {
+	original := &event.Event{
+		ID:     "$original",
+		RoomID: "!room:example.com",
+		Sender: "@alice:example.com",
+		Type:   event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "hello\nworld",
+		}},
+	}
+	reply := &event.MessageEventContent{MsgType: event.MsgText, Body: "hi <3"}
+	reply.SetReply(original)
+	assert.Equal(t, "> <@alice:example.com> hello\n> world\n\nhi <3", reply.Body)
+	assert.Equal(t, event.FormatHTML, reply.Format)
+	assert.Contains(t, reply.FormattedBody, "hello<br/>world</blockquote></mx-reply>hi &lt;3")
+
+	original.ID = "$reply"
+	original.Content.Parsed = reply
+	nested := &event.MessageEventContent{MsgType: event.MsgEmote, Body: "waves"}
+	nested.SetReply(original)
+	assert.Equal(t, "> <@alice:example.com> hi <3\n\nwaves", nested.Body)
+	assert.NotContains(t, nested.FormattedBody, "hello")
+	assert.Contains(t, reply.Body, "> <@alice:example.com> hello", "generating a fallback shouldn't modify the replied-to event")
+
+	nested.RemoveReplyFallback()
+	assert.Equal(t, "waves", nested.Body)
+	assert.Equal(t, "waves", nested.FormattedBody)
+}
+
+func TestMessageEventContent_SetReply_Media(t *testing.T) {
+	image := &event.Event{
+		ID:      "$image",
+		Sender:  "@alice:example.com",
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png"}},
+	}
+	reply := &event.MessageEventContent{MsgType: event.MsgText, Body: "cute"}
+	reply.SetReply(image)
+	assert.Equal(t, "> <@alice:example.com> sent an image.\n\ncute", reply.Body)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	ErrServerACLDeniesSender = errors.New("server ACL would deny the sender's own server")
+	ErrServerACLNoAllowed    = errors.New("server ACL doesn't allow any servers")
+)
+
+// NewServerACL creates a server ACL that allows all servers except IP literals.
+func NewServerACL() *ServerACLEventContent {
+	return &ServerACLEventContent{Allow: []string{"*"}}
+}
+
+func addUniqueString(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+func removeString(list []string, value string) []string {
+	filtered := list[:0]
+	for _, existing := range list {
+		if existing != value {
+			filtered = append(filtered, existing)
+		}
+	}
+	return filtered
+}
+
+// AddAllow adds the given server name glob to the allow list, unless it's already there.
+func (acl *ServerACLEventContent) AddAllow(server string) {
+	acl.Allow = addUniqueString(acl.Allow, server)
+}
+
+// RemoveAllow removes the given server name glob from the allow list.
+func (acl *ServerACLEventContent) RemoveAllow(server string) {
+	acl.Allow = removeString(acl.Allow, server)
+}
+
+// AddDeny adds the given server name glob to the deny list, unless it's already there.
+func (acl *ServerACLEventContent) AddDeny(server string) {
+	acl.Deny = addUniqueString(acl.Deny, server)
+}
+
+// RemoveDeny removes the given server name glob from the deny list.
+func (acl *ServerACLEventContent) RemoveDeny(server string) {
+	acl.Deny = removeString(acl.Deny, server)
+}
+
+func isIPLiteral(host string) bool {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return true
+	}
+	return net.ParseIP(host) != nil
+}
+
+func stripServerPort(serverName string) string {
+	if strings.HasPrefix(serverName, "[") {
+		if end := strings.IndexRune(serverName, ']'); end > 0 {
+			return serverName[:end+1]
+		}
+		return serverName
+	} else if colon := strings.LastIndexByte(serverName, ':'); colon > 0 {
+		return serverName[:colon]
+	}
+	return serverName
+}
+
+func matchesAnyGlob(globs []string, value string) bool {
+	for _, glob := range globs {
+		if CompilePolicyGlob(glob).MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowed checks whether the given server name passes the ACL. The port of the server name is ignored.
+// https://spec.matrix.org/v1.4/client-server-api/#server-access-control-lists-acls-for-rooms
+func (acl *ServerACLEventContent) IsAllowed(serverName string) bool {
+	host := stripServerPort(serverName)
+	if !acl.AllowIPLiterals && isIPLiteral(host) {
+		return false
+	} else if matchesAnyGlob(acl.Deny, host) {
+		return false
+	}
+	return matchesAnyGlob(acl.Allow, host)
+}
+
+// Validate checks that the ACL doesn't lock out the server of the user who is about to send it.
+func (acl *ServerACLEventContent) Validate(senderServer string) error {
+	if len(acl.Allow) == 0 {
+		return ErrServerACLNoAllowed
+	} else if !acl.IsAllowed(senderServer) {
+		return fmt.Errorf("%w (%s)", ErrServerACLDeniesSender, senderServer)
+	}
+	return nil
+}
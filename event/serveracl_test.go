@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestServerACLEventContent_IsAllowed(t *testing.T) {
+	acl := event.NewServerACL()
+	acl.AddDeny("*.evil.com")
+	acl.AddDeny("evil.com")
+	acl.AddDeny("evil.com")
+	assert.Equal(t, []string{"*.evil.com", "evil.com"}, acl.Deny)
+
+	assert.True(t, acl.IsAllowed("example.com"))
+	assert.True(t, acl.IsAllowed("example.com:8448"))
+	assert.False(t, acl.IsAllowed("evil.com:8448"))
+	assert.False(t, acl.IsAllowed("matrix.evil.com"))
+	assert.False(t, acl.IsAllowed("1.2.3.4"))
+	assert.False(t, acl.IsAllowed("[1234:5678::abcd]:8448"))
+
+	acl.AllowIPLiterals = true
+	assert.True(t, acl.IsAllowed("1.2.3.4:8448"))
+
+	acl.RemoveDeny("evil.com")
+	assert.True(t, acl.IsAllowed("evil.com"))
+}
+
+func TestServerACLEventContent_Validate(t *testing.T) {
+	acl := event.NewServerACL()
+	assert.NoError(t, acl.Validate("example.com"))
+	acl.AddDeny("example.*")
+	assert.True(t, errors.Is(acl.Validate("example.com"), event.ErrServerACLDeniesSender))
+	acl.RemoveAllow("*")
+	assert.True(t, errors.Is(acl.Validate("example.com"), event.ErrServerACLNoAllowed))
+}
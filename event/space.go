@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"errors"
+	"sort"
+)
+
+// MaxSpaceOrderLength is the maximum length of the order field in m.space.child events.
+const MaxSpaceOrderLength = 50
+
+var ErrInvalidSpaceOrder = errors.New("invalid space child order")
+
+// ValidateSpaceOrder checks that the given m.space.child order is valid: at most 50 characters,
+// all of which must be printable ASCII (0x20 - 0x7E).
+// https://spec.matrix.org/v1.4/client-server-api/#ordering-of-children-within-a-space
+func ValidateSpaceOrder(order string) error {
+	if len(order) > MaxSpaceOrderLength {
+		return ErrInvalidSpaceOrder
+	}
+	for i := 0; i < len(order); i++ {
+		if order[i] < 0x20 || order[i] > 0x7E {
+			return ErrInvalidSpaceOrder
+		}
+	}
+	return nil
+}
+
+// IsValid returns whether the space child event is valid. Child events without any via servers
+// are treated as if they don't exist, which is how children are removed from a space.
+func (content *SpaceChildEventContent) IsValid() bool {
+	return len(content.Via) > 0
+}
+
+// AddVia adds the given servers to the via list, skipping ones that are already there.
+func (content *SpaceChildEventContent) AddVia(servers ...string) {
+	for _, server := range servers {
+		content.Via = addUniqueString(content.Via, server)
+	}
+}
+
+// RemoveVia removes the given server from the via list.
+func (content *SpaceChildEventContent) RemoveVia(server string) {
+	content.Via = removeString(content.Via, server)
+}
+
+// IsValid returns whether the space parent event is valid, i.e. whether it has at least one via server.
+func (content *SpaceParentEventContent) IsValid() bool {
+	return len(content.Via) > 0
+}
+
+// AddVia adds the given servers to the via list, skipping ones that are already there.
+func (content *SpaceParentEventContent) AddVia(servers ...string) {
+	for _, server := range servers {
+		content.Via = addUniqueString(content.Via, server)
+	}
+}
+
+// SortSpaceChildren sorts m.space.child events in the order defined in the spec: children with a valid order
+// come first sorted by the order, then the rest by the timestamp of the child event, and finally by room ID.
+// Invalid child events (without via servers) are removed. The content of the events must already be parsed.
+func SortSpaceChildren(children []*Event) []*Event {
+	valid := make([]*Event, 0, len(children))
+	for _, evt := range children {
+		content, ok := evt.Content.Parsed.(*SpaceChildEventContent)
+		if ok && content.IsValid() && evt.StateKey != nil {
+			valid = append(valid, evt)
+		}
+	}
+	orderOf := func(evt *Event) (string, bool) {
+		order := evt.Content.AsSpaceChild().Order
+		return order, len(order) > 0 && ValidateSpaceOrder(order) == nil
+	}
+	sort.SliceStable(valid, func(i, j int) bool {
+		orderI, hasOrderI := orderOf(valid[i])
+		orderJ, hasOrderJ := orderOf(valid[j])
+		if hasOrderI != hasOrderJ {
+			return hasOrderI
+		} else if hasOrderI && orderI != orderJ {
+			return orderI < orderJ
+		} else if valid[i].Timestamp != valid[j].Timestamp {
+			return valid[i].Timestamp < valid[j].Timestamp
+		}
+		return *valid[i].StateKey < *valid[j].StateKey
+	})
+	return valid
+}
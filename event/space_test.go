@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestValidateSpaceOrder(t *testing.T) {
+	assert.NoError(t, event.ValidateSpaceOrder(""))
+	assert.NoError(t, event.ValidateSpaceOrder("a~ !"))
+	assert.Error(t, event.ValidateSpaceOrder(strings.Repeat("a", 51)))
+	assert.Error(t, event.ValidateSpaceOrder("ä"))
+	assert.Error(t, event.ValidateSpaceOrder("\n"))
+}
+
+func TestSortSpaceChildren(t *testing.T) {
+	makeSpaceChild := func(roomID, order string, ts int64, via ...string) *event.Event {
+		return makeEvent(t, event.Event{Type: event.StateSpaceChild, StateKey: &roomID, Timestamp: ts}, &event.SpaceChildEventContent{Via: via, Order: order})
+	}
+	sorted := event.SortSpaceChildren([]*event.Event{
+		makeSpaceChild("!d:example.com", "", 1, "example.com"),
+		makeSpaceChild("!c:example.com", "", 1, "example.com"),
+		makeSpaceChild("!removed:example.com", "a", 1),
+		makeSpaceChild("!b:example.com", "b", 5, "example.com"),
+		makeSpaceChild("!a:example.com", "a", 9, "example.com"),
+		makeSpaceChild("!invalid:example.com", "\n", 0, "example.com"),
+	})
+	var roomIDs []string
+	for _, evt := range sorted {
+		roomIDs = append(roomIDs, *evt.StateKey)
+	}
+	assert.Equal(t, []string{"!a:example.com", "!b:example.com", "!invalid:example.com", "!c:example.com", "!d:example.com"}, roomIDs)
+}
@@ -7,6 +7,8 @@
 package event
 
 import (
+	"encoding/json"
+
 	"maunium.net/go/mautrix/id"
 )
 
@@ -15,18 +17,24 @@ import (
 type CanonicalAliasEventContent struct {
 	Alias      id.RoomAlias   `json:"alias"`
 	AltAliases []id.RoomAlias `json:"alt_aliases,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // RoomNameEventContent represents the content of a m.room.name state event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-name
 type RoomNameEventContent struct {
 	Name string `json:"name"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // RoomAvatarEventContent represents the content of a m.room.avatar state event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-avatar
 type RoomAvatarEventContent struct {
 	URL id.ContentURI `json:"url"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // ServerACLEventContent represents the content of a m.room.server_acl state event.
@@ -35,12 +43,16 @@ type ServerACLEventContent struct {
 	Allow           []string `json:"allow,omitempty"`
 	AllowIPLiterals bool     `json:"allow_ip_literals"`
 	Deny            []string `json:"deny,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // TopicEventContent represents the content of a m.room.topic state event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-topic
 type TopicEventContent struct {
 	Topic string `json:"topic"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // TombstoneEventContent represents the content of a m.room.tombstone state event.
@@ -48,19 +60,61 @@ type TopicEventContent struct {
 type TombstoneEventContent struct {
 	Body            string    `json:"body"`
 	ReplacementRoom id.RoomID `json:"replacement_room"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Predecessor is a reference to the room that a room replaced.
+type Predecessor struct {
+	RoomID  id.RoomID  `json:"room_id"`
+	EventID id.EventID `json:"event_id"`
 }
 
 // CreateEventContent represents the content of a m.room.create state event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-create
 type CreateEventContent struct {
-	Type        RoomType  `json:"type,omitempty"`
-	Creator     id.UserID `json:"creator,omitempty"`
-	Federate    bool      `json:"m.federate,omitempty"`
-	RoomVersion string    `json:"version,omitempty"`
-	Predecessor struct {
-		RoomID  id.RoomID  `json:"room_id"`
-		EventID id.EventID `json:"event_id"`
-	} `json:"predecessor"`
+	Type    RoomType  `json:"type,omitempty"`
+	Creator id.UserID `json:"creator,omitempty"`
+	// Federate is only true if the m.federate field is explicitly true. The field defaults to true when it's missing,
+	// which a plain bool can't represent, so use FederatePtr or the IsFederated and SetFederated helpers instead.
+	Federate    bool        `json:"-"`
+	FederatePtr *bool       `json:"m.federate,omitempty"`
+	RoomVersion string      `json:"room_version,omitempty"`
+	Predecessor Predecessor `json:"predecessor"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// IsFederated returns whether users on other servers can join the room. Rooms are federated by default.
+func (content *CreateEventContent) IsFederated() bool {
+	if content.FederatePtr == nil {
+		return true
+	}
+	return *content.FederatePtr
+}
+
+// SetFederated sets the m.federate field.
+func (content *CreateEventContent) SetFederated(federate bool) {
+	content.FederatePtr = &federate
+	content.Federate = federate
+}
+
+// GetRoomVersion returns the version of the room. Rooms without an explicit version are version 1.
+func (content *CreateEventContent) GetRoomVersion() id.RoomVersion {
+	if len(content.RoomVersion) == 0 {
+		return id.RoomV1
+	}
+	return id.RoomVersion(content.RoomVersion)
+}
+
+// IsSpace returns whether the room is a space.
+func (content *CreateEventContent) IsSpace() bool {
+	return content.Type == RoomTypeSpace
+}
+
+// HasPredecessor returns whether the room is an upgraded version of another room.
+func (content *CreateEventContent) HasPredecessor() bool {
+	return len(content.Predecessor.RoomID) > 0
 }
 
 // JoinRule specifies how open a room is to new members.
@@ -68,22 +122,55 @@ type CreateEventContent struct {
 type JoinRule string
 
 const (
-	JoinRulePublic  JoinRule = "public"
-	JoinRuleKnock   JoinRule = "knock"
-	JoinRuleInvite  JoinRule = "invite"
-	JoinRulePrivate JoinRule = "private"
+	JoinRulePublic          JoinRule = "public"
+	JoinRuleKnock           JoinRule = "knock"
+	JoinRuleInvite          JoinRule = "invite"
+	JoinRulePrivate         JoinRule = "private"
+	JoinRuleRestricted      JoinRule = "restricted"
+	JoinRuleKnockRestricted JoinRule = "knock_restricted"
 )
 
+// IsSupportedIn returns whether the join rule can be used in rooms with the given version.
+func (jr JoinRule) IsSupportedIn(roomVersion id.RoomVersion) bool {
+	switch jr {
+	case JoinRuleKnock:
+		return roomVersion.Knock()
+	case JoinRuleRestricted:
+		return roomVersion.RestrictedJoins()
+	case JoinRuleKnockRestricted:
+		return roomVersion.KnockRestricted()
+	default:
+		return true
+	}
+}
+
+type JoinRuleAllowType string
+
+const (
+	JoinRuleAllowRoomMembership JoinRuleAllowType = "m.room_membership"
+)
+
+// JoinRuleAllow is a condition for joining rooms with the restricted or knock_restricted join rules.
+type JoinRuleAllow struct {
+	RoomID id.RoomID         `json:"room_id"`
+	Type   JoinRuleAllowType `json:"type"`
+}
+
 // JoinRulesEventContent represents the content of a m.room.join_rules state event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-join-rules
 type JoinRulesEventContent struct {
-	JoinRule JoinRule `json:"join_rule"`
+	JoinRule JoinRule        `json:"join_rule"`
+	Allow    []JoinRuleAllow `json:"allow,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // PinnedEventsEventContent represents the content of a m.room.pinned_events state event.
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-pinned-events
 type PinnedEventsEventContent struct {
 	Pinned []id.EventID `json:"pinned"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // HistoryVisibility specifies who can see new messages.
@@ -101,6 +188,8 @@ const (
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-history-visibility
 type HistoryVisibilityEventContent struct {
 	HistoryVisibility HistoryVisibility `json:"history_visibility"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // GuestAccess specifies whether or not guest accounts can join.
@@ -116,6 +205,8 @@ const (
 // https://matrix.org/docs/spec/client_server/r0.6.0#m-room-guest-access
 type GuestAccessEventContent struct {
 	GuestAccess GuestAccess `json:"guest_access"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type BridgeInfoSection struct {
@@ -133,22 +224,35 @@ type BridgeEventContent struct {
 	Protocol  BridgeInfoSection  `json:"protocol"`
 	Network   *BridgeInfoSection `json:"network,omitempty"`
 	Channel   BridgeInfoSection  `json:"channel"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
+// SpaceChildEventContent represents the content of a m.space.child state event.
+// https://spec.matrix.org/v1.4/client-server-api/#mspacechild
 type SpaceChildEventContent struct {
-	Via   []string `json:"via,omitempty"`
-	Order string   `json:"order,omitempty"`
+	Via       []string `json:"via,omitempty"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
+// SpaceParentEventContent represents the content of a m.space.parent state event.
+// https://spec.matrix.org/v1.4/client-server-api/#mspaceparent
 type SpaceParentEventContent struct {
 	Via       []string `json:"via,omitempty"`
 	Canonical bool     `json:"canonical,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // ModPolicyContent represents the content of a m.room.rule.user, m.room.rule.room, and m.room.rule.server state event.
 // https://spec.matrix.org/v1.1/client-server-api/#moderation-policy-lists
 type ModPolicyContent struct {
-	Entity         string `json:"entity"`
-	Reason         string `json:"reason"`
-	Recommendation string `json:"recommendation"`
+	Entity         string               `json:"entity"`
+	Reason         string               `json:"reason"`
+	Recommendation PolicyRecommendation `json:"recommendation"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
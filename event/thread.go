@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"sort"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// ThreadSummary is the m.thread bundled aggregation that servers include in the unsigned data of thread roots.
+// https://spec.matrix.org/v1.4/client-server-api/#server-side-aggregation-of-mthread-relationships
+type ThreadSummary struct {
+	LatestEvent             *Event `json:"latest_event,omitempty"`
+	Count                   int    `json:"count"`
+	CurrentUserParticipated bool   `json:"current_user_participated"`
+}
+
+// IsThreadRoot returns whether the server has reported the event as the root of a thread.
+func (evt *Event) IsThreadRoot() bool {
+	return evt.Unsigned.Relations.Thread != nil
+}
+
+// GetThreadSummary returns the thread summary from the bundled aggregations of the event, or nil if it's not a thread root.
+func (evt *Event) GetThreadSummary() *ThreadSummary {
+	return evt.Unsigned.Relations.Thread
+}
+
+// GetThreadID returns the thread root event ID if the message is in a thread.
+func (content *MessageEventContent) GetThreadID() id.EventID {
+	if content.RelatesTo != nil {
+		return content.RelatesTo.GetThreadID()
+	}
+	return ""
+}
+
+// SetThread makes the message a part of the thread with the given root.
+//
+// The latest event in the thread is used as the m.in_reply_to fallback for clients that don't support threads.
+// If it's empty, the root event is used instead.
+func (content *MessageEventContent) SetThread(root, latest id.EventID) {
+	if len(latest) == 0 {
+		latest = root
+	}
+	content.RelatesTo = &RelatesTo{
+		Type:          RelThread,
+		EventID:       root,
+		InReplyTo:     latest,
+		IsFallingBack: true,
+	}
+}
+
+// SetThreadReply makes the message an explicit reply to another event inside the thread with the given root.
+// Unlike SetThread, the reply is not a fallback, so the body will also include the normal reply fallback.
+func (content *MessageEventContent) SetThreadReply(root id.EventID, inReplyTo *Event) {
+	content.SetReply(inReplyTo)
+	content.RelatesTo = &RelatesTo{
+		Type:      RelThread,
+		EventID:   root,
+		InReplyTo: inReplyTo.ID,
+	}
+}
+
+// Thread contains the events in a single thread, sorted by timestamp.
+type Thread struct {
+	Root   *Event
+	Events []*Event
+
+	seen map[id.EventID]struct{}
+}
+
+// NewThread creates a thread with the given root event.
+// If the root has a bundled thread summary, the latest event in it is added to the thread.
+func NewThread(root *Event) *Thread {
+	thread := &Thread{Root: root, seen: make(map[id.EventID]struct{})}
+	if summary := root.GetThreadSummary(); summary != nil && summary.LatestEvent != nil {
+		_ = summary.LatestEvent.Content.ParseRaw(summary.LatestEvent.Type)
+		thread.Add(summary.LatestEvent)
+	}
+	return thread
+}
+
+func threadIDOf(evt *Event) id.EventID {
+	if relatable, ok := evt.Content.Parsed.(Relatable); ok {
+		if rel := relatable.OptionalGetRelatesTo(); rel != nil {
+			return rel.GetThreadID()
+		}
+	}
+	return ""
+}
+
+// Add adds the given events to the thread, e.g. from a /relations response. Events that are not in the thread
+// or that have already been added are ignored. The content of the events must already be parsed.
+//
+// Returns the number of events that were added.
+func (thread *Thread) Add(events ...*Event) int {
+	added := 0
+	for _, evt := range events {
+		if _, alreadyAdded := thread.seen[evt.ID]; alreadyAdded || threadIDOf(evt) != thread.Root.ID {
+			continue
+		}
+		thread.seen[evt.ID] = struct{}{}
+		thread.Events = append(thread.Events, evt)
+		added++
+	}
+	if added > 0 {
+		sort.SliceStable(thread.Events, func(i, j int) bool {
+			return thread.Events[i].Timestamp < thread.Events[j].Timestamp
+		})
+	}
+	return added
+}
+
+// Latest returns the latest event in the thread, or the root if the thread is empty.
+func (thread *Thread) Latest() *Event {
+	if len(thread.Events) == 0 {
+		return thread.Root
+	}
+	return thread.Events[len(thread.Events)-1]
+}
+
+// Get returns the event with the given ID if it's the root or in the thread.
+func (thread *Thread) Get(eventID id.EventID) *Event {
+	if thread.Root.ID == eventID {
+		return thread.Root
+	}
+	for _, evt := range thread.Events {
+		if evt.ID == eventID {
+			return evt
+		}
+	}
+	return nil
+}
+
+// Parent returns the event that the given thread event is an explicit reply to. Thread events that are not
+// explicit replies (i.e. the reply is only a fallback) are considered to be replies to the root.
+//
+// If the parent isn't in the thread, nil is returned.
+func (thread *Thread) Parent(evt *Event) *Event {
+	if relatable, ok := evt.Content.Parsed.(Relatable); ok {
+		if rel := relatable.OptionalGetRelatesTo(); rel != nil && len(rel.GetReplyID()) > 0 {
+			return thread.Get(rel.GetReplyID())
+		}
+	}
+	return thread.Root
+}
+
+// Walk calls the given function for each event in the thread in order, along with the event it's replying to
+// (see Parent). Walking stops if the function returns false.
+func (thread *Thread) Walk(fn func(evt, parent *Event) bool) {
+	for _, evt := range thread.Events {
+		if !fn(evt, thread.Parent(evt)) {
+			return
+		}
+	}
+}
+
+// Participants returns the users who have sent events in the thread, including the sender of the root event.
+func (thread *Thread) Participants() []id.UserID {
+	participants := []id.UserID{thread.Root.Sender}
+	seen := map[id.UserID]struct{}{thread.Root.Sender: {}}
+	for _, evt := range thread.Events {
+		if _, ok := seen[evt.Sender]; !ok {
+			seen[evt.Sender] = struct{}{}
+			participants = append(participants, evt.Sender)
+		}
+	}
+	return participants
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const threadRootEvent = `{
+	"type": "m.room.message",
+	"event_id": "$root",
+	"sender": "@alice:example.com",
+	"origin_server_ts": 1,
+	"content": {"msgtype": "m.text", "body": "root"},
+	"unsigned": {
+		"m.relations": {
+			"m.thread": {
+				"latest_event": {
+					"type": "m.room.message",
+					"event_id": "$latest",
+					"sender": "@bob:example.com",
+					"origin_server_ts": 3,
+					"content": {
+						"msgtype": "m.text",
+						"body": "latest",
+						"m.relates_to": {"rel_type": "m.thread", "event_id": "$root", "is_falling_back": true, "m.in_reply_to": {"event_id": "$first"}}
+					}
+				},
+				"count": 2,
+				"current_user_participated": true
+			}
+		}
+	}
+}`
+
+func TestRelatesTo_Thread(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}
+	content.SetThread("$root", "$latest")
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"msgtype": "m.text",
+		"body": "hi",
+		"m.relates_to": {"rel_type": "m.thread", "event_id": "$root", "is_falling_back": true, "m.in_reply_to": {"event_id": "$latest"}}
+	}`, string(data))
+
+	var parsed event.MessageEventContent
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, id.EventID("$root"), parsed.GetThreadID())
+	assert.Equal(t, id.EventID("$latest"), parsed.RelatesTo.InReplyTo)
+	assert.Empty(t, parsed.GetReplyTo(), "fallback replies shouldn't be treated as real replies")
+}
+
+func TestThread(t *testing.T) {
+	root := parseEvent(t, threadRootEvent)
+	require.True(t, root.IsThreadRoot())
+	summary := root.GetThreadSummary()
+	assert.Equal(t, 2, summary.Count)
+	assert.True(t, summary.CurrentUserParticipated)
+
+	thread := event.NewThread(root)
+	require.Len(t, thread.Events, 1)
+	assert.Equal(t, id.EventID("$latest"), thread.Latest().ID)
+
+	first := &event.Event{ID: "$first", Sender: "@carol:example.com", Type: event.EventMessage, Timestamp: 2}
+	firstContent := &event.MessageEventContent{MsgType: event.MsgText, Body: "first"}
+	firstContent.SetThread("$root", "")
+	first.Content.Parsed = firstContent
+	unrelated := &event.Event{ID: "$other", Type: event.EventMessage, Content: event.Content{Parsed: &event.MessageEventContent{}}}
+	assert.Equal(t, 1, thread.Add(first, unrelated, thread.Latest()))
+
+	var walked []id.EventID
+	thread.Walk(func(evt, parent *event.Event) bool {
+		assert.Equal(t, root, parent)
+		walked = append(walked, evt.ID)
+		return true
+	})
+	assert.Equal(t, []id.EventID{"$first", "$latest"}, walked)
+	assert.Equal(t, []id.UserID{"@alice:example.com", "@carol:example.com", "@bob:example.com"}, thread.Participants())
+
+	reply := &event.Event{ID: "$reply", Sender: "@alice:example.com", Type: event.EventMessage, Timestamp: 4}
+	replyContent := &event.MessageEventContent{MsgType: event.MsgText, Body: "reply"}
+	replyContent.SetThreadReply("$root", first)
+	reply.Content.Parsed = replyContent
+	thread.Add(reply)
+	assert.Equal(t, first, thread.Parent(reply))
+	assert.Contains(t, replyContent.Body, "> <@carol:example.com> first")
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func parseToDevice(t *testing.T, data string) *event.Event {
+	var evt event.Event
+	require.NoError(t, json.Unmarshal([]byte(data), &evt))
+	evt.Type.Class = event.ToDeviceEventType
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	return &evt
+}
+
+func TestToDevice_Secrets(t *testing.T) {
+	evt := parseToDevice(t, `{"type": "m.secret.request", "sender": "@a:example.com", "content": {"name": "m.megolm_backup.v1", "action": "request", "requesting_device_id": "ABCDEF", "request_id": "req1"}}`)
+	req := evt.Content.AsSecretRequest()
+	assert.Equal(t, "m.megolm_backup.v1", req.Name)
+	assert.Equal(t, event.SecretRequestRequest, req.Action)
+	assert.EqualValues(t, "ABCDEF", req.RequestingDeviceID)
+
+	evt = parseToDevice(t, `{"type": "m.secret.send", "sender": "@a:example.com", "content": {"request_id": "req1", "secret": "hunter2"}}`)
+	assert.Equal(t, "hunter2", evt.Content.AsSecretSend().Secret)
+}
+
+func TestToDevice_Verification(t *testing.T) {
+	evt := parseToDevice(t, `{"type": "m.key.verification.ready", "sender": "@a:example.com", "content": {"transaction_id": "txn", "from_device": "ABCDEF", "methods": ["m.sas.v1"]}}`)
+	ready := evt.Content.AsVerificationReady()
+	assert.Equal(t, "txn", ready.TransactionID)
+	assert.Equal(t, []event.VerificationMethod{event.VerificationMethodSAS}, ready.Methods)
+
+	evt = parseToDevice(t, `{"type": "m.key.verification.done", "sender": "@a:example.com", "content": {"transaction_id": "txn"}}`)
+	assert.Equal(t, "txn", evt.Content.AsVerificationDone().TransactionID)
+
+	evt = parseToDevice(t, `{"type": "m.dummy", "sender": "@a:example.com", "content": {}}`)
+	assert.IsType(t, &event.DummyEventContent{}, evt.Content.Parsed)
+}
+
+func TestToDevice_GuessClass(t *testing.T) {
+	for _, evtType := range []string{"m.room_key", "m.dummy", "m.secret.request", "m.secret.send"} {
+		assert.Equal(t, event.ToDeviceEventType, event.NewEventType(evtType).Class, evtType)
+	}
+	// Verification event types that are also used in rooms are guessed to be message events, like before.
+	for _, evtType := range []string{"m.key.verification.start", "m.key.verification.done"} {
+		assert.Equal(t, event.MessageEventType, event.NewEventType(evtType).Class, evtType)
+	}
+	assert.Equal(t, event.UnknownEventType, event.NewEventType("m.key.verification.request").Class)
+}
+
+func TestInRoomVerificationDone(t *testing.T) {
+	evt := parseEvent(t, `{"type": "m.key.verification.done", "sender": "@a:example.com", "content": {"m.relates_to": {"rel_type": "m.reference", "event_id": "$request"}}}`)
+	assert.True(t, evt.Type.IsInRoomVerification())
+	done := evt.Content.AsVerificationDone()
+	require.NotNil(t, done.RelatesTo)
+	assert.EqualValues(t, "$request", done.RelatesTo.EventID)
+}
@@ -83,7 +83,8 @@ func (et *Type) IsToDevice() bool {
 func (et *Type) IsInRoomVerification() bool {
 	switch et.Type {
 	case InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
-		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type:
+		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
+		InRoomVerificationDone.Type:
 		return true
 	default:
 		return false
@@ -109,23 +110,36 @@ func (et *Type) GuessClass() TypeClass {
 	case StateAliases.Type, StateCanonicalAlias.Type, StateCreate.Type, StateJoinRules.Type, StateMember.Type,
 		StatePowerLevels.Type, StateRoomName.Type, StateRoomAvatar.Type, StateServerACL.Type, StateTopic.Type,
 		StatePinnedEvents.Type, StateTombstone.Type, StateEncryption.Type, StateBridge.Type, StateHalfShotBridge.Type,
-		StateSpaceParent.Type, StateSpaceChild.Type, StatePolicyRoom.Type, StatePolicyServer.Type, StatePolicyUser.Type:
+		StateSpaceParent.Type, StateSpaceChild.Type, StatePolicyRoom.Type, StatePolicyServer.Type, StatePolicyUser.Type,
+		StateBeaconInfo.Type, StateUnstablePolicyRoom.Type, StateUnstablePolicyServer.Type, StateUnstablePolicyUser.Type,
+		StateWidget.Type, StateUnstableWidget.Type, StateGroupCall.Type, StateGroupCallMember.Type, StateImagePack.Type,
+		StateInsertionMarker.Type:
 		return StateEventType
 	case EphemeralEventReceipt.Type, EphemeralEventTyping.Type, EphemeralEventPresence.Type:
 		return EphemeralEventType
 	case AccountDataDirectChats.Type, AccountDataPushRules.Type, AccountDataRoomTags.Type,
 		AccountDataSecretStorageKey.Type, AccountDataSecretStorageDefaultKey.Type,
-		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type:
+		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type,
+		AccountDataMegolmBackupKey.Type, AccountDataImagePack.Type, AccountDataImagePackRooms.Type,
+		AccountDataFullyRead.Type, AccountDataIgnoredUserList.Type, AccountDataIdentityServer.Type,
+		AccountDataBreadcrumbs.Type:
 		return AccountDataEventType
 	case EventRedaction.Type, EventMessage.Type, EventEncrypted.Type, EventReaction.Type, EventSticker.Type,
 		InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
 		InRoomVerificationKey.Type, InRoomVerificationMAC.Type, InRoomVerificationCancel.Type,
-		CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
-		CallNegotiate.Type, CallHangup.Type:
+		InRoomVerificationDone.Type, CallInvite.Type, CallCandidates.Type, CallAnswer.Type, CallReject.Type, CallSelectAnswer.Type,
+		CallNegotiate.Type, CallHangup.Type, EventPollStart.Type, EventPollResponse.Type, EventPollEnd.Type,
+		EventUnstablePollStart.Type, EventUnstablePollResponse.Type, EventUnstablePollEnd.Type, EventBeacon.Type,
+		EventExtensibleMessage.Type, EventExtensibleFile.Type, EventExtensibleImage.Type, EventExtensibleAudio.Type,
+		EventInsertion.Type, EventBatch.Type:
 		return MessageEventType
-	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type:
+	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type,
+		ToDeviceOrgMatrixRoomKeyWithheld.Type, ToDeviceDummy.Type, ToDeviceSecretRequest.Type, ToDeviceSecretSend.Type:
 		return ToDeviceEventType
 	default:
+		if class, ok := getCustomTypeClass(et.Type); ok {
+			return class
+		}
 		return UnknownEventType
 	}
 }
@@ -185,6 +199,22 @@ var (
 	StateHalfShotBridge    = Type{"uk.half-shot.bridge", StateEventType}
 	StateSpaceChild        = Type{"m.space.child", StateEventType}
 	StateSpaceParent       = Type{"m.space.parent", StateEventType}
+
+	StateBeaconInfo = Type{"org.matrix.msc3672.beacon_info", StateEventType}
+
+	StateWidget         = Type{"m.widget", StateEventType}
+	StateUnstableWidget = Type{"im.vector.modular.widgets", StateEventType}
+
+	StateGroupCall       = Type{"org.matrix.msc3401.call", StateEventType}
+	StateGroupCallMember = Type{"org.matrix.msc3401.call.member", StateEventType}
+
+	StateImagePack = Type{"im.ponies.room_emotes", StateEventType}
+
+	StateInsertionMarker = Type{"org.matrix.msc2716.marker", StateEventType}
+
+	StateUnstablePolicyRoom   = Type{"org.matrix.mjolnir.rule.room", StateEventType}
+	StateUnstablePolicyServer = Type{"org.matrix.mjolnir.rule.server", StateEventType}
+	StateUnstablePolicyUser   = Type{"org.matrix.mjolnir.rule.user", StateEventType}
 )
 
 // Message events
@@ -195,12 +225,31 @@ var (
 	EventReaction  = Type{"m.reaction", MessageEventType}
 	EventSticker   = Type{"m.sticker", MessageEventType}
 
+	EventPollStart    = Type{"m.poll.start", MessageEventType}
+	EventPollResponse = Type{"m.poll.response", MessageEventType}
+	EventPollEnd      = Type{"m.poll.end", MessageEventType}
+
+	EventUnstablePollStart    = Type{"org.matrix.msc3381.poll.start", MessageEventType}
+	EventUnstablePollResponse = Type{"org.matrix.msc3381.poll.response", MessageEventType}
+	EventUnstablePollEnd      = Type{"org.matrix.msc3381.poll.end", MessageEventType}
+
+	EventBeacon = Type{"org.matrix.msc3672.beacon", MessageEventType}
+
+	EventInsertion = Type{"org.matrix.msc2716.insertion", MessageEventType}
+	EventBatch     = Type{"org.matrix.msc2716.batch", MessageEventType}
+
+	EventExtensibleMessage = Type{"m.message", MessageEventType}
+	EventExtensibleFile    = Type{"m.file", MessageEventType}
+	EventExtensibleImage   = Type{"m.image", MessageEventType}
+	EventExtensibleAudio   = Type{"m.audio", MessageEventType}
+
 	InRoomVerificationStart  = Type{"m.key.verification.start", MessageEventType}
 	InRoomVerificationReady  = Type{"m.key.verification.ready", MessageEventType}
 	InRoomVerificationAccept = Type{"m.key.verification.accept", MessageEventType}
 	InRoomVerificationKey    = Type{"m.key.verification.key", MessageEventType}
 	InRoomVerificationMAC    = Type{"m.key.verification.mac", MessageEventType}
 	InRoomVerificationCancel = Type{"m.key.verification.cancel", MessageEventType}
+	InRoomVerificationDone   = Type{"m.key.verification.done", MessageEventType}
 
 	CallInvite       = Type{"m.call.invite", MessageEventType}
 	CallCandidates   = Type{"m.call.candidates", MessageEventType}
@@ -226,11 +275,18 @@ var (
 	AccountDataFullyRead       = Type{"m.fully_read", AccountDataEventType}
 	AccountDataIgnoredUserList = Type{"m.ignored_user_list", AccountDataEventType}
 
+	AccountDataImagePack      = Type{"im.ponies.user_emotes", AccountDataEventType}
+	AccountDataImagePackRooms = Type{"im.ponies.emote_rooms", AccountDataEventType}
+
 	AccountDataSecretStorageDefaultKey = Type{"m.secret_storage.default_key", AccountDataEventType}
 	AccountDataSecretStorageKey        = Type{"m.secret_storage.key", AccountDataEventType}
 	AccountDataCrossSigningMaster      = Type{"m.cross_signing.master", AccountDataEventType}
 	AccountDataCrossSigningUser        = Type{"m.cross_signing.user_signing", AccountDataEventType}
 	AccountDataCrossSigningSelf        = Type{"m.cross_signing.self_signing", AccountDataEventType}
+	AccountDataMegolmBackupKey         = Type{"m.megolm_backup.v1", AccountDataEventType}
+
+	AccountDataIdentityServer = Type{"m.identity_server", AccountDataEventType}
+	AccountDataBreadcrumbs    = Type{"im.vector.setting.breadcrumbs", AccountDataEventType}
 )
 
 // Device-to-device events
@@ -247,6 +303,10 @@ var (
 	ToDeviceVerificationKey     = Type{"m.key.verification.key", ToDeviceEventType}
 	ToDeviceVerificationMAC     = Type{"m.key.verification.mac", ToDeviceEventType}
 	ToDeviceVerificationCancel  = Type{"m.key.verification.cancel", ToDeviceEventType}
+	ToDeviceVerificationReady   = Type{"m.key.verification.ready", ToDeviceEventType}
+	ToDeviceVerificationDone    = Type{"m.key.verification.done", ToDeviceEventType}
+	ToDeviceSecretRequest       = Type{"m.secret.request", ToDeviceEventType}
+	ToDeviceSecretSend          = Type{"m.secret.send", ToDeviceEventType}
 
 	ToDeviceOrgMatrixRoomKeyWithheld = Type{"org.matrix.room_key.withheld", ToDeviceEventType}
 )
@@ -0,0 +1,193 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// MaxEventSize is the maximum size of a federation-format event in bytes, as defined by the spec.
+	MaxEventSize = 65536
+	// MaxIdentifierLength is the maximum length of the type, state_key, sender and room_id fields of events.
+	MaxIdentifierLength = 255
+
+	// EventEnvelopeOverhead is a rough estimate of how many bytes the server adds to events when converting them
+	// into the federation format (prev_events, auth_events, hashes, signatures, depth, etc).
+	EventEnvelopeOverhead = 1024
+)
+
+var (
+	ErrEventTooLarge        = errors.New("event is too large")
+	ErrIdentifierTooLong    = errors.New("identifier is too long")
+	ErrMissingStateKey      = errors.New("state event is missing a state key")
+	ErrUnexpectedStateKey   = errors.New("non-state event has a state key")
+	ErrInvalidStateKey      = errors.New("invalid state key")
+	ErrInvalidContentFields = errors.New("content has fields of the wrong type")
+)
+
+// ValidateOutgoing checks that the given event can be sent to a room without the server rejecting it.
+// The event doesn't need to have an ID or timestamp, but the room ID and sender should be set, as they count
+// towards the size limit.
+//
+// If encrypted is true, the size check estimates the size of the m.room.encrypted event that the content
+// would be encrypted into, rather than the size of the plaintext event.
+func ValidateOutgoing(evt *Event, encrypted bool) error {
+	if len(evt.Type.Type) > MaxIdentifierLength {
+		return fmt.Errorf("%w: event type is %d bytes, maximum is %d", ErrIdentifierTooLong, len(evt.Type.Type), MaxIdentifierLength)
+	} else if len(evt.RoomID) > MaxIdentifierLength {
+		return fmt.Errorf("%w: room ID is %d bytes, maximum is %d", ErrIdentifierTooLong, len(evt.RoomID), MaxIdentifierLength)
+	} else if len(evt.Sender) > MaxIdentifierLength {
+		return fmt.Errorf("%w: sender is %d bytes, maximum is %d", ErrIdentifierTooLong, len(evt.Sender), MaxIdentifierLength)
+	}
+	if err := validateStateKey(evt); err != nil {
+		return err
+	}
+	content, err := json.Marshal(&evt.Content)
+	if err != nil {
+		return fmt.Errorf("failed to marshal content: %w", err)
+	}
+	if err = validateContentFields(evt.Type, content); err != nil {
+		return err
+	}
+	// State events are never encrypted
+	encrypted = encrypted && !evt.Type.IsState()
+	size, err := EstimateEventSize(evt, content, encrypted)
+	if err != nil {
+		return err
+	} else if size > MaxEventSize {
+		what := "event"
+		if encrypted {
+			what = "encrypted event"
+		}
+		return fmt.Errorf("%w: %s would be approximately %d bytes, maximum is %d", ErrEventTooLarge, what, size, MaxEventSize)
+	}
+	return nil
+}
+
+func validateStateKey(evt *Event) error {
+	if evt.StateKey == nil {
+		if evt.Type.IsState() {
+			return fmt.Errorf("%w (type %s)", ErrMissingStateKey, evt.Type.Type)
+		}
+		return nil
+	} else if evt.Type.Class != StateEventType && evt.Type.Class != UnknownEventType {
+		return fmt.Errorf("%w (type %s)", ErrUnexpectedStateKey, evt.Type.Type)
+	}
+	stateKey := *evt.StateKey
+	if len(stateKey) > MaxIdentifierLength {
+		return fmt.Errorf("%w: state key is %d bytes, maximum is %d", ErrIdentifierTooLong, len(stateKey), MaxIdentifierLength)
+	}
+	switch evt.Type {
+	case StateMember:
+		if _, _, err := id.UserID(stateKey).Parse(); err != nil {
+			return fmt.Errorf("%w: member state key must be a user ID: %v", ErrInvalidStateKey, err)
+		}
+	case StateCreate, StatePowerLevels, StateJoinRules, StateHistoryVisibility, StateGuestAccess,
+		StateRoomName, StateTopic, StateRoomAvatar, StateCanonicalAlias, StateEncryption,
+		StateTombstone, StateServerACL, StatePinnedEvents:
+		if len(stateKey) != 0 {
+			return fmt.Errorf("%w: %s must have an empty state key", ErrInvalidStateKey, evt.Type.Type)
+		}
+	case StateSpaceChild, StateSpaceParent:
+		if !strings.HasPrefix(stateKey, "!") {
+			return fmt.Errorf("%w: %s state key must be a room ID", ErrInvalidStateKey, evt.Type.Type)
+		}
+	}
+	if strings.HasPrefix(stateKey, "@") && evt.Type != StateMember {
+		// State keys starting with @ are reserved for the user with that ID.
+		if len(evt.Sender) > 0 && id.UserID(stateKey) != evt.Sender {
+			return fmt.Errorf("%w: state keys starting with @ must match the sender", ErrInvalidStateKey)
+		}
+	}
+	return nil
+}
+
+// validateContentFields checks that the known fields in the content have the correct types
+// by parsing the content into the struct registered in TypeMap.
+func validateContentFields(evtType Type, content []byte) error {
+	structType, ok := getContentStructType(evtType)
+	if !ok {
+		return nil
+	}
+	err := json.Unmarshal(content, reflect.New(structType).Interface())
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("%w: %s must be %s, got %s", ErrInvalidContentFields, typeErr.Field, typeErr.Type, typeErr.Value)
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidContentFields, err)
+	}
+	return nil
+}
+
+// Sizes of the base64 strings in megolm events.
+const (
+	curve25519KeyLength = 43
+	megolmSessionLength = 43
+	deviceIDLength      = 10
+
+	// version byte, message index tag + varint, ciphertext tag + length varint
+	megolmMessageHeaderLength = 1 + 1 + 5 + 1 + 3
+	// truncated HMAC-SHA-256 and ed25519 signature
+	megolmMessageTrailerLength = 8 + 64
+)
+
+// EstimateEventSize estimates the size of the event after the server has converted it into the federation format.
+// The content must be the JSON-encoded content of the event. If encrypted is true, the size of the m.room.encrypted
+// event that the content would be encrypted into is estimated instead.
+func EstimateEventSize(evt *Event, content json.RawMessage, encrypted bool) (int, error) {
+	evtType := evt.Type
+	if encrypted {
+		plaintext, err := json.Marshal(map[string]interface{}{
+			"type":    evt.Type.Type,
+			"content": content,
+			"room_id": evt.RoomID,
+		})
+		if err != nil {
+			return 0, err
+		}
+		paddedLength := (len(plaintext)/16 + 1) * 16
+		ciphertextLength := base64.RawStdEncoding.EncodedLen(megolmMessageHeaderLength + paddedLength + megolmMessageTrailerLength)
+		encryptedContent := &EncryptedEventContent{
+			Algorithm:        id.AlgorithmMegolmV1,
+			SenderKey:        id.SenderKey(strings.Repeat("A", curve25519KeyLength)),
+			DeviceID:         id.DeviceID(strings.Repeat("A", deviceIDLength)),
+			SessionID:        id.SessionID(strings.Repeat("A", megolmSessionLength)),
+			MegolmCiphertext: []byte(strings.Repeat("A", ciphertextLength)),
+		}
+		var relatable struct {
+			RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+		}
+		// Errors are ignored, the content was just marshaled so it's valid JSON, and an invalid relation is simply not copied.
+		_ = json.Unmarshal(content, &relatable)
+		encryptedContent.RelatesTo = relatable.RelatesTo
+		content, err = json.Marshal(encryptedContent)
+		if err != nil {
+			return 0, err
+		}
+		evtType = EventEncrypted
+	}
+	envelope, err := json.Marshal(&struct {
+		StateKey *string         `json:"state_key,omitempty"`
+		Sender   id.UserID       `json:"sender"`
+		Type     string          `json:"type"`
+		RoomID   id.RoomID       `json:"room_id"`
+		Content  json.RawMessage `json:"content"`
+		Redacts  id.EventID      `json:"redacts,omitempty"`
+	}{evt.StateKey, evt.Sender, evtType.Type, evt.RoomID, content, evt.Redacts})
+	if err != nil {
+		return 0, err
+	}
+	return len(envelope) + EventEnvelopeOverhead, nil
+}
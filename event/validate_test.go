@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func makeOutgoing(evtType event.Type, stateKey *string, content interface{}) *event.Event {
+	return &event.Event{
+		Type:     evtType,
+		StateKey: stateKey,
+		Sender:   "@user:example.com",
+		RoomID:   "!room:example.com",
+		Content:  event.Content{Parsed: content},
+	}
+}
+
+func TestValidateOutgoing_Size(t *testing.T) {
+	small := makeOutgoing(event.EventMessage, nil, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"})
+	assert.NoError(t, event.ValidateOutgoing(small, false))
+	assert.NoError(t, event.ValidateOutgoing(small, true))
+
+	// Fits as plaintext, but base64 expands it past the limit when encrypted.
+	medium := makeOutgoing(event.EventMessage, nil, &event.MessageEventContent{MsgType: event.MsgText, Body: strings.Repeat("a", 55000)})
+	assert.NoError(t, event.ValidateOutgoing(medium, false))
+	assert.ErrorIs(t, event.ValidateOutgoing(medium, true), event.ErrEventTooLarge)
+
+	large := makeOutgoing(event.EventMessage, nil, &event.MessageEventContent{MsgType: event.MsgText, Body: strings.Repeat("a", 70000)})
+	assert.ErrorIs(t, event.ValidateOutgoing(large, false), event.ErrEventTooLarge)
+}
+
+func TestValidateOutgoing_StateKey(t *testing.T) {
+	empty := ""
+	assert.ErrorIs(t, event.ValidateOutgoing(makeOutgoing(event.StateTopic, nil, &event.TopicEventContent{}), false), event.ErrMissingStateKey)
+	assert.ErrorIs(t, event.ValidateOutgoing(makeOutgoing(event.EventMessage, &empty, &event.MessageEventContent{}), false), event.ErrUnexpectedStateKey)
+	assert.NoError(t, event.ValidateOutgoing(makeOutgoing(event.StateTopic, &empty, &event.TopicEventContent{Topic: "hi"}), false))
+
+	notEmpty := "foo"
+	assert.ErrorIs(t, event.ValidateOutgoing(makeOutgoing(event.StateTopic, &notEmpty, &event.TopicEventContent{}), false), event.ErrInvalidStateKey)
+	assert.ErrorIs(t, event.ValidateOutgoing(makeOutgoing(event.StateMember, &notEmpty, &event.MemberEventContent{Membership: event.MembershipJoin}), false), event.ErrInvalidStateKey)
+
+	otherUser := "@other:example.com"
+	custom := event.Type{Type: "com.example.state", Class: event.StateEventType}
+	assert.ErrorIs(t, event.ValidateOutgoing(makeOutgoing(custom, &otherUser, map[string]interface{}{}), false), event.ErrInvalidStateKey)
+	ownUser := "@user:example.com"
+	assert.NoError(t, event.ValidateOutgoing(makeOutgoing(custom, &ownUser, map[string]interface{}{}), false))
+
+	tooLong := strings.Repeat("a", 256)
+	assert.ErrorIs(t, event.ValidateOutgoing(makeOutgoing(custom, &tooLong, map[string]interface{}{}), false), event.ErrIdentifierTooLong)
+}
+
+func TestValidateOutgoing_ContentFields(t *testing.T) {
+	evt := makeOutgoing(event.EventMessage, nil, map[string]interface{}{"msgtype": "m.text", "body": 123})
+	err := event.ValidateOutgoing(evt, false)
+	assert.ErrorIs(t, err, event.ErrInvalidContentFields)
+	assert.Contains(t, err.Error(), "body")
+
+	evt = makeOutgoing(event.EventMessage, nil, map[string]interface{}{"msgtype": "m.text", "body": "hi", "com.example.custom": 123})
+	assert.NoError(t, event.ValidateOutgoing(evt, false))
+}
+
+func TestEstimateEventSize_Encrypted(t *testing.T) {
+	evt := makeOutgoing(event.EventMessage, nil, nil)
+	content := json.RawMessage(`{"msgtype":"m.text","body":"hi","m.relates_to":{"rel_type":"m.replace","event_id":"$foo"}}`)
+	plain, err := event.EstimateEventSize(evt, content, false)
+	assert.NoError(t, err)
+	encrypted, err := event.EstimateEventSize(evt, content, true)
+	assert.NoError(t, err)
+	assert.Greater(t, encrypted, plain)
+	assert.Greater(t, plain, len(content)+len(evt.RoomID)+len(id.UserID("@user:example.com")))
+}
@@ -138,6 +138,8 @@ func (vsec *VerificationStartEventContent) SetRelatesTo(rel *RelatesTo) {
 
 // VerificationReadyEventContent represents the content of a m.key.verification.ready event.
 type VerificationReadyEventContent struct {
+	// An opaque identifier for the verification request. Only present for to-device verification.
+	TransactionID string `json:"transaction_id,omitempty"`
 	// The device ID which accepted the process.
 	FromDevice id.DeviceID `json:"from_device"`
 	// The verification methods supported by the sender.
@@ -304,3 +306,29 @@ func (vcec *VerificationCancelEventContent) OptionalGetRelatesTo() *RelatesTo {
 func (vcec *VerificationCancelEventContent) SetRelatesTo(rel *RelatesTo) {
 	vcec.RelatesTo = rel
 }
+
+// VerificationDoneEventContent represents the content of a m.key.verification.done event.
+// https://spec.matrix.org/v1.4/client-server-api/#mkeyverificationdone
+type VerificationDoneEventContent struct {
+	// The opaque identifier for the verification process. Only present for to-device verification.
+	TransactionID string `json:"transaction_id,omitempty"`
+	// Original event ID for in-room verification.
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+var _ Relatable = (*VerificationDoneEventContent)(nil)
+
+func (vdec *VerificationDoneEventContent) GetRelatesTo() *RelatesTo {
+	if vdec.RelatesTo == nil {
+		vdec.RelatesTo = &RelatesTo{}
+	}
+	return vdec.RelatesTo
+}
+
+func (vdec *VerificationDoneEventContent) OptionalGetRelatesTo() *RelatesTo {
+	return vdec.RelatesTo
+}
+
+func (vdec *VerificationDoneEventContent) SetRelatesTo(rel *RelatesTo) {
+	vdec.RelatesTo = rel
+}
@@ -10,6 +10,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+
+	"maunium.net/go/mautrix/id"
 )
 
 type CallHangupReason string
@@ -83,34 +85,50 @@ type CallInviteEventContent struct {
 	BaseCallEventContent
 	Lifetime int      `json:"lifetime"`
 	Offer    CallData `json:"offer"`
+	// The user being called in version 1 calls. If empty, the call is meant for anyone in the room.
+	Invitee id.UserID `json:"invitee,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type CallCandidatesEventContent struct {
 	BaseCallEventContent
 	Candidates []CallCandidate `json:"candidates"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type CallRejectEventContent struct {
 	BaseCallEventContent
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type CallAnswerEventContent struct {
 	BaseCallEventContent
 	Answer CallData `json:"answer"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type CallSelectAnswerEventContent struct {
 	BaseCallEventContent
 	SelectedPartyID string `json:"selected_party_id"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type CallNegotiateEventContent struct {
 	BaseCallEventContent
 	Lifetime    int      `json:"lifetime"`
 	Description CallData `json:"description"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 type CallHangupEventContent struct {
 	BaseCallEventContent
 	Reason CallHangupReason `json:"reason"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
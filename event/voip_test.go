@@ -9,11 +9,13 @@ package event_test
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 const callCandidates = `{
@@ -173,3 +175,32 @@ func TestCallVersion_UnmarshalJSON(t *testing.T) {
 	err = json.Unmarshal([]byte(`{"hmm": true}`), &version)
 	assert.Error(t, err)
 }
+
+func TestCallTracker(t *testing.T) {
+	tracker := event.NewCallTracker()
+	makeCallEvent := func(evtType event.Type, sender id.UserID, ts int64, content string) *event.Event {
+		return makeEvent(t, event.Event{Type: evtType, Sender: sender, RoomID: "!room:example.org", Timestamp: ts}, content)
+	}
+	call := tracker.Update(makeCallEvent(event.CallInvite, "@alice:example.org", 1000, `{"call_id": "c1", "party_id": "p1", "version": "1", "lifetime": 60000, "invitee": "@bob:example.org", "offer": {"type": "offer", "sdp": "v=0\r\nm=audio 9\r\nm=video 9\r\n"}}`))
+	require.NotNil(t, call)
+	assert.Equal(t, event.CallStateRinging, call.State)
+	assert.True(t, call.Video)
+	assert.Equal(t, id.UserID("@bob:example.org"), call.Invitee)
+	assert.Len(t, tracker.Active(time.UnixMilli(2000)), 1)
+	assert.Empty(t, tracker.Active(time.UnixMilli(70000)))
+
+	call = tracker.Update(makeCallEvent(event.CallAnswer, "@bob:example.org", 5000, `{"call_id": "c1", "party_id": "p2", "version": "1", "answer": {"type": "answer", "sdp": "v=0"}}`))
+	require.NotNil(t, call)
+	assert.Equal(t, event.CallStateConnected, call.State)
+	assert.Equal(t, id.UserID("@bob:example.org"), call.Callee)
+	assert.Len(t, tracker.Active(time.UnixMilli(70000)), 1)
+
+	call = tracker.Update(makeCallEvent(event.CallHangup, "@alice:example.org", 9000, `{"call_id": "c1", "party_id": "p1", "version": "1", "reason": "user_hangup"}`))
+	require.NotNil(t, call)
+	assert.Equal(t, event.CallStateEnded, call.State)
+	assert.Equal(t, event.CallHangupUserHangup, call.HangupReason)
+	assert.Empty(t, tracker.Active(time.UnixMilli(10000)))
+
+	assert.Nil(t, tracker.Update(makeCallEvent(event.CallHangup, "@bob:example.org", 9500, `{"call_id": "c1", "party_id": "p2", "version": "1"}`)))
+	assert.Nil(t, tracker.Update(makeCallEvent(event.CallAnswer, "@bob:example.org", 9500, `{"call_id": "unknown", "party_id": "p2", "version": "1", "answer": {"type": "answer", "sdp": ""}}`)))
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// WidgetType is the type of widget in a widget state event.
+type WidgetType string
+
+const (
+	WidgetTypeCustom WidgetType = "m.custom"
+	WidgetTypeJitsi  WidgetType = "jitsi"
+	// WidgetTypeJitsiMSC is the type used for Jitsi widgets in MSC1236. Most clients still use WidgetTypeJitsi.
+	WidgetTypeJitsiMSC WidgetType = "m.jitsi"
+)
+
+// DefaultJitsiWrapperURL is the URL template of the Jitsi wrapper hosted by Element.
+const DefaultJitsiWrapperURL = "https://app.element.io/jitsi.html#conferenceDomain=$domain&conferenceId=$conferenceId&isAudioOnly=$isAudioOnly&displayName=$matrix_display_name&avatarUrl=$matrix_avatar_url&userId=$matrix_user_id&roomId=$matrix_room_id&theme=$theme&roomName=$roomName"
+
+var ErrNotJitsiWidget = errors.New("widget is not a Jitsi widget")
+
+// WidgetEventContent represents the content of a m.widget or im.vector.modular.widgets state event.
+// The state key of the event is the widget ID, and widgets are removed by sending an empty content.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/1236
+type WidgetEventContent struct {
+	ID      string     `json:"id,omitempty"`
+	Type    WidgetType `json:"type,omitempty"`
+	URL     string     `json:"url,omitempty"`
+	Name    string     `json:"name,omitempty"`
+	Creator id.UserID  `json:"creatorUserId,omitempty"`
+	// Arbitrary data used for filling in the variables in the URL template.
+	Data json.RawMessage `json:"data,omitempty"`
+
+	WaitForIframeLoad bool `json:"waitForIframeLoad,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// IsActive returns whether the widget exists. Removed widgets have empty content.
+func (content *WidgetEventContent) IsActive() bool {
+	return len(content.Type) > 0 && len(content.URL) > 0
+}
+
+// IsJitsi returns whether the widget is a Jitsi conference widget.
+func (content *WidgetEventContent) IsJitsi() bool {
+	return content.Type == WidgetTypeJitsi || content.Type == WidgetTypeJitsiMSC
+}
+
+// ParseData parses the data field of the widget into the given struct.
+func (content *WidgetEventContent) ParseData(into interface{}) error {
+	if len(content.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content.Data, into)
+}
+
+// SetData replaces the data field of the widget with the given value.
+func (content *WidgetEventContent) SetData(data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	content.Data = raw
+	return nil
+}
+
+// FillURL replaces the $variables in the URL template of the widget. Variables are first looked up
+// in the given map (e.g. matrix_user_id, matrix_room_id), then in the top-level string, number and
+// boolean fields of the widget data. Unknown variables are left as-is.
+func (content *WidgetEventContent) FillURL(vars map[string]string) string {
+	var data map[string]interface{}
+	_ = content.ParseData(&data)
+	values := make(map[string]string, len(vars)+len(data))
+	for key, value := range data {
+		switch typedValue := value.(type) {
+		case string:
+			values[key] = typedValue
+		case float64:
+			values[key] = strconv.FormatFloat(typedValue, 'f', -1, 64)
+		case bool:
+			values[key] = strconv.FormatBool(typedValue)
+		}
+	}
+	for key, value := range vars {
+		values[key] = value
+	}
+	var buf strings.Builder
+	template := content.URL
+	for {
+		index := strings.IndexByte(template, '$')
+		if index < 0 {
+			buf.WriteString(template)
+			break
+		}
+		buf.WriteString(template[:index])
+		template = template[index+1:]
+		end := 0
+		for end < len(template) && isWidgetVariableChar(template[end]) {
+			end++
+		}
+		value, ok := values[template[:end]]
+		if ok {
+			buf.WriteString(url.QueryEscape(value))
+		} else {
+			buf.WriteByte('$')
+			buf.WriteString(template[:end])
+		}
+		template = template[end:]
+	}
+	return buf.String()
+}
+
+func isWidgetVariableChar(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') || char == '_'
+}
+
+// JitsiWidgetData is the data stored in Jitsi widgets.
+type JitsiWidgetData struct {
+	Domain       string `json:"domain"`
+	ConferenceID string `json:"conferenceId"`
+	IsAudioOnly  bool   `json:"isAudioOnly"`
+	RoomName     string `json:"roomName,omitempty"`
+}
+
+// JitsiData parses the data of a Jitsi widget.
+func (content *WidgetEventContent) JitsiData() (*JitsiWidgetData, error) {
+	if !content.IsJitsi() {
+		return nil, ErrNotJitsiWidget
+	}
+	var data JitsiWidgetData
+	err := content.ParseData(&data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// NewJitsiWidget creates the content for a Jitsi conference widget. The widget ID should be used as the state key
+// when sending the event. If wrapperURL is empty, DefaultJitsiWrapperURL is used.
+func NewJitsiWidget(widgetID string, creator id.UserID, wrapperURL string, data *JitsiWidgetData) (*WidgetEventContent, error) {
+	if len(wrapperURL) == 0 {
+		wrapperURL = DefaultJitsiWrapperURL
+	}
+	content := &WidgetEventContent{
+		ID:      widgetID,
+		Type:    WidgetTypeJitsi,
+		URL:     wrapperURL,
+		Name:    "Jitsi",
+		Creator: creator,
+	}
+	if len(data.RoomName) > 0 {
+		content.Name = data.RoomName
+	}
+	err := content.SetData(data)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
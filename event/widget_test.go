@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestNewJitsiWidget(t *testing.T) {
+	content, err := event.NewJitsiWidget("jitsi_1", "@bot:example.com", "", &event.JitsiWidgetData{
+		Domain:       "meet.example.com",
+		ConferenceID: "Conf123",
+		RoomName:     "Standup",
+	})
+	require.NoError(t, err)
+	assert.True(t, content.IsActive())
+	assert.True(t, content.IsJitsi())
+	assert.Equal(t, "Standup", content.Name)
+
+	data, err := json.Marshal(content)
+	require.NoError(t, err)
+	var parsed event.WidgetEventContent
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	jitsi, err := parsed.JitsiData()
+	require.NoError(t, err)
+	assert.Equal(t, "meet.example.com", jitsi.Domain)
+	assert.Equal(t, "Conf123", jitsi.ConferenceID)
+	assert.False(t, jitsi.IsAudioOnly)
+}
+
+func TestWidgetEventContent_FillURL(t *testing.T) {
+	content := &event.WidgetEventContent{
+		Type: event.WidgetTypeCustom,
+		URL:  "https://example.com/widget?user=$matrix_user_id&room=$matrix_room_id&n=$count&x=$unknown",
+		Data: json.RawMessage(`{"count": 5}`),
+	}
+	filled := content.FillURL(map[string]string{"matrix_user_id": "@a:example.com", "matrix_room_id": "!r:example.com"})
+	assert.Equal(t, "https://example.com/widget?user=%40a%3Aexample.com&room=%21r%3Aexample.com&n=5&x=$unknown", filled)
+
+	_, err := content.JitsiData()
+	assert.ErrorIs(t, err, event.ErrNotJitsiWidget)
+	assert.False(t, (&event.WidgetEventContent{}).IsActive())
+}
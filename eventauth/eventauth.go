@@ -0,0 +1,234 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package eventauth implements the hashing and signing algorithms used for federation-format Matrix events:
+// canonical JSON, content and reference hashes, event ID calculation and ed25519 signatures.
+//
+// https://spec.matrix.org/v1.4/server-server-api/#signing-events
+package eventauth
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"maunium.net/go/mautrix/crypto/canonicaljson"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrInvalidJSON          = errors.New("invalid JSON")
+	ErrEventIDNotComputable = errors.New("event IDs in this room version are not derived from the reference hash")
+	ErrEventIDMismatch      = errors.New("event ID doesn't match reference hash")
+	ErrContentHashMismatch  = errors.New("content hash doesn't match")
+	ErrSignatureNotFound    = errors.New("signature not found")
+	ErrInvalidSignature     = errors.New("invalid signature")
+)
+
+// CanonicalJSON marshals the given value into canonical JSON. If the value is already a []byte or json.RawMessage,
+// it's only re-encoded.
+func CanonicalJSON(value interface{}) ([]byte, error) {
+	var data []byte
+	switch typedValue := value.(type) {
+	case []byte:
+		data = typedValue
+	case json.RawMessage:
+		data = typedValue
+	default:
+		var err error
+		data, err = json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return canonicaljson.CanonicalJSON(data)
+}
+
+func deleteKeys(data []byte, keys ...string) ([]byte, error) {
+	var err error
+	for _, key := range keys {
+		data, err = sjson.DeleteBytes(data, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// ContentHash computes the SHA-256 content hash of a federation-format event.
+// https://spec.matrix.org/v1.4/server-server-api/#calculating-the-content-hash-for-an-event
+func ContentHash(eventJSON []byte) ([32]byte, error) {
+	if !gjson.ValidBytes(eventJSON) {
+		return [32]byte{}, ErrInvalidJSON
+	}
+	stripped, err := deleteKeys(eventJSON, "unsigned", "signatures", "hashes")
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(canonicaljson.CanonicalJSONAssumeValid(stripped)), nil
+}
+
+// AddContentHash computes the content hash of the event and stores it in the hashes.sha256 field.
+func AddContentHash(eventJSON []byte) ([]byte, error) {
+	hash, err := ContentHash(eventJSON)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetBytes(eventJSON, "hashes.sha256", base64.RawStdEncoding.EncodeToString(hash[:]))
+}
+
+// VerifyContentHash checks that the hashes.sha256 field of the event matches its content.
+func VerifyContentHash(eventJSON []byte) error {
+	hash, err := ContentHash(eventJSON)
+	if err != nil {
+		return err
+	}
+	expected := gjson.GetBytes(eventJSON, "hashes.sha256").Str
+	if expected != base64.RawStdEncoding.EncodeToString(hash[:]) {
+		return ErrContentHashMismatch
+	}
+	return nil
+}
+
+// ReferenceHash computes the reference hash of a federation-format event, which is the SHA-256 hash
+// of the redacted event without signatures or unsigned data.
+// https://spec.matrix.org/v1.4/server-server-api/#calculating-the-reference-hash-for-an-event
+func ReferenceHash(eventJSON []byte, roomVersion id.RoomVersion) ([32]byte, error) {
+	redacted, err := Redact(eventJSON, roomVersion)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	redacted, err = deleteKeys(redacted, "signatures", "unsigned", "event_id")
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(canonicaljson.CanonicalJSONAssumeValid(redacted)), nil
+}
+
+// EventID calculates the ID of an event in room version 3 or later. Older room versions use
+// server-generated event IDs, so ErrEventIDNotComputable is returned for them.
+func EventID(eventJSON []byte, roomVersion id.RoomVersion) (id.EventID, error) {
+	format := roomVersion.EventIDFormat()
+	if format == id.EventIDFormatCustom {
+		return "", ErrEventIDNotComputable
+	}
+	hash, err := ReferenceHash(eventJSON, roomVersion)
+	if err != nil {
+		return "", err
+	}
+	if format == id.EventIDFormatBase64 {
+		return id.EventID("$" + base64.RawStdEncoding.EncodeToString(hash[:])), nil
+	}
+	return id.EventID("$" + base64.RawURLEncoding.EncodeToString(hash[:])), nil
+}
+
+// VerifyEventID checks that the given event ID is valid for the event in the given room version.
+// In room versions 3 and later, the ID must match the reference hash of the event. Older room versions
+// use server-generated IDs, so only the format of the ID is checked.
+func VerifyEventID(eventJSON []byte, eventID id.EventID, roomVersion id.RoomVersion) error {
+	if err := eventID.ValidateForRoomVersion(roomVersion); err != nil {
+		return err
+	} else if roomVersion.EventIDFormat() == id.EventIDFormatCustom {
+		return nil
+	}
+	expected, err := EventID(eventJSON, roomVersion)
+	if err != nil {
+		return err
+	} else if expected != eventID {
+		return fmt.Errorf("%w (expected %s, got %s)", ErrEventIDMismatch, expected, eventID)
+	}
+	return nil
+}
+
+// signablePayload returns the canonical JSON of the data without the signatures and unsigned fields,
+// along with the existing signatures object.
+func signablePayload(data []byte) ([]byte, gjson.Result, error) {
+	if !gjson.ValidBytes(data) {
+		return nil, gjson.Result{}, ErrInvalidJSON
+	}
+	signatures := gjson.GetBytes(data, "signatures")
+	stripped, err := deleteKeys(data, "signatures", "unsigned")
+	if err != nil {
+		return nil, signatures, err
+	}
+	return canonicaljson.CanonicalJSONAssumeValid(stripped), signatures, nil
+}
+
+// SignJSON signs an arbitrary JSON object and adds the signature to its signatures field.
+// https://spec.matrix.org/v1.4/appendices#signing-json
+func SignJSON(data []byte, serverName, keyID string, key ed25519.PrivateKey) ([]byte, error) {
+	payload, _, err := signablePayload(data)
+	if err != nil {
+		return nil, err
+	}
+	signature := base64.RawStdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return sjson.SetBytes(data, fmt.Sprintf("signatures.%s.%s", escapePath(serverName), escapePath(keyID)), signature)
+}
+
+// VerifyJSON checks the signature of the given server and key ID on the JSON object.
+func VerifyJSON(data []byte, serverName, keyID string, key ed25519.PublicKey) error {
+	payload, signatures, err := signablePayload(data)
+	if err != nil {
+		return err
+	}
+	signature := signatures.Get(escapePath(serverName) + "." + escapePath(keyID))
+	if !signature.Exists() {
+		return ErrSignatureNotFound
+	}
+	decoded, err := base64.RawStdEncoding.DecodeString(signature.Str)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	} else if !ed25519.Verify(key, payload, decoded) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SignEvent adds the content hash to a federation-format event and signs the redacted form of it.
+// https://spec.matrix.org/v1.4/server-server-api/#signing-events
+func SignEvent(eventJSON []byte, roomVersion id.RoomVersion, serverName, keyID string, key ed25519.PrivateKey) ([]byte, error) {
+	withHash, err := AddContentHash(eventJSON)
+	if err != nil {
+		return nil, err
+	}
+	redacted, err := Redact(withHash, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	signedRedacted, err := SignJSON(redacted, serverName, keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetRawBytes(withHash, "signatures", []byte(gjson.GetBytes(signedRedacted, "signatures").Raw))
+}
+
+// VerifyEventSignature checks the signature of the given server on the redacted form of the event.
+// The content hash is not checked, as events that fail the hash check are redacted rather than rejected.
+func VerifyEventSignature(eventJSON []byte, roomVersion id.RoomVersion, serverName, keyID string, key ed25519.PublicKey) error {
+	redacted, err := Redact(eventJSON, roomVersion)
+	if err != nil {
+		return err
+	}
+	return VerifyJSON(redacted, serverName, keyID, key)
+}
+
+func escapePath(key string) string {
+	escaped := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '.', '*', '?', '\\', '|', '#', '@', '!':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, key[i])
+	}
+	return string(escaped)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package eventauth_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+
+	"maunium.net/go/mautrix/eventauth"
+	"maunium.net/go/mautrix/id"
+)
+
+// Signing key from the examples in the spec appendices.
+func testKey(t *testing.T) ed25519.PrivateKey {
+	seed, err := base64.RawStdEncoding.DecodeString("YJDBA9Xnr2sVqXD9Vj7XVUnmFZcZrlw8Md7kMW+3XA1")
+	require.NoError(t, err)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func TestSignJSON_SpecExamples(t *testing.T) {
+	key := testKey(t)
+	signed, err := eventauth.SignJSON([]byte(`{}`), "domain", "ed25519:1", key)
+	require.NoError(t, err)
+	assert.Equal(t, "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZAQ", gjson.GetBytes(signed, `signatures.domain.ed25519:1`).Str)
+
+	signed, err = eventauth.SignJSON([]byte(`{"two": "Two", "one": 1}`), "domain", "ed25519:1", key)
+	require.NoError(t, err)
+	assert.Equal(t, "KqmLSbO39/Bzb0QIYE82zqLwsA+PDzYIpIRA2sRQ4sL53+sN6/fpNSoqE7BP7vBZhG6kYdD13EIMJpvhJI+6Bw", gjson.GetBytes(signed, `signatures.domain.ed25519:1`).Str)
+	assert.NoError(t, eventauth.VerifyJSON(signed, "domain", "ed25519:1", key.Public().(ed25519.PublicKey)))
+}
+
+func TestVerifyJSON_Invalid(t *testing.T) {
+	key := testKey(t)
+	pubKey := key.Public().(ed25519.PublicKey)
+	signed, err := eventauth.SignJSON([]byte(`{"one":1,"unsigned":{"age":5}}`), "example.com", "ed25519:a.b", key)
+	require.NoError(t, err)
+	assert.NoError(t, eventauth.VerifyJSON(signed, "example.com", "ed25519:a.b", pubKey))
+	assert.ErrorIs(t, eventauth.VerifyJSON(signed, "example.org", "ed25519:a.b", pubKey), eventauth.ErrSignatureNotFound)
+	tampered := []byte(strings.Replace(string(signed), `"one":1`, `"one":2`, 1))
+	assert.ErrorIs(t, eventauth.VerifyJSON(tampered, "example.com", "ed25519:a.b", pubKey), eventauth.ErrInvalidSignature)
+}
+
+const specExampleEvent = `{
+	"room_id": "!x:domain",
+	"sender": "@a:domain",
+	"origin": "domain",
+	"origin_server_ts": 1000000,
+	"signatures": {},
+	"hashes": {},
+	"type": "X",
+	"content": {},
+	"prev_events": [],
+	"auth_events": [],
+	"depth": 3,
+	"unsigned": {"age_ts": 1000000}
+}`
+
+func TestSignEvent_SpecExample(t *testing.T) {
+	key := testKey(t)
+	signed, err := eventauth.SignEvent([]byte(specExampleEvent), "1", "domain", "ed25519:1", key)
+	require.NoError(t, err)
+	assert.Equal(t, "5jM4wQpv6lnBo7CLIghJuHdW+s2CMBJPUOGOC89ncos", gjson.GetBytes(signed, "hashes.sha256").Str)
+	assert.Equal(t, "KxwGjPSDEtvnFgU00fwFz+l6d2pJM6XBIaMEn81SXPTRl16AqLAYqfIReFGZlHi5KLjAWbOoMszkwsQma+lYAg", gjson.GetBytes(signed, `signatures.domain.ed25519:1`).Str)
+	assert.Equal(t, int64(1000000), gjson.GetBytes(signed, "unsigned.age_ts").Int())
+	assert.NoError(t, eventauth.VerifyContentHash(signed))
+	assert.NoError(t, eventauth.VerifyEventSignature(signed, "1", "domain", "ed25519:1", key.Public().(ed25519.PublicKey)))
+}
+
+func TestEventID(t *testing.T) {
+	evt := []byte(`{"type":"m.room.message","room_id":"!x:domain","sender":"@a:domain","content":{"body":"hi"},"unsigned":{"age":1}}`)
+	_, err := eventauth.EventID(evt, "2")
+	assert.ErrorIs(t, err, eventauth.ErrEventIDNotComputable)
+
+	v3, err := eventauth.EventID(evt, "3")
+	require.NoError(t, err)
+	v4, err := eventauth.EventID(evt, "4")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(v4), "$"))
+	assert.Len(t, string(v4), 44)
+	assert.Equal(t, strings.NewReplacer("+", "-", "/", "_").Replace(string(v3)), string(v4))
+
+	// The content is redacted before hashing, so changing the body must not change the ID.
+	edited := []byte(strings.Replace(string(evt), `"hi"`, `"bye"`, 1))
+	editedID, err := eventauth.EventID(edited, "4")
+	require.NoError(t, err)
+	assert.Equal(t, v4, editedID)
+}
+
+func TestVerifyEventID(t *testing.T) {
+	evt := []byte(`{"type":"m.room.message","room_id":"!x:domain","sender":"@a:domain","content":{"body":"hi"}}`)
+	v3, err := eventauth.EventID(evt, "3")
+	require.NoError(t, err)
+	v4, err := eventauth.EventID(evt, "4")
+	require.NoError(t, err)
+	assert.NoError(t, eventauth.VerifyEventID(evt, v3, "3"))
+	assert.NoError(t, eventauth.VerifyEventID(evt, v4, "10"))
+	assert.NoError(t, eventauth.VerifyEventID(evt, "$custom:domain", "2"))
+
+	other := []byte(strings.Replace(string(evt), `"m.room.message"`, `"m.sticker"`, 1))
+	otherID, err := eventauth.EventID(other, "4")
+	require.NoError(t, err)
+	assert.ErrorIs(t, eventauth.VerifyEventID(evt, otherID, "4"), eventauth.ErrEventIDMismatch)
+	assert.ErrorIs(t, eventauth.VerifyEventID(evt, "$custom:domain", "4"), id.ErrEventIDFormatMismatch)
+}
+
+func TestRedact(t *testing.T) {
+	member := []byte(`{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"join","displayname":"A","join_authorised_via_users_server":"@b:domain"},"unsigned":{"age":1}}`)
+	redacted, err := eventauth.Redact(member, "8")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"join"}}`, string(redacted))
+	redacted, err = eventauth.Redact(member, "9")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"join","join_authorised_via_users_server":"@b:domain"}}`, string(redacted))
+
+	_, err = eventauth.Redact([]byte(`{`), "9")
+	assert.ErrorIs(t, err, eventauth.ErrInvalidJSON)
+}
+
+func TestRedact_V11(t *testing.T) {
+	create := []byte(`{"type":"m.room.create","state_key":"","origin":"domain","content":{"creator":"@a:domain","room_version":"11","m.federate":false}}`)
+	redacted, err := eventauth.Redact(create, "10")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"m.room.create","state_key":"","origin":"domain","content":{"creator":"@a:domain"}}`, string(redacted))
+	redacted, err = eventauth.Redact(create, "11")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"m.room.create","state_key":"","content":{"creator":"@a:domain","room_version":"11","m.federate":false}}`, string(redacted))
+
+	redaction := []byte(`{"type":"m.room.redaction","content":{"redacts":"$target","reason":"spam"}}`)
+	redacted, err = eventauth.Redact(redaction, "11")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"m.room.redaction","content":{"redacts":"$target"}}`, string(redacted))
+
+	powerLevels := []byte(`{"type":"m.room.power_levels","state_key":"","content":{"invite":50,"notifications":{"room":50}}}`)
+	redacted, err = eventauth.Redact(powerLevels, "11")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"m.room.power_levels","state_key":"","content":{"invite":50}}`, string(redacted))
+
+	member := []byte(`{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"invite","third_party_invite":{"display_name":"a","signed":{"token":"abc"}}}}`)
+	redacted, err = eventauth.Redact(member, "11")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"m.room.member","state_key":"@a:domain","content":{"membership":"invite","third_party_invite":{"signed":{"token":"abc"}}}}`, string(redacted))
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package eventauth
+
+import (
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var preservedTopLevelKeys = []string{
+	"event_id", "type", "room_id", "sender", "state_key", "content", "hashes", "signatures", "depth",
+	"prev_events", "auth_events", "origin_server_ts",
+}
+
+// Keys that were preserved in room versions before v11.
+var legacyPreservedTopLevelKeys = []string{"prev_state", "origin", "membership"}
+
+func preservedContentKeys(eventType string, roomVersion id.RoomVersion) []string {
+	switch eventType {
+	case "m.room.member":
+		if roomVersion.UpdatedRedactionRules() {
+			return []string{"membership", "join_authorised_via_users_server", "third_party_invite.signed"}
+		} else if roomVersion.RestrictedJoinsFix() {
+			return []string{"membership", "join_authorised_via_users_server"}
+		}
+		return []string{"membership"}
+	case "m.room.create":
+		return []string{"creator"}
+	case "m.room.join_rules":
+		if roomVersion.RestrictedJoins() {
+			return []string{"join_rule", "allow"}
+		}
+		return []string{"join_rule"}
+	case "m.room.power_levels":
+		if roomVersion.UpdatedRedactionRules() {
+			return []string{"ban", "events", "events_default", "invite", "kick", "redact", "state_default", "users", "users_default"}
+		}
+		return []string{"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"}
+	case "m.room.redaction":
+		if roomVersion.UpdatedRedactionRules() {
+			return []string{"redacts"}
+		}
+		return nil
+	case "m.room.aliases":
+		if roomVersion.SpecialCasedAliasesAuth() {
+			return []string{"aliases"}
+		}
+		return nil
+	case "m.room.history_visibility":
+		return []string{"history_visibility"}
+	default:
+		return nil
+	}
+}
+
+// Redact applies the redaction algorithm of the given room version to a federation-format event.
+// https://spec.matrix.org/v1.4/client-server-api/#redactions
+func Redact(eventJSON []byte, roomVersion id.RoomVersion) ([]byte, error) {
+	if !gjson.ValidBytes(eventJSON) {
+		return nil, ErrInvalidJSON
+	}
+	parsed := gjson.ParseBytes(eventJSON)
+	output := []byte("{}")
+	var err error
+	topLevelKeys := preservedTopLevelKeys
+	if !roomVersion.UpdatedRedactionRules() {
+		topLevelKeys = append(topLevelKeys[:len(topLevelKeys):len(topLevelKeys)], legacyPreservedTopLevelKeys...)
+	}
+	for _, key := range topLevelKeys {
+		if value := parsed.Get(key); value.Exists() && key != "content" {
+			output, err = sjson.SetRawBytes(output, key, []byte(value.Raw))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	evtType := parsed.Get("type").Str
+	if evtType == "m.room.create" && roomVersion.UpdatedRedactionRules() {
+		// The entire content of create events is preserved since v11
+		if content := parsed.Get("content"); content.IsObject() {
+			return sjson.SetRawBytes(output, "content", []byte(content.Raw))
+		}
+	}
+	content := []byte("{}")
+	for _, key := range preservedContentKeys(evtType, roomVersion) {
+		if value := parsed.Get("content." + key); value.Exists() {
+			content, err = sjson.SetRawBytes(content, key, []byte(value.Raw))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sjson.SetRawBytes(output, "content", content)
+}
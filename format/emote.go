@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const SlashMePrefix = "/me "
+
+// RenderEmote renders the given markdown like RenderMarkdown, but produces a m.emote message.
+// A leading /me in the text is removed.
+func RenderEmote(text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
+	content := RenderMarkdown(strings.TrimPrefix(text, SlashMePrefix), allowMarkdown, allowHTML)
+	content.MsgType = event.MsgEmote
+	return content
+}
+
+// RenderNotice renders the given markdown like RenderMarkdown, but produces a m.notice message.
+func RenderNotice(text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
+	content := RenderMarkdown(text, allowMarkdown, allowHTML)
+	content.MsgType = event.MsgNotice
+	return content
+}
+
+// ParseSlashMe converts m.text messages that start with /me into m.emote messages.
+// It returns true if the message was converted.
+func ParseSlashMe(content *event.MessageEventContent) bool {
+	if content.MsgType != event.MsgText || !strings.HasPrefix(content.Body, SlashMePrefix) {
+		return false
+	}
+	content.MsgType = event.MsgEmote
+	content.Body = content.Body[len(SlashMePrefix):]
+	if content.Format == event.FormatHTML {
+		content.FormattedBody = strings.TrimPrefix(content.FormattedBody, SlashMePrefix)
+	}
+	return true
+}
+
+// ToSlashMe converts m.emote messages into m.text messages that start with /me, for networks where
+// emotes are sent as normal messages. It returns true if the message was converted.
+func ToSlashMe(content *event.MessageEventContent) bool {
+	if content.MsgType != event.MsgEmote {
+		return false
+	}
+	content.MsgType = event.MsgText
+	content.Body = SlashMePrefix + content.Body
+	if content.Format == event.FormatHTML {
+		content.FormattedBody = SlashMePrefix + content.FormattedBody
+	}
+	return true
+}
+
+// EmoteToText converts an emote into the "* Sender does something" form used by most clients to display emotes.
+func EmoteToText(content *event.MessageEventContent, senderName string) string {
+	return fmt.Sprintf("* %s %s", senderName, content.Body)
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+func TestRenderEmote(t *testing.T) {
+	content := format.RenderEmote("/me waves **happily**", true, false)
+	assert.Equal(t, event.MsgEmote, content.MsgType)
+	assert.Equal(t, "waves **happily**", content.Body)
+	assert.Equal(t, "waves <strong>happily</strong>", content.FormattedBody)
+	assert.Equal(t, "* Alice waves **happily**", format.EmoteToText(&content, "Alice"))
+
+	notice := format.RenderNotice("done", true, false)
+	assert.Equal(t, event.MsgNotice, notice.MsgType)
+	assert.Equal(t, "done", notice.Body)
+}
+
+func TestSlashMe_RoundTrip(t *testing.T) {
+	content := format.RenderMarkdown("/me waves _slowly_", true, false)
+	assert.True(t, format.ParseSlashMe(&content))
+	assert.Equal(t, event.MsgEmote, content.MsgType)
+	assert.Equal(t, "waves _slowly_", content.Body)
+	assert.Equal(t, "waves <em>slowly</em>", content.FormattedBody)
+	assert.False(t, format.ParseSlashMe(&content))
+
+	assert.True(t, format.ToSlashMe(&content))
+	assert.Equal(t, event.MsgText, content.MsgType)
+	assert.Equal(t, "/me waves _slowly_", content.Body)
+	assert.Equal(t, "/me waves <em>slowly</em>", content.FormattedBody)
+}
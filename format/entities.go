@@ -0,0 +1,422 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/net/html"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// EntityType is the type of formatting applied by an Entity.
+type EntityType string
+
+const (
+	EntityBold          EntityType = "bold"
+	EntityItalic        EntityType = "italic"
+	EntityStrikethrough EntityType = "strikethrough"
+	EntityUnderline     EntityType = "underline"
+	EntityCode          EntityType = "code"
+	EntityPre           EntityType = "pre"
+	EntityLink          EntityType = "link"
+	EntityPill          EntityType = "pill"
+	EntitySpoiler       EntityType = "spoiler"
+	EntityBlockquote    EntityType = "blockquote"
+	EntityColor         EntityType = "color"
+	EntityMath          EntityType = "math"
+)
+
+// Entity is a formatting entity that applies to a range of an EntityString.
+type Entity struct {
+	Type EntityType
+	// The start and length of the range in bytes.
+	Offset int
+	Length int
+
+	// The URL of links.
+	URL string
+	// The target of pills.
+	MatrixURI *id.MatrixURI
+	// The language of pre entities.
+	Language string
+	// The reason of spoilers.
+	Reason string
+	// The colors of color entities.
+	Color, BackgroundColor string
+	// Whether math entities are displayed as a block.
+	DisplayMode bool
+}
+
+// EntityString is an intermediate representation of formatted text: plain text and a list of formatting entities,
+// similar to how many chat networks represent formatting. Entities are sorted by offset, and entities parsed from
+// HTML are always properly nested, but entities created by other code may overlap arbitrarily.
+type EntityString struct {
+	Text     string
+	Entities []Entity
+}
+
+// UTF16Entities returns a copy of the entities where offsets and lengths are in UTF-16 code units instead of bytes.
+func (es *EntityString) UTF16Entities() []Entity {
+	converted := make([]Entity, len(es.Entities))
+	for i, entity := range es.Entities {
+		start := len(utf16.Encode([]rune(es.Text[:entity.Offset])))
+		length := len(utf16.Encode([]rune(es.Text[entity.Offset : entity.Offset+entity.Length])))
+		entity.Offset, entity.Length = start, length
+		converted[i] = entity
+	}
+	return converted
+}
+
+type entityParser struct {
+	text     strings.Builder
+	entities []Entity
+}
+
+func (ep *entityParser) ensureNewline() {
+	text := ep.text.String()
+	if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+		ep.text.WriteByte('\n')
+	}
+}
+
+func getAttr(node *html.Node, key string) (string, bool) {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+func (ep *entityParser) entityForNode(node *html.Node) *Entity {
+	switch node.Data {
+	case "b", "strong":
+		return &Entity{Type: EntityBold}
+	case "i", "em":
+		return &Entity{Type: EntityItalic}
+	case "s", "del", "strike":
+		return &Entity{Type: EntityStrikethrough}
+	case "u", "ins":
+		return &Entity{Type: EntityUnderline}
+	case "code", "tt":
+		return &Entity{Type: EntityCode}
+	case "blockquote":
+		return &Entity{Type: EntityBlockquote}
+	case "pre":
+		entity := &Entity{Type: EntityPre}
+		if node.FirstChild != nil && node.FirstChild.Type == html.ElementNode && node.FirstChild.Data == "code" {
+			class, _ := getAttr(node.FirstChild, "class")
+			entity.Language = codeLanguageFromClass(class)
+		}
+		return entity
+	case "a":
+		href, _ := getAttr(node, "href")
+		if len(href) == 0 {
+			return nil
+		}
+		if uri, err := id.ParseMatrixURIOrMatrixToURL(href); err == nil && uri != nil {
+			return &Entity{Type: EntityPill, MatrixURI: uri}
+		}
+		return &Entity{Type: EntityLink, URL: href}
+	case "span", "font":
+		if reason, ok := getAttr(node, "data-mx-spoiler"); ok {
+			return &Entity{Type: EntitySpoiler, Reason: reason}
+		}
+		fg, _ := getAttr(node, "data-mx-color")
+		if len(fg) == 0 {
+			fg, _ = getAttr(node, "color")
+		}
+		bg, _ := getAttr(node, "data-mx-bg-color")
+		if len(fg) > 0 || len(bg) > 0 {
+			return &Entity{Type: EntityColor, Color: fg, BackgroundColor: bg}
+		}
+	}
+	return nil
+}
+
+func (ep *entityParser) parseChildren(node *html.Node, inPre bool) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		ep.parseNode(child, inPre)
+	}
+}
+
+func (ep *entityParser) parseNode(node *html.Node, inPre bool) {
+	switch node.Type {
+	case html.TextNode:
+		text := node.Data
+		if !inPre {
+			text = strings.ReplaceAll(text, "\n", "")
+		}
+		ep.text.WriteString(text)
+		return
+	case html.DocumentNode:
+		ep.parseChildren(node, inPre)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	switch node.Data {
+	case "br":
+		ep.text.WriteByte('\n')
+		return
+	case "hr":
+		ep.ensureNewline()
+		ep.text.WriteString("---\n")
+		return
+	case "img":
+		alt, _ := getAttr(node, "alt")
+		ep.text.WriteString(alt)
+		return
+	case "mx-reply":
+		return
+	}
+	if latex, isMath := getAttr(node, "data-mx-maths"); isMath && (node.Data == "span" || node.Data == "div") {
+		displayMode := node.Data == "div"
+		if displayMode {
+			ep.ensureNewline()
+		}
+		ep.entities = append(ep.entities, Entity{Type: EntityMath, Offset: ep.text.Len(), Length: len(latex), DisplayMode: displayMode})
+		ep.text.WriteString(latex)
+		if displayMode {
+			ep.ensureNewline()
+		}
+		return
+	}
+	isBlock := isBlockTag(node.Data) || node.Data == "li"
+	if isBlock {
+		ep.ensureNewline()
+	}
+	if node.Data == "li" && node.Parent != nil {
+		ep.text.WriteString(listItemPrefix(node))
+	}
+	entity := ep.entityForNode(node)
+	entityIndex := -1
+	if entity != nil {
+		entity.Offset = ep.text.Len()
+		entityIndex = len(ep.entities)
+		ep.entities = append(ep.entities, *entity)
+	}
+	ep.parseChildren(node, inPre || node.Data == "pre")
+	if entityIndex >= 0 {
+		length := ep.text.Len() - ep.entities[entityIndex].Offset
+		// Don't include the trailing newline of block content in the entity
+		if length > 0 && strings.HasSuffix(ep.text.String(), "\n") && ep.entities[entityIndex].Type != EntityPre {
+			length--
+		}
+		ep.entities[entityIndex].Length = length
+	}
+	if isBlock {
+		ep.ensureNewline()
+	}
+}
+
+func listItemPrefix(node *html.Node) string {
+	if node.Parent.Data != "ol" {
+		return "* "
+	}
+	counter := 1
+	if start, ok := getAttr(node.Parent, "start"); ok {
+		if parsed, err := strconv.Atoi(start); err == nil {
+			counter = parsed
+		}
+	}
+	for sibling := node.PrevSibling; sibling != nil; sibling = sibling.PrevSibling {
+		if sibling.Type == html.ElementNode && sibling.Data == "li" {
+			counter++
+		}
+	}
+	return fmt.Sprintf("%d. ", counter)
+}
+
+func isBlockTag(tag string) bool {
+	for _, blockTag := range BlockTags {
+		if tag == blockTag {
+			return true
+		}
+	}
+	return false
+}
+
+// HTMLToEntities parses Matrix HTML into an EntityString. Reply fallbacks are removed.
+func HTMLToEntities(htmlData string) *EntityString {
+	node, _ := html.Parse(strings.NewReader(htmlData))
+	parser := &entityParser{}
+	parser.parseNode(node, false)
+	text := strings.TrimRight(parser.text.String(), "\n")
+	entities := parser.entities[:0]
+	for _, entity := range parser.entities {
+		if entity.Offset+entity.Length > len(text) {
+			entity.Length = len(text) - entity.Offset
+		}
+		if entity.Length > 0 {
+			entities = append(entities, entity)
+		}
+	}
+	return &EntityString{Text: text, Entities: entities}
+}
+
+func (entity *Entity) openTag(text string) string {
+	switch entity.Type {
+	case EntityBold:
+		return "<strong>"
+	case EntityItalic:
+		return "<em>"
+	case EntityStrikethrough:
+		return "<del>"
+	case EntityUnderline:
+		return "<u>"
+	case EntityCode:
+		return "<code>"
+	case EntityBlockquote:
+		return "<blockquote>"
+	case EntityPre:
+		if len(entity.Language) > 0 {
+			return fmt.Sprintf(`<pre><code class="language-%s">`, html.EscapeString(entity.Language))
+		}
+		return "<pre><code>"
+	case EntityLink:
+		return fmt.Sprintf(`<a href="%s">`, html.EscapeString(entity.URL))
+	case EntityPill:
+		return fmt.Sprintf(`<a href="%s">`, html.EscapeString(entity.MatrixURI.MatrixToURL()))
+	case EntitySpoiler:
+		if len(entity.Reason) > 0 {
+			return fmt.Sprintf(`<span data-mx-spoiler="%s">`, html.EscapeString(entity.Reason))
+		}
+		return "<span data-mx-spoiler>"
+	case EntityColor:
+		var attrs []string
+		if len(entity.Color) > 0 {
+			attrs = append(attrs, fmt.Sprintf(`data-mx-color="%s"`, html.EscapeString(entity.Color)))
+		}
+		if len(entity.BackgroundColor) > 0 {
+			attrs = append(attrs, fmt.Sprintf(`data-mx-bg-color="%s"`, html.EscapeString(entity.BackgroundColor)))
+		}
+		return "<font " + strings.Join(attrs, " ") + ">"
+	case EntityMath:
+		latex := html.EscapeString(text[entity.Offset : entity.Offset+entity.Length])
+		if entity.DisplayMode {
+			return fmt.Sprintf(`<div data-mx-maths="%s"><code>`, latex)
+		}
+		return fmt.Sprintf(`<span data-mx-maths="%s"><code>`, latex)
+	default:
+		return ""
+	}
+}
+
+func (entity *Entity) closeTag() string {
+	switch entity.Type {
+	case EntityBold:
+		return "</strong>"
+	case EntityItalic:
+		return "</em>"
+	case EntityStrikethrough:
+		return "</del>"
+	case EntityUnderline:
+		return "</u>"
+	case EntityCode:
+		return "</code>"
+	case EntityBlockquote:
+		return "</blockquote>"
+	case EntityPre:
+		return "</code></pre>"
+	case EntityLink, EntityPill:
+		return "</a>"
+	case EntitySpoiler:
+		return "</span>"
+	case EntityColor:
+		return "</font>"
+	case EntityMath:
+		if entity.DisplayMode {
+			return "</code></div>"
+		}
+		return "</code></span>"
+	default:
+		return ""
+	}
+}
+
+func (entity *Entity) end() int {
+	return entity.Offset + entity.Length
+}
+
+// ToHTML converts the EntityString into Matrix HTML. Overlapping entities are split so that the tags nest properly.
+func (es *EntityString) ToHTML() string {
+	entities := make([]*Entity, 0, len(es.Entities))
+	boundarySet := map[int]struct{}{0: {}, len(es.Text): {}}
+	for i := range es.Entities {
+		entity := &es.Entities[i]
+		if entity.Length <= 0 || entity.Offset < 0 || entity.end() > len(es.Text) {
+			continue
+		}
+		entities = append(entities, entity)
+		boundarySet[entity.Offset] = struct{}{}
+		boundarySet[entity.end()] = struct{}{}
+	}
+	// Longer entities are opened first, so that they're outside shorter entities starting at the same offset
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].Offset != entities[j].Offset {
+			return entities[i].Offset < entities[j].Offset
+		}
+		return entities[i].Length > entities[j].Length
+	})
+	boundaries := make([]int, 0, len(boundarySet))
+	for boundary := range boundarySet {
+		boundaries = append(boundaries, boundary)
+	}
+	sort.Ints(boundaries)
+
+	var output strings.Builder
+	var stack []*Entity
+	nextEntity := 0
+	inPre := 0
+	for i, boundary := range boundaries {
+		// Close all entities that end here. Entities opened after them must be closed too and reopened afterwards.
+		closeFrom := len(stack)
+		for j, entity := range stack {
+			if entity.end() <= boundary {
+				closeFrom = j
+				break
+			}
+		}
+		var reopen []*Entity
+		for j := len(stack) - 1; j >= closeFrom; j-- {
+			output.WriteString(stack[j].closeTag())
+			if stack[j].Type == EntityPre {
+				inPre--
+			}
+			if stack[j].end() > boundary {
+				reopen = append([]*Entity{stack[j]}, reopen...)
+			}
+		}
+		stack = stack[:closeFrom]
+		for ; nextEntity < len(entities) && entities[nextEntity].Offset == boundary; nextEntity++ {
+			reopen = append(reopen, entities[nextEntity])
+		}
+		for _, entity := range reopen {
+			output.WriteString(entity.openTag(es.Text))
+			if entity.Type == EntityPre {
+				inPre++
+			}
+			stack = append(stack, entity)
+		}
+		if i+1 < len(boundaries) {
+			segment := html.EscapeString(es.Text[boundary:boundaries[i+1]])
+			if inPre == 0 {
+				segment = strings.ReplaceAll(segment, "\n", "<br>")
+			}
+			output.WriteString(segment)
+		}
+	}
+	return output.String()
+}
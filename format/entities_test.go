@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestHTMLToEntities(t *testing.T) {
+	es := format.HTMLToEntities(`hello <strong>wörld <em>and</em></strong> <a href="https://matrix.to/#/@user:example.com">User</a><br><a href="https://example.com">link</a>`)
+	assert.Equal(t, "hello wörld and User\nlink", es.Text)
+	require.Len(t, es.Entities, 4)
+	assert.Equal(t, format.Entity{Type: format.EntityBold, Offset: 6, Length: 10}, es.Entities[0])
+	assert.Equal(t, format.Entity{Type: format.EntityItalic, Offset: 13, Length: 3}, es.Entities[1])
+	assert.Equal(t, format.EntityPill, es.Entities[2].Type)
+	assert.Equal(t, id.UserID("@user:example.com"), es.Entities[2].MatrixURI.UserID())
+	assert.Equal(t, format.Entity{Type: format.EntityLink, Offset: 22, Length: 4, URL: "https://example.com"}, es.Entities[3])
+
+	utf16 := es.UTF16Entities()
+	assert.Equal(t, 9, utf16[0].Length)
+	assert.Equal(t, 10, es.Entities[0].Length, "UTF16Entities shouldn't modify the original entities")
+}
+
+func TestHTMLToEntities_Blocks(t *testing.T) {
+	es := format.HTMLToEntities("<p>intro</p><pre><code class=\"language-go\">fmt.Println()\n</code></pre><ul><li>one</li><li>two</li></ul><blockquote>quote</blockquote>")
+	assert.Equal(t, "intro\nfmt.Println()\n* one\n* two\nquote", es.Text)
+	require.Len(t, es.Entities, 3)
+	assert.Equal(t, format.Entity{Type: format.EntityPre, Offset: 6, Length: 14, Language: "go"}, es.Entities[0])
+	assert.Equal(t, format.EntityCode, es.Entities[1].Type)
+	assert.Equal(t, format.Entity{Type: format.EntityBlockquote, Offset: 32, Length: 5}, es.Entities[2])
+}
+
+func TestEntityString_ToHTML(t *testing.T) {
+	input := `a <strong>b <em>c</em></strong> <span data-mx-spoiler="why">d</span> <font data-mx-color="#ff0000">e</font><br><del>f</del>`
+	assert.Equal(t, input, format.HTMLToEntities(input).ToHTML())
+
+	math := `<span data-mx-maths="x^2"><code>x^2</code></span> &lt;3`
+	assert.Equal(t, math, format.HTMLToEntities(math).ToHTML())
+}
+
+func TestEntityString_ToHTML_Overlapping(t *testing.T) {
+	es := &format.EntityString{
+		Text: "hello world",
+		Entities: []format.Entity{
+			{Type: format.EntityBold, Offset: 0, Length: 7},
+			{Type: format.EntityItalic, Offset: 4, Length: 7},
+		},
+	}
+	assert.Equal(t, "<strong>hell<em>o w</em></strong><em>orld</em>", es.ToHTML())
+}
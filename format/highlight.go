@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// CodeHighlighter converts a code block into syntax highlighted HTML. The output will be placed inside
+// <pre><code class="language-...">, so it should only contain inline tags like <span>.
+//
+// If the highlighter doesn't support the language, it should return false, which will make the renderer
+// fall back to the plain code block.
+type CodeHighlighter func(code, language string) (highlighted string, ok bool)
+
+// HighlightingRenderer is a blackfriday renderer that passes fenced code blocks through a CodeHighlighter.
+// The language class is kept on the code tag, so HTMLParser will still find the language when parsing
+// the highlighted output back into markdown.
+type HighlightingRenderer struct {
+	blackfriday.Renderer
+	Highlighter CodeHighlighter
+}
+
+var highlightPlaceholder = []byte("\x00highlighted code\x00")
+
+// CodeBlockLanguage returns the language of a fenced code block node, i.e. the first word of the info string.
+func CodeBlockLanguage(node *blackfriday.Node) string {
+	info := string(node.Info)
+	if endOfLang := strings.IndexAny(info, "\t "); endOfLang >= 0 {
+		info = info[:endOfLang]
+	}
+	return info
+}
+
+func (r *HighlightingRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type != blackfriday.CodeBlock || r.Highlighter == nil {
+		return r.Renderer.RenderNode(w, node, entering)
+	}
+	language := CodeBlockLanguage(node)
+	highlighted, ok := r.Highlighter(string(node.Literal), language)
+	if !ok {
+		return r.Renderer.RenderNode(w, node, entering)
+	}
+	// Render the code block normally with a placeholder in place of the code to get the surrounding tags.
+	placeholderNode := *node
+	placeholderNode.Literal = highlightPlaceholder
+	var buf bytes.Buffer
+	status := r.Renderer.RenderNode(&buf, &placeholderNode, entering)
+	_, _ = w.Write(bytes.Replace(buf.Bytes(), highlightPlaceholder, []byte(highlighted), 1))
+	return status
+}
+
+// NewHighlightingRenderer creates a blackfriday renderer option that highlights code blocks with the given
+// highlighter. It can be passed to RenderMarkdownCustom.
+func NewHighlightingRenderer(highlighter CodeHighlighter, allowHTML bool) blackfriday.Option {
+	return blackfriday.WithRenderer(&HighlightingRenderer{Renderer: BaseRenderer(allowHTML), Highlighter: highlighter})
+}
+
+// codeLanguageFromClass finds the language-* class in the given class attribute value.
+func codeLanguageFromClass(class string) string {
+	for _, part := range strings.Fields(class) {
+		if strings.HasPrefix(part, "language-") {
+			return part[len("language-"):]
+		}
+	}
+	return ""
+}
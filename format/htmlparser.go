@@ -21,6 +21,15 @@ type Context map[string]interface{}
 type TextConverter func(string, Context) string
 type CodeBlockConverter func(code, language string, ctx Context) string
 type PillConverter func(displayname, mxid, eventID string, ctx Context) string
+type LinkConverter func(text, href string, ctx Context) string
+
+// PillResolver is called for matrix.to and matrix: links. It can replace the link with a mention or link on a
+// remote network. If it returns false, the link is handled by PillConverter like links to unknown users.
+type PillResolver func(displayname string, uri *id.MatrixURI, ctx Context) (replacement string, ok bool)
+type ImageConverter func(src, alt, title string, ctx Context) string
+type SpoilerConverter func(text, reason string, ctx Context) string
+type ColorConverter func(text, fg, bg string, ctx Context) string
+type MathConverter func(latex string, displayMode bool, ctx Context) string
 
 func DefaultPillConverter(displayname, mxid, eventID string, _ Context) string {
 	switch {
@@ -44,6 +53,7 @@ func DefaultPillConverter(displayname, mxid, eventID string, _ Context) string {
 
 // HTMLParser is a somewhat customizable Matrix HTML parser.
 type HTMLParser struct {
+	PillResolver            PillResolver
 	PillConverter           PillConverter
 	TabsToSpaces            int
 	Newline                 string
@@ -54,6 +64,23 @@ type HTMLParser struct {
 	UnderlineConverter      TextConverter
 	MonospaceBlockConverter CodeBlockConverter
 	MonospaceConverter      TextConverter
+	// LinkConverter is called for links that aren't handled by PillConverter.
+	LinkConverter LinkConverter
+	// ImageConverter is called for <img> tags. If not set, images are dropped. Use DefaultImageConverter for the alt text.
+	ImageConverter ImageConverter
+	// ReplyFallbackConverter is called with the content of <mx-reply> blocks. Return an empty string to drop the fallback.
+	ReplyFallbackConverter TextConverter
+	// SpoilerConverter is called for <span data-mx-spoiler> tags. The reason is empty if the spoiler has no reason.
+	// If not set, the spoiler text is included as-is. Use DefaultSpoilerConverter for the ||spoiler|| syntax.
+	SpoilerConverter SpoilerConverter
+	// ColorConverter is called for <span> and <font> tags with data-mx-color, data-mx-bg-color or color attributes.
+	ColorConverter ColorConverter
+	// MathConverter is called for <span> and <div> tags with the data-mx-maths attribute (MSC2191).
+	// If not set, DefaultMathConverter is used.
+	MathConverter MathConverter
+	// TableConverter is called for <table> tags. If not set, the cell contents are included without any formatting.
+	// Use DefaultTableConverter for aligned plaintext tables.
+	TableConverter TableConverter
 }
 
 // TaggedString is a string that also contains a HTML tag.
@@ -63,12 +90,17 @@ type TaggedString struct {
 }
 
 func (parser *HTMLParser) getAttribute(node *html.Node, attribute string) string {
+	val, _ := parser.maybeGetAttribute(node, attribute)
+	return val
+}
+
+func (parser *HTMLParser) maybeGetAttribute(node *html.Node, attribute string) (string, bool) {
 	for _, attr := range node.Attr {
 		if attr.Key == attribute {
-			return attr.Val
+			return attr.Val, true
 		}
 	}
-	return ""
+	return "", false
 }
 
 // Digits counts the number of digits in a non-negative integer.
@@ -170,18 +202,101 @@ func (parser *HTMLParser) linkToString(node *html.Node, stripLinebreak bool, ctx
 	if len(href) == 0 {
 		return str
 	}
-	if parser.PillConverter != nil {
+	if parser.PillResolver != nil || parser.PillConverter != nil {
 		parsedMatrix, err := id.ParseMatrixURIOrMatrixToURL(href)
 		if err == nil && parsedMatrix != nil {
-			return parser.PillConverter(str, parsedMatrix.PrimaryIdentifier(), parsedMatrix.SecondaryIdentifier(), ctx)
+			if parser.PillResolver != nil {
+				if replacement, ok := parser.PillResolver(str, parsedMatrix, ctx); ok {
+					return replacement
+				}
+			}
+			if parser.PillConverter != nil {
+				return parser.PillConverter(str, parsedMatrix.PrimaryIdentifier(), parsedMatrix.SecondaryIdentifier(), ctx)
+			}
 		}
 	}
+	if parser.LinkConverter != nil {
+		return parser.LinkConverter(str, href, ctx)
+	}
 	if str == href {
 		return str
 	}
 	return fmt.Sprintf("%s (%s)", str, href)
 }
 
+func (parser *HTMLParser) imgToString(node *html.Node, ctx Context) string {
+	src := parser.getAttribute(node, "src")
+	alt := parser.getAttribute(node, "alt")
+	title := parser.getAttribute(node, "title")
+	if parser.ImageConverter != nil {
+		return parser.ImageConverter(src, alt, title, ctx)
+	}
+	return ""
+}
+
+// DefaultImageConverter converts images into their alt text, or the title if there's no alt text.
+func DefaultImageConverter(_, alt, title string, _ Context) string {
+	if len(alt) > 0 {
+		return alt
+	}
+	return title
+}
+
+func (parser *HTMLParser) mathToString(latex string, displayMode bool, ctx Context) string {
+	if parser.MathConverter != nil {
+		return parser.MathConverter(latex, displayMode, ctx)
+	}
+	return DefaultMathConverter(latex, displayMode, ctx)
+}
+
+func (parser *HTMLParser) spanToString(node *html.Node, stripLinebreak bool, ctx Context) string {
+	if latex, isMath := parser.maybeGetAttribute(node, "data-mx-maths"); isMath {
+		return parser.mathToString(latex, false, ctx)
+	}
+	str := parser.nodeToTagAwareString(node.FirstChild, stripLinebreak, ctx)
+	if reason, isSpoiler := parser.maybeGetAttribute(node, "data-mx-spoiler"); isSpoiler {
+		if parser.SpoilerConverter != nil {
+			return parser.SpoilerConverter(str, reason, ctx)
+		}
+		return str
+	}
+	if parser.ColorConverter != nil {
+		fg := parser.getAttribute(node, "data-mx-color")
+		if len(fg) == 0 && node.Data == "font" {
+			fg = parser.getAttribute(node, "color")
+		}
+		bg := parser.getAttribute(node, "data-mx-bg-color")
+		if len(fg) > 0 || len(bg) > 0 {
+			return parser.ColorConverter(str, fg, bg, ctx)
+		}
+	}
+	return str
+}
+
+func (parser *HTMLParser) replyFallbackToString(node *html.Node, stripLinebreak bool, ctx Context) string {
+	str := parser.nodeToTagAwareString(node.FirstChild, stripLinebreak, ctx)
+	if parser.ReplyFallbackConverter != nil {
+		return parser.ReplyFallbackConverter(str, ctx)
+	}
+	return str
+}
+
+// codeToString extracts the text in a code block, ignoring any formatting tags such as syntax highlighting.
+func (parser *HTMLParser) codeToString(node *html.Node) string {
+	var buf strings.Builder
+	for ; node != nil; node = node.NextSibling {
+		switch {
+		case node.Type == html.TextNode:
+			buf.WriteString(node.Data)
+		case node.Type == html.ElementNode && node.Data == "br":
+			buf.WriteByte('\n')
+		default:
+			buf.WriteString(parser.codeToString(node.FirstChild))
+		}
+	}
+	return buf.String()
+}
+
 func (parser *HTMLParser) tagToString(node *html.Node, stripLinebreak bool, ctx Context) string {
 	switch node.Data {
 	case "blockquote":
@@ -196,6 +311,19 @@ func (parser *HTMLParser) tagToString(node *html.Node, stripLinebreak bool, ctx
 		return parser.basicFormatToString(node, stripLinebreak, ctx)
 	case "a":
 		return parser.linkToString(node, stripLinebreak, ctx)
+	case "img":
+		return parser.imgToString(node, ctx)
+	case "span", "font":
+		return parser.spanToString(node, stripLinebreak, ctx)
+	case "mx-reply":
+		return parser.replyFallbackToString(node, stripLinebreak, ctx)
+	case "table":
+		return parser.tableToString(node, stripLinebreak, ctx)
+	case "div":
+		if latex, isMath := parser.maybeGetAttribute(node, "data-mx-maths"); isMath {
+			return parser.mathToString(latex, true, ctx)
+		}
+		return parser.nodeToTagAwareString(node.FirstChild, stripLinebreak, ctx)
 	case "p":
 		return parser.nodeToTagAwareString(node.FirstChild, stripLinebreak, ctx)
 	case "hr":
@@ -203,13 +331,10 @@ func (parser *HTMLParser) tagToString(node *html.Node, stripLinebreak bool, ctx
 	case "pre":
 		var preStr, language string
 		if node.FirstChild != nil && node.FirstChild.Type == html.ElementNode && node.FirstChild.Data == "code" {
-			class := parser.getAttribute(node.FirstChild, "class")
-			if strings.HasPrefix(class, "language-") {
-				language = class[len("language-"):]
-			}
-			preStr = parser.nodeToString(node.FirstChild.FirstChild, false, ctx)
+			language = codeLanguageFromClass(parser.getAttribute(node.FirstChild, "class"))
+			preStr = parser.codeToString(node.FirstChild.FirstChild)
 		} else {
-			preStr = parser.nodeToString(node.FirstChild, false, ctx)
+			preStr = parser.codeToString(node.FirstChild)
 		}
 		if parser.MonospaceBlockConverter != nil {
 			return parser.MonospaceBlockConverter(preStr, language, ctx)
@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestHTMLToText_Defaults(t *testing.T) {
+	assert.Equal(t, "**bold** and _italic_", format.HTMLToText("<strong>bold</strong> and <em>italic</em>"))
+	assert.Equal(t, "example (https://example.com)", format.HTMLToText(`<a href="https://example.com">example</a>`))
+	assert.Equal(t, "look", format.HTMLToText(`look <img src="mxc://example.com/cat" alt=":cat:">`))
+	assert.Equal(t, "hidden", format.HTMLToText(`<span data-mx-spoiler>hidden</span>`))
+}
+
+func TestHTMLParser_DefaultImageConverter(t *testing.T) {
+	parser := &format.HTMLParser{ImageConverter: format.DefaultImageConverter}
+	assert.Equal(t, "look :cat:", parser.Parse(`look <img src="mxc://example.com/cat" alt=":cat:">`, nil))
+	assert.Equal(t, "look cat", parser.Parse(`look <img src="mxc://example.com/cat" title="cat">`, nil))
+}
+
+func TestHTMLParser_DefaultSpoilerConverter(t *testing.T) {
+	parser := &format.HTMLParser{SpoilerConverter: format.DefaultSpoilerConverter}
+	assert.Equal(t, "||hidden||", parser.Parse(`<span data-mx-spoiler>hidden</span>`, nil))
+	assert.Equal(t, "||nsfw|hidden||", parser.Parse(`<span data-mx-spoiler="nsfw">hidden</span>`, nil))
+}
+
+func TestHTMLParser_CustomConverters(t *testing.T) {
+	parser := &format.HTMLParser{
+		TabsToSpaces: 4,
+		Newline:      "\n",
+		LinkConverter: func(text, href string, _ format.Context) string {
+			return fmt.Sprintf("[%s](<%s>)", text, href)
+		},
+		ImageConverter: func(src, alt, _ string, _ format.Context) string {
+			return fmt.Sprintf("<%s %s>", alt, src)
+		},
+		SpoilerConverter: func(text, reason string, _ format.Context) string {
+			return fmt.Sprintf("||%s|%s||", reason, text)
+		},
+		ColorConverter: func(text, fg, bg string, _ format.Context) string {
+			return fmt.Sprintf("{%s/%s:%s}", fg, bg, text)
+		},
+		ReplyFallbackConverter: func(string, format.Context) string {
+			return ""
+		},
+	}
+	assert.Equal(t, "[site](<https://example.com>)", parser.Parse(`<a href="https://example.com">site</a>`, nil))
+	assert.Equal(t, "<:cat: mxc://example.com/cat>", parser.Parse(`<img src="mxc://example.com/cat" alt=":cat:">`, nil))
+	assert.Equal(t, "||nsfw|secret||", parser.Parse(`<span data-mx-spoiler="nsfw">secret</span>`, nil))
+	assert.Equal(t, "|||secret||", parser.Parse(`<span data-mx-spoiler>secret</span>`, nil))
+	assert.Equal(t, "{#ff0000/:red} {#00ff00/#000000:green}", parser.Parse(`<font color="#ff0000">red</font> <span data-mx-color="#00ff00" data-mx-bg-color="#000000">green</span>`, nil))
+	assert.Equal(t, "plain span", parser.Parse(`<span>plain span</span>`, nil))
+	assert.Equal(t, "reply", parser.Parse(`<mx-reply><blockquote>original</blockquote></mx-reply>reply`, nil))
+}
+
+func TestHTMLParser_PillResolver(t *testing.T) {
+	remoteIDs := map[id.UserID]string{"@telegram_1234:example.com": "1234"}
+	parser := &format.HTMLParser{
+		Newline:       "\n",
+		PillConverter: format.DefaultPillConverter,
+		PillResolver: func(displayname string, uri *id.MatrixURI, _ format.Context) (string, bool) {
+			switch {
+			case len(uri.UserID()) > 0:
+				remoteID, ok := remoteIDs[uri.UserID()]
+				return fmt.Sprintf("<@%s>", remoteID), ok
+			case len(uri.EventID()) > 0:
+				return fmt.Sprintf("<message %s in %s>", uri.EventID(), uri.RoomID()), true
+			}
+			return "", false
+		},
+	}
+	assert.Equal(t, "hi <@1234>", parser.Parse(`hi <a href="https://matrix.to/#/@telegram_1234:example.com">Telegram User</a>`, nil))
+	assert.Equal(t, "hi Matrix User", parser.Parse(`hi <a href="matrix:u/user:example.com">Matrix User</a>`, nil))
+	assert.Equal(t, "see <message $event in !room:example.com>", parser.Parse(`see <a href="https://matrix.to/#/!room:example.com/$event?via=example.com">this</a>`, nil))
+	assert.Equal(t, "#alias:example.com", parser.Parse(`<a href="https://matrix.to/#/%23alias:example.com">#alias:example.com</a>`, nil))
+}
+
+func TestHTMLParser_TableConverter(t *testing.T) {
+	var parsed *format.Table
+	parser := &format.HTMLParser{
+		Newline: "\n",
+		TableConverter: func(table *format.Table, _ format.Context) string {
+			parsed = table
+			return "table"
+		},
+	}
+	assert.Equal(t, "before\ntable", parser.Parse(`before<table><caption>Fruit</caption><tr><th>name</th><th style="text-align: right">count</th></tr><tr><td><b>apples</b></td><td>5</td></tr></table>`, nil))
+	assert.Equal(t, &format.Table{
+		Caption: "Fruit",
+		Rows: [][]format.TableCell{
+			{{Text: "name", Header: true}, {Text: "count", Header: true, Align: "right"}},
+			{{Text: "**apples**"}, {Text: "5"}},
+		},
+	}, parsed)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+var (
+	URLRegex   = regexp.MustCompile(`https?://[^\s<>"]+`)
+	EmailRegex = regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`)
+)
+
+// LinkifyOptions controls what Linkify turns into links.
+type LinkifyOptions struct {
+	URLs      bool
+	Emails    bool
+	MatrixIDs bool
+}
+
+// DefaultLinkifyOptions enables linkifying everything.
+var DefaultLinkifyOptions = LinkifyOptions{URLs: true, Emails: true, MatrixIDs: true}
+
+type linkSpan struct {
+	start, end int
+	href       string
+}
+
+// trimURLPunctuation removes trailing punctuation that's more likely to be part of the sentence than the URL.
+// Closing parentheses are only removed if they're not balanced within the URL.
+func trimURLPunctuation(url string) string {
+	for len(url) > 0 {
+		last := url[len(url)-1]
+		if strings.IndexByte(".,:;!?'\"", last) >= 0 ||
+			(last == ')' && strings.Count(url, ")") > strings.Count(url, "(")) {
+			url = url[:len(url)-1]
+		} else {
+			break
+		}
+	}
+	return url
+}
+
+func findLinks(text string, opts LinkifyOptions) []linkSpan {
+	var spans []linkSpan
+	if opts.URLs {
+		for _, match := range URLRegex.FindAllStringIndex(text, -1) {
+			url := trimURLPunctuation(text[match[0]:match[1]])
+			spans = append(spans, linkSpan{match[0], match[0] + len(url), url})
+		}
+	}
+	if opts.Emails {
+		for _, match := range EmailRegex.FindAllStringIndex(text, -1) {
+			spans = append(spans, linkSpan{match[0], match[1], "mailto:" + text[match[0]:match[1]]})
+		}
+	}
+	if opts.MatrixIDs {
+		for _, match := range PillRegex.FindAllStringSubmatchIndex(text, -1) {
+			spans = append(spans, linkSpan{match[2], match[3], pillURL(text[match[2]:match[3]])})
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	// Remove overlapping matches, e.g. the domain of an URL being detected as an email address
+	filtered := spans[:0]
+	lastEnd := 0
+	for _, span := range spans {
+		if span.start >= lastEnd && span.end > span.start {
+			filtered = append(filtered, span)
+			lastEnd = span.end
+		}
+	}
+	return filtered
+}
+
+func escapeWithLinebreaks(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+}
+
+// Linkify converts the given plain text into HTML where URLs, email addresses and Matrix identifiers are links.
+// The second return value is false if nothing was linkified.
+func Linkify(text string, opts LinkifyOptions) (string, bool) {
+	spans := findLinks(text, opts)
+	if len(spans) == 0 {
+		return escapeWithLinebreaks(text), false
+	}
+	var output strings.Builder
+	lastEnd := 0
+	for _, span := range spans {
+		output.WriteString(escapeWithLinebreaks(text[lastEnd:span.start]))
+		_, _ = fmt.Fprintf(&output, `<a href="%s">%s</a>`, html.EscapeString(span.href), html.EscapeString(text[span.start:span.end]))
+		lastEnd = span.end
+	}
+	output.WriteString(escapeWithLinebreaks(text[lastEnd:]))
+	return output.String(), true
+}
+
+// LinkifyContent adds a formatted body with links to the given plaintext message.
+// Messages that already have a formatted body and messages with nothing to linkify aren't modified.
+func LinkifyContent(content *event.MessageEventContent, opts LinkifyOptions) {
+	if len(content.FormattedBody) > 0 || content.Format == event.FormatHTML {
+		return
+	}
+	linkified, ok := Linkify(content.Body, opts)
+	if ok {
+		content.Format = event.FormatHTML
+		content.FormattedBody = linkified
+	}
+}
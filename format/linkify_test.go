@@ -0,0 +1,40 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+func TestLinkify(t *testing.T) {
+	linkified, ok := format.Linkify("see https://example.com/wiki/Go_(language). or mail a@b.example.com\nping @bob:example.com <3", format.DefaultLinkifyOptions)
+	assert.True(t, ok)
+	assert.Equal(t, `see <a href="https://example.com/wiki/Go_(language)">https://example.com/wiki/Go_(language)</a>. or mail <a href="mailto:a@b.example.com">a@b.example.com</a><br>ping <a href="https://matrix.to/#/%40bob%3Aexample.com">@bob:example.com</a> &lt;3`, linkified)
+
+	linkified, ok = format.Linkify("(https://example.com/a?b=c&d=e)", format.LinkifyOptions{URLs: true})
+	assert.True(t, ok)
+	assert.Equal(t, `(<a href="https://example.com/a?b=c&amp;d=e">https://example.com/a?b=c&amp;d=e</a>)`, linkified)
+
+	_, ok = format.Linkify("@bob:example.com", format.LinkifyOptions{URLs: true})
+	assert.False(t, ok)
+}
+
+func TestLinkifyContent(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "nothing here"}
+	format.LinkifyContent(content, format.DefaultLinkifyOptions)
+	assert.Empty(t, content.FormattedBody)
+
+	content.Body = "go to https://example.com"
+	format.LinkifyContent(content, format.DefaultLinkifyOptions)
+	assert.Equal(t, event.FormatHTML, content.Format)
+	assert.Equal(t, `go to <a href="https://example.com">https://example.com</a>`, content.FormattedBody)
+}
@@ -27,6 +27,18 @@ func (r *EscapingRenderer) RenderNode(w io.Writer, node *blackfriday.Node, enter
 	return r.HTMLRenderer.RenderNode(w, node, entering)
 }
 
+// RenderHeader converts all inline HTML in the AST into text before rendering, so that wrapping renderers
+// don't see HTMLSpan nodes.
+func (r *EscapingRenderer) RenderHeader(w io.Writer, ast *blackfriday.Node) {
+	ast.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if node.Type == blackfriday.HTMLSpan {
+			node.Type = blackfriday.Text
+		}
+		return blackfriday.GoToNext
+	})
+	r.HTMLRenderer.RenderHeader(w, ast)
+}
+
 var AntiParagraphRegex = regexp.MustCompile("^<p>(.+?)</p>$")
 var Extensions = blackfriday.WithExtensions(blackfriday.NoIntraEmphasis |
 	blackfriday.Tables |
@@ -41,16 +53,47 @@ var bfhtml = blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
 var Renderer = blackfriday.WithRenderer(bfhtml)
 var NoHTMLRenderer = blackfriday.WithRenderer(&EscapingRenderer{bfhtml})
 
+// BaseRenderer returns the HTML renderer used by RenderMarkdown. Custom renderers like PillRenderer and
+// SpoilerRenderer can be wrapped around it and passed to RenderMarkdownCustom using blackfriday.WithRenderer.
+func BaseRenderer(allowHTML bool) blackfriday.Renderer {
+	if allowHTML {
+		return bfhtml
+	}
+	return &EscapingRenderer{bfhtml}
+}
+
+var PillHTMLRenderer = blackfriday.WithRenderer(&PillRenderer{bfhtml})
+var PillNoHTMLRenderer = blackfriday.WithRenderer(&PillRenderer{&EscapingRenderer{bfhtml}})
+
 func RenderMarkdown(text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
+	renderer := Renderer
+	if !allowHTML {
+		renderer = NoHTMLRenderer
+	}
+	return RenderMarkdownCustom(text, allowMarkdown, allowHTML, renderer)
+}
+
+// RenderMarkdownWithMentions renders markdown like RenderMarkdown, but also turns user IDs and room aliases
+// in the text into matrix.to pills, and fills the m.mentions field with the users who were mentioned.
+//
+// The Mentions field is always set, so the returned content only pings the users who were explicitly mentioned.
+func RenderMarkdownWithMentions(text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
+	renderer := PillHTMLRenderer
+	if !allowHTML {
+		renderer = PillNoHTMLRenderer
+	}
+	content := RenderMarkdownCustom(text, allowMarkdown, allowHTML, renderer)
+	content.Mentions = ExtractMentions(content.FormattedBody, content.Body)
+	return content
+}
+
+// RenderMarkdownCustom renders markdown using the given blackfriday renderer option.
+func RenderMarkdownCustom(text string, allowMarkdown, allowHTML bool, renderer blackfriday.Option) event.MessageEventContent {
 	var htmlBody string
 
 	if allowMarkdown {
-		renderer := Renderer
-		if !allowHTML {
-			renderer = NoHTMLRenderer
-		}
 		htmlBodyBytes := blackfriday.Run([]byte(text), Extensions, renderer)
-		htmlBody = strings.TrimRight(string(htmlBodyBytes), "\n")
+		htmlBody = strings.Trim(string(htmlBodyBytes), "\n")
 		htmlBody = AntiParagraphRegex.ReplaceAllString(htmlBody, "$1")
 	} else {
 		htmlBody = strings.Replace(text, "\n", "<br>", -1)
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"html"
+	"strings"
+	"testing"
+
+	"github.com/russross/blackfriday/v2"
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRenderMarkdown_Basic(t *testing.T) {
+	content := format.RenderMarkdown("**hello** world", true, false)
+	assert.Equal(t, event.FormatHTML, content.Format)
+	assert.Equal(t, "<strong>hello</strong> world", content.FormattedBody)
+	assert.Equal(t, "**hello** world", content.Body)
+
+	content = format.RenderMarkdown("hello world", true, false)
+	assert.Empty(t, content.FormattedBody)
+	assert.Equal(t, "hello world", content.Body)
+}
+
+func TestRenderMarkdownWithMentions(t *testing.T) {
+	content := format.RenderMarkdownWithMentions("hi @alice:example.com, see #room:example.org and `@bob:example.com`", true, false)
+	assert.Equal(t, `hi <a href="https://matrix.to/#/%40alice%3Aexample.com">@alice:example.com</a>, see <a href="https://matrix.to/#/%23room%3Aexample.org">#room:example.org</a> and <code>@bob:example.com</code>`, content.FormattedBody)
+	assert.Equal(t, "hi @alice:example.com, see #room:example.org and `@bob:example.com`", content.Body)
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, content.Mentions.UserIDs)
+	assert.False(t, content.Mentions.Room)
+}
+
+func TestRenderMarkdownWithMentions_ExplicitLinks(t *testing.T) {
+	content := format.RenderMarkdownWithMentions("[Bob](https://matrix.to/#/@bob:example.com) @room", true, false)
+	assert.Equal(t, `<a href="https://matrix.to/#/@bob:example.com">Bob</a> @room`, content.FormattedBody)
+	assert.Equal(t, []id.UserID{"@bob:example.com"}, content.Mentions.UserIDs)
+	assert.True(t, content.Mentions.Room)
+
+	content = format.RenderMarkdownWithMentions("no mentions here", true, false)
+	assert.NotNil(t, content.Mentions)
+	assert.Empty(t, content.Mentions.UserIDs)
+}
+
+func TestRenderMarkdown_Highlighting(t *testing.T) {
+	highlighter := func(code, language string) (string, bool) {
+		if language != "go" {
+			return "", false
+		}
+		return strings.Replace(html.EscapeString(code), "func", `<span data-mx-color="#ff0000">func</span>`, 1), true
+	}
+	renderer := format.NewHighlightingRenderer(highlighter, false)
+	content := format.RenderMarkdownCustom("```go\nfunc main() {}\n```", true, false, renderer)
+	assert.Equal(t, "<pre><code class=\"language-go\"><span data-mx-color=\"#ff0000\">func</span> main() {}\n</code></pre>", content.FormattedBody)
+	assert.Equal(t, "```go\nfunc main() {}\n```", content.Body)
+
+	content = format.RenderMarkdownCustom("```python\nprint(1 < 2)\n```", true, false, renderer)
+	assert.Equal(t, "<pre><code class=\"language-python\">print(1 &lt; 2)\n</code></pre>", content.FormattedBody)
+}
+
+func TestHTMLParser_CodeBlockLanguage(t *testing.T) {
+	parser := &format.HTMLParser{
+		Newline: "\n",
+		MonospaceBlockConverter: func(code, language string, _ format.Context) string {
+			return language + ":" + code
+		},
+		ColorConverter: func(text, fg, bg string, _ format.Context) string {
+			return "colored"
+		},
+	}
+	assert.Equal(t, "go:func main() {}", parser.Parse(`<pre><code class="hljs language-go"><span data-mx-color="#ff0000">func</span> main() {}<br></code></pre>`, nil))
+}
+
+func TestRenderMarkdown_Spoilers(t *testing.T) {
+	renderer := blackfriday.WithRenderer(&format.SpoilerRenderer{&format.PillRenderer{format.BaseRenderer(false)}})
+	content := format.RenderMarkdownCustom("the ending: ||they <die>|| and ||sad|@bob:example.com leaves||", true, false, renderer)
+	assert.Equal(t, `the ending: <span data-mx-spoiler>they &lt;die&gt;</span> and <span data-mx-spoiler="sad"><a href="https://matrix.to/#/%40bob%3Aexample.com">@bob:example.com</a> leaves</span>`, content.FormattedBody)
+	// The plaintext body is generated with HTMLToText, which doesn't convert spoilers by default.
+	assert.Equal(t, "the ending: they <die> and @bob:example.com leaves", content.Body)
+
+	content = format.RenderMarkdownCustom("no | spoilers || here", true, false, renderer)
+	assert.Empty(t, content.FormattedBody)
+}
+
+func TestRenderMarkdown_Math(t *testing.T) {
+	renderer := blackfriday.WithRenderer(&format.MathRenderer{format.BaseRenderer(false)})
+	content := format.RenderMarkdownCustom("inline $x^2 < y$ and $`\\frac{a}{b}`$, but not $5 or $10", true, false, renderer)
+	assert.Equal(t, `inline <span data-mx-maths="x^2 &lt; y"><code>x^2 &lt; y</code></span> and <span data-mx-maths="\frac{a}{b}"><code>\frac{a}{b}</code></span>, but not $5 or $10`, content.FormattedBody)
+	assert.Equal(t, `inline $x^2 < y$ and $\frac{a}{b}$, but not $5 or $10`, content.Body)
+
+	content = format.RenderMarkdownCustom("```math\nE = mc^2\n```", true, false, renderer)
+	assert.Equal(t, `<div data-mx-maths="E = mc^2"><code>E = mc^2</code></div>`, content.FormattedBody)
+	assert.Equal(t, "$$E = mc^2$$", content.Body)
+}
+
+func TestRenderMarkdown_Table(t *testing.T) {
+	content := format.RenderMarkdown("| name | count |\n|:---|---:|\n| apples | 5 |\n| kiwis | 12 |", true, false)
+	assert.Contains(t, content.FormattedBody, "<table>")
+	// HTMLToText doesn't format tables by default.
+	assert.Equal(t, "namecountapples5kiwis12", content.Body)
+
+	parser := &format.HTMLParser{Newline: "\n", TableConverter: format.DefaultTableConverter}
+	assert.Equal(t, "| name   | count |\n|--------|-------|\n| apples |     5 |\n| kiwis  |    12 |", parser.Parse(content.FormattedBody, nil))
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// InlineMathRegex matches $latex$ in plain text. To avoid matching prices, the content can't start or end with
+// whitespace and the closing $ can't be followed by a digit.
+var InlineMathRegex = regexp.MustCompile(`\$([^$\s](?:[^$\n]*[^$\s])?)\$(?:[^0-9]|$)`)
+
+var mathInfo = []byte("math")
+
+// MathRenderer is a blackfriday renderer that outputs LaTeX as data-mx-maths tags (MSC2191).
+//
+// Inline math can be written as $latex$ or $`latex`$, and block math as a fenced code block with the math or
+// latex language. The code span syntax is recommended for anything complicated, as the content of plain
+// $latex$ is parsed as markdown first, which eats backslashes before punctuation.
+//
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2191
+type MathRenderer struct {
+	blackfriday.Renderer
+}
+
+func (r *MathRenderer) RenderHeader(w io.Writer, ast *blackfriday.Node) {
+	r.Renderer.RenderHeader(w, ast)
+	mergeAdjacentText(ast)
+	ast.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if node.Type != blackfriday.Code || node.Prev == nil || node.Next == nil ||
+			node.Prev.Type != blackfriday.Text || node.Next.Type != blackfriday.Text ||
+			!bytes.HasSuffix(node.Prev.Literal, []byte("$")) || !bytes.HasPrefix(node.Next.Literal, []byte("$")) {
+			return blackfriday.GoToNext
+		}
+		node.Prev.Literal = node.Prev.Literal[:len(node.Prev.Literal)-1]
+		node.Next.Literal = node.Next.Literal[1:]
+		node.Info = mathInfo
+		return blackfriday.GoToNext
+	})
+}
+
+func writeMath(w io.Writer, latex string, displayMode bool) {
+	latex = html.EscapeString(latex)
+	if displayMode {
+		_, _ = fmt.Fprintf(w, `<div data-mx-maths="%s"><code>%s</code></div>`, latex, latex)
+		_, _ = io.WriteString(w, "\n")
+	} else {
+		_, _ = fmt.Fprintf(w, `<span data-mx-maths="%s"><code>%s</code></span>`, latex, latex)
+	}
+}
+
+func (r *MathRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	switch node.Type {
+	case blackfriday.CodeBlock:
+		if language := CodeBlockLanguage(node); language == "math" || language == "latex" {
+			writeMath(w, string(bytes.TrimRight(node.Literal, "\n")), true)
+			return blackfriday.GoToNext
+		}
+	case blackfriday.Code:
+		if bytes.Equal(node.Info, mathInfo) {
+			writeMath(w, string(node.Literal), false)
+			return blackfriday.GoToNext
+		}
+	case blackfriday.Text:
+		if isInsideLink(node) {
+			break
+		}
+		text := node.Literal
+		lastEnd := 0
+		for _, match := range InlineMathRegex.FindAllSubmatchIndex(text, -1) {
+			r.Renderer.RenderNode(w, &blackfriday.Node{Type: blackfriday.Text, Literal: text[lastEnd:match[0]], Parent: node.Parent}, true)
+			writeMath(w, string(text[match[2]:match[3]]), false)
+			// The regex consumes the character after the closing $, so continue right after the $
+			lastEnd = match[3] + 1
+		}
+		r.Renderer.RenderNode(w, &blackfriday.Node{Type: blackfriday.Text, Literal: text[lastEnd:], Parent: node.Parent}, true)
+		return blackfriday.GoToNext
+	}
+	return r.Renderer.RenderNode(w, node, entering)
+}
+
+// DefaultMathConverter converts LaTeX back into the $latex$ and $$latex$$ syntaxes.
+func DefaultMathConverter(latex string, displayMode bool, _ Context) string {
+	if displayMode {
+		return fmt.Sprintf("$$%s$$", latex)
+	}
+	return fmt.Sprintf("$%s$", latex)
+}
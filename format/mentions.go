@@ -0,0 +1,209 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/russross/blackfriday/v2"
+	"golang.org/x/net/html"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// PillRegex matches user IDs and room aliases in plain text.
+var PillRegex = regexp.MustCompile(`(?:^|[\s(])([@#][^\s:@#]+:[a-zA-Z0-9.-]*[a-zA-Z0-9](?::\d{1,5})?)`)
+
+// RoomMentionRegex matches @room in plain text.
+var RoomMentionRegex = regexp.MustCompile(`(?:^|\W)@room(?:\W|$)`)
+
+// PillRenderer is a blackfriday renderer that turns user IDs and room aliases in text nodes into matrix.to pills.
+// Text inside links and code is left as-is.
+type PillRenderer struct {
+	blackfriday.Renderer
+}
+
+func isInsideLink(node *blackfriday.Node) bool {
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		if parent.Type == blackfriday.Link {
+			return true
+		}
+	}
+	return false
+}
+
+func pillURL(identifier string) string {
+	if identifier[0] == '@' {
+		return id.UserID(identifier).URI().MatrixToURL()
+	}
+	return id.RoomAlias(identifier).URI().MatrixToURL()
+}
+
+func (r *PillRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type != blackfriday.Text || isInsideLink(node) {
+		return r.Renderer.RenderNode(w, node, entering)
+	}
+	text := node.Literal
+	renderText := func(part []byte) {
+		r.Renderer.RenderNode(w, &blackfriday.Node{Type: blackfriday.Text, Literal: part, Parent: node.Parent}, true)
+	}
+	lastEnd := 0
+	for _, match := range PillRegex.FindAllSubmatchIndex(text, -1) {
+		start, end := match[2], match[3]
+		renderText(text[lastEnd:start])
+		identifier := string(text[start:end])
+		_, _ = fmt.Fprintf(w, `<a href="%s">%s</a>`, html.EscapeString(pillURL(identifier)), html.EscapeString(identifier))
+		lastEnd = end
+	}
+	renderText(text[lastEnd:])
+	return blackfriday.GoToNext
+}
+
+// ExtractedMentions contains the Matrix identifiers and permalinks found in a message.
+type ExtractedMentions struct {
+	UserIDs     []id.UserID
+	RoomIDs     []id.RoomID
+	RoomAliases []id.RoomAlias
+	// Links to specific events. The primary identifier of each URI is the room ID or alias.
+	EventLinks []*id.MatrixURI
+	// Whether the message contains @room.
+	Room bool
+}
+
+// PlaintextMatrixLinkRegex matches matrix.to URLs and matrix: URIs in plain text.
+var PlaintextMatrixLinkRegex = regexp.MustCompile(`(?:https://matrix\.to/#/|matrix:)[^\s<>"]+`)
+
+func (em *ExtractedMentions) addUser(userID id.UserID) {
+	for _, existing := range em.UserIDs {
+		if existing == userID {
+			return
+		}
+	}
+	em.UserIDs = append(em.UserIDs, userID)
+}
+
+func (em *ExtractedMentions) addRoomID(roomID id.RoomID) {
+	for _, existing := range em.RoomIDs {
+		if existing == roomID {
+			return
+		}
+	}
+	em.RoomIDs = append(em.RoomIDs, roomID)
+}
+
+func (em *ExtractedMentions) addRoomAlias(alias id.RoomAlias) {
+	for _, existing := range em.RoomAliases {
+		if existing == alias {
+			return
+		}
+	}
+	em.RoomAliases = append(em.RoomAliases, alias)
+}
+
+func (em *ExtractedMentions) addURI(uri *id.MatrixURI) {
+	switch {
+	case uri.Sigil2 == '$':
+		for _, existing := range em.EventLinks {
+			if existing.MXID1 == uri.MXID1 && existing.MXID2 == uri.MXID2 {
+				return
+			}
+		}
+		em.EventLinks = append(em.EventLinks, uri)
+	case len(uri.UserID()) > 0:
+		em.addUser(uri.UserID())
+	case len(uri.RoomID()) > 0:
+		em.addRoomID(uri.RoomID())
+	case len(uri.RoomAlias()) > 0:
+		em.addRoomAlias(uri.RoomAlias())
+	}
+}
+
+func (em *ExtractedMentions) addHTMLLinks(htmlBody string) {
+	tokenizer := html.NewTokenizer(strings.NewReader(htmlBody))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		} else if tokenType != html.StartTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data != "a" {
+			continue
+		}
+		for _, attr := range token.Attr {
+			if attr.Key != "href" {
+				continue
+			}
+			uri, err := id.ParseMatrixURIOrMatrixToURL(attr.Val)
+			if err == nil && uri != nil {
+				em.addURI(uri)
+			}
+		}
+	}
+}
+
+func (em *ExtractedMentions) addPlaintext(body string) {
+	for _, link := range PlaintextMatrixLinkRegex.FindAllString(body, -1) {
+		uri, err := id.ParseMatrixURIOrMatrixToURL(strings.TrimRight(link, ".,)!?"))
+		if err == nil && uri != nil {
+			em.addURI(uri)
+		}
+	}
+	for _, match := range PillRegex.FindAllStringSubmatch(body, -1) {
+		identifier := match[1]
+		if identifier[0] == '@' {
+			em.addUser(id.UserID(identifier))
+		} else {
+			em.addRoomAlias(id.RoomAlias(identifier))
+		}
+	}
+}
+
+// ToMentions converts the extracted mentions into the m.mentions field of a message.
+func (em *ExtractedMentions) ToMentions() *event.Mentions {
+	mentions := &event.Mentions{Room: em.Room}
+	for _, userID := range em.UserIDs {
+		mentions.Add(userID)
+	}
+	return mentions
+}
+
+// ExtractAllMentions finds all Matrix identifiers and permalinks in the given message. If the message has a
+// formatted body, links in it are used. Otherwise, identifiers and matrix.to links in the plaintext body are used.
+// Reply fallbacks are ignored, so the sender of the replied-to message isn't counted as mentioned.
+func ExtractAllMentions(content *event.MessageEventContent) *ExtractedMentions {
+	body := content.Body
+	formattedBody := content.FormattedBody
+	if len(content.GetReplyTo()) > 0 {
+		body = event.TrimReplyFallbackText(body)
+		formattedBody = event.TrimReplyFallbackHTML(formattedBody)
+	}
+	em := &ExtractedMentions{
+		Room: RoomMentionRegex.MatchString(body),
+	}
+	if content.Format == event.FormatHTML && len(formattedBody) > 0 {
+		em.addHTMLLinks(formattedBody)
+	} else {
+		em.addPlaintext(body)
+	}
+	return em
+}
+
+// ExtractMentions finds the users mentioned in the given Matrix HTML using matrix.to or matrix: URI links.
+// If plaintext is non-empty, it's also checked for @room.
+func ExtractMentions(htmlBody, plaintext string) *event.Mentions {
+	em := &ExtractedMentions{
+		Room: RoomMentionRegex.MatchString(plaintext),
+	}
+	em.addHTMLLinks(htmlBody)
+	return em.ToMentions()
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestExtractAllMentions_HTML(t *testing.T) {
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          "> <@original:example.com> hi\n\nAlice, see #room:example.com and this",
+		Format:        event.FormatHTML,
+		FormattedBody: `<mx-reply><blockquote><a href="https://matrix.to/#/@original:example.com">@original:example.com</a> hi</blockquote></mx-reply><a href="https://matrix.to/#/@alice:example.com">Alice</a>, see <a href="https://matrix.to/#/%23room:example.com">#room:example.com</a> and <a href="https://matrix.to/#/!room:example.com/$event?via=example.com">this</a> <a href="matrix:u/alice:example.com">again</a>`,
+		RelatesTo:     &event.RelatesTo{InReplyTo: "$original"},
+	}
+	mentions := format.ExtractAllMentions(content)
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, mentions.UserIDs)
+	assert.Equal(t, []id.RoomAlias{"#room:example.com"}, mentions.RoomAliases)
+	require.Len(t, mentions.EventLinks, 1)
+	assert.Equal(t, id.RoomID("!room:example.com"), mentions.EventLinks[0].RoomID())
+	assert.Equal(t, id.EventID("$event"), mentions.EventLinks[0].EventID())
+	assert.False(t, mentions.Room)
+	assert.Equal(t, &event.Mentions{UserIDs: []id.UserID{"@alice:example.com"}}, mentions.ToMentions())
+}
+
+func TestExtractAllMentions_Plaintext(t *testing.T) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "@room @bob:example.com look at https://matrix.to/#/!abc:example.com and #chat:example.org.",
+	}
+	mentions := format.ExtractAllMentions(content)
+	assert.True(t, mentions.Room)
+	assert.Equal(t, []id.UserID{"@bob:example.com"}, mentions.UserIDs)
+	assert.Equal(t, []id.RoomID{"!abc:example.com"}, mentions.RoomIDs)
+	assert.Equal(t, []id.RoomAlias{"#chat:example.org"}, mentions.RoomAliases)
+}
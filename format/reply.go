@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// RenderReply renders the given markdown like RenderMarkdown and makes the message a reply to the given event.
+// The reply fallbacks are generated from the content of the original event after removing its own fallback,
+// so the original event must have parsed content.
+func RenderReply(inReplyTo *event.Event, text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
+	content := RenderMarkdown(text, allowMarkdown, allowHTML)
+	content.SetReply(inReplyTo)
+	return content
+}
+
+// RenderQuote renders the given markdown like RenderMarkdown and prepends a quote of the given event.
+// Unlike RenderReply, the quote is a part of the message itself rather than a fallback, so it isn't hidden
+// by clients and the message doesn't have a reply relation.
+func RenderQuote(quoted *event.Event, text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
+	content := RenderMarkdown(text, allowMarkdown, allowHTML)
+	quotedContent, ok := quoted.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return content
+	}
+	quotedCopy := *quotedContent
+	quotedCopy.RemoveReplyFallback()
+	quotedHTML := quotedCopy.FormattedBody
+	if quotedCopy.Format != event.FormatHTML || len(quotedHTML) == 0 {
+		quotedHTML = escapeWithLinebreaks(quotedCopy.Body)
+	}
+	if len(content.FormattedBody) == 0 || content.Format != event.FormatHTML {
+		content.FormattedBody = escapeWithLinebreaks(content.Body)
+		content.Format = event.FormatHTML
+	}
+	content.FormattedBody = fmt.Sprintf(
+		`<blockquote><a href="https://matrix.to/#/%s">%s</a>:<br>%s</blockquote>%s`,
+		quoted.Sender, quoted.Sender, quotedHTML, content.FormattedBody,
+	)
+	lines := strings.Split(strings.TrimSpace(quotedCopy.Body), "\n")
+	lines[0] = fmt.Sprintf("<%s> %s", quoted.Sender, lines[0])
+	content.Body = "> " + strings.Join(lines, "\n> ") + "\n\n" + content.Body
+	return content
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+func makeOriginal() *event.Event {
+	return &event.Event{
+		ID:     "$original",
+		RoomID: "!room:example.com",
+		Sender: "@alice:example.com",
+		Type:   event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          "> <@bob:example.com> first\n\nhello **world**",
+			Format:        event.FormatHTML,
+			FormattedBody: `<mx-reply><blockquote>first</blockquote></mx-reply>hello <strong>world</strong>`,
+			RelatesTo:     &event.RelatesTo{InReplyTo: "$first"},
+		}},
+	}
+}
+
+func TestRenderReply(t *testing.T) {
+	content := format.RenderReply(makeOriginal(), "hi _there_", true, false)
+	assert.Equal(t, `<mx-reply><blockquote><a href="https://matrix.to/#/!room:example.com/$original?via=example.com">In reply to</a> <a href="https://matrix.to/#/@alice:example.com">@alice:example.com</a><br>hello <strong>world</strong></blockquote></mx-reply>hi <em>there</em>`, content.FormattedBody)
+	assert.Equal(t, "> <@alice:example.com> hello **world**\n\nhi _there_", content.Body)
+	assert.Equal(t, "$original", content.GetReplyTo().String())
+}
+
+func TestRenderQuote(t *testing.T) {
+	content := format.RenderQuote(makeOriginal(), "agreed", true, false)
+	assert.Equal(t, `<blockquote><a href="https://matrix.to/#/@alice:example.com">@alice:example.com</a>:<br>hello <strong>world</strong></blockquote>agreed`, content.FormattedBody)
+	assert.Equal(t, "> <@alice:example.com> hello **world**\n\nagreed", content.Body)
+	assert.Nil(t, content.RelatesTo)
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Sanitizer removes tags and attributes that aren't allowed in Matrix HTML from untrusted input.
+// Disallowed tags are removed but their content is kept, except for tags like <script> whose content is dropped.
+//
+// https://spec.matrix.org/v1.4/client-server-api/#mroommessage-msgtypes
+type Sanitizer struct {
+	// Map from allowed tag name to the attributes allowed on that tag.
+	AllowedTags map[string][]string
+	// URL schemes allowed in the href attribute of links.
+	AllowedLinkSchemes []string
+	// URL schemes allowed in the src attribute of images.
+	AllowedImageSchemes []string
+}
+
+// DroppedContentTags are tags whose content is removed along with the tag itself.
+var DroppedContentTags = map[string]struct{}{
+	"script": {}, "style": {}, "head": {}, "title": {}, "iframe": {}, "object": {}, "embed": {},
+	"template": {}, "noscript": {}, "textarea": {}, "select": {}, "svg": {}, "math": {},
+}
+
+var voidTags = map[string]struct{}{"br": {}, "hr": {}, "img": {}}
+
+var colorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// NewSanitizer creates a sanitizer that allows the tags and attributes listed in the spec,
+// plus the data-mx-maths attribute from MSC2191.
+func NewSanitizer() *Sanitizer {
+	allowed := map[string][]string{
+		"font": {"data-mx-bg-color", "data-mx-color", "color"},
+		"span": {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler", "data-mx-maths"},
+		"div":  {"data-mx-maths"},
+		"a":    {"name", "target", "href"},
+		"img":  {"width", "height", "alt", "title", "src"},
+		"ol":   {"start"},
+		"code": {"class"},
+	}
+	for _, tag := range []string{
+		"del", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "p", "ul", "sup", "sub", "li", "b", "i", "u",
+		"strong", "em", "strike", "s", "hr", "br", "table", "thead", "tbody", "tr", "th", "td", "caption", "pre",
+		"details", "summary", "mx-reply",
+	} {
+		allowed[tag] = nil
+	}
+	return &Sanitizer{
+		AllowedTags:         allowed,
+		AllowedLinkSchemes:  []string{"https", "http", "ftp", "mailto", "magnet", "matrix"},
+		AllowedImageSchemes: []string{"mxc"},
+	}
+}
+
+// AllowTag allows the given tag with the given attributes. If the tag is already allowed, the attributes are added
+// to the existing list.
+func (s *Sanitizer) AllowTag(tag string, attributes ...string) {
+	s.AllowedTags[tag] = append(s.AllowedTags[tag], attributes...)
+}
+
+func hasScheme(url string, schemes []string) bool {
+	for _, scheme := range schemes {
+		if len(url) > len(scheme) && url[len(scheme)] == ':' && strings.EqualFold(url[:len(scheme)], scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Sanitizer) isAllowedValue(tag, attr, value string) bool {
+	switch attr {
+	case "href":
+		return hasScheme(value, s.AllowedLinkSchemes)
+	case "src":
+		return hasScheme(value, s.AllowedImageSchemes)
+	case "data-mx-color", "data-mx-bg-color", "color":
+		return colorRegex.MatchString(value)
+	case "class":
+		if tag == "code" {
+			return strings.HasPrefix(value, "language-") && !strings.ContainsAny(value, " \t\n")
+		}
+	}
+	return true
+}
+
+func (s *Sanitizer) filterAttributes(tag string, attrs []html.Attribute) []html.Attribute {
+	allowedAttrs := s.AllowedTags[tag]
+	filtered := attrs[:0]
+	for _, attr := range attrs {
+		if len(attr.Namespace) > 0 {
+			continue
+		}
+		for _, allowedAttr := range allowedAttrs {
+			if attr.Key == allowedAttr && s.isAllowedValue(tag, attr.Key, attr.Val) {
+				filtered = append(filtered, attr)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// Sanitize removes disallowed tags and attributes from the given HTML.
+func (s *Sanitizer) Sanitize(input string) string {
+	var output strings.Builder
+	var openTags []string
+	dropDepth := 0
+	tokenizer := html.NewTokenizer(strings.NewReader(input))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			// Either the end of the input or a tokenization error, the output is closed properly in both cases
+			break
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.TextToken:
+			if dropDepth == 0 {
+				output.WriteString(html.EscapeString(token.Data))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if _, dropContent := DroppedContentTags[token.Data]; dropContent {
+				if tokenType == html.StartTagToken {
+					dropDepth++
+				}
+				continue
+			}
+			if _, allowed := s.AllowedTags[token.Data]; !allowed || dropDepth > 0 {
+				continue
+			}
+			token.Attr = s.filterAttributes(token.Data, token.Attr)
+			if _, isVoid := voidTags[token.Data]; isVoid {
+				token.Type = html.SelfClosingTagToken
+			} else {
+				token.Type = html.StartTagToken
+				openTags = append(openTags, token.Data)
+			}
+			output.WriteString(token.String())
+		case html.EndTagToken:
+			if _, dropContent := DroppedContentTags[token.Data]; dropContent {
+				if dropDepth > 0 {
+					dropDepth--
+				}
+				continue
+			}
+			// Close the tag and any unclosed tags inside it, or ignore the end tag if the tag isn't open.
+			for i := len(openTags) - 1; i >= 0; i-- {
+				if openTags[i] == token.Data {
+					for j := len(openTags) - 1; j >= i; j-- {
+						output.WriteString("</" + openTags[j] + ">")
+					}
+					openTags = openTags[:i]
+					break
+				}
+			}
+		}
+	}
+	for i := len(openTags) - 1; i >= 0; i-- {
+		output.WriteString("</" + openTags[i] + ">")
+	}
+	return output.String()
+}
+
+var defaultSanitizer = NewSanitizer()
+
+// SanitizeHTML removes tags and attributes that aren't allowed by the spec from the given HTML.
+func SanitizeHTML(input string) string {
+	return defaultSanitizer.Sanitize(input)
+}
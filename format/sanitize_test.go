@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/format"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	assert.Equal(t, `<b>bold</b> text`, format.SanitizeHTML(`<b onclick="alert(1)">bold</b> text<script>alert(1)</script>`))
+	assert.Equal(t, `<a>link</a> <a href="https://example.com">ok</a>`, format.SanitizeHTML(`<a href="javascript:alert(1)">link</a> <a href="https://example.com" style="font-size: 1000px">ok</a>`))
+	assert.Equal(t, `<img src="mxc://example.com/abc" alt="cat"/><img/>`, format.SanitizeHTML(`<img src="mxc://example.com/abc" alt="cat"><img src="https://tracker.example.com/pixel.gif">`))
+	assert.Equal(t, `<span data-mx-color="#ff0000">red</span><span>bad</span>`, format.SanitizeHTML(`<span data-mx-color="#ff0000">red</span><span data-mx-color="red; background: url(x)">bad</span>`))
+	assert.Equal(t, `<p>unknown &lt;tag&gt; content</p>`, format.SanitizeHTML(`<p><marquee>unknown &lt;tag&gt; content</marquee></p>`))
+	assert.Equal(t, `<blockquote><p>unclosed</p></blockquote>`, format.SanitizeHTML(`<blockquote><p>unclosed</blockquote></div>`))
+	assert.Equal(t, `<pre><code class="language-go">code</code></pre>`, format.SanitizeHTML(`<pre><code class="language-go">code</code></pre>`))
+	assert.Equal(t, `<span data-mx-spoiler="">secret</span>`, format.SanitizeHTML(`<span data-mx-spoiler>secret</span><style>body { display: none }</style>`))
+}
+
+func TestSanitizer_AllowTag(t *testing.T) {
+	sanitizer := format.NewSanitizer()
+	sanitizer.AllowTag("span", "data-custom")
+	sanitizer.AllowTag("kbd")
+	assert.Equal(t, `<kbd>Ctrl</kbd> <span data-custom="x">y</span>`, sanitizer.Sanitize(`<kbd>Ctrl</kbd> <span data-custom="x" data-other="z">y</span>`))
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// LengthFunc measures the length of a string for message splitting.
+type LengthFunc func(string) int
+
+// ByteLength measures strings in bytes.
+func ByteLength(str string) int {
+	return len(str)
+}
+
+// RuneLength measures strings in Unicode code points.
+func RuneLength(str string) int {
+	return utf8.RuneCountInString(str)
+}
+
+// cutText finds the longest prefix of text whose length is at most limit. The cut is made after the last line break
+// or space if there is one. If there isn't, the cut is made at the last rune boundary that fits if hardCut is true,
+// and otherwise nothing is cut off.
+func cutText(text string, limit int, length LengthFunc, hardCut bool) (string, string) {
+	if length(text) <= limit {
+		return text, ""
+	}
+	runeStarts := make([]int, 0, len(text))
+	for i := range text {
+		runeStarts = append(runeStarts, i)
+	}
+	// The length of a prefix never decreases when it gets longer, so binary search for the longest one that fits
+	fitting := sort.Search(len(runeStarts), func(i int) bool {
+		return length(text[:runeStarts[i]]) > limit
+	})
+	cut := 0
+	if fitting > 0 {
+		cut = runeStarts[fitting-1]
+	}
+	if lastBreak := strings.LastIndexByte(text[:cut], '\n'); lastBreak >= 0 {
+		cut = lastBreak + 1
+	} else if lastSpace := strings.LastIndexByte(text[:cut], ' '); lastSpace >= 0 {
+		cut = lastSpace + 1
+	} else if !hardCut {
+		cut = 0
+	}
+	return text[:cut], text[cut:]
+}
+
+// SplitText splits plain text into parts that are at most limit long, preferably at line breaks or spaces.
+func SplitText(text string, limit int, length LengthFunc) []string {
+	var parts []string
+	for len(text) > 0 {
+		part, rest := cutText(text, limit, length, true)
+		if len(part) == 0 {
+			// The limit is too small to fit even a single character
+			part, rest = text, ""
+		}
+		parts = append(parts, strings.TrimRight(part, "\n"))
+		text = rest
+	}
+	return parts
+}
+
+type htmlSplitter struct {
+	limit  int
+	length LengthFunc
+
+	parts    []string
+	current  strings.Builder
+	openTags []html.Token
+}
+
+func (s *htmlSplitter) closingTags() string {
+	var closing strings.Builder
+	for i := len(s.openTags) - 1; i >= 0; i-- {
+		closing.WriteString("</" + s.openTags[i].Data + ">")
+	}
+	return closing.String()
+}
+
+func (s *htmlSplitter) openingTags() string {
+	var opening strings.Builder
+	for _, token := range s.openTags {
+		opening.WriteString(token.String())
+	}
+	return opening.String()
+}
+
+func (s *htmlSplitter) remaining() int {
+	return s.limit - s.length(s.current.String()) - s.length(s.closingTags())
+}
+
+// flush ends the current part, closing all open tags, and starts a new part where the tags are reopened.
+func (s *htmlSplitter) flush() bool {
+	opening := s.openingTags()
+	if s.current.Len() == len(opening) && s.current.String() == opening {
+		// Nothing has been written to the current part, flushing wouldn't make any progress
+		return false
+	}
+	s.parts = append(s.parts, s.current.String()+s.closingTags())
+	s.current.Reset()
+	s.current.WriteString(s.openingTags())
+	return true
+}
+
+func (s *htmlSplitter) writeText(text string) {
+	escapedLength := func(str string) int {
+		return s.length(html.EscapeString(str))
+	}
+	for len(text) > 0 {
+		part, rest := cutText(text, s.remaining(), escapedLength, false)
+		if len(part) == 0 {
+			// Prefer starting a new part over splitting in the middle of a word
+			if s.flush() {
+				continue
+			}
+			part, rest = cutText(text, s.remaining(), escapedLength, true)
+		}
+		if len(part) == 0 {
+			// The text doesn't fit even in an empty part, so write one rune past the limit to make progress
+			_, size := utf8.DecodeRuneInString(text)
+			part, rest = text[:size], text[size:]
+		}
+		s.current.WriteString(html.EscapeString(part))
+		text = rest
+	}
+}
+
+func (s *htmlSplitter) writeTag(token html.Token, needsClosing bool) {
+	tag := token.String()
+	required := s.length(tag)
+	if needsClosing {
+		required += s.length("</" + token.Data + ">")
+	}
+	if required > s.remaining() {
+		s.flush()
+	}
+	s.current.WriteString(tag)
+}
+
+// SplitHTML splits Matrix HTML into parts that are at most limit long. Parts are only split between tags or inside
+// text, never inside a tag or an HTML entity, and any tags that are open at the split point are closed at the end of
+// the part and reopened at the start of the next part. Text is preferably split at line breaks or spaces.
+func SplitHTML(input string, limit int, length LengthFunc) []string {
+	splitter := &htmlSplitter{limit: limit, length: length}
+	tokenizer := html.NewTokenizer(strings.NewReader(input))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.TextToken:
+			splitter.writeText(token.Data)
+		case html.StartTagToken:
+			_, isVoid := voidTags[token.Data]
+			splitter.writeTag(token, !isVoid)
+			if !isVoid {
+				splitter.openTags = append(splitter.openTags, token)
+			}
+		case html.SelfClosingTagToken:
+			splitter.writeTag(token, false)
+		case html.EndTagToken:
+			for i := len(splitter.openTags) - 1; i >= 0; i-- {
+				if splitter.openTags[i].Data == token.Data {
+					splitter.openTags = append(splitter.openTags[:i], splitter.openTags[i+1:]...)
+					splitter.current.WriteString(token.String())
+					break
+				}
+			}
+		}
+	}
+	if splitter.current.Len() > 0 {
+		splitter.parts = append(splitter.parts, splitter.current.String()+splitter.closingTags())
+	}
+	return splitter.parts
+}
+
+// SplitMessage splits a message into multiple messages whose body, or formatted body if the message has one, is at
+// most limit long. The plaintext bodies of split HTML messages are generated with HTMLToText. Other fields of the
+// message, such as relations, are copied to every part.
+func SplitMessage(content *event.MessageEventContent, limit int, length LengthFunc) []*event.MessageEventContent {
+	var parts []*event.MessageEventContent
+	if content.Format == event.FormatHTML && len(content.FormattedBody) > 0 {
+		if length(content.FormattedBody) <= limit {
+			return []*event.MessageEventContent{content}
+		}
+		for _, htmlPart := range SplitHTML(content.FormattedBody, limit, length) {
+			part := *content
+			part.FormattedBody = htmlPart
+			part.Body = HTMLToText(htmlPart)
+			parts = append(parts, &part)
+		}
+	} else {
+		if length(content.Body) <= limit {
+			return []*event.MessageEventContent{content}
+		}
+		for _, textPart := range SplitText(content.Body, limit, length) {
+			part := *content
+			part.Body = textPart
+			parts = append(parts, &part)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+func TestSplitText(t *testing.T) {
+	assert.Equal(t, []string{"hello ", "world"}, format.SplitText("hello world", 8, format.ByteLength))
+	assert.Equal(t, []string{"first line", "second"}, format.SplitText("first line\nsecond", 12, format.ByteLength))
+	assert.Equal(t, []string{"abcd", "efgh"}, format.SplitText("abcdefgh", 4, format.ByteLength))
+	assert.Equal(t, []string{"äöå", "äöå"}, format.SplitText("äöåäöå", 3, format.RuneLength))
+	assert.Equal(t, []string{"ä", "ö"}, format.SplitText("äö", 3, format.ByteLength))
+}
+
+func TestSplitHTML(t *testing.T) {
+	parts := format.SplitHTML(`<b>bold text</b> and <a href="https://example.com">a link &amp; more</a>`, 40, format.ByteLength)
+	assert.Equal(t, []string{
+		`<b>bold text</b> and `,
+		`<a href="https://example.com">a </a>`,
+		`<a href="https://example.com">link </a>`,
+		`<a href="https://example.com">&amp; </a>`,
+		`<a href="https://example.com">more</a>`,
+	}, parts)
+	for _, part := range parts {
+		assert.LessOrEqual(t, len(part), 40)
+	}
+
+	parts = format.SplitHTML("<p>"+strings.Repeat("word ", 10)+"</p><p>short</p>", 30, format.ByteLength)
+	for _, part := range parts {
+		assert.LessOrEqual(t, len(part), 30)
+		assert.True(t, strings.HasPrefix(part, "<p>") && strings.HasSuffix(part, "</p>"), part)
+	}
+	assert.Equal(t, "<p>word word </p><p>short</p>", parts[len(parts)-1])
+}
+
+func TestSplitMessage(t *testing.T) {
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          "**one** two three",
+		Format:        event.FormatHTML,
+		FormattedBody: "<strong>one</strong> two three",
+	}
+	parts := format.SplitMessage(content, 24, format.ByteLength)
+	require.Len(t, parts, 2)
+	assert.Equal(t, "<strong>one</strong> ", parts[0].FormattedBody)
+	assert.Equal(t, "**one**", parts[0].Body)
+	assert.Equal(t, "two three", parts[1].FormattedBody)
+	assert.Equal(t, "two three", parts[1].Body)
+
+	plain := &event.MessageEventContent{MsgType: event.MsgText, Body: "short"}
+	assert.Equal(t, []*event.MessageEventContent{plain}, format.SplitMessage(plain, 100, format.ByteLength))
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// SpoilerRegex matches ||spoiler|| and ||reason|spoiler|| in plain text.
+var SpoilerRegex = regexp.MustCompile(`\|\|(?:([^|]*)\|)?([^|]+?)\|\|`)
+
+// SpoilerRenderer is a blackfriday renderer that turns ||spoiler|| and ||reason|spoiler|| in text into
+// <span data-mx-spoiler> tags. Spoilers can't contain other markdown formatting. Text inside the spoiler is
+// still passed to the wrapped renderer, so it can be combined with PillRenderer.
+type SpoilerRenderer struct {
+	blackfriday.Renderer
+}
+
+// mergeAdjacentText merges consecutive text nodes in the AST, so that spoiler markers split into multiple nodes
+// by the markdown parser (e.g. around < characters) are found.
+func mergeAdjacentText(ast *blackfriday.Node) {
+	ast.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if !entering || node.Type != blackfriday.Text {
+			return blackfriday.GoToNext
+		}
+		for node.Next != nil && node.Next.Type == blackfriday.Text {
+			// The literals point to the original markdown, so they must be copied instead of appending in-place
+			merged := make([]byte, 0, len(node.Literal)+len(node.Next.Literal))
+			node.Literal = append(append(merged, node.Literal...), node.Next.Literal...)
+			node.Next.Unlink()
+		}
+		return blackfriday.GoToNext
+	})
+}
+
+func (r *SpoilerRenderer) RenderHeader(w io.Writer, ast *blackfriday.Node) {
+	r.Renderer.RenderHeader(w, ast)
+	mergeAdjacentText(ast)
+}
+
+func (r *SpoilerRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type != blackfriday.Text || isInsideLink(node) {
+		return r.Renderer.RenderNode(w, node, entering)
+	}
+	text := node.Literal
+	renderText := func(part []byte) {
+		r.Renderer.RenderNode(w, &blackfriday.Node{Type: blackfriday.Text, Literal: part, Parent: node.Parent}, true)
+	}
+	lastEnd := 0
+	for _, match := range SpoilerRegex.FindAllSubmatchIndex(text, -1) {
+		renderText(text[lastEnd:match[0]])
+		if match[2] >= 0 {
+			_, _ = fmt.Fprintf(w, `<span data-mx-spoiler="%s">`, html.EscapeString(string(text[match[2]:match[3]])))
+		} else {
+			_, _ = io.WriteString(w, "<span data-mx-spoiler>")
+		}
+		renderText(text[match[4]:match[5]])
+		_, _ = io.WriteString(w, "</span>")
+		lastEnd = match[1]
+	}
+	renderText(text[lastEnd:])
+	return blackfriday.GoToNext
+}
+
+// DefaultSpoilerConverter converts spoilers into the same ||reason|spoiler|| syntax that SpoilerRenderer accepts.
+func DefaultSpoilerConverter(text, reason string, _ Context) string {
+	if len(reason) > 0 {
+		return fmt.Sprintf("||%s|%s||", reason, text)
+	}
+	return fmt.Sprintf("||%s||", text)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// TableCell is a single cell in a parsed HTML table.
+type TableCell struct {
+	// The content of the cell, converted to text using the parser. Line breaks are replaced with spaces.
+	Text   string
+	Header bool
+	// The alignment of the cell (left, center or right), or an empty string if not specified.
+	Align string
+}
+
+// Table is a parsed HTML table.
+type Table struct {
+	Caption string
+	Rows    [][]TableCell
+}
+
+type TableConverter func(table *Table, ctx Context) string
+
+// ColumnCount returns the number of columns in the widest row of the table.
+func (table *Table) ColumnCount() int {
+	count := 0
+	for _, row := range table.Rows {
+		if len(row) > count {
+			count = len(row)
+		}
+	}
+	return count
+}
+
+func isHeaderRow(row []TableCell) bool {
+	for _, cell := range row {
+		if !cell.Header {
+			return false
+		}
+	}
+	return len(row) > 0
+}
+
+func padCell(text string, width int, align string) string {
+	padding := width - utf8.RuneCountInString(text)
+	switch align {
+	case "right":
+		return strings.Repeat(" ", padding) + text
+	case "center":
+		return strings.Repeat(" ", padding/2) + text + strings.Repeat(" ", padding-padding/2)
+	default:
+		return text + strings.Repeat(" ", padding)
+	}
+}
+
+// DefaultTableConverter converts tables into aligned plaintext using the markdown table syntax,
+// which is readable when displayed in a monospace font.
+func DefaultTableConverter(table *Table, _ Context) string {
+	widths := make([]int, table.ColumnCount())
+	for _, row := range table.Rows {
+		for i, cell := range row {
+			if length := utf8.RuneCountInString(cell.Text); length > widths[i] {
+				widths[i] = length
+			}
+		}
+	}
+	var lines []string
+	if len(table.Caption) > 0 {
+		lines = append(lines, table.Caption)
+	}
+	for rowIndex, row := range table.Rows {
+		cells := make([]string, len(widths))
+		for i := range widths {
+			var cell TableCell
+			if i < len(row) {
+				cell = row[i]
+			}
+			cells[i] = padCell(cell.Text, widths[i], cell.Align)
+		}
+		lines = append(lines, strings.TrimRight("| "+strings.Join(cells, " | ")+" |", " "))
+		if isHeaderRow(row) && (rowIndex+1 >= len(table.Rows) || !isHeaderRow(table.Rows[rowIndex+1])) {
+			separators := make([]string, len(widths))
+			for i, width := range widths {
+				separators[i] = strings.Repeat("-", width)
+			}
+			lines = append(lines, "|-"+strings.Join(separators, "-|-")+"-|")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (parser *HTMLParser) cellAlign(node *html.Node) string {
+	if align := parser.getAttribute(node, "align"); len(align) > 0 {
+		return strings.ToLower(align)
+	}
+	style := strings.ReplaceAll(parser.getAttribute(node, "style"), " ", "")
+	if index := strings.Index(style, "text-align:"); index >= 0 {
+		align := style[index+len("text-align:"):]
+		if end := strings.IndexByte(align, ';'); end >= 0 {
+			align = align[:end]
+		}
+		return strings.ToLower(align)
+	}
+	return ""
+}
+
+func (parser *HTMLParser) collectTableRows(node *html.Node, table *Table, ctx Context) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode {
+			continue
+		}
+		switch child.Data {
+		case "caption":
+			table.Caption = parser.nodeToTagAwareString(child.FirstChild, true, ctx)
+		case "thead", "tbody", "tfoot":
+			parser.collectTableRows(child, table, ctx)
+		case "tr":
+			var row []TableCell
+			for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type != html.ElementNode || (cell.Data != "td" && cell.Data != "th") {
+					continue
+				}
+				text := parser.nodeToTagAwareString(cell.FirstChild, true, ctx)
+				row = append(row, TableCell{
+					Text:   strings.Join(strings.Fields(text), " "),
+					Header: cell.Data == "th",
+					Align:  parser.cellAlign(cell),
+				})
+			}
+			table.Rows = append(table.Rows, row)
+		}
+	}
+}
+
+// ParseTable parses the given <table> node into a Table.
+func (parser *HTMLParser) ParseTable(node *html.Node, ctx Context) *Table {
+	var table Table
+	parser.collectTableRows(node, &table, ctx)
+	return &table
+}
+
+func (parser *HTMLParser) tableToString(node *html.Node, stripLinebreak bool, ctx Context) string {
+	if parser.TableConverter == nil {
+		return parser.nodeToTagAwareString(node.FirstChild, stripLinebreak, ctx)
+	}
+	return parser.TableConverter(parser.ParseTable(node, ctx), ctx)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// TimestampFormat is the time format used by the timestamp template function.
+var TimestampFormat = "2006-01-02 15:04:05 MST"
+
+func templatePill(mxid interface{}, displayname ...string) template.HTML {
+	identifier := fmt.Sprint(mxid)
+	var uri *id.MatrixURI
+	switch {
+	case strings.HasPrefix(identifier, "@"):
+		uri = id.UserID(identifier).URI()
+	case strings.HasPrefix(identifier, "#"):
+		uri = id.RoomAlias(identifier).URI()
+	case strings.HasPrefix(identifier, "!"):
+		uri = id.RoomID(identifier).URI()
+	default:
+		return template.HTML(template.HTMLEscapeString(identifier))
+	}
+	text := identifier
+	if len(displayname) > 0 && len(displayname[0]) > 0 {
+		text = displayname[0]
+	}
+	return template.HTML(fmt.Sprintf(`<a href="%s">%s</a>`, template.HTMLEscapeString(uri.MatrixToURL()), template.HTMLEscapeString(text)))
+}
+
+func templateTimestamp(value interface{}) (string, error) {
+	var ts time.Time
+	switch typedValue := value.(type) {
+	case time.Time:
+		ts = typedValue
+	case *time.Time:
+		ts = *typedValue
+	case int64:
+		ts = time.UnixMilli(typedValue)
+	case int:
+		ts = time.UnixMilli(int64(typedValue))
+	default:
+		return "", fmt.Errorf("unsupported timestamp type %T", value)
+	}
+	return ts.Format(TimestampFormat), nil
+}
+
+func templateCode(code string) template.HTML {
+	return template.HTML("<code>" + template.HTMLEscapeString(code) + "</code>")
+}
+
+func templateCodeBlock(language, code string) template.HTML {
+	if len(language) > 0 {
+		return template.HTML(fmt.Sprintf(`<pre><code class="language-%s">%s</code></pre>`, template.HTMLEscapeString(language), template.HTMLEscapeString(code)))
+	}
+	return template.HTML("<pre><code>" + template.HTMLEscapeString(code) + "</code></pre>")
+}
+
+// TemplateFuncs are the functions available in templates created with NewTemplate.
+//
+//   - pill <mxid> [displayname]: a link to a user, room or room alias
+//   - timestamp <time.Time or unix milliseconds>: a timestamp formatted with TimestampFormat
+//   - code <text>: inline code
+//   - codeBlock <language> <text>: a code block, the language can be empty
+var TemplateFuncs = template.FuncMap{
+	"pill":      templatePill,
+	"timestamp": templateTimestamp,
+	"code":      templateCode,
+	"codeBlock": templateCodeBlock,
+}
+
+// Template is a html/template based message composer. The template produces the HTML formatted body, and the
+// plaintext body is generated from it, so both stay consistent. Values inserted into the template are escaped
+// automatically, so it's safe to use with user-provided data.
+type Template struct {
+	tpl     *template.Template
+	MsgType event.MessageType
+}
+
+// NewTemplate parses the given HTML template. The template can use the functions in TemplateFuncs.
+// Messages rendered from the template are m.notice by default.
+func NewTemplate(name, text string) (*Template, error) {
+	tpl, err := template.New(name).Funcs(TemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tpl: tpl, MsgType: event.MsgNotice}, nil
+}
+
+// MustNewTemplate is like NewTemplate, but panics if parsing fails.
+func MustNewTemplate(name, text string) *Template {
+	tpl, err := NewTemplate(name, text)
+	if err != nil {
+		panic(err)
+	}
+	return tpl
+}
+
+// Render executes the template with the given data and returns the message content.
+func (t *Template) Render(data interface{}) (*event.MessageEventContent, error) {
+	var buf strings.Builder
+	err := t.tpl.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	htmlBody := strings.TrimSpace(buf.String())
+	content := &event.MessageEventContent{
+		MsgType: t.MsgType,
+		Body:    HTMLToText(htmlBody),
+	}
+	if content.Body != htmlBody {
+		content.Format = event.FormatHTML
+		content.FormattedBody = htmlBody
+	}
+	return content, nil
+}
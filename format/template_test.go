@@ -0,0 +1,45 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestTemplate(t *testing.T) {
+	tpl := format.MustNewTemplate("ban", `{{pill .UserID .Name}} was banned at {{timestamp .Time}}<br>Reason: {{.Reason}}{{codeBlock "json" .Details}}`)
+	content, err := tpl.Render(map[string]interface{}{
+		"UserID":  id.UserID("@spammer:example.com"),
+		"Name":    "Spam <Bot>",
+		"Time":    time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC),
+		"Reason":  "<script>alert(1)</script>",
+		"Details": `{"a": 1}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, event.MsgNotice, content.MsgType)
+	assert.Equal(t, `<a href="https://matrix.to/#/%40spammer%3Aexample.com">Spam &lt;Bot&gt;</a> was banned at 2022-10-01 12:00:00 UTC<br>Reason: &lt;script&gt;alert(1)&lt;/script&gt;<pre><code class="language-json">{&#34;a&#34;: 1}</code></pre>`, content.FormattedBody)
+	assert.Equal(t, "Spam <Bot> was banned at 2022-10-01 12:00:00 UTC\nReason: <script>alert(1)</script>\n```json\n{\"a\": 1}\n```", content.Body)
+}
+
+func TestTemplate_Plain(t *testing.T) {
+	tpl := format.MustNewTemplate("plain", `hello {{.}}`)
+	content, err := tpl.Render("world")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", content.Body)
+	assert.Empty(t, content.FormattedBody)
+
+	_, err = format.NewTemplate("invalid", "{{")
+	assert.Error(t, err)
+}
@@ -1,6 +1,6 @@
 module maunium.net/go/mautrix
 
-go 1.17
+go 1.18
 
 require (
 	github.com/gorilla/mux v1.8.0
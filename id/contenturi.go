@@ -11,6 +11,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -38,6 +40,9 @@ func (uriString ContentURIString) ParseOrIgnore() ContentURI {
 type ContentURI struct {
 	Homeserver string
 	FileID     string
+	// The raw query string of the URI (without the leading question mark), if any.
+	// The query is preserved when stringifying the URI, but isn't included in download URLs.
+	Query string
 }
 
 func MustParseContentURI(uri string) ContentURI {
@@ -59,10 +64,17 @@ func ParseContentURI(uri string) (parsed ContentURI, err error) {
 	} else {
 		parsed.Homeserver = uri[6 : 6+index]
 		parsed.FileID = uri[6+index+1:]
+		parsed.splitQuery()
 	}
 	return
 }
 
+func (uri *ContentURI) splitQuery() {
+	if queryIndex := strings.IndexRune(uri.FileID, '?'); queryIndex != -1 {
+		uri.FileID, uri.Query = uri.FileID[:queryIndex], uri.FileID[queryIndex+1:]
+	}
+}
+
 var mxcBytes = []byte("mxc://")
 
 func ParseContentURIBytes(uri []byte) (parsed ContentURI, err error) {
@@ -75,6 +87,7 @@ func ParseContentURIBytes(uri []byte) (parsed ContentURI, err error) {
 	} else {
 		parsed.Homeserver = string(uri[6 : 6+index])
 		parsed.FileID = string(uri[6+index+1:])
+		parsed.splitQuery()
 	}
 	return
 }
@@ -86,7 +99,17 @@ func (uri *ContentURI) UnmarshalJSON(raw []byte) (err error) {
 	} else if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
 		return InputNotJSONString
 	}
-	parsed, err := ParseContentURIBytes(raw[1 : len(raw)-1])
+	var parsed ContentURI
+	if bytes.ContainsRune(raw, '\\') {
+		// The string has escape sequences (e.g. \u0026 for & in queries), so it must be properly unmarshaled first
+		var str string
+		if err = json.Unmarshal(raw, &str); err != nil {
+			return err
+		}
+		parsed, err = ParseContentURI(str)
+	} else {
+		parsed, err = ParseContentURIBytes(raw[1 : len(raw)-1])
+	}
 	if err != nil {
 		return err
 	}
@@ -121,9 +144,62 @@ func (uri *ContentURI) String() string {
 	if uri.IsEmpty() {
 		return ""
 	}
+	if len(uri.Query) > 0 {
+		return fmt.Sprintf("mxc://%s/%s?%s", uri.Homeserver, uri.FileID, uri.Query)
+	}
 	return fmt.Sprintf("mxc://%s/%s", uri.Homeserver, uri.FileID)
 }
 
+// QueryValues parses the query string of the URI.
+func (uri *ContentURI) QueryValues() url.Values {
+	values, _ := url.ParseQuery(uri.Query)
+	return values
+}
+
+func (uri *ContentURI) mediaURL(baseURL, endpoint string, query url.Values) string {
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	pathParts := []string{"_matrix", "client", "v1", "media", endpoint, uri.Homeserver, uri.FileID}
+	escapedParts := make([]string, len(pathParts))
+	for i, part := range pathParts {
+		escapedParts[i] = url.PathEscape(part)
+	}
+	parsedURL.RawPath = strings.TrimSuffix(parsedURL.EscapedPath(), "/") + "/" + strings.Join(escapedParts, "/")
+	parsedURL.Path, _ = url.PathUnescape(parsedURL.RawPath)
+	parsedURL.RawQuery = query.Encode()
+	return parsedURL.String()
+}
+
+// AuthenticatedDownloadURL returns the authenticated client media download URL for this content URI on the given
+// homeserver (e.g. https://matrix.example.com). Requests to the URL must include an access token.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3916
+func (uri *ContentURI) AuthenticatedDownloadURL(homeserverURL string) string {
+	return uri.mediaURL(homeserverURL, "download", nil)
+}
+
+// ThumbnailMethod is the method used to resize images when generating thumbnails.
+type ThumbnailMethod string
+
+const (
+	ThumbnailCrop  ThumbnailMethod = "crop"
+	ThumbnailScale ThumbnailMethod = "scale"
+)
+
+// AuthenticatedThumbnailURL returns the authenticated client media thumbnail URL for this content URI on the given
+// homeserver with the given size and resize method. Requests to the URL must include an access token.
+func (uri *ContentURI) AuthenticatedThumbnailURL(homeserverURL string, width, height int, method ThumbnailMethod) string {
+	query := url.Values{
+		"width":  []string{strconv.Itoa(width)},
+		"height": []string{strconv.Itoa(height)},
+	}
+	if len(method) > 0 {
+		query.Set("method", string(method))
+	}
+	return uri.mediaURL(homeserverURL, "thumbnail", query)
+}
+
 func (uri *ContentURI) CUString() ContentURIString {
 	return ContentURIString(uri.String())
 }
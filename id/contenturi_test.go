@@ -0,0 +1,44 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseContentURI_Query(t *testing.T) {
+	uri, err := id.ParseContentURI("mxc://example.com/abc123?encrypted=true&v=2")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", uri.Homeserver)
+	assert.Equal(t, "abc123", uri.FileID)
+	assert.Equal(t, "encrypted=true&v=2", uri.Query)
+	assert.Equal(t, "2", uri.QueryValues().Get("v"))
+	assert.Equal(t, "mxc://example.com/abc123?encrypted=true&v=2", uri.String())
+
+	data, err := json.Marshal(&uri)
+	require.NoError(t, err)
+	var parsed id.ContentURI
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, uri, parsed)
+
+	plain := id.MustParseContentURI("mxc://example.com/abc123")
+	assert.Empty(t, plain.Query)
+	assert.Equal(t, "mxc://example.com/abc123", plain.String())
+}
+
+func TestContentURI_AuthenticatedURLs(t *testing.T) {
+	uri := id.MustParseContentURI("mxc://example.com/abc123?v=2")
+	assert.Equal(t, "https://matrix.example.com/_matrix/client/v1/media/download/example.com/abc123", uri.AuthenticatedDownloadURL("https://matrix.example.com"))
+	assert.Equal(t, "https://matrix.example.com/base/_matrix/client/v1/media/download/example.com/abc123", uri.AuthenticatedDownloadURL("https://matrix.example.com/base/"))
+	assert.Equal(t, "https://matrix.example.com/_matrix/client/v1/media/thumbnail/example.com/abc123?height=96&method=crop&width=64", uri.AuthenticatedThumbnailURL("https://matrix.example.com", 64, 96, id.ThumbnailCrop))
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// hashEventIDLength is the length of hash-based event IDs: a $ followed by 32 bytes of unpadded base64.
+const hashEventIDLength = 1 + 43
+
+var ErrEventIDFormatMismatch = errors.New("event ID format doesn't match room version")
+
+// IsHashBased returns true if the event ID looks like a reference hash (room v3+) rather than
+// a server-generated $opaque:server.name ID (room v1 and v2).
+func (eventID EventID) IsHashBased() bool {
+	return len(eventID) == hashEventIDLength && eventID[0] == '$' && !strings.ContainsRune(string(eventID), ':')
+}
+
+// Format guesses the format of the event ID based on its contents.
+//
+// Hash-based event IDs that only contain alphanumeric characters are valid in both the standard and URL-safe
+// base64 formats, in which case EventIDFormatURLSafeBase64 is returned. Use ValidateForRoomVersion if the
+// room version is known.
+func (eventID EventID) Format() EventIDFormat {
+	if !eventID.IsHashBased() {
+		return EventIDFormatCustom
+	} else if strings.ContainsAny(string(eventID), "+/") {
+		return EventIDFormatBase64
+	}
+	return EventIDFormatURLSafeBase64
+}
+
+// ParseCustom parses a room v1/v2 event ID into the opaque localpart and the server name of the origin server.
+func (eventID EventID) ParseCustom() (localpart string, server ServerName, err error) {
+	colon := strings.IndexRune(string(eventID), ':')
+	if len(eventID) == 0 || eventID[0] != '$' || colon <= 1 || colon == len(eventID)-1 {
+		err = fmt.Errorf("'%s' %w", eventID, ErrInvalidEventID)
+		return
+	}
+	localpart, server = string(eventID[1:colon]), ServerName(eventID[colon+1:])
+	return
+}
+
+// ValidateForRoomVersion checks that the event ID is valid in the given room version:
+// v1 and v2 use $opaque:server.name IDs, v3 uses standard unpadded base64 hashes and v4+ use URL-safe unpadded base64.
+func (eventID EventID) ValidateForRoomVersion(roomVersion RoomVersion) error {
+	if len(eventID) > IdentifierMaxLength {
+		return ErrIdentifierTooLong
+	}
+	var encoding *base64.Encoding
+	switch roomVersion.EventIDFormat() {
+	case EventIDFormatCustom:
+		_, server, err := eventID.ParseCustom()
+		if err != nil {
+			return err
+		}
+		return server.Validate()
+	case EventIDFormatBase64:
+		encoding = base64.RawStdEncoding
+	default:
+		encoding = base64.RawURLEncoding
+	}
+	if !eventID.IsHashBased() {
+		return fmt.Errorf("'%s' %w %s", eventID, ErrEventIDFormatMismatch, roomVersion)
+	} else if _, err := encoding.DecodeString(string(eventID[1:])); err != nil {
+		return fmt.Errorf("'%s' %w %s", eventID, ErrEventIDFormatMismatch, roomVersion)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	customEventID  = id.EventID("$abc123:example.com")
+	stdEventID     = id.EventID("$acR1l0raoZnm60CBwAVgqbZqoO/mYU81xysh1u7XcJk")
+	urlSafeEventID = id.EventID("$acR1l0raoZnm60CBwAVgqbZqoO_mYU81xysh1u7XcJk")
+)
+
+func TestEventID_Format(t *testing.T) {
+	assert.False(t, customEventID.IsHashBased())
+	assert.True(t, stdEventID.IsHashBased())
+	assert.Equal(t, id.EventIDFormatCustom, customEventID.Format())
+	assert.Equal(t, id.EventIDFormatBase64, stdEventID.Format())
+	assert.Equal(t, id.EventIDFormatURLSafeBase64, urlSafeEventID.Format())
+
+	localpart, server, err := customEventID.ParseCustom()
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", localpart)
+	assert.Equal(t, id.ServerName("example.com"), server)
+	_, _, err = urlSafeEventID.ParseCustom()
+	assert.ErrorIs(t, err, id.ErrInvalidEventID)
+}
+
+func TestEventID_ValidateForRoomVersion(t *testing.T) {
+	assert.NoError(t, customEventID.ValidateForRoomVersion(id.RoomV1))
+	assert.NoError(t, stdEventID.ValidateForRoomVersion(id.RoomV3))
+	assert.NoError(t, urlSafeEventID.ValidateForRoomVersion(id.RoomV4))
+	assert.NoError(t, urlSafeEventID.ValidateForRoomVersion(id.RoomV11))
+
+	assert.ErrorIs(t, stdEventID.ValidateForRoomVersion(id.RoomV2), id.ErrInvalidEventID)
+	assert.ErrorIs(t, customEventID.ValidateForRoomVersion(id.RoomV3), id.ErrEventIDFormatMismatch)
+	assert.ErrorIs(t, urlSafeEventID.ValidateForRoomVersion(id.RoomV3), id.ErrEventIDFormatMismatch)
+	assert.ErrorIs(t, stdEventID.ValidateForRoomVersion(id.RoomV4), id.ErrEventIDFormatMismatch)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// IdentifierMaxLength is the maximum length of all sigil-prefixed identifiers.
+const IdentifierMaxLength = 255
+
+var (
+	ErrEmptyIdentifier   = errors.New("identifier is empty")
+	ErrUnknownSigil      = errors.New("has an unknown sigil")
+	ErrInvalidRoomID     = errors.New("is not a valid room ID")
+	ErrInvalidEventID    = errors.New("is not a valid event ID")
+	ErrIdentifierTooLong = errors.New("the given identifier is longer than 255 bytes")
+)
+
+// Identifier is a Matrix identifier with a sigil, i.e. a UserID, RoomID, RoomAlias or EventID.
+type Identifier interface {
+	fmt.Stringer
+	isIdentifier()
+}
+
+func (UserID) isIdentifier()    {}
+func (RoomID) isIdentifier()    {}
+func (RoomAlias) isIdentifier() {}
+func (EventID) isIdentifier()   {}
+
+// ParseIdentifier detects the type of the given Matrix identifier based on its sigil and validates it.
+//
+// The returned value is a UserID, RoomID, RoomAlias or EventID, which can be checked with a type switch:
+//
+//	switch ident := parsed.(type) {
+//	case id.UserID:
+//	case id.RoomID:
+//	case id.RoomAlias:
+//	case id.EventID:
+//	}
+//
+// User IDs are validated using the historical grammar (see UserID.ParseAndValidateRelaxed), as this is meant
+// for parsing references to existing entities. Room and event IDs are opaque, so only their basic structure is checked.
+func ParseIdentifier(identifier string) (Identifier, error) {
+	if len(identifier) == 0 {
+		return nil, ErrEmptyIdentifier
+	} else if len(identifier) > IdentifierMaxLength {
+		return nil, ErrIdentifierTooLong
+	}
+	switch identifier[0] {
+	case '@':
+		userID := UserID(identifier)
+		_, _, err := userID.ParseAndValidateRelaxed()
+		if err != nil {
+			return nil, err
+		}
+		return userID, nil
+	case '#':
+		alias := RoomAlias(identifier)
+		_, _, err := alias.ParseAndValidate()
+		if err != nil {
+			return nil, err
+		}
+		return alias, nil
+	case '!':
+		// Room IDs are always in the !opaque:server format.
+		colon := strings.IndexRune(identifier, ':')
+		if colon <= 1 || colon == len(identifier)-1 {
+			return nil, fmt.Errorf("'%s' %w", identifier, ErrInvalidRoomID)
+		}
+		return RoomID(identifier), nil
+	case '$':
+		// Event IDs are $opaque:server in room versions 1 and 2 and unpadded base64 in later versions,
+		// so the only thing that can be checked is that the opaque part isn't empty.
+		if len(identifier) == 1 || identifier[1] == ':' {
+			return nil, fmt.Errorf("'%s' %w", identifier, ErrInvalidEventID)
+		}
+		return EventID(identifier), nil
+	default:
+		return nil, fmt.Errorf("'%s' %w", identifier, ErrUnknownSigil)
+	}
+}
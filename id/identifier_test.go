@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseIdentifier(t *testing.T) {
+	tests := map[string]id.Identifier{
+		"@user:example.com":    id.UserID("@user:example.com"),
+		"@User:example.com":    id.UserID("@User:example.com"),
+		"#alias:example.com":   id.RoomAlias("#alias:example.com"),
+		"!opaque:example.com":  id.RoomID("!opaque:example.com"),
+		"$opaque:example.com":  id.EventID("$opaque:example.com"),
+		"$Rqnc-F-dvnEYJTyHq_i": id.EventID("$Rqnc-F-dvnEYJTyHq_i"),
+	}
+	for input, expected := range tests {
+		parsed, err := id.ParseIdentifier(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, expected, parsed, input)
+		assert.Equal(t, input, parsed.String())
+	}
+}
+
+func TestParseIdentifier_Invalid(t *testing.T) {
+	_, err := id.ParseIdentifier("")
+	assert.ErrorIs(t, err, id.ErrEmptyIdentifier)
+	_, err = id.ParseIdentifier("+group:example.com")
+	assert.ErrorIs(t, err, id.ErrUnknownSigil)
+	_, err = id.ParseIdentifier("@user")
+	assert.ErrorIs(t, err, id.ErrInvalidUserID)
+	_, err = id.ParseIdentifier("#alias")
+	assert.ErrorIs(t, err, id.ErrInvalidRoomAlias)
+	_, err = id.ParseIdentifier("!opaque")
+	assert.ErrorIs(t, err, id.ErrInvalidRoomID)
+	_, err = id.ParseIdentifier("!:example.com")
+	assert.ErrorIs(t, err, id.ErrInvalidRoomID)
+	_, err = id.ParseIdentifier("$")
+	assert.ErrorIs(t, err, id.ErrInvalidEventID)
+	_, err = id.ParseIdentifier("@" + strings.Repeat("a", 255) + ":example.com")
+	assert.ErrorIs(t, err, id.ErrIdentifierTooLong)
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"regexp"
 	"strings"
 )
 
@@ -34,6 +35,14 @@ var (
 
 var ErrNotMatrixToOrMatrixURI = errors.New("that URL is not a matrix.to URL nor matrix: URI")
 
+// Actions that can be specified in matrix: URIs and matrix.to URLs.
+const (
+	// MatrixURIActionJoin asks the client to join the room (after confirming with the user).
+	MatrixURIActionJoin = "join"
+	// MatrixURIActionChat asks the client to open a direct chat with the user.
+	MatrixURIActionChat = "chat"
+)
+
 // MatrixURI contains the result of parsing a matrix: URI using ParseMatrixURI
 type MatrixURI struct {
 	Sigil1 rune
@@ -42,6 +51,9 @@ type MatrixURI struct {
 	MXID2  string
 	Via    []string
 	Action string
+	// The client that created the link, e.g. im.vector.app. Clients may use this as a hint for suggesting apps
+	// to install when opening a link without a client.
+	Client string
 }
 
 // SigilToPathSegment contains a mapping from Matrix identifier sigils to matrix: URI path segments.
@@ -60,17 +72,41 @@ func (uri *MatrixURI) getQuery() url.Values {
 	if len(uri.Action) > 0 {
 		q.Set("action", uri.Action)
 	}
+	if len(uri.Client) > 0 {
+		q.Set("client", uri.Client)
+	}
 	return q
 }
 
+// WithVia returns a copy of the URI with the given via servers.
+func (uri *MatrixURI) WithVia(via ...string) *MatrixURI {
+	newURI := *uri
+	newURI.Via = via
+	return &newURI
+}
+
+// WithAction returns a copy of the URI with the given action, e.g. MatrixURIActionJoin.
+func (uri *MatrixURI) WithAction(action string) *MatrixURI {
+	newURI := *uri
+	newURI.Action = action
+	return &newURI
+}
+
+// WithClient returns a copy of the URI with the given client hint.
+func (uri *MatrixURI) WithClient(client string) *MatrixURI {
+	newURI := *uri
+	newURI.Client = client
+	return &newURI
+}
+
 // String converts the parsed matrix: URI back into the string representation.
 func (uri *MatrixURI) String() string {
 	parts := []string{
 		SigilToPathSegment[uri.Sigil1],
-		uri.MXID1,
+		url.PathEscape(uri.MXID1),
 	}
 	if uri.Sigil2 != 0 {
-		parts = append(parts, SigilToPathSegment[uri.Sigil2], uri.MXID2)
+		parts = append(parts, SigilToPathSegment[uri.Sigil2], url.PathEscape(uri.MXID2))
 	}
 	return (&url.URL{
 		Scheme:   "matrix",
@@ -177,6 +213,13 @@ func ProcessMatrixURI(uri *url.URL) (*MatrixURI, error) {
 
 	// Step 3: split the path into segments separated by /
 	parts := strings.Split(uri.Opaque, "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unescape segment %d: %w", i+1, err)
+		}
+		parts[i] = unescaped
+	}
 
 	// Step 4: Check that the URI contains either 2 or 4 segments
 	if len(parts) != 2 && len(parts) != 4 {
@@ -221,14 +264,8 @@ func ProcessMatrixURI(uri *url.URL) (*MatrixURI, error) {
 	}
 
 	// Step 7: parse the query and extract via and action items
-	via, ok := uri.Query()["via"]
-	if ok && len(via) > 0 {
-		parsed.Via = via
-	}
-	action, ok := uri.Query()["action"]
-	if ok && len(action) > 0 {
-		parsed.Action = action[len(action)-1]
-	}
+	query := uri.Query()
+	parsed.parseQuery(query)
 
 	return &parsed, nil
 }
@@ -248,10 +285,24 @@ func ProcessMatrixToURL(uri *url.URL) (*MatrixURI, error) {
 		return nil, ErrNotMatrixTo
 	}
 
-	initialSplit := strings.SplitN(uri.Fragment, "?", 2)
+	// Split the fragment before unescaping, so that escaped slashes and question marks
+	// in identifiers (e.g. event IDs in old room versions) are handled correctly.
+	initialSplit := strings.SplitN(uri.EscapedFragment(), "?", 2)
 	parts := strings.Split(initialSplit[0], "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unescape matrix.to URL segment: %w", err)
+		}
+		parts[i] = unescaped
+	}
+	query := uri.Query()
 	if len(initialSplit) > 1 {
-		uri.RawQuery = initialSplit[1]
+		var err error
+		query, err = url.ParseQuery(initialSplit[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse matrix.to URL query: %w", err)
+		}
 	}
 
 	if len(parts) < 2 || len(parts) > 3 {
@@ -280,14 +331,46 @@ func ProcessMatrixToURL(uri *url.URL) (*MatrixURI, error) {
 		}
 	}
 
-	via, ok := uri.Query()["via"]
+	parsed.parseQuery(query)
+
+	return &parsed, nil
+}
+
+func (uri *MatrixURI) parseQuery(query url.Values) {
+	via, ok := query["via"]
 	if ok && len(via) > 0 {
-		parsed.Via = via
+		uri.Via = via
 	}
-	action, ok := uri.Query()["action"]
+	action, ok := query["action"]
 	if ok && len(action) > 0 {
-		parsed.Action = action[len(action)-1]
+		uri.Action = action[len(action)-1]
+	}
+	client, ok := query["client"]
+	if ok && len(client) > 0 {
+		uri.Client = client[len(client)-1]
 	}
+}
 
-	return &parsed, nil
+var matrixLinkRegex = regexp.MustCompile(`(?:matrix:|https://matrix\.to/#/)[^\s<>"']+`)
+
+// FindMatrixURIs finds all valid matrix: URIs and matrix.to URLs in the given plaintext message.
+// Trailing punctuation that is likely part of the surrounding sentence is ignored.
+func FindMatrixURIs(text string) []*MatrixURI {
+	var uris []*MatrixURI
+	for _, match := range matrixLinkRegex.FindAllString(text, -1) {
+		match = strings.TrimRight(match, ".,;:!?)]")
+		parsed, err := ParseMatrixURIOrMatrixToURL(match)
+		if err == nil {
+			uris = append(uris, parsed)
+		}
+	}
+	return uris
+}
+
+// trimSigil removes the first character (the sigil) from the given identifier, if it's not empty.
+func trimSigil(identifier string) string {
+	if len(identifier) == 0 {
+		return identifier
+	}
+	return identifier[1:]
 }
@@ -172,3 +172,51 @@ func TestParseMatrixToURL_EventID(t *testing.T) {
 	assert.Equal(t, roomIDEventLink, *parsed2)
 	assert.Equal(t, roomIDEventLink, *parsed2Encoded)
 }
+
+func TestMatrixToURL_EscapedIdentifiers(t *testing.T) {
+	// Event IDs in room versions 1-3 use standard base64, which may contain slashes and plus signs
+	uri := id.RoomID("!room:example.org").EventURI("$ab/cd+ef?g", "example.org", "matrix.org")
+	matrixTo := uri.MatrixToURL()
+	assert.Equal(t, "https://matrix.to/#/%21room%3Aexample.org/%24ab%2Fcd%2Bef%3Fg?via=example.org&via=matrix.org", matrixTo)
+	parsed, err := id.ParseMatrixToURL(matrixTo)
+	require.NoError(t, err)
+	assert.Equal(t, *uri, *parsed)
+
+	parsed, err = id.ParseMatrixURI(uri.String())
+	require.NoError(t, err)
+	assert.Equal(t, *uri, *parsed)
+
+	aliasURI := id.RoomAlias("#room:example.org").EventURI("$event", "example.org")
+	parsed, err = id.ParseMatrixURIOrMatrixToURL(aliasURI.MatrixToURL())
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$event"), parsed.EventID())
+	assert.Equal(t, []string{"example.org"}, parsed.Via)
+}
+
+func TestMatrixURI_Builders(t *testing.T) {
+	joinLink := id.RoomAlias("#someroom:example.org").URI().WithAction(id.MatrixURIActionJoin).WithClient("im.example")
+	assert.Equal(t, "matrix:r/someroom:example.org?action=join&client=im.example", joinLink.String())
+	assert.Equal(t, "https://matrix.to/#/%23someroom%3Aexample.org?action=join&client=im.example", joinLink.MatrixToURL())
+	assert.Empty(t, roomAliasLink.Action, "builders must not modify the original URI")
+
+	chatLink := userLink.WithAction(id.MatrixURIActionChat)
+	assert.Equal(t, "matrix:u/user:example.org?action=chat", chatLink.String())
+
+	parsed, err := id.ParseMatrixURIOrMatrixToURL(joinLink.MatrixToURL())
+	require.NoError(t, err)
+	assert.Equal(t, joinLink, parsed)
+	parsed, err = id.ParseMatrixURI(joinLink.WithVia("example.com").String())
+	require.NoError(t, err)
+	assert.Equal(t, id.MatrixURIActionJoin, parsed.Action)
+	assert.Equal(t, "im.example", parsed.Client)
+	assert.Equal(t, []string{"example.com"}, parsed.Via)
+}
+
+func TestFindMatrixURIs(t *testing.T) {
+	uris := id.FindMatrixURIs("Join matrix:r/someroom:example.org?action=join, or see https://matrix.to/#/%40user%3Aexample.org. Not matrix:invalid")
+	require.Len(t, uris, 2)
+	assert.Equal(t, id.RoomAlias("#someroom:example.org"), uris[0].RoomAlias())
+	assert.Equal(t, id.MatrixURIActionJoin, uris[0].Action)
+	assert.Equal(t, id.UserID("@user:example.org"), uris[1].UserID())
+	assert.Empty(t, id.FindMatrixURIs("no links here"))
+}
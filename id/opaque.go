@@ -39,7 +39,7 @@ func (roomID RoomID) String() string {
 func (roomID RoomID) URI(via ...string) *MatrixURI {
 	return &MatrixURI{
 		Sigil1: '!',
-		MXID1:  string(roomID)[1:],
+		MXID1:  trimSigil(string(roomID)),
 		Via:    via,
 	}
 }
@@ -47,9 +47,9 @@ func (roomID RoomID) URI(via ...string) *MatrixURI {
 func (roomID RoomID) EventURI(eventID EventID, via ...string) *MatrixURI {
 	return &MatrixURI{
 		Sigil1: '!',
-		MXID1:  string(roomID)[1:],
+		MXID1:  trimSigil(string(roomID)),
 		Sigil2: '$',
-		MXID2:  string(eventID)[1:],
+		MXID2:  trimSigil(string(eventID)),
 		Via:    via,
 	}
 }
@@ -58,19 +58,21 @@ func (roomAlias RoomAlias) String() string {
 	return string(roomAlias)
 }
 
-func (roomAlias RoomAlias) URI() *MatrixURI {
+func (roomAlias RoomAlias) URI(via ...string) *MatrixURI {
 	return &MatrixURI{
 		Sigil1: '#',
-		MXID1:  string(roomAlias)[1:],
+		MXID1:  trimSigil(string(roomAlias)),
+		Via:    via,
 	}
 }
 
-func (roomAlias RoomAlias) EventURI(eventID EventID) *MatrixURI {
+func (roomAlias RoomAlias) EventURI(eventID EventID, via ...string) *MatrixURI {
 	return &MatrixURI{
 		Sigil1: '#',
-		MXID1:  string(roomAlias)[1:],
+		MXID1:  trimSigil(string(roomAlias)),
 		Sigil2: '$',
-		MXID2:  string(eventID)[1:],
+		MXID2:  trimSigil(string(eventID)),
+		Via:    via,
 	}
 }
 
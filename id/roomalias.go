@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const RoomAliasMaxLength = 255
+
+var (
+	ErrInvalidRoomAlias          = errors.New("is not a valid room alias")
+	ErrRoomAliasTooLong          = errors.New("the given room alias is longer than 255 bytes")
+	ErrInvalidRoomAliasLocalpart = errors.New("contains characters that are not allowed in room alias localparts")
+)
+
+// Parse parses the room alias into the localpart and server name.
+//
+// Like UserID.Parse, this only checks the basic structure: the alias must start with # and contain a colon.
+// Use ParseAndValidate to also validate the localpart and server name.
+func (roomAlias RoomAlias) Parse() (localpart string, server ServerName, err error) {
+	if len(roomAlias) == 0 || roomAlias[0] != '#' {
+		err = fmt.Errorf("'%s' %w", roomAlias, ErrInvalidRoomAlias)
+		return
+	}
+	colon := strings.IndexRune(string(roomAlias), ':')
+	if colon == -1 {
+		err = fmt.Errorf("'%s' %w", roomAlias, ErrInvalidRoomAlias)
+		return
+	}
+	localpart, server = string(roomAlias[1:colon]), ServerName(roomAlias[colon+1:])
+	return
+}
+
+// ValidateRoomAliasLocalpart validates a room alias localpart. The localpart may contain any valid
+// non-surrogate Unicode codepoints except colons and NUL.
+func ValidateRoomAliasLocalpart(localpart string) error {
+	if len(localpart) == 0 {
+		return ErrEmptyLocalpart
+	} else if !utf8.ValidString(localpart) || strings.ContainsAny(localpart, ":\x00") {
+		return fmt.Errorf("'%s' %w", localpart, ErrInvalidRoomAliasLocalpart)
+	}
+	return nil
+}
+
+// ParseAndValidate parses the room alias like Parse, and also validates the localpart, server name and length.
+func (roomAlias RoomAlias) ParseAndValidate() (localpart string, server ServerName, err error) {
+	localpart, server, err = roomAlias.Parse()
+	if err == nil {
+		err = ValidateRoomAliasLocalpart(localpart)
+	}
+	if err == nil {
+		err = server.Validate()
+	}
+	if err == nil && len(roomAlias) > RoomAliasMaxLength {
+		err = ErrRoomAliasTooLong
+	}
+	return
+}
+
+// Normalize returns the room alias with the server name lowercased. Server names are DNS names or IP addresses,
+// so they're case-insensitive, while localparts are case-sensitive and are left as-is.
+// Invalid aliases are returned unchanged.
+func (roomAlias RoomAlias) Normalize() RoomAlias {
+	localpart, server, err := roomAlias.Parse()
+	if err != nil {
+		return roomAlias
+	}
+	return NewRoomAlias(localpart, strings.ToLower(server.String()))
+}
+
+// EqualFold checks if two room aliases are equal when ignoring case. Some servers treat aliases
+// case-insensitively, so this can be used to detect aliases that may conflict.
+func (roomAlias RoomAlias) EqualFold(other RoomAlias) bool {
+	return strings.EqualFold(string(roomAlias), string(other))
+}
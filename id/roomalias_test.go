@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomAlias_Parse(t *testing.T) {
+	localpart, server, err := id.RoomAlias("#Some Room:[::1]:8448").ParseAndValidate()
+	assert.NoError(t, err)
+	assert.Equal(t, "Some Room", localpart)
+	assert.Equal(t, id.ServerName("[::1]:8448"), server)
+
+	_, _, err = id.RoomAlias("!room:example.com").Parse()
+	assert.True(t, errors.Is(err, id.ErrInvalidRoomAlias))
+	_, _, err = id.RoomAlias("#room").Parse()
+	assert.True(t, errors.Is(err, id.ErrInvalidRoomAlias))
+	_, _, err = id.RoomAlias("#:example.com").ParseAndValidate()
+	assert.True(t, errors.Is(err, id.ErrEmptyLocalpart))
+	_, _, err = id.RoomAlias("#a\x00b:example.com").ParseAndValidate()
+	assert.True(t, errors.Is(err, id.ErrInvalidRoomAliasLocalpart))
+	_, _, err = id.RoomAlias("#room:exa mple.com").ParseAndValidate()
+	assert.True(t, errors.Is(err, id.ErrInvalidServerName))
+	_, _, err = id.RoomAlias("#" + strings.Repeat("a", 255) + ":example.com").ParseAndValidate()
+	assert.True(t, errors.Is(err, id.ErrRoomAliasTooLong))
+}
+
+func TestRoomAlias_Normalize(t *testing.T) {
+	assert.Equal(t, id.RoomAlias("#MyRoom:example.com"), id.RoomAlias("#MyRoom:Example.COM").Normalize())
+	assert.Equal(t, id.RoomAlias("invalid"), id.RoomAlias("invalid").Normalize())
+	assert.True(t, id.RoomAlias("#MyRoom:example.com").EqualFold("#myroom:EXAMPLE.com"))
+}
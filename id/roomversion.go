@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RoomVersion is the version of a room, which defines the event format and the rules used for authorizing events.
+// https://spec.matrix.org/v1.4/rooms/
+type RoomVersion string
+
+const (
+	RoomV1  RoomVersion = "1"
+	RoomV2  RoomVersion = "2"
+	RoomV3  RoomVersion = "3"
+	RoomV4  RoomVersion = "4"
+	RoomV5  RoomVersion = "5"
+	RoomV6  RoomVersion = "6"
+	RoomV7  RoomVersion = "7"
+	RoomV8  RoomVersion = "8"
+	RoomV9  RoomVersion = "9"
+	RoomV10 RoomVersion = "10"
+	RoomV11 RoomVersion = "11"
+)
+
+// LatestStableRoomVersion is the newest stable room version that this library knows about.
+const LatestStableRoomVersion = RoomV11
+
+// EventIDFormat specifies how event IDs are generated in a room version.
+type EventIDFormat int
+
+const (
+	// EventIDFormatCustom means event IDs are generated by the origin server in the $opaque:server.name format.
+	EventIDFormatCustom EventIDFormat = iota
+	// EventIDFormatBase64 means event IDs are the standard unpadded base64 reference hash of the event.
+	EventIDFormatBase64
+	// EventIDFormatURLSafeBase64 means event IDs are the URL-safe unpadded base64 reference hash of the event.
+	EventIDFormatURLSafeBase64
+)
+
+func (rv RoomVersion) String() string {
+	return string(rv)
+}
+
+// number returns the numeric version, or 0 for unknown (e.g. unstable) room versions.
+func (rv RoomVersion) number() int {
+	version, err := strconv.Atoi(string(rv))
+	if err != nil || version < 1 || strconv.Itoa(version) != string(rv) {
+		return 0
+	}
+	return version
+}
+
+// IsKnown returns whether the room version is a stable room version known by this library.
+func (rv RoomVersion) IsKnown() bool {
+	version := rv.number()
+	return version > 0 && version <= LatestStableRoomVersion.number()
+}
+
+// atLeast returns whether the room version is at least the given version.
+// Unknown room versions are assumed to be newer than all known versions.
+func (rv RoomVersion) atLeast(minimum int) bool {
+	version := rv.number()
+	return version == 0 || version >= minimum
+}
+
+// EventIDFormat returns the format of event IDs in the room version.
+func (rv RoomVersion) EventIDFormat() EventIDFormat {
+	switch {
+	case rv.atLeast(4):
+		return EventIDFormatURLSafeBase64
+	case rv.atLeast(3):
+		return EventIDFormatBase64
+	default:
+		return EventIDFormatCustom
+	}
+}
+
+// EnforcesKeyValidity returns whether servers must respect the valid_until_ts of signing keys (v5+).
+func (rv RoomVersion) EnforcesKeyValidity() bool {
+	return rv.atLeast(5)
+}
+
+// StrictCanonicalJSON returns whether the room version enforces canonical JSON number limits
+// and disallows floats, NaN and Infinity in events (v6+).
+func (rv RoomVersion) StrictCanonicalJSON() bool {
+	return rv.atLeast(6)
+}
+
+// SpecialCasedAliasesAuth returns whether m.room.aliases events have special auth rules
+// and are preserved when redacting (v1-v5).
+func (rv RoomVersion) SpecialCasedAliasesAuth() bool {
+	return !rv.atLeast(6)
+}
+
+// Knock returns whether the room version supports the knock join rule (v7+).
+func (rv RoomVersion) Knock() bool {
+	return rv.atLeast(7)
+}
+
+// RestrictedJoins returns whether the room version supports the restricted join rule (v8+).
+func (rv RoomVersion) RestrictedJoins() bool {
+	return rv.atLeast(8)
+}
+
+// RestrictedJoinsFix returns whether the join_authorised_via_users_server field is preserved
+// when redacting member events (v9+).
+func (rv RoomVersion) RestrictedJoinsFix() bool {
+	return rv.atLeast(9)
+}
+
+// KnockRestricted returns whether the room version supports the knock_restricted join rule (v10+).
+func (rv RoomVersion) KnockRestricted() bool {
+	return rv.atLeast(10)
+}
+
+// RedactsInContent returns whether the redacts field of m.room.redaction events is inside the content
+// rather than at the top level of the event (v11+).
+func (rv RoomVersion) RedactsInContent() bool {
+	return rv.atLeast(11)
+}
+
+// UpdatedRedactionRules returns whether the room version uses the redaction algorithm from v11, which preserves
+// the entire create event content, the invite power level and the redacts key, and drops origin and membership.
+func (rv RoomVersion) UpdatedRedactionRules() bool {
+	return rv.atLeast(11)
+}
+
+// ExtensibleEvents returns whether the room version only allows extensible events (MSC3932).
+func (rv RoomVersion) ExtensibleEvents() bool {
+	return strings.HasPrefix(string(rv), "org.matrix.msc1767.")
+}
+
+// IntegerPowerLevels returns whether power levels must be integers rather than strings (v10+).
+func (rv RoomVersion) IntegerPowerLevels() bool {
+	return rv.atLeast(10)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomVersion_EventIDFormat(t *testing.T) {
+	assert.Equal(t, id.EventIDFormatCustom, id.RoomV1.EventIDFormat())
+	assert.Equal(t, id.EventIDFormatCustom, id.RoomV2.EventIDFormat())
+	assert.Equal(t, id.EventIDFormatBase64, id.RoomV3.EventIDFormat())
+	assert.Equal(t, id.EventIDFormatURLSafeBase64, id.RoomV4.EventIDFormat())
+	assert.Equal(t, id.EventIDFormatURLSafeBase64, id.RoomV10.EventIDFormat())
+	assert.Equal(t, id.EventIDFormatURLSafeBase64, id.RoomVersion("org.matrix.msc1767.10").EventIDFormat())
+}
+
+func TestRoomVersion_Capabilities(t *testing.T) {
+	assert.False(t, id.RoomV6.Knock())
+	assert.True(t, id.RoomV7.Knock())
+	assert.False(t, id.RoomV7.RestrictedJoins())
+	assert.True(t, id.RoomV8.RestrictedJoins())
+	assert.False(t, id.RoomV9.IntegerPowerLevels())
+	assert.True(t, id.RoomV10.IntegerPowerLevels())
+	assert.True(t, id.RoomV10.KnockRestricted())
+	assert.True(t, id.RoomV5.SpecialCasedAliasesAuth())
+	assert.False(t, id.RoomV6.SpecialCasedAliasesAuth())
+	assert.False(t, id.RoomV10.RedactsInContent())
+	assert.True(t, id.RoomV11.RedactsInContent())
+	assert.True(t, id.RoomVersion("org.matrix.msc1767.10").ExtensibleEvents())
+}
+
+func TestRoomVersion_IsKnown(t *testing.T) {
+	assert.True(t, id.RoomV1.IsKnown())
+	assert.True(t, id.RoomV10.IsKnown())
+	assert.True(t, id.RoomV11.IsKnown())
+	assert.False(t, id.RoomVersion("12").IsKnown())
+	assert.False(t, id.RoomVersion("01").IsKnown())
+	assert.False(t, id.RoomVersion("org.matrix.msc2716v3").IsKnown())
+}
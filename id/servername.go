@@ -0,0 +1,150 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ServerName is the name of a homeserver, optionally including a port.
+// https://spec.matrix.org/v1.4/appendices/#server-name
+type ServerName string
+
+var (
+	ErrInvalidServerName = errors.New("is not a valid server name")
+	ErrInvalidPort       = errors.New("has an invalid port")
+)
+
+var dnsNameRegex = regexp.MustCompile(`^[A-Za-z0-9.-]{1,255}$`)
+
+func (serverName ServerName) String() string {
+	return string(serverName)
+}
+
+// Parse splits the server name into the hostname and port. The port is 0 if it's not specified.
+// IPv6 literals are returned with the brackets removed.
+func (serverName ServerName) Parse() (hostname string, port int, err error) {
+	str := string(serverName)
+	portStr := ""
+	if strings.HasPrefix(str, "[") {
+		end := strings.IndexRune(str, ']')
+		if end == -1 {
+			err = fmt.Errorf("'%s' %w: unterminated IPv6 literal", serverName, ErrInvalidServerName)
+			return
+		}
+		hostname = str[1:end]
+		rest := str[end+1:]
+		if len(rest) > 0 {
+			if rest[0] != ':' {
+				err = fmt.Errorf("'%s' %w: unexpected characters after IPv6 literal", serverName, ErrInvalidServerName)
+				return
+			}
+			portStr = rest[1:]
+			if len(portStr) == 0 {
+				err = fmt.Errorf("'%s' %w", serverName, ErrInvalidPort)
+				return
+			}
+		}
+		if ip := net.ParseIP(hostname); ip == nil || ip.To4() != nil || strings.ContainsRune(hostname, '%') {
+			err = fmt.Errorf("'%s' %w: invalid IPv6 literal", serverName, ErrInvalidServerName)
+			return
+		}
+	} else {
+		colon := strings.IndexRune(str, ':')
+		hostname = str
+		if colon != -1 {
+			hostname, portStr = str[:colon], str[colon+1:]
+			if len(portStr) == 0 {
+				err = fmt.Errorf("'%s' %w", serverName, ErrInvalidPort)
+				return
+			}
+		}
+		if !dnsNameRegex.MatchString(hostname) {
+			err = fmt.Errorf("'%s' %w", serverName, ErrInvalidServerName)
+			return
+		}
+	}
+	if len(portStr) > 0 {
+		if len(portStr) > 5 {
+			err = fmt.Errorf("'%s' %w", serverName, ErrInvalidPort)
+			return
+		}
+		for _, char := range portStr {
+			if char < '0' || char > '9' {
+				err = fmt.Errorf("'%s' %w", serverName, ErrInvalidPort)
+				return
+			}
+		}
+		port, _ = strconv.Atoi(portStr)
+		if port < 1 || port > 65535 {
+			err = fmt.Errorf("'%s' %w", serverName, ErrInvalidPort)
+			return
+		}
+	}
+	return
+}
+
+// Validate checks that the server name matches the grammar in the spec.
+func (serverName ServerName) Validate() error {
+	_, _, err := serverName.Parse()
+	return err
+}
+
+// Hostname returns the hostname part of the server name without the port. IPv6 literals are returned without brackets.
+// If the server name is invalid, an empty string is returned.
+func (serverName ServerName) Hostname() string {
+	hostname, _, err := serverName.Parse()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// Port returns the port of the server name, or 0 if it doesn't have an explicit port or is invalid.
+func (serverName ServerName) Port() int {
+	_, port, _ := serverName.Parse()
+	return port
+}
+
+// IsIPLiteral returns true if the hostname part of the server name is an IPv4 or IPv6 address.
+func (serverName ServerName) IsIPLiteral() bool {
+	hostname := serverName.Hostname()
+	return len(hostname) > 0 && net.ParseIP(hostname) != nil
+}
+
+// serverNameFromIdentifier returns everything after the first colon in the given identifier.
+// The localparts of identifiers can't contain colons, so this works even when the server name is an IPv6 literal.
+func serverNameFromIdentifier(identifier string) ServerName {
+	colon := strings.IndexRune(identifier, ':')
+	if colon == -1 {
+		return ""
+	}
+	return ServerName(identifier[colon+1:])
+}
+
+// Homeserver returns the server name part of the user ID, or an empty string if the user ID doesn't contain one.
+func (userID UserID) Homeserver() ServerName {
+	return serverNameFromIdentifier(string(userID))
+}
+
+// ServerName returns the server name part of the room ID, or an empty string if the room ID doesn't contain one.
+//
+// Note that the server name in room IDs doesn't mean anything after the room is created,
+// the server may not even be in the room anymore.
+func (roomID RoomID) ServerName() ServerName {
+	return serverNameFromIdentifier(string(roomID))
+}
+
+// ServerName returns the server name part of the room alias, or an empty string if the alias doesn't contain one.
+func (roomAlias RoomAlias) ServerName() ServerName {
+	return serverNameFromIdentifier(string(roomAlias))
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestServerName_Parse(t *testing.T) {
+	tests := []struct {
+		serverName id.ServerName
+		hostname   string
+		port       int
+	}{
+		{"example.com", "example.com", 0},
+		{"example.com:8448", "example.com", 8448},
+		{"1.2.3.4:1234", "1.2.3.4", 1234},
+		{"[::1]", "::1", 0},
+		{"[1234:5678::abcd]:5678", "1234:5678::abcd", 5678},
+	}
+	for _, test := range tests {
+		hostname, port, err := test.serverName.Parse()
+		assert.NoError(t, err, test.serverName)
+		assert.Equal(t, test.hostname, hostname)
+		assert.Equal(t, test.port, port)
+	}
+	assert.True(t, id.ServerName("[::1]:8448").IsIPLiteral())
+	assert.False(t, id.ServerName("example.com").IsIPLiteral())
+}
+
+func TestServerName_Parse_Invalid(t *testing.T) {
+	for _, serverName := range []id.ServerName{"", "example.com:", "example.com:123456", "example.com:0", "exa mple.com", "[::1", "[::1]x", "[1.2.3.4]", "::1", "example.com:80a"} {
+		err := serverName.Validate()
+		assert.Error(t, err, serverName)
+		assert.True(t, errors.Is(err, id.ErrInvalidServerName) || errors.Is(err, id.ErrInvalidPort), serverName)
+	}
+}
+
+func TestIdentifierServerNames(t *testing.T) {
+	assert.Equal(t, id.ServerName("[::1]:8448"), id.UserID("@user:[::1]:8448").Homeserver())
+	assert.Equal(t, "::1", id.UserID("@user:[::1]:8448").Homeserver().Hostname())
+	assert.Equal(t, id.ServerName("example.com"), id.RoomID("!abc:example.com").ServerName())
+	assert.Equal(t, id.ServerName("example.com:1234"), id.RoomAlias("#room:example.com:1234").ServerName())
+	assert.Equal(t, id.ServerName(""), id.UserID("@invalid").Homeserver())
+}
@@ -34,6 +34,7 @@ var (
 	ErrNoncompliantLocalpart = errors.New("contains characters that are not allowed")
 	ErrUserIDTooLong         = errors.New("the given user ID is longer than 255 characters")
 	ErrEmptyLocalpart        = errors.New("empty localparts are not allowed")
+	ErrNotGhostUserID        = errors.New("is not a ghost user ID")
 )
 
 // Parse parses the user ID into the localpart and server name.
@@ -58,7 +59,7 @@ func (userID UserID) Parse() (localpart, homeserver string, err error) {
 func (userID UserID) URI() *MatrixURI {
 	return &MatrixURI{
 		Sigil1: '@',
-		MXID1:  string(userID)[1:],
+		MXID1:  trimSigil(string(userID)),
 	}
 }
 
@@ -75,6 +76,41 @@ func ValidateUserLocalpart(localpart string) error {
 	return nil
 }
 
+// ValidateHistoricalUserLocalpart validates a Matrix user ID localpart using the historical grammar, which allows
+// any printable ASCII character other than colons. Such localparts are not allowed for new users, but may still
+// exist on older servers. See https://spec.matrix.org/v1.4/appendices/#historical-user-ids
+func ValidateHistoricalUserLocalpart(localpart string) error {
+	if len(localpart) == 0 {
+		return ErrEmptyLocalpart
+	}
+	for _, char := range localpart {
+		if char < 0x21 || char > 0x7E || char == ':' {
+			return fmt.Errorf("'%s' %w", localpart, ErrNoncompliantLocalpart)
+		}
+	}
+	return nil
+}
+
+// IsHistorical returns true if the user ID localpart is valid according to the historical grammar,
+// but not according to the current strict grammar.
+func (userID UserID) IsHistorical() bool {
+	localpart, _, err := userID.Parse()
+	return err == nil && ValidateUserLocalpart(localpart) != nil && ValidateHistoricalUserLocalpart(localpart) == nil
+}
+
+// ParseAndValidateRelaxed parses the user ID like ParseAndValidate, but allows historical localparts.
+// This should be used for validating user IDs of existing users (e.g. ones received from other servers).
+func (userID UserID) ParseAndValidateRelaxed() (localpart, homeserver string, err error) {
+	localpart, homeserver, err = userID.Parse()
+	if err == nil {
+		err = ValidateHistoricalUserLocalpart(localpart)
+	}
+	if err == nil && len(userID) > UserIDMaxLength {
+		err = ErrUserIDTooLong
+	}
+	return
+}
+
 // ParseAndValidate parses the user ID into the localpart and server name like Parse,
 // and also validates that the localpart is allowed according to the user identifiers spec.
 func (userID UserID) ParseAndValidate() (localpart, homeserver string, err error) {
@@ -209,3 +245,35 @@ func DecodeUserLocalpart(str string) (string, error) {
 	}
 	return outputBuffer.String(), nil
 }
+
+// GhostLocalpartMapper maps arbitrary remote usernames to user IDs with a fixed prefix and back,
+// e.g. for creating ghost users in bridges. The remote usernames are encoded with EncodeUserLocalpart.
+type GhostLocalpartMapper struct {
+	// The prefix to add before the encoded username, e.g. "example_".
+	Prefix string
+	// The server name to use in user IDs.
+	Homeserver string
+}
+
+// UserID returns the user ID for the given remote username.
+// An error is returned if the user ID would be longer than the maximum length allowed.
+func (gm *GhostLocalpartMapper) UserID(remoteUsername string) (UserID, error) {
+	userID := NewUserID(gm.Prefix+EncodeUserLocalpart(remoteUsername), gm.Homeserver)
+	if len(userID) > UserIDMaxLength {
+		return userID, ErrUserIDTooLong
+	}
+	return userID, nil
+}
+
+// RemoteUsername parses the given user ID and returns the remote username it represents.
+// An error is returned if the user ID isn't on the configured homeserver, doesn't have the prefix
+// or the localpart isn't valid encoded.
+func (gm *GhostLocalpartMapper) RemoteUsername(userID UserID) (string, error) {
+	localpart, homeserver, err := userID.Parse()
+	if err != nil {
+		return "", err
+	} else if homeserver != gm.Homeserver || !strings.HasPrefix(localpart, gm.Prefix) {
+		return "", fmt.Errorf("'%s' %w", userID, ErrNotGhostUserID)
+	}
+	return DecodeUserLocalpart(localpart[len(gm.Prefix):])
+}
@@ -8,6 +8,7 @@ package id_test
 
 import (
 	"errors"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -84,3 +85,42 @@ func TestUserID_URI(t *testing.T) {
 	userID := id.NewUserID("hello", "example.com")
 	assert.Equal(t, userID.URI().String(), "matrix:u/hello:example.com")
 }
+
+func TestValidateHistoricalUserLocalpart(t *testing.T) {
+	assert.NoError(t, id.ValidateHistoricalUserLocalpart("Alice[bridge]"))
+	assert.True(t, errors.Is(id.ValidateHistoricalUserLocalpart("a b"), id.ErrNoncompliantLocalpart))
+	assert.True(t, errors.Is(id.ValidateHistoricalUserLocalpart("a:b"), id.ErrNoncompliantLocalpart))
+	assert.True(t, errors.Is(id.ValidateHistoricalUserLocalpart("ä"), id.ErrNoncompliantLocalpart))
+	assert.True(t, errors.Is(id.ValidateHistoricalUserLocalpart(""), id.ErrEmptyLocalpart))
+
+	assert.True(t, id.UserID("@Alice:example.com").IsHistorical())
+	assert.False(t, id.UserID("@alice:example.com").IsHistorical())
+	assert.False(t, id.UserID("@a b:example.com").IsHistorical())
+
+	_, _, err := id.UserID("@Alice:example.com").ParseAndValidate()
+	assert.Error(t, err)
+	localpart, _, err := id.UserID("@Alice:example.com").ParseAndValidateRelaxed()
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", localpart)
+}
+
+func TestGhostLocalpartMapper(t *testing.T) {
+	mapper := &id.GhostLocalpartMapper{Prefix: "remote_", Homeserver: "example.com"}
+	userID, err := mapper.UserID("Alph@Bet_50up")
+	assert.NoError(t, err)
+	assert.Equal(t, id.UserID("@remote__alph=40_bet__50up:example.com"), userID)
+	_, _, err = userID.ParseAndValidate()
+	assert.NoError(t, err)
+
+	username, err := mapper.RemoteUsername(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Alph@Bet_50up", username)
+
+	_, err = mapper.RemoteUsername("@remote_alice:other.example.com")
+	assert.True(t, errors.Is(err, id.ErrNotGhostUserID))
+	_, err = mapper.RemoteUsername("@alice:example.com")
+	assert.True(t, errors.Is(err, id.ErrNotGhostUserID))
+
+	_, err = mapper.UserID(strings.Repeat("A", 200))
+	assert.True(t, errors.Is(err, id.ErrUserIDTooLong))
+}
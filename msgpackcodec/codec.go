@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package msgpackcodec contains a MessagePack StateCodec for persistent state stores.
+//
+// The package is a separate Go module, so that users of the main module don't need to depend on msgpack.
+// Importing the package registers the codec, so that appservice.StateCodecByName("msgpack") returns it.
+package msgpackcodec
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// Codec encodes values as MessagePack, using the same field names as JSON.
+var Codec appservice.StateCodec = msgpackCodec{}
+
+func init() {
+	appservice.RegisterStateCodec(Codec)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
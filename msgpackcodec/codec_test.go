@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package msgpackcodec_test
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/msgpackcodec"
+	"maunium.net/go/mautrix/sqlstatestore"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (log testLogger) Debugfln(message string, args ...interface{}) {
+	log.t.Logf(message, args...)
+}
+
+func (log testLogger) Warnfln(message string, args ...interface{}) {
+	log.t.Errorf(message, args...)
+}
+
+func TestStateCodecByName(t *testing.T) {
+	assert.Equal(t, msgpackcodec.Codec, appservice.StateCodecByName("msgpack"))
+}
+
+func TestCodec_SQLStateStore(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	store := sqlstatestore.NewSQLStateStore(db, "sqlite3", testLogger{t})
+	require.NoError(t, store.CreateTables())
+	store.Codec = msgpackcodec.Codec
+
+	levels := &event.PowerLevelsEventContent{Users: map[id.UserID]int{userID: 50}, EventsDefault: 10}
+	store.SetPowerLevels(roomID, levels)
+	store.SetEncryptionEvent(roomID, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1, RotationPeriodMessages: 100})
+
+	loaded := store.GetPowerLevels(roomID)
+	require.NotNil(t, loaded)
+	assert.Equal(t, levels.Users, loaded.Users)
+	assert.Equal(t, 10, loaded.EventsDefault)
+	encryption := store.GetEncryptionEvent(roomID)
+	require.NotNil(t, encryption)
+	assert.Equal(t, 100, encryption.RotationPeriodMessages)
+}
@@ -0,0 +1,26 @@
+module maunium.net/go/mautrix/msgpackcodec
+
+go 1.18
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.12
+	github.com/stretchr/testify v1.7.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	maunium.net/go/mautrix v0.0.0-20261016080452-74cd5529e3e6
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/tidwall/gjson v1.14.0 // indirect
+	github.com/tidwall/match v1.1.1 // indirect
+	github.com/tidwall/pretty v1.2.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/crypto v0.0.0-20220315160706-3147a52a75dd // indirect
+	golang.org/x/net v0.0.0-20220225172249-27dd8689420f // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+	maunium.net/go/maulogger/v2 v2.3.2 // indirect
+)
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// DefaultProfileCacheTTL is the TTL used by NewProfileCache if the given TTL is zero.
+	DefaultProfileCacheTTL = 1 * time.Hour
+	// DefaultProfileCacheSize is the default maximum number of entries in caches created with NewProfileCache.
+	DefaultProfileCacheSize = 10000
+)
+
+type cachedProfile struct {
+	profile   RespUserProfile
+	expiresAt time.Time
+}
+
+// ProfileCache is an in-memory cache of global user profiles (displayname and avatar URL).
+//
+// The cache is only filled from /profile responses in Client.GetProfile, as member events may contain
+// per-room profiles. It can be shared between multiple clients (e.g. all the intents of an appservice).
+type ProfileCache struct {
+	TTL time.Duration
+	// MaxEntries is the maximum number of cached profiles. When the cache is full, expired entries are removed,
+	// followed by the entries closest to expiring. Zero means no limit.
+	MaxEntries int
+
+	profiles map[id.UserID]cachedProfile
+	lock     sync.RWMutex
+}
+
+// NewProfileCache creates a new profile cache where entries expire after the given TTL.
+func NewProfileCache(ttl time.Duration) *ProfileCache {
+	if ttl == 0 {
+		ttl = DefaultProfileCacheTTL
+	}
+	return &ProfileCache{
+		TTL:        ttl,
+		MaxEntries: DefaultProfileCacheSize,
+		profiles:   make(map[id.UserID]cachedProfile),
+	}
+}
+
+// Get returns the cached profile of the given user. If the user isn't cached or the entry has expired, ok is false.
+func (pc *ProfileCache) Get(userID id.UserID) (profile *RespUserProfile, ok bool) {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	cached, ok := pc.profiles[userID]
+	if !ok || time.Now().After(cached.expiresAt) {
+		return nil, false
+	}
+	profile = &RespUserProfile{}
+	*profile = cached.profile
+	return profile, true
+}
+
+// Set stores the profile of the given user and resets the expiry of the entry.
+func (pc *ProfileCache) Set(userID id.UserID, profile *RespUserProfile) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if _, exists := pc.profiles[userID]; !exists && pc.MaxEntries > 0 && len(pc.profiles) >= pc.MaxEntries {
+		pc.pruneExpired()
+		for len(pc.profiles) >= pc.MaxEntries {
+			pc.evictOldest()
+		}
+	}
+	pc.profiles[userID] = cachedProfile{
+		profile:   *profile,
+		expiresAt: time.Now().Add(pc.TTL),
+	}
+}
+
+// evictOldest removes the entry closest to expiring. This must be called while holding the write lock.
+func (pc *ProfileCache) evictOldest() {
+	var oldestUserID id.UserID
+	var oldestExpiry time.Time
+	for userID, cached := range pc.profiles {
+		if len(oldestUserID) == 0 || cached.expiresAt.Before(oldestExpiry) {
+			oldestUserID = userID
+			oldestExpiry = cached.expiresAt
+		}
+	}
+	delete(pc.profiles, oldestUserID)
+}
+
+// Invalidate removes the cached profile of the given user.
+func (pc *ProfileCache) Invalidate(userID id.UserID) {
+	pc.lock.Lock()
+	delete(pc.profiles, userID)
+	pc.lock.Unlock()
+}
+
+// PruneExpired removes all expired entries from the cache. Expired entries are also removed automatically
+// when the cache is full.
+func (pc *ProfileCache) PruneExpired() {
+	pc.lock.Lock()
+	pc.pruneExpired()
+	pc.lock.Unlock()
+}
+
+func (pc *ProfileCache) pruneExpired() {
+	now := time.Now()
+	for userID, cached := range pc.profiles {
+		if now.After(cached.expiresAt) {
+			delete(pc.profiles, userID)
+		}
+	}
+}
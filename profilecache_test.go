@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestProfileCache_Expiry(t *testing.T) {
+	cache := mautrix.NewProfileCache(50 * time.Millisecond)
+	cache.Set("@alice:example.com", &mautrix.RespUserProfile{DisplayName: "Alice"})
+	profile, ok := cache.Get("@alice:example.com")
+	require.True(t, ok)
+	assert.Equal(t, "Alice", profile.DisplayName)
+
+	time.Sleep(100 * time.Millisecond)
+	_, ok = cache.Get("@alice:example.com")
+	assert.False(t, ok)
+}
+
+func TestProfileCache_MaxEntries(t *testing.T) {
+	cache := mautrix.NewProfileCache(time.Hour)
+	cache.MaxEntries = 2
+	cache.Set("@alice:example.com", &mautrix.RespUserProfile{DisplayName: "Alice"})
+	cache.Set("@bob:example.com", &mautrix.RespUserProfile{DisplayName: "Bob"})
+	// Updating an existing entry doesn't evict anything.
+	cache.Set("@alice:example.com", &mautrix.RespUserProfile{DisplayName: "Alice 2"})
+	cache.Set("@carol:example.com", &mautrix.RespUserProfile{DisplayName: "Carol"})
+
+	_, ok := cache.Get("@bob:example.com")
+	assert.False(t, ok, "the entry closest to expiring should be evicted")
+	profile, ok := cache.Get("@alice:example.com")
+	require.True(t, ok)
+	assert.Equal(t, "Alice 2", profile.DisplayName)
+	_, ok = cache.Get("@carol:example.com")
+	assert.True(t, ok)
+}
+
+func TestClient_GetProfile_Cache(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"displayname": "Alice %d"}`, atomic.LoadInt32(&requests))
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+
+	// The cache is opt-in.
+	_, err = cli.GetProfile("@alice:example.com")
+	require.NoError(t, err)
+	_, err = cli.GetProfile("@alice:example.com")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+
+	cli.ProfileCache = mautrix.NewProfileCache(0)
+	for i := 0; i < 2; i++ {
+		profile, err := cli.GetProfile("@alice:example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "Alice 3", profile.DisplayName)
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt32(&requests))
+
+	cli.ProfileCache.Invalidate(id.UserID("@alice:example.com"))
+	profile, err := cli.GetProfile("@alice:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice 4", profile.DisplayName)
+}
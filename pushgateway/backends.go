@@ -0,0 +1,337 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func doJSONRequest(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}) (*http.Response, []byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return resp, nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return resp, respData, nil
+}
+
+// WebhookBackend delivers notifications by POSTing them as JSON to a HTTP endpoint.
+// The request body is a ReqNotify containing only the device the notification is being delivered to.
+//
+// If the endpoint responds with HTTP 404 or 410, the push key is rejected.
+type WebhookBackend struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+func (wb *WebhookBackend) Send(ctx context.Context, notif *Notification, device *Device) error {
+	notifCopy := *notif
+	notifCopy.Devices = []*Device{device}
+	resp, _, err := doJSONRequest(ctx, wb.Client, wb.URL, wb.Headers, &ReqNotify{Notification: &notifCopy})
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: webhook returned HTTP %d", ErrPushKeyRejected, resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	default:
+		return nil
+	}
+}
+
+// FCMLegacyURL is the endpoint of the legacy Firebase Cloud Messaging HTTP API.
+const FCMLegacyURL = "https://fcm.googleapis.com/fcm/send"
+
+// FCMBackend delivers notifications using the legacy Firebase Cloud Messaging HTTP API.
+//
+// Notifications are sent as data messages, which contain the notification fields (except devices and content)
+// as well as the device's pusher data. Apps are expected to fetch the event themselves.
+type FCMBackend struct {
+	ServerKey string
+	// The URL to send requests to. Defaults to FCMLegacyURL.
+	URL    string
+	Client *http.Client
+}
+
+type fcmRequest struct {
+	To       string                 `json:"to"`
+	Priority string                 `json:"priority"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+type fcmResponse struct {
+	Failure int `json:"failure"`
+	Results []struct {
+		Error string `json:"error"`
+	} `json:"results"`
+}
+
+// FCMData converts a notification into the flat data dictionary used in FCM data messages.
+func FCMData(notif *Notification, device *Device) map[string]interface{} {
+	data := make(map[string]interface{})
+	if device.Data != nil {
+		for key, value := range device.Data.Extra {
+			data[key] = value
+		}
+	}
+	if len(notif.EventID) > 0 {
+		data["event_id"] = notif.EventID
+	}
+	if len(notif.RoomID) > 0 {
+		data["room_id"] = notif.RoomID
+	}
+	if notif.Type != nil {
+		data["type"] = notif.Type.Type
+	}
+	if len(notif.Sender) > 0 {
+		data["sender"] = notif.Sender
+	}
+	if len(notif.SenderDisplayName) > 0 {
+		data["sender_display_name"] = notif.SenderDisplayName
+	}
+	if len(notif.RoomName) > 0 {
+		data["room_name"] = notif.RoomName
+	}
+	if len(notif.RoomAlias) > 0 {
+		data["room_alias"] = notif.RoomAlias
+	}
+	if notif.Counts != nil {
+		data["unread"] = notif.Counts.Unread
+		data["missed_calls"] = notif.Counts.MissedCalls
+	}
+	data["prio"] = notif.Priority
+	return data
+}
+
+func (fb *FCMBackend) Send(ctx context.Context, notif *Notification, device *Device) error {
+	url := fb.URL
+	if len(url) == 0 {
+		url = FCMLegacyURL
+	}
+	priority := "high"
+	if notif.Priority == PriorityLow {
+		priority = "normal"
+	}
+	req := &fcmRequest{
+		To:       device.PushKey,
+		Priority: priority,
+		Data:     FCMData(notif, device),
+	}
+	headers := map[string]string{"Authorization": "key=" + fb.ServerKey}
+	resp, data, err := doJSONRequest(ctx, fb.Client, url, headers, req)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("FCM returned HTTP %d", resp.StatusCode)
+	}
+	var fcmResp fcmResponse
+	err = json.Unmarshal(data, &fcmResp)
+	if err != nil {
+		return fmt.Errorf("failed to parse FCM response: %w", err)
+	} else if fcmResp.Failure == 0 || len(fcmResp.Results) == 0 {
+		return nil
+	}
+	switch errCode := fcmResp.Results[0].Error; errCode {
+	case "NotRegistered", "InvalidRegistration", "MismatchSenderId":
+		return fmt.Errorf("%w: %s", ErrPushKeyRejected, errCode)
+	default:
+		return fmt.Errorf("FCM returned error %s", errCode)
+	}
+}
+
+const (
+	// APNsProductionURL is the base URL of the production Apple Push Notification service.
+	APNsProductionURL = "https://api.push.apple.com"
+	// APNsDevelopmentURL is the base URL of the sandbox Apple Push Notification service.
+	APNsDevelopmentURL = "https://api.sandbox.push.apple.com"
+)
+
+// apnsTokenLifetime is how long APNs provider tokens are reused. Apple rejects tokens older than an hour
+// and asks providers to not refresh them more often than every 20 minutes.
+const apnsTokenLifetime = 50 * time.Minute
+
+// APNsBackend delivers notifications using the Apple Push Notification service with token-based authentication.
+//
+// Notifications that contain an event are sent as mutable alerts, so that a notification service extension in
+// the app can fetch and decrypt the event. The notification fields (same as FCMData) are included in the payload
+// next to the aps dictionary. Notifications that only update badge counts are sent as background pushes.
+type APNsBackend struct {
+	// The bundle ID of the app, sent in the apns-topic header.
+	Topic string
+	// The key ID, team ID and private key used to sign provider tokens.
+	KeyID  string
+	TeamID string
+	Key    *ecdsa.PrivateKey
+	// The base URL to send requests to. Defaults to APNsProductionURL.
+	URL string
+	// The HTTP client to use. APNs requires HTTP/2, which the default client supports over TLS.
+	Client *http.Client
+
+	tokenLock   sync.Mutex
+	token       string
+	tokenIssued time.Time
+}
+
+// ParseAPNsKey parses an APNs authentication key in the PEM-encoded PKCS #8 format Apple provides (.p8 files).
+func ParseAPNsKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unexpected private key type %T", key)
+	}
+	return ecKey, nil
+}
+
+func (ab *APNsBackend) getToken() (string, error) {
+	ab.tokenLock.Lock()
+	defer ab.tokenLock.Unlock()
+	now := time.Now()
+	if len(ab.token) > 0 && now.Sub(ab.tokenIssued) < apnsTokenLifetime {
+		return ab.token, nil
+	}
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": ab.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": ab.TeamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, ab.Key, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign provider token: %w", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	ab.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	ab.tokenIssued = now
+	return ab.token, nil
+}
+
+// APNsPayload converts a notification into an APNs payload.
+func APNsPayload(notif *Notification, device *Device) map[string]interface{} {
+	payload := FCMData(notif, device)
+	delete(payload, "prio")
+	aps := make(map[string]interface{})
+	if notif.Counts != nil {
+		aps["badge"] = notif.Counts.Unread
+	}
+	if len(notif.EventID) == 0 {
+		aps["content-available"] = 1
+	} else {
+		alert := make(map[string]interface{})
+		if len(notif.RoomName) > 0 {
+			alert["title"] = notif.RoomName
+		} else if len(notif.SenderDisplayName) > 0 {
+			alert["title"] = notif.SenderDisplayName
+		} else if len(notif.Sender) > 0 {
+			alert["title"] = notif.Sender
+		}
+		var content struct {
+			Body string `json:"body"`
+		}
+		if len(notif.Content) > 0 && json.Unmarshal(notif.Content, &content) == nil && len(content.Body) > 0 {
+			alert["body"] = content.Body
+		}
+		aps["alert"] = alert
+		aps["mutable-content"] = 1
+	}
+	payload["aps"] = aps
+	return payload
+}
+
+type apnsResponse struct {
+	Reason string `json:"reason"`
+}
+
+func (ab *APNsBackend) Send(ctx context.Context, notif *Notification, device *Device) error {
+	baseURL := ab.URL
+	if len(baseURL) == 0 {
+		baseURL = APNsProductionURL
+	}
+	token, err := ab.getToken()
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"Authorization": "bearer " + token,
+		"apns-topic":    ab.Topic,
+	}
+	if len(notif.EventID) == 0 {
+		headers["apns-push-type"] = "background"
+		headers["apns-priority"] = "5"
+	} else {
+		headers["apns-push-type"] = "alert"
+		if notif.Priority == PriorityLow {
+			headers["apns-priority"] = "5"
+		} else {
+			headers["apns-priority"] = "10"
+		}
+	}
+	url := baseURL + "/3/device/" + device.PushKey
+	resp, data, err := doJSONRequest(ctx, ab.Client, url, headers, APNsPayload(notif, device))
+	if err != nil {
+		return err
+	} else if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var apnsResp apnsResponse
+	_ = json.Unmarshal(data, &apnsResp)
+	switch {
+	case resp.StatusCode == http.StatusGone,
+		resp.StatusCode == http.StatusBadRequest && (apnsResp.Reason == "BadDeviceToken" || apnsResp.Reason == "DeviceTokenNotForTopic"):
+		return fmt.Errorf("%w: APNs returned HTTP %d (%s)", ErrPushKeyRejected, resp.StatusCode, apnsResp.Reason)
+	default:
+		return fmt.Errorf("APNs returned HTTP %d (%s)", resp.StatusCode, apnsResp.Reason)
+	}
+}
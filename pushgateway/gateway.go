@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrPushKeyRejected should be returned (possibly wrapped) by backends when the push key is no longer valid.
+// Rejected push keys are reported to the homeserver, which will then remove the pusher.
+var ErrPushKeyRejected = errors.New("push key rejected")
+
+// Backend delivers notifications to a specific push provider.
+type Backend interface {
+	Send(ctx context.Context, notif *Notification, device *Device) error
+}
+
+// BackendFunc is a function that implements Backend.
+type BackendFunc func(ctx context.Context, notif *Notification, device *Device) error
+
+func (fn BackendFunc) Send(ctx context.Context, notif *Notification, device *Device) error {
+	return fn(ctx, notif, device)
+}
+
+// NotifyPath is the path of the notify endpoint in the Push Gateway API.
+const NotifyPath = "/_matrix/push/v1/notify"
+
+// Gateway is an http.Handler that implements the Push Gateway API and dispatches notifications to backends
+// based on the app ID of each device.
+type Gateway struct {
+	// Backends for specific app IDs.
+	Backends map[string]Backend
+	// The backend to use for app IDs that don't have a specific backend. If nil, devices with unknown
+	// app IDs are rejected.
+	DefaultBackend Backend
+	// Function that is called with errors from backends. Optional.
+	OnError func(notif *Notification, device *Device, err error)
+}
+
+// NewGateway creates a new Gateway with no backends.
+func NewGateway() *Gateway {
+	return &Gateway{Backends: make(map[string]Backend)}
+}
+
+// AddBackend registers a backend for the given app ID.
+func (gw *Gateway) AddBackend(appID string, backend Backend) {
+	gw.Backends[appID] = backend
+}
+
+func (gw *Gateway) getBackend(appID string) Backend {
+	backend, ok := gw.Backends[appID]
+	if !ok {
+		return gw.DefaultBackend
+	}
+	return backend
+}
+
+// Notify delivers the notification to all devices in it and returns the list of rejected push keys.
+//
+// If delivery fails with a non-rejection error for every device, the last error is returned
+// so that the homeserver can retry the request later.
+func (gw *Gateway) Notify(ctx context.Context, notif *Notification) (rejected []string, err error) {
+	rejected = []string{}
+	failed := 0
+	for _, device := range notif.Devices {
+		backend := gw.getBackend(device.AppID)
+		if backend == nil {
+			rejected = append(rejected, device.PushKey)
+			continue
+		}
+		sendErr := backend.Send(ctx, notif, device)
+		if errors.Is(sendErr, ErrPushKeyRejected) {
+			rejected = append(rejected, device.PushKey)
+		} else if sendErr != nil {
+			failed++
+			err = sendErr
+			if gw.OnError != nil {
+				gw.OnError(notif, device, sendErr)
+			}
+		}
+	}
+	if failed < len(notif.Devices) {
+		err = nil
+	}
+	return
+}
+
+type errorResponse struct {
+	ErrorCode string `json:"errcode"`
+	Message   string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+// ServeHTTP handles requests to the notify endpoint.
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != NotifyPath {
+		writeJSON(w, http.StatusNotFound, &errorResponse{"M_UNRECOGNIZED", "Unrecognized endpoint"})
+		return
+	} else if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{"M_UNRECOGNIZED", "Method not allowed"})
+		return
+	}
+	var req ReqNotify
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &errorResponse{"M_NOT_JSON", "Failed to parse request body"})
+		return
+	} else if req.Notification == nil {
+		writeJSON(w, http.StatusBadRequest, &errorResponse{"M_BAD_JSON", "Missing notification"})
+		return
+	}
+	rejected, err := gw.Notify(r.Context(), req.Notification)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, &errorResponse{"M_UNKNOWN", fmt.Sprintf("Failed to deliver notification: %v", err)})
+		return
+	}
+	writeJSON(w, http.StatusOK, &RespNotify{Rejected: rejected})
+}
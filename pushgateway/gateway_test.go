@@ -0,0 +1,167 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushgateway_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/pushgateway"
+)
+
+const testNotification = `{
+	"notification": {
+		"event_id": "$event",
+		"room_id": "!room:example.com",
+		"type": "m.room.message",
+		"sender": "@alice:example.com",
+		"prio": "high",
+		"content": {"msgtype": "m.text", "body": "hello"},
+		"counts": {"unread": 2},
+		"devices": [
+			{"app_id": "com.example.app", "pushkey": "valid", "data": {"url": "https://push.example.com/_matrix/push/v1/notify", "custom": 1}},
+			{"app_id": "com.example.app", "pushkey": "expired"},
+			{"app_id": "com.example.unknown", "pushkey": "unknown"}
+		]
+	}
+}`
+
+func postNotify(gw *pushgateway.Gateway, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, pushgateway.NotifyPath, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, req)
+	return w
+}
+
+func TestGateway_ServeHTTP(t *testing.T) {
+	var delivered []*pushgateway.Device
+	gw := pushgateway.NewGateway()
+	gw.AddBackend("com.example.app", pushgateway.BackendFunc(func(ctx context.Context, notif *pushgateway.Notification, device *pushgateway.Device) error {
+		assert.Equal(t, "hello", parseBody(t, notif.Content))
+		if device.PushKey == "expired" {
+			return pushgateway.ErrPushKeyRejected
+		}
+		delivered = append(delivered, device)
+		return nil
+	}))
+	w := postNotify(gw, testNotification)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp pushgateway.RespNotify
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"expired", "unknown"}, resp.Rejected)
+	require.Len(t, delivered, 1)
+	assert.Equal(t, "https://push.example.com/_matrix/push/v1/notify", delivered[0].Data.URL)
+	assert.Equal(t, float64(1), delivered[0].Data.Extra["custom"])
+}
+
+func parseBody(t *testing.T, content json.RawMessage) string {
+	var parsed struct {
+		Body string `json:"body"`
+	}
+	require.NoError(t, json.Unmarshal(content, &parsed))
+	return parsed.Body
+}
+
+func TestGateway_ServeHTTP_Failure(t *testing.T) {
+	gw := pushgateway.NewGateway()
+	gw.DefaultBackend = pushgateway.BackendFunc(func(ctx context.Context, notif *pushgateway.Notification, device *pushgateway.Device) error {
+		return errors.New("network error")
+	})
+	w := postNotify(gw, testNotification)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	w = postNotify(gw, `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWebhookBackend(t *testing.T) {
+	var received pushgateway.ReqNotify
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		if received.Notification.Devices[0].PushKey == "expired" {
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer server.Close()
+
+	gw := pushgateway.NewGateway()
+	gw.DefaultBackend = &pushgateway.WebhookBackend{URL: server.URL, Headers: map[string]string{"Authorization": "secret"}}
+	w := postNotify(gw, testNotification)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"rejected": ["expired"]}`, w.Body.String())
+	require.Len(t, received.Notification.Devices, 1)
+	assert.Equal(t, "$event", received.Notification.EventID.String())
+}
+
+func TestAPNsBackend(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "com.example.app", r.Header.Get("apns-topic"))
+		assert.Equal(t, "alert", r.Header.Get("apns-push-type"))
+		assert.Equal(t, "10", r.Header.Get("apns-priority"))
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
+		parts := strings.Split(token, ".")
+		require.Len(t, parts, 3)
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		require.Len(t, signature, 64)
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.True(t, ecdsa.Verify(&key.PublicKey, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])))
+		header, err := base64.RawURLEncoding.DecodeString(parts[0])
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"alg": "ES256", "kid": "KEYID"}`, string(header))
+
+		switch r.URL.Path {
+		case "/3/device/valid":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		case "/3/device/expired":
+			w.WriteHeader(http.StatusGone)
+			_, _ = w.Write([]byte(`{"reason": "Unregistered"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"reason": "BadDeviceToken"}`))
+		}
+	}))
+	defer server.Close()
+
+	gw := pushgateway.NewGateway()
+	gw.AddBackend("com.example.app", &pushgateway.APNsBackend{
+		Topic:  "com.example.app",
+		KeyID:  "KEYID",
+		TeamID: "TEAMID",
+		Key:    key,
+		URL:    server.URL,
+	})
+	w := postNotify(gw, testNotification)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"rejected": ["expired", "unknown"]}`, w.Body.String())
+	require.NotNil(t, payload)
+	assert.Equal(t, "$event", payload["event_id"])
+	assert.EqualValues(t, 1, payload["custom"])
+	assert.Equal(t, map[string]interface{}{
+		"alert":           map[string]interface{}{"title": "@alice:example.com", "body": "hello"},
+		"badge":           float64(2),
+		"mutable-content": float64(1),
+	}, payload["aps"])
+}
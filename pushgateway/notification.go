@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package pushgateway implements the receiving side of the Matrix Push Gateway API.
+//
+// https://spec.matrix.org/v1.4/push-gateway-api/
+//
+// Notifications are dispatched to pluggable backends based on the app ID of each pusher. Backends for webhooks,
+// Firebase Cloud Messaging and the Apple Push Notification service are included, other providers can be added by
+// implementing the Backend interface.
+package pushgateway
+
+import (
+	"encoding/json"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// NotificationPriority is the priority of a notification.
+type NotificationPriority string
+
+const (
+	PriorityHigh NotificationPriority = "high"
+	PriorityLow  NotificationPriority = "low"
+)
+
+// NotificationCounts contains the badge counts of the user receiving a notification.
+type NotificationCounts struct {
+	Unread      int `json:"unread,omitempty"`
+	MissedCalls int `json:"missed_calls,omitempty"`
+}
+
+// PusherData is the data dictionary of a pusher, as set by the client when registering the pusher.
+type PusherData struct {
+	URL    string `json:"url,omitempty"`
+	Format string `json:"format,omitempty"`
+
+	// Any other fields set by the client.
+	Extra map[string]interface{} `json:"-"`
+}
+
+func (pd *PusherData) UnmarshalJSON(data []byte) error {
+	type plainPusherData PusherData
+	err := json.Unmarshal(data, (*plainPusherData)(pd))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &pd.Extra)
+	delete(pd.Extra, "url")
+	delete(pd.Extra, "format")
+	return err
+}
+
+func (pd *PusherData) MarshalJSON() ([]byte, error) {
+	data := make(map[string]interface{}, len(pd.Extra)+2)
+	for key, value := range pd.Extra {
+		data[key] = value
+	}
+	if len(pd.URL) > 0 {
+		data["url"] = pd.URL
+	}
+	if len(pd.Format) > 0 {
+		data["format"] = pd.Format
+	}
+	return json.Marshal(data)
+}
+
+// Device is a single device that a notification should be delivered to.
+type Device struct {
+	AppID     string                 `json:"app_id"`
+	PushKey   string                 `json:"pushkey"`
+	PushKeyTS int64                  `json:"pushkey_ts,omitempty"`
+	Data      *PusherData            `json:"data,omitempty"`
+	Tweaks    map[string]interface{} `json:"tweaks,omitempty"`
+}
+
+// Notification is a notification sent by a homeserver to the push gateway.
+type Notification struct {
+	EventID           id.EventID           `json:"event_id,omitempty"`
+	RoomID            id.RoomID            `json:"room_id,omitempty"`
+	Type              *event.Type          `json:"type,omitempty"`
+	Sender            id.UserID            `json:"sender,omitempty"`
+	SenderDisplayName string               `json:"sender_display_name,omitempty"`
+	RoomName          string               `json:"room_name,omitempty"`
+	RoomAlias         id.RoomAlias         `json:"room_alias,omitempty"`
+	UserIsTarget      bool                 `json:"user_is_target,omitempty"`
+	Priority          NotificationPriority `json:"prio,omitempty"`
+	Content           json.RawMessage      `json:"content,omitempty"`
+	Counts            *NotificationCounts  `json:"counts,omitempty"`
+	Devices           []*Device            `json:"devices"`
+}
+
+// IsEventIDOnly returns true if the notification doesn't contain event content, i.e. the pusher format is
+// event_id_only or the notification only updates badge counts.
+func (notif *Notification) IsEventIDOnly() bool {
+	return len(notif.Content) == 0
+}
+
+// ReqNotify is the request body of the /_matrix/push/v1/notify endpoint.
+type ReqNotify struct {
+	Notification *Notification `json:"notification"`
+}
+
+// RespNotify is the response body of the /_matrix/push/v1/notify endpoint.
+type RespNotify struct {
+	Rejected []string `json:"rejected"`
+}
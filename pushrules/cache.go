@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules
+
+import (
+	"container/list"
+	"sync"
+
+	"maunium.net/go/mautrix/pushrules/glob"
+)
+
+// MaxCachedGlobs is the maximum number of compiled glob patterns (and parsed property paths) to keep in the cache
+// used when evaluating push rules and conditions directly. When the limit is reached, the least recently used
+// pattern is evicted. Compiled rulesets (see RulesetCache) don't use this cache.
+var MaxCachedGlobs = 4096
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// lruCache is a map that evicts the least recently used entries when it's full.
+// The front of the list is the most recently used entry.
+type lruCache[K comparable, V any] struct {
+	lock    sync.Mutex
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+func newLRUCache[K comparable, V any]() *lruCache[K, V] {
+	return &lruCache[K, V]{
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+func (cache *lruCache[K, V]) get(key K) (value V, ok bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		return
+	}
+	cache.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[K, V]).value, true
+}
+
+// put adds the entry to the cache and evicts the least recently used entries until there are at most maxSize entries.
+// If maxSize is zero or negative, the cache isn't limited.
+func (cache *lruCache[K, V]) put(key K, value V, maxSize int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		elem.Value.(*lruEntry[K, V]).value = value
+		cache.order.MoveToFront(elem)
+	} else {
+		cache.entries[key] = cache.order.PushFront(&lruEntry[K, V]{key, value})
+	}
+	for maxSize > 0 && cache.order.Len() > maxSize {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+func (cache *lruCache[K, V]) remove(key K) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.order.Remove(elem)
+		delete(cache.entries, key)
+	}
+}
+
+func (cache *lruCache[K, V]) clear() {
+	cache.lock.Lock()
+	cache.order.Init()
+	cache.entries = make(map[K]*list.Element)
+	cache.lock.Unlock()
+}
+
+func (cache *lruCache[K, V]) len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.order.Len()
+}
+
+type cachedGlob struct {
+	glob *glob.Glob
+	err  error
+}
+
+var globCache = newLRUCache[string, cachedGlob]()
+var pathCache = newLRUCache[string, []string]()
+
+// compileGlob compiles the given glob pattern, or returns the cached result if it has been compiled before.
+func compileGlob(pattern string) (*glob.Glob, error) {
+	if cached, ok := globCache.get(pattern); ok {
+		return cached.glob, cached.err
+	}
+	compiled, err := glob.Compile(pattern)
+	globCache.put(pattern, cachedGlob{compiled, err}, MaxCachedGlobs)
+	return compiled, err
+}
+
+// getPropertyPath splits the given event property path, or returns the cached result if it has been split before.
+// The returned slice must not be modified.
+func getPropertyPath(path string) []string {
+	if parts, ok := pathCache.get(path); ok {
+		return parts
+	}
+	parts := splitPropertyPath(path)
+	pathCache.put(path, parts, MaxCachedGlobs)
+	return parts
+}
+
+// ClearCache clears the cache of compiled glob patterns and parsed property paths, as well as DefaultRulesetCache.
+//
+// To only drop the compiled form of a single ruleset (e.g. when receiving new m.push_rules account data),
+// use RulesetCache.Invalidate instead.
+func ClearCache() {
+	globCache.clear()
+	pathCache.clear()
+	DefaultRulesetCache.Clear()
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+func TestClearCache(t *testing.T) {
+	condition := newMatchPushCondition("content.body", "*hello*")
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "oh hello there"})
+	assert.True(t, condition.Match(blankTestRoom, evt))
+	pushrules.ClearCache()
+	assert.True(t, condition.Match(blankTestRoom, evt))
+	condition.Pattern = "*goodbye*"
+	assert.False(t, condition.Match(blankTestRoom, evt))
+}
+
+func newCompileTestRuleset() *pushrules.PushRuleset {
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	rules.Content = append(rules.Content, pushrules.NewKeywordRule("cats", true, "default"))
+	rules.Room.Map["!fakeroom:maunium.net"] = pushrules.NewRoomRule("!fakeroom:maunium.net", pushrules.RoomModeAllMessages)
+	return rules
+}
+
+func TestCompiledRuleset_GetActions(t *testing.T) {
+	rules := newCompileTestRuleset()
+	compiled, err := rules.Compile()
+	require.NoError(t, err)
+	room := newFakeRoom(4)
+	room.powerLevels = &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@tulir:maunium.net": 100}}
+	events := []*event.Event{
+		newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello world"}),
+		newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "I like cats"}),
+		newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hey tulir"}),
+		newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "@room hi"}),
+		newFakeEvent(event.EventMessage, &event.MessageEventContent{
+			MsgType:  event.MsgText,
+			Body:     "hey tulir",
+			Mentions: &event.Mentions{},
+		}),
+		newFakeEvent(event.EventMessage, &event.MessageEventContent{
+			MsgType:  event.MsgText,
+			Body:     "hey",
+			Mentions: &event.Mentions{UserIDs: []id.UserID{"@tulir:maunium.net"}},
+		}),
+		newFakeEvent(event.EventReaction, &event.ReactionEventContent{}),
+		newFakeEvent(event.EventEncrypted, &event.EncryptedEventContent{}),
+	}
+	otherRoom := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello world"})
+	otherRoom.RoomID = "!other:maunium.net"
+	events = append(events, otherRoom)
+	for _, evt := range events {
+		assert.Equal(t, rules.GetActions(room, evt), compiled.GetActions(room, evt), "actions differ for %s", evt.Content.VeryRaw)
+	}
+}
+
+func TestCompiledRuleset_Snapshot(t *testing.T) {
+	rules := newCompileTestRuleset()
+	compiled, err := rules.Compile()
+	require.NoError(t, err)
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "I like cats"})
+	before := compiled.GetActions(newFakeRoom(4), evt)
+
+	rules.Content[len(rules.Content)-1].Pattern = "dogs"
+	assert.Equal(t, before, compiled.GetActions(newFakeRoom(4), evt))
+	hash, err := rules.Hash()
+	require.NoError(t, err)
+	assert.NotEqual(t, compiled.Hash(), hash)
+}
+
+func TestRulesetCache(t *testing.T) {
+	cache := pushrules.NewRulesetCache(2)
+	first, err := cache.Get(newCompileTestRuleset())
+	require.NoError(t, err)
+	same, err := cache.Get(newCompileTestRuleset())
+	require.NoError(t, err)
+	assert.Same(t, first, same, "identical rulesets should share the compiled form")
+
+	defaults, err := cache.Get(pushrules.DefaultPushRuleset("@tulir:maunium.net"))
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Hash(), defaults.Hash())
+	assert.Equal(t, 2, cache.Len())
+
+	// Invalidating one ruleset keeps the others.
+	cache.Invalidate(first.Hash())
+	assert.Equal(t, 1, cache.Len())
+	again, err := cache.Get(pushrules.DefaultPushRuleset("@tulir:maunium.net"))
+	require.NoError(t, err)
+	assert.Same(t, defaults, again)
+
+	// Adding more rulesets than the limit evicts the least recently used one.
+	_, err = cache.Get(newCompileTestRuleset())
+	require.NoError(t, err)
+	_, err = cache.Get(pushrules.DefaultPushRuleset("@other:maunium.net"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, cache.Len())
+	again, err = cache.Get(pushrules.DefaultPushRuleset("@tulir:maunium.net"))
+	require.NoError(t, err)
+	assert.NotSame(t, defaults, again)
+}
+
+func BenchmarkCompiledRuleset_GetActions(b *testing.B) {
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	rules.Content = append(rules.Content, pushrules.NewKeywordRule("cats", true, "default"))
+	compiled, err := pushrules.DefaultRulesetCache.Get(rules)
+	require.NoError(b, err)
+	room := newFakeRoom(4)
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello world"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compiled.GetActions(room, evt)
+	}
+}
+
+func BenchmarkPushRuleset_GetActions(b *testing.B) {
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	rules.Content = append(rules.Content, pushrules.NewKeywordRule("cats", true, "default"))
+	room := newFakeRoom(4)
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello world"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rules.GetActions(room, evt)
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules/glob"
+)
+
+// MaxCachedRulesets is the size of DefaultRulesetCache.
+const MaxCachedRulesets = 256
+
+// DefaultRulesetCache is a process-wide RulesetCache for callers that don't need their own.
+var DefaultRulesetCache = NewRulesetCache(MaxCachedRulesets)
+
+// RulesetCache caches compiled push rulesets, keyed on a hash of the ruleset's contents, so identical rulesets
+// (e.g. the default rules of many users) share one compiled ruleset. When the cache is full, the least recently
+// used ruleset is evicted.
+//
+// A changed ruleset has a different hash, so it's never evaluated with stale rules. When a user's push rules
+// change (i.e. when receiving new m.push_rules account data), the compiled form of their previous rules can be
+// dropped with Invalidate instead of waiting for it to be evicted.
+type RulesetCache struct {
+	maxSize int
+	cache   *lruCache[string, *CompiledRuleset]
+}
+
+// NewRulesetCache creates a cache that holds at most maxSize compiled rulesets. If maxSize is zero or negative,
+// the cache isn't limited.
+func NewRulesetCache(maxSize int) *RulesetCache {
+	return &RulesetCache{
+		maxSize: maxSize,
+		cache:   newLRUCache[string, *CompiledRuleset](),
+	}
+}
+
+// Get returns the compiled form of the given ruleset, compiling it if it isn't cached yet.
+func (rc *RulesetCache) Get(rs *PushRuleset) (*CompiledRuleset, error) {
+	hash, err := rs.Hash()
+	if err != nil {
+		return nil, err
+	} else if compiled, ok := rc.cache.get(hash); ok {
+		return compiled, nil
+	}
+	compiled := compileRuleset(rs, hash)
+	rc.cache.put(hash, compiled, rc.maxSize)
+	return compiled, nil
+}
+
+// Invalidate removes the compiled ruleset with the given hash (see CompiledRuleset.Hash and PushRuleset.Hash)
+// from the cache. Other cached rulesets aren't affected.
+func (rc *RulesetCache) Invalidate(hash string) {
+	rc.cache.remove(hash)
+}
+
+// Clear removes all compiled rulesets from the cache.
+func (rc *RulesetCache) Clear() {
+	rc.cache.clear()
+}
+
+// Len returns the number of cached rulesets.
+func (rc *RulesetCache) Len() int {
+	return rc.cache.len()
+}
+
+// hashableRule includes the rule type, which isn't included in the normal JSON form, as it affects matching.
+type hashableRule struct {
+	Type PushRuleType `json:"type"`
+	*PushRule
+}
+
+type hashableRuleMap struct {
+	Type  PushRuleType   `json:"type"`
+	Rules []hashableRule `json:"rules"`
+}
+
+type hashableRuleset struct {
+	Override  []hashableRule  `json:"override"`
+	Content   []hashableRule  `json:"content"`
+	Room      hashableRuleMap `json:"room"`
+	Sender    hashableRuleMap `json:"sender"`
+	Underride []hashableRule  `json:"underride"`
+}
+
+func toHashableRules(rules PushRuleArray) []hashableRule {
+	hashable := make([]hashableRule, len(rules))
+	for i, rule := range rules {
+		hashable[i] = hashableRule{rule.Type, rule}
+	}
+	return hashable
+}
+
+func toHashableRuleMap(ruleMap PushRuleMap) hashableRuleMap {
+	// Maps have no order, so the rules are sorted to get the same hash for the same rules.
+	rules := ruleMap.Unmap()
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].RuleID < rules[j].RuleID
+	})
+	return hashableRuleMap{Type: ruleMap.Type, Rules: toHashableRules(rules)}
+}
+
+// Hash returns a hash of the contents of the ruleset. Rulesets that match events the same way have the same hash.
+func (rs *PushRuleset) Hash() (string, error) {
+	data, err := json.Marshal(&hashableRuleset{
+		Override:  toHashableRules(rs.Override),
+		Content:   toHashableRules(rs.Content),
+		Room:      toHashableRuleMap(rs.Room),
+		Sender:    toHashableRuleMap(rs.Sender),
+		Underride: toHashableRules(rs.Underride),
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Compile compiles the ruleset without caching it. Most callers should use RulesetCache.Get instead.
+func (rs *PushRuleset) Compile() (*CompiledRuleset, error) {
+	hash, err := rs.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return compileRuleset(rs, hash), nil
+}
+
+// CompiledRuleset is a push ruleset whose glob patterns, property paths and member count conditions have been
+// parsed in advance, so evaluating it doesn't parse anything. Compiling takes a snapshot of the ruleset,
+// so later changes to the PushRuleset don't affect the compiled form.
+type CompiledRuleset struct {
+	hash      string
+	override  []*compiledRule
+	content   []*compiledRule
+	room      compiledRuleMap
+	sender    compiledRuleMap
+	underride []*compiledRule
+}
+
+type conditionMatcher func(room Room, evt *event.Event) bool
+
+type compiledRule struct {
+	actions             PushActionArray
+	isLegacyMentionRule bool
+	match               conditionMatcher
+}
+
+type compiledRuleMap struct {
+	rules map[string]*compiledRule
+	typ   PushRuleType
+}
+
+func compileRuleset(rs *PushRuleset, hash string) *CompiledRuleset {
+	return &CompiledRuleset{
+		hash:      hash,
+		override:  compileRules(rs.Override),
+		content:   compileRules(rs.Content),
+		room:      compileRuleMap(rs.Room),
+		sender:    compileRuleMap(rs.Sender),
+		underride: compileRules(rs.Underride),
+	}
+}
+
+func compileRules(rules PushRuleArray) []*compiledRule {
+	compiled := make([]*compiledRule, len(rules))
+	for i, rule := range rules {
+		compiled[i] = rule.compile()
+	}
+	return compiled
+}
+
+func compileRuleMap(ruleMap PushRuleMap) compiledRuleMap {
+	compiled := compiledRuleMap{rules: make(map[string]*compiledRule, len(ruleMap.Map)), typ: ruleMap.Type}
+	for key, rule := range ruleMap.Map {
+		compiled.rules[key] = rule.compile()
+	}
+	return compiled
+}
+
+func copyActions(actions PushActionArray) PushActionArray {
+	if actions == nil {
+		return nil
+	}
+	copied := make(PushActionArray, len(actions))
+	for i, action := range actions {
+		actionCopy := *action
+		copied[i] = &actionCopy
+	}
+	return copied
+}
+
+func neverMatch(Room, *event.Event) bool {
+	return false
+}
+
+func (rule *PushRule) compile() *compiledRule {
+	compiled := &compiledRule{
+		actions:             copyActions(rule.Actions),
+		isLegacyMentionRule: rule.isLegacyMentionRule(),
+		match:               neverMatch,
+	}
+	if !rule.Enabled {
+		return compiled
+	}
+	switch rule.Type {
+	case OverrideRule, UnderrideRule:
+		conditions := make([]conditionMatcher, len(rule.Conditions))
+		for i, cond := range rule.Conditions {
+			conditions[i] = cond.compile()
+		}
+		compiled.match = func(room Room, evt *event.Event) bool {
+			for _, cond := range conditions {
+				if !cond(room, evt) {
+					return false
+				}
+			}
+			return true
+		}
+	case ContentRule:
+		pattern, err := glob.Compile(rule.Pattern)
+		if err == nil {
+			compiled.match = func(_ Room, evt *event.Event) bool {
+				msg, ok := evt.Content.Raw["body"].(string)
+				return ok && pattern.MatchString(msg)
+			}
+		}
+	case RoomRule:
+		roomID := id.RoomID(rule.RuleID)
+		compiled.match = func(_ Room, evt *event.Event) bool {
+			return evt.RoomID == roomID
+		}
+	case SenderRule:
+		userID := id.UserID(rule.RuleID)
+		compiled.match = func(_ Room, evt *event.Event) bool {
+			return evt.Sender == userID
+		}
+	}
+	return compiled
+}
+
+// compile parses the condition in advance. The condition is copied, so changing it afterwards has no effect.
+func (cond *PushCondition) compile() conditionMatcher {
+	condCopy := *cond
+	switch cond.Kind {
+	case KindEventMatch:
+		if em := compileEventMatch(cond.Key, cond.Pattern); em != nil {
+			return func(_ Room, evt *event.Event) bool {
+				return em.match(evt)
+			}
+		}
+	case KindContainsDisplayName:
+		return condCopy.matchDisplayName
+	case KindRoomMemberCount:
+		if filter, ok := parseMemberCountFilter(cond.MemberCountCondition); ok {
+			return func(room Room, _ *event.Event) bool {
+				return filter.match(room.GetMemberCount())
+			}
+		}
+	case KindEventPropertyIs:
+		path, value := splitPropertyPath(cond.Key), cond.Value
+		return func(_ Room, evt *event.Event) bool {
+			return propertyIs(evt, path, value)
+		}
+	case KindEventPropertyContains:
+		path, value := splitPropertyPath(cond.Key), cond.Value
+		return func(_ Room, evt *event.Event) bool {
+			return propertyContains(evt, path, value)
+		}
+	case KindSenderNotificationPermission:
+		return condCopy.matchSenderNotificationPermission
+	case KindRelatedEventMatch:
+		var em *parsedEventMatch
+		if len(cond.Key) > 0 {
+			if em = compileEventMatch(cond.Key, cond.Pattern); em == nil {
+				break
+			}
+		}
+		return func(room Room, evt *event.Event) bool {
+			relatedEvent := condCopy.getRelatedEvent(room, evt)
+			// Conditions without a key only check that the relation exists
+			return relatedEvent != nil && (em == nil || em.match(relatedEvent))
+		}
+	}
+	return neverMatch
+}
+
+// compileEventMatch parses an event_match condition, or returns nil if the pattern is invalid.
+func compileEventMatch(key, rawPattern string) *parsedEventMatch {
+	pattern, err := glob.Compile(rawPattern)
+	if err != nil {
+		return nil
+	}
+	return newEventMatch(key, splitPropertyPath(key), rawPattern, pattern)
+}
+
+// Hash returns the hash of the ruleset that this was compiled from.
+func (crs *CompiledRuleset) Hash() string {
+	return crs.hash
+}
+
+func (rule *compiledRule) matches(room Room, evt *event.Event) bool {
+	if rule.isLegacyMentionRule && hasIntentionalMentions(evt) {
+		return false
+	}
+	return rule.match(room, evt)
+}
+
+func getCompiledActions(rules []*compiledRule, room Room, evt *event.Event) PushActionArray {
+	for _, rule := range rules {
+		if rule.matches(room, evt) {
+			return rule.actions
+		}
+	}
+	return nil
+}
+
+func (ruleMap compiledRuleMap) getActions(room Room, evt *event.Event) PushActionArray {
+	var rule *compiledRule
+	var found bool
+	switch ruleMap.typ {
+	case RoomRule:
+		rule, found = ruleMap.rules[string(evt.RoomID)]
+	case SenderRule:
+		rule, found = ruleMap.rules[string(evt.Sender)]
+	}
+	if found && rule.matches(room, evt) {
+		return rule.actions
+	}
+	return nil
+}
+
+// GetActions matches the given event against the compiled ruleset. The result is the same as
+// PushRuleset.GetActions of the ruleset that this was compiled from. The returned actions must not be modified.
+func (crs *CompiledRuleset) GetActions(room Room, evt *event.Event) PushActionArray {
+	if match := getCompiledActions(crs.override, room, evt); match != nil {
+		return match
+	} else if match = getCompiledActions(crs.content, room, evt); match != nil {
+		return match
+	} else if match = crs.room.getActions(room, evt); match != nil {
+		return match
+	} else if match = crs.sender.getActions(room, evt); match != nil {
+		return match
+	} else if match = getCompiledActions(crs.underride, room, evt); match != nil {
+		return match
+	}
+	return DefaultPushActions
+}
@@ -7,12 +7,14 @@
 package pushrules
 
 import (
+	"encoding/json"
 	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
 
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules/glob"
 )
 
@@ -22,6 +24,21 @@ type Room interface {
 	GetMemberCount() int
 }
 
+// PowerLevelfulRoom is an extension to Room that is needed for processing sender_notification_permission push conditions.
+// Rooms that don't implement this interface never match those conditions.
+type PowerLevelfulRoom interface {
+	Room
+	GetPowerLevels() *event.PowerLevelsEventContent
+}
+
+// EventfulRoom is an extension to Room that is needed for processing related_event_match push conditions.
+// Rooms that don't implement this interface never match those conditions.
+type EventfulRoom interface {
+	Room
+	// GetEvent returns the event with the given ID, or nil if it's not available.
+	GetEvent(eventID id.EventID) *event.Event
+}
+
 // PushCondKind is the type of a push condition.
 type PushCondKind string
 
@@ -30,21 +47,57 @@ const (
 	KindEventMatch          PushCondKind = "event_match"
 	KindContainsDisplayName PushCondKind = "contains_display_name"
 	KindRoomMemberCount     PushCondKind = "room_member_count"
+
+	KindEventPropertyIs              PushCondKind = "event_property_is"
+	KindEventPropertyContains        PushCondKind = "event_property_contains"
+	KindSenderNotificationPermission PushCondKind = "sender_notification_permission"
+
+	// KindRelatedEventMatch is the unstable condition kind from MSC3664 for matching against the event
+	// that the event is related to.
+	KindRelatedEventMatch PushCondKind = "im.nheko.msc3664.related_event_match"
 )
 
 // PushCondition wraps a condition that is required for a specific PushRule to be used.
 type PushCondition struct {
 	// The type of the condition.
 	Kind PushCondKind `json:"kind"`
-	// The dot-separated field of the event to match. Only applicable if kind is EventMatch.
+	// The dot-separated field of the event to match. Only applicable if kind is EventMatch, EventPropertyIs or
+	// EventPropertyContains. Literal dots and backslashes in field names can be escaped with a backslash.
+	// For SenderNotificationPermission, this is the type of notification in the power levels, e.g. "room".
 	Key string `json:"key,omitempty"`
 	// The glob-style pattern to match the field against. Only applicable if kind is EventMatch.
 	Pattern string `json:"pattern,omitempty"`
+	// The exact value to match the field against. Only applicable if kind is EventPropertyIs or EventPropertyContains.
+	// Must be a string, an integer, a boolean or null.
+	Value interface{} `json:"value,omitempty"`
+	// The type of relation to follow. Only applicable if kind is RelatedEventMatch.
+	// The special value "m.in_reply_to" matches replies.
+	RelType event.RelationType `json:"rel_type,omitempty"`
+	// Whether relations that are only reply fallbacks (e.g. in threads) should be matched.
+	// Only applicable if kind is RelatedEventMatch.
+	IncludeFallbacks *bool `json:"include_fallbacks,omitempty"`
 	// The condition that needs to be fulfilled for RoomMemberCount-type conditions.
 	// A decimal integer optionally prefixed by ==, <, >, >= or <=. Prefix "==" is assumed if no prefix found.
 	MemberCountCondition string `json:"is,omitempty"`
 }
 
+type serializablePushCondition PushCondition
+
+// marshalablePropertyCondition overrides the value field of PushCondition so that null values aren't omitted.
+type marshalablePropertyCondition struct {
+	serializablePushCondition
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON marshals the condition into JSON. The value field is always included for EventPropertyIs and
+// EventPropertyContains conditions, as null is a valid value to match against.
+func (cond PushCondition) MarshalJSON() ([]byte, error) {
+	if cond.Kind == KindEventPropertyIs || cond.Kind == KindEventPropertyContains {
+		return json.Marshal(marshalablePropertyCondition{serializablePushCondition(cond), cond.Value})
+	}
+	return json.Marshal(serializablePushCondition(cond))
+}
+
 // MemberCountFilterRegex is the regular expression to parse the MemberCountCondition of PushConditions.
 var MemberCountFilterRegex = regexp.MustCompile("^(==|[<>]=?)?([0-9]+)$")
 
@@ -57,45 +110,225 @@ func (cond *PushCondition) Match(room Room, evt *event.Event) bool {
 		return cond.matchDisplayName(room, evt)
 	case KindRoomMemberCount:
 		return cond.matchMemberCount(room)
+	case KindEventPropertyIs:
+		return cond.matchPropertyIs(evt)
+	case KindEventPropertyContains:
+		return cond.matchPropertyContains(evt)
+	case KindSenderNotificationPermission:
+		return cond.matchSenderNotificationPermission(room, evt)
+	case KindRelatedEventMatch:
+		return cond.matchRelatedEvent(room, evt)
 	default:
 		return false
 	}
 }
 
 func (cond *PushCondition) matchValue(room Room, evt *event.Event) bool {
-	index := strings.IndexRune(cond.Key, '.')
-	key := cond.Key
-	subkey := ""
-	if index > 0 {
-		subkey = key[index+1:]
-		key = key[0:index]
-	}
-
-	pattern, err := glob.Compile(cond.Pattern)
+	pattern, err := compileGlob(cond.Pattern)
 	if err != nil {
 		return false
 	}
+	return newEventMatch(cond.Key, getPropertyPath(cond.Key), cond.Pattern, pattern).match(evt)
+}
+
+// parsedEventMatch is a parsed event_match condition.
+type parsedEventMatch struct {
+	key    string
+	subkey string
+	// The whole key split into parts, for matching nested content fields.
+	path         []string
+	emptyPattern bool
+	pattern      *glob.Glob
+}
+
+func newEventMatch(key string, path []string, rawPattern string, pattern *glob.Glob) *parsedEventMatch {
+	em := &parsedEventMatch{key: key, path: path, emptyPattern: rawPattern == "", pattern: pattern}
+	if index := strings.IndexRune(key, '.'); index > 0 {
+		em.subkey = key[index+1:]
+		em.key = key[0:index]
+	}
+	return em
+}
 
-	switch key {
+func (em *parsedEventMatch) match(evt *event.Event) bool {
+	switch em.key {
 	case "type":
-		return pattern.MatchString(evt.Type.String())
+		return em.pattern.MatchString(evt.Type.String())
 	case "sender":
-		return pattern.MatchString(string(evt.Sender))
+		return em.pattern.MatchString(string(evt.Sender))
 	case "room_id":
-		return pattern.MatchString(string(evt.RoomID))
+		return em.pattern.MatchString(string(evt.RoomID))
 	case "state_key":
 		if evt.StateKey == nil {
-			return cond.Pattern == ""
+			return em.emptyPattern
+		}
+		return em.pattern.MatchString(*evt.StateKey)
+	case "content":
+		val, ok := evt.Content.Raw[em.subkey].(string)
+		if !ok {
+			val, _ = getEventPropertyByPath(evt, em.path).(string)
+		}
+		return em.pattern.MatchString(val)
+	default:
+		return false
+	}
+}
+
+// splitPropertyPath splits a dot-separated event property path, handling backslash escapes as specified in MSC3873.
+func splitPropertyPath(path string) []string {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, char := range path {
+		if escaped {
+			if char != '.' && char != '\\' {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(char)
+			escaped = false
+		} else if char == '\\' {
+			escaped = true
+		} else if char == '.' {
+			parts = append(parts, current.String())
+			current.Reset()
+		} else {
+			current.WriteRune(char)
+		}
+	}
+	if escaped {
+		current.WriteRune('\\')
+	}
+	return append(parts, current.String())
+}
+
+func getEventProperty(evt *event.Event, path string) interface{} {
+	return getEventPropertyByPath(evt, getPropertyPath(path))
+}
+
+func getEventPropertyByPath(evt *event.Event, parts []string) interface{} {
+	switch parts[0] {
+	case "type":
+		if len(parts) == 1 {
+			return evt.Type.Type
+		}
+	case "sender":
+		if len(parts) == 1 {
+			return string(evt.Sender)
+		}
+	case "room_id":
+		if len(parts) == 1 {
+			return string(evt.RoomID)
+		}
+	case "event_id":
+		if len(parts) == 1 {
+			return string(evt.ID)
+		}
+	case "state_key":
+		if len(parts) == 1 && evt.StateKey != nil {
+			return *evt.StateKey
 		}
-		return pattern.MatchString(*evt.StateKey)
 	case "content":
-		val, _ := evt.Content.Raw[subkey].(string)
-		return pattern.MatchString(val)
+		raw := evt.Content.Raw
+		if raw == nil && len(evt.Content.VeryRaw) > 0 {
+			_ = json.Unmarshal(evt.Content.VeryRaw, &raw)
+		}
+		var val interface{} = raw
+		for _, part := range parts[1:] {
+			obj, ok := val.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			val, ok = obj[part]
+			if !ok {
+				return nil
+			}
+		}
+		return val
+	}
+	return nil
+}
+
+func hasEventProperty(evt *event.Event, parts []string) bool {
+	if parts[0] != "content" {
+		return getEventPropertyByPath(evt, parts) != nil
+	}
+	// Explicit null values in the content are distinct from missing values
+	lastIndex := len(parts) - 1
+	container, ok := getEventPropertyByPath(evt, parts[:lastIndex]).(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = container[parts[lastIndex]]
+	return ok
+}
+
+// valueEquals checks if a value from an event is exactly equal to a push condition value.
+// Only strings, integers, booleans and null are comparable, as specified for event_property_is.
+func valueEquals(eventValue, condValue interface{}) bool {
+	switch typedCondValue := condValue.(type) {
+	case nil:
+		return eventValue == nil
+	case string, bool:
+		return eventValue == condValue
+	case float64:
+		eventFloat, ok := eventValue.(float64)
+		return ok && eventFloat == typedCondValue && typedCondValue == float64(int64(typedCondValue))
+	case int:
+		eventFloat, ok := eventValue.(float64)
+		return ok && eventFloat == float64(typedCondValue)
+	case int64:
+		eventFloat, ok := eventValue.(float64)
+		return ok && eventFloat == float64(typedCondValue)
+	case json.Number:
+		condInt, err := typedCondValue.Int64()
+		eventFloat, ok := eventValue.(float64)
+		return err == nil && ok && eventFloat == float64(condInt)
 	default:
 		return false
 	}
 }
 
+func (cond *PushCondition) matchPropertyIs(evt *event.Event) bool {
+	return propertyIs(evt, getPropertyPath(cond.Key), cond.Value)
+}
+
+func propertyIs(evt *event.Event, path []string, value interface{}) bool {
+	if value == nil && !hasEventProperty(evt, path) {
+		return false
+	}
+	return valueEquals(getEventPropertyByPath(evt, path), value)
+}
+
+func (cond *PushCondition) matchPropertyContains(evt *event.Event) bool {
+	return propertyContains(evt, getPropertyPath(cond.Key), cond.Value)
+}
+
+func propertyContains(evt *event.Event, path []string, value interface{}) bool {
+	array, ok := getEventPropertyByPath(evt, path).([]interface{})
+	if !ok {
+		return false
+	}
+	for _, item := range array {
+		if valueEquals(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cond *PushCondition) matchSenderNotificationPermission(room Room, evt *event.Event) bool {
+	plRoom, ok := room.(PowerLevelfulRoom)
+	if !ok {
+		return false
+	}
+	pl := plRoom.GetPowerLevels()
+	if pl == nil {
+		// Power levels are unknown, so assume the sender has no permission
+		return false
+	}
+	return pl.GetUserLevel(evt.Sender) >= pl.NotificationLevel(cond.Key)
+}
+
 func (cond *PushCondition) matchDisplayName(room Room, evt *event.Event) bool {
 	displayname := room.GetOwnDisplayname()
 	if len(displayname) == 0 {
@@ -121,29 +354,89 @@ func (cond *PushCondition) matchDisplayName(room Room, evt *event.Event) bool {
 }
 
 func (cond *PushCondition) matchMemberCount(room Room) bool {
-	group := MemberCountFilterRegex.FindStringSubmatch(cond.MemberCountCondition)
-	if len(group) != 3 {
-		return false
-	}
+	filter, ok := parseMemberCountFilter(cond.MemberCountCondition)
+	return ok && filter.match(room.GetMemberCount())
+}
 
-	operator := group[1]
-	wantedMemberCount, _ := strconv.Atoi(group[2])
+// memberCountFilter is a parsed room_member_count condition.
+type memberCountFilter struct {
+	operator string
+	count    int
+}
 
-	memberCount := room.GetMemberCount()
+func parseMemberCountFilter(condition string) (filter memberCountFilter, ok bool) {
+	group := MemberCountFilterRegex.FindStringSubmatch(condition)
+	if len(group) != 3 {
+		return
+	}
+	filter.operator = group[1]
+	filter.count, _ = strconv.Atoi(group[2])
+	return filter, true
+}
 
-	switch operator {
+func (filter memberCountFilter) match(memberCount int) bool {
+	switch filter.operator {
 	case "==", "":
-		return memberCount == wantedMemberCount
+		return memberCount == filter.count
 	case ">":
-		return memberCount > wantedMemberCount
+		return memberCount > filter.count
 	case ">=":
-		return memberCount >= wantedMemberCount
+		return memberCount >= filter.count
 	case "<":
-		return memberCount < wantedMemberCount
+		return memberCount < filter.count
 	case "<=":
-		return memberCount <= wantedMemberCount
+		return memberCount <= filter.count
 	default:
 		// Should be impossible due to regex.
 		return false
 	}
 }
+
+// RelTypeInReplyTo is the pseudo relation type used by related_event_match conditions to match replies.
+const RelTypeInReplyTo event.RelationType = "m.in_reply_to"
+
+var relatesToPath = []string{"content", "m.relates_to"}
+
+func (cond *PushCondition) getRelatedEventID(evt *event.Event) id.EventID {
+	relatesTo, ok := getEventPropertyByPath(evt, relatesToPath).(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if cond.RelType == RelTypeInReplyTo {
+		isFallingBack, _ := relatesTo["is_falling_back"].(bool)
+		if isFallingBack && (cond.IncludeFallbacks == nil || !*cond.IncludeFallbacks) {
+			return ""
+		}
+		inReplyTo, _ := relatesTo["m.in_reply_to"].(map[string]interface{})
+		eventID, _ := inReplyTo["event_id"].(string)
+		return id.EventID(eventID)
+	}
+	if relType, _ := relatesTo["rel_type"].(string); relType != string(cond.RelType) {
+		return ""
+	}
+	eventID, _ := relatesTo["event_id"].(string)
+	return id.EventID(eventID)
+}
+
+func (cond *PushCondition) matchRelatedEvent(room Room, evt *event.Event) bool {
+	relatedEvent := cond.getRelatedEvent(room, evt)
+	if relatedEvent == nil {
+		return false
+	} else if len(cond.Key) == 0 {
+		// Conditions without a key only check that the relation exists
+		return true
+	}
+	return cond.matchValue(room, relatedEvent)
+}
+
+func (cond *PushCondition) getRelatedEvent(room Room, evt *event.Event) *event.Event {
+	eventID := cond.getRelatedEventID(evt)
+	if len(eventID) == 0 {
+		return nil
+	}
+	eventfulRoom, ok := room.(EventfulRoom)
+	if !ok {
+		return nil
+	}
+	return eventfulRoom.GetEvent(eventID)
+}
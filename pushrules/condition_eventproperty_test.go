@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+var propertyTestEvent = newFakeEvent(event.EventMessage, map[string]interface{}{
+	"msgtype": "m.text",
+	"body":    "hello",
+	"m.relates_to": map[string]interface{}{
+		"rel_type": "m.thread",
+	},
+	"level":   5,
+	"flag":    true,
+	"nothing": nil,
+	"tags":    []interface{}{"foo", 3, false},
+})
+
+func newPropertyCondition(kind pushrules.PushCondKind, key string, value interface{}) *pushrules.PushCondition {
+	return &pushrules.PushCondition{
+		Kind:  kind,
+		Key:   key,
+		Value: value,
+	}
+}
+
+func TestPushCondition_Match_KindEventPropertyIs(t *testing.T) {
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.msgtype", "m.text").Match(blankTestRoom, propertyTestEvent))
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyIs, `content.m\.relates_to.rel_type`, "m.thread").Match(blankTestRoom, propertyTestEvent))
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.level", 5).Match(blankTestRoom, propertyTestEvent))
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.flag", true).Match(blankTestRoom, propertyTestEvent))
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.nothing", nil).Match(blankTestRoom, propertyTestEvent))
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyIs, "type", "m.room.message").Match(blankTestRoom, propertyTestEvent))
+}
+
+func TestPushCondition_Match_KindEventPropertyIs_Fail(t *testing.T) {
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.body", "hell").Match(blankTestRoom, propertyTestEvent), "event_property_is must not glob")
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.m.relates_to.rel_type", "m.thread").Match(blankTestRoom, propertyTestEvent))
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.level", "5").Match(blankTestRoom, propertyTestEvent))
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.flag", 1).Match(blankTestRoom, propertyTestEvent))
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.missing", nil).Match(blankTestRoom, propertyTestEvent))
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyIs, "content.tags", "foo").Match(blankTestRoom, propertyTestEvent))
+}
+
+func TestPushCondition_Match_KindEventPropertyContains(t *testing.T) {
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyContains, "content.tags", "foo").Match(blankTestRoom, propertyTestEvent))
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyContains, "content.tags", 3).Match(blankTestRoom, propertyTestEvent))
+	assert.True(t, newPropertyCondition(pushrules.KindEventPropertyContains, "content.tags", false).Match(blankTestRoom, propertyTestEvent))
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyContains, "content.tags", "bar").Match(blankTestRoom, propertyTestEvent))
+	assert.False(t, newPropertyCondition(pushrules.KindEventPropertyContains, "content.body", "hello").Match(blankTestRoom, propertyTestEvent))
+}
+
+func TestPushCondition_Match_KindEventPropertyIs_FromJSON(t *testing.T) {
+	var condition pushrules.PushCondition
+	err := json.Unmarshal([]byte(`{"kind": "event_property_is", "key": "content.level", "value": 5}`), &condition)
+	require.NoError(t, err)
+	assert.True(t, condition.Match(blankTestRoom, propertyTestEvent))
+}
+
+func TestPushCondition_Match_KindSenderNotificationPermission(t *testing.T) {
+	condition := &pushrules.PushCondition{Kind: pushrules.KindSenderNotificationPermission, Key: "room"}
+	room := newFakeRoom(2)
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "@room"})
+	assert.False(t, condition.Match(room, evt), "rooms without known power levels shouldn't match")
+
+	room.powerLevels = &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{"@tulir:maunium.net": 50},
+	}
+	assert.True(t, condition.Match(room, evt))
+
+	roomLevel := 100
+	room.powerLevels.Notifications = &event.NotificationPowerLevels{RoomPtr: &roomLevel}
+	assert.False(t, condition.Match(room, evt))
+}
+
+func TestPushCondition_MarshalNullValue(t *testing.T) {
+	var condition pushrules.PushCondition
+	require.NoError(t, json.Unmarshal([]byte(`{"kind": "event_property_is", "key": "content.nothing", "value": null}`), &condition))
+	assert.Nil(t, condition.Value)
+	assert.True(t, condition.Match(blankTestRoom, propertyTestEvent))
+
+	data, err := json.Marshal(&condition)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"kind": "event_property_is", "key": "content.nothing", "value": null}`, string(data))
+
+	data, err = json.Marshal(pushrules.PushCondition{Kind: pushrules.KindEventMatch, Key: "content.body", Pattern: "hello"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"kind": "event_match", "key": "content.body", "pattern": "hello"}`, string(data))
+}
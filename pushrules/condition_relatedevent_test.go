@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+func newRelatedEventTestRoom() *FakeRoom {
+	room := newFakeRoom(3)
+	original := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"})
+	original.ID = "$original"
+	room.events = map[id.EventID]*event.Event{original.ID: original}
+	return room
+}
+
+func TestPushCondition_Match_KindRelatedEventMatch_Reply(t *testing.T) {
+	room := newRelatedEventTestRoom()
+	condition := &pushrules.PushCondition{
+		Kind:    pushrules.KindRelatedEventMatch,
+		RelType: pushrules.RelTypeInReplyTo,
+		Key:     "sender",
+		Pattern: "@tulir:maunium.net",
+	}
+	reply := newFakeEvent(event.EventMessage, &event.MessageEventContent{
+		MsgType:   event.MsgText,
+		Body:      "hi",
+		RelatesTo: &event.RelatesTo{InReplyTo: "$original"},
+	})
+	assert.True(t, condition.Match(room, reply))
+	assert.False(t, condition.Match(newFakeRoom(3), reply), "rooms without events shouldn't match")
+
+	condition.Pattern = "@someone:example.com"
+	assert.False(t, condition.Match(room, reply))
+
+	condition.Key, condition.Pattern = "", ""
+	assert.True(t, condition.Match(room, reply))
+	unknownReply := newFakeEvent(event.EventMessage, &event.MessageEventContent{
+		MsgType:   event.MsgText,
+		Body:      "hi",
+		RelatesTo: &event.RelatesTo{InReplyTo: "$unknown"},
+	})
+	assert.False(t, condition.Match(room, unknownReply))
+}
+
+func TestPushCondition_Match_KindRelatedEventMatch_ThreadFallback(t *testing.T) {
+	room := newRelatedEventTestRoom()
+	threadMessage := newFakeEvent(event.EventMessage, map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "hi",
+		"m.relates_to": map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        "$original",
+			"is_falling_back": true,
+			"m.in_reply_to":   map[string]interface{}{"event_id": "$original"},
+		},
+	})
+	condition := &pushrules.PushCondition{
+		Kind:    pushrules.KindRelatedEventMatch,
+		RelType: pushrules.RelTypeInReplyTo,
+		Key:     "content.body",
+		Pattern: "hello",
+	}
+	assert.False(t, condition.Match(room, threadMessage))
+	includeFallbacks := true
+	condition.IncludeFallbacks = &includeFallbacks
+	assert.True(t, condition.Match(room, threadMessage))
+
+	condition = &pushrules.PushCondition{
+		Kind:    pushrules.KindRelatedEventMatch,
+		RelType: event.RelThread,
+		Key:     "content.body",
+		Pattern: "hello",
+	}
+	assert.True(t, condition.Match(room, threadMessage))
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 )
 
@@ -102,8 +103,10 @@ func TestPushCondition_Match_InvalidKind(t *testing.T) {
 }
 
 type FakeRoom struct {
-	members map[string]*event.MemberEventContent
-	owner   string
+	members     map[string]*event.MemberEventContent
+	owner       string
+	powerLevels *event.PowerLevelsEventContent
+	events      map[id.EventID]*event.Event
 }
 
 func newFakeRoom(memberCount int) *FakeRoom {
@@ -141,3 +144,11 @@ func (fr *FakeRoom) GetOwnDisplayname() string {
 	}
 	return ""
 }
+
+func (fr *FakeRoom) GetPowerLevels() *event.PowerLevelsEventContent {
+	return fr.powerLevels
+}
+
+func (fr *FakeRoom) GetEvent(eventID id.EventID) *event.Event {
+	return fr.events[eventID]
+}
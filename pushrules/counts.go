@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// NotificationCounts contains the unread notification and highlight counts of a room,
+// equivalent to the unread_notifications object in sync responses.
+type NotificationCounts struct {
+	Notifications int `json:"notification_count"`
+	Highlights    int `json:"highlight_count"`
+}
+
+// CountNotifications computes the notification counts of a room from its timeline, in the same way as servers do.
+//
+// The timeline must be in chronological order. Only events after the event the user's read receipt points at are
+// counted. If the read receipt isn't in the timeline, all events are counted. Events sent by the user themselves
+// never count.
+func (rs *PushRuleset) CountNotifications(room Room, timeline []*event.Event, readUpTo id.EventID, ownUserID id.UserID) (counts NotificationCounts) {
+	start := 0
+	if len(readUpTo) > 0 {
+		for i := len(timeline) - 1; i >= 0; i-- {
+			if timeline[i].ID == readUpTo {
+				start = i + 1
+				break
+			}
+		}
+	}
+	for _, evt := range timeline[start:] {
+		if evt.Sender == ownUserID {
+			continue
+		}
+		should := rs.GetActions(room, evt).Should()
+		if should.Notify {
+			counts.Notifications++
+			if should.Highlight {
+				counts.Highlights++
+			}
+		}
+	}
+	return
+}
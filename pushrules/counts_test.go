@@ -0,0 +1,44 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+func TestPushRuleset_CountNotifications(t *testing.T) {
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	room := newFakeRoom(4)
+
+	newMessage := func(eventID id.EventID, sender id.UserID, body string) *event.Event {
+		evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: body})
+		evt.ID = eventID
+		evt.Sender = sender
+		return evt
+	}
+	notice := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgNotice, Body: "beep"})
+	notice.ID = "$notice"
+	notice.Sender = "@bot:example.com"
+	timeline := []*event.Event{
+		newMessage("$1", "@alice:example.com", "hello"),
+		newMessage("$2", "@tulir:maunium.net", "hi alice"),
+		newMessage("$3", "@alice:example.com", "how are you tulir?"),
+		notice,
+		newMessage("$4", "@bob:example.com", "hey"),
+	}
+
+	assert.Equal(t, pushrules.NotificationCounts{Notifications: 3, Highlights: 1}, rules.CountNotifications(room, timeline, "", "@tulir:maunium.net"))
+	assert.Equal(t, pushrules.NotificationCounts{Notifications: 2, Highlights: 1}, rules.CountNotifications(room, timeline, "$2", "@tulir:maunium.net"))
+	assert.Equal(t, pushrules.NotificationCounts{Notifications: 1}, rules.CountNotifications(room, timeline, "$3", "@tulir:maunium.net"))
+	assert.Equal(t, pushrules.NotificationCounts{}, rules.CountNotifications(room, timeline, "$4", "@tulir:maunium.net"))
+}
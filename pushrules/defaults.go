@@ -0,0 +1,204 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// IDs of the server-default push rules.
+const (
+	RuleIDMaster               = ".m.rule.master"
+	RuleIDSuppressNotices      = ".m.rule.suppress_notices"
+	RuleIDInviteForMe          = ".m.rule.invite_for_me"
+	RuleIDMemberEvent          = ".m.rule.member_event"
+	RuleIDIsUserMention        = ".m.rule.is_user_mention"
+	RuleIDIsRoomMention        = ".m.rule.is_room_mention"
+	RuleIDTombstone            = ".m.rule.tombstone"
+	RuleIDReaction             = ".m.rule.reaction"
+	RuleIDServerACL            = ".m.rule.server_acl"
+	RuleIDSuppressEdits        = ".m.rule.suppress_edits"
+	RuleIDCall                 = ".m.rule.call"
+	RuleIDEncryptedOneToOne    = ".m.rule.encrypted_room_one_to_one"
+	RuleIDRoomOneToOne         = ".m.rule.room_one_to_one"
+	RuleIDMessage              = ".m.rule.message"
+	RuleIDEncrypted            = ".m.rule.encrypted"
+	mentionsUserIDsPropertyKey = `content.m\.mentions.user_ids`
+	mentionsRoomPropertyKey    = `content.m\.mentions.room`
+)
+
+// NewIsUserMentionCondition returns the event_property_contains condition used by the .m.rule.is_user_mention rule.
+func NewIsUserMentionCondition(userID id.UserID) *PushCondition {
+	return &PushCondition{
+		Kind:  KindEventPropertyContains,
+		Key:   mentionsUserIDsPropertyKey,
+		Value: userID.String(),
+	}
+}
+
+// NewIsRoomMentionConditions returns the conditions used by the .m.rule.is_room_mention rule.
+func NewIsRoomMentionConditions() []*PushCondition {
+	return []*PushCondition{{
+		Kind:  KindEventPropertyIs,
+		Key:   mentionsRoomPropertyKey,
+		Value: true,
+	}, {
+		Kind: KindSenderNotificationPermission,
+		Key:  "room",
+	}}
+}
+
+func eventMatch(key, pattern string) *PushCondition {
+	return &PushCondition{Kind: KindEventMatch, Key: key, Pattern: pattern}
+}
+
+func notifyWithSound(sound string) PushActionArray {
+	return PushActionArray{{Action: ActionNotify}, {Action: ActionSetTweak, Tweak: TweakSound, Value: sound}}
+}
+
+func notifyHighlight(sound string) PushActionArray {
+	actions := PushActionArray{{Action: ActionNotify}, {Action: ActionSetTweak, Tweak: TweakHighlight}}
+	if len(sound) > 0 {
+		actions = append(actions, &PushAction{Action: ActionSetTweak, Tweak: TweakSound, Value: sound})
+	}
+	return actions
+}
+
+func defaultRule(ruleID string, actions PushActionArray, conditions ...*PushCondition) *PushRule {
+	if conditions == nil {
+		conditions = []*PushCondition{}
+	}
+	return &PushRule{
+		RuleID:     ruleID,
+		Actions:    actions,
+		Default:    true,
+		Enabled:    true,
+		Conditions: conditions,
+	}
+}
+
+// DefaultPushRuleset returns the server-default push rules for the given user, as specified in the
+// Client-Server API, including the intentional mention rules from MSC3952.
+func DefaultPushRuleset(userID id.UserID) *PushRuleset {
+	dontNotify := PushActionArray{}
+	notify := PushActionArray{{Action: ActionNotify}}
+
+	master := defaultRule(RuleIDMaster, dontNotify)
+	master.Enabled = false
+	override := PushRuleArray{
+		master,
+		defaultRule(RuleIDSuppressNotices, dontNotify, eventMatch("content.msgtype", string(event.MsgNotice))),
+		defaultRule(RuleIDInviteForMe, notifyWithSound("default"),
+			eventMatch("type", event.StateMember.Type),
+			eventMatch("content.membership", string(event.MembershipInvite)),
+			eventMatch("state_key", userID.String())),
+		defaultRule(RuleIDMemberEvent, dontNotify, eventMatch("type", event.StateMember.Type)),
+		defaultRule(RuleIDIsUserMention, notifyHighlight("default"), NewIsUserMentionCondition(userID)),
+		defaultRule(RuleIDContainsDisplayName, notifyHighlight("default"), &PushCondition{Kind: KindContainsDisplayName}),
+		defaultRule(RuleIDIsRoomMention, notifyHighlight(""), NewIsRoomMentionConditions()...),
+		defaultRule(RuleIDRoomNotif, notifyHighlight(""),
+			&PushCondition{Kind: KindSenderNotificationPermission, Key: "room"},
+			eventMatch("content.body", "@room")),
+		defaultRule(RuleIDTombstone, notifyHighlight(""),
+			eventMatch("type", event.StateTombstone.Type),
+			eventMatch("state_key", "")),
+		defaultRule(RuleIDReaction, dontNotify, eventMatch("type", event.EventReaction.Type)),
+		defaultRule(RuleIDServerACL, dontNotify,
+			eventMatch("type", event.StateServerACL.Type),
+			eventMatch("state_key", "")),
+		defaultRule(RuleIDSuppressEdits, dontNotify, &PushCondition{
+			Kind:  KindEventPropertyIs,
+			Key:   `content.m\.relates_to.rel_type`,
+			Value: string(event.RelReplace),
+		}),
+	}
+	localpart, _, _ := userID.Parse()
+	content := PushRuleArray{{
+		RuleID:  RuleIDContainsUserName,
+		Actions: notifyHighlight("default"),
+		Default: true,
+		Enabled: true,
+		Pattern: localpart,
+	}}
+	underride := PushRuleArray{
+		defaultRule(RuleIDCall, notifyWithSound("ring"), eventMatch("type", "m.call.invite")),
+		defaultRule(RuleIDEncryptedOneToOne, notify,
+			&PushCondition{Kind: KindRoomMemberCount, MemberCountCondition: "2"},
+			eventMatch("type", event.EventEncrypted.Type)),
+		defaultRule(RuleIDRoomOneToOne, notifyWithSound("default"),
+			&PushCondition{Kind: KindRoomMemberCount, MemberCountCondition: "2"},
+			eventMatch("type", event.EventMessage.Type)),
+		defaultRule(RuleIDMessage, notify, eventMatch("type", event.EventMessage.Type)),
+		defaultRule(RuleIDEncrypted, notify, eventMatch("type", event.EventEncrypted.Type)),
+	}
+	return &PushRuleset{
+		Override:  override.SetType(OverrideRule),
+		Content:   content.SetType(ContentRule),
+		Room:      PushRuleArray{}.SetTypeAndMap(RoomRule),
+		Sender:    PushRuleArray{}.SetTypeAndMap(SenderRule),
+		Underride: underride.SetType(UnderrideRule),
+	}
+}
+
+func mergeRuleArray(defaults, userRules PushRuleArray, typ PushRuleType) PushRuleArray {
+	defaultIDs := make(map[string]struct{}, len(defaults))
+	for _, rule := range defaults {
+		defaultIDs[rule.RuleID] = struct{}{}
+	}
+	userDefaults := make(map[string]*PushRule)
+	var custom, unknownDefaults PushRuleArray
+	for _, rule := range userRules {
+		if _, isKnownDefault := defaultIDs[rule.RuleID]; isKnownDefault {
+			userDefaults[rule.RuleID] = rule
+		} else if rule.Default {
+			unknownDefaults = append(unknownDefaults, rule)
+		} else {
+			custom = append(custom, rule)
+		}
+	}
+	merged := make(PushRuleArray, 0, len(defaults)+len(custom)+len(unknownDefaults))
+	if typ == OverrideRule && len(defaults) > 0 {
+		// The master rule always comes first, even before user-defined override rules
+		master := defaults[0]
+		if userRule, ok := userDefaults[master.RuleID]; ok {
+			master = userRule
+		}
+		merged = append(merged, master)
+		defaults = defaults[1:]
+	}
+	merged = append(merged, custom...)
+	for _, rule := range defaults {
+		if userRule, ok := userDefaults[rule.RuleID]; ok {
+			rule = userRule
+		}
+		merged = append(merged, rule)
+	}
+	merged = append(merged, unknownDefaults...)
+	return merged.SetType(typ)
+}
+
+// MergeWithDefaults overlays the given user-defined push rules (e.g. from m.push_rules account data) on top of the
+// server-default rules for the given user, in the same precedence order that servers use.
+//
+// User-defined rules are evaluated before the default rules of the same kind (except for the master rule), while
+// modifications of default rules (e.g. disabling them or changing actions) replace the default rule in place.
+// Default rules that are missing from the user's rules, e.g. because they were added in a newer spec version, are
+// added from DefaultPushRuleset.
+func MergeWithDefaults(userRules *PushRuleset, userID id.UserID) *PushRuleset {
+	defaults := DefaultPushRuleset(userID)
+	if userRules == nil {
+		return defaults
+	}
+	return &PushRuleset{
+		Override:  mergeRuleArray(defaults.Override, userRules.Override, OverrideRule),
+		Content:   mergeRuleArray(defaults.Content, userRules.Content, ContentRule),
+		Room:      userRules.Room.Unmap().SetTypeAndMap(RoomRule),
+		Sender:    userRules.Sender.Unmap().SetTypeAndMap(SenderRule),
+		Underride: mergeRuleArray(defaults.Underride, userRules.Underride, UnderrideRule),
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+func TestDefaultPushRuleset_IntentionalMentions(t *testing.T) {
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	room := newFakeRoom(4)
+	room.powerLevels = &event.PowerLevelsEventContent{Users: map[id.UserID]int{"@tulir:maunium.net": 50}}
+
+	mentioned := newFakeEvent(event.EventMessage, &event.MessageEventContent{
+		MsgType:  event.MsgText,
+		Body:     "hey",
+		Mentions: &event.Mentions{UserIDs: []id.UserID{"@tulir:maunium.net"}},
+	})
+	should := rules.GetActions(room, mentioned).Should()
+	assert.True(t, should.Notify)
+	assert.True(t, should.Highlight)
+
+	notMentioned := newFakeEvent(event.EventMessage, &event.MessageEventContent{
+		MsgType:  event.MsgText,
+		Body:     "hey tulir",
+		Mentions: &event.Mentions{},
+	})
+	should = rules.GetActions(room, notMentioned).Should()
+	assert.True(t, should.Notify)
+	assert.False(t, should.Highlight, "legacy display name rule shouldn't apply to events with m.mentions")
+
+	legacy := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hey tulir"})
+	assert.True(t, rules.GetActions(room, legacy).Should().Highlight)
+
+	roomMention := newFakeEvent(event.EventMessage, &event.MessageEventContent{
+		MsgType:  event.MsgText,
+		Body:     "hey everyone",
+		Mentions: &event.Mentions{Room: true},
+	})
+	assert.True(t, rules.GetActions(room, roomMention).Should().Highlight)
+	room.powerLevels.Users["@tulir:maunium.net"] = 0
+	assert.False(t, rules.GetActions(room, roomMention).Should().Highlight)
+}
+
+func TestDefaultPushRuleset_SuppressEdits(t *testing.T) {
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	edit := &event.MessageEventContent{MsgType: event.MsgText, Body: "* hey"}
+	edit.SetEdit("$original")
+	actions := rules.GetActions(newFakeRoom(4), newFakeEvent(event.EventMessage, edit))
+	assert.NotNil(t, actions)
+	assert.Empty(t, actions)
+}
+
+func TestDefaultPushRuleset_JSON(t *testing.T) {
+	data, err := json.Marshal(pushrules.DefaultPushRuleset("@tulir:maunium.net"))
+	require.NoError(t, err)
+	var parsed pushrules.PushRuleset
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	require.Len(t, parsed.Override, 12)
+	assert.Equal(t, pushrules.RuleIDIsUserMention, parsed.Override[4].RuleID)
+	assert.Equal(t, `content.m\.mentions.user_ids`, parsed.Override[4].Conditions[0].Key)
+	assert.Equal(t, "@tulir:maunium.net", parsed.Override[4].Conditions[0].Value)
+	assert.Equal(t, "tulir", parsed.Content[0].Pattern)
+}
+
+func TestMergeWithDefaults(t *testing.T) {
+	var userRules pushrules.PushRuleset
+	err := json.Unmarshal([]byte(`{
+		"override": [
+			{"rule_id": ".m.rule.master", "default": true, "enabled": true, "actions": [], "conditions": []},
+			{"rule_id": "custom", "default": false, "enabled": true, "actions": ["notify"], "conditions": [{"kind": "event_match", "key": "content.body", "pattern": "*cats*"}]},
+			{"rule_id": ".m.rule.suppress_notices", "default": true, "enabled": false, "actions": [], "conditions": [{"kind": "event_match", "key": "content.msgtype", "pattern": "m.notice"}]},
+			{"rule_id": ".m.rule.future_rule", "default": true, "enabled": true, "actions": [], "conditions": []}
+		],
+		"content": [],
+		"room": [{"rule_id": "!room:maunium.net", "default": false, "enabled": true, "actions": []}],
+		"sender": [],
+		"underride": [
+			{"rule_id": ".m.rule.message", "default": true, "enabled": false, "actions": ["notify"], "conditions": [{"kind": "event_match", "key": "type", "pattern": "m.room.message"}]}
+		]
+	}`), &userRules)
+	require.NoError(t, err)
+
+	merged := pushrules.MergeWithDefaults(&userRules, "@tulir:maunium.net")
+	require.Len(t, merged.Override, 14)
+	assert.Equal(t, pushrules.RuleIDMaster, merged.Override[0].RuleID)
+	assert.True(t, merged.Override[0].Enabled)
+	assert.Equal(t, "custom", merged.Override[1].RuleID)
+	assert.Equal(t, pushrules.RuleIDSuppressNotices, merged.Override[2].RuleID)
+	assert.False(t, merged.Override[2].Enabled)
+	assert.Equal(t, pushrules.RuleIDIsUserMention, merged.Override[5].RuleID)
+	assert.Equal(t, ".m.rule.future_rule", merged.Override[13].RuleID)
+	require.Len(t, merged.Content, 1)
+	assert.Equal(t, pushrules.RuleIDContainsUserName, merged.Content[0].RuleID)
+	assert.Contains(t, merged.Room.Map, "!room:maunium.net")
+	assert.Equal(t, pushrules.RoomRule, merged.Room.Type)
+	require.Len(t, merged.Underride, 5)
+	assert.False(t, merged.Underride[3].Enabled)
+
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"})
+	assert.Nil(t, merged.Underride.GetActions(newFakeRoom(4), evt), "disabled default rule shouldn't match")
+}
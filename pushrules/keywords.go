@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules
+
+import (
+	"strings"
+)
+
+var globEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`?`, `\?`,
+	`[`, `\[`,
+	`]`, `\]`,
+	`{`, `\{`,
+	`}`, `\}`,
+)
+
+// EscapeGlob escapes glob special characters in the given string, so that it can be used as a literal pattern.
+func EscapeGlob(text string) string {
+	return globEscaper.Replace(text)
+}
+
+// UnescapeGlob reverses EscapeGlob.
+func UnescapeGlob(pattern string) string {
+	var out strings.Builder
+	escaped := false
+	for _, char := range pattern {
+		if !escaped && char == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		out.WriteRune(char)
+	}
+	return out.String()
+}
+
+var keywordRuleIDReplacer = strings.NewReplacer("/", "_", `\`, "_")
+
+// KeywordRuleID returns the rule ID used for the content rule of the given keyword.
+// The keyword itself is used as the ID like other clients do, except that slashes and backslashes,
+// which aren't allowed in rule IDs, are replaced with underscores.
+func KeywordRuleID(keyword string) string {
+	return keywordRuleIDReplacer.Replace(keyword)
+}
+
+// Keyword is a high-level representation of a user-defined content rule.
+type Keyword struct {
+	Keyword   string
+	RuleID    string
+	Enabled   bool
+	Notify    bool
+	Highlight bool
+	// The sound to play, or an empty string for no sound.
+	Sound string
+}
+
+// NewKeywordRule creates a content rule that matches the given keyword literally.
+// The rule always notifies, and additionally highlights and plays a sound if requested.
+func NewKeywordRule(keyword string, highlight bool, sound string) *PushRule {
+	actions := PushActionArray{{Action: ActionNotify}}
+	if highlight {
+		actions = append(actions, &PushAction{Action: ActionSetTweak, Tweak: TweakHighlight})
+	}
+	if len(sound) > 0 {
+		actions = append(actions, &PushAction{Action: ActionSetTweak, Tweak: TweakSound, Value: sound})
+	}
+	return &PushRule{
+		Type:    ContentRule,
+		RuleID:  KeywordRuleID(keyword),
+		Actions: actions,
+		Enabled: true,
+		Pattern: EscapeGlob(keyword),
+	}
+}
+
+// GetKeywords returns all user-defined content rules as keywords. Default rules (e.g. for the user's own name)
+// are not included.
+func (rs *PushRuleset) GetKeywords() []Keyword {
+	keywords := make([]Keyword, 0, len(rs.Content))
+	for _, rule := range rs.Content {
+		if rule.Default {
+			continue
+		}
+		should := rule.Actions.Should()
+		keywords = append(keywords, Keyword{
+			Keyword:   UnescapeGlob(rule.Pattern),
+			RuleID:    rule.RuleID,
+			Enabled:   rule.Enabled,
+			Notify:    should.Notify,
+			Highlight: should.Highlight,
+			Sound:     should.SoundName,
+		})
+	}
+	return keywords
+}
+
+// GetKeyword finds the content rule for the given keyword.
+func (rs *PushRuleset) GetKeyword(keyword string) (Keyword, bool) {
+	for _, kw := range rs.GetKeywords() {
+		if kw.Keyword == keyword {
+			return kw, true
+		}
+	}
+	return Keyword{}, false
+}
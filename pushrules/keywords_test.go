@@ -0,0 +1,50 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+func TestEscapeGlob(t *testing.T) {
+	assert.Equal(t, `what\?`, pushrules.EscapeGlob("what?"))
+	assert.Equal(t, `\[a\*b\]\\`, pushrules.EscapeGlob(`[a*b]\`))
+	assert.Equal(t, `[a*b]\`, pushrules.UnescapeGlob(pushrules.EscapeGlob(`[a*b]\`)))
+}
+
+func TestNewKeywordRule(t *testing.T) {
+	rule := pushrules.NewKeywordRule("c*t?", true, "default")
+	assert.Equal(t, "c*t?", rule.RuleID)
+	room := newFakeRoom(4)
+	matching := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "c*t?"})
+	nonMatching := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "cats"})
+	assert.True(t, rule.Match(room, matching))
+	assert.False(t, rule.Match(room, nonMatching), "glob characters in keywords should be matched literally")
+
+	assert.Equal(t, "a_b", pushrules.NewKeywordRule("a/b", false, "").RuleID)
+}
+
+func TestPushRuleset_GetKeywords(t *testing.T) {
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	rules.Content = append(rules.Content, pushrules.NewKeywordRule("cats?", true, "default"), pushrules.NewKeywordRule("dogs", false, ""))
+	keywords := rules.GetKeywords()
+	require.Len(t, keywords, 2)
+	assert.Equal(t, pushrules.Keyword{Keyword: "cats?", RuleID: "cats?", Enabled: true, Notify: true, Highlight: true, Sound: "default"}, keywords[0])
+	assert.Equal(t, pushrules.Keyword{Keyword: "dogs", RuleID: "dogs", Enabled: true, Notify: true}, keywords[1])
+
+	kw, ok := rules.GetKeyword("dogs")
+	assert.True(t, ok)
+	assert.False(t, kw.Highlight)
+	_, ok = rules.GetKeyword("tulir")
+	assert.False(t, ok)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules
+
+import (
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomNotificationMode is a high-level notification setting for a single room,
+// represented in the ruleset as room-specific override and room rules (using the same conventions as Element).
+type RoomNotificationMode string
+
+const (
+	// RoomModeDefault means there are no room-specific rules.
+	RoomModeDefault RoomNotificationMode = "default"
+	// RoomModeAllMessages means all messages notify with a sound (a room rule with notify and sound actions).
+	RoomModeAllMessages RoomNotificationMode = "all_messages"
+	// RoomModeMentionsOnly means only mentions and keywords notify (a room rule with no actions).
+	RoomModeMentionsOnly RoomNotificationMode = "mentions_only"
+	// RoomModeMute means nothing notifies (an override rule matching the room ID with no actions).
+	RoomModeMute RoomNotificationMode = "mute"
+)
+
+// NewRoomMuteRule creates the override rule used to mute a room.
+func NewRoomMuteRule(roomID id.RoomID) *PushRule {
+	return &PushRule{
+		Type:    OverrideRule,
+		RuleID:  roomID.String(),
+		Actions: PushActionArray{},
+		Enabled: true,
+		Conditions: []*PushCondition{{
+			Kind:    KindEventMatch,
+			Key:     "room_id",
+			Pattern: roomID.String(),
+		}},
+	}
+}
+
+// NewRoomRule creates the room-specific rule used for the mentions only and all messages modes.
+// Other modes return nil.
+func NewRoomRule(roomID id.RoomID, mode RoomNotificationMode) *PushRule {
+	var actions PushActionArray
+	switch mode {
+	case RoomModeMentionsOnly:
+		actions = PushActionArray{}
+	case RoomModeAllMessages:
+		actions = notifyWithSound("default")
+	default:
+		return nil
+	}
+	return &PushRule{
+		Type:    RoomRule,
+		RuleID:  roomID.String(),
+		Actions: actions,
+		Enabled: true,
+	}
+}
+
+func (rs *PushRuleset) isRoomMuted(roomID id.RoomID) bool {
+	for _, rule := range rs.Override {
+		if rule.RuleID != roomID.String() || !rule.Enabled || rule.Actions.Should().Notify {
+			continue
+		} else if len(rule.Conditions) == 1 && rule.Conditions[0].Kind == KindEventMatch &&
+			rule.Conditions[0].Key == "room_id" && rule.Conditions[0].Pattern == roomID.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRoomNotificationMode returns the notification mode of the given room based on the room-specific rules.
+func (rs *PushRuleset) GetRoomNotificationMode(roomID id.RoomID) RoomNotificationMode {
+	if rs.isRoomMuted(roomID) {
+		return RoomModeMute
+	}
+	rule, ok := rs.Room.Map[roomID.String()]
+	if !ok || !rule.Enabled {
+		return RoomModeDefault
+	} else if rule.Actions.Should().Notify {
+		return RoomModeAllMessages
+	}
+	return RoomModeMentionsOnly
+}
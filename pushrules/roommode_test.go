@@ -0,0 +1,37 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pushrules_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+func TestPushRuleset_GetRoomNotificationMode(t *testing.T) {
+	const roomID = "!fakeroom:maunium.net"
+	rules := pushrules.DefaultPushRuleset("@tulir:maunium.net")
+	room := newFakeRoom(4)
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"})
+	assert.Equal(t, pushrules.RoomModeDefault, rules.GetRoomNotificationMode(roomID))
+
+	rules.Room.Map[roomID] = pushrules.NewRoomRule(roomID, pushrules.RoomModeMentionsOnly)
+	assert.Equal(t, pushrules.RoomModeMentionsOnly, rules.GetRoomNotificationMode(roomID))
+	assert.False(t, rules.GetActions(room, evt).Should().Notify)
+
+	rules.Room.Map[roomID] = pushrules.NewRoomRule(roomID, pushrules.RoomModeAllMessages)
+	assert.Equal(t, pushrules.RoomModeAllMessages, rules.GetRoomNotificationMode(roomID))
+	assert.True(t, rules.GetActions(room, evt).Should().PlaySound)
+
+	rules.Override = append(rules.Override, pushrules.NewRoomMuteRule(roomID))
+	assert.Equal(t, pushrules.RoomModeMute, rules.GetRoomNotificationMode(roomID))
+	assert.False(t, rules.GetActions(room, evt).Should().Notify)
+	assert.Equal(t, pushrules.RoomModeDefault, rules.GetRoomNotificationMode("!otherroom:maunium.net"))
+}
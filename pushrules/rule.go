@@ -11,7 +11,6 @@ import (
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
-	"maunium.net/go/mautrix/pushrules/glob"
 )
 
 func init() {
@@ -114,9 +113,30 @@ type PushRule struct {
 	Pattern string `json:"pattern,omitempty"`
 }
 
+// IDs of the legacy mention push rules, which don't apply to events with intentional mentions (MSC3952).
+const (
+	RuleIDContainsDisplayName = ".m.rule.contains_display_name"
+	RuleIDContainsUserName    = ".m.rule.contains_user_name"
+	RuleIDRoomNotif           = ".m.rule.roomnotif"
+)
+
+func hasIntentionalMentions(evt *event.Event) bool {
+	if _, ok := evt.Content.Raw["m.mentions"]; ok {
+		return true
+	}
+	msg, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	return ok && msg.Mentions != nil
+}
+
+func (rule *PushRule) isLegacyMentionRule() bool {
+	return rule.Default && (rule.RuleID == RuleIDContainsDisplayName || rule.RuleID == RuleIDContainsUserName || rule.RuleID == RuleIDRoomNotif)
+}
+
 func (rule *PushRule) Match(room Room, evt *event.Event) bool {
 	if !rule.Enabled {
 		return false
+	} else if rule.isLegacyMentionRule() && hasIntentionalMentions(evt) {
+		return false
 	}
 	switch rule.Type {
 	case OverrideRule, UnderrideRule:
@@ -142,7 +162,7 @@ func (rule *PushRule) matchConditions(room Room, evt *event.Event) bool {
 }
 
 func (rule *PushRule) matchPattern(room Room, evt *event.Event) bool {
-	pattern, err := glob.Compile(rule.Pattern)
+	pattern, err := compileGlob(rule.Pattern)
 	if err != nil {
 		return false
 	}
@@ -77,6 +77,29 @@ func TestPushRule_Match_Content(t *testing.T) {
 	assert.True(t, rule.Match(blankTestRoom, evt))
 }
 
+func TestPushRule_Match_LegacyMentionIgnoredWithMentions(t *testing.T) {
+	rule := &pushrules.PushRule{
+		Type:    pushrules.ContentRule,
+		RuleID:  pushrules.RuleIDContainsUserName,
+		Default: true,
+		Enabled: true,
+		Pattern: "tulir",
+	}
+
+	evt := newFakeEvent(event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "hi tulir",
+	})
+	assert.True(t, rule.Match(blankTestRoom, evt))
+
+	evt = newFakeEvent(event.EventMessage, &event.MessageEventContent{
+		MsgType:  event.MsgText,
+		Body:     "hi tulir",
+		Mentions: &event.Mentions{},
+	})
+	assert.False(t, rule.Match(blankTestRoom, evt))
+}
+
 func TestPushRule_Match_Content_Fail(t *testing.T) {
 	rule := &pushrules.PushRule{
 		Type:    pushrules.ContentRule,
@@ -70,6 +70,9 @@ var DefaultPushActions = PushActionArray{&PushAction{Action: ActionDontNotify}}
 // GetActions matches the given event against all of the push rule
 // collections in this push ruleset in the order of priority as
 // specified in spec section 11.12.1.4.
+//
+// The rules are interpreted on every call. When evaluating many events, use a CompiledRuleset
+// from RulesetCache.Get instead.
 func (rs *PushRuleset) GetActions(room Room, evt *event.Event) (match PushActionArray) {
 	// Add push rule collections to array in priority order
 	arrays := []PushRuleCollection{rs.Override, rs.Content, rs.Room, rs.Sender, rs.Underride}
@@ -0,0 +1,480 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package redisstatestore contains a StateStore implementation backed by Redis, which allows multiple
+// appservice workers to share the same state.
+//
+// The package is a separate Go module, so that users of the main module don't need to depend on go-redis.
+package redisstatestore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RedisStateStore is an implementation of the appservice StateStore that stores everything in Redis.
+// It also implements the crypto StateStore interface.
+//
+// Keys are namespaced with Prefix, so multiple appservices can share the same Redis database.
+// Members, power levels and encryption event contents are encoded with Codec, which is JSON by default.
+type RedisStateStore struct {
+	Client redis.UniversalClient
+	Prefix string
+	Log    mautrix.WarnLogger
+	Codec  appservice.StateCodec
+}
+
+var _ appservice.StateStore = (*RedisStateStore)(nil)
+
+// NewRedisStateStore creates a new Redis state store using the given client and key prefix (e.g. "mautrix:").
+func NewRedisStateStore(client redis.UniversalClient, prefix string, log mautrix.WarnLogger) *RedisStateStore {
+	return &RedisStateStore{
+		Client: client,
+		Prefix: prefix,
+		Log:    log,
+		Codec:  appservice.JSONCodec,
+	}
+}
+
+func (store *RedisStateStore) key(parts ...string) string {
+	key := store.Prefix
+	for i, part := range parts {
+		if i > 0 {
+			key += ":"
+		}
+		key += part
+	}
+	return key
+}
+
+func (store *RedisStateStore) registrationsKey() string {
+	return store.key("registrations")
+}
+
+func (store *RedisStateStore) membersKey(roomID id.RoomID) string {
+	return store.key("members", roomID.String())
+}
+
+func (store *RedisStateStore) roomStateKey(roomID id.RoomID) string {
+	return store.key("room_state", roomID.String())
+}
+
+func (store *RedisStateStore) encryptedRoomsKey() string {
+	return store.key("encrypted_rooms")
+}
+
+func (store *RedisStateStore) profileKey(userID id.UserID) string {
+	return store.key("profile", userID.String())
+}
+
+func (store *RedisStateStore) typingKey(roomID id.RoomID, userID id.UserID) string {
+	return store.key("typing", roomID.String(), userID.String())
+}
+
+func (store *RedisStateStore) IsRegistered(userID id.UserID) bool {
+	isRegistered, err := store.Client.SIsMember(context.Background(), store.registrationsKey(), userID.String()).Result()
+	if err != nil {
+		store.Log.Warnfln("Failed to check registration of %s: %v", userID, err)
+	}
+	return isRegistered
+}
+
+func (store *RedisStateStore) MarkRegistered(userID id.UserID) {
+	err := store.Client.SAdd(context.Background(), store.registrationsKey(), userID.String()).Err()
+	if err != nil {
+		store.Log.Warnfln("Failed to mark %s as registered: %v", userID, err)
+	}
+}
+
+func (store *RedisStateStore) IsTyping(roomID id.RoomID, userID id.UserID) bool {
+	count, err := store.Client.Exists(context.Background(), store.typingKey(roomID, userID)).Result()
+	if err != nil {
+		store.Log.Warnfln("Failed to check typing status of %s in %s: %v", userID, roomID, err)
+	}
+	return count > 0
+}
+
+// SetTyping marks the user as typing in the room for the given number of seconds. The typing status is stored
+// with an expiry, so it's removed automatically. Negative timeouts remove the typing status immediately.
+func (store *RedisStateStore) SetTyping(roomID id.RoomID, userID id.UserID, timeout int64) {
+	var err error
+	if timeout >= 0 {
+		err = store.Client.Set(context.Background(), store.typingKey(roomID, userID), 1, time.Duration(timeout+1)*time.Second).Err()
+	} else {
+		err = store.Client.Del(context.Background(), store.typingKey(roomID, userID)).Err()
+	}
+	if err != nil {
+		store.Log.Warnfln("Failed to set typing status of %s in %s: %v", userID, roomID, err)
+	}
+}
+
+func (store *RedisStateStore) GetRoomMembers(roomID id.RoomID) map[id.UserID]*event.MemberEventContent {
+	members := make(map[id.UserID]*event.MemberEventContent)
+	data, err := store.Client.HGetAll(context.Background(), store.membersKey(roomID)).Result()
+	if err != nil {
+		store.Log.Warnfln("Failed to get members of %s: %v", roomID, err)
+		return members
+	}
+	for userID, memberData := range data {
+		var member event.MemberEventContent
+		if err = store.Codec.Unmarshal([]byte(memberData), &member); err != nil {
+			store.Log.Warnfln("Failed to parse member %s in %s: %v", userID, roomID, err)
+		} else {
+			members[id.UserID(userID)] = &member
+		}
+	}
+	return members
+}
+
+func (store *RedisStateStore) GetMembership(roomID id.RoomID, userID id.UserID) event.Membership {
+	return store.GetMember(roomID, userID).Membership
+}
+
+func (store *RedisStateStore) GetMember(roomID id.RoomID, userID id.UserID) *event.MemberEventContent {
+	member, ok := store.TryGetMember(roomID, userID)
+	if !ok {
+		member = &event.MemberEventContent{Membership: event.MembershipLeave}
+	}
+	return member
+}
+
+func (store *RedisStateStore) TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool) {
+	data, err := store.Client.HGet(context.Background(), store.membersKey(roomID), userID.String()).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false
+	} else if err != nil {
+		store.Log.Warnfln("Failed to get member info of %s in %s: %v", userID, roomID, err)
+		return nil, false
+	}
+	var member event.MemberEventContent
+	if err = store.Codec.Unmarshal(data, &member); err != nil {
+		store.Log.Warnfln("Failed to parse member info of %s in %s: %v", userID, roomID, err)
+		return nil, false
+	}
+	return &member, true
+}
+
+func (store *RedisStateStore) IsInRoom(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin)
+}
+
+func (store *RedisStateStore) IsInvited(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin, event.MembershipInvite)
+}
+
+func (store *RedisStateStore) IsMembership(roomID id.RoomID, userID id.UserID, allowedMemberships ...event.Membership) bool {
+	membership := store.GetMembership(roomID, userID)
+	for _, allowedMembership := range allowedMemberships {
+		if allowedMembership == membership {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMembership changes the membership of the user while keeping the rest of the stored member info.
+//
+// This is a read-modify-write operation, so concurrent updates to the same member from other workers may be lost.
+func (store *RedisStateStore) SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership) {
+	member, ok := store.TryGetMember(roomID, userID)
+	if !ok {
+		member = &event.MemberEventContent{}
+	}
+	member.Membership = membership
+	store.SetMember(roomID, userID, member)
+}
+
+func (store *RedisStateStore) SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	data, err := store.Codec.Marshal(member)
+	if err != nil {
+		store.Log.Warnfln("Failed to marshal member info of %s in %s: %v", userID, roomID, err)
+		return
+	}
+	err = store.Client.HSet(context.Background(), store.membersKey(roomID), userID.String(), data).Err()
+	if err != nil {
+		store.Log.Warnfln("Failed to set member info of %s in %s: %v", userID, roomID, err)
+	}
+}
+
+// SetMembers stores the given members with a single HSET command.
+func (store *RedisStateStore) SetMembers(roomID id.RoomID, members map[id.UserID]*event.MemberEventContent) {
+	if len(members) == 0 {
+		return
+	}
+	values, err := store.marshalMembers(members)
+	if err != nil {
+		store.Log.Warnfln("Failed to marshal members of %s: %v", roomID, err)
+		return
+	}
+	err = store.Client.HSet(context.Background(), store.membersKey(roomID), values).Err()
+	if err != nil {
+		store.Log.Warnfln("Failed to set members of %s: %v", roomID, err)
+	}
+}
+
+func (store *RedisStateStore) marshalMembers(members map[id.UserID]*event.MemberEventContent) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(members))
+	for userID, member := range members {
+		data, err := store.Codec.Marshal(member)
+		if err != nil {
+			return nil, err
+		}
+		values[userID.String()] = data
+	}
+	return values, nil
+}
+
+// ReplaceRoomState replaces the stored members, power levels, encryption and metadata of the room
+// in a single MULTI/EXEC transaction.
+func (store *RedisStateStore) ReplaceRoomState(roomID id.RoomID, state []*event.Event) {
+	snapshot := appservice.NewRoomStateSnapshot(state)
+	members, err := store.marshalMembers(snapshot.Members)
+	if err != nil {
+		store.Log.Warnfln("Failed to marshal members of %s: %v", roomID, err)
+		return
+	}
+	meta := snapshot.Metadata
+	roomState := map[string]interface{}{
+		"name":            meta.Name,
+		"topic":           meta.Topic,
+		"avatar_url":      meta.AvatarURL.String(),
+		"canonical_alias": meta.CanonicalAlias.String(),
+		"room_type":       string(meta.Type),
+	}
+	if snapshot.PowerLevels != nil {
+		if roomState["power_levels"], err = store.Codec.Marshal(snapshot.PowerLevels); err != nil {
+			store.Log.Warnfln("Failed to marshal power levels of %s: %v", roomID, err)
+			return
+		}
+	}
+	if snapshot.Encryption != nil {
+		if roomState["encryption"], err = store.Codec.Marshal(snapshot.Encryption); err != nil {
+			store.Log.Warnfln("Failed to marshal encryption event of %s: %v", roomID, err)
+			return
+		}
+	}
+	ctx := context.Background()
+	_, err = store.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, store.membersKey(roomID), store.roomStateKey(roomID))
+		if len(members) > 0 {
+			pipe.HSet(ctx, store.membersKey(roomID), members)
+		}
+		pipe.HSet(ctx, store.roomStateKey(roomID), roomState)
+		if snapshot.Encryption != nil {
+			pipe.SAdd(ctx, store.encryptedRoomsKey(), roomID.String())
+		} else {
+			pipe.SRem(ctx, store.encryptedRoomsKey(), roomID.String())
+		}
+		return nil
+	})
+	if err != nil {
+		store.Log.Warnfln("Failed to replace state of %s: %v", roomID, err)
+	}
+}
+
+func (store *RedisStateStore) setRoomStateField(roomID id.RoomID, field string, value interface{}) {
+	err := store.Client.HSet(context.Background(), store.roomStateKey(roomID), field, value).Err()
+	if err != nil {
+		store.Log.Warnfln("Failed to store %s of %s: %v", field, roomID, err)
+	}
+}
+
+func (store *RedisStateStore) getRoomStateValue(roomID id.RoomID, field string, into interface{}) bool {
+	data, err := store.Client.HGet(context.Background(), store.roomStateKey(roomID), field).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false
+	} else if err != nil {
+		store.Log.Warnfln("Failed to get %s of %s: %v", field, roomID, err)
+		return false
+	} else if err = store.Codec.Unmarshal(data, into); err != nil {
+		store.Log.Warnfln("Failed to parse %s of %s: %v", field, roomID, err)
+		return false
+	}
+	return true
+}
+
+func (store *RedisStateStore) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) {
+	data, err := store.Codec.Marshal(levels)
+	if err != nil {
+		store.Log.Warnfln("Failed to marshal power levels of %s: %v", roomID, err)
+		return
+	}
+	store.setRoomStateField(roomID, "power_levels", data)
+}
+
+func (store *RedisStateStore) GetPowerLevels(roomID id.RoomID) *event.PowerLevelsEventContent {
+	var levels event.PowerLevelsEventContent
+	if !store.getRoomStateValue(roomID, "power_levels", &levels) {
+		return nil
+	}
+	return &levels
+}
+
+func (store *RedisStateStore) GetPowerLevel(roomID id.RoomID, userID id.UserID) int {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return 0
+	}
+	return levels.GetUserLevel(userID)
+}
+
+func (store *RedisStateStore) GetPowerLevelRequirement(roomID id.RoomID, eventType event.Type) int {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return (&event.PowerLevelsEventContent{}).GetEventLevel(eventType)
+	}
+	return levels.GetEventLevel(eventType)
+}
+
+func (store *RedisStateStore) HasPowerLevel(roomID id.RoomID, userID id.UserID, eventType event.Type) bool {
+	return store.GetPowerLevel(roomID, userID) >= store.GetPowerLevelRequirement(roomID, eventType)
+}
+
+func (store *RedisStateStore) SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent) {
+	data, err := store.Codec.Marshal(content)
+	if err != nil {
+		store.Log.Warnfln("Failed to marshal encryption event of %s: %v", roomID, err)
+		return
+	}
+	store.setRoomStateField(roomID, "encryption", data)
+	err = store.Client.SAdd(context.Background(), store.encryptedRoomsKey(), roomID.String()).Err()
+	if err != nil {
+		store.Log.Warnfln("Failed to add %s to encrypted rooms: %v", roomID, err)
+	}
+}
+
+func (store *RedisStateStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	var content event.EncryptionEventContent
+	if !store.getRoomStateValue(roomID, "encryption", &content) {
+		return nil
+	}
+	return &content
+}
+
+func (store *RedisStateStore) IsEncrypted(roomID id.RoomID) bool {
+	return store.GetEncryptionEvent(roomID) != nil
+}
+
+// FindSharedRooms returns the encrypted rooms where the given user is joined or invited.
+func (store *RedisStateStore) FindSharedRooms(userID id.UserID) (rooms []id.RoomID) {
+	roomIDs, err := store.Client.SMembers(context.Background(), store.encryptedRoomsKey()).Result()
+	if err != nil {
+		store.Log.Warnfln("Failed to get encrypted rooms: %v", err)
+		return
+	}
+	for _, roomID := range roomIDs {
+		if store.IsInvited(id.RoomID(roomID), userID) {
+			rooms = append(rooms, id.RoomID(roomID))
+		}
+	}
+	return
+}
+
+func (store *RedisStateStore) SetRoomName(roomID id.RoomID, name string) {
+	store.setRoomStateField(roomID, "name", name)
+}
+
+func (store *RedisStateStore) SetRoomTopic(roomID id.RoomID, topic string) {
+	store.setRoomStateField(roomID, "topic", topic)
+}
+
+func (store *RedisStateStore) SetRoomAvatar(roomID id.RoomID, avatarURL id.ContentURI) {
+	store.setRoomStateField(roomID, "avatar_url", avatarURL.String())
+}
+
+func (store *RedisStateStore) SetCanonicalAlias(roomID id.RoomID, alias id.RoomAlias) {
+	store.setRoomStateField(roomID, "canonical_alias", alias.String())
+}
+
+func (store *RedisStateStore) SetRoomType(roomID id.RoomID, roomType event.RoomType) {
+	store.setRoomStateField(roomID, "room_type", string(roomType))
+}
+
+// GetRoomMetadata returns the stored metadata of the room. If the room has no stored state, ok is false.
+func (store *RedisStateStore) GetRoomMetadata(roomID id.RoomID) (meta appservice.RoomMetadata, ok bool) {
+	data, err := store.Client.HGetAll(context.Background(), store.roomStateKey(roomID)).Result()
+	if err != nil {
+		store.Log.Warnfln("Failed to get metadata of %s: %v", roomID, err)
+		return
+	} else if len(data) == 0 {
+		return
+	}
+	meta.Name = data["name"]
+	meta.Topic = data["topic"]
+	meta.AvatarURL, _ = id.ParseContentURI(data["avatar_url"])
+	meta.CanonicalAlias = id.RoomAlias(data["canonical_alias"])
+	meta.Type = event.RoomType(data["room_type"])
+	return meta, true
+}
+
+func (store *RedisStateStore) getProfileField(userID id.UserID, field string) (string, bool) {
+	value, err := store.Client.HGet(context.Background(), store.profileKey(userID), field).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false
+	} else if err != nil {
+		store.Log.Warnfln("Failed to get %s of %s: %v", field, userID, err)
+		return "", false
+	}
+	return value, true
+}
+
+func (store *RedisStateStore) setProfileField(userID id.UserID, field, value string) {
+	err := store.Client.HSet(context.Background(), store.profileKey(userID), field, value).Err()
+	if err != nil {
+		store.Log.Warnfln("Failed to store %s of %s: %v", field, userID, err)
+	}
+}
+
+func (store *RedisStateStore) GetDisplayName(userID id.UserID) (string, bool) {
+	return store.getProfileField(userID, "displayname")
+}
+
+func (store *RedisStateStore) SetDisplayName(userID id.UserID, displayName string) {
+	store.setProfileField(userID, "displayname", displayName)
+}
+
+func (store *RedisStateStore) GetAvatarURL(userID id.UserID) (id.ContentURI, bool) {
+	avatarURL, ok := store.getProfileField(userID, "avatar_url")
+	if !ok {
+		return id.ContentURI{}, false
+	}
+	parsed, err := id.ParseContentURI(avatarURL)
+	if err != nil {
+		store.Log.Warnfln("Failed to parse stored avatar URL of %s: %v", userID, err)
+		return id.ContentURI{}, false
+	}
+	return parsed, true
+}
+
+func (store *RedisStateStore) SetAvatarURL(userID id.UserID, avatarURL id.ContentURI) {
+	store.setProfileField(userID, "avatar_url", avatarURL.String())
+}
+
+// CountEntries returns the number of registrations and encrypted rooms in the store. Rooms and members aren't
+// counted, as that would require scanning the whole keyspace.
+func (store *RedisStateStore) CountEntries() map[string]int {
+	counts := make(map[string]int, 2)
+	for name, key := range map[string]string{
+		"registrations":   store.registrationsKey(),
+		"encrypted_rooms": store.encryptedRoomsKey(),
+	} {
+		count, err := store.Client.SCard(context.Background(), key).Result()
+		if err != nil {
+			store.Log.Warnfln("Failed to count %s: %v", name, err)
+		} else {
+			counts[name] = int(count)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package redisstatestore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/statestoretest"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/redisstatestore"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (log testLogger) Debugfln(message string, args ...interface{}) {
+	log.t.Logf(message, args...)
+}
+
+func (log testLogger) Warnfln(message string, args ...interface{}) {
+	log.t.Errorf(message, args...)
+}
+
+func newTestStore(t *testing.T) (*redisstatestore.RedisStateStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return redisstatestore.NewRedisStateStore(client, "test:", testLogger{t}), server
+}
+
+func TestRedisStateStore_Members(t *testing.T) {
+	store, _ := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+
+	assert.False(t, store.IsRegistered(userID))
+	store.MarkRegistered(userID)
+	assert.True(t, store.IsRegistered(userID))
+
+	assert.Equal(t, event.MembershipLeave, store.GetMembership(roomID, userID))
+	store.SetMember(roomID, userID, &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "User"})
+	assert.True(t, store.IsInRoom(roomID, userID))
+	store.SetMembership(roomID, userID, event.MembershipInvite)
+	assert.True(t, store.IsInvited(roomID, userID))
+	assert.False(t, store.IsInRoom(roomID, userID))
+	assert.Equal(t, "User", store.GetMember(roomID, userID).Displayname)
+	assert.Len(t, store.GetRoomMembers(roomID), 1)
+
+	assert.Nil(t, store.GetPowerLevels(roomID))
+	store.SetPowerLevels(roomID, &event.PowerLevelsEventContent{Users: map[id.UserID]int{userID: 50}})
+	assert.Equal(t, 50, store.GetPowerLevel(roomID, userID))
+
+	assert.False(t, store.IsEncrypted(roomID))
+	assert.Empty(t, store.FindSharedRooms(userID))
+	store.SetEncryptionEvent(roomID, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+	assert.True(t, store.IsEncrypted(roomID))
+	assert.Equal(t, []id.RoomID{roomID}, store.FindSharedRooms(userID))
+
+	store.SetRoomName(roomID, "Room")
+	meta, ok := store.GetRoomMetadata(roomID)
+	require.True(t, ok)
+	assert.Equal(t, "Room", meta.Name)
+}
+
+func TestRedisStateStore_Profile(t *testing.T) {
+	store, _ := newTestStore(t)
+	const userID = id.UserID("@user:example.com")
+
+	_, ok := store.GetDisplayName(userID)
+	assert.False(t, ok)
+	store.SetDisplayName(userID, "")
+	displayName, ok := store.GetDisplayName(userID)
+	assert.True(t, ok)
+	assert.Empty(t, displayName)
+
+	store.SetAvatarURL(userID, id.MustParseContentURI("mxc://example.com/avatar"))
+	avatarURL, ok := store.GetAvatarURL(userID)
+	assert.True(t, ok)
+	assert.Equal(t, "mxc://example.com/avatar", avatarURL.String())
+}
+
+func TestRedisStateStore_Typing(t *testing.T) {
+	store, server := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+
+	store.SetTyping(roomID, userID, 5)
+	assert.True(t, store.IsTyping(roomID, userID))
+	server.FastForward(10 * time.Second)
+	assert.False(t, store.IsTyping(roomID, userID))
+
+	store.SetTyping(roomID, userID, 5)
+	store.SetTyping(roomID, userID, -1)
+	assert.False(t, store.IsTyping(roomID, userID))
+}
+
+func TestRedisStateStore_Bulk(t *testing.T) {
+	store, _ := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+	const oldMember = id.UserID("@old:example.com")
+	const newMember = id.UserID("@new:example.com")
+
+	store.SetMembers(roomID, map[id.UserID]*event.MemberEventContent{
+		oldMember: {Membership: event.MembershipJoin},
+		newMember: {Membership: event.MembershipInvite},
+	})
+	assert.True(t, store.IsInRoom(roomID, oldMember))
+	assert.True(t, store.IsInvited(roomID, newMember))
+	store.SetEncryptionEvent(roomID, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+
+	store.ReplaceRoomState(roomID, []*event.Event{
+		statestoretest.StateEvent(event.StateMember, newMember.String(), &event.MemberEventContent{Membership: event.MembershipJoin}),
+		statestoretest.StateEvent(event.StatePowerLevels, "", &event.PowerLevelsEventContent{Users: map[id.UserID]int{newMember: 100}}),
+		statestoretest.StateEvent(event.StateTopic, "", &event.TopicEventContent{Topic: "Topic"}),
+	})
+	assert.False(t, store.IsInRoom(roomID, oldMember))
+	assert.True(t, store.IsInRoom(roomID, newMember))
+	assert.Equal(t, 100, store.GetPowerLevel(roomID, newMember))
+	assert.False(t, store.IsEncrypted(roomID))
+	assert.Empty(t, store.FindSharedRooms(newMember))
+	meta, ok := store.GetRoomMetadata(roomID)
+	require.True(t, ok)
+	assert.Equal(t, "Topic", meta.Topic)
+}
+
+func TestRedisStateStore_Codecs(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+	for _, codec := range []appservice.StateCodec{appservice.JSONCodec, appservice.GobCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			store, _ := newTestStore(t)
+			store.Codec = codec
+			store.SetMember(roomID, userID, &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "User"})
+			store.SetPowerLevels(roomID, &event.PowerLevelsEventContent{Users: map[id.UserID]int{userID: 50}})
+			store.SetEncryptionEvent(roomID, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+
+			assert.Equal(t, "User", store.GetMember(roomID, userID).Displayname)
+			assert.Equal(t, 50, store.GetPowerLevel(roomID, userID))
+			assert.True(t, store.IsEncrypted(roomID))
+			assert.Equal(t, []id.RoomID{roomID}, store.FindSharedRooms(userID))
+		})
+	}
+}
+
+func TestRedisStateStore_CountEntries(t *testing.T) {
+	store, _ := newTestStore(t)
+	store.MarkRegistered("@bot:example.com")
+	store.SetEncryptionEvent("!a:example.com", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+
+	var counter appservice.StateStoreEntryCounter = store
+	assert.Equal(t, map[string]int{"registrations": 1, "encrypted_rooms": 1}, counter.CountEntries())
+}
@@ -103,6 +103,8 @@ type ReqCreateRoom struct {
 	IsDirect        bool                   `json:"is_direct,omitempty"`
 
 	PowerLevelOverride *event.PowerLevelsEventContent `json:"power_level_content_override,omitempty"`
+
+	RoomVersion id.RoomVersion `json:"room_version,omitempty"`
 }
 
 // ReqRedact is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-redact-eventid-txnid
@@ -307,9 +309,26 @@ type ReqPutPushRule struct {
 	Before string `json:"-"`
 	After  string `json:"-"`
 
-	Actions    []pushrules.PushActionType `json:"actions"`
-	Conditions []pushrules.PushCondition  `json:"conditions"`
-	Pattern    string                     `json:"pattern"`
+	Actions    pushrules.PushActionArray  `json:"actions"`
+	Conditions []*pushrules.PushCondition `json:"conditions,omitempty"`
+	Pattern    string                     `json:"pattern,omitempty"`
+}
+
+// NewReqPutPushRule creates a ReqPutPushRule that recreates the given push rule.
+func NewReqPutPushRule(rule *pushrules.PushRule) *ReqPutPushRule {
+	return &ReqPutPushRule{
+		Actions:    rule.Actions,
+		Conditions: rule.Conditions,
+		Pattern:    rule.Pattern,
+	}
+}
+
+type ReqPutPushRuleEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+type ReqPutPushRuleActions struct {
+	Actions pushrules.PushActionArray `json:"actions"`
 }
 
 type ReqBatchSend struct {
@@ -321,6 +340,23 @@ type ReqBatchSend struct {
 }
 
 type ReqSetReadMarkers struct {
-	Read      id.EventID `json:"m.read"`
-	FullyRead id.EventID `json:"m.fully_read"`
+	Read        id.EventID `json:"m.read,omitempty"`
+	ReadPrivate id.EventID `json:"m.read.private,omitempty"`
+	FullyRead   id.EventID `json:"m.fully_read,omitempty"`
+}
+
+type ReqSendReceipt struct {
+	ThreadID string `json:"thread_id,omitempty"`
+}
+
+// ReqGetRelations contains the optional parameters for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidrelationseventidreltypeeventtype
+type ReqGetRelations struct {
+	// RelationType filters the relations to the given type. It's required if EventType is set.
+	RelationType event.RelationType
+	EventType    event.Type
+
+	Dir   rune
+	From  string
+	To    string
+	Limit int
 }
@@ -3,6 +3,7 @@ package mautrix
 import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
 )
 
 // RespWhoami is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-account-whoami
@@ -147,6 +148,12 @@ type RespUserDisplayName struct {
 	DisplayName string `json:"displayname"`
 }
 
+// RespUserProfile is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuserid
+type RespUserProfile struct {
+	DisplayName string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+}
+
 // RespRegister is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-register
 type RespRegister struct {
 	AccessToken  string      `json:"access_token"`
@@ -345,3 +352,18 @@ type RespBatchSend struct {
 
 	NextBatchID id.BatchID `json:"next_batch_id"`
 }
+
+// RespGetRelations is the JSON response for https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv1roomsroomidrelationseventidreltypeeventtype
+type RespGetRelations struct {
+	Chunk     []*event.Event `json:"chunk"`
+	NextBatch string         `json:"next_batch,omitempty"`
+	PrevBatch string         `json:"prev_batch,omitempty"`
+}
+
+type RespPushRuleEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+type RespPushRuleActions struct {
+	Actions pushrules.PushActionArray `json:"actions"`
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstatestore
+
+import (
+	"database/sql"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const upsertMemberQuery = `
+	INSERT INTO mx_user_profile (room_id, user_id, membership, displayname, avatar_url) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (room_id, user_id) DO UPDATE SET membership=excluded.membership, displayname=excluded.displayname, avatar_url=excluded.avatar_url
+`
+
+func insertMembers(tx *sql.Tx, roomID id.RoomID, members map[id.UserID]*event.MemberEventContent) error {
+	stmt, err := tx.Prepare(upsertMemberQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for userID, member := range members {
+		_, err = stmt.Exec(roomID, userID, member.Membership, member.Displayname, member.AvatarURL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMembers stores the given members in a single transaction.
+func (store *SQLStateStore) SetMembers(roomID id.RoomID, members map[id.UserID]*event.MemberEventContent) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		store.Log.Warnfln("Failed to begin transaction to store members of %s: %v", roomID, err)
+		return
+	}
+	if err = insertMembers(tx, roomID, members); err != nil {
+		_ = tx.Rollback()
+		store.Log.Warnfln("Failed to store members of %s: %v", roomID, err)
+	} else if err = tx.Commit(); err != nil {
+		store.Log.Warnfln("Failed to commit members of %s: %v", roomID, err)
+	}
+}
+
+// marshalNullable encodes the content with the store's codec, or returns nil (i.e. NULL) if the content is nil.
+func (store *SQLStateStore) marshalNullable(content interface{}, isNil bool) (interface{}, error) {
+	if isNil {
+		return nil, nil
+	}
+	return store.Codec.Marshal(content)
+}
+
+// updatePowerLevelColumns updates the parsed power level columns of the room. The mx_room_state row must already exist.
+func updatePowerLevelColumns(tx *sql.Tx, roomID id.RoomID, levels *event.PowerLevelsEventContent) error {
+	var usersDefault, eventsDefault, stateDefault sql.NullInt64
+	if levels != nil {
+		usersDefault = sql.NullInt64{Int64: int64(levels.UsersDefault), Valid: true}
+		eventsDefault = sql.NullInt64{Int64: int64(levels.EventsDefault), Valid: true}
+		stateDefault = sql.NullInt64{Int64: int64(levels.StateDefault()), Valid: true}
+	}
+	_, err := tx.Exec(
+		"UPDATE mx_room_state SET users_default=$1, events_default=$2, state_default=$3 WHERE room_id=$4",
+		usersDefault, eventsDefault, stateDefault, roomID,
+	)
+	if err != nil {
+		return err
+	} else if _, err = tx.Exec("DELETE FROM mx_user_power_level WHERE room_id=$1", roomID); err != nil {
+		return err
+	} else if levels == nil || len(levels.Users) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("INSERT INTO mx_user_power_level (room_id, user_id, power_level) VALUES ($1, $2, $3)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for userID, level := range levels.Users {
+		if _, err = stmt.Exec(roomID, userID, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *SQLStateStore) replaceRoomState(tx *sql.Tx, roomID id.RoomID, snapshot *appservice.RoomStateSnapshot) error {
+	powerLevels, err := store.marshalNullable(snapshot.PowerLevels, snapshot.PowerLevels == nil)
+	if err != nil {
+		return err
+	}
+	encryption, err := store.marshalNullable(snapshot.Encryption, snapshot.Encryption == nil)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM mx_user_profile WHERE room_id=$1", roomID); err != nil {
+		return err
+	} else if err = insertMembers(tx, roomID, snapshot.Members); err != nil {
+		return err
+	}
+	meta := snapshot.Metadata
+	_, err = tx.Exec(`
+		INSERT INTO mx_room_state (room_id, power_levels, encryption, name, topic, avatar_url, canonical_alias, room_type)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (room_id) DO UPDATE
+			SET power_levels=excluded.power_levels, encryption=excluded.encryption, name=excluded.name,
+			    topic=excluded.topic, avatar_url=excluded.avatar_url, canonical_alias=excluded.canonical_alias,
+			    room_type=excluded.room_type
+	`, roomID, powerLevels, encryption, meta.Name, meta.Topic, meta.AvatarURL.String(), string(meta.CanonicalAlias), string(meta.Type))
+	if err != nil {
+		return err
+	}
+	return updatePowerLevelColumns(tx, roomID, snapshot.PowerLevels)
+}
+
+// ReplaceRoomState replaces the stored members, power levels, encryption and metadata of the room in a single transaction.
+func (store *SQLStateStore) ReplaceRoomState(roomID id.RoomID, state []*event.Event) {
+	snapshot := appservice.NewRoomStateSnapshot(state)
+	tx, err := store.DB.Begin()
+	if err != nil {
+		store.Log.Warnfln("Failed to begin transaction to replace state of %s: %v", roomID, err)
+		return
+	}
+	if err = store.replaceRoomState(tx, roomID, snapshot); err != nil {
+		_ = tx.Rollback()
+		store.Log.Warnfln("Failed to replace state of %s: %v", roomID, err)
+	} else if err = tx.Commit(); err != nil {
+		store.Log.Warnfln("Failed to commit state of %s: %v", roomID, err)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstatestore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var _ mautrix.Storer = (*SQLStateStore)(nil)
+
+func (store *SQLStateStore) SaveFilterID(userID id.UserID, filterID string) {
+	_, err := store.DB.Exec(`
+		INSERT INTO mx_client_sync (user_id, filter_id) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET filter_id=excluded.filter_id
+	`, userID, filterID)
+	if err != nil {
+		store.Log.Warnfln("Failed to store filter ID of %s: %v", userID, err)
+	}
+}
+
+func (store *SQLStateStore) LoadFilterID(userID id.UserID) string {
+	var filterID sql.NullString
+	err := store.DB.QueryRow("SELECT filter_id FROM mx_client_sync WHERE user_id=$1", userID).Scan(&filterID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warnfln("Failed to scan filter ID of %s: %v", userID, err)
+	}
+	return filterID.String
+}
+
+func (store *SQLStateStore) SaveNextBatch(userID id.UserID, nextBatchToken string) {
+	_, err := store.DB.Exec(`
+		INSERT INTO mx_client_sync (user_id, next_batch) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET next_batch=excluded.next_batch
+	`, userID, nextBatchToken)
+	if err != nil {
+		store.Log.Warnfln("Failed to store next batch token of %s: %v", userID, err)
+	}
+}
+
+func (store *SQLStateStore) LoadNextBatch(userID id.UserID) string {
+	var nextBatch sql.NullString
+	err := store.DB.QueryRow("SELECT next_batch FROM mx_client_sync WHERE user_id=$1", userID).Scan(&nextBatch)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warnfln("Failed to scan next batch token of %s: %v", userID, err)
+	}
+	return nextBatch.String
+}
+
+// SaveRoom replaces all stored state events of the room with the state in the given room.
+func (store *SQLStateStore) SaveRoom(room *mautrix.Room) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		store.Log.Warnfln("Failed to begin transaction to save %s: %v", room.ID, err)
+		return
+	}
+	_, err = tx.Exec("DELETE FROM mx_room_state_event WHERE room_id=$1", room.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		store.Log.Warnfln("Failed to delete old state of %s: %v", room.ID, err)
+		return
+	}
+	for _, stateKeys := range room.State {
+		for _, evt := range stateKeys {
+			if err = store.insertStateEvent(tx, room.ID, evt); err != nil {
+				_ = tx.Rollback()
+				store.Log.Warnfln("Failed to save state event %s in %s: %v", evt.ID, room.ID, err)
+				return
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		store.Log.Warnfln("Failed to commit state of %s: %v", room.ID, err)
+	}
+}
+
+func (store *SQLStateStore) insertStateEvent(tx *sql.Tx, roomID id.RoomID, evt *event.Event) error {
+	if evt.StateKey == nil {
+		return nil
+	}
+	eventBytes, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO mx_room_state_event (room_id, event_type, state_key, event) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, event_type, state_key) DO UPDATE SET event=excluded.event
+	`, roomID, evt.Type.Type, *evt.StateKey, string(eventBytes))
+	return err
+}
+
+// LoadRoom loads the stored state events of the room. If there's no stored state, nil is returned.
+func (store *SQLStateStore) LoadRoom(roomID id.RoomID) *mautrix.Room {
+	rows, err := store.DB.Query("SELECT event FROM mx_room_state_event WHERE room_id=$1", roomID)
+	if err != nil {
+		store.Log.Warnfln("Failed to query state of %s: %v", roomID, err)
+		return nil
+	}
+	defer rows.Close()
+	var room *mautrix.Room
+	for rows.Next() {
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			store.Log.Warnfln("Failed to scan state event in %s: %v", roomID, err)
+			continue
+		}
+		var evt event.Event
+		err = json.Unmarshal([]byte(data), &evt)
+		if err != nil {
+			store.Log.Warnfln("Failed to parse state event in %s: %v", roomID, err)
+			continue
+		}
+		evt.Type.Class = event.StateEventType
+		if room == nil {
+			room = mautrix.NewRoom(roomID)
+		}
+		room.UpdateState(&evt)
+	}
+	return room
+}
+
+func (store *SQLStateStore) SaveRoomAccountData(roomID id.RoomID, evt *event.Event) {
+	eventBytes, err := json.Marshal(evt)
+	if err != nil {
+		store.Log.Warnfln("Failed to marshal %s account data of %s: %v", evt.Type.Type, roomID, err)
+		return
+	}
+	_, err = store.DB.Exec(`
+		INSERT INTO mx_room_account_data (room_id, event_type, event) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, event_type) DO UPDATE SET event=excluded.event
+	`, roomID, evt.Type.Type, string(eventBytes))
+	if err != nil {
+		store.Log.Warnfln("Failed to store %s account data of %s: %v", evt.Type.Type, roomID, err)
+	}
+}
+
+func (store *SQLStateStore) LoadRoomAccountData(roomID id.RoomID, eventType event.Type) *event.Event {
+	var data string
+	err := store.DB.
+		QueryRow("SELECT event FROM mx_room_account_data WHERE room_id=$1 AND event_type=$2", roomID, eventType.Type).
+		Scan(&data)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			store.Log.Warnfln("Failed to scan %s account data of %s: %v", eventType.Type, roomID, err)
+		}
+		return nil
+	}
+	var evt event.Event
+	if err = json.Unmarshal([]byte(data), &evt); err != nil {
+		store.Log.Warnfln("Failed to parse %s account data of %s: %v", eventType.Type, roomID, err)
+		return nil
+	}
+	evt.Type.Class = event.AccountDataEventType
+	evt.RoomID = roomID
+	return &evt
+}
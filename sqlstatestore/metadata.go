@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstatestore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func (store *SQLStateStore) setRoomStateColumn(roomID id.RoomID, column, value string) {
+	_, err := store.DB.Exec(fmt.Sprintf(`
+		INSERT INTO mx_room_state (room_id, %[1]s) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET %[1]s=excluded.%[1]s
+	`, column), roomID, value)
+	if err != nil {
+		store.Log.Warnfln("Failed to store %s of %s: %v", column, roomID, err)
+	}
+}
+
+func (store *SQLStateStore) SetRoomName(roomID id.RoomID, name string) {
+	store.setRoomStateColumn(roomID, "name", name)
+}
+
+func (store *SQLStateStore) SetRoomTopic(roomID id.RoomID, topic string) {
+	store.setRoomStateColumn(roomID, "topic", topic)
+}
+
+func (store *SQLStateStore) SetRoomAvatar(roomID id.RoomID, avatarURL id.ContentURI) {
+	store.setRoomStateColumn(roomID, "avatar_url", avatarURL.String())
+}
+
+func (store *SQLStateStore) SetCanonicalAlias(roomID id.RoomID, alias id.RoomAlias) {
+	store.setRoomStateColumn(roomID, "canonical_alias", string(alias))
+}
+
+func (store *SQLStateStore) SetRoomType(roomID id.RoomID, roomType event.RoomType) {
+	store.setRoomStateColumn(roomID, "room_type", string(roomType))
+}
+
+// GetRoomMetadata returns the stored metadata of the room. If the room has no stored state, ok is false.
+func (store *SQLStateStore) GetRoomMetadata(roomID id.RoomID) (meta appservice.RoomMetadata, ok bool) {
+	var name, topic, avatarURL, canonicalAlias, roomType sql.NullString
+	err := store.DB.
+		QueryRow("SELECT name, topic, avatar_url, canonical_alias, room_type FROM mx_room_state WHERE room_id=$1", roomID).
+		Scan(&name, &topic, &avatarURL, &canonicalAlias, &roomType)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			store.Log.Warnfln("Failed to scan metadata of %s: %v", roomID, err)
+		}
+		return
+	}
+	meta.Name = name.String
+	meta.Topic = topic.String
+	meta.AvatarURL, _ = id.ParseContentURI(avatarURL.String)
+	meta.CanonicalAlias = id.RoomAlias(canonicalAlias.String)
+	meta.Type = event.RoomType(roomType.String)
+	return meta, true
+}
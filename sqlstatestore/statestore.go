@@ -0,0 +1,364 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sqlstatestore contains a StateStore and Storer implementation for SQLite and Postgres databases.
+package sqlstatestore
+
+import (
+	"database/sql"
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SQLStateStore is an implementation of the appservice StateStore that persists everything except typing
+// notifications in a database. It also implements the crypto StateStore interface and the mautrix Storer interface
+// used for persisting sync tokens and room state of clients.
+//
+// Power levels and encryption event contents are encoded with Codec, which is JSON by default. Memberships and
+// the numeric power levels are also stored in separate columns, so they can be queried directly.
+type SQLStateStore struct {
+	*appservice.TypingStateStore
+
+	DB      *sql.DB
+	Dialect string
+	Log     mautrix.WarnLogger
+	Codec   appservice.StateCodec
+}
+
+var _ appservice.StateStore = (*SQLStateStore)(nil)
+
+// NewSQLStateStore creates a new SQL state store. The dialect must be either sqlite3 or postgres.
+//
+// CreateTables must be called before using the store.
+func NewSQLStateStore(db *sql.DB, dialect string, log mautrix.WarnLogger) *SQLStateStore {
+	return &SQLStateStore{
+		TypingStateStore: appservice.NewTypingStateStore(),
+
+		DB:      db,
+		Dialect: dialect,
+		Log:     log,
+		Codec:   appservice.JSONCodec,
+	}
+}
+
+// CreateTables applies all the pending database migrations.
+func (store *SQLStateStore) CreateTables() error {
+	return Upgrade(store.DB, store.Dialect)
+}
+
+func (store *SQLStateStore) IsRegistered(userID id.UserID) bool {
+	var isRegistered bool
+	err := store.DB.
+		QueryRow("SELECT EXISTS(SELECT 1 FROM mx_registrations WHERE user_id=$1)", userID).
+		Scan(&isRegistered)
+	if err != nil {
+		store.Log.Warnfln("Failed to scan registration existence for %s: %v", userID, err)
+	}
+	return isRegistered
+}
+
+func (store *SQLStateStore) MarkRegistered(userID id.UserID) {
+	_, err := store.DB.Exec("INSERT INTO mx_registrations (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", userID)
+	if err != nil {
+		store.Log.Warnfln("Failed to mark %s as registered: %v", userID, err)
+	}
+}
+
+func (store *SQLStateStore) GetRoomMembers(roomID id.RoomID) map[id.UserID]*event.MemberEventContent {
+	members := make(map[id.UserID]*event.MemberEventContent)
+	rows, err := store.DB.Query("SELECT user_id, membership, displayname, avatar_url FROM mx_user_profile WHERE room_id=$1", roomID)
+	if err != nil {
+		store.Log.Warnfln("Failed to query members of %s: %v", roomID, err)
+		return members
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID id.UserID
+		var member event.MemberEventContent
+		err = rows.Scan(&userID, &member.Membership, &member.Displayname, &member.AvatarURL)
+		if err != nil {
+			store.Log.Warnfln("Failed to scan member in %s: %v", roomID, err)
+		} else {
+			members[userID] = &member
+		}
+	}
+	return members
+}
+
+func (store *SQLStateStore) GetMembership(roomID id.RoomID, userID id.UserID) event.Membership {
+	return store.GetMember(roomID, userID).Membership
+}
+
+func (store *SQLStateStore) GetMember(roomID id.RoomID, userID id.UserID) *event.MemberEventContent {
+	member, ok := store.TryGetMember(roomID, userID)
+	if !ok {
+		member = &event.MemberEventContent{Membership: event.MembershipLeave}
+	}
+	return member
+}
+
+func (store *SQLStateStore) TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool) {
+	var member event.MemberEventContent
+	err := store.DB.
+		QueryRow("SELECT membership, displayname, avatar_url FROM mx_user_profile WHERE room_id=$1 AND user_id=$2", roomID, userID).
+		Scan(&member.Membership, &member.Displayname, &member.AvatarURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false
+	} else if err != nil {
+		store.Log.Warnfln("Failed to scan member info of %s in %s: %v", userID, roomID, err)
+		return nil, false
+	}
+	return &member, true
+}
+
+func (store *SQLStateStore) IsInRoom(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin)
+}
+
+func (store *SQLStateStore) IsInvited(roomID id.RoomID, userID id.UserID) bool {
+	return store.IsMembership(roomID, userID, event.MembershipJoin, event.MembershipInvite)
+}
+
+func (store *SQLStateStore) IsMembership(roomID id.RoomID, userID id.UserID, allowedMemberships ...event.Membership) bool {
+	membership := store.GetMembership(roomID, userID)
+	for _, allowedMembership := range allowedMemberships {
+		if allowedMembership == membership {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *SQLStateStore) SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership) {
+	_, err := store.DB.Exec(`
+		INSERT INTO mx_user_profile (room_id, user_id, membership) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET membership=excluded.membership
+	`, roomID, userID, membership)
+	if err != nil {
+		store.Log.Warnfln("Failed to set membership of %s in %s to %s: %v", userID, roomID, membership, err)
+	}
+}
+
+func (store *SQLStateStore) SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent) {
+	_, err := store.DB.Exec(upsertMemberQuery, roomID, userID, member.Membership, member.Displayname, member.AvatarURL)
+	if err != nil {
+		store.Log.Warnfln("Failed to set member info of %s in %s: %v", userID, roomID, err)
+	}
+}
+
+func (store *SQLStateStore) setPowerLevels(tx *sql.Tx, roomID id.RoomID, levels *event.PowerLevelsEventContent) error {
+	levelsBytes, err := store.marshalNullable(levels, levels == nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO mx_room_state (room_id, power_levels) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET power_levels=excluded.power_levels
+	`, roomID, levelsBytes)
+	if err != nil {
+		return err
+	}
+	return updatePowerLevelColumns(tx, roomID, levels)
+}
+
+// SetPowerLevels stores the power levels of a room along with the parsed power level columns in a single transaction.
+func (store *SQLStateStore) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		store.Log.Warnfln("Failed to begin transaction to store power levels of %s: %v", roomID, err)
+		return
+	}
+	if err = store.setPowerLevels(tx, roomID, levels); err != nil {
+		_ = tx.Rollback()
+		store.Log.Warnfln("Failed to store power levels of %s: %v", roomID, err)
+	} else if err = tx.Commit(); err != nil {
+		store.Log.Warnfln("Failed to commit power levels of %s: %v", roomID, err)
+	}
+}
+
+func (store *SQLStateStore) GetPowerLevels(roomID id.RoomID) (levels *event.PowerLevelsEventContent) {
+	var data []byte
+	err := store.DB.QueryRow("SELECT power_levels FROM mx_room_state WHERE room_id=$1", roomID).Scan(&data)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			store.Log.Warnfln("Failed to scan power levels of %s: %v", roomID, err)
+		}
+		return
+	} else if data == nil {
+		return
+	}
+	levels = &event.PowerLevelsEventContent{}
+	err = store.Codec.Unmarshal(data, levels)
+	if err != nil {
+		store.Log.Warnfln("Failed to parse power levels of %s: %v", roomID, err)
+		return nil
+	}
+	return
+}
+
+// GetPowerLevel returns the power level of the user in the room using the parsed power level columns,
+// without decoding the full power levels.
+func (store *SQLStateStore) GetPowerLevel(roomID id.RoomID, userID id.UserID) int {
+	var level sql.NullInt64
+	err := store.DB.QueryRow(`
+		SELECT COALESCE(
+			(SELECT power_level FROM mx_user_power_level WHERE room_id=$1 AND user_id=$2),
+			users_default
+		) FROM mx_room_state WHERE room_id=$1
+	`, roomID, userID).Scan(&level)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warnfln("Failed to scan power level of %s in %s: %v", userID, roomID, err)
+	}
+	return int(level.Int64)
+}
+
+func (store *SQLStateStore) GetPowerLevelRequirement(roomID id.RoomID, eventType event.Type) int {
+	levels := store.GetPowerLevels(roomID)
+	if levels == nil {
+		return (&event.PowerLevelsEventContent{}).GetEventLevel(eventType)
+	}
+	return levels.GetEventLevel(eventType)
+}
+
+func (store *SQLStateStore) HasPowerLevel(roomID id.RoomID, userID id.UserID, eventType event.Type) bool {
+	return store.GetPowerLevel(roomID, userID) >= store.GetPowerLevelRequirement(roomID, eventType)
+}
+
+// SetEncryptionEvent stores the m.room.encryption event content of a room.
+func (store *SQLStateStore) SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent) {
+	contentBytes, err := store.marshalNullable(content, content == nil)
+	if err != nil {
+		store.Log.Warnfln("Failed to marshal encryption event of %s: %v", roomID, err)
+		return
+	}
+	_, err = store.DB.Exec(`
+		INSERT INTO mx_room_state (room_id, encryption) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET encryption=excluded.encryption
+	`, roomID, contentBytes)
+	if err != nil {
+		store.Log.Warnfln("Failed to store encryption event of %s: %v", roomID, err)
+	}
+}
+
+// GetEncryptionEvent returns the m.room.encryption event content of a room, or nil if the room isn't encrypted.
+func (store *SQLStateStore) GetEncryptionEvent(roomID id.RoomID) *event.EncryptionEventContent {
+	var data []byte
+	err := store.DB.QueryRow("SELECT encryption FROM mx_room_state WHERE room_id=$1", roomID).Scan(&data)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			store.Log.Warnfln("Failed to scan encryption event of %s: %v", roomID, err)
+		}
+		return nil
+	} else if data == nil {
+		return nil
+	}
+	var content event.EncryptionEventContent
+	err = store.Codec.Unmarshal(data, &content)
+	if err != nil {
+		store.Log.Warnfln("Failed to parse encryption event of %s: %v", roomID, err)
+		return nil
+	}
+	return &content
+}
+
+// IsEncrypted returns whether the room has encryption enabled.
+func (store *SQLStateStore) IsEncrypted(roomID id.RoomID) bool {
+	return store.GetEncryptionEvent(roomID) != nil
+}
+
+// FindSharedRooms returns the encrypted rooms where the given user is joined or invited.
+func (store *SQLStateStore) FindSharedRooms(userID id.UserID) (rooms []id.RoomID) {
+	rows, err := store.DB.Query(`
+		SELECT mx_user_profile.room_id FROM mx_user_profile
+		LEFT JOIN mx_room_state ON mx_room_state.room_id=mx_user_profile.room_id
+		WHERE mx_user_profile.user_id=$1 AND mx_user_profile.membership IN ('join', 'invite') AND mx_room_state.encryption IS NOT NULL
+	`, userID)
+	if err != nil {
+		store.Log.Warnfln("Failed to query shared rooms with %s: %v", userID, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID id.RoomID
+		err = rows.Scan(&roomID)
+		if err != nil {
+			store.Log.Warnfln("Failed to scan shared room ID with %s: %v", userID, err)
+		} else {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return
+}
+
+func (store *SQLStateStore) GetDisplayName(userID id.UserID) (string, bool) {
+	var displayName sql.NullString
+	err := store.DB.QueryRow("SELECT displayname FROM mx_global_profile WHERE user_id=$1", userID).Scan(&displayName)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warnfln("Failed to scan displayname of %s: %v", userID, err)
+	}
+	return displayName.String, displayName.Valid
+}
+
+func (store *SQLStateStore) SetDisplayName(userID id.UserID, displayName string) {
+	_, err := store.DB.Exec(`
+		INSERT INTO mx_global_profile (user_id, displayname) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET displayname=excluded.displayname
+	`, userID, displayName)
+	if err != nil {
+		store.Log.Warnfln("Failed to store displayname of %s: %v", userID, err)
+	}
+}
+
+func (store *SQLStateStore) GetAvatarURL(userID id.UserID) (id.ContentURI, bool) {
+	var avatarURL sql.NullString
+	err := store.DB.QueryRow("SELECT avatar_url FROM mx_global_profile WHERE user_id=$1", userID).Scan(&avatarURL)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warnfln("Failed to scan avatar URL of %s: %v", userID, err)
+	}
+	if !avatarURL.Valid {
+		return id.ContentURI{}, false
+	}
+	parsed, err := id.ParseContentURI(avatarURL.String)
+	if err != nil && len(avatarURL.String) > 0 {
+		store.Log.Warnfln("Failed to parse stored avatar URL of %s: %v", userID, err)
+		return id.ContentURI{}, false
+	}
+	return parsed, true
+}
+
+func (store *SQLStateStore) SetAvatarURL(userID id.UserID, avatarURL id.ContentURI) {
+	_, err := store.DB.Exec(`
+		INSERT INTO mx_global_profile (user_id, avatar_url) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET avatar_url=excluded.avatar_url
+	`, userID, avatarURL.String())
+	if err != nil {
+		store.Log.Warnfln("Failed to store avatar URL of %s: %v", userID, err)
+	}
+}
+
+// CountEntries returns the number of registrations, rooms, members, encrypted rooms and global profiles in the database.
+func (store *SQLStateStore) CountEntries() map[string]int {
+	counts := make(map[string]int, 5)
+	for name, query := range map[string]string{
+		"registrations":   "SELECT COUNT(*) FROM mx_registrations",
+		"rooms":           "SELECT COUNT(*) FROM mx_room_state",
+		"members":         "SELECT COUNT(*) FROM mx_user_profile",
+		"encrypted_rooms": "SELECT COUNT(*) FROM mx_room_state WHERE encryption IS NOT NULL",
+		"profiles":        "SELECT COUNT(*) FROM mx_global_profile",
+	} {
+		var count int
+		if err := store.DB.QueryRow(query).Scan(&count); err != nil {
+			store.Log.Warnfln("Failed to count %s: %v", name, err)
+		} else {
+			counts[name] = count
+		}
+	}
+	return counts
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstatestore_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/statestoretest"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqlstatestore"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (log testLogger) Debugfln(message string, args ...interface{}) {
+	log.t.Logf(message, args...)
+}
+
+func (log testLogger) Warnfln(message string, args ...interface{}) {
+	log.t.Errorf(message, args...)
+}
+
+func newTestStore(t *testing.T) *sqlstatestore.SQLStateStore {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	store := sqlstatestore.NewSQLStateStore(db, "sqlite3", testLogger{t})
+	require.NoError(t, store.CreateTables())
+	return store
+}
+
+func TestUpgrade(t *testing.T) {
+	store := newTestStore(t)
+	version, err := sqlstatestore.GetVersion(store.DB)
+	require.NoError(t, err)
+	assert.Equal(t, len(sqlstatestore.Upgrades), version)
+	// Upgrading an up-to-date database is a no-op.
+	assert.NoError(t, store.CreateTables())
+	assert.ErrorIs(t, sqlstatestore.Upgrade(store.DB, "mysql"), sqlstatestore.ErrUnknownDialect)
+}
+
+func TestUpgrade_BackfillPowerLevels(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	_, err = sqlstatestore.GetVersion(db)
+	require.NoError(t, err)
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	for _, upgrade := range sqlstatestore.Upgrades[:4] {
+		require.NoError(t, upgrade(tx, "sqlite3"))
+	}
+	require.NoError(t, sqlstatestore.SetVersion(tx, 4))
+	_, err = tx.Exec(`INSERT INTO mx_room_state (room_id, power_levels) VALUES ('!room:example.com', '{"users":{"@admin:example.com":100},"users_default":10}')`)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	store := sqlstatestore.NewSQLStateStore(db, "sqlite3", testLogger{t})
+	require.NoError(t, store.CreateTables())
+	assert.Equal(t, 100, store.GetPowerLevel("!room:example.com", "@admin:example.com"))
+	assert.Equal(t, 10, store.GetPowerLevel("!room:example.com", "@user:example.com"))
+	assert.Equal(t, 100, store.GetPowerLevels("!room:example.com").GetUserLevel("@admin:example.com"))
+}
+
+func TestSQLStateStore_Members(t *testing.T) {
+	store := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+
+	assert.False(t, store.IsRegistered(userID))
+	store.MarkRegistered(userID)
+	store.MarkRegistered(userID)
+	assert.True(t, store.IsRegistered(userID))
+
+	assert.Equal(t, event.MembershipLeave, store.GetMembership(roomID, userID))
+	store.SetMember(roomID, userID, &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "User"})
+	assert.True(t, store.IsInRoom(roomID, userID))
+	assert.Equal(t, "User", store.GetMember(roomID, userID).Displayname)
+	store.SetMembership(roomID, userID, event.MembershipInvite)
+	assert.False(t, store.IsInRoom(roomID, userID))
+	assert.True(t, store.IsInvited(roomID, userID))
+	assert.Equal(t, "User", store.GetMember(roomID, userID).Displayname)
+	assert.Len(t, store.GetRoomMembers(roomID), 1)
+
+	assert.Nil(t, store.GetPowerLevels(roomID))
+	store.SetPowerLevels(roomID, &event.PowerLevelsEventContent{Users: map[id.UserID]int{userID: 100}})
+	assert.Equal(t, 100, store.GetPowerLevel(roomID, userID))
+	assert.True(t, store.HasPowerLevel(roomID, userID, event.StateRoomName))
+
+	_, ok := store.GetDisplayName(userID)
+	assert.False(t, ok)
+	store.SetDisplayName(userID, "Global")
+	displayName, ok := store.GetDisplayName(userID)
+	assert.True(t, ok)
+	assert.Equal(t, "Global", displayName)
+}
+
+func TestSQLStateStore_Storer(t *testing.T) {
+	store := newTestStore(t)
+	const userID = id.UserID("@bot:example.com")
+	const roomID = id.RoomID("!room:example.com")
+
+	store.SaveFilterID(userID, "filter")
+	store.SaveNextBatch(userID, "s1")
+	store.SaveNextBatch(userID, "s2")
+	assert.Equal(t, "filter", store.LoadFilterID(userID))
+	assert.Equal(t, "s2", store.LoadNextBatch(userID))
+	assert.Empty(t, store.LoadNextBatch("@other:example.com"))
+
+	assert.Nil(t, store.LoadRoom(roomID))
+	room := mautrix.NewRoom(roomID)
+	stateKey := string(userID)
+	room.UpdateState(&event.Event{
+		Type:     event.StateMember,
+		StateKey: &stateKey,
+		RoomID:   roomID,
+		ID:       "$member",
+		Content:  event.Content{Raw: map[string]interface{}{"membership": "join"}},
+	})
+	store.SaveRoom(room)
+	loaded := store.LoadRoom(roomID)
+	require.NotNil(t, loaded)
+	assert.Equal(t, event.MembershipJoin, loaded.GetMembershipState(userID))
+	assert.Equal(t, id.EventID("$member"), loaded.GetStateEvent(event.StateMember, stateKey).ID)
+}
+
+func TestSQLStateStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+	open := func() *sqlstatestore.SQLStateStore {
+		db, err := sql.Open("sqlite3", path)
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { _ = db.Close() })
+		store := sqlstatestore.NewSQLStateStore(db, "sqlite3", testLogger{t})
+		require.NoError(t, store.CreateTables())
+		return store
+	}
+
+	store := open()
+	store.MarkRegistered(userID)
+	store.SetMembership(roomID, userID, event.MembershipJoin)
+	store.SetPowerLevels(roomID, &event.PowerLevelsEventContent{Users: map[id.UserID]int{userID: 50}})
+	store.SetEncryptionEvent(roomID, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+	require.NoError(t, store.DB.Close())
+
+	// A new store on the same database must see everything the previous one wrote.
+	store = open()
+	assert.True(t, store.IsRegistered(userID))
+	assert.True(t, store.IsInRoom(roomID, userID))
+	assert.Equal(t, 50, store.GetPowerLevel(roomID, userID))
+	assert.True(t, store.IsEncrypted(roomID))
+}
+
+func TestSQLStateStore_Encryption(t *testing.T) {
+	store := newTestStore(t)
+	const encryptedRoom = id.RoomID("!encrypted:example.com")
+	const plainRoom = id.RoomID("!plain:example.com")
+	const userID = id.UserID("@user:example.com")
+
+	assert.False(t, store.IsEncrypted(encryptedRoom))
+	assert.Nil(t, store.GetEncryptionEvent(encryptedRoom))
+	store.SetEncryptionEvent(encryptedRoom, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1, RotationPeriodMessages: 100})
+	assert.True(t, store.IsEncrypted(encryptedRoom))
+	assert.Equal(t, 100, store.GetEncryptionEvent(encryptedRoom).RotationPeriodMessages)
+
+	store.SetMembership(encryptedRoom, userID, event.MembershipJoin)
+	store.SetMembership(plainRoom, userID, event.MembershipJoin)
+	assert.Equal(t, []id.RoomID{encryptedRoom}, store.FindSharedRooms(userID))
+	store.SetMembership(encryptedRoom, userID, event.MembershipLeave)
+	assert.Empty(t, store.FindSharedRooms(userID))
+}
+
+func TestSQLStateStore_Typing(t *testing.T) {
+	store := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+
+	assert.False(t, store.IsTyping(roomID, userID))
+	store.SetTyping(roomID, userID, 30)
+	assert.True(t, store.IsTyping(roomID, userID))
+	store.SetTyping(roomID, userID, -1)
+	assert.False(t, store.IsTyping(roomID, userID))
+}
+
+func TestSQLStateStore_RoomMetadata(t *testing.T) {
+	store := newTestStore(t)
+	const roomID = id.RoomID("!space:example.com")
+
+	_, ok := store.GetRoomMetadata(roomID)
+	assert.False(t, ok)
+	store.SetRoomName(roomID, "Space")
+	store.SetRoomTopic(roomID, "Topic")
+	store.SetRoomAvatar(roomID, id.MustParseContentURI("mxc://example.com/avatar"))
+	store.SetCanonicalAlias(roomID, "#space:example.com")
+	store.SetRoomType(roomID, event.RoomTypeSpace)
+	store.SetRoomName(roomID, "Renamed space")
+
+	meta, ok := store.GetRoomMetadata(roomID)
+	require.True(t, ok)
+	assert.Equal(t, "Renamed space", meta.Name)
+	assert.Equal(t, "Topic", meta.Topic)
+	assert.Equal(t, "mxc://example.com/avatar", meta.AvatarURL.String())
+	assert.Equal(t, id.RoomAlias("#space:example.com"), meta.CanonicalAlias)
+	assert.True(t, meta.IsSpace())
+}
+
+func TestSQLStateStore_Bulk(t *testing.T) {
+	store := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+	const oldMember = id.UserID("@old:example.com")
+	const newMember = id.UserID("@new:example.com")
+
+	store.SetMembers(roomID, map[id.UserID]*event.MemberEventContent{
+		oldMember: {Membership: event.MembershipJoin},
+		newMember: {Membership: event.MembershipInvite},
+	})
+	assert.True(t, store.IsInRoom(roomID, oldMember))
+	assert.True(t, store.IsInvited(roomID, newMember))
+
+	store.ReplaceRoomState(roomID, []*event.Event{
+		statestoretest.StateEvent(event.StateMember, newMember.String(), &event.MemberEventContent{Membership: event.MembershipJoin}),
+		statestoretest.StateEvent(event.StatePowerLevels, "", &event.PowerLevelsEventContent{Users: map[id.UserID]int{newMember: 100}}),
+		statestoretest.StateEvent(event.StateEncryption, "", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}),
+		statestoretest.StateEvent(event.StateRoomName, "", &event.RoomNameEventContent{Name: "Room"}),
+	})
+	assert.False(t, store.IsInRoom(roomID, oldMember))
+	assert.True(t, store.IsInRoom(roomID, newMember))
+	assert.Equal(t, 100, store.GetPowerLevel(roomID, newMember))
+	assert.True(t, store.IsEncrypted(roomID))
+	meta, ok := store.GetRoomMetadata(roomID)
+	require.True(t, ok)
+	assert.Equal(t, "Room", meta.Name)
+}
+
+func TestSQLStateStore_RoomAccountData(t *testing.T) {
+	store := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+
+	assert.Nil(t, store.LoadRoomAccountData(roomID, event.AccountDataRoomTags))
+	assert.Nil(t, mautrix.LoadRoomTags(store, roomID))
+	store.SaveRoomAccountData(roomID, &event.Event{
+		Type:    event.AccountDataRoomTags,
+		Content: event.Content{Raw: map[string]interface{}{"tags": map[string]interface{}{"m.favourite": map[string]interface{}{"order": 0.5}}}},
+	})
+	store.SaveRoomAccountData(roomID, &event.Event{
+		Type:    event.AccountDataFullyRead,
+		Content: event.Content{Parsed: &event.FullyReadEventContent{EventID: "$event"}},
+	})
+
+	tags := mautrix.LoadRoomTags(store, roomID)
+	require.Contains(t, tags, "m.favourite")
+	assert.Equal(t, "0.5", tags["m.favourite"].Order.String())
+	assert.Equal(t, id.EventID("$event"), mautrix.LoadFullyRead(store, roomID))
+}
+
+func TestSQLStateStore_Codecs(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	const userID = id.UserID("@user:example.com")
+	for _, codec := range []appservice.StateCodec{appservice.JSONCodec, appservice.GobCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			store := newTestStore(t)
+			store.Codec = codec
+			levels := &event.PowerLevelsEventContent{Users: map[id.UserID]int{userID: 50}, EventsDefault: 10}
+			store.SetPowerLevels(roomID, levels)
+			store.SetEncryptionEvent(roomID, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1, RotationPeriodMessages: 100})
+
+			loaded := store.GetPowerLevels(roomID)
+			require.NotNil(t, loaded)
+			assert.Equal(t, levels.Users, loaded.Users)
+			assert.Equal(t, 10, loaded.EventsDefault)
+			encryption := store.GetEncryptionEvent(roomID)
+			require.NotNil(t, encryption)
+			assert.Equal(t, 100, encryption.RotationPeriodMessages)
+		})
+	}
+}
+
+func TestSQLStateStore_PowerLevelColumns(t *testing.T) {
+	store := newTestStore(t)
+	const roomID = id.RoomID("!room:example.com")
+	const admin = id.UserID("@admin:example.com")
+	const user = id.UserID("@user:example.com")
+
+	assert.Equal(t, 0, store.GetPowerLevel(roomID, user))
+	store.SetPowerLevels(roomID, &event.PowerLevelsEventContent{Users: map[id.UserID]int{admin: 100}, UsersDefault: 5})
+	assert.Equal(t, 100, store.GetPowerLevel(roomID, admin))
+	assert.Equal(t, 5, store.GetPowerLevel(roomID, user))
+
+	var adminCount int
+	err := store.DB.QueryRow("SELECT COUNT(*) FROM mx_user_power_level WHERE room_id=$1 AND power_level>=100", roomID).Scan(&adminCount)
+	require.NoError(t, err)
+	assert.Equal(t, 1, adminCount)
+
+	store.SetPowerLevels(roomID, &event.PowerLevelsEventContent{Users: map[id.UserID]int{user: 50}})
+	assert.Equal(t, 0, store.GetPowerLevel(roomID, admin))
+	assert.Equal(t, 50, store.GetPowerLevel(roomID, user))
+}
+
+func TestSQLStateStore_CountEntries(t *testing.T) {
+	store := newTestStore(t)
+	store.MarkRegistered("@bot:example.com")
+	store.SetMember("!a:example.com", "@user:example.com", &event.MemberEventContent{Membership: event.MembershipJoin})
+	store.SetMember("!a:example.com", "@bot:example.com", &event.MemberEventContent{Membership: event.MembershipJoin})
+	store.SetEncryptionEvent("!a:example.com", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+	store.SetPowerLevels("!b:example.com", &event.PowerLevelsEventContent{})
+
+	var counter appservice.StateStoreEntryCounter = store
+	assert.Equal(t, map[string]int{
+		"registrations":   1,
+		"rooms":           2,
+		"members":         2,
+		"encrypted_rooms": 1,
+		"profiles":        0,
+	}, counter.CountEntries())
+}
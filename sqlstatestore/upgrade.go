@@ -0,0 +1,213 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstatestore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type upgradeFunc func(*sql.Tx, string) error
+
+var ErrUnknownDialect = errors.New("unknown dialect")
+
+// Upgrades contains the database migrations of the state store. The index of the function is the schema version
+// that it upgrades from.
+var Upgrades = [...]upgradeFunc{
+	func(tx *sql.Tx, _ string) error {
+		for _, query := range []string{
+			`CREATE TABLE IF NOT EXISTS mx_registrations (
+				user_id TEXT PRIMARY KEY
+			)`,
+			`CREATE TABLE IF NOT EXISTS mx_user_profile (
+				room_id     TEXT,
+				user_id     TEXT,
+				membership  TEXT NOT NULL,
+				displayname TEXT NOT NULL DEFAULT '',
+				avatar_url  TEXT NOT NULL DEFAULT '',
+				PRIMARY KEY (room_id, user_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS mx_room_state (
+				room_id      TEXT PRIMARY KEY,
+				power_levels TEXT,
+				encryption   TEXT
+			)`,
+			`CREATE TABLE IF NOT EXISTS mx_global_profile (
+				user_id     TEXT PRIMARY KEY,
+				displayname TEXT,
+				avatar_url  TEXT
+			)`,
+		} {
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	func(tx *sql.Tx, _ string) error {
+		for _, query := range []string{
+			`CREATE TABLE IF NOT EXISTS mx_client_sync (
+				user_id    TEXT PRIMARY KEY,
+				filter_id  TEXT,
+				next_batch TEXT
+			)`,
+			`CREATE TABLE IF NOT EXISTS mx_room_state_event (
+				room_id    TEXT,
+				event_type TEXT,
+				state_key  TEXT,
+				event      TEXT NOT NULL,
+				PRIMARY KEY (room_id, event_type, state_key)
+			)`,
+		} {
+			if _, err := tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	func(tx *sql.Tx, _ string) error {
+		for _, column := range []string{"name", "topic", "avatar_url", "canonical_alias", "room_type"} {
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE mx_room_state ADD COLUMN %s TEXT", column)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	func(tx *sql.Tx, _ string) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS mx_room_account_data (
+			room_id    TEXT,
+			event_type TEXT,
+			event      TEXT NOT NULL,
+			PRIMARY KEY (room_id, event_type)
+		)`)
+		return err
+	},
+	func(tx *sql.Tx, dialect string) error {
+		if dialect == "postgres" {
+			for _, column := range []string{"power_levels", "encryption"} {
+				_, err := tx.Exec(fmt.Sprintf("ALTER TABLE mx_room_state ALTER COLUMN %[1]s TYPE bytea USING convert_to(%[1]s, 'UTF8')", column))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, column := range []string{"users_default", "events_default", "state_default"} {
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE mx_room_state ADD COLUMN %s INTEGER", column)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS mx_user_power_level (
+			room_id     TEXT,
+			user_id     TEXT,
+			power_level INTEGER NOT NULL,
+			PRIMARY KEY (room_id, user_id)
+		)`)
+		if err != nil {
+			return err
+		}
+		return backfillPowerLevelColumns(tx)
+	},
+}
+
+// backfillPowerLevelColumns fills the parsed power level columns from the power levels stored before they existed,
+// which were always stored as JSON.
+func backfillPowerLevelColumns(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT room_id, power_levels FROM mx_room_state WHERE power_levels IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	allLevels := make(map[id.RoomID]*event.PowerLevelsEventContent)
+	for rows.Next() {
+		var roomID id.RoomID
+		var data []byte
+		if err = rows.Scan(&roomID, &data); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		var levels event.PowerLevelsEventContent
+		if err = json.Unmarshal(data, &levels); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to parse power levels of %s: %w", roomID, err)
+		}
+		allLevels[roomID] = &levels
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+	for roomID, levels := range allLevels {
+		if err = updatePowerLevelColumns(tx, roomID, levels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetVersion returns the current version of the DB schema.
+func GetVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS mx_version (version INTEGER)")
+	if err != nil {
+		return -1, err
+	}
+
+	version := 0
+	row := db.QueryRow("SELECT version FROM mx_version LIMIT 1")
+	if row != nil {
+		_ = row.Scan(&version)
+	}
+	return version, nil
+}
+
+// SetVersion sets the schema version in a running DB transaction.
+func SetVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec("DELETE FROM mx_version")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO mx_version (version) VALUES ($1)", version)
+	return err
+}
+
+// Upgrade upgrades the database from the current to the latest version available.
+func Upgrade(db *sql.DB, dialect string) error {
+	if dialect != "sqlite3" && dialect != "postgres" {
+		return ErrUnknownDialect
+	}
+	version, err := GetVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(Upgrades); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		migrateFunc := Upgrades[version]
+		err = migrateFunc(tx, dialect)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err = SetVersion(tx, version+1); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
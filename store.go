@@ -17,6 +17,8 @@ type Storer interface {
 	LoadNextBatch(userID id.UserID) string
 	SaveRoom(room *Room)
 	LoadRoom(roomID id.RoomID) *Room
+	SaveRoomAccountData(roomID id.RoomID, evt *event.Event)
+	LoadRoomAccountData(roomID id.RoomID, eventType event.Type) *event.Event
 }
 
 // InMemoryStore implements the Storer interface.
@@ -25,9 +27,10 @@ type Storer interface {
 // or next batch tokens on any goroutine other than the syncing goroutine: the one
 // which called Client.Sync().
 type InMemoryStore struct {
-	Filters   map[id.UserID]string
-	NextBatch map[id.UserID]string
-	Rooms     map[id.RoomID]*Room
+	Filters         map[id.UserID]string
+	NextBatch       map[id.UserID]string
+	Rooms           map[id.RoomID]*Room
+	RoomAccountData map[id.RoomID]map[string]*event.Event
 }
 
 // SaveFilterID to memory.
@@ -60,6 +63,21 @@ func (s *InMemoryStore) LoadRoom(roomID id.RoomID) *Room {
 	return s.Rooms[roomID]
 }
 
+// SaveRoomAccountData to memory.
+func (s *InMemoryStore) SaveRoomAccountData(roomID id.RoomID, evt *event.Event) {
+	roomData, ok := s.RoomAccountData[roomID]
+	if !ok {
+		roomData = make(map[string]*event.Event)
+		s.RoomAccountData[roomID] = roomData
+	}
+	roomData[evt.Type.Type] = evt
+}
+
+// LoadRoomAccountData from memory.
+func (s *InMemoryStore) LoadRoomAccountData(roomID id.RoomID, eventType event.Type) *event.Event {
+	return s.RoomAccountData[roomID][eventType.Type]
+}
+
 // UpdateState stores a state event. This can be passed to DefaultSyncer.OnEvent to keep all room state cached.
 func (s *InMemoryStore) UpdateState(_ EventSource, evt *event.Event) {
 	if !evt.Type.IsState() {
@@ -79,6 +97,8 @@ func NewInMemoryStore() *InMemoryStore {
 		Filters:   make(map[id.UserID]string),
 		NextBatch: make(map[id.UserID]string),
 		Rooms:     make(map[id.RoomID]*Room),
+
+		RoomAccountData: make(map[id.RoomID]map[string]*event.Event),
 	}
 }
 
@@ -160,3 +180,30 @@ func NewAccountDataStore(eventType string, client *Client) *AccountDataStore {
 		client:        client,
 	}
 }
+
+func loadParsedRoomAccountData(store Storer, roomID id.RoomID, eventType event.Type) *event.Event {
+	evt := store.LoadRoomAccountData(roomID, eventType)
+	if evt != nil && evt.Content.Parsed == nil {
+		eventType.Class = event.AccountDataEventType
+		_ = evt.Content.ParseRaw(eventType)
+	}
+	return evt
+}
+
+// LoadRoomTags returns the tags of the given room from the m.tag room account data in the store.
+func LoadRoomTags(store Storer, roomID id.RoomID) event.Tags {
+	evt := loadParsedRoomAccountData(store, roomID, event.AccountDataRoomTags)
+	if evt == nil {
+		return nil
+	}
+	return evt.Content.AsTag().Tags
+}
+
+// LoadFullyRead returns the fully read marker of the given room from the m.fully_read room account data in the store.
+func LoadFullyRead(store Storer, roomID id.RoomID) id.EventID {
+	evt := loadParsedRoomAccountData(store, roomID, event.AccountDataFullyRead)
+	if evt == nil {
+		return ""
+	}
+	return evt.Content.AsFullyRead().EventID
+}
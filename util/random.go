@@ -0,0 +1,69 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Common alphabets for RandomString.
+const (
+	AlphabetLowercase    = "abcdefghijklmnopqrstuvwxyz"
+	AlphabetUppercase    = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	AlphabetDigits       = "0123456789"
+	AlphabetAlphanumeric = AlphabetLowercase + AlphabetUppercase + AlphabetDigits
+	AlphabetHex          = AlphabetDigits + "abcdef"
+)
+
+// RandomBytes generates the given number of cryptographically secure random bytes.
+//
+// This panics if the system random number generator fails, as there's no reasonable way to recover from that.
+func RandomBytes(n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	if err != nil {
+		panic(fmt.Errorf("failed to read random bytes: %w", err))
+	}
+	return data
+}
+
+// RandomString generates a cryptographically secure random string of the given length
+// using characters from the given alphabet. Every character in the alphabet is equally likely.
+func RandomString(n int, alphabet string) string {
+	if len(alphabet) == 0 {
+		panic("RandomString called with empty alphabet")
+	}
+	max := big.NewInt(int64(len(alphabet)))
+	output := make([]byte, n)
+	for i := range output {
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(fmt.Errorf("failed to read random number: %w", err))
+		}
+		output[i] = alphabet[index.Int64()]
+	}
+	return string(output)
+}
+
+// RandomToken generates a random alphanumeric string of the given length, e.g. for access tokens.
+func RandomToken(n int) string {
+	return RandomString(n, AlphabetAlphanumeric)
+}
+
+// RandomTransactionID generates a random transaction ID, e.g. for sending events or starting verification.
+func RandomTransactionID() string {
+	return RandomString(32, AlphabetAlphanumeric)
+}
+
+// RandomDeviceID generates a random device ID in the same format as Synapse (10 uppercase letters).
+func RandomDeviceID() id.DeviceID {
+	return id.DeviceID(RandomString(10, AlphabetUppercase))
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2022 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package util_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/util"
+)
+
+func TestRandomString(t *testing.T) {
+	str := util.RandomString(64, util.AlphabetHex)
+	assert.Len(t, str, 64)
+	for _, char := range str {
+		assert.True(t, strings.ContainsRune(util.AlphabetHex, char))
+	}
+	assert.NotEqual(t, str, util.RandomString(64, util.AlphabetHex))
+	assert.Equal(t, "aaaa", util.RandomString(4, "a"))
+	assert.Panics(t, func() { util.RandomString(4, "") })
+}
+
+func TestRandomDeviceID(t *testing.T) {
+	deviceID := util.RandomDeviceID()
+	assert.Len(t, deviceID, 10)
+	assert.Equal(t, strings.ToUpper(string(deviceID)), string(deviceID))
+	assert.Len(t, util.RandomTransactionID(), 32)
+	assert.Len(t, util.RandomBytes(16), 16)
+}